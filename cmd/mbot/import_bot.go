@@ -2,7 +2,9 @@ package main
 
 // bot platforms
 import (
+	_ "arhat.dev/mbot/pkg/bot/console"
 	_ "arhat.dev/mbot/pkg/bot/discord"
+	_ "arhat.dev/mbot/pkg/bot/email"
 	_ "arhat.dev/mbot/pkg/bot/github"
 	_ "arhat.dev/mbot/pkg/bot/gitlab"
 	_ "arhat.dev/mbot/pkg/bot/gitter"
@@ -14,5 +16,6 @@ import (
 	_ "arhat.dev/mbot/pkg/bot/slack"
 	_ "arhat.dev/mbot/pkg/bot/telegram"
 	_ "arhat.dev/mbot/pkg/bot/vk"
+	_ "arhat.dev/mbot/pkg/bot/webhook"
 	_ "arhat.dev/mbot/pkg/bot/whatsapp"
 )
@@ -12,4 +12,5 @@ import (
 	_ "arhat.dev/mbot/pkg/generator/lua"
 	_ "arhat.dev/mbot/pkg/generator/multigen"
 	_ "arhat.dev/mbot/pkg/generator/tengo"
+	_ "arhat.dev/mbot/pkg/generator/wasm"
 )
@@ -0,0 +1,38 @@
+#!/bin/sh
+
+# lux.sh runs lux for the exec generator, the video url is the params of the
+# /download command, downloaded video is sent back as a session message
+#
+# requires jq
+
+set -e
+
+req="$(cat)"
+
+if [ "$(printf '%s' "${req}" | jq -r .call)" != "new" ]; then
+  exit 0
+fi
+
+url="$(printf '%s' "${req}" | jq -r .params)"
+dir="$(mktemp -d ./lux.XXXXXX)"
+
+# lux output is logged by the bot
+lux -o "${dir}" "${url}" >&2
+
+file="$(find "${dir}" -type f | head -n 1)"
+if [ -z "${file}" ]; then
+  echo "no video downloaded" >&2
+  exit 1
+fi
+
+jq -n --arg url "${url}" --arg file "${file}" '{
+  version: 1,
+  data: $url,
+  messages: [{
+    spans: [{
+      flags: ["video"],
+      file: $file,
+      caption: [{ flags: ["url"], text: $url, url: $url }]
+    }]
+  }]
+}'
@@ -15,6 +15,7 @@ require (
 	github.com/dop251/goja v0.0.0-20220714114325-87952593a54c
 	github.com/google/go-github/v45 v45.2.0
 	github.com/gotd/contrib v0.13.0
+	github.com/gotd/ige v0.2.2
 	github.com/gotd/td v0.61.0
 	github.com/h2non/filetype v1.1.3
 	github.com/line/line-bot-sdk-go/v7 v7.16.0
@@ -25,6 +26,7 @@ require (
 	github.com/slack-go/slack v0.11.0
 	github.com/spf13/cobra v1.5.0
 	github.com/stretchr/testify v1.8.0
+	github.com/tetratelabs/wazero v1.3.1
 	github.com/vartanbeno/go-reddit/v2 v2.0.0
 	github.com/xanzy/go-gitlab v0.69.0
 	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64
@@ -80,7 +82,6 @@ require (
 	github.com/googleapis/gax-go/v2 v2.1.1 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
-	github.com/gotd/ige v0.2.2 // indirect
 	github.com/gotd/neo v0.1.5 // indirect
 	github.com/graph-gophers/graphql-go v1.3.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
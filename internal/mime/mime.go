@@ -7,7 +7,7 @@ const (
 	MIMEType_Application = "application"
 	MIMEType_Image       = "image"
 	MIMEType_Video       = "video"
-	MIMEType_Audio       = "auido"
+	MIMEType_Audio       = "audio"
 	MIMEType_Text        = "text"
 
 	// composite types
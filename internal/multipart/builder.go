@@ -53,9 +53,13 @@ func (b *Builder) SetBoundary(boundary string) error {
 }
 
 func (b *Builder) Build() (formDataContentType string, r Reader) {
-	const (
-		PREFIX = "multipart/form-data; boundary="
-	)
+	return b.BuildAs("multipart/form-data")
+}
+
+// BuildAs is like Build, but uses mediaType (e.g. multipart/alternative) in
+// the returned content type
+func (b *Builder) BuildAs(mediaType string) (contentType string, r Reader) {
+	PREFIX := mediaType + "; boundary="
 
 	boundary := b.boundary
 	if len(boundary) == 0 {
@@ -65,12 +69,12 @@ func (b *Builder) Build() (formDataContentType string, r Reader) {
 	// We must quote the boundary if it contains any of the
 	// tspecials characters defined by RFC 2045, or space.
 	if strings.ContainsAny(boundary, `()<>@,;:\"/[]?= `) {
-		formDataContentType = PREFIX + `"` + boundary + `"`
+		contentType = PREFIX + `"` + boundary + `"`
 	} else {
-		formDataContentType = PREFIX + boundary
+		contentType = PREFIX + boundary
 	}
 
-	return formDataContentType, Reader{
+	return contentType, Reader{
 		offset:   -2,
 		boundary: boundary,
 		parts:    b.parts,
@@ -64,6 +64,14 @@ func TestBuilder(t *testing.T) {
 	assert.Equal(t, mw.FormDataContentType(), ct)
 }
 
+func TestBuilderBuildAs(t *testing.T) {
+	var b Builder
+
+	assert.NoError(t, b.SetBoundary("foo bar"))
+	ct, _ := b.BuildAs("multipart/alternative")
+	assert.Equal(t, `multipart/alternative; boundary="foo bar"`, ct)
+}
+
 func TestRandomBoundary(t *testing.T) {
 	b := RandomBoundary()
 	t.Log(b)
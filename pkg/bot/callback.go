@@ -0,0 +1,84 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"arhat.dev/pkg/queue"
+)
+
+const (
+	// DefaultCallbackTTL is how long OnClick callbacks of buttons are kept by default
+	DefaultCallbackTTL = 24 * time.Hour
+
+	// DefaultCallbackIDSize is the default number of random bytes in callback ids
+	DefaultCallbackIDSize = 16
+)
+
+// CallbackRegistry keeps OnClick callbacks of buttons for a while, keyed by random
+// ids, so that buttons sent before restart never trigger callbacks added after it
+type CallbackRegistry struct {
+	q      *queue.TimeoutQueue[string, func() error]
+	ttl    time.Duration
+	idSize int
+}
+
+// NewCallbackRegistry creates a CallbackRegistry expiring callbacks after ttl,
+// ids are hex encoded idSize random bytes
+//
+// ttl defaults to DefaultCallbackTTL and idSize defaults to DefaultCallbackIDSize
+// when not positive
+func NewCallbackRegistry(ctx context.Context, ttl time.Duration, idSize int) *CallbackRegistry {
+	if ttl <= 0 {
+		ttl = DefaultCallbackTTL
+	}
+
+	if idSize <= 0 {
+		idSize = DefaultCallbackIDSize
+	}
+
+	r := &CallbackRegistry{
+		q:      queue.NewTimeoutQueue[string, func() error](),
+		ttl:    ttl,
+		idSize: idSize,
+	}
+
+	r.q.Start(ctx.Done())
+	go func() {
+		// drop expired callbacks
+		for range r.q.TakeCh() {
+		}
+	}()
+
+	return r
+}
+
+// Add keeps fn for a while, it returns the id of the callback
+func (r *CallbackRegistry) Add(fn func() error) (string, error) {
+	buf := make([]byte, r.idSize)
+	for {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		id := hex.EncodeToString(buf)
+		if _, ok := r.q.Find(id); ok {
+			continue
+		}
+
+		err = r.q.OfferWithDelay(id, fn, r.ttl)
+		if err != nil {
+			return "", err
+		}
+
+		return id, nil
+	}
+}
+
+// Find returns the callback with the id if not expired
+func (r *CallbackRegistry) Find(id string) (func() error, bool) {
+	return r.q.Find(id)
+}
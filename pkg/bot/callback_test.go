@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackRegistry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewCallbackRegistry(ctx, time.Hour, 4)
+
+	called := 0
+	id1, err := r.Add(func() error { called++; return nil })
+	require.NoError(t, err)
+	assert.Len(t, id1, 8)
+
+	id2, err := r.Add(func() error { return nil })
+	require.NoError(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	fn, ok := r.Find(id1)
+	require.True(t, ok)
+	assert.NoError(t, fn())
+	assert.Equal(t, 1, called)
+
+	_, ok = r.Find("not-exists")
+	assert.False(t, ok)
+
+	t.Run("Restart", func(t *testing.T) {
+		r2 := NewCallbackRegistry(ctx, time.Hour, 0)
+		_, ok := r2.Find(id1)
+		assert.False(t, ok)
+
+		id, err := r2.Add(func() error { return nil })
+		require.NoError(t, err)
+		assert.Len(t, id, 2*DefaultCallbackIDSize)
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		r3 := NewCallbackRegistry(ctx, 10*time.Millisecond, 0)
+		id, err := r3.Add(func() error { return nil })
+		require.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			_, ok := r3.Find(id)
+			return !ok
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
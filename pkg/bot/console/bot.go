@@ -0,0 +1,251 @@
+package console
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+var _ bot.Interface = (*consoleBot)(nil)
+
+type consoleBot struct {
+	bot.BaseBot
+
+	socket   string
+	listener net.Listener
+
+	noColor bool
+	botName string
+
+	// users maps user names to whether the user is admin
+	users       map[string]bool
+	defaultUser string
+	defaultChat string
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	history   *bot.MessageHistory[chatIDWrapper, *messageContext]
+	callbacks *bot.CallbackRegistry
+	msgSeq    uint64
+
+	// mu guards terminals and writes to them
+	mu        sync.Mutex
+	terminals map[*terminal]struct{}
+
+	// messages are handled one by one in the order received
+	msgCh chan *messageContext
+}
+
+// Configure listens on the unix socket if configured
+func (c *consoleBot) Configure() error {
+	if len(c.socket) == 0 {
+		return nil
+	}
+
+	// remove socket left by previous run
+	err := os.Remove(c.socket)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	c.listener, err = net.Listen("unix", c.socket)
+	if err != nil {
+		return fmt.Errorf("listen unix socket: %w", err)
+	}
+
+	return nil
+}
+
+// Start serves the console on stdin/stdout or the unix socket
+func (c *consoleBot) Start(baseURL string, mux rt.Mux) error {
+	go c.handleMessages()
+
+	if c.listener == nil {
+		go c.serve(c.newTerminal(os.Stdin, os.Stdout))
+		return nil
+	}
+
+	go func() {
+		<-c.Context().Done()
+		_ = c.listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := c.listener.Accept()
+			if err != nil {
+				select {
+				case <-c.Context().Done():
+				default:
+					c.Logger().E("failed to accept console connection", log.Error(err))
+				}
+
+				return
+			}
+
+			go c.serve(c.newTerminal(conn, conn))
+		}
+	}()
+
+	c.Logger().D("serving console", log.String("socket", c.socket))
+	return nil
+}
+
+func (c *consoleBot) serve(t *terminal) {
+	c.mu.Lock()
+	if c.terminals == nil {
+		c.terminals = make(map[*terminal]struct{})
+	}
+	c.terminals[t] = struct{}{}
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+
+		c.mu.Lock()
+		delete(c.terminals, t)
+		c.mu.Unlock()
+	}()
+
+	if t.closer != nil {
+		go func() {
+			select {
+			case <-c.Context().Done():
+			case <-done:
+			}
+
+			_ = t.closer.Close()
+		}()
+	}
+
+	err := t.run()
+	if err != nil {
+		c.Logger().I("console closed", log.Error(err))
+	}
+}
+
+func (c *consoleBot) nextMsgID() rt.MessageID {
+	return rt.MessageID(atomic.AddUint64(&c.msgSeq, 1))
+}
+
+// deliver writes a message to terminals of the chat, private chats are only
+// shown to terminals of the user
+func (c *consoleBot) deliver(chat chatIDWrapper, from *terminal, header, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for t := range c.terminals {
+		if t == from || (chat.isPrivate() && t.user != chat.user()) {
+			continue
+		}
+
+		t.writeLocked(header, text)
+	}
+}
+
+// onMessage handles message typed in the terminal
+func (c *consoleBot) onMessage(t *terminal, chat chatIDWrapper, user, text, file string, replyTo rt.MessageID) {
+	mc := &messageContext{
+		chat:      chat,
+		user:      user,
+		msgID:     c.nextMsgID(),
+		replyTo:   replyTo,
+		text:      text,
+		file:      file,
+		timestamp: time.Now().UTC(),
+	}
+
+	mc.con = conversationImpl{
+		bot:  c,
+		chat: chat,
+	}
+
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(chat.ID()),
+		rt.LogSenderID(userIDOf(user)),
+	)
+
+	t.writeNote(fmt.Sprintf("#%d", mc.msgID))
+	c.deliver(chat, t, c.header(mc.msgID, chat, user, replyTo), c.inputText(mc))
+
+	c.history.Add(mc)
+
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+}
+
+// inputText is the text shown to other terminals
+func (c *consoleBot) inputText(mc *messageContext) string {
+	if len(mc.file) == 0 {
+		return mc.text
+	}
+
+	return strings.TrimSpace("[file: " + mc.file + "] " + mc.text)
+}
+
+func (c *consoleBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+		}
+	}
+}
+
+func (c *consoleBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	if strings.HasPrefix(mc.text, "/") && len(mc.file) == 0 {
+		cmd, params, _ := strings.Cut(mc.text, " ")
+		handled, err := c.engine.HandleBotCmd(mc, cmd, strings.TrimSpace(params))
+		if handled {
+			return err
+		}
+	}
+
+	// filter private message for input to this bot
+	handled, err := c.engine.HandleInput(mc)
+	if handled {
+		return err
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+func (c *consoleBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromInput(mc, s.Workflow()))
+
+	return nil
+}
+
+// isAdmin checks whether the user is configured as admin
+func (c *consoleBot) isAdmin(user string) bool {
+	return c.users[user]
+}
@@ -0,0 +1,140 @@
+package console
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"arhat.dev/rs"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "console"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// UserConfig is a fake user sending messages from the console
+type UserConfig struct {
+	rs.BaseField
+
+	// Name of the user
+	Name string `yaml:"name"`
+
+	// Admin allows the user to use botcmds of adminOnly workflows in group chats
+	Admin bool `yaml:"admin"`
+}
+
+// Config for console bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// Socket is the path of unix socket to accept console connections (e.g. with
+	// `socat - UNIX-CONNECT:/tmp/mbot.sock`), when not set, messages are read from
+	// stdin and bot messages are written to stdout
+	Socket string `yaml:"socket"`
+
+	// Users are fake users, the first one is the user of new console
+	//
+	// defaults to a single admin user `user`
+	Users []UserConfig `yaml:"users"`
+
+	// Chats are names of fake group chats, the first one is the chat of new console
+	//
+	// defaults to [console]
+	Chats []string `yaml:"chats"`
+
+	// BotName is the name of the bot shown in console
+	//
+	// defaults to mbot
+	BotName string `yaml:"botName"`
+
+	// NoColor disables ANSI escape codes in output
+	NoColor bool `yaml:"noColor"`
+
+	// CallbackTTL is how long buttons with callbacks are clickable
+	//
+	// defaults to 24h
+	CallbackTTL time.Duration `yaml:"callbackTTL"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	users := make(map[string]bool, len(c.Users))
+	for _, u := range c.Users {
+		name := strings.TrimSpace(u.Name)
+		if !isValidName(name) {
+			return nil, fmt.Errorf("invalid user name %q", u.Name)
+		}
+
+		users[name] = u.Admin
+	}
+
+	defaultUser := "user"
+	if len(c.Users) != 0 {
+		defaultUser = strings.TrimSpace(c.Users[0].Name)
+	} else {
+		users[defaultUser] = true
+	}
+
+	defaultChat := "console"
+	for i, name := range c.Chats {
+		name = strings.TrimSpace(name)
+		if !isValidName(name) {
+			return nil, fmt.Errorf("invalid chat name %q", c.Chats[i])
+		}
+
+		if i == 0 {
+			defaultChat = name
+		}
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	botName := c.BotName
+	if len(botName) == 0 {
+		botName = "mbot"
+	}
+
+	cb := &consoleBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		socket:  c.Socket,
+		noColor: c.NoColor,
+		botName: botName,
+
+		users:       users,
+		defaultUser: defaultUser,
+		defaultChat: defaultChat,
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		callbacks: bot.NewCallbackRegistry(rtCtx.Context(), c.CallbackTTL, callbackIDSize),
+
+		msgCh: make(chan *messageContext, 64),
+	}
+
+	cb.history = bot.NewMessageHistory[chatIDWrapper, *messageContext](0)
+	cb.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: cb}, cb.sessions, &cb.wfSet, engine.Options{
+		HelpInPrivate: true,
+		ReplyOnly:     " can only be used as a reply, send it with `:reply <id>`.",
+	})
+
+	return cb, nil
+}
+
+// isValidName checks user and chat names, they are used in console commands
+// and `@` is reserved for private chats
+func isValidName(name string) bool {
+	return len(name) != 0 && !strings.ContainsAny(name, " \t@")
+}
@@ -0,0 +1,196 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestFormatSpans(t *testing.T) {
+	spans := []rt.Span{
+		{Text: "a "},
+		{Flags: rt.SpanFlag_Bold, Text: "bold"},
+		{Text: " "},
+		{Flags: rt.SpanFlag_URL, Text: "link", URL: "https://example.com"},
+		{Text: " "},
+		{Flags: rt.SpanFlag_Image, SpanMediaOptions: rt.SpanMediaOptions{Filename: "a.png"}},
+	}
+
+	assert.Equal(t, "a bold link (https://example.com) [image: a.png]", formatSpans(true, spans))
+	assert.Equal(t,
+		"a \x1b[1mbold\x1b[0m \x1b[34;4mlink\x1b[0m (\x1b[34;4mhttps://example.com\x1b[0m) \x1b[35m[image: a.png]\x1b[0m",
+		formatSpans(false, spans),
+	)
+
+	assert.Equal(t, "│ quote\n│ line", formatSpans(true, []rt.Span{{Flags: rt.SpanFlag_Blockquote, Text: "quote\nline"}}))
+}
+
+// testConsole is a console connected to the unix socket
+type testConsole struct {
+	t *testing.T
+
+	conn  net.Conn
+	lines *bufio.Scanner
+}
+
+func dialConsole(t *testing.T, socket string) *testConsole {
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &testConsole{t: t, conn: conn, lines: bufio.NewScanner(conn)}
+}
+
+func (c *testConsole) send(line string) {
+	_, err := c.conn.Write([]byte(line + "\n"))
+	require.NoError(c.t, err)
+}
+
+// expect reads lines until one containing s, returns that line
+func (c *testConsole) expect(s string) string {
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for c.lines.Scan() {
+		if strings.Contains(c.lines.Text(), s) {
+			return c.lines.Text()
+		}
+	}
+
+	require.FailNow(c.t, "expected line not found", s)
+	return ""
+}
+
+func TestBot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "mbot.sock")
+
+	file := filepath.Join(dir, "shot.png")
+	require.NoError(t, os.WriteFile(file, []byte("\x89PNG\r\n\x1a\n"), 0644))
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, true),
+
+		Socket: socket,
+		Users: []UserConfig{
+			{Name: "alice", Admin: true},
+			{Name: "bob"},
+		},
+		Chats:   []string{"dev"},
+		NoColor: true,
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	require.NoError(t, b.Configure())
+	require.NoError(t, b.Start("", nil))
+
+	c1 := dialConsole(t, socket)
+	c1.expect("-- you are alice in dev")
+
+	c2 := dialConsole(t, socket)
+	c2.expect("-- you are alice in dev")
+	c2.send(":user bob")
+	c2.expect("-- you are bob")
+
+	t.Run("Session", func(t *testing.T) {
+		c2.send("/new topic")
+		c2.expect("[dev] mbot")
+		c1.expect("[dev] bob")
+		c1.expect("Only admins can use this bot in group chat.")
+
+		c1.send("/new topic")
+		c2.expect("created topic")
+
+		c1.send("**hi** #tag")
+		assert.Contains(t, c2.expect("[dev] alice"), "**hi** #tag")
+
+		c1.send(":file " + file + " shot")
+		c1.expect("-- #")
+
+		c2.send("not relevant")
+		id := strings.TrimPrefix(c2.expect("-- #"), "-- ")
+
+		c1.send(":reply " + id + " /ignore")
+		c1.expect("Ignored.")
+
+		c1.send("/end")
+		c1.expect("published")
+
+		assert.EqualValues(t, []string{
+			"topic" +
+				"alice: hi #tag\n" +
+				"alice: shot\n",
+		}, pub.Posts())
+	})
+
+	t.Run("PrivateChat", func(t *testing.T) {
+		c1.send(":dm")
+		c1.expect("-- you are in private chat with mbot")
+
+		c1.send("/help")
+		c1.expect("[@alice] mbot")
+
+		// private chat of alice is not shown to bob
+		c2.send(":dm")
+		c2.expect("-- you are in private chat with mbot")
+		c2.send("/help")
+		assert.Contains(t, c2.expect("] mbot"), "[@bob] mbot")
+
+		c1.send(":chat dev")
+		c2.send(":chat dev")
+	})
+
+	t.Run("Callbacks", func(t *testing.T) {
+		clicked := make(chan struct{}, 1)
+
+		con := &conversationImpl{bot: b.(*consoleBot), chat: chatIDWrapper{name: "dev"}}
+		_, err := con.SendMessage(ctx, rt.SendMessageOptions{
+			Body: []rt.Span{{Text: "choose"}},
+			Callbacks: [][]rt.MessageCallbackSpec{{
+				{Text: "ok", OnClick: rt.NewOptionalValue(func() error {
+					clicked <- struct{}{}
+					return nil
+				})},
+				{Text: "docs", URL: rt.NewOptionalValue("https://example.com")},
+			}},
+		})
+		require.NoError(t, err)
+
+		c2.expect("choose")
+		buttons := c2.expect(": ok]")
+		assert.True(t, strings.HasSuffix(buttons, ": ok] [docs] https://example.com"), buttons)
+
+		id, _, _ := strings.Cut(strings.TrimPrefix(buttons, "["), ":")
+		assert.Len(t, id, 2*callbackIDSize)
+
+		c2.send(":click " + id)
+		select {
+		case <-clicked:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "callback not called")
+		}
+
+		c2.send(":click 1")
+		c2.expect("-- button [1] has expired")
+	})
+}
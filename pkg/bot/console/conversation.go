@@ -0,0 +1,68 @@
+package console
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// callbackIDSize is the number of random bytes in ids of OnClick buttons, ids
+// are typed by users in `:click`, so they are kept short
+const callbackIDSize = 4
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *consoleBot
+
+	chat chatIDWrapper
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// spans are rendered with ANSI escape codes, callbacks are rendered as buttons
+// below the text, one line per row, OnClick buttons are labeled with ids for `:click`
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) ([]rt.MessageID, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var buf strings.Builder
+	buf.WriteString(formatSpans(c.bot.noColor, opts.Body))
+
+	for _, row := range opts.Callbacks {
+		var buttons []string
+		for _, cb := range row {
+			switch {
+			case !cb.OnClick.IsNil():
+				id, err := c.bot.callbacks.Add(cb.OnClick.Get())
+				if err != nil {
+					return nil, fmt.Errorf("add button callback: %w", err)
+				}
+
+				buttons = append(buttons, formatButton(c.bot.noColor, cb.Text, id, ""))
+			case !cb.URL.IsNil():
+				buttons = append(buttons, formatButton(c.bot.noColor, cb.Text, "", cb.URL.Get()))
+			}
+		}
+
+		if len(buttons) != 0 {
+			buf.WriteString("\n")
+			buf.WriteString(strings.Join(buttons, " "))
+		}
+	}
+
+	msgID := c.bot.nextMsgID()
+	c.bot.deliver(c.chat, nil, c.bot.header(msgID, c.chat, c.bot.botName, opts.ReplyTo), buf.String())
+
+	return []rt.MessageID{msgID}, nil
+}
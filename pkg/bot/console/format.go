@@ -0,0 +1,148 @@
+package console
+
+import (
+	"strconv"
+	"strings"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// ANSI SGR parameters
+//
+// ref: https://en.wikipedia.org/wiki/ANSI_escape_code#SGR_(Select_Graphic_Rendition)_parameters
+const (
+	ansiBold          = "1"
+	ansiDim           = "2"
+	ansiItalic        = "3"
+	ansiUnderline     = "4"
+	ansiStrikethrough = "9"
+	ansiRed           = "31"
+	ansiGreen         = "32"
+	ansiYellow        = "33"
+	ansiBlue          = "34"
+	ansiMagenta       = "35"
+	ansiCyan          = "36"
+)
+
+// style wraps text with ANSI escape codes
+func (c *consoleBot) style(text string, params ...string) string {
+	return styleText(c.noColor, text, params...)
+}
+
+func styleText(noColor bool, text string, params ...string) string {
+	if noColor || len(params) == 0 || len(text) == 0 {
+		return text
+	}
+
+	return "\x1b[" + strings.Join(params, ";") + "m" + text + "\x1b[0m"
+}
+
+// header is shown before message text (e.g. `[dev] alice #3 ↪ #2:`)
+func (c *consoleBot) header(msgID rt.MessageID, chat chatIDWrapper, author string, replyTo rt.MessageID) string {
+	ret := c.style("["+chat.name+"]", ansiDim) + " " + c.style(author, ansiBold)
+	ret += c.style(" #"+strconv.FormatUint(uint64(msgID), 10), ansiDim)
+	if replyTo != 0 {
+		ret += c.style(" ↪ #"+strconv.FormatUint(uint64(replyTo), 10), ansiDim)
+	}
+
+	return ret + ":"
+}
+
+// formatSpans renders spans as ANSI styled text
+func formatSpans(noColor bool, spans []rt.Span) string {
+	var buf strings.Builder
+
+	for i := range spans {
+		formatSpan(&buf, noColor, &spans[i])
+	}
+
+	return buf.String()
+}
+
+// nolint:gocyclo
+func formatSpan(buf *strings.Builder, noColor bool, sp *rt.Span) {
+	if sp.IsMedia() {
+		var kind string
+		switch {
+		case sp.IsImage():
+			kind = "image"
+		case sp.Flags&rt.SpanFlag_Video != 0:
+			kind = "video"
+		case sp.Flags&(rt.SpanFlag_Audio|rt.SpanFlag_Voice) != 0:
+			kind = "audio"
+		default:
+			kind = "file"
+		}
+
+		if len(sp.Filename) != 0 {
+			kind += ": " + sp.Filename
+		}
+
+		buf.WriteString(styleText(noColor, "["+kind+"]", ansiMagenta))
+		if len(sp.URL) != 0 {
+			buf.WriteString(" ")
+			buf.WriteString(styleText(noColor, sp.URL, ansiBlue, ansiUnderline))
+		}
+
+		if len(sp.Caption) != 0 {
+			buf.WriteString(" ")
+			buf.WriteString(formatSpans(noColor, sp.Caption))
+		}
+
+		return
+	}
+
+	var params []string
+	if sp.IsBold() {
+		params = append(params, ansiBold)
+	}
+
+	if sp.IsItalic() {
+		params = append(params, ansiItalic)
+	}
+
+	if sp.IsUnderline() {
+		params = append(params, ansiUnderline)
+	}
+
+	if sp.IsStrikethrough() {
+		params = append(params, ansiStrikethrough)
+	}
+
+	switch {
+	case sp.IsCode() || sp.IsPre():
+		params = append(params, ansiCyan)
+	case sp.Flags.IsMention():
+		params = append(params, ansiYellow)
+	case sp.Flags.IsHashTag():
+		params = append(params, ansiGreen)
+	case sp.IsURL() || sp.Flags.IsEmail():
+		params = append(params, ansiBlue, ansiUnderline)
+	}
+
+	text := sp.Text
+	if sp.IsBlockquote() {
+		text = "│ " + strings.ReplaceAll(text, "\n", "\n│ ")
+	}
+
+	if sp.IsPre() && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	buf.WriteString(styleText(noColor, text, params...))
+	if sp.IsURL() && len(sp.URL) != 0 && sp.URL != sp.Text {
+		buf.WriteString(" (")
+		buf.WriteString(styleText(noColor, sp.URL, ansiBlue, ansiUnderline))
+		buf.WriteString(")")
+	}
+}
+
+// formatButton renders callback button, OnClick buttons are labeled with the
+// callback id for `:click`
+func formatButton(noColor bool, text, id, url string) string {
+	if len(id) != 0 {
+		return styleText(noColor, "["+id+": "+text+"]", ansiRed, ansiBold)
+	}
+
+	return styleText(noColor, "["+text+"]", ansiBold) + " " + styleText(noColor, url, ansiBlue, ansiUnderline)
+}
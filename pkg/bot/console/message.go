@@ -0,0 +1,130 @@
+package console
+
+import (
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func (c *consoleBot) newMessageFromInput(mc *messageContext, wf *bot.Workflow) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.timestamp
+	ret.Spans = markdown.Parse(mc.text, markdown.Options{Mentions: true, HashTags: true})
+
+	if len(mc.file) != 0 {
+		c.appendFileSpan(mc, ret, wf)
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	if mc.chat.isPrivate() {
+		ret.Flags |= rt.MessageFlag_Private
+	}
+
+	if mc.replyTo != 0 {
+		ret.Flags |= rt.MessageFlag_Reply
+		ret.ReplyTo = mc.replyTo
+	}
+
+	ret.ChatName = mc.chat.name
+	ret.Author = mc.user
+
+	return
+}
+
+// appendFileSpan adds the local file as media span, and copies the file to cache
+// then uploads it in background when the workflow requires
+func (c *consoleBot) appendFileSpan(mc *messageContext, m *rt.Message, wf *bot.Workflow) {
+	path, err := filepath.Abs(mc.file)
+	if err != nil {
+		path = mc.file
+	}
+
+	span := rt.Span{
+		URL: "file://" + filepath.ToSlash(path),
+		SpanMediaOptions: rt.SpanMediaOptions{
+			Filename:    filepath.Base(path),
+			ContentType: mime.TypeByExtension(filepath.Ext(path)),
+		},
+	}
+
+	if info, err2 := os.Stat(path); err2 == nil {
+		span.Size = info.Size()
+	}
+
+	switch contentType := span.ContentType; {
+	case strings.HasPrefix(contentType, "image/"):
+		span.Flags = rt.SpanFlag_Image
+	case strings.HasPrefix(contentType, "video/"):
+		span.Flags = rt.SpanFlag_Video
+	case strings.HasPrefix(contentType, "audio/"):
+		span.Flags = rt.SpanFlag_Audio
+	default:
+		span.Flags = rt.SpanFlag_File
+	}
+
+	if len(span.ContentType) == 0 {
+		// provide default mime type for storage driver
+		span.ContentType = "application/octet-stream"
+	}
+
+	m.Spans = append(m.Spans, span)
+
+	if !wf.DownloadMedia() {
+		return
+	}
+
+	mediaSpan := &m.Spans[len(m.Spans)-1]
+	con := mc.con
+
+	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
+		mc.logger.D("copy file", log.String("path", path))
+
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			f, err2 := os.Open(path)
+			if err2 != nil {
+				return err2
+			}
+			defer func() { _ = f.Close() }()
+
+			_, err2 = io.Copy(cacheWR, f)
+			return err2
+		})
+		if err != nil {
+			mc.logger.I("failed to copy file", log.Error(err))
+			c.sendErrorf(mc, "unable to read file: %v", err)
+			return
+		}
+
+		mc.logger.D("upload file",
+			log.String("filename", mediaSpan.Filename),
+			rt.LogCacheID(cacheRD.ID()),
+			log.Int64("size", sz),
+		)
+
+		sout, err := bot.Upload(&con, wf.Storage, mediaSpan.Filename, sz, cacheRD, mediaSpan.ContentType)
+		if err != nil {
+			mc.logger.I("failed to upload file", log.Error(err))
+			c.sendErrorf(mc, "unable to upload file: %v", err)
+			return
+		}
+
+		mediaSpan.Size = sz
+		mediaSpan.URL = sout.URL
+		mediaSpan.Data = cacheRD
+	})
+}
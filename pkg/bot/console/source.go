@@ -0,0 +1,56 @@
+package console
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashName generates a stable uint64 id for user and chat names
+func hashName(name string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](name))
+	return h.Sum64()
+}
+
+func userIDOf(name string) rt.UserID { return rt.UserID(hashName(name)) }
+
+// chatIDWrapper is the chat data stored in session requests
+type chatIDWrapper struct {
+	// name of the group chat, or `@` followed by the user name for private chat
+	name string
+}
+
+func privateChatOf(user string) chatIDWrapper { return chatIDWrapper{name: "@" + user} }
+
+func (c chatIDWrapper) ID() rt.ChatID { return rt.ChatID(hashName(c.name)) }
+
+func (c chatIDWrapper) isPrivate() bool { return strings.HasPrefix(c.name, "@") }
+
+// user is the user of the private chat
+func (c chatIDWrapper) user() string { return strings.TrimPrefix(c.name, "@") }
+
+type messageContext struct {
+	con conversationImpl
+
+	chat chatIDWrapper
+	user string
+
+	msgID   rt.MessageID
+	replyTo rt.MessageID
+
+	// text in markdown
+	text string
+
+	// file is the path of local file attached with `:file`
+	file string
+
+	timestamp time.Time
+
+	logger log.Interface
+}
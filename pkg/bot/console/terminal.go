@@ -0,0 +1,200 @@
+package console
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// maxLineSize limits the size of a single line of input
+const maxLineSize = 1 << 20
+
+const consoleUsage = `Console commands:
+:user <name>             switch to user
+:chat <name>             switch to group chat
+:dm                      switch to private chat with the bot
+:reply <id> <text>       send text as reply to message #id
+:file <path> [caption]   send local file
+:click <id>              click button [id]
+:quit                    close this console
+::text                   send text starting with ':'
+other lines are sent as markdown messages`
+
+// terminal is a console connected to the bot, every terminal acts as a user
+// in a chat
+type terminal struct {
+	bot *consoleBot
+
+	r      io.Reader
+	w      io.Writer
+	closer io.Closer
+
+	// user and chat are guarded by bot.mu
+	user string
+	chat chatIDWrapper
+}
+
+func (c *consoleBot) newTerminal(r io.Reader, w io.Writer) *terminal {
+	t := &terminal{
+		bot: c,
+
+		r: r,
+		w: w,
+
+		user: c.defaultUser,
+		chat: chatIDWrapper{name: c.defaultChat},
+	}
+
+	if closer, ok := r.(io.Closer); ok && r != os.Stdin {
+		t.closer = closer
+	}
+
+	return t
+}
+
+func (t *terminal) run() error {
+	user, chat := t.state()
+	t.writeNote("you are " + user + " in " + chat.name + ", send :help for console commands")
+
+	sc := bufio.NewScanner(t.r)
+	sc.Buffer(make([]byte, 0, 4096), maxLineSize)
+
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "::"):
+			t.send(line[1:], "", 0)
+		case strings.HasPrefix(line, ":"):
+			if t.handleCommand(line[1:]) {
+				return nil
+			}
+		default:
+			t.send(line, "", 0)
+		}
+	}
+
+	return sc.Err()
+}
+
+func (t *terminal) state() (string, chatIDWrapper) {
+	t.bot.mu.Lock()
+	defer t.bot.mu.Unlock()
+
+	return t.user, t.chat
+}
+
+func (t *terminal) send(text, file string, replyTo rt.MessageID) {
+	user, chat := t.state()
+	t.bot.onMessage(t, chat, user, text, file, replyTo)
+}
+
+// handleCommand handles console command, it returns true when the terminal
+// should be closed
+// nolint:gocyclo
+func (t *terminal) handleCommand(line string) (quit bool) {
+	cmd, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	args = strings.TrimSpace(args)
+
+	switch cmd {
+	case "help":
+		t.writeNote(consoleUsage)
+	case "user":
+		if !isValidName(args) {
+			t.writeNote("usage: :user <name>")
+			return
+		}
+
+		t.bot.mu.Lock()
+		t.user = args
+		if t.chat.isPrivate() {
+			t.chat = privateChatOf(args)
+		}
+		t.bot.mu.Unlock()
+
+		t.writeNote("you are " + args)
+	case "chat":
+		if !isValidName(args) {
+			t.writeNote("usage: :chat <name>")
+			return
+		}
+
+		t.bot.mu.Lock()
+		t.chat = chatIDWrapper{name: args}
+		t.bot.mu.Unlock()
+
+		t.writeNote("you are in " + args)
+	case "dm":
+		t.bot.mu.Lock()
+		t.chat = privateChatOf(t.user)
+		t.bot.mu.Unlock()
+
+		t.writeNote("you are in private chat with " + t.bot.botName)
+	case "reply":
+		idStr, text, _ := strings.Cut(args, " ")
+		id, err := strconv.ParseUint(strings.TrimPrefix(idStr, "#"), 10, 64)
+		if err != nil || len(strings.TrimSpace(text)) == 0 {
+			t.writeNote("usage: :reply <id> <text>")
+			return
+		}
+
+		t.send(strings.TrimSpace(text), "", rt.MessageID(id))
+	case "file":
+		path, caption, _ := strings.Cut(args, " ")
+		if len(path) == 0 {
+			t.writeNote("usage: :file <path> [caption]")
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			t.writeNote("not a regular file: " + path)
+			return
+		}
+
+		t.send(strings.TrimSpace(caption), path, 0)
+	case "click":
+		id := strings.Trim(args, "[]")
+		if len(id) == 0 {
+			t.writeNote("usage: :click <id>")
+			return
+		}
+
+		fn, ok := t.bot.callbacks.Find(id)
+		if !ok {
+			t.writeNote("button [" + id + "] has expired")
+			return
+		}
+
+		err := fn()
+		if err != nil {
+			t.writeNote("button [" + args + "] failed: " + err.Error())
+		}
+	case "quit":
+		return true
+	default:
+		t.writeNote("unknown command :" + cmd + ", send :help for console commands")
+	}
+
+	return
+}
+
+// writeNote writes console feedback to the terminal
+func (t *terminal) writeNote(text string) {
+	t.bot.mu.Lock()
+	defer t.bot.mu.Unlock()
+
+	_, _ = io.WriteString(t.w, t.bot.style("-- "+strings.ReplaceAll(text, "\n", "\n-- "), ansiDim)+"\n")
+}
+
+// writeLocked writes a chat message to the terminal, bot.mu MUST be held
+func (t *terminal) writeLocked(header, text string) {
+	_, _ = io.WriteString(t.w, header+" "+text+"\n")
+}
@@ -1,7 +1,428 @@
 package discord
 
-// TODO
-
 import (
-	_ "github.com/bwmarrin/discordgo"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/bwmarrin/discordgo"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
 )
+
+const (
+	// maxCommandDescriptionLength is the max characters of application command description
+	maxCommandDescriptionLength = 100
+
+	// paramsOptionName is the name of the string option of application commands
+	paramsOptionName = "params"
+
+	// adminPermissions are permissions considered as guild admin
+	adminPermissions = discordgo.PermissionAdministrator | discordgo.PermissionManageServer
+)
+
+var _ bot.Interface = (*discordBot)(nil)
+
+type discordBot struct {
+	bot.BaseBot
+
+	client    *discordgo.Session
+	cmdPrefix string
+
+	// resolved in Configure
+	botUserID string
+	appID     string
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	callbacks *bot.CallbackRegistry
+
+	// messages are handled one by one in the order received
+	msgCh chan *messageContext
+
+	cacheMu  *sync.Mutex
+	channels map[string]*discordgo.Channel
+	// dmChats are direct message channels of users, used to ask for tokens
+	dmChats map[string]string
+}
+
+// Configure checks the bot token and registers workflow commands as application commands
+func (c *discordBot) Configure() error {
+	self, err := c.client.User("@me")
+	if err != nil {
+		return fmt.Errorf("check bot token: %w", err)
+	}
+
+	app, err := c.client.Application("@me")
+	if err != nil {
+		return fmt.Errorf("get application: %w", err)
+	}
+
+	c.botUserID = self.ID
+	c.appID = app.ID
+
+	c.Logger().D("recognized self",
+		log.String("user_id", self.ID),
+		log.String("username", self.Username),
+		log.String("app_id", app.ID),
+	)
+
+	cmds := c.applicationCommands()
+	_, err = c.client.ApplicationCommandBulkOverwrite(c.appID, "", cmds)
+	if err != nil {
+		return fmt.Errorf("set application commands: %w", err)
+	}
+
+	c.Logger().D("application commands updated", log.Int("count", len(cmds)))
+	return nil
+}
+
+// applicationCommands converts workflow commands to global application commands
+func (c *discordBot) applicationCommands() (ret []*discordgo.ApplicationCommand) {
+	seen := make(map[string]struct{})
+	for i := range c.wfSet.Workflows {
+		wf := &c.wfSet.Workflows[i]
+
+		for j, cmd := range wf.BotCommands.Commands {
+			desc := wf.BotCommands.Descriptions[j]
+			if len(cmd) == 0 || len(desc) == 0 {
+				continue
+			}
+
+			name := strings.ToLower(strings.TrimPrefix(cmd, "/"))
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+
+			if r := []rune(desc); len(r) > maxCommandDescriptionLength {
+				desc = string(r[:maxCommandDescriptionLength])
+			}
+
+			spec := &discordgo.ApplicationCommand{
+				Type:        discordgo.ChatApplicationCommand,
+				Name:        name,
+				Description: desc,
+			}
+
+			switch wf.BotCommands.Parse(cmd) {
+			case rt.BotCmd_New, rt.BotCmd_Resume, rt.BotCmd_End, rt.BotCmd_Delete:
+				spec.Options = []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        paramsOptionName,
+					Description: "Parameters of the command",
+				}}
+			}
+
+			ret = append(ret, spec)
+		}
+	}
+
+	return
+}
+
+// Start connects to the gateway in background
+func (c *discordBot) Start(baseURL string, mux rt.Mux) error {
+	go c.handleMessages()
+
+	go func() {
+		for {
+			// discordgo reconnects (resumes the session if possible) on its own
+			// once connected
+			err := c.client.Open()
+			if err == nil {
+				break
+			}
+
+			c.Logger().I("failed to connect gateway, retry later", log.Error(err))
+
+			select {
+			case <-c.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+
+		<-c.Context().Done()
+		_ = c.client.Close()
+	}()
+
+	return nil
+}
+
+func (c *discordBot) onMessageCreate(_ *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author == nil || m.Author.ID == c.botUserID {
+		return
+	}
+
+	switch m.Type {
+	case discordgo.MessageTypeDefault, discordgo.MessageTypeReply:
+	default:
+		// joins, pins and other system messages
+		return
+	}
+
+	c.enqueue(c.newMessageContext(m.Message))
+}
+
+func (c *discordBot) onInteractionCreate(_ *discordgo.Session, i *discordgo.InteractionCreate) {
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		c.onApplicationCommand(i.Interaction)
+	case discordgo.InteractionMessageComponent:
+		c.onMessageComponent(i.Interaction)
+	}
+}
+
+func (c *discordBot) onApplicationCommand(i *discordgo.Interaction) {
+	data := i.ApplicationCommandData()
+
+	var params string
+	for _, opt := range data.Options {
+		if opt.Name == paramsOptionName && opt.Type == discordgo.ApplicationCommandOptionString {
+			params = strings.TrimSpace(opt.StringValue())
+		}
+	}
+
+	cmdText := strings.TrimSpace("/" + data.Name + " " + params)
+
+	// interactions must be responded in 3s, replies are sent as normal messages
+	err := c.client.InteractionRespond(i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: "`" + cmdText + "`",
+		},
+	})
+	if err != nil {
+		c.Logger().I("failed to respond application command", log.Error(err))
+	}
+
+	mc := &messageContext{
+		chat:  chatIDWrapper{channel: i.ChannelID},
+		guild: i.GuildID,
+
+		// application commands are not messages, the text is prefixed so that
+		// it will be handled as botcmd
+		text: c.cmdPrefix + strings.TrimPrefix(cmdText, "/"),
+
+		isPrivate: len(i.GuildID) == 0,
+		timestamp: time.Now().UTC(),
+	}
+
+	switch {
+	case i.Member != nil && i.Member.User != nil:
+		mc.user = i.Member.User.ID
+		mc.isAdmin = i.Member.Permissions&adminPermissions != 0
+	case i.User != nil:
+		mc.user = i.User.ID
+	default:
+		return
+	}
+
+	c.setupMessageContext(mc)
+	c.enqueue(mc)
+}
+
+func (c *discordBot) onMessageComponent(i *discordgo.Interaction) {
+	customID := i.MessageComponentData().CustomID
+
+	err := c.client.InteractionRespond(i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		c.Logger().I("failed to respond button click", log.Error(err))
+	}
+
+	if !strings.HasPrefix(customID, callbackCustomIDPrefix) {
+		return
+	}
+
+	onClick, ok := c.callbacks.Find(strings.TrimPrefix(customID, callbackCustomIDPrefix))
+	if !ok {
+		c.Logger().V("callback not found", log.String("custom_id", customID))
+		return
+	}
+
+	go func() {
+		err2 := onClick()
+		if err2 != nil {
+			c.Logger().I("failed to handle button click", log.String("custom_id", customID), log.Error(err2))
+		}
+	}()
+}
+
+// newMessageContext creates message context for the discord message
+func (c *discordBot) newMessageContext(msg *discordgo.Message) *messageContext {
+	mc := &messageContext{
+		chat:  chatIDWrapper{channel: msg.ChannelID},
+		guild: msg.GuildID,
+		user:  msg.Author.ID,
+
+		msg:   msg,
+		msgID: messageIDOf(msg.ID),
+		text:  msg.Content,
+
+		isPrivate: len(msg.GuildID) == 0,
+		timestamp: msg.Timestamp.UTC(),
+	}
+
+	if ref := msg.MessageReference; ref != nil && ref.ChannelID == msg.ChannelID {
+		mc.replyTo = messageIDOf(ref.MessageID)
+	}
+
+	c.setupMessageContext(mc)
+	return mc
+}
+
+func (c *discordBot) setupMessageContext(mc *messageContext) {
+	mc.con = conversationImpl{
+		bot:     c,
+		channel: mc.chat.channel,
+	}
+
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.chat.ID()),
+		rt.LogSenderID(userIDOf(mc.user)),
+	)
+}
+
+func (c *discordBot) enqueue(mc *messageContext) {
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+}
+
+func (c *discordBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+		}
+	}
+}
+
+func (c *discordBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	if strings.HasPrefix(mc.text, c.cmdPrefix) {
+		cmd, params, _ := strings.Cut(strings.TrimPrefix(mc.text, c.cmdPrefix), " ")
+		if len(cmd) != 0 {
+			handled, err := c.engine.HandleBotCmd(mc, "/"+cmd, strings.TrimSpace(params))
+			if handled || mc.msg == nil {
+				return err
+			}
+		}
+	}
+
+	if mc.msg == nil {
+		// unknown application command
+		return nil
+	}
+
+	// filter private message for input to this bot
+	handled, err := c.engine.HandleInput(mc)
+	if handled {
+		return err
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+func (c *discordBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromDiscordMessage(mc, s.Workflow()))
+
+	return nil
+}
+
+// isAdmin checks whether the sender of the message can manage the guild
+func (c *discordBot) isAdmin(mc *messageContext) bool {
+	if mc.isAdmin {
+		return true
+	}
+
+	perms, err := c.client.UserChannelPermissions(mc.user, mc.chat.channel)
+	if err != nil {
+		mc.logger.I("failed to get user permissions", log.Error(err))
+		return false
+	}
+
+	return perms&adminPermissions != 0
+}
+
+// channelInfo returns the channel from state or cache, it fetches the channel
+// when not found
+func (c *discordBot) channelInfo(channel string) (*discordgo.Channel, error) {
+	if ch, err := c.client.State.Channel(channel); err == nil {
+		return ch, nil
+	}
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if ch, ok := c.channels[channel]; ok {
+		return ch, nil
+	}
+
+	ch, err := c.client.Channel(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	c.channels[channel] = ch
+	return ch, nil
+}
+
+// channelName returns name of the channel, or the id when unknown
+func (c *discordBot) channelName(channel string) string {
+	ch, err := c.channelInfo(channel)
+	if err != nil {
+		c.Logger().I("failed to get channel info", log.String("channel", channel), log.Error(err))
+		return channel
+	}
+
+	switch {
+	case len(ch.Name) != 0:
+		return ch.Name
+	case len(ch.Recipients) != 0:
+		return "@" + ch.Recipients[0].Username
+	default:
+		return channel
+	}
+}
+
+// privateChannelOf returns the direct message channel with the user
+func (c *discordBot) privateChannelOf(user string) (string, error) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if channel, ok := c.dmChats[user]; ok {
+		return channel, nil
+	}
+
+	ch, err := c.client.UserChannelCreate(user)
+	if err != nil {
+		return "", fmt.Errorf("create direct message channel: %w", err)
+	}
+
+	c.dmChats[user] = ch.ID
+	return ch.ID, nil
+}
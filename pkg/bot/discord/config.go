@@ -0,0 +1,133 @@
+package discord
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/rs"
+	"github.com/bwmarrin/discordgo"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "discord"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// Config for discord bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// BotToken of the discord application
+	BotToken string `yaml:"botToken"`
+
+	// APIURL is the base url of discord rest api
+	//
+	// defaults to https://discord.com/api/v9/
+	APIURL string `yaml:"apiURL"`
+
+	// GatewayURL is the websocket url of discord gateway
+	//
+	// defaults to the one returned by the rest api (GET /gateway)
+	GatewayURL string `yaml:"gatewayURL"`
+
+	// CommandPrefix is the prefix of bot commands in text messages
+	//
+	// discord clients intercept messages starting with `/` as application
+	// commands, which cannot be used as reply, so the workflow command `/include`
+	// can be sent as `!include` in reply to the message to include
+	//
+	// defaults to `!`
+	CommandPrefix string `yaml:"commandPrefix"`
+
+	// CallbackTTL is how long buttons with callbacks are clickable
+	//
+	// defaults to 24h
+	CallbackTTL time.Duration `yaml:"callbackTTL"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	if len(c.BotToken) == 0 {
+		return nil, fmt.Errorf("botToken is required")
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	token := c.BotToken
+	if !strings.HasPrefix(token, "Bot ") {
+		token = "Bot " + token
+	}
+
+	client, err := discordgo.New(token)
+	if err != nil {
+		return nil, fmt.Errorf("create discord session: %w", err)
+	}
+
+	apiURL := c.APIURL
+	if len(apiURL) != 0 && !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+
+	client.Client = &http.Client{
+		Timeout: 20 * time.Second,
+		Transport: &endpointTransport{
+			apiURL:     apiURL,
+			gatewayURL: c.GatewayURL,
+			base:       http.DefaultTransport,
+		},
+	}
+	client.Identify.Intents = discordgo.IntentsGuilds |
+		discordgo.IntentsGuildMessages |
+		discordgo.IntentsDirectMessages |
+		discordgo.IntentsMessageContent
+	// keep events in order, they are handled asynchronously in handleMessages
+	client.SyncEvents = true
+
+	cmdPrefix := c.CommandPrefix
+	if len(cmdPrefix) == 0 {
+		cmdPrefix = "!"
+	}
+
+	db := &discordBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		client:    client,
+		cmdPrefix: cmdPrefix,
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		callbacks: bot.NewCallbackRegistry(rtCtx.Context(), c.CallbackTTL, 0),
+
+		msgCh: make(chan *messageContext, 64),
+
+		cacheMu:  &sync.Mutex{},
+		channels: make(map[string]*discordgo.Channel),
+		dmChats:  make(map[string]string),
+	}
+
+	db.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: db}, db.sessions, &db.wfSet, engine.Options{
+		CmdPrefix:        cmdPrefix,
+		AdminOnly:        "Only server admins can use this bot in channel.",
+		GroupChat:        "channel",
+		CheckPrivateChat: "Please check direct messages from me.",
+	})
+
+	client.AddHandler(db.onMessageCreate)
+	client.AddHandler(db.onInteractionCreate)
+
+	return db, nil
+}
@@ -0,0 +1,141 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const (
+	// maxEmbedDescriptionLength is the max characters of embed description
+	maxEmbedDescriptionLength = 4096
+
+	// maxButtonLabelLength is the max characters of button label
+	maxButtonLabelLength = 80
+
+	// maxActionsRows is the max count of action rows in a message
+	maxActionsRows = 5
+
+	// maxRowButtons is the max count of buttons in an action row
+	maxRowButtons = 5
+
+	// callbackCustomIDPrefix is the prefix of custom ids of OnClick buttons
+	callbackCustomIDPrefix = "mbot-"
+)
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *discordBot
+
+	channel string
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// message body is sent as embeds, one message per embed, callbacks are attached to
+// the last message as buttons
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) (ret []rt.MessageID, err error) {
+	parts := bot.SplitText(formatSpans(opts.Body), maxEmbedDescriptionLength)
+	components, err := c.buildComponents(opts.Callbacks)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 0 {
+		if len(components) == 0 {
+			return nil, nil
+		}
+
+		// components only
+		parts = append(parts, "")
+	}
+
+	for i, part := range parts {
+		data := &discordgo.MessageSend{}
+		if len(part) != 0 {
+			data.Embeds = []*discordgo.MessageEmbed{{
+				Type:        discordgo.EmbedTypeRich,
+				Description: part,
+			}}
+		}
+
+		if i == 0 && opts.ReplyTo != 0 {
+			data.Reference = &discordgo.MessageReference{
+				MessageID: idOf(uint64(opts.ReplyTo)),
+				ChannelID: c.channel,
+			}
+		}
+
+		if i == len(parts)-1 {
+			data.Components = components
+		}
+
+		// TODO: discordgo does not support context in rest api calls
+		var msg *discordgo.Message
+		msg, err = c.bot.client.ChannelMessageSendComplex(c.channel, data)
+		if err != nil {
+			return
+		}
+
+		ret = append(ret, messageIDOf(msg.ID))
+	}
+
+	return
+}
+
+// buildComponents converts callbacks to action rows of buttons
+func (c *conversationImpl) buildComponents(callbacks [][]rt.MessageCallbackSpec) (ret []discordgo.MessageComponent, err error) {
+	for _, row := range callbacks {
+		if len(ret) == maxActionsRows {
+			break
+		}
+
+		var buttons []discordgo.MessageComponent
+		for _, cb := range row {
+			if len(buttons) == maxRowButtons {
+				break
+			}
+
+			label := cb.Text
+			if r := []rune(label); len(r) > maxButtonLabelLength {
+				label = string(r[:maxButtonLabelLength])
+			}
+
+			btn := discordgo.Button{Label: label}
+			switch {
+			case !cb.URL.IsNil():
+				btn.Style = discordgo.LinkButton
+				btn.URL = cb.URL.Get()
+			case !cb.OnClick.IsNil():
+				btn.Style = discordgo.PrimaryButton
+				var id string
+				id, err = c.bot.callbacks.Add(cb.OnClick.Get())
+				if err != nil {
+					return nil, fmt.Errorf("add button callback: %w", err)
+				}
+
+				btn.CustomID = callbackCustomIDPrefix + id
+			default:
+				continue
+			}
+
+			buttons = append(buttons, btn)
+		}
+
+		if len(buttons) != 0 {
+			ret = append(ret, discordgo.ActionsRow{Components: buttons})
+		}
+	}
+
+	return
+}
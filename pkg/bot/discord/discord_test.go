@@ -0,0 +1,528 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func testResolve(kind byte, id string) string {
+	return string(kind) + "name-" + id
+}
+
+func TestParseMarkdown(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		text     string
+		expected []rt.Span
+	}{
+		{
+			name:     "Plain",
+			text:     `a \*b\* snake_case_name 2*3`,
+			expected: []rt.Span{{Text: "a *b* snake_case_name 2*3"}},
+		},
+		{
+			name: "Styles",
+			text: "**bold** *it* __under__ ~~gone~~ ***both*** ||secret|| `a*b*` ``c`d``",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Bold, Text: "bold"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Italic, Text: "it"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Underline, Text: "under"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Strikethrough, Text: "gone"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Bold | rt.SpanFlag_Italic, Text: "both"},
+				{Text: " secret "},
+				{Flags: rt.SpanFlag_Code, Text: "a*b*"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Code, Text: "c`d"},
+			},
+		},
+		{
+			name: "Entities",
+			text: "<@1> <@!2> <@&3> <#4> <:smile:5> <t:0:R> [site](https://example.com) see https://a.example/b.",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Mention, Text: "@@name-1", Hint: "1"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Mention, Text: "@@name-2", Hint: "2"},
+				{Text: " @&name-3 ##name-4 :smile: 1970-01-01T00:00:00Z "},
+				{Flags: rt.SpanFlag_URL, Text: "site", URL: "https://example.com"},
+				{Text: " see "},
+				{Flags: rt.SpanFlag_URL, Text: "https://a.example/b", URL: "https://a.example/b"},
+				{Text: "."},
+			},
+		},
+		{
+			name: "Blocks",
+			text: "> quoted\nnormal\n```go\nx := 1\n\ny\n```\n>>> all\nquoted",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Blockquote, Text: "quoted\n"},
+				{Text: "normal\n"},
+				{Flags: rt.SpanFlag_Pre, Text: "x := 1\n\ny", Hint: "go"},
+				{Text: "\n"},
+				{Flags: rt.SpanFlag_Blockquote, Text: "all\nquoted"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.EqualValues(t, test.expected, parseMarkdown(test.text, testResolve))
+		})
+	}
+}
+
+func TestFormatSpans(t *testing.T) {
+	assert.Equal(t,
+		"a\\*b **bold** *it* `x` [link](https://example.com/a_%29) <@123> > q\n> r"+
+			"[photo.png](fake://p.png)",
+		formatSpans([]rt.Span{
+			{Text: "a*b "},
+			{Flags: rt.SpanFlag_Bold, Text: "bold "},
+			{Flags: rt.SpanFlag_Italic, Text: "it"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Code, Text: "x"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_URL, Text: "link", URL: "https://example.com/a_)"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Mention, Text: "@alice", Hint: "123"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Blockquote, Text: "q\nr"},
+			{
+				Flags: rt.SpanFlag_Image,
+				URL:   "fake://p.png",
+				SpanMediaOptions: rt.SpanMediaOptions{
+					Filename: "photo.png",
+				},
+			},
+		}),
+	)
+}
+
+const (
+	testGuild   = "300"
+	testChannel = "400"
+	testAlice   = "1"
+	testBob     = "2"
+)
+
+type gatewayPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d,omitempty"`
+	S  int64           `json:"s,omitempty"`
+	T  string          `json:"t,omitempty"`
+}
+
+// fakeDiscord is a stand-in of discord rest api and gateway
+type fakeDiscord struct {
+	*httptest.Server
+
+	t *testing.T
+
+	seq    int64
+	msgSeq int64
+
+	// events to send through gateway
+	events chan gatewayPayload
+	// drop current gateway connection
+	drop chan struct{}
+
+	identified chan struct{}
+	resumed    chan string
+
+	// messages sent to channels
+	posted chan *fakeMessage
+	// types of interaction responses
+	responded chan int
+
+	mu         sync.Mutex
+	commands   []map[string]any
+	downloaded int
+}
+
+type fakeMessage struct {
+	ChannelID string `json:"-"`
+
+	Embeds []struct {
+		Description string `json:"description"`
+	} `json:"embeds"`
+
+	Components []struct {
+		Components []struct {
+			Label    string `json:"label"`
+			Style    int    `json:"style"`
+			URL      string `json:"url"`
+			CustomID string `json:"custom_id"`
+		} `json:"components"`
+	} `json:"components"`
+
+	Reference *struct {
+		MessageID string `json:"message_id"`
+	} `json:"message_reference"`
+}
+
+func newFakeDiscord(t *testing.T) *fakeDiscord {
+	s := &fakeDiscord{
+		t: t,
+
+		events: make(chan gatewayPayload, 16),
+		drop:   make(chan struct{}),
+
+		identified: make(chan struct{}, 1),
+		resumed:    make(chan string, 1),
+
+		posted:    make(chan *fakeMessage, 16),
+		responded: make(chan int, 16),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gateway/", s.handleGateway)
+	mux.HandleFunc("/files/photo.png", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.downloaded++
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	})
+	mux.HandleFunc("/api/", s.handleAPI)
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *fakeDiscord) reply(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (s *fakeDiscord) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bot token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	switch {
+	case path == "users/@me":
+		s.reply(w, map[string]any{"id": "100", "username": "mbot", "bot": true})
+	case path == "oauth2/applications/@me":
+		s.reply(w, map[string]any{"id": "200", "name": "mbot"})
+	case path == "applications/200/commands" && r.Method == http.MethodPut:
+		var cmds []map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&cmds)
+
+		s.mu.Lock()
+		s.commands = cmds
+		s.mu.Unlock()
+
+		s.reply(w, cmds)
+	case path == "users/@me/channels":
+		s.reply(w, map[string]any{"id": "500", "type": 1})
+	case strings.HasPrefix(path, "interactions/"):
+		var resp struct {
+			Type int `json:"type"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&resp)
+
+		s.responded <- resp.Type
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "channels/") && strings.HasSuffix(path, "/messages"):
+		msg := &fakeMessage{
+			ChannelID: strings.TrimSuffix(strings.TrimPrefix(path, "channels/"), "/messages"),
+		}
+		_ = json.NewDecoder(r.Body).Decode(msg)
+
+		s.posted <- msg
+		s.reply(w, map[string]any{
+			"id":         fmt.Sprint(9000 + atomic.AddInt64(&s.msgSeq, 1)),
+			"channel_id": msg.ChannelID,
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeDiscord) handleGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	var wmu sync.Mutex
+	send := func(p gatewayPayload) {
+		wmu.Lock()
+		defer wmu.Unlock()
+
+		if p.Op == 0 {
+			p.S = atomic.AddInt64(&s.seq, 1)
+		}
+
+		_ = conn.WriteJSON(p)
+	}
+
+	send(gatewayPayload{Op: 10, D: json.RawMessage(`{"heartbeat_interval":45000}`)})
+
+	var hello struct {
+		Op int `json:"op"`
+		D  struct {
+			Token     string `json:"token"`
+			SessionID string `json:"session_id"`
+		} `json:"d"`
+	}
+	if conn.ReadJSON(&hello) != nil || hello.D.Token != "Bot token" {
+		return
+	}
+
+	switch hello.Op {
+	case 2:
+		send(gatewayPayload{Op: 0, T: "READY", D: json.RawMessage(
+			`{"v":9,"session_id":"sess","user":{"id":"100","username":"mbot","bot":true},"guilds":[]}`,
+		)})
+		send(gatewayPayload{Op: 0, T: "GUILD_CREATE", D: mustJSON(s.t, map[string]any{
+			"id":       testGuild,
+			"name":     "test",
+			"owner_id": testAlice,
+			"roles":    []any{map[string]any{"id": testGuild, "name": "@everyone", "permissions": "0"}},
+			"channels": []any{map[string]any{"id": testChannel, "name": "general", "type": 0, "guild_id": testGuild}},
+			"members": []any{
+				map[string]any{"user": map[string]any{"id": testAlice, "username": "alice"}, "roles": []any{}},
+				map[string]any{"user": map[string]any{"id": testBob, "username": "bob"}, "roles": []any{}},
+			},
+		})})
+
+		s.identified <- struct{}{}
+	case 6:
+		send(gatewayPayload{Op: 0, T: "RESUMED", D: json.RawMessage(`{}`)})
+		s.resumed <- hello.D.SessionID
+	default:
+		return
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		for {
+			var p gatewayPayload
+			if conn.ReadJSON(&p) != nil {
+				return
+			}
+
+			if p.Op == 1 {
+				send(gatewayPayload{Op: 11})
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-s.drop:
+			return
+		case p := <-s.events:
+			send(p)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return data
+}
+
+func (s *fakeDiscord) sendMessage(id, author, content string, extra map[string]any) {
+	msg := map[string]any{
+		"id":         id,
+		"channel_id": testChannel,
+		"guild_id":   testGuild,
+		"author":     map[string]any{"id": author, "username": map[string]string{testAlice: "alice", testBob: "bob"}[author]},
+		"content":    content,
+		"timestamp":  "2022-01-01T00:00:00Z",
+		"type":       0,
+	}
+
+	for k, v := range extra {
+		msg[k] = v
+	}
+
+	s.events <- gatewayPayload{Op: 0, T: "MESSAGE_CREATE", D: mustJSON(s.t, msg)}
+}
+
+func (s *fakeDiscord) expectPosted(t *testing.T, expected string) *fakeMessage {
+	select {
+	case msg := <-s.posted:
+		require.Len(t, msg.Embeds, 1)
+		assert.Equal(t, expected, msg.Embeds[0].Description)
+		return msg
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timeout waiting for message", expected)
+		return nil
+	}
+}
+
+func expect[T any](t *testing.T, ch <-chan T, what string) (ret T) {
+	select {
+	case ret = <-ch:
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timeout waiting for "+what)
+	}
+
+	return
+}
+
+func TestBot(t *testing.T) {
+	srv := newFakeDiscord(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, true),
+
+		BotToken:   "token",
+		APIURL:     srv.URL + "/api",
+		GatewayURL: "ws" + strings.TrimPrefix(srv.URL, "http") + "/gateway",
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+	require.NoError(t, b.Configure())
+
+	srv.mu.Lock()
+	cmds := map[string]map[string]any{}
+	for _, cmd := range srv.commands {
+		cmds[cmd["name"].(string)] = cmd
+	}
+	srv.mu.Unlock()
+
+	if assert.Contains(t, cmds, "new") && assert.Contains(t, cmds, "help") {
+		assert.Len(t, cmds["new"]["options"], 1)
+		assert.Empty(t, cmds["help"]["options"])
+	}
+
+	require.NoError(t, b.Start("", http.NewServeMux()))
+	expect(t, srv.identified, "identify")
+
+	t.Run("Session", func(t *testing.T) {
+		srv.sendMessage("1001", testBob, "!new topic", nil)
+		msg := srv.expectPosted(t, "Only server admins can use this bot in channel.")
+		if assert.NotNil(t, msg.Reference) {
+			assert.Equal(t, "1001", msg.Reference.MessageID)
+		}
+
+		srv.sendMessage("1002", testAlice, "!new topic", nil)
+		srv.expectPosted(t, "created topic")
+
+		srv.sendMessage("1003", testAlice, "**hello** <@2> [link](https://example.com)", map[string]any{
+			"member":   map[string]any{"nick": "Alice"},
+			"mentions": []any{map[string]any{"id": testBob, "username": "bob"}},
+		})
+
+		// resume after connection lost
+		srv.drop <- struct{}{}
+		assert.Equal(t, "sess", expect(t, srv.resumed, "resume"))
+
+		srv.sendMessage("1004", testBob, "", map[string]any{
+			"attachments": []any{map[string]any{
+				"id":           "600",
+				"filename":     "photo.png",
+				"content_type": "image/png",
+				"size":         8,
+				"url":          srv.URL + "/files/photo.png",
+			}},
+		})
+
+		srv.sendMessage("1005", testAlice, "!end", nil)
+		srv.expectPosted(t, "published")
+
+		assert.EqualValues(t, []string{
+			"topic" +
+				"Alice: hello @bob link\n" +
+				"bob: \n",
+		}, pub.Posts())
+
+		srv.mu.Lock()
+		assert.Equal(t, 1, srv.downloaded)
+		srv.mu.Unlock()
+	})
+
+	t.Run("ApplicationCommand", func(t *testing.T) {
+		srv.events <- gatewayPayload{Op: 0, T: "INTERACTION_CREATE", D: mustJSON(t, map[string]any{
+			"id":         "700",
+			"type":       2,
+			"token":      "itoken",
+			"channel_id": testChannel,
+			"guild_id":   testGuild,
+			"member": map[string]any{
+				"user":        map[string]any{"id": testAlice, "username": "alice"},
+				"permissions": "8",
+			},
+			"data": map[string]any{"id": "800", "name": "end"},
+		})}
+
+		assert.Equal(t, 4, expect(t, srv.responded, "interaction response"))
+		msg := srv.expectPosted(t, "There is no active session.")
+		assert.Nil(t, msg.Reference)
+	})
+
+	t.Run("Callbacks", func(t *testing.T) {
+		clicked := make(chan struct{})
+		con := &conversationImpl{bot: b.(*discordBot), channel: testChannel}
+		_, err := con.SendMessage(ctx, rt.SendMessageOptions{
+			Body: []rt.Span{{Text: "choose"}},
+			Callbacks: [][]rt.MessageCallbackSpec{{
+				{Text: "open", URL: rt.NewOptionalValue("https://example.com")},
+				{Text: "click", OnClick: rt.NewOptionalValue(func() error {
+					close(clicked)
+					return nil
+				})},
+			}},
+		})
+		require.NoError(t, err)
+
+		msg := srv.expectPosted(t, "choose")
+		require.Len(t, msg.Components, 1)
+		require.Len(t, msg.Components[0].Components, 2)
+		assert.Equal(t, "https://example.com", msg.Components[0].Components[0].URL)
+
+		srv.events <- gatewayPayload{Op: 0, T: "INTERACTION_CREATE", D: mustJSON(t, map[string]any{
+			"id":         "701",
+			"type":       3,
+			"token":      "itoken",
+			"channel_id": testChannel,
+			"guild_id":   testGuild,
+			"data": map[string]any{
+				"custom_id":      msg.Components[0].Components[1].CustomID,
+				"component_type": 2,
+			},
+		})}
+
+		assert.Equal(t, 6, expect(t, srv.responded, "interaction response"))
+		expect(t, clicked, "button callback")
+	})
+}
@@ -0,0 +1,71 @@
+package discord
+
+import (
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+var (
+	_ engine.Message[chatIDWrapper]                  = (*messageContext)(nil)
+	_ engine.Adapter[chatIDWrapper, *messageContext] = (*adapter)(nil)
+)
+
+func (mc *messageContext) Chat() chatIDWrapper           { return mc.chat }
+func (mc *messageContext) ChatName() string              { return "#" + mc.con.bot.channelName(mc.chat.channel) }
+func (mc *messageContext) IsPrivate() bool               { return mc.isPrivate }
+func (mc *messageContext) SenderID() rt.UserID           { return userIDOf(mc.user) }
+func (mc *messageContext) MessageID() rt.MessageID       { return mc.msgID }
+func (mc *messageContext) ReplyTo() rt.MessageID         { return mc.replyTo }
+func (mc *messageContext) InputText() string             { return mc.text }
+func (mc *messageContext) Conversation() rt.Conversation { return &mc.con }
+func (mc *messageContext) Logger() log.Interface         { return mc.logger }
+
+// adapter implements engine.Adapter for discord
+type adapter struct {
+	c *discordBot
+}
+
+func (a adapter) Reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	return a.c.reply(mc, body...)
+}
+
+func (a adapter) Conversation(chat chatIDWrapper) rt.Conversation {
+	return &conversationImpl{bot: a.c, channel: chat.channel}
+}
+
+// DeleteAfter does nothing, notices are kept in the channel history
+func (a adapter) DeleteAfter(chat chatIDWrapper, delay time.Duration, msgIDs ...rt.MessageID) {}
+
+func (a adapter) PrivateChatOf(mc *messageContext) (chatIDWrapper, bool, error) {
+	channel, err := a.c.privateChannelOf(mc.user)
+	if err != nil {
+		return chatIDWrapper{}, false, err
+	}
+
+	return chatIDWrapper{channel: channel}, true, nil
+}
+
+func (a adapter) PrivateChatLink(startParams string) (string, bool) { return "", false }
+
+func (a adapter) IsAdmin(mc *messageContext) (bool, error) { return a.c.isAdmin(mc), nil }
+
+func (a adapter) RepliedMessage(mc *messageContext) (*messageContext, bool) {
+	if mc.msg == nil {
+		return nil, false
+	}
+
+	ref := mc.msg.ReferencedMessage
+	if ref == nil || ref.Author == nil {
+		return nil, false
+	}
+
+	return a.c.newMessageContext(ref), true
+}
+
+func (a adapter) AppendSessionMessage(mc *messageContext) error {
+	return a.c.appendSessionMessage(mc)
+}
@@ -0,0 +1,675 @@
+package discord
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"arhat.dev/pkg/log"
+	"github.com/bwmarrin/discordgo"
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/types"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// webURL is the base url of links to discord web app
+const webURL = "https://discord.com/"
+
+func (c *discordBot) newMessageFromDiscordMessage(mc *messageContext, wf *bot.Workflow) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.timestamp
+	ret.Spans = parseMarkdown(mc.text, func(kind byte, id string) string {
+		switch kind {
+		case '@':
+			for _, u := range mc.msg.Mentions {
+				if u.ID == id {
+					return u.Username
+				}
+			}
+		case '#':
+			return c.channelName(id)
+		case '&':
+			role, err := c.client.State.Role(mc.guild, id)
+			if err == nil {
+				return role.Name
+			}
+		}
+
+		return id
+	})
+
+	for _, a := range mc.msg.Attachments {
+		c.appendAttachmentSpan(mc, ret, a, wf)
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	if mc.isPrivate {
+		ret.Flags |= rt.MessageFlag_Private
+	}
+
+	if mc.replyTo != 0 {
+		ret.Flags |= rt.MessageFlag_Reply
+		ret.ReplyTo = mc.replyTo
+	}
+
+	guild := mc.guild
+	if len(guild) == 0 {
+		guild = "@me"
+	}
+
+	ret.ChatName = c.channelName(mc.chat.channel)
+	ret.ChatLink = webURL + "channels/" + guild + "/" + mc.chat.channel
+	ret.Author = displayName(mc.msg)
+	ret.AuthorLink = webURL + "users/" + mc.user
+
+	return
+}
+
+// displayName returns guild nickname of the message author, or the username when
+// not set
+func displayName(msg *discordgo.Message) string {
+	if msg.Member != nil && len(msg.Member.Nick) != 0 {
+		return msg.Member.Nick
+	}
+
+	return msg.Author.Username
+}
+
+// appendAttachmentSpan adds the attachment span to the message, and downloads the
+// attachment in background when the workflow requires
+func (c *discordBot) appendAttachmentSpan(mc *messageContext, m *rt.Message, a *discordgo.MessageAttachment, wf *bot.Workflow) {
+	span := rt.Span{
+		URL: a.URL,
+		SpanMediaOptions: rt.SpanMediaOptions{
+			Filename:    a.Filename,
+			Size:        int64(a.Size),
+			ContentType: a.ContentType,
+		},
+	}
+
+	switch mimeType := a.ContentType; {
+	case strings.HasPrefix(mimeType, "image/"):
+		span.Flags = rt.SpanFlag_Image
+	case strings.HasPrefix(mimeType, "video/"):
+		span.Flags = rt.SpanFlag_Video
+	case strings.HasPrefix(mimeType, "audio/"):
+		span.Flags = rt.SpanFlag_Audio
+	default:
+		span.Flags = rt.SpanFlag_File
+	}
+
+	m.Spans = append(m.Spans, span)
+
+	if len(a.URL) == 0 || !wf.DownloadMedia() {
+		return
+	}
+
+	mediaSpan := &m.Spans[len(m.Spans)-1]
+	con := mc.con
+	url := a.URL
+
+	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
+		mc.logger.D("download attachment", log.Int64("size", mediaSpan.Size), log.String("content_type", mediaSpan.ContentType))
+
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			return c.download(url, cacheWR)
+		})
+		if err != nil {
+			mc.logger.I("failed to download attachment", log.Error(err))
+			c.sendErrorf(mc, "unable to download: %v", err)
+			return
+		}
+
+		contentType, ext := mediaSpan.ContentType, strings.TrimPrefix(path.Ext(mediaSpan.Filename), ".")
+		if len(contentType) == 0 || len(ext) == 0 {
+			var (
+				buf [32]byte
+				ft  types.Type
+			)
+
+			n, _ := cacheRD.Read(buf[:])
+			_, err = cacheRD.Seek(0, io.SeekStart)
+			if err != nil {
+				mc.logger.E("failed to seek to start", log.Error(err))
+				c.sendErrorf(mc, "bad cache reuse")
+				return
+			}
+
+			ft, err = filetype.Match(buf[:n])
+			if err == nil {
+				if len(contentType) == 0 {
+					contentType = ft.MIME.Value
+				}
+
+				if len(ext) == 0 {
+					ext = ft.Extension
+				}
+			}
+		}
+
+		if len(contentType) != 0 {
+			mediaSpan.ContentType = contentType
+		} else {
+			// provide default mime type for storage driver
+			mediaSpan.ContentType = "application/octet-stream"
+		}
+
+		var filename string
+		if len(mediaSpan.Filename) == 0 { // no filename set
+			filename = cacheRD.ID().String() + "." + ext
+		} else {
+			filename = mediaSpan.Filename
+			if len(path.Ext(filename)) == 0 {
+				filename += "." + ext
+			}
+		}
+
+		mc.logger.D("upload attachment",
+			log.String("filename", filename),
+			rt.LogCacheID(cacheRD.ID()),
+			log.Int64("size", sz),
+		)
+
+		sout, err := bot.Upload(&con, wf.Storage, filename, sz, cacheRD, mediaSpan.ContentType)
+		if err != nil {
+			mc.logger.I("failed to upload attachment", log.Error(err))
+			c.sendErrorf(mc, "unable to upload file: %v", err)
+			return
+		}
+
+		mediaSpan.Size = sz
+		mediaSpan.URL = sout.URL
+		mediaSpan.Data = cacheRD
+	})
+}
+
+// download fetches the attachment, attachment urls are public, no auth is required
+func (c *discordBot) download(url string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(c.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// markdownParser converts discord markdown to spans
+//
+// ref: https://support.discord.com/hc/en-us/articles/210298617
+type markdownParser struct {
+	// resolve returns the name of mentioned user (`@`), role (`&`) or channel (`#`)
+	resolve func(kind byte, id string) string
+
+	spans []rt.Span
+}
+
+// parseMarkdown converts content of discord message to spans
+func parseMarkdown(text string, resolve func(kind byte, id string) string) []rt.Span {
+	p := markdownParser{resolve: resolve}
+
+	// blockquote is line based
+	for len(text) != 0 {
+		var flags rt.SpanFlag
+		switch {
+		case strings.HasPrefix(text, ">>> "):
+			// all lines after are quoted
+			p.parseInline(text[4:], rt.SpanFlag_Blockquote)
+			return p.spans
+		case strings.HasPrefix(text, "> "):
+			flags = rt.SpanFlag_Blockquote
+			text = text[2:]
+		}
+
+		line, rest, found := cutLine(text)
+		p.parseInline(line, flags)
+		if found {
+			p.appendText(flags, "\n", "", "")
+		}
+
+		text = rest
+	}
+
+	return p.spans
+}
+
+// cutLine cuts text at the first newline outside of code blocks
+func cutLine(text string) (line, rest string, found bool) {
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\n':
+			return text[:i], text[i+1:], true
+		case strings.HasPrefix(text[i:], "```"):
+			end := strings.Index(text[i+3:], "```")
+			if end < 0 {
+				return text, "", false
+			}
+
+			i += 3 + end + 2
+		}
+	}
+
+	return text, "", false
+}
+
+// nolint:gocyclo
+func (p *markdownParser) parseInline(text string, flags rt.SpanFlag) {
+	var buf strings.Builder
+	flush := func() {
+		if buf.Len() != 0 {
+			p.appendText(flags, buf.String(), "", "")
+			buf.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+
+		switch c := text[i]; {
+		case c == '\\' && i+1 < len(text) && isASCIIPunct(text[i+1]):
+			buf.WriteByte(text[i+1])
+			i += 2
+		case strings.HasPrefix(rest, "```"):
+			end := strings.Index(rest[3:], "```")
+			if end < 0 {
+				buf.WriteString("```")
+				i += 3
+				continue
+			}
+
+			flush()
+			lang, code := splitCodeBlock(rest[3 : 3+end])
+			p.appendText(flags|rt.SpanFlag_Pre, code, "", lang)
+			i += 3 + end + 3
+		case c == '`':
+			marker := "`"
+			if strings.HasPrefix(rest, "``") {
+				marker = "``"
+			}
+
+			end := strings.Index(rest[len(marker):], marker)
+			if end <= 0 {
+				buf.WriteString(marker)
+				i += len(marker)
+				continue
+			}
+
+			flush()
+			code := rest[len(marker) : len(marker)+end]
+			if len(marker) == 2 {
+				code = strings.TrimSpace(code)
+			}
+
+			p.appendText(flags|rt.SpanFlag_Code, code, "", "")
+			i += len(marker) + end + len(marker)
+		case c == '<':
+			end := strings.IndexByte(rest, '>')
+			if end <= 0 || !p.appendEntity(flags, rest[1:end], flush) {
+				buf.WriteByte(c)
+				i++
+				continue
+			}
+
+			i += end + 1
+		case c == '[':
+			n := p.appendMaskedLink(flags, rest, flush)
+			if n == 0 {
+				buf.WriteByte(c)
+				i++
+				continue
+			}
+
+			i += n
+		case (strings.HasPrefix(rest, "https://") || strings.HasPrefix(rest, "http://")) &&
+			(i == 0 || !isWordChar(text[i-1])):
+			url := cutURL(rest)
+			flush()
+			p.appendText(flags|rt.SpanFlag_URL, url, url, "")
+			i += len(url)
+		case c == '*' || c == '_' || c == '~' || c == '|':
+			marker, f := styleMarker(rest)
+			if len(marker) == 0 {
+				buf.WriteByte(c)
+				i++
+				continue
+			}
+
+			end := findClosingMarker(text, i, marker)
+			if end < 0 {
+				buf.WriteString(marker)
+				i += len(marker)
+				continue
+			}
+
+			flush()
+			p.parseInline(text[i+len(marker):end], flags|f)
+			i = end + len(marker)
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+
+	flush()
+}
+
+// styleMarker returns the style marker at the start of text and its span flag
+//
+// spoiler (`||`) has no flag
+func styleMarker(text string) (string, rt.SpanFlag) {
+	for _, m := range [...]struct {
+		marker string
+		flag   rt.SpanFlag
+	}{
+		{"***", rt.SpanFlag_Bold | rt.SpanFlag_Italic},
+		{"**", rt.SpanFlag_Bold},
+		{"__", rt.SpanFlag_Underline},
+		{"~~", rt.SpanFlag_Strikethrough},
+		{"||", 0},
+		{"*", rt.SpanFlag_Italic},
+		{"_", rt.SpanFlag_Italic},
+	} {
+		if strings.HasPrefix(text, m.marker) {
+			return m.marker, m.flag
+		}
+	}
+
+	return "", 0
+}
+
+// findClosingMarker finds the closing marker of the one at text[i], returns -1
+// when not found
+//
+// content of the style should not start or end with space, and `_` only takes
+// effect at word boundaries
+func findClosingMarker(text string, i int, marker string) int {
+	start := i + len(marker)
+	if marker == "_" && i != 0 && isWordChar(text[i-1]) {
+		return -1
+	}
+
+	if start >= len(text) || text[start] == ' ' {
+		return -1
+	}
+
+	for j := start + 1; j+len(marker) <= len(text); j++ {
+		if !strings.HasPrefix(text[j:], marker) || text[j-1] == ' ' {
+			continue
+		}
+
+		next := j + len(marker)
+		if next < len(text) && text[next] == marker[0] {
+			// longer marker, e.g. `**` when looking for `*`
+			if len(marker) == 1 {
+				j++
+			}
+
+			continue
+		}
+
+		if marker == "_" && next < len(text) && isWordChar(text[next]) {
+			continue
+		}
+
+		return j
+	}
+
+	return -1
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < 0x80 && (unicode.IsPunct(rune(c)) || unicode.IsSymbol(rune(c)))
+}
+
+// splitCodeBlock splits language name from content of the code block
+func splitCodeBlock(text string) (lang, code string) {
+	first, rest, found := strings.Cut(text, "\n")
+	if found && len(first) != 0 && !strings.ContainsAny(first, " \t") {
+		text = rest
+	} else {
+		first = ""
+	}
+
+	return first, strings.TrimSuffix(strings.TrimPrefix(text, "\n"), "\n")
+}
+
+// cutURL returns the url at the start of text, trailing punctuations are excluded
+func cutURL(text string) string {
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '<'
+	})
+	if end < 0 {
+		end = len(text)
+	}
+
+	return strings.TrimRight(text[:end], ".,:;!?\"'")
+}
+
+// appendEntity handles `<...>` in markdown, which can be user/role mention, channel link,
+// custom emoji, timestamp or url without embed, it returns false when entity is unknown
+func (p *markdownParser) appendEntity(flags rt.SpanFlag, entity string, flush func()) bool {
+	var (
+		text, url, hint string
+	)
+
+	switch {
+	case strings.HasPrefix(entity, "@&") && isSnowflake(entity[2:]):
+		text = "@" + p.resolve('&', entity[2:])
+	case strings.HasPrefix(entity, "@!") && isSnowflake(entity[2:]):
+		hint = entity[2:]
+		text = "@" + p.resolve('@', hint)
+		flags |= rt.SpanFlag_Mention
+	case strings.HasPrefix(entity, "@") && isSnowflake(entity[1:]):
+		hint = entity[1:]
+		text = "@" + p.resolve('@', hint)
+		flags |= rt.SpanFlag_Mention
+	case strings.HasPrefix(entity, "#") && isSnowflake(entity[1:]):
+		text = "#" + p.resolve('#', entity[1:])
+	case strings.HasPrefix(entity, ":") || strings.HasPrefix(entity, "a:"):
+		// custom emoji <:name:id>
+		name, id, ok := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(entity, "a"), ":"), ":")
+		if !ok || !isSnowflake(id) {
+			return false
+		}
+
+		text = ":" + name + ":"
+	case strings.HasPrefix(entity, "t:"):
+		ts, _, _ := strings.Cut(entity[2:], ":")
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return false
+		}
+
+		text = time.Unix(sec, 0).UTC().Format(time.RFC3339)
+	case strings.HasPrefix(entity, "https://") || strings.HasPrefix(entity, "http://"):
+		text, url = entity, entity
+		flags |= rt.SpanFlag_URL
+	default:
+		return false
+	}
+
+	flush()
+	p.appendText(flags, text, url, hint)
+	return true
+}
+
+// appendMaskedLink handles `[text](url)` at the start of text, returns size of the
+// link, 0 if not a link
+func (p *markdownParser) appendMaskedLink(flags rt.SpanFlag, text string, flush func()) int {
+	labelEnd := strings.Index(text, "](")
+	if labelEnd <= 1 || strings.ContainsAny(text[1:labelEnd], "[\n") {
+		return 0
+	}
+
+	urlStart := labelEnd + 2
+	urlEnd := strings.IndexByte(text[urlStart:], ')')
+	if urlEnd <= 0 {
+		return 0
+	}
+
+	url := strings.Trim(text[urlStart:urlStart+urlEnd], "<>")
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return 0
+	}
+
+	flush()
+	p.appendText(flags|rt.SpanFlag_URL, text[1:labelEnd], url, "")
+	return urlStart + urlEnd + 1
+}
+
+func isSnowflake(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *markdownParser) appendText(flags rt.SpanFlag, text, url, hint string) {
+	if len(text) == 0 {
+		return
+	}
+
+	if len(p.spans) != 0 {
+		last := &p.spans[len(p.spans)-1]
+		if last.Flags == flags && last.URL == url && last.Hint == hint && !flags.IsLink() && !flags.IsPre() {
+			last.Text += text
+			return
+		}
+	}
+
+	p.spans = append(p.spans, rt.Span{Flags: flags, Text: text, URL: url, Hint: hint})
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, `*`, `\*`, `_`, `\_`, `~`, `\~`, "`", "\\`",
+	`|`, `\|`, `<`, `\<`, `>`, `\>`, `[`, `\[`, `]`, `\]`,
+)
+
+// formatSpans converts spans to discord markdown
+func formatSpans(spans []rt.Span) string {
+	var buf strings.Builder
+
+	for i := range spans {
+		formatSpan(&buf, &spans[i])
+	}
+
+	return buf.String()
+}
+
+// nolint:gocyclo
+func formatSpan(buf *strings.Builder, sp *rt.Span) {
+	if sp.IsMedia() {
+		switch {
+		case len(sp.URL) != 0:
+			name := sp.Filename
+			if len(name) == 0 {
+				name = sp.URL
+			}
+
+			buf.WriteString(maskedLink(name, sp.URL))
+		case len(sp.Filename) != 0:
+			buf.WriteString(markdownEscaper.Replace("[" + sp.Filename + "]"))
+		}
+
+		if len(sp.Caption) != 0 {
+			buf.WriteString(" ")
+			buf.WriteString(formatSpans(sp.Caption))
+		}
+
+		return
+	}
+
+	var text string
+	switch {
+	case sp.IsMention() && isSnowflake(sp.Hint):
+		text = "<@" + sp.Hint + ">"
+	case sp.IsURL() && len(sp.URL) != 0:
+		text = maskedLink(sp.Text, sp.URL)
+	case sp.IsPre():
+		text = "```" + sp.Hint + "\n" + strings.ReplaceAll(sp.Text, "```", "`\u200b``") + "\n```"
+	case sp.IsCode():
+		if strings.Contains(sp.Text, "`") {
+			text = "`` " + sp.Text + " ``"
+		} else {
+			text = "`" + sp.Text + "`"
+		}
+	default:
+		text = markdownEscaper.Replace(sp.Text)
+	}
+
+	if !sp.IsPre() && !sp.IsCode() {
+		if sp.IsStrikethrough() {
+			text = wrapMarker(text, "~~")
+		}
+
+		if sp.IsUnderline() {
+			text = wrapMarker(text, "__")
+		}
+
+		if sp.IsItalic() {
+			text = wrapMarker(text, "*")
+		}
+
+		if sp.IsBold() {
+			text = wrapMarker(text, "**")
+		}
+	}
+
+	if sp.IsBlockquote() {
+		text = "> " + strings.ReplaceAll(text, "\n", "\n> ")
+	}
+
+	buf.WriteString(text)
+}
+
+// maskedLink formats `[text](url)`
+func maskedLink(text, url string) string {
+	return "[" + markdownEscaper.Replace(text) + "](" + strings.ReplaceAll(url, ")", "%29") + ")"
+}
+
+// wrapMarker wraps text with style marker, leading and trailing spaces are kept
+// outside of the markers
+func wrapMarker(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if len(trimmed) == 0 {
+		return text
+	}
+
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
@@ -0,0 +1,55 @@
+package discord
+
+import (
+	"strconv"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/bwmarrin/discordgo"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// snowflake converts discord id to uint64, discord ids are unique across all
+// resources
+func snowflake(id string) uint64 {
+	v, _ := strconv.ParseUint(id, 10, 64)
+	return v
+}
+
+func idOf(v uint64) string { return strconv.FormatUint(v, 10) }
+
+func userIDOf(user string) rt.UserID      { return rt.UserID(snowflake(user)) }
+func messageIDOf(msg string) rt.MessageID { return rt.MessageID(snowflake(msg)) }
+
+// chatIDWrapper is the chat data stored in session requests
+type chatIDWrapper struct {
+	channel string
+}
+
+func (c chatIDWrapper) ID() rt.ChatID { return rt.ChatID(snowflake(c.channel)) }
+
+type messageContext struct {
+	con conversationImpl
+
+	chat  chatIDWrapper
+	guild string
+	user  string
+
+	// msg is the original message, nil for application commands
+	msg *discordgo.Message
+
+	msgID   rt.MessageID
+	replyTo rt.MessageID
+
+	// text in discord markdown
+	text string
+
+	isPrivate bool
+	// isAdmin is set when the sender has admin permissions in the guild
+	isAdmin bool
+
+	timestamp time.Time
+
+	logger log.Interface
+}
@@ -0,0 +1,65 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// endpointTransport redirects discordgo requests to custom endpoints
+//
+// discordgo has all endpoints hard coded as package variables, sharing them
+// across bots, so the custom rest api url is applied to requests instead
+type endpointTransport struct {
+	// apiURL replaces discordgo.EndpointAPI when set
+	apiURL string
+
+	// gatewayURL is returned as the result of discordgo.EndpointGateway when set
+	gatewayURL string
+
+	base http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqURL := req.URL.String()
+	if !strings.HasPrefix(reqURL, discordgo.EndpointAPI) {
+		return t.base.RoundTrip(req)
+	}
+
+	if len(t.gatewayURL) != 0 && reqURL == discordgo.EndpointGateway {
+		data, err := json.Marshal(map[string]string{"url": t.gatewayURL})
+		if err != nil {
+			return nil, err
+		}
+
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(data)),
+			Request:    req,
+		}, nil
+	}
+
+	if len(t.apiURL) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	u, err := url.Parse(t.apiURL + strings.TrimPrefix(reqURL, discordgo.EndpointAPI))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.URL, req.Host = u, u.Host
+
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,41 @@
+package discord
+
+import (
+	"fmt"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func plain(text string) rt.Span { return rt.Span{Flags: rt.SpanFlag_PlainText, Text: text} }
+func bold(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Bold, Text: text} }
+
+// sendText sends spans as a single message
+func (c *discordBot) sendText(con *conversationImpl, replyTo rt.MessageID, body ...rt.Span) (msgID rt.MessageID, err error) {
+	msgIDs, err := con.SendMessage(c.Context(), rt.SendMessageOptions{
+		ReplyTo: replyTo,
+		Body:    body,
+	})
+	if err != nil {
+		c.Logger().E("failed to send message", log.Error(err))
+		return
+	}
+
+	if len(msgIDs) != 0 {
+		msgID = msgIDs[0]
+	}
+
+	return
+}
+
+// reply sends message to the channel where mc comes from as a reply to mc
+//
+// application commands are not messages, replies to them are sent as normal messages
+func (c *discordBot) reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	return c.sendText(&mc.con, mc.msgID, body...)
+}
+
+func (c *discordBot) sendErrorf(mc *messageContext, format string, args ...any) {
+	c.reply(mc, plain("Internal bot error: "), bold(fmt.Sprintf(format, args...)))
+}
@@ -0,0 +1,332 @@
+package email
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+var _ bot.Interface = (*emailBot)(nil)
+
+type emailBot struct {
+	bot.BaseBot
+
+	from *mail.Address
+
+	imap *imapOptions
+
+	lmtpNetwork  string
+	lmtpListen   string
+	lmtpListener net.Listener
+
+	smtpServer   string
+	smtpHost     string
+	smtpTLS      *tls.Config
+	smtpStartTLS bool
+	smtpUsername string
+	smtpPassword string
+
+	admins map[string]struct{}
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	history   *bot.MessageHistory[chatIDWrapper, *messageContext]
+	threads   threadRegistry
+	callbacks *bot.CallbackRegistry
+	msgSeq    uint64
+
+	// mails are handled one by one in the order received
+	msgCh chan *messageContext
+}
+
+// Configure listens on the lmtp address
+func (c *emailBot) Configure() (err error) {
+	if len(c.lmtpListen) == 0 {
+		return nil
+	}
+
+	if c.lmtpNetwork == "unix" {
+		// remove stale socket file
+		_ = os.Remove(c.lmtpListen)
+	}
+
+	c.lmtpListener, err = net.Listen(c.lmtpNetwork, c.lmtpListen)
+	if err != nil {
+		return fmt.Errorf("listen lmtp: %w", err)
+	}
+
+	return nil
+}
+
+// Start polls the imap mailbox and serves lmtp, http is not used
+func (c *emailBot) Start(baseURL string, mux rt.Mux) error {
+	if c.imap != nil {
+		go c.pollIMAP()
+	}
+
+	if c.lmtpListener != nil {
+		go c.serveLMTP(c.lmtpListener)
+	}
+
+	go c.handleMessages()
+
+	return nil
+}
+
+func (c *emailBot) pollIMAP() {
+	var client *imapClient
+	defer func() {
+		if client != nil {
+			client.close()
+		}
+	}()
+
+	ticker := time.NewTicker(c.imap.interval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		if client == nil {
+			client, err = dialIMAP(c.Context(), c.imap)
+			if err != nil {
+				c.Logger().I("failed to connect imap server", log.Error(err))
+			}
+		}
+
+		if client != nil {
+			err = c.fetchUnseen(client)
+			if err != nil {
+				c.Logger().I("failed to fetch mails", log.Error(err))
+
+				client.close()
+				client = nil
+			}
+		}
+
+		select {
+		case <-c.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *emailBot) fetchUnseen(client *imapClient) error {
+	uids, err := client.searchUnseen()
+	if err != nil {
+		return fmt.Errorf("search unseen: %w", err)
+	}
+
+	for _, uid := range uids {
+		raw, err := client.fetch(uid)
+		if err != nil {
+			return fmt.Errorf("fetch mail %d: %w", uid, err)
+		}
+
+		err = c.onMail(raw)
+		if err != nil {
+			c.Logger().I("bad mail from imap", log.Uint32("uid", uid), log.Error(err))
+		}
+
+		// mark as seen even if it's bad, to avoid fetching it again
+		err = client.markSeen(uid)
+		if err != nil {
+			return fmt.Errorf("mark mail %d seen: %w", uid, err)
+		}
+	}
+
+	return nil
+}
+
+// onMail parses the raw mail and enqueues it for handling
+func (c *emailBot) onMail(raw []byte) error {
+	m, err := parseMail(raw)
+	if err != nil {
+		return err
+	}
+
+	from := normalizeAddress(m.from.Address)
+	self := normalizeAddress(c.from.Address)
+	if from == self || m.autoSubmitted {
+		return nil
+	}
+
+	// participants of the thread, excluding the bot
+	var participants []string
+	for _, addr := range append([]*mail.Address{m.from}, m.recipients...) {
+		a := normalizeAddress(addr.Address)
+		if a != self && !contains(participants, a) {
+			participants = append(participants, a)
+		}
+	}
+
+	if len(m.messageID) == 0 {
+		m.messageID = c.newMessageID()
+	}
+
+	mc := &messageContext{
+		mail: m,
+		from: from,
+
+		msgID: messageIDOf(m.messageID),
+
+		timestamp: m.date.UTC(),
+	}
+
+	// the thread is identified by its first mail
+	switch {
+	case len(m.references) != 0:
+		mc.chat = chatIDWrapper{id: m.references[0]}
+	case len(m.inReplyTo) != 0:
+		mc.chat = chatIDWrapper{id: m.inReplyTo}
+	default:
+		mc.chat = chatIDWrapper{id: m.messageID}
+	}
+
+	if _, known := c.threads.get(mc.chat.ID()); !known && len(participants) == 1 {
+		// only the bot was addressed out of existing threads
+		mc.chat = privateChatOf(from)
+	}
+
+	if len(m.inReplyTo) != 0 {
+		mc.replyTo = messageIDOf(m.inReplyTo)
+	}
+
+	mc.con = conversationImpl{
+		bot:  c,
+		chat: mc.chat,
+	}
+
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.chat.ID()),
+		rt.LogSenderID(userIDOf(from)),
+	)
+
+	references := append(m.references, m.messageID)
+	if len(references) > maxReferences {
+		references = append(references[:1], references[len(references)-maxReferences+1:]...)
+	}
+
+	c.threads.update(mc.chat.ID(), trimReplyPrefix(m.subject), m.messageID, references, participants...)
+	c.history.Add(mc)
+
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+
+	return nil
+}
+
+func (c *emailBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+		}
+	}
+}
+
+func (c *emailBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	// botcmd in subject (e.g. `[new] Weekly sync`), or in the first line of the body
+	cmd, params, ok := parseSubjectCommand(mc.mail.subject)
+	if !ok {
+		line, _, _ := strings.Cut(mc.mail.text, "\n")
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "/") {
+			cmd, params, _ = strings.Cut(line, " ")
+			ok = true
+		}
+	}
+
+	if ok && cmd == clickCmd {
+		return c.handleClick(mc, strings.TrimSpace(params))
+	}
+
+	if ok {
+		handled, err := c.engine.HandleBotCmd(mc, cmd, strings.TrimSpace(params))
+		if handled {
+			return err
+		}
+	}
+
+	// filter private message for input to this bot
+	handled, err := c.engine.HandleInput(mc)
+	if handled {
+		return err
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+// handleClick calls the OnClick callback of the button with the id, failures are
+// replied to the sender
+func (c *emailBot) handleClick(mc *messageContext, id string) error {
+	onClick, ok := c.callbacks.Find(id)
+	if !ok {
+		_, err := c.reply(mc, plain("The button has expired."))
+		return err
+	}
+
+	go func() {
+		err := onClick()
+		if err != nil {
+			mc.logger.I("failed to handle button click", log.Error(err))
+			_, _ = c.reply(mc, plain("Failed: "+err.Error()))
+		}
+	}()
+
+	return nil
+}
+
+// parseSubjectCommand parses `[cmd] params` in subject as botcmd `/cmd params`,
+// replies (subject prefixed with `Re:`) are not parsed
+func parseSubjectCommand(subject string) (cmd, params string, ok bool) {
+	subject = strings.TrimSpace(subject)
+	if !strings.HasPrefix(subject, "[") {
+		return
+	}
+
+	name, params, ok := strings.Cut(subject[1:], "]")
+	if !ok || len(name) == 0 || strings.ContainsAny(name, " \t") {
+		return "", "", false
+	}
+
+	return "/" + strings.ToLower(name), strings.TrimSpace(params), true
+}
+
+func (c *emailBot) isAdmin(addr string) bool {
+	_, ok := c.admins[addr]
+	return ok
+}
+
+func (c *emailBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromMail(mc, s.Workflow()))
+
+	return nil
+}
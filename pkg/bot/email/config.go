@@ -0,0 +1,214 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/tlshelper"
+	"arhat.dev/rs"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "email"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// IMAPConfig for polling incoming mails
+type IMAPConfig struct {
+	rs.BaseField
+
+	// Server address with port (e.g. imap.example.com:993)
+	Server string              `yaml:"server"`
+	TLS    tlshelper.TLSConfig `yaml:"tls"`
+
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Mailbox to poll
+	//
+	// defaults to INBOX
+	Mailbox string `yaml:"mailbox"`
+
+	// PollInterval is the interval between two checks for unseen mails
+	//
+	// defaults to 1m
+	PollInterval time.Duration `yaml:"pollInterval"`
+}
+
+// LMTPConfig for accepting incoming mails from the mail server
+type LMTPConfig struct {
+	rs.BaseField
+
+	// Network of the listener, one of [tcp, unix]
+	//
+	// defaults to tcp
+	Network string `yaml:"network"`
+
+	// Listen address (e.g. 127.0.0.1:2424 or /run/mbot/lmtp.sock)
+	Listen string `yaml:"listen"`
+}
+
+// SMTPConfig for sending mails
+type SMTPConfig struct {
+	rs.BaseField
+
+	// Server address with port (e.g. smtp.example.com:465)
+	Server string `yaml:"server"`
+
+	// TLS config, when enabled without startTLS, connections are tls from the start
+	TLS tlshelper.TLSConfig `yaml:"tls"`
+
+	// StartTLS upgrades plain text connection with STARTTLS
+	StartTLS bool `yaml:"startTLS"`
+
+	// Username and Password for PLAIN authentication, if any
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Config for email bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// From is the address of the bot (e.g. `mbot <mbot@example.com>`)
+	From string `yaml:"from"`
+
+	// Admins are addresses allowed to use botcmds of adminOnly workflows in
+	// threads with others
+	Admins []string `yaml:"admins"`
+
+	IMAP IMAPConfig `yaml:"imap"`
+	LMTP LMTPConfig `yaml:"lmtp"`
+	SMTP SMTPConfig `yaml:"smtp"`
+
+	// CallbackTTL is how long buttons with callbacks are clickable
+	//
+	// defaults to 24h
+	CallbackTTL time.Duration `yaml:"callbackTTL"`
+}
+
+// nolint:gocyclo
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", c.From, err)
+	}
+
+	if len(c.IMAP.Server) == 0 && len(c.LMTP.Listen) == 0 {
+		return nil, fmt.Errorf("one of imap or lmtp is required")
+	}
+
+	smtpHost, _, err := net.SplitHostPort(c.SMTP.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp server address %q: %w", c.SMTP.Server, err)
+	}
+
+	smtpTLS, err := c.SMTP.TLS.GetTLSConfig(false)
+	if err != nil {
+		return nil, fmt.Errorf("create smtp tls config: %w", err)
+	}
+
+	if smtpTLS != nil && len(smtpTLS.ServerName) == 0 {
+		smtpTLS.ServerName = smtpHost
+	}
+
+	if c.SMTP.StartTLS && smtpTLS == nil {
+		return nil, fmt.Errorf("smtp tls config is required for startTLS")
+	}
+
+	eb := &emailBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		from: from,
+
+		smtpServer:   c.SMTP.Server,
+		smtpHost:     smtpHost,
+		smtpTLS:      smtpTLS,
+		smtpStartTLS: c.SMTP.StartTLS,
+		smtpUsername: c.SMTP.Username,
+		smtpPassword: c.SMTP.Password,
+
+		admins: make(map[string]struct{}, len(c.Admins)),
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+
+		callbacks: bot.NewCallbackRegistry(rtCtx.Context(), c.CallbackTTL, callbackIDSize),
+
+		msgCh: make(chan *messageContext, 64),
+	}
+
+	for _, addr := range c.Admins {
+		eb.admins[normalizeAddress(addr)] = struct{}{}
+	}
+
+	if len(c.IMAP.Server) != 0 {
+		imapHost, _, err := net.SplitHostPort(c.IMAP.Server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid imap server address %q: %w", c.IMAP.Server, err)
+		}
+
+		imapTLS, err := c.IMAP.TLS.GetTLSConfig(false)
+		if err != nil {
+			return nil, fmt.Errorf("create imap tls config: %w", err)
+		}
+
+		if imapTLS != nil && len(imapTLS.ServerName) == 0 {
+			imapTLS.ServerName = imapHost
+		}
+
+		eb.imap = &imapOptions{
+			server:   c.IMAP.Server,
+			tls:      imapTLS,
+			username: c.IMAP.Username,
+			password: c.IMAP.Password,
+			mailbox:  c.IMAP.Mailbox,
+			interval: c.IMAP.PollInterval,
+		}
+
+		if len(eb.imap.mailbox) == 0 {
+			eb.imap.mailbox = "INBOX"
+		}
+
+		if eb.imap.interval <= 0 {
+			eb.imap.interval = time.Minute
+		}
+	}
+
+	if len(c.LMTP.Listen) != 0 {
+		eb.lmtpNetwork, eb.lmtpListen = strings.ToLower(c.LMTP.Network), c.LMTP.Listen
+		switch eb.lmtpNetwork {
+		case "":
+			eb.lmtpNetwork = "tcp"
+		case "tcp", "unix":
+		default:
+			return nil, fmt.Errorf("unsupported lmtp network %q", c.LMTP.Network)
+		}
+	}
+
+	eb.wfSet, err = c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	eb.history = bot.NewMessageHistory[chatIDWrapper, *messageContext](0)
+	eb.threads.init()
+	eb.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: eb}, eb.sessions, &eb.wfSet, engine.Options{
+		HelpInPrivate:    true,
+		AdminOnly:        "Only admins can use this bot in threads with others.",
+		CheckPrivateChat: "Please check the mail from me.",
+		ReplyOnly:        " can only be used in reply to a mail.",
+	})
+
+	return eb, nil
+}
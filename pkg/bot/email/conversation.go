@@ -0,0 +1,217 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"arhat.dev/mbot/pkg/bot/html"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const (
+	// clickCmd is the botcmd clicking the OnClick button with the id in params
+	clickCmd = "/click"
+
+	// callbackIDSize is the number of random bytes in ids of OnClick buttons, ids
+	// are typed by users, so they are kept short
+	callbackIDSize = 4
+)
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *emailBot
+
+	chat chatIDWrapper
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// every message is sent as a mail to participants of the thread, callbacks with
+// url are appended as links, and OnClick callbacks are appended as `/click <id>`
+// botcmds to reply with
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) ([]rt.MessageID, error) {
+	chatID := c.chat.ID()
+
+	t, ok := c.bot.threads.get(chatID)
+	if !ok {
+		if !c.chat.private {
+			return nil, fmt.Errorf("unknown thread %q", c.chat.id)
+		}
+
+		t = thread{
+			subject:      c.bot.displayName(),
+			participants: []string{c.chat.id},
+		}
+	}
+
+	body := opts.Body
+	for _, row := range opts.Callbacks {
+		for _, cb := range row {
+			switch {
+			case !cb.URL.IsNil():
+				body = append(body,
+					rt.Span{Text: "\n"},
+					rt.Span{Flags: rt.SpanFlag_URL, Text: cb.Text, URL: cb.URL.Get()},
+				)
+			case !cb.OnClick.IsNil():
+				id, err := c.bot.callbacks.Add(cb.OnClick.Get())
+				if err != nil {
+					return nil, fmt.Errorf("add button callback: %w", err)
+				}
+
+				body = append(body,
+					rt.Span{Text: "\n" + cb.Text + ": reply with "},
+					rt.Span{Flags: rt.SpanFlag_Code, Text: clickCmd + " " + id},
+				)
+			}
+		}
+	}
+
+	plain, formatted := html.Format(body)
+
+	m := &outgoingMail{
+		from:       c.bot.from,
+		to:         t.participants,
+		subject:    t.subject,
+		messageID:  c.bot.newMessageID(),
+		inReplyTo:  t.lastMsgID,
+		references: t.references,
+
+		plain: plain,
+		html:  formatted,
+	}
+
+	if opts.ReplyTo != 0 {
+		if msgID := c.bot.threads.messageID(opts.ReplyTo); len(msgID) != 0 {
+			m.inReplyTo = msgID
+		}
+	}
+
+	if len(m.inReplyTo) != 0 && !strings.HasPrefix(strings.ToLower(m.subject), "re:") {
+		m.subject = "Re: " + m.subject
+	}
+
+	if len(m.inReplyTo) != 0 && !contains(m.references, m.inReplyTo) {
+		m.references = append(m.references, m.inReplyTo)
+	}
+
+	raw, err := m.build()
+	if err != nil {
+		return nil, fmt.Errorf("build mail: %w", err)
+	}
+
+	err = c.bot.sendMail(ctx, m.to, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	references := append(m.references, m.messageID)
+	if len(references) > maxReferences {
+		references = append(references[:1], references[len(references)-maxReferences+1:]...)
+	}
+
+	c.bot.threads.update(chatID, t.subject, m.messageID, references, t.participants...)
+
+	return []rt.MessageID{messageIDOf(m.messageID)}, nil
+}
+
+// displayName is the name of the bot in from address, or the local part of the
+// address when not set
+func (c *emailBot) displayName() string {
+	if len(c.from.Name) != 0 {
+		return c.from.Name
+	}
+
+	name, _, _ := strings.Cut(c.from.Address, "@")
+	return name
+}
+
+// newMessageID generates a unique Message-ID in the domain of the bot address
+func (c *emailBot) newMessageID() string {
+	domain := c.from.Address[strings.LastIndexByte(c.from.Address, '@')+1:]
+
+	return "<mbot." + strconv.FormatInt(time.Now().UnixNano(), 36) +
+		"." + strconv.FormatUint(atomic.AddUint64(&c.msgSeq, 1), 36) + "@" + domain + ">"
+}
+
+const smtpTimeout = time.Minute
+
+// sendMail sends the raw mail to recipients
+func (c *emailBot) sendMail(ctx context.Context, to []string, raw []byte) (err error) {
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	if c.smtpTLS != nil && !c.smtpStartTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.smtpTLS}).DialContext(ctx, "tcp", c.smtpServer)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.smtpServer)
+	}
+	if err != nil {
+		return fmt.Errorf("dial smtp server: %w", err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, c.smtpHost)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("create smtp client: %w", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	if c.smtpStartTLS {
+		err = client.StartTLS(c.smtpTLS)
+		if err != nil {
+			return fmt.Errorf("smtp starttls: %w", err)
+		}
+	}
+
+	if len(c.smtpUsername) != 0 {
+		err = client.Auth(smtp.PlainAuth("", c.smtpUsername, c.smtpPassword, c.smtpHost))
+		if err != nil {
+			return fmt.Errorf("smtp auth: %w", err)
+		}
+	}
+
+	err = client.Mail(c.from.Address)
+	if err != nil {
+		return fmt.Errorf("smtp mail from: %w", err)
+	}
+
+	for _, addr := range to {
+		err = client.Rcpt(addr)
+		if err != nil {
+			return fmt.Errorf("smtp rcpt to %q: %w", addr, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp data: %w", err)
+	}
+
+	_, err = w.Write(raw)
+	if err != nil {
+		return fmt.Errorf("write mail data: %w", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("send mail data: %w", err)
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,544 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// testMail builds a raw mail, headers with empty value are omitted
+func testMail(headers [][2]string, body string) []byte {
+	var buf strings.Builder
+	for _, h := range headers {
+		if len(h[1]) != 0 {
+			buf.WriteString(h[0] + ": " + h[1] + "\r\n")
+		}
+	}
+
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(buf.String())
+}
+
+// textMail builds a plain text mail, In-Reply-To is the last one in references
+func textMail(from, to, cc, subject, msgID, references, body string) []byte {
+	refs := strings.Fields(references)
+
+	inReplyTo := ""
+	if len(refs) != 0 {
+		inReplyTo = refs[len(refs)-1]
+	}
+
+	return testMail([][2]string{
+		{"From", from},
+		{"To", to},
+		{"Cc", cc},
+		{"Subject", subject},
+		{"Message-ID", msgID},
+		{"In-Reply-To", inReplyTo},
+		{"References", references},
+		{"Content-Type", "text/plain; charset=utf-8"},
+	}, body)
+}
+
+const testAttachmentMail = `--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+hello =E4=BD=A0=E5=A5=BD
+
+On Mon, 1 Aug 2022, Alice wrote:
+> quoted
+
+--=20
+Bob
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>hello <b>html</b></p>
+--inner--
+--outer
+Content-Type: image/png
+Content-Disposition: attachment; filename="=?utf-8?q?shot=E5=9B=BE.png?="
+Content-Transfer-Encoding: base64
+
+iVBORw0K
+Ggo=
+--outer--
+`
+
+func TestParseMail(t *testing.T) {
+	m, err := parseMail(testMail([][2]string{
+		{"From", "Bob <bob@example.com>"},
+		{"To", "mbot@example.com"},
+		{"Cc", "Alice <alice@example.com>"},
+		{"Subject", "=?utf-8?q?Re:_Weekly_sync_=E5=91=A8=E4=BC=9A?="},
+		{"Message-ID", "<2@example.com>"},
+		{"In-Reply-To", "<1@example.com>"},
+		{"References", "<0@example.com>\r\n <1@example.com>"},
+		{"Auto-Submitted", "no"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `multipart/mixed; boundary="outer"`},
+	}, testAttachmentMail))
+	require.NoError(t, err)
+
+	assert.Equal(t, "<2@example.com>", m.messageID)
+	assert.Equal(t, "<1@example.com>", m.inReplyTo)
+	assert.EqualValues(t, []string{"<0@example.com>", "<1@example.com>"}, m.references)
+	assert.Equal(t, "bob@example.com", m.from.Address)
+	assert.Len(t, m.recipients, 2)
+	assert.Equal(t, "Re: Weekly sync 周会", m.subject)
+	assert.False(t, m.autoSubmitted)
+
+	assert.Equal(t, "hello 你好", m.text)
+	assert.EqualValues(t, []rt.Span{{Text: "hello 你好"}}, m.spans)
+
+	require.Len(t, m.attachments, 1)
+	assert.Equal(t, "shot图.png", m.attachments[0].filename)
+	assert.Equal(t, "image/png", m.attachments[0].contentType)
+	assert.Equal(t, []byte("\x89PNG\r\n\x1a\n"), m.attachments[0].data)
+
+	// html only
+	m, err = parseMail(testMail([][2]string{
+		{"From", "bob@example.com"},
+		{"Content-Type", "text/html"},
+		{"Auto-Submitted", "auto-replied"},
+	}, `<p>see <a href="https://example.com">this</a></p><blockquote type="cite">quoted</blockquote>`))
+	require.NoError(t, err)
+
+	assert.True(t, m.autoSubmitted)
+	assert.Equal(t, "see this", m.text)
+	assert.EqualValues(t, []rt.Span{
+		{Text: "see "},
+		{Flags: rt.SpanFlag_URL, Text: "this", URL: "https://example.com"},
+	}, m.spans)
+}
+
+func TestParseSubjectCommand(t *testing.T) {
+	for _, test := range []struct {
+		subject string
+		cmd     string
+		params  string
+		ok      bool
+	}{
+		{"[new] Weekly sync", "/new", "Weekly sync", true},
+		{" [END]", "/end", "", true},
+		{"Re: [new] Weekly sync", "", "", false},
+		{"[not a cmd] foo", "", "", false},
+		{"[] foo", "", "", false},
+		{"Weekly sync", "", "", false},
+	} {
+		t.Run(test.subject, func(t *testing.T) {
+			cmd, params, ok := parseSubjectCommand(test.subject)
+			assert.Equal(t, test.cmd, cmd)
+			assert.Equal(t, test.params, params)
+			assert.Equal(t, test.ok, ok)
+		})
+	}
+}
+
+func TestOutgoingMail(t *testing.T) {
+	from, err := mail.ParseAddress("mbot <mbot@example.com>")
+	require.NoError(t, err)
+
+	m := &outgoingMail{
+		from:       from,
+		to:         []string{"alice@example.com", "bob@example.com"},
+		subject:    "Re: 周会",
+		messageID:  "<3@example.com>",
+		inReplyTo:  "<2@example.com>",
+		references: []string{"<1@example.com>", "<2@example.com>"},
+		plain:      "hi 你好",
+		html:       "<b>hi</b> 你好",
+	}
+
+	raw, err := m.build()
+	require.NoError(t, err)
+
+	parsed, err := parseMail(raw)
+	require.NoError(t, err)
+
+	assert.Equal(t, "mbot@example.com", parsed.from.Address)
+	assert.Len(t, parsed.recipients, 2)
+	assert.Equal(t, "Re: 周会", parsed.subject)
+	assert.Equal(t, "<3@example.com>", parsed.messageID)
+	assert.Equal(t, "<2@example.com>", parsed.inReplyTo)
+	assert.EqualValues(t, m.references, parsed.references)
+	assert.True(t, parsed.autoSubmitted)
+	assert.Equal(t, "hi 你好", parsed.text)
+}
+
+// fakeIMAP serves a single mailbox
+type fakeIMAP struct {
+	l net.Listener
+
+	mu    sync.Mutex
+	mails []*fakeMail
+}
+
+type fakeMail struct {
+	uid  int
+	raw  []byte
+	seen bool
+}
+
+func newFakeIMAP(t *testing.T) *fakeIMAP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	s := &fakeIMAP{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeIMAP) add(raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mails = append(s.mails, &fakeMail{uid: len(s.mails) + 1, raw: raw})
+}
+
+func (s *fakeIMAP) find(uid string) *fakeMail {
+	for _, m := range s.mails {
+		if strconv.Itoa(m.uid) == uid {
+			return m
+		}
+	}
+
+	return nil
+}
+
+func (s *fakeIMAP) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("* OK fake imap ready")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			_ = tp.PrintfLine("* BAD invalid command")
+			continue
+		}
+
+		tag, cmd := fields[0], strings.ToUpper(fields[1])
+		if cmd == "UID" && len(fields) > 2 {
+			cmd += " " + strings.ToUpper(fields[2])
+		}
+
+		s.mu.Lock()
+		switch {
+		case cmd == "LOGIN":
+			if fields[2] != `"mbot"` || fields[3] != `"password"` {
+				_ = tp.PrintfLine("%s NO invalid credentials", tag)
+				s.mu.Unlock()
+				continue
+			}
+		case cmd == "SELECT":
+			_ = tp.PrintfLine("* %d EXISTS", len(s.mails))
+		case cmd == "UID SEARCH":
+			var uids []string
+			for _, m := range s.mails {
+				if !m.seen {
+					uids = append(uids, strconv.Itoa(m.uid))
+				}
+			}
+
+			_ = tp.PrintfLine("* SEARCH %s", strings.Join(uids, " "))
+		case cmd == "UID FETCH":
+			if m := s.find(fields[3]); m != nil {
+				_, _ = fmt.Fprintf(tp.W, "* %d FETCH (UID %d BODY[] {%d}\r\n", m.uid, m.uid, len(m.raw))
+				_, _ = tp.W.Write(m.raw)
+				_ = tp.PrintfLine(")")
+			}
+		case cmd == "UID STORE":
+			if m := s.find(fields[3]); m != nil {
+				m.seen = true
+			}
+		case cmd == "LOGOUT":
+			_ = tp.PrintfLine("* BYE")
+			_ = tp.PrintfLine("%s OK", tag)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		_ = tp.PrintfLine("%s OK done", tag)
+	}
+}
+
+// fakeSMTP receives mails sent by the bot
+type fakeSMTP struct {
+	l net.Listener
+
+	mails chan sentMail
+}
+
+type sentMail struct {
+	rcpts []string
+	mail  *mailMessage
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	s := &fakeSMTP{l: l, mails: make(chan sentMail, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(t, conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTP) serve(t *testing.T, conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ESMTP")
+
+	var rcpts []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250-localhost")
+			_ = tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			rcpts = nil
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			rcpts = append(rcpts, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			raw, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			m, err := parseMail(raw)
+			assert.NoError(t, err)
+			s.mails <- sentMail{rcpts: rcpts, mail: m}
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("500 unknown command")
+		}
+	}
+}
+
+func (s *fakeSMTP) expect(t *testing.T) sentMail {
+	select {
+	case m := <-s.mails:
+		return m
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no mail sent")
+		return sentMail{}
+	}
+}
+
+func TestBot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	imapServer := newFakeIMAP(t)
+	smtpServer := newFakeSMTP(t)
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, true),
+
+		From:   "mbot <mbot@example.com>",
+		Admins: []string{"Alice@Example.com"},
+		IMAP: IMAPConfig{
+			Server:       imapServer.l.Addr().String(),
+			Username:     "mbot",
+			Password:     "password",
+			PollInterval: 20 * time.Millisecond,
+		},
+		LMTP: LMTPConfig{
+			Listen: "127.0.0.1:0",
+		},
+		SMTP: SMTPConfig{
+			Server: smtpServer.l.Addr().String(),
+		},
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	require.NoError(t, b.Configure())
+	require.NoError(t, b.Start("", nil))
+
+	const (
+		alice = "Alice <alice@example.com>"
+		bob   = "Bob <bob@example.com>"
+		mbot  = "mbot@example.com"
+	)
+
+	t.Run("Session", func(t *testing.T) {
+		imapServer.add(textMail(bob, mbot, alice, "[new] Bob's topic", "<0@example.com>", "", "hi"))
+		sent := smtpServer.expect(t)
+		assert.Equal(t, "Only admins can use this bot in threads with others.", sent.mail.text)
+
+		imapServer.add(textMail(alice, mbot+", "+bob, "", "[new] Weekly sync", "<1@example.com>", "", "agenda"))
+		sent = smtpServer.expect(t)
+		assert.ElementsMatch(t, []string{"alice@example.com", "bob@example.com"}, sent.rcpts)
+		assert.Equal(t, "Re: [new] Weekly sync", sent.mail.subject)
+		assert.Equal(t, "<1@example.com>", sent.mail.inReplyTo)
+		assert.Contains(t, sent.mail.text, "created Weekly sync")
+
+		imapServer.add(testMail([][2]string{
+			{"From", bob},
+			{"To", mbot},
+			{"Cc", alice},
+			{"Subject", "Re: [new] Weekly sync"},
+			{"Message-ID", "<2@example.com>"},
+			{"In-Reply-To", sent.mail.messageID},
+			{"References", "<1@example.com> " + sent.mail.messageID},
+			{"Content-Type", `multipart/mixed; boundary="outer"`},
+		}, testAttachmentMail))
+		imapServer.add(textMail(bob, mbot, alice, "Re: [new] Weekly sync", "<3@example.com>", "<1@example.com>", "not relevant"))
+		imapServer.add(textMail(alice, mbot, bob, "Re: [new] Weekly sync", "<4@example.com>", "<1@example.com> <3@example.com>", "/ignore"))
+
+		sent = smtpServer.expect(t)
+		assert.Equal(t, "Ignored.", sent.mail.text)
+		assert.Equal(t, "<4@example.com>", sent.mail.inReplyTo)
+
+		imapServer.add(textMail(alice, mbot, bob, "Re: [new] Weekly sync", "<5@example.com>", "<1@example.com>", "/end"))
+		sent = smtpServer.expect(t)
+		assert.Contains(t, sent.mail.text, "published")
+
+		assert.EqualValues(t, []string{
+			"Weekly sync" +
+				"Bob: hello 你好\n",
+		}, pub.Posts())
+	})
+
+	t.Run("LMTP", func(t *testing.T) {
+		conn, err := net.Dial("tcp", b.(*emailBot).lmtpListener.Addr().String())
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		tp := textproto.NewConn(conn)
+		expect := func(code int) {
+			_, _, err := tp.ReadResponse(code)
+			require.NoError(t, err)
+		}
+
+		expect(220)
+		require.NoError(t, tp.PrintfLine("LHLO localhost"))
+		expect(250)
+		require.NoError(t, tp.PrintfLine("MAIL FROM:<alice@example.com>"))
+		expect(250)
+		require.NoError(t, tp.PrintfLine("RCPT TO:<mbot@example.com>"))
+		expect(250)
+		require.NoError(t, tp.PrintfLine("DATA"))
+		expect(354)
+
+		w := tp.DotWriter()
+		_, err = w.Write(textMail(alice, mbot, "", "help", "<6@example.com>", "", "/help"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		expect(250)
+
+		sent := smtpServer.expect(t)
+		assert.EqualValues(t, []string{"alice@example.com"}, sent.rcpts)
+		assert.Equal(t, "Re: help", sent.mail.subject)
+		assert.Contains(t, sent.mail.text, "/new")
+
+		require.NoError(t, tp.PrintfLine("QUIT"))
+		expect(221)
+	})
+
+	t.Run("Click", func(t *testing.T) {
+		clicked := make(chan struct{}, 1)
+		con := &conversationImpl{bot: b.(*emailBot), chat: privateChatOf("alice@example.com")}
+		_, err := con.SendMessage(ctx, rt.SendMessageOptions{
+			Body: []rt.Span{{Text: "choose"}},
+			Callbacks: [][]rt.MessageCallbackSpec{{
+				{Text: "ok", OnClick: rt.NewOptionalValue(func() error {
+					clicked <- struct{}{}
+					return nil
+				})},
+			}},
+		})
+		require.NoError(t, err)
+
+		sent := smtpServer.expect(t)
+		_, line, ok := strings.Cut(sent.mail.text, "ok: reply with ")
+		require.True(t, ok, sent.mail.text)
+		cmd := strings.TrimSpace(line)
+		require.True(t, strings.HasPrefix(cmd, clickCmd+" "), cmd)
+		assert.Len(t, strings.TrimPrefix(cmd, clickCmd+" "), 2*callbackIDSize)
+
+		imapServer.add(textMail(alice, mbot, "", "Re: mbot", "<7@example.com>", sent.mail.messageID, cmd))
+		select {
+		case <-clicked:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "callback not called")
+		}
+
+		imapServer.add(textMail(alice, mbot, "", "Re: mbot", "<8@example.com>", sent.mail.messageID, "/click 00000000"))
+		sent = smtpServer.expect(t)
+		assert.Equal(t, "The button has expired.", sent.mail.text)
+	})
+}
+
+func TestBotConfig(t *testing.T) {
+	_, err := (&Config{From: "mbot@example.com", SMTP: SMTPConfig{Server: "localhost:25"}}).
+		Create(rt.NewContext(context.TODO(), log.NoOpLogger, nil), bottest.NewCreationContext(nil))
+	assert.ErrorContains(t, err, "one of imap or lmtp is required")
+}
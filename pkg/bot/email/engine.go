@@ -0,0 +1,62 @@
+package email
+
+import (
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+var (
+	_ engine.Message[chatIDWrapper]                  = (*messageContext)(nil)
+	_ engine.Adapter[chatIDWrapper, *messageContext] = (*adapter)(nil)
+)
+
+func (mc *messageContext) Chat() chatIDWrapper           { return mc.chat }
+func (mc *messageContext) IsPrivate() bool               { return mc.chat.private }
+func (mc *messageContext) SenderID() rt.UserID           { return userIDOf(mc.from) }
+func (mc *messageContext) MessageID() rt.MessageID       { return mc.msgID }
+func (mc *messageContext) ReplyTo() rt.MessageID         { return mc.replyTo }
+func (mc *messageContext) Conversation() rt.Conversation { return &mc.con }
+func (mc *messageContext) Logger() log.Interface         { return mc.logger }
+
+// InputText returns the first line of the mail in case of mail signatures
+func (mc *messageContext) InputText() string {
+	line, _, _ := strings.Cut(mc.mail.text, "\n")
+	return line
+}
+
+// adapter implements engine.Adapter for email
+type adapter struct {
+	c *emailBot
+}
+
+func (a adapter) Reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	return a.c.reply(mc, body...)
+}
+
+func (a adapter) Conversation(chat chatIDWrapper) rt.Conversation {
+	return &conversationImpl{bot: a.c, chat: chat}
+}
+
+// DeleteAfter does nothing, sent mails cannot be deleted
+func (a adapter) DeleteAfter(chat chatIDWrapper, delay time.Duration, msgIDs ...rt.MessageID) {}
+
+func (a adapter) PrivateChatOf(mc *messageContext) (chatIDWrapper, bool, error) {
+	return privateChatOf(mc.from), true, nil
+}
+
+func (a adapter) PrivateChatLink(startParams string) (string, bool) { return "", false }
+
+func (a adapter) IsAdmin(mc *messageContext) (bool, error) { return a.c.isAdmin(mc.from), nil }
+
+func (a adapter) RepliedMessage(mc *messageContext) (*messageContext, bool) {
+	return a.c.history.Find(mc.chat.ID(), mc.replyTo)
+}
+
+func (a adapter) AppendSessionMessage(mc *messageContext) error {
+	return a.c.appendSessionMessage(mc)
+}
@@ -0,0 +1,213 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapOptions for polling the mailbox
+type imapOptions struct {
+	server   string
+	tls      *tls.Config
+	username string
+	password string
+	mailbox  string
+	interval time.Duration
+}
+
+// imapClient is a minimal IMAP4rev1 client supporting commands required to poll
+// unseen mails
+//
+// ref: https://www.rfc-editor.org/rfc/rfc3501
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	seq int
+}
+
+// imapResponse is an untagged response, with literal data if any
+type imapResponse struct {
+	line    string
+	literal []byte
+}
+
+const imapTimeout = time.Minute
+
+func dialIMAP(ctx context.Context, opts *imapOptions) (_ *imapClient, err error) {
+	dialer := &net.Dialer{Timeout: imapTimeout}
+
+	var conn net.Conn
+	if opts.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: opts.tls}).DialContext(ctx, "tcp", opts.server)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", opts.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &imapClient{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	defer func() {
+		if err != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, _, err := c.readLine()
+	if err != nil {
+		return nil, fmt.Errorf("read greeting: %w", err)
+	}
+
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		return nil, fmt.Errorf("unexpected greeting %q", greeting)
+	}
+
+	if !strings.HasPrefix(greeting, "* PREAUTH") {
+		_, err = c.cmd("LOGIN " + imapQuote(opts.username) + " " + imapQuote(opts.password))
+		if err != nil {
+			return nil, fmt.Errorf("login: %w", err)
+		}
+	}
+
+	_, err = c.cmd("SELECT " + imapQuote(opts.mailbox))
+	if err != nil {
+		return nil, fmt.Errorf("select mailbox: %w", err)
+	}
+
+	return c, nil
+}
+
+// searchUnseen returns uids of unseen mails
+func (c *imapClient) searchUnseen() (uids []uint32, err error) {
+	resps, err := c.cmd("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, resp := range resps {
+		fields := strings.Fields(resp.line)
+		if len(fields) < 2 || fields[0] != "*" || !strings.EqualFold(fields[1], "SEARCH") {
+			continue
+		}
+
+		for _, f := range fields[2:] {
+			uid, err := strconv.ParseUint(f, 10, 32)
+			if err == nil {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+
+	return
+}
+
+// fetch returns the raw mail, the mail is not marked as seen
+func (c *imapClient) fetch(uid uint32) ([]byte, error) {
+	resps, err := c.cmd("UID FETCH " + strconv.FormatUint(uint64(uid), 10) + " BODY.PEEK[]")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, resp := range resps {
+		if resp.literal != nil && strings.Contains(strings.ToUpper(resp.line), "FETCH") {
+			return resp.literal, nil
+		}
+	}
+
+	return nil, fmt.Errorf("mail %d not found", uid)
+}
+
+func (c *imapClient) markSeen(uid uint32) error {
+	_, err := c.cmd("UID STORE " + strconv.FormatUint(uint64(uid), 10) + ` +FLAGS.SILENT (\Seen)`)
+	return err
+}
+
+func (c *imapClient) close() {
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = c.cmd("LOGOUT")
+	_ = c.conn.Close()
+}
+
+// cmd sends the command and reads responses until the tagged one
+func (c *imapClient) cmd(command string) (resps []imapResponse, err error) {
+	c.seq++
+	tag := "m" + strconv.Itoa(c.seq)
+
+	_ = c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	_, err = io.WriteString(c.conn, tag+" "+command+"\r\n")
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		line, literal, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(line, tag+" ") {
+			resps = append(resps, imapResponse{line: line, literal: literal})
+			continue
+		}
+
+		status := strings.TrimPrefix(line, tag+" ")
+		if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+			return nil, fmt.Errorf("%s", status)
+		}
+
+		return resps, nil
+	}
+}
+
+// readLine reads a response line, literals (`{n}\r\n<n bytes>`) in the line are
+// returned separately, only the last one is kept
+func (c *imapClient) readLine() (line string, literal []byte, err error) {
+	var buf strings.Builder
+	for {
+		part, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+
+		part = strings.TrimRight(part, "\r\n")
+		buf.WriteString(part)
+
+		if !strings.HasSuffix(part, "}") {
+			return buf.String(), literal, nil
+		}
+
+		start := strings.LastIndexByte(part, '{')
+		if start == -1 {
+			return buf.String(), literal, nil
+		}
+
+		size, err := strconv.ParseInt(strings.TrimSuffix(part[start+1:len(part)-1], "+"), 10, 64)
+		if err != nil || size < 0 || size > maxMailSize {
+			return "", nil, fmt.Errorf("invalid literal size in %q", part)
+		}
+
+		literal = make([]byte, size)
+		_, err = io.ReadFull(c.r, literal)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// imapQuote formats s as a quoted string
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,119 @@
+package email
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+)
+
+const lmtpTimeout = 5 * time.Minute
+
+// serveLMTP accepts mails delivered by the mail server
+//
+// ref: https://www.rfc-editor.org/rfc/rfc2033
+func (c *emailBot) serveLMTP(l net.Listener) {
+	go func() {
+		<-c.Context().Done()
+		_ = l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if c.Context().Err() == nil && !errors.Is(err, net.ErrClosed) {
+				c.Logger().I("failed to accept lmtp connection", log.Error(err))
+			}
+
+			return
+		}
+
+		go c.handleLMTPConn(conn)
+	}
+}
+
+// nolint:gocyclo
+func (c *emailBot) handleLMTPConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	tp := textproto.NewConn(conn)
+	reply := func(lines ...string) bool {
+		for _, line := range lines {
+			if tp.PrintfLine("%s", line) != nil {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	hostname := c.from.Address[strings.LastIndexByte(c.from.Address, '@')+1:]
+	if !reply("220 " + hostname + " LMTP ready") {
+		return
+	}
+
+	var rcpts int
+	for {
+		_ = conn.SetDeadline(time.Now().Add(lmtpTimeout))
+
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			reply("250-"+hostname, "250-PIPELINING", "250-ENHANCEDSTATUSCODES", "250 8BITMIME")
+		case "MAIL":
+			rcpts = 0
+			reply("250 2.1.0 OK")
+		case "RCPT":
+			rcpts++
+			reply("250 2.1.5 OK")
+		case "DATA":
+			if rcpts == 0 {
+				reply("503 5.5.1 No valid recipients")
+				continue
+			}
+
+			if !reply("354 Start mail input; end with <CRLF>.<CRLF>") {
+				return
+			}
+
+			raw, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			// lmtp requires one response per recipient
+			status := "250 2.0.0 OK"
+			switch {
+			case len(raw) > maxMailSize:
+				status = "552 5.3.4 Message too big"
+			default:
+				if err = c.onMail(raw); err != nil {
+					c.Logger().I("bad mail from lmtp", log.Error(err))
+					status = "554 5.6.0 Invalid message"
+				}
+			}
+
+			for ; rcpts > 0; rcpts-- {
+				reply(status)
+			}
+		case "RSET":
+			rcpts = 0
+			reply("250 2.0.0 OK")
+		case "NOOP":
+			reply("250 2.0.0 OK")
+		case "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			reply("500 5.5.2 Unknown command")
+		}
+	}
+}
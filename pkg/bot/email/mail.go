@@ -0,0 +1,391 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	stdmime "mime"
+	stdmultipart "mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	nethtml "golang.org/x/net/html"
+
+	"arhat.dev/mbot/internal/mime"
+	"arhat.dev/mbot/internal/multipart"
+	"arhat.dev/mbot/pkg/bot/html"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// maxMailSize limits the size of a single incoming mail
+const maxMailSize = 32 << 20
+
+// maxMIMEDepth limits nesting of multipart entities
+const maxMIMEDepth = 8
+
+// mailMessage is the parsed incoming mail
+type mailMessage struct {
+	messageID  string
+	inReplyTo  string
+	references []string
+
+	from *mail.Address
+	// recipients in To and Cc
+	recipients []*mail.Address
+
+	subject string
+	date    time.Time
+
+	// autoSubmitted is true for mails generated automatically (e.g. vacation
+	// replies), they are ignored to avoid loops
+	autoSubmitted bool
+
+	// text is the body text with quotes removed
+	text  string
+	spans []rt.Span
+
+	attachments []attachment
+}
+
+type attachment struct {
+	filename    string
+	contentType string
+	data        []byte
+}
+
+var wordDecoder = &stdmime.WordDecoder{}
+
+// parseMail parses raw mail data
+func parseMail(raw []byte) (*mailMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("read mail: %w", err)
+	}
+
+	ret := &mailMessage{
+		messageID:  firstMessageID(msg.Header.Get("Message-Id")),
+		inReplyTo:  firstMessageID(msg.Header.Get("In-Reply-To")),
+		references: parseMessageIDs(msg.Header.Get("References")),
+	}
+
+	ret.from, err = mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+
+	for _, key := range []string{"To", "Cc"} {
+		addrs, err2 := msg.Header.AddressList(key)
+		if err2 == nil {
+			ret.recipients = append(ret.recipients, addrs...)
+		}
+	}
+
+	ret.subject, err = wordDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		ret.subject = msg.Header.Get("Subject")
+	}
+
+	ret.date, err = msg.Header.Date()
+	if err != nil {
+		ret.date = time.Now()
+	}
+
+	if v := strings.ToLower(msg.Header.Get("Auto-Submitted")); len(v) != 0 && v != "no" {
+		ret.autoSubmitted = true
+	}
+
+	var body mailBody
+	err = body.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	if err != nil {
+		return nil, fmt.Errorf("read mail body: %w", err)
+	}
+
+	switch {
+	case body.hasPlain:
+		ret.text = stripQuotes(body.plain)
+		ret.spans = []rt.Span{{Text: ret.text}}
+	case body.hasHTML:
+		ret.spans = html.Parse(body.html, htmlOptions)
+
+		var buf strings.Builder
+		for _, sp := range ret.spans {
+			buf.WriteString(sp.Text)
+		}
+		ret.text = buf.String()
+	}
+
+	if len(ret.text) == 0 {
+		ret.spans = nil
+	}
+
+	ret.attachments = body.attachments
+
+	return ret, nil
+}
+
+// htmlOptions skips quotes of replies in html mails
+var htmlOptions = html.Options{
+	Ignore: func(n *nethtml.Node) bool {
+		for _, attr := range n.Attr {
+			switch {
+			case attr.Key == "type" && attr.Val == "cite",
+				attr.Key == "class" && strings.Contains(attr.Val, "gmail_quote"),
+				attr.Key == "class" && strings.Contains(attr.Val, "moz-cite-prefix"):
+				return true
+			}
+		}
+
+		return false
+	},
+}
+
+// mailBody collects texts and attachments of the mail body
+type mailBody struct {
+	hasPlain, hasHTML bool
+
+	plain, html string
+
+	attachments []attachment
+}
+
+// nolint:gocyclo
+func (b *mailBody) walk(header textproto.MIMEHeader, r io.Reader, depth int) error {
+	contentType := header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = "text/plain"
+	}
+
+	mediaType, params, err := stdmime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", nil
+	}
+
+	mt := mime.New(mediaType)
+	if mt.Type() == mime.MIMEType_Multipart {
+		if depth >= maxMIMEDepth {
+			return nil
+		}
+
+		mr := stdmultipart.NewReader(r, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			err = b.walk(part.Header, part, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), r))
+	if err != nil {
+		return err
+	}
+
+	disposition, dparams, _ := stdmime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if len(filename) == 0 {
+		filename = params["name"]
+	}
+
+	if decoded, err := wordDecoder.DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+
+	if mt.Type() == mime.MIMEType_Text && disposition != "attachment" && len(filename) == 0 {
+		switch mt.Subtype() {
+		case "plain":
+			if !b.hasPlain {
+				b.hasPlain, b.plain = true, toValidText(data)
+			}
+			return nil
+		case "html":
+			if !b.hasHTML {
+				b.hasHTML, b.html = true, toValidText(data)
+			}
+			return nil
+		}
+	}
+
+	b.attachments = append(b.attachments, attachment{
+		filename:    filename,
+		contentType: mediaType,
+		data:        data,
+	})
+
+	return nil
+}
+
+func decodeTransferEncoding(cte string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// newlineStripper removes line breaks in base64 encoded content
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	j := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' {
+			p[j] = c
+			j++
+		}
+	}
+
+	return j, err
+}
+
+func toValidText(data []byte) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(string(data), "�"), "\r\n", "\n")
+}
+
+// stripQuotes removes quoted lines, their attribution lines and signature of plain
+// text mails
+func stripQuotes(text string) string {
+	var lines []string
+
+	s := bufio.NewScanner(strings.NewReader(text))
+	s.Buffer(make([]byte, 0, 4096), maxMailSize)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), " \t")
+		if line == "--" && strings.HasSuffix(s.Text(), " ") {
+			// signature delimiter `-- `
+			break
+		}
+
+		if !strings.HasPrefix(line, ">") {
+			lines = append(lines, line)
+			continue
+		}
+
+		// drop attribution line (e.g. `On Mon, ... Alice wrote:`) before quotes
+		i := len(lines) - 1
+		for i >= 0 && len(lines[i]) == 0 {
+			i--
+		}
+
+		if i >= 0 && strings.HasSuffix(lines[i], " wrote:") {
+			lines = lines[:i]
+		}
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func firstMessageID(v string) string {
+	ids := parseMessageIDs(v)
+	if len(ids) == 0 {
+		return ""
+	}
+
+	return ids[0]
+}
+
+// parseMessageIDs parses space separated msg-ids (e.g. `<a@example.com> <b@example.com>`)
+func parseMessageIDs(v string) (ret []string) {
+	for _, f := range strings.Fields(v) {
+		if strings.HasPrefix(f, "<") && strings.HasSuffix(f, ">") && len(f) > 2 {
+			ret = append(ret, f)
+		}
+	}
+
+	return
+}
+
+// outgoingMail is the mail sent by the bot
+type outgoingMail struct {
+	from       *mail.Address
+	to         []string
+	subject    string
+	messageID  string
+	inReplyTo  string
+	references []string
+
+	plain, html string
+}
+
+// build renders the mail as multipart/alternative of plain text and html
+func (m *outgoingMail) build() ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		hb  multipart.HeaderBuilder
+		pb  multipart.Builder
+	)
+
+	for _, text := range [...]struct {
+		contentType, body string
+	}{
+		{"text/plain; charset=utf-8", m.plain},
+		{"text/html; charset=utf-8", "<html><body>" + m.html + "</body></html>"},
+	} {
+		var encoded bytes.Buffer
+		qw := quotedprintable.NewWriter(&encoded)
+		_, _ = qw.Write([]byte(text.body))
+		_ = qw.Close()
+
+		pb.CreatePart(
+			hb.Reset("").
+				Add("Content-Type", text.contentType).
+				Add("Content-Transfer-Encoding", "quoted-printable").
+				Build(),
+			&encoded,
+		)
+	}
+
+	contentType, body := pb.BuildAs("multipart/alternative")
+
+	header := func(name, value string) {
+		buf.WriteString(name)
+		buf.WriteString(": ")
+		buf.WriteString(value)
+		buf.WriteString("\r\n")
+	}
+
+	header("From", m.from.String())
+	header("To", strings.Join(m.to, ", "))
+	header("Subject", stdmime.QEncoding.Encode("utf-8", m.subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", m.messageID)
+	if len(m.inReplyTo) != 0 {
+		header("In-Reply-To", m.inReplyTo)
+	}
+
+	if len(m.references) != 0 {
+		header("References", strings.Join(m.references, " "))
+	}
+
+	// rfc3834: avoid auto replies to messages from the bot
+	header("Auto-Submitted", "auto-replied")
+	header("MIME-Version", "1.0")
+	header("Content-Type", contentType)
+	buf.WriteString("\r\n")
+
+	_, err := buf.ReadFrom(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,115 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	stdmime "mime"
+	"path"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/internal/mime"
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func (c *emailBot) newMessageFromMail(mc *messageContext, wf *bot.Workflow) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.timestamp
+	ret.Text = mc.mail.text
+	ret.Spans = append(ret.Spans, mc.mail.spans...)
+
+	for i := range mc.mail.attachments {
+		c.appendAttachmentSpan(mc, ret, &mc.mail.attachments[i], wf)
+	}
+
+	if mc.chat.private {
+		ret.Flags |= rt.MessageFlag_Private
+	}
+
+	if mc.replyTo != 0 {
+		ret.Flags |= rt.MessageFlag_Reply
+		ret.ReplyTo = mc.replyTo
+	}
+
+	ret.ChatName = mc.ChatName()
+
+	ret.Author = mc.author()
+	ret.AuthorLink = "mailto:" + mc.from
+
+	return
+}
+
+// appendAttachmentSpan adds the attachment as media span, and uploads the file
+// in background when the workflow requires
+func (c *emailBot) appendAttachmentSpan(mc *messageContext, m *rt.Message, a *attachment, wf *bot.Workflow) {
+	span := rt.Span{
+		SpanMediaOptions: rt.SpanMediaOptions{
+			Filename:    a.filename,
+			ContentType: a.contentType,
+		},
+	}
+
+	if len(span.Filename) != 0 && span.ContentType == "application/octet-stream" {
+		if ct := stdmime.TypeByExtension(path.Ext(span.Filename)); len(ct) != 0 {
+			span.ContentType = ct
+		}
+	}
+
+	switch mime.New(span.ContentType).Type() {
+	case mime.MIMEType_Image:
+		span.Flags = rt.SpanFlag_Image
+	case mime.MIMEType_Video:
+		span.Flags = rt.SpanFlag_Video
+	case mime.MIMEType_Audio:
+		span.Flags = rt.SpanFlag_Audio
+	default:
+		span.Flags = rt.SpanFlag_File
+	}
+
+	m.Spans = append(m.Spans, span)
+
+	if !wf.DownloadMedia() || len(a.data) == 0 {
+		return
+	}
+
+	mediaSpan := &m.Spans[len(m.Spans)-1]
+	con := mc.con
+	data := a.data
+
+	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			_, err2 := io.Copy(cacheWR, bytes.NewReader(data))
+			return err2
+		})
+		if err != nil {
+			mc.logger.I("failed to cache attachment", log.Error(err))
+			c.sendErrorf(mc, "unable to cache attachment: %v", err)
+			return
+		}
+
+		filename := mediaSpan.Filename
+		if len(filename) == 0 {
+			filename = cacheRD.ID().String()
+		}
+
+		mc.logger.D("upload file",
+			log.String("filename", filename),
+			rt.LogCacheID(cacheRD.ID()),
+			log.Int64("size", sz),
+		)
+
+		sout, err := bot.Upload(&con, wf.Storage, filename, sz, cacheRD, mediaSpan.ContentType)
+		if err != nil {
+			mc.logger.I("failed to upload file", log.Error(err))
+			c.sendErrorf(mc, "unable to upload file: %v", err)
+			return
+		}
+
+		mediaSpan.Size = sz
+		mediaSpan.URL = sout.URL
+		mediaSpan.Data = cacheRD
+	})
+}
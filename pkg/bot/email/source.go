@@ -0,0 +1,204 @@
+package email
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashID generates a stable uint64 id for message ids and addresses
+func hashID(id string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](id))
+	return h.Sum64()
+}
+
+func userIDOf(addr string) rt.UserID        { return rt.UserID(hashID(addr)) }
+func messageIDOf(msgID string) rt.MessageID { return rt.MessageID(hashID(msgID)) }
+
+// normalizeAddress lowercases the address for comparison
+func normalizeAddress(addr string) string { return strings.ToLower(strings.TrimSpace(addr)) }
+
+// chatIDWrapper is the chat data stored in session requests
+type chatIDWrapper struct {
+	// id is the Message-ID of the first mail in the thread, or the address
+	// of the user for private chat
+	id string
+
+	private bool
+}
+
+func privateChatOf(addr string) chatIDWrapper { return chatIDWrapper{id: addr, private: true} }
+
+func (c chatIDWrapper) ID() rt.ChatID {
+	if c.private {
+		// avoid collision with threads
+		return rt.ChatID(hashID("@" + c.id))
+	}
+
+	return rt.ChatID(hashID(c.id))
+}
+
+type messageContext struct {
+	con conversationImpl
+
+	chat chatIDWrapper
+	mail *mailMessage
+
+	// from is the normalized address of the sender
+	from string
+
+	msgID   rt.MessageID
+	replyTo rt.MessageID
+
+	timestamp time.Time
+
+	logger log.Interface
+}
+
+// chatName returns the thread subject for display
+func (mc *messageContext) ChatName() string {
+	if mc.chat.private {
+		return mc.from
+	}
+
+	return trimReplyPrefix(mc.mail.subject)
+}
+
+// author returns the display name of the sender
+func (mc *messageContext) author() string {
+	if len(mc.mail.from.Name) != 0 {
+		return mc.mail.from.Name
+	}
+
+	return mc.from
+}
+
+// maxReferences is the max number of message ids in References header of
+// outgoing mails
+const maxReferences = 20
+
+// thread is the state of a mail thread for replying
+type thread struct {
+	subject string
+
+	// participants are addresses to send mails to, excluding the bot
+	participants []string
+
+	// lastMsgID is the Message-ID of the latest mail in the thread
+	lastMsgID  string
+	references []string
+}
+
+// threadRegistry keeps threads by chat id, along with Message-IDs of all mails
+// seen for replying to a specific mail
+type threadRegistry struct {
+	mu      *sync.Mutex
+	threads map[rt.ChatID]*thread
+
+	order  []rt.MessageID
+	msgIDs map[rt.MessageID]string
+}
+
+// maxMessageIDs is the max number of Message-IDs kept for reply
+const maxMessageIDs = 1024
+
+func (r *threadRegistry) init() {
+	r.mu = &sync.Mutex{}
+	r.threads = make(map[rt.ChatID]*thread)
+	r.msgIDs = make(map[rt.MessageID]string)
+}
+
+// update records the mail in the thread of the chat
+func (r *threadRegistry) update(chatID rt.ChatID, subject, msgID string, references []string, participants ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.threads[chatID]
+	if !ok {
+		t = &thread{subject: subject}
+		r.threads[chatID] = t
+	}
+
+	for _, p := range participants {
+		if !contains(t.participants, p) {
+			t.participants = append(t.participants, p)
+		}
+	}
+
+	if len(references) != 0 {
+		t.references = references
+	}
+
+	if len(msgID) != 0 {
+		t.lastMsgID = msgID
+		id := messageIDOf(msgID)
+		if _, ok := r.msgIDs[id]; !ok {
+			r.msgIDs[id] = msgID
+			r.order = append(r.order, id)
+			if len(r.order) > maxMessageIDs {
+				delete(r.msgIDs, r.order[0])
+				r.order = r.order[1:]
+			}
+		}
+	}
+}
+
+// get returns a copy of the thread
+func (r *threadRegistry) get(chatID rt.ChatID) (thread, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.threads[chatID]
+	if !ok {
+		return thread{}, false
+	}
+
+	ret := *t
+	ret.participants = append([]string(nil), t.participants...)
+	ret.references = append([]string(nil), t.references...)
+	return ret, true
+}
+
+// messageID returns the Message-ID of a mail seen
+func (r *threadRegistry) messageID(msgID rt.MessageID) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.msgIDs[msgID]
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trimReplyPrefix removes `Re:` and `Fwd:` prefixes of the subject
+func trimReplyPrefix(subject string) string {
+	for {
+		s := strings.TrimSpace(subject)
+		lower := strings.ToLower(s)
+
+		switch {
+		case strings.HasPrefix(lower, "re:"):
+			subject = s[3:]
+		case strings.HasPrefix(lower, "fw:"):
+			subject = s[3:]
+		case strings.HasPrefix(lower, "fwd:"):
+			subject = s[4:]
+		default:
+			return s
+		}
+	}
+}
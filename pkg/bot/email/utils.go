@@ -0,0 +1,34 @@
+package email
+
+import (
+	"fmt"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func plain(text string) rt.Span { return rt.Span{Flags: rt.SpanFlag_PlainText, Text: text} }
+func bold(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Bold, Text: text} }
+
+// reply sends message to the chat where mc comes from as a reply to mc
+func (c *emailBot) reply(mc *messageContext, body ...rt.Span) (msgID rt.MessageID, err error) {
+	msgIDs, err := mc.con.SendMessage(c.Context(), rt.SendMessageOptions{
+		ReplyTo: mc.msgID,
+		Body:    body,
+	})
+	if err != nil {
+		mc.logger.E("failed to send message", log.Error(err))
+		return
+	}
+
+	if len(msgIDs) != 0 {
+		msgID = msgIDs[0]
+	}
+
+	return
+}
+
+func (c *emailBot) sendErrorf(mc *messageContext, format string, args ...any) {
+	c.reply(mc, plain("Internal bot error: "), bold(fmt.Sprintf(format, args...)))
+}
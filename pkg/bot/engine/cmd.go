@@ -0,0 +1,634 @@
+package engine
+
+import (
+	"fmt"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/publisher"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+func (e *Engine[C, M]) handleBotCmd_New(m M, wf *bot.Workflow, cmd, params string) error {
+	return e.handleBotCmd_Session(m, wf, cmd, params, true)
+}
+
+func (e *Engine[C, M]) handleBotCmd_Resume(m M, wf *bot.Workflow, cmd, params string) error {
+	return e.handleBotCmd_Session(m, wf, cmd, params, false)
+}
+
+// handleBotCmd_Session marks a session standby, and activates it when the
+// publisher requires no login, otherwise asks for token in private chat
+func (e *Engine[C, M]) handleBotCmd_Session(
+	m M,
+	wf *bot.Workflow,
+	cmd, params string,
+	isNew bool,
+) (err error) {
+	chatID, userID := m.Chat().ID(), m.SenderID()
+
+	if len(params) == 0 {
+		m.Logger().D("invalid command usage", log.String("cmd", cmd), log.String("reason", "missing param"))
+		if isNew {
+			e.notice(m, plain("Please specify a session topic, e.g. "), code(e.CmdText(cmd)+" foo"))
+		} else {
+			e.notice(m, plain("Please specify the key of the session, e.g. "), code(e.CmdText(cmd)+" your-key"))
+		}
+
+		return nil
+	}
+
+	_, ok := e.sessions.ActiveSessionOf(m.Chat())
+	if ok {
+		m.Logger().D("invalid command usage", log.String("cmd", cmd), log.String("reason", "already in a session"))
+		e.notice(m, plain("Please end existing session before starting a new one."))
+		return nil
+	}
+
+	if !e.sessions.MarkSessionStandby(wf, userID, m.Chat(), params, isNew, requestTimeout) {
+		e.notice(m, plain("You have already started a session with no token replied, please end that first."))
+		return nil
+	}
+
+	pub, user, err := wf.CreatePublisher()
+	if err != nil {
+		e.sessions.ResolvePendingRequest(userID)
+		e.reply(m, plain("Internal bot error: "), bold(err.Error()))
+		return err
+	}
+
+	if user.NextCredential() == rt.LoginFlow_None {
+		// no login required
+
+		_, err = e.sessions.ActivateSession(wf, userID, chatID, pub)
+		if err != nil {
+			e.notice(m, plain("You have already started a session before, please end that first."))
+			return nil
+		}
+
+		defer func() {
+			if err != nil {
+				e.sessions.DeactivateSessionOf(m.Chat())
+				e.reply(m, plain("The session was canceled due to error: "), bold(err.Error()))
+			}
+		}()
+
+		var note rt.PublisherOutput
+		note, err = e.prepareSession(m.Conversation(), wf, pub, params, isNew)
+		if err != nil {
+			return
+		}
+
+		_, _ = sendOutput(m.Conversation(), &note)
+		return nil
+	}
+
+	// login is required, ask for token in private chat
+
+	_, err = pub.CheckLogin(m.Conversation(), cmd, params, user)
+	if err != nil {
+		e.sessions.ResolvePendingRequest(userID)
+		e.reply(m, bold(wf.PublisherName()), plain(" login check failed: "), bold(err.Error()))
+		return nil
+	}
+
+	if !m.IsPrivate() {
+		// redirect user to private chat with links when possible
+		var (
+			buttons []rt.MessageCallbackSpec
+			body    []rt.Span
+		)
+
+		if isNew {
+			buttons, ok = e.linkButtons(userID, chatID, "Create", actionCreate, "Enter", actionEnter)
+			body = []rt.Span{plain("Create or enter your "), bold(wf.PublisherName()), plain(" token for this session.")}
+		} else {
+			buttons, ok = e.linkButtons(userID, chatID, "Enter", actionEnter)
+			body = []rt.Span{plain("Enter your "), bold(wf.PublisherName()), plain(" token to continue this session.")}
+		}
+
+		if ok {
+			err = e.sendLinks(m, buttons, body...)
+			if err != nil {
+				e.sessions.ResolvePendingRequest(userID)
+			}
+
+			return err
+		}
+	}
+
+	body := []rt.Span{
+		plain("Reply with your "),
+		bold(wf.PublisherName()),
+		plain(" token for the session in " + m.ChatName()),
+	}
+	if isNew {
+		body = append(body,
+			plain(", or send "),
+			code(e.CmdText(wf.BotCommands.TextOf(rt.BotCmd_Start))),
+			plain(" to create a new one."),
+		)
+	} else {
+		body = append(body, plain("."))
+	}
+
+	asked, err := e.askForInput(m, wf, body...)
+	if !asked || err != nil {
+		e.sessions.ResolvePendingRequest(userID)
+		if !asked {
+			e.reply(m,
+				bold(wf.PublisherName()),
+				plain(" requires login, which is not supported without private chat, please configure the publisher with credentials."),
+			)
+		}
+
+		return err
+	}
+
+	if !m.IsPrivate() {
+		e.reply(m, plain(e.opts.CheckPrivateChat))
+	}
+
+	return nil
+}
+
+// prepareSession creates a new post or retrieves the existing one
+func (e *Engine[C, M]) prepareSession(
+	con rt.Conversation,
+	wf *bot.Workflow,
+	pub publisher.Interface,
+	params string,
+	isNew bool,
+) (_ rt.PublisherOutput, err error) {
+	if !isNew {
+		return pub.Retrieve(con, wf.BotCommands.TextOf(rt.BotCmd_Resume), params)
+	}
+
+	in := rt.GeneratorInput{
+		Cmd:    wf.BotCommands.TextOf(rt.BotCmd_New),
+		Params: params,
+	}
+
+	content, err := wf.Generator.New(con, &in)
+	if err != nil {
+		return rt.PublisherOutput{}, fmt.Errorf("failed to render page header: %w", err)
+	}
+
+	return pub.CreateNew(con, in.Cmd, params, &content)
+}
+
+// handleBotCmd_Start handles start botcmd in private chat, with params sent by
+// private chat links or none
+//
+// it creates a new publisher user for the standby session of the same user, or
+// asks for token of the existing user
+func (e *Engine[C, M]) handleBotCmd_Start(m M, wf *bot.Workflow, cmd, params string) error {
+	userID := m.SenderID()
+
+	if !m.IsPrivate() {
+		e.notice(m, plain("You cannot use "), code(e.CmdText(cmd)), plain(" command in "+e.opts.GroupChat+"."))
+		return nil
+	}
+
+	if len(params) == 0 {
+		standbySession, ok := e.sessions.GetStandbySession(userID)
+		if !ok || !standbySession.IsNew {
+			e.reply(m,
+				plain("Welcome, need some help? send command "),
+				code(e.CmdText(wf.BotCommands.TextOf(rt.BotCmd_Help))),
+				plain(" to show all commands."),
+			)
+			return nil
+		}
+
+		return e.createSession(m, standbySession)
+	}
+
+	sp, err := decodeStartParams(params)
+	if err != nil {
+		e.reply(m, plain("Bad start params: "), bold(err.Error()))
+		return nil
+	}
+
+	// ensure same user
+	if sp.userID != userID {
+		e.reply(m, bold("The link is not for you :("))
+		return nil
+	}
+
+	if sp.action != actionCreate && sp.action != actionEnter {
+		e.reply(m, plain("Unknown action."))
+		return nil
+	}
+
+	standbySession, ok := e.sessions.GetStandbySession(userID)
+	if !ok {
+		m.Logger().I("bad start attempt",
+			log.String("reason", "no session requested"),
+			rt.LogOrigChatID(sp.chatID),
+			rt.LogOrigSenderID(sp.userID),
+		)
+
+		e.reply(m, plain("No session requested."))
+		return nil
+	}
+
+	// defensive check, should not happen
+	if origChatID := standbySession.Data.ID(); origChatID != sp.chatID {
+		m.Logger().E("unexpected chat id not match",
+			log.Uint64("expected_orig_chat_id", uint64(origChatID)),
+			log.Uint64("actual_orig_chat_id", uint64(sp.chatID)),
+		)
+
+		e.reply(m, plain("Unexpected chat id not match."))
+		return nil
+	}
+
+	// delete `/start` message
+	e.adapter.DeleteAfter(m.Chat(), noticeTTL, m.MessageID())
+
+	if sp.action == actionCreate {
+		return e.createSession(m, standbySession)
+	}
+
+	msgID, err := e.prompt(m.Chat(), standbySession.Workflow(),
+		plain("Reply this message with your "),
+		bold(standbySession.Workflow().PublisherName()),
+		plain(" token."),
+	)
+	if err != nil {
+		return err
+	}
+
+	if !e.sessions.MarkRequestExpectingInput(userID, msgID) {
+		e.reply(m, plain("The session is not expecting any input."))
+		e.adapter.DeleteAfter(m.Chat(), noticeTTL, msgID)
+	}
+
+	return nil
+}
+
+// createSession creates a new publisher user for the standby session and activates it
+func (e *Engine[C, M]) createSession(m M, standbySession *session.SessionRequest[C]) (err error) {
+	var (
+		userID  = m.SenderID()
+		wf      = standbySession.Workflow()
+		origCon = e.adapter.Conversation(standbySession.Data)
+	)
+
+	defer func() {
+		if err != nil {
+			_, _ = e.sessions.ResolvePendingRequest(userID)
+
+			// best effort
+			e.reply(m, plain("The session was canceled due to error, please retry later: "), bold(err.Error()))
+			if standbySession.Data.ID() != m.Chat().ID() {
+				_, _ = e.send(origCon, plain("The session was canceled due to error, please retry later."))
+			}
+		}
+	}()
+
+	pub, userConfig, err := wf.CreatePublisher()
+	if err != nil {
+		return
+	}
+
+	token, err := pub.Login(m.Conversation(), userConfig)
+	if err != nil {
+		return fmt.Errorf("%s login failed: %w", wf.PublisherName(), err)
+	}
+
+	_, err = sendOutput(m.Conversation(), &token)
+	if err != nil {
+		return fmt.Errorf("unable to send auth token: %w", err)
+	}
+
+	note, err := e.prepareSession(m.Conversation(), wf, pub, standbySession.Params, true)
+	if err != nil {
+		return
+	}
+
+	_, err = e.sessions.ActivateSession(wf, userID, standbySession.Data.ID(), pub)
+	if err != nil {
+		return fmt.Errorf("session not activated: %w", err)
+	}
+
+	_, _ = sendOutput(origCon, &note)
+	return nil
+}
+
+func (e *Engine[C, M]) handleBotCmd_Cancel(m M, wf *bot.Workflow, cmd, params string) error {
+	prevReq, ok := e.sessions.ResolvePendingRequest(m.SenderID())
+	if !ok {
+		e.notice(m, plain("There is no pending request."))
+		return nil
+	}
+
+	e.notice(m,
+		plain("You have canceled the pending "),
+		code(e.CmdText(wf.BotCommands.TextOf(session.GetCommandFromRequest[C](prevReq)))),
+		plain(" request."),
+	)
+
+	if sr, isSR := prevReq.(*session.SessionRequest[C]); isSR {
+		if sr.Data.ID() != m.Chat().ID() {
+			_, _ = e.send(e.adapter.Conversation(sr.Data), plain("Session canceled by the initiator."))
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine[C, M]) handleBotCmd_End(m M, wf *bot.Workflow, cmd, params string) error {
+	currentSession, ok := e.sessions.ActiveSessionOf(m.Chat())
+	if !ok {
+		m.Logger().D("invalid command usage", log.String("cmd", cmd), log.String("reason", "no active session"))
+		e.notice(m, plain("There is no active session."))
+		return nil
+	}
+
+	msgs := currentSession.GetMessages()
+	content, err := bot.GenerateContent(
+		wf.Generator,
+		m.Conversation(),
+		wf.BotCommands.TextOf(rt.BotCmd_End),
+		params,
+		msgs,
+	)
+	if err != nil {
+		m.Logger().I("failed to generate post content", log.Error(err))
+		e.reply(m, plain("Internal bot error: failed to generate post content: "), bold(err.Error()))
+		return nil
+	}
+
+	note, err := currentSession.GetPublisher().AppendToExisting(
+		m.Conversation(),
+		wf.BotCommands.TextOf(rt.BotCmd_End),
+		params,
+		&content,
+	)
+	if err != nil {
+		m.Logger().I("failed to append content to post", log.Error(err))
+		e.reply(m, bold(currentSession.Workflow().PublisherName()), plain(" post update error: "), bold(err.Error()))
+		return nil
+	}
+
+	for _, msg := range msgs {
+		msg.Dispose()
+	}
+
+	currentSession.TruncMessages(len(msgs))
+
+	_, ok = e.sessions.DeactivateSessionOf(m.Chat())
+	if !ok {
+		e.reply(m, plain("Internal bot error: active session already been ended out of no reason."))
+		return nil
+	}
+
+	_, _ = sendOutput(m.Conversation(), &note)
+	return nil
+}
+
+func (e *Engine[C, M]) handleBotCmd_Include(m M, wf *bot.Workflow, cmd, params string) error {
+	if m.ReplyTo() == 0 {
+		m.Logger().D("invalid command usage", log.String("cmd", cmd), log.String("reason", "not a reply"))
+		e.notice(m, code(e.CmdText(cmd)), plain(e.opts.ReplyOnly))
+		return nil
+	}
+
+	_, ok := e.sessions.ActiveSessionOf(m.Chat())
+	if !ok {
+		m.Logger().D("invalid command usage", log.String("cmd", cmd), log.String("reason", "not in a session"))
+		e.notice(m, plain("There is no active session, "), code(e.CmdText(cmd)), plain(" will do nothing in this case."))
+		return nil
+	}
+
+	toAppend, ok := e.adapter.RepliedMessage(m)
+	if !ok {
+		e.notice(m, plain("That message is not available."))
+		return nil
+	}
+
+	err := e.adapter.AppendSessionMessage(toAppend)
+	if err != nil {
+		e.notice(m, plain("Failed to include that message."))
+		return err
+	}
+
+	e.notice(m, plain("Included."))
+	return nil
+}
+
+func (e *Engine[C, M]) handleBotCmd_Ignore(m M, wf *bot.Workflow, cmd, params string) error {
+	if m.ReplyTo() == 0 {
+		m.Logger().D("invalid command usage", log.String("cmd", cmd), log.String("reason", "not a reply"))
+		e.notice(m, code(e.CmdText(cmd)), plain(e.opts.ReplyOnly))
+		return nil
+	}
+
+	currentSession, ok := e.sessions.ActiveSessionOf(m.Chat())
+	if !ok {
+		m.Logger().D("invalid command usage", log.String("cmd", cmd), log.String("reason", "not in a session"))
+		e.notice(m, plain("There is no active session, "), code(e.CmdText(cmd)), plain(" will do nothing in this case."))
+		return nil
+	}
+
+	_ = currentSession.DeleteMessage(m.ReplyTo())
+
+	m.Logger().V("ignored message")
+	e.notice(m, plain("Ignored."))
+	return nil
+}
+
+func (e *Engine[C, M]) handleBotCmd_Edit(m M, wf *bot.Workflow, cmd, params string) error {
+	return e.handleBotCmd_Manage(m, wf, rt.BotCmd_Edit, cmd, params)
+}
+
+func (e *Engine[C, M]) handleBotCmd_List(m M, wf *bot.Workflow, cmd, params string) error {
+	return e.handleBotCmd_Manage(m, wf, rt.BotCmd_List, cmd, params)
+}
+
+func (e *Engine[C, M]) handleBotCmd_Delete(m M, wf *bot.Workflow, cmd, params string) error {
+	if len(params) == 0 {
+		m.Logger().D("invalid command usage", log.String("cmd", cmd), log.String("reason", "missing param"))
+		e.notice(m,
+			plain("Please specify the url(s) of the "),
+			bold(wf.PublisherName()),
+			plain(" post(s) to be deleted."),
+		)
+		return nil
+	}
+
+	return e.handleBotCmd_Manage(m, wf, rt.BotCmd_Delete, cmd, params)
+}
+
+// handleBotCmd_Manage handles edit, list and delete commands, they all require
+// publisher token sent in private chat
+func (e *Engine[C, M]) handleBotCmd_Manage(
+	m M,
+	wf *bot.Workflow,
+	bc rt.BotCmd,
+	cmd, params string,
+) error {
+	if !m.IsPrivate() {
+		e.notice(m, plain("You cannot use "), code(e.CmdText(cmd)), plain(" command in "+e.opts.GroupChat+"."))
+		return nil
+	}
+
+	var (
+		userID = m.SenderID()
+
+		prevCmd rt.BotCmd
+		ok      bool
+		action  string
+	)
+
+	switch bc {
+	case rt.BotCmd_Edit:
+		prevCmd, ok = e.sessions.MarkPendingEditing(wf, userID, requestTimeout)
+		action = "edit"
+	case rt.BotCmd_List:
+		prevCmd, ok = e.sessions.MarkPendingListing(wf, userID, requestTimeout)
+		action = "list your posts"
+	default:
+		prevCmd, ok = e.sessions.MarkPendingDeleting(wf, userID, params, requestTimeout)
+		action = "delete"
+	}
+
+	if !ok {
+		e.reply(m,
+			plain("You have pending "),
+			code(e.CmdText(wf.BotCommands.TextOf(prevCmd))),
+			plain(" request not finished."),
+		)
+		return nil
+	}
+
+	asked, err := e.askForInput(m, wf,
+		plain("Reply with your "),
+		bold(wf.PublisherName()),
+		plain(" token to "+action+"."),
+	)
+	if !asked || err != nil {
+		e.sessions.ResolvePendingRequest(userID)
+		if !asked {
+			e.reply(m, code(e.CmdText(cmd)), plain(" is not supported, there is no private chat to send your token."))
+		}
+	}
+
+	return err
+}
+
+func (e *Engine[C, M]) handleBotCmd_Help(m M, wf *bot.Workflow, cmd, params string) (err error) {
+	body := []rt.Span{
+		plain("Usage:\n"),
+	}
+
+	for i := range e.wfSet.Workflows {
+		wf := &e.wfSet.Workflows[i]
+		if !e.available(m, wf) {
+			continue
+		}
+
+		for i, cmd := range wf.BotCommands.Commands {
+			if len(cmd) == 0 || len(wf.BotCommands.Descriptions[i]) == 0 {
+				continue
+			}
+
+			body = append(body,
+				code(e.CmdText(cmd)),
+				plain(" - "+wf.BotCommands.Descriptions[i]+"\n"),
+			)
+		}
+	}
+
+	if !e.opts.HelpInPrivate || m.IsPrivate() {
+		_, err = e.adapter.Reply(m, body...)
+		return
+	}
+
+	chat, ok, err := e.adapter.PrivateChatOf(m)
+	if err != nil || !ok {
+		_, err = e.adapter.Reply(m, body...)
+		return
+	}
+
+	_, err = e.send(e.adapter.Conversation(chat), body...)
+	return
+}
+
+// askForInput sends the message asking for input in private chat, and marks the
+// pending request of the user expecting input
+//
+// asked is false when there is no private chat on the platform
+func (e *Engine[C, M]) askForInput(m M, wf *bot.Workflow, body ...rt.Span) (asked bool, err error) {
+	chat := m.Chat()
+	if !m.IsPrivate() {
+		var ok bool
+		chat, ok, err = e.adapter.PrivateChatOf(m)
+		if err != nil || !ok {
+			return ok, err
+		}
+	}
+
+	msgID, err := e.prompt(chat, wf, body...)
+	if err != nil {
+		return true, err
+	}
+
+	if !e.sessions.MarkRequestExpectingInput(m.SenderID(), msgID) {
+		return true, fmt.Errorf("no pending request")
+	}
+
+	return true, nil
+}
+
+// prompt sends the message asking for publisher token to the chat
+func (e *Engine[C, M]) prompt(chat C, wf *bot.Workflow, body ...rt.Span) (rt.MessageID, error) {
+	if p, ok := e.adapter.(Prompter[C]); ok {
+		return p.Prompt(chat, wf.PublisherName()+" token", body...)
+	}
+
+	return e.send(e.adapter.Conversation(chat), body...)
+}
+
+// linkButtons creates buttons opening private chat, textAndActions are pairs of
+// button text and action in start params
+//
+// ok is false when the platform has no private chat link
+func (e *Engine[C, M]) linkButtons(
+	userID rt.UserID,
+	chatID rt.ChatID,
+	textAndActions ...string,
+) (ret []rt.MessageCallbackSpec, ok bool) {
+	for i := 0; i+1 < len(textAndActions); i += 2 {
+		sp := startParams{action: textAndActions[i+1], userID: userID, chatID: chatID}
+
+		var url string
+		url, ok = e.adapter.PrivateChatLink(sp.encode())
+		if !ok {
+			return nil, false
+		}
+
+		ret = append(ret, rt.MessageCallbackSpec{Text: textAndActions[i]})
+		ret[len(ret)-1].URL.Set(url)
+	}
+
+	return
+}
+
+// sendLinks replies m with buttons of private chat links
+func (e *Engine[C, M]) sendLinks(m M, buttons []rt.MessageCallbackSpec, body ...rt.Span) error {
+	con := m.Conversation()
+	_, err := con.SendMessage(con.Context(), rt.SendMessageOptions{
+		ReplyTo:        m.MessageID(),
+		NoNotification: true,
+		NoWebPreview:   true,
+		Body:           body,
+		Callbacks:      [][]rt.MessageCallbackSpec{buttons},
+	})
+
+	return err
+}
@@ -0,0 +1,330 @@
+// Package engine implements botcmds and session handling shared by all bot platforms
+//
+// a platform parses incoming messages and hands them to the engine as botcmds or
+// potential input, the engine talks back through the platform Adapter
+package engine
+
+import (
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+// Message is the incoming message handled by the engine
+type Message[C session.Chat] interface {
+	// Chat returns the chat where the message was sent
+	Chat() C
+
+	// ChatName returns the name of the chat shown to users
+	ChatName() string
+
+	// IsPrivate returns true when the message was sent in private chat with the bot
+	IsPrivate() bool
+
+	// SenderID returns the id of the user sent this message
+	SenderID() rt.UserID
+
+	// MessageID returns the id of this message, 0 if unknown
+	MessageID() rt.MessageID
+
+	// ReplyTo returns the id of the message replied by this message, 0 if not a reply
+	ReplyTo() rt.MessageID
+
+	// InputText returns the text used as user input (e.g. publisher token)
+	InputText() string
+
+	// Conversation returns the conversation of the chat
+	Conversation() rt.Conversation
+
+	// Logger returns the logger with fields of this message
+	Logger() log.Interface
+}
+
+// Adapter is the platform specific part of the engine
+type Adapter[C session.Chat, M Message[C]] interface {
+	// Reply sends text message to the chat of m, as a reply to m when possible
+	Reply(m M, body ...rt.Span) (rt.MessageID, error)
+
+	// Conversation returns the conversation of the chat
+	Conversation(chat C) rt.Conversation
+
+	// DeleteAfter deletes messages in the chat after the delay, it does nothing
+	// when the platform doesn't support message deletion
+	DeleteAfter(chat C, delay time.Duration, msgIDs ...rt.MessageID)
+
+	// PrivateChatOf returns the private chat with the sender of m, ok is false
+	// when there is no private chat on the platform
+	PrivateChatOf(m M) (chat C, ok bool, err error)
+
+	// PrivateChatLink returns the url opening private chat with the bot, the
+	// platform MUST deliver the start botcmd with startParams to the engine when
+	// user opened the url
+	//
+	// ok is false when there is no such url, the engine asks for input in the
+	// private chat directly in that case
+	PrivateChatLink(startParams string) (url string, ok bool)
+
+	// IsAdmin checks whether the sender of m is admin of the (non-private) chat
+	IsAdmin(m M) (bool, error)
+
+	// RepliedMessage returns the message replied by m, ok is false when it's not
+	// available (e.g. sent long ago)
+	RepliedMessage(m M) (replied M, ok bool)
+
+	// AppendSessionMessage appends m to the active session of its chat
+	AppendSessionMessage(m M) error
+}
+
+// Prompter is implemented by adapters sending special messages when asking for
+// user input (e.g. force reply in telegram)
+type Prompter[C session.Chat] interface {
+	// Prompt sends the message asking for input to the chat, placeholder is the
+	// hint of the expected input
+	Prompt(chat C, placeholder string, body ...rt.Span) (rt.MessageID, error)
+}
+
+// ScopeChecker is implemented by adapters supporting workflow scopes, workflows
+// with scope are never available when the adapter doesn't implement it
+type ScopeChecker[M any] interface {
+	// InScope checks whether m is sent in the scope of the workflow
+	InScope(m M, wf *bot.Workflow, scope *bot.WorkflowScope) (bool, error)
+}
+
+// HandleFunc handles a single botcmd
+type HandleFunc[M any] func(m M, wf *bot.Workflow, cmd, params string) error
+
+// Options of the engine, empty notices are set to defaults in New
+type Options struct {
+	// CmdPrefix replaces `/` of botcmds shown to users (e.g. `!` for `!new`)
+	CmdPrefix string
+
+	// InputByReply requires private messages to be replies to the message asking
+	// for input to be treated as input
+	InputByReply bool
+
+	// HelpInPrivate sends usage of botcmds to private chat to avoid flooding
+	// group chats
+	HelpInPrivate bool
+
+	// AdminOnly is sent when users other than admins used botcmds of adminOnly
+	// workflows in group chat
+	//
+	// defaults to `Only admins can use this bot in group chat.`
+	AdminOnly string
+
+	// GroupChat is how group chats are called on the platform (e.g. `channel`)
+	//
+	// defaults to `group chat`
+	GroupChat string
+
+	// CheckPrivateChat is sent in group chat after asking for input in private chat
+	//
+	// defaults to `Please check private messages from me.`
+	CheckPrivateChat string
+
+	// ReplyOnly follows botcmds which can only be used as a reply when they are not
+	//
+	// defaults to ` can only be used as a reply.`
+	ReplyOnly string
+}
+
+// delays of message deletion
+const (
+	noticeTTL = 5 * time.Second
+	inputTTL  = 10 * time.Second
+	accessTTL = 5 * time.Minute
+
+	// requestTimeout is how long pending requests wait for input
+	requestTimeout = 5 * time.Minute
+)
+
+// New creates an engine serving workflows in wfSet, sessions are shared with the
+// platform to find active sessions when appending messages
+func New[C session.Chat, M Message[C]](
+	adapter Adapter[C, M],
+	sessions session.Manager[C],
+	wfSet *bot.WorkflowSet,
+	opts Options,
+) *Engine[C, M] {
+	if len(opts.AdminOnly) == 0 {
+		opts.AdminOnly = "Only admins can use this bot in group chat."
+	}
+
+	if len(opts.GroupChat) == 0 {
+		opts.GroupChat = "group chat"
+	}
+
+	if len(opts.CheckPrivateChat) == 0 {
+		opts.CheckPrivateChat = "Please check private messages from me."
+	}
+
+	if len(opts.ReplyOnly) == 0 {
+		opts.ReplyOnly = " can only be used as a reply."
+	}
+
+	e := &Engine[C, M]{
+		adapter:  adapter,
+		sessions: sessions,
+		wfSet:    wfSet,
+		opts:     opts,
+	}
+
+	e.handlers = map[rt.BotCmd]HandleFunc[M]{
+		rt.BotCmd_New:     e.handleBotCmd_New,
+		rt.BotCmd_Resume:  e.handleBotCmd_Resume,
+		rt.BotCmd_Start:   e.handleBotCmd_Start,
+		rt.BotCmd_Cancel:  e.handleBotCmd_Cancel,
+		rt.BotCmd_End:     e.handleBotCmd_End,
+		rt.BotCmd_Include: e.handleBotCmd_Include,
+		rt.BotCmd_Ignore:  e.handleBotCmd_Ignore,
+		rt.BotCmd_Edit:    e.handleBotCmd_Edit,
+		rt.BotCmd_List:    e.handleBotCmd_List,
+		rt.BotCmd_Delete:  e.handleBotCmd_Delete,
+		rt.BotCmd_Help:    e.handleBotCmd_Help,
+	}
+
+	return e
+}
+
+// Engine handles botcmds and user input for sessions
+type Engine[C session.Chat, M Message[C]] struct {
+	adapter  Adapter[C, M]
+	sessions session.Manager[C]
+	wfSet    *bot.WorkflowSet
+	opts     Options
+
+	handlers map[rt.BotCmd]HandleFunc[M]
+}
+
+// Handle replaces the default handler of the botcmd, MUST be called before
+// handling any message
+func (e *Engine[C, M]) Handle(bc rt.BotCmd, h HandleFunc[M]) {
+	e.handlers[bc] = h
+}
+
+// HandleBotCmd handles single botcmd with all params as a single string, it
+// returns false when the cmd is not known to any workflow available to m
+func (e *Engine[C, M]) HandleBotCmd(m M, cmd, params string) (bool, error) {
+	wf, ok := e.wfSet.WorkflowFor(cmd)
+	if !ok {
+		return false, nil
+	}
+
+	m.Logger().V("handle bot command", log.String("cmd", cmd))
+
+	bc := wf.BotCommands.Parse(cmd)
+
+	// start botcmds in private chat continue requests made in scope (e.g. start
+	// links), the request is checked by its handler
+	inScope := (bc == rt.BotCmd_Start && m.IsPrivate()) || e.available(m, wf)
+	if !inScope {
+		// behave as if the workflow doesn't exist here
+		m.Logger().V("botcmd not in scope of the workflow",
+			log.String("cmd", cmd),
+			rt.LogChatID(m.Chat().ID()),
+			rt.LogSenderID(m.SenderID()),
+		)
+		return false, nil
+	}
+
+	if wf.RequireAdmin() && !m.IsPrivate() {
+		// ensure only admin can use this bot in group chat
+
+		isAdmin, err := e.adapter.IsAdmin(m)
+		if err != nil {
+			e.reply(m, plain("Internal bot error: unable to verify the initiator: "), bold(err.Error()))
+			return true, err
+		}
+
+		if !isAdmin {
+			e.notice(m, plain(e.opts.AdminOnly))
+			return true, nil
+		}
+	}
+
+	handle, ok := e.handlers[bc]
+	if !ok {
+		m.Logger().E("unhandled cmd", log.String("cmd", cmd))
+		e.reply(m, plain("Internal bot error: "), bold(e.CmdText(cmd)), plain(" not handled."))
+		return true, nil
+	}
+
+	return true, handle(m, wf, cmd, params)
+}
+
+// available checks whether the workflow is available to m
+func (e *Engine[C, M]) available(m M, wf *bot.Workflow) bool {
+	scope := wf.Scope()
+	if scope == nil {
+		return true
+	}
+
+	checker, ok := e.adapter.(ScopeChecker[M])
+	if !ok {
+		return false
+	}
+
+	ok, err := checker.InScope(m, wf, scope)
+	if err != nil {
+		m.Logger().I("failed to check workflow scope", log.Error(err))
+		return false
+	}
+
+	return ok
+}
+
+// CmdText converts workflow botcmd to the one used on the platform
+func (e *Engine[C, M]) CmdText(cmd string) string {
+	if len(e.opts.CmdPrefix) == 0 {
+		return cmd
+	}
+
+	return e.opts.CmdPrefix + strings.TrimPrefix(cmd, "/")
+}
+
+func plain(text string) rt.Span { return rt.Span{Flags: rt.SpanFlag_PlainText, Text: text} }
+func bold(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Bold, Text: text} }
+func code(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Code, Text: text} }
+
+// reply replies m with best effort
+func (e *Engine[C, M]) reply(m M, body ...rt.Span) rt.MessageID {
+	msgID, err := e.adapter.Reply(m, body...)
+	if err != nil {
+		m.Logger().I("failed to reply", log.Error(err))
+	}
+
+	return msgID
+}
+
+// notice replies m and deletes both the notice and m later
+func (e *Engine[C, M]) notice(m M, body ...rt.Span) {
+	msgID := e.reply(m, body...)
+	e.adapter.DeleteAfter(m.Chat(), noticeTTL, msgID, m.MessageID())
+}
+
+// send sends text message to the chat, returns id of the first message sent
+func (e *Engine[C, M]) send(con rt.Conversation, body ...rt.Span) (msgID rt.MessageID, err error) {
+	msgIDs, err := con.SendMessage(con.Context(), rt.SendMessageOptions{
+		NoWebPreview: true,
+		Body:         body,
+	})
+	if len(msgIDs) != 0 {
+		msgID = msgIDs[0]
+	}
+
+	return
+}
+
+// sendOutput sends message in the publisher output (if any) to the conversation
+func sendOutput(con rt.Conversation, out *rt.PublisherOutput) ([]rt.MessageID, error) {
+	if out.SendMessage.IsNil() {
+		return nil, nil
+	}
+
+	return con.SendMessage(con.Context(), out.SendMessage.Get())
+}
@@ -0,0 +1,650 @@
+package engine
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+func TestStartParams(t *testing.T) {
+	sp := startParams{action: actionCreate, userID: math.MaxUint64, chatID: math.MaxUint64}
+	encoded := sp.encode()
+
+	// telegram allows up to 64 characters
+	assert.LessOrEqual(t, len(encoded), 64)
+
+	decoded, err := decodeStartParams(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, sp, decoded)
+
+	for _, bad := range []string{
+		"not base64 !",
+		"Y3JlYXRl",         // create
+		"Y3JlYXRlOjE6Mg==", // create:1:2
+	} {
+		_, err = decodeStartParams(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+var _ session.TopicChat = testChat{}
+
+// testChat is named as `{chat}[/{topic}]`
+type testChat struct {
+	name string
+}
+
+func (c testChat) ID() rt.ChatID {
+	chat, _, _ := strings.Cut(c.name, "/")
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(chat))
+	return rt.ChatID(h.Sum64())
+}
+
+func (c testChat) TopicID() rt.MessageID {
+	_, topic, _ := strings.Cut(c.name, "/")
+	id, _ := strconv.ParseUint(topic, 10, 64)
+	return rt.MessageID(id)
+}
+
+// private chats are named after users with `@` prefix
+func (c testChat) private() bool { return strings.HasPrefix(c.name, "@") }
+
+type testMessage struct {
+	a *testAdapter
+
+	chat    testChat
+	user    string
+	id      rt.MessageID
+	replyTo rt.MessageID
+	text    string
+}
+
+func (m *testMessage) Chat() testChat          { return m.chat }
+func (m *testMessage) ChatName() string        { return m.chat.name }
+func (m *testMessage) IsPrivate() bool         { return m.chat.private() }
+func (m *testMessage) SenderID() rt.UserID     { return rt.UserID(testChat{m.user}.ID()) }
+func (m *testMessage) MessageID() rt.MessageID { return m.id }
+func (m *testMessage) ReplyTo() rt.MessageID   { return m.replyTo }
+func (m *testMessage) InputText() string       { return m.text }
+func (m *testMessage) Logger() log.Interface   { return log.NoOpLogger }
+
+func (m *testMessage) Conversation() rt.Conversation {
+	return &testConversation{a: m.a, chat: m.chat}
+}
+
+type testSent struct {
+	id      rt.MessageID
+	chat    string
+	text    string
+	buttons []string
+}
+
+type testConversation struct {
+	a    *testAdapter
+	chat testChat
+}
+
+func (c *testConversation) Context() context.Context { return context.TODO() }
+
+func (c *testConversation) SendMessage(ctx context.Context, opts rt.SendMessageOptions) ([]rt.MessageID, error) {
+	var (
+		text    strings.Builder
+		buttons []string
+	)
+
+	for _, sp := range opts.Body {
+		text.WriteString(sp.Text)
+	}
+
+	for _, row := range opts.Callbacks {
+		for _, cb := range row {
+			buttons = append(buttons, cb.Text+" "+cb.URL.Get())
+		}
+	}
+
+	return []rt.MessageID{c.a.record(c.chat.name, text.String(), buttons)}, nil
+}
+
+var _ Adapter[testChat, *testMessage] = (*testAdapter)(nil)
+
+type testAdapter struct {
+	sessions session.Manager[testChat]
+
+	admins    map[string]bool
+	noPrivate bool
+	link      bool
+
+	mu    sync.Mutex
+	seq   rt.MessageID
+	sent  []testSent
+	msgs  map[rt.MessageID]*testMessage
+	input rt.MessageID
+}
+
+func (a *testAdapter) record(chat, text string, buttons []string) rt.MessageID {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+	a.sent = append(a.sent, testSent{id: a.seq, chat: chat, text: text, buttons: buttons})
+	return a.seq
+}
+
+// take returns all messages sent since last call
+func (a *testAdapter) take() (ret []testSent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ret, a.sent = a.sent, nil
+	return
+}
+
+func (a *testAdapter) newMessage(chat, user, text string, replyTo rt.MessageID) *testMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+	m := &testMessage{a: a, chat: testChat{chat}, user: user, id: a.seq, replyTo: replyTo, text: text}
+	a.msgs[m.id] = m
+	return m
+}
+
+func (a *testAdapter) Reply(m *testMessage, body ...rt.Span) (rt.MessageID, error) {
+	msgIDs, err := m.Conversation().SendMessage(context.TODO(), rt.SendMessageOptions{ReplyTo: m.id, Body: body})
+	if err != nil {
+		return 0, err
+	}
+
+	return msgIDs[0], nil
+}
+
+func (a *testAdapter) Conversation(chat testChat) rt.Conversation {
+	return &testConversation{a: a, chat: chat}
+}
+
+func (a *testAdapter) DeleteAfter(chat testChat, delay time.Duration, msgIDs ...rt.MessageID) {}
+
+func (a *testAdapter) PrivateChatOf(m *testMessage) (testChat, bool, error) {
+	return testChat{"@" + m.user}, !a.noPrivate, nil
+}
+
+func (a *testAdapter) PrivateChatLink(startParams string) (string, bool) {
+	return "https://example.com/bot?start=" + startParams, a.link
+}
+
+func (a *testAdapter) IsAdmin(m *testMessage) (bool, error) { return a.admins[m.user], nil }
+
+func (a *testAdapter) RepliedMessage(m *testMessage) (*testMessage, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	replied, ok := a.msgs[m.replyTo]
+	return replied, ok
+}
+
+func (a *testAdapter) AppendSessionMessage(m *testMessage) error {
+	s, ok := a.sessions.ActiveSessionOf(m.chat)
+	if !ok {
+		return nil
+	}
+
+	msg := rt.NewMessage()
+	msg.ID = m.id
+	msg.Author = m.user
+	msg.Text = m.text
+	s.AppendMessage(msg)
+	return nil
+}
+
+var _ ScopeChecker[*testMessage] = testScopedAdapter{}
+
+// testScopedAdapter matches workflow scope with chat names and users
+type testScopedAdapter struct {
+	*testAdapter
+}
+
+func (a testScopedAdapter) InScope(m *testMessage, wf *bot.Workflow, scope *bot.WorkflowScope) (bool, error) {
+	for _, chat := range scope.Chats {
+		if chat == m.chat.name {
+			return true, nil
+		}
+	}
+
+	for _, u := range scope.Users {
+		if u.Chat == m.chat.name && u.User == m.user {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+var _ Prompter[testChat] = (*testPrompter)(nil)
+
+type testPrompter struct {
+	*testAdapter
+}
+
+func (p testPrompter) Prompt(chat testChat, placeholder string, body ...rt.Span) (rt.MessageID, error) {
+	return p.record(chat.name, "["+placeholder+"] "+body[0].Text, nil), nil
+}
+
+type testScopedPrompter struct {
+	*testAdapter
+}
+
+func (p testScopedPrompter) InScope(m *testMessage, wf *bot.Workflow, scope *bot.WorkflowScope) (bool, error) {
+	return testScopedAdapter{p.testAdapter}.InScope(m, wf, scope)
+}
+
+func (p testScopedPrompter) Prompt(chat testChat, placeholder string, body ...rt.Span) (rt.MessageID, error) {
+	return testPrompter{p.testAdapter}.Prompt(chat, placeholder, body...)
+}
+
+type testBot struct {
+	*testAdapter
+
+	e *Engine[testChat, *testMessage]
+}
+
+func newTestBot(t *testing.T, adminOnly bool, pub *bottest.Publisher, opts Options) *testBot {
+	ctx, cancel := context.WithCancel(context.TODO())
+	t.Cleanup(cancel)
+
+	cc := bottest.CommonConfig(adminOnly, false)
+	wfSet, err := cc.Resolve(bottest.NewCreationContext(pub))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	a := &testAdapter{
+		sessions: session.NewManager[testChat](ctx),
+		admins:   map[string]bool{"alice": true},
+		msgs:     make(map[rt.MessageID]*testMessage),
+	}
+
+	return &testBot{
+		testAdapter: a,
+		e:           New[testChat, *testMessage](a, a.sessions, &wfSet, opts),
+	}
+}
+
+// send handles text as botcmd, input or session message in order, like what
+// platforms do
+func (b *testBot) send(t *testing.T, chat, user, text string, replyTo rt.MessageID) *testMessage {
+	m := b.newMessage(chat, user, text, replyTo)
+
+	if strings.HasPrefix(text, "/") {
+		cmd, params, _ := strings.Cut(text, " ")
+		handled, err := b.e.HandleBotCmd(m, cmd, params)
+		assert.NoError(t, err)
+		if handled {
+			return m
+		}
+	}
+
+	handled, err := b.e.HandleInput(m)
+	assert.NoError(t, err)
+	if !handled {
+		assert.NoError(t, b.AppendSessionMessage(m))
+	}
+
+	return m
+}
+
+func (b *testBot) expect(t *testing.T, expected ...testSent) []testSent {
+	sent := b.take()
+	for i := range sent {
+		sent[i].id = 0
+	}
+
+	assert.Equal(t, expected, sent)
+	return sent
+}
+
+func TestEngine(t *testing.T) {
+	t.Run("Session", func(t *testing.T) {
+		pub := &bottest.Publisher{}
+		b := newTestBot(t, true, pub, Options{})
+
+		b.send(t, "#group", "bob", "/new weekly", 0)
+		b.expect(t, testSent{chat: "#group", text: "Only admins can use this bot in group chat."})
+
+		b.send(t, "#group", "alice", "/new", 0)
+		b.expect(t, testSent{chat: "#group", text: "Please specify a session topic, e.g. /new foo"})
+
+		early := b.send(t, "#group", "bob", "sent before the session", 0)
+
+		b.send(t, "#group", "alice", "/new weekly", 0)
+		b.expect(t, testSent{chat: "#group", text: "created weekly"})
+
+		b.send(t, "#group", "alice", "/new other", 0)
+		b.expect(t, testSent{chat: "#group", text: "Please end existing session before starting a new one."})
+
+		b.send(t, "#group", "bob", "hello", 0)
+		noise := b.send(t, "#group", "bob", "noise", 0)
+
+		b.send(t, "#group", "alice", "/include", 0)
+		b.expect(t, testSent{chat: "#group", text: "/include can only be used as a reply."})
+
+		b.send(t, "#group", "alice", "/include", early.id)
+		b.send(t, "#group", "alice", "/include", math.MaxUint32)
+		b.send(t, "#group", "alice", "/ignore", noise.id)
+		b.expect(t,
+			testSent{chat: "#group", text: "Included."},
+			testSent{chat: "#group", text: "That message is not available."},
+			testSent{chat: "#group", text: "Ignored."},
+		)
+
+		b.send(t, "#group", "alice", "/end", 0)
+		b.expect(t, testSent{chat: "#group", text: "published"})
+
+		b.send(t, "#group", "alice", "/end", 0)
+		b.expect(t, testSent{chat: "#group", text: "There is no active session."})
+
+		assert.Equal(t, []string{"weeklybob: hello\nbob: sent before the session\n"}, pub.Posts())
+	})
+
+	t.Run("Login", func(t *testing.T) {
+		pub := &bottest.Publisher{Token: "secret"}
+		b := newTestBot(t, false, pub, Options{CmdPrefix: "!", CheckPrivateChat: "Check DM."})
+
+		b.send(t, "#group", "bob", "/new weekly", 0)
+		b.expect(t,
+			testSent{chat: "@bob", text: "Reply with your fake token for the session in #group, or send !start to create a new one."},
+			testSent{chat: "#group", text: "Check DM."},
+		)
+
+		b.send(t, "#group", "bob", "/new again", 0)
+		b.expect(t, testSent{chat: "#group", text: "You have already started a session with no token replied, please end that first."})
+
+		b.send(t, "@bob", "bob", "wrong", 0)
+		b.expect(t, testSent{chat: "@bob", text: "fake auth error: invalid token"})
+
+		b.send(t, "@bob", "bob", " secret\n", 0)
+		b.expect(t,
+			testSent{chat: "@bob", text: "Success!"},
+			testSent{chat: "#group", text: "created weekly"},
+		)
+
+		b.send(t, "#group", "bob", "/end", 0)
+		b.expect(t, testSent{chat: "#group", text: "published"})
+
+		// create new publisher user
+		b.send(t, "#group", "bob", "/new monthly", 0)
+		b.take()
+
+		b.send(t, "@bob", "bob", "/start", 0)
+		b.expect(t,
+			testSent{chat: "@bob", text: "token secret"},
+			testSent{chat: "#group", text: "created monthly"},
+		)
+
+		b.send(t, "#group", "bob", "/resume weekly", 0)
+		b.expect(t, testSent{chat: "#group", text: "Please end existing session before starting a new one."})
+
+		b.send(t, "#other", "bob", "/new yearly", 0)
+		b.take()
+
+		b.send(t, "@bob", "bob", "/cancel", 0)
+		b.expect(t,
+			testSent{chat: "@bob", text: "You have canceled the pending !new request."},
+			testSent{chat: "#other", text: "Session canceled by the initiator."},
+		)
+
+		b.send(t, "@bob", "bob", "secret", 0)
+		b.expect(t)
+
+		assert.Equal(t, []string{"weekly", "monthly"}, pub.Posts())
+	})
+
+	t.Run("Link", func(t *testing.T) {
+		pub := &bottest.Publisher{Token: "secret"}
+		b := newTestBot(t, false, pub, Options{InputByReply: true})
+		b.link = true
+		p := testPrompter{b.testAdapter}
+		b.e = New[testChat, *testMessage](p, b.sessions, b.e.wfSet, Options{InputByReply: true})
+
+		b.send(t, "#group", "bob", "/new weekly", 0)
+		sent := b.take()
+		if !assert.Len(t, sent, 1) || !assert.Len(t, sent[0].buttons, 2) {
+			return
+		}
+		assert.Equal(t, "Create or enter your fake token for this session.", sent[0].text)
+
+		startParamsOf := func(button string) string {
+			u, err := url.Parse(button[strings.IndexByte(button, ' ')+1:])
+			assert.NoError(t, err)
+			return u.Query().Get("start")
+		}
+
+		create, enter := startParamsOf(sent[0].buttons[0]), startParamsOf(sent[0].buttons[1])
+
+		b.send(t, "@carol", "carol", "/start "+enter, 0)
+		b.expect(t, testSent{chat: "@carol", text: "The link is not for you :("})
+
+		b.send(t, "#group", "bob", "/start "+enter, 0)
+		b.expect(t, testSent{chat: "#group", text: "You cannot use /start command in group chat."})
+
+		b.send(t, "@bob", "bob", "/start "+enter, 0)
+		b.expect(t, testSent{chat: "@bob", text: "[fake token] Reply this message with your "})
+
+		prompt := b.seq
+
+		// not a reply to the prompt
+		b.send(t, "@bob", "bob", "secret", 0)
+		b.expect(t)
+
+		b.send(t, "@bob", "bob", "secret", prompt)
+		b.expect(t,
+			testSent{chat: "@bob", text: "Success!"},
+			testSent{chat: "#group", text: "created weekly"},
+		)
+
+		b.send(t, "@bob", "bob", "/start "+create, 0)
+		b.expect(t, testSent{chat: "@bob", text: "No session requested."})
+	})
+
+	t.Run("Manage", func(t *testing.T) {
+		pub := &bottest.Publisher{Token: "secret"}
+		b := newTestBot(t, false, pub, Options{GroupChat: "channel"})
+
+		b.send(t, "#group", "bob", "/edit", 0)
+		b.expect(t, testSent{chat: "#group", text: "You cannot use /edit command in channel."})
+
+		b.send(t, "@bob", "bob", "/delete", 0)
+		b.expect(t, testSent{chat: "@bob", text: "Please specify the url(s) of the fake post(s) to be deleted."})
+
+		for _, test := range []struct {
+			cmd    string
+			result string
+		}{
+			{cmd: "/edit", result: "access"},
+			{cmd: "/list", result: "0 posts"},
+			{cmd: "/delete foo", result: "deleted foo"},
+		} {
+			b.send(t, "@bob", "bob", test.cmd, 0)
+			b.take()
+
+			b.send(t, "@bob", "bob", "/list", 0)
+			b.expect(t, testSent{chat: "@bob", text: "You have pending " + strings.Fields(test.cmd)[0] + " request not finished."})
+
+			b.send(t, "@bob", "bob", "secret", 0)
+			b.expect(t, testSent{chat: "@bob", text: test.result})
+		}
+
+		b.send(t, "@bob", "bob", "/help", 0)
+		sent := b.take()
+		if assert.Len(t, sent, 1) {
+			assert.True(t, strings.HasPrefix(sent[0].text, "Usage:\n/help - show help text\n/new - "))
+		}
+	})
+
+	t.Run("No Private Chat", func(t *testing.T) {
+		pub := &bottest.Publisher{Token: "secret"}
+		b := newTestBot(t, false, pub, Options{})
+		b.noPrivate = true
+
+		b.send(t, "#group", "bob", "/new weekly", 0)
+		b.expect(t, testSent{
+			chat: "#group",
+			text: "fake requires login, which is not supported without private chat, please configure the publisher with credentials.",
+		})
+
+		b.send(t, "#group", "bob", "/new weekly", 0)
+		b.take()
+	})
+
+	t.Run("Scope", func(t *testing.T) {
+		cc := bottest.CommonConfig(false, false)
+		cc.Workflows[0].Scope = bot.WorkflowScope{
+			Chats: []string{"#team"},
+			Users: []bot.ScopedUser{{Chat: "#group", User: "carol"}},
+		}
+
+		wfSet, err := cc.Resolve(bottest.NewCreationContext(&bottest.Publisher{}))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		b := newTestBot(t, false, &bottest.Publisher{}, Options{})
+
+		// adapter without scope support
+		b.e = New[testChat, *testMessage](b.testAdapter, b.sessions, &wfSet, Options{})
+		b.send(t, "#team", "bob", "/new weekly", 0)
+		b.expect(t)
+
+		b.e = New[testChat, *testMessage](testScopedAdapter{b.testAdapter}, b.sessions, &wfSet, Options{})
+		handled, err := b.e.HandleBotCmd(b.newMessage("#group", "bob", "/new weekly", 0), "/new", "weekly")
+		assert.NoError(t, err)
+		assert.False(t, handled)
+
+		b.send(t, "#group", "bob", "/new weekly", 0)
+		b.send(t, "#group", "bob", "/help", 0)
+		b.expect(t)
+
+		b.send(t, "#group", "carol", "/new weekly", 0)
+		b.expect(t, testSent{chat: "#group", text: "created weekly"})
+
+		b.send(t, "#team", "bob", "/help", 0)
+		sent := b.take()
+		if assert.Len(t, sent, 1) {
+			assert.Contains(t, sent[0].text, "/new")
+		}
+	})
+
+	t.Run("Scope Login", func(t *testing.T) {
+		pub := &bottest.Publisher{Token: "secret"}
+		cc := bottest.CommonConfig(false, false)
+		cc.Workflows[0].Scope = bot.WorkflowScope{Chats: []string{"#team"}}
+
+		wfSet, err := cc.Resolve(bottest.NewCreationContext(pub))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		b := newTestBot(t, false, pub, Options{})
+		b.link = true
+		b.e = New[testChat, *testMessage](testScopedPrompter{b.testAdapter}, b.sessions, &wfSet, Options{})
+
+		b.send(t, "#team", "bob", "/new weekly", 0)
+		sent := b.take()
+		if !assert.Len(t, sent, 1) || !assert.Len(t, sent[0].buttons, 2) {
+			return
+		}
+
+		u, err := url.Parse(sent[0].buttons[1][strings.IndexByte(sent[0].buttons[1], ' ')+1:])
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// private chat is out of scope
+		b.send(t, "@bob", "bob", "/new other", 0)
+		b.expect(t)
+
+		b.send(t, "@bob", "bob", "/start "+u.Query().Get("start"), 0)
+		b.expect(t, testSent{chat: "@bob", text: "[fake token] Reply this message with your "})
+
+		b.send(t, "@bob", "bob", "secret", 0)
+		b.expect(t,
+			testSent{chat: "@bob", text: "Success!"},
+			testSent{chat: "#team", text: "created weekly"},
+		)
+
+		// start in group chat is still checked
+		b.send(t, "#group", "bob", "/start", 0)
+		b.expect(t)
+	})
+
+	t.Run("Topic", func(t *testing.T) {
+		pub := &bottest.Publisher{Token: "secret"}
+		b := newTestBot(t, false, pub, Options{})
+
+		b.send(t, "#forum/2", "bob", "/new weekly", 0)
+		b.take()
+		b.send(t, "@bob", "bob", "secret", 0)
+		b.expect(t,
+			testSent{chat: "@bob", text: "Success!"},
+			testSent{chat: "#forum/2", text: "created weekly"},
+		)
+
+		b.send(t, "#forum/3", "bob", "/new monthly", 0)
+		b.take()
+		b.send(t, "@bob", "bob", "secret", 0)
+		b.expect(t,
+			testSent{chat: "@bob", text: "Success!"},
+			testSent{chat: "#forum/3", text: "created monthly"},
+		)
+
+		b.send(t, "#forum/2", "bob", "/new other", 0)
+		b.expect(t, testSent{chat: "#forum/2", text: "Please end existing session before starting a new one."})
+
+		b.send(t, "#forum/2", "bob", "hello", 0)
+		b.send(t, "#forum/3", "carol", "hi", 0)
+		b.send(t, "#forum", "carol", "general", 0)
+
+		b.send(t, "#forum", "bob", "/end", 0)
+		b.expect(t, testSent{chat: "#forum", text: "There is no active session."})
+
+		b.send(t, "#forum/3", "bob", "/end", 0)
+		b.send(t, "#forum/2", "bob", "/end", 0)
+		b.expect(t,
+			testSent{chat: "#forum/3", text: "published"},
+			testSent{chat: "#forum/2", text: "published"},
+		)
+
+		// the fake publisher appends to the last post
+		assert.Equal(t, []string{"weekly", "monthlycarol: hi\nbob: hello\n"}, pub.Posts())
+	})
+
+	t.Run("Custom Handler", func(t *testing.T) {
+		b := newTestBot(t, false, &bottest.Publisher{}, Options{})
+		b.e.Handle(rt.BotCmd_Include, func(m *testMessage, wf *bot.Workflow, cmd, params string) error {
+			_, err := b.Reply(m, rt.Span{Text: "include " + params})
+			return err
+		})
+
+		b.send(t, "#group", "bob", "/include 1", 0)
+		b.expect(t, testSent{chat: "#group", text: "include 1"})
+
+		handled, err := b.e.HandleBotCmd(b.newMessage("#group", "bob", "", 0), "/unknown", "")
+		assert.NoError(t, err)
+		assert.False(t, handled)
+	})
+}
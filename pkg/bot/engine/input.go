@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/publisher"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+// HandleInput treats m as user input for pending requests of the sender, it
+// returns false when m is not expected
+//
+// only messages in private chat can be input
+func (e *Engine[C, M]) HandleInput(m M) (bool, error) {
+	if !m.IsPrivate() {
+		return false, nil
+	}
+
+	for _, handle := range [...]func(m M) (bool, error){
+		e.tryToHandleInputForDiscussOrContinue,
+		e.tryToHandleInputForEditing,
+		e.tryToHandleInputForListing,
+		e.tryToHandleInputForDeleting,
+	} {
+		done, err := handle(m)
+		if done {
+			return true, err
+		}
+	}
+
+	return false, nil
+}
+
+// isExpected checks whether the request is expecting m as input, returns id of
+// the message asking for input
+func (e *Engine[C, M]) isExpected(m M, req session.Request) (rt.MessageID, bool) {
+	msgIDShouldReplyTo, isExpectingInput := req.GetMessageIDShouldReplyTo()
+	if !isExpectingInput {
+		return 0, false
+	}
+
+	if e.opts.InputByReply && m.ReplyTo() != msgIDShouldReplyTo {
+		return 0, false
+	}
+
+	return msgIDShouldReplyTo, true
+}
+
+func (e *Engine[C, M]) tryToHandleInputForDiscussOrContinue(m M) (handled bool, err error) {
+	userID := m.SenderID()
+
+	m.Logger().V("try handle input for discuss or continue")
+	standbySession, ok := e.sessions.GetStandbySession(userID)
+	if !ok {
+		return false, nil
+	}
+
+	msgIDShouldReplyTo, ok := e.isExpected(m, standbySession)
+	if !ok {
+		return false, nil
+	}
+
+	handled = true
+	wf := standbySession.Workflow()
+	origCon := e.adapter.Conversation(standbySession.Data)
+
+	defer func() {
+		if err != nil {
+			_, _ = e.sessions.ResolvePendingRequest(userID)
+
+			// best effort
+			e.reply(m, plain("The session was canceled due to error, please retry later: "), bold(err.Error()))
+			if standbySession.Data.ID() != m.Chat().ID() {
+				_, _ = e.send(origCon, plain("The session was canceled due to error, please retry later."))
+			}
+		}
+	}()
+
+	pub, ok, err := e.loginWithToken(m, wf)
+	if !ok {
+		return
+	}
+
+	note, err := e.prepareSession(m.Conversation(), wf, pub, standbySession.Params, standbySession.IsNew)
+	if err != nil {
+		if !standbySession.IsNew {
+			// we may not find the post if user provided a wrong key, let user try again
+			e.reply(m, plain("Retrieve "), bold(wf.PublisherName()), plain(" post failed: "), bold(err.Error()))
+			return true, nil
+		}
+
+		return
+	}
+
+	m.Logger().V("activate session")
+	_, err = e.sessions.ActivateSession(wf, userID, standbySession.Data.ID(), pub)
+	if err != nil {
+		return
+	}
+
+	msgID := e.reply(m, plain("Success!"))
+
+	// delete user provided token related messages
+	e.adapter.DeleteAfter(m.Chat(), inputTTL, msgID, m.MessageID(), msgIDShouldReplyTo)
+
+	_, _ = sendOutput(origCon, &note)
+	return true, nil
+}
+
+func (e *Engine[C, M]) tryToHandleInputForEditing(m M) (bool, error) {
+	m.Logger().V("try handle input for editing")
+	req, ok := e.sessions.GetPendingEditing(m.SenderID())
+	if !ok {
+		return false, nil
+	}
+
+	msgIDShouldReplyTo, ok := e.isExpected(m, req)
+	if !ok {
+		return false, nil
+	}
+
+	return true, e.handleManageInput(m, req.Workflow(), "edit", msgIDShouldReplyTo, func(pub publisher.Interface) (rt.PublisherOutput, error) {
+		return pub.RequestExternalAccess(m.Conversation())
+	})
+}
+
+func (e *Engine[C, M]) tryToHandleInputForListing(m M) (bool, error) {
+	m.Logger().V("try handle input for listing")
+	req, ok := e.sessions.GetPendingListing(m.SenderID())
+	if !ok {
+		return false, nil
+	}
+
+	msgIDShouldReplyTo, ok := e.isExpected(m, req)
+	if !ok {
+		return false, nil
+	}
+
+	return true, e.handleManageInput(m, req.Workflow(), "list", msgIDShouldReplyTo, func(pub publisher.Interface) (rt.PublisherOutput, error) {
+		return pub.List(m.Conversation())
+	})
+}
+
+func (e *Engine[C, M]) tryToHandleInputForDeleting(m M) (bool, error) {
+	m.Logger().V("try handle input for deleting")
+	req, ok := e.sessions.GetPendingDeleting(m.SenderID())
+	if !ok {
+		return false, nil
+	}
+
+	msgIDShouldReplyTo, ok := e.isExpected(m, req)
+	if !ok {
+		return false, nil
+	}
+
+	return true, e.handleManageInput(m, req.Workflow(), "delete", msgIDShouldReplyTo, func(pub publisher.Interface) (rt.PublisherOutput, error) {
+		return pub.Delete(m.Conversation(), req.Workflow().BotCommands.TextOf(rt.BotCmd_Delete), req.Params)
+	})
+}
+
+func (e *Engine[C, M]) handleManageInput(
+	m M,
+	wf *bot.Workflow,
+	action string,
+	msgIDShouldReplyTo rt.MessageID,
+	do func(pub publisher.Interface) (rt.PublisherOutput, error),
+) (err error) {
+	userID := m.SenderID()
+
+	defer func() {
+		if err != nil {
+			_, _ = e.sessions.ResolvePendingRequest(userID)
+
+			// best effort
+			e.reply(m, plain("The "+action+" request was canceled due to error, please retry later: "), bold(err.Error()))
+		}
+	}()
+
+	pub, ok, err := e.loginWithToken(m, wf)
+	if !ok {
+		return
+	}
+
+	out, err := do(pub)
+	if err != nil {
+		return
+	}
+
+	e.sessions.ResolvePendingRequest(userID)
+
+	msgIDs, _ := sendOutput(m.Conversation(), &out)
+
+	// delete user provided token related messages
+	e.adapter.DeleteAfter(m.Chat(), inputTTL, m.MessageID(), msgIDShouldReplyTo)
+
+	if action == "edit" {
+		// the external access is not meant to be kept
+		e.adapter.DeleteAfter(m.Chat(), accessTTL, msgIDs...)
+	}
+
+	return nil
+}
+
+// loginWithToken logs in the publisher with input text as token
+//
+// ok is false when login failed, err is not nil only when the request should
+// be canceled
+func (e *Engine[C, M]) loginWithToken(m M, wf *bot.Workflow) (pub publisher.Interface, ok bool, err error) {
+	pub, userConfig, err := wf.CreatePublisher()
+	if err != nil {
+		return nil, false, fmt.Errorf("create publisher: %w", err)
+	}
+
+	userConfig.SetToken(strings.TrimSpace(m.InputText()))
+	_, err = pub.Login(m.Conversation(), userConfig)
+	if err != nil {
+		m.Logger().D("publisher login failed", log.Error(err))
+		e.reply(m, bold(wf.PublisherName()), plain(" auth error: "), bold(err.Error()))
+
+		// usually not our fault, let user try again
+		return nil, false, nil
+	}
+
+	return pub, true, nil
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"arhat.dev/pkg/stringhelper"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// actions in start params
+const (
+	// actionCreate creates a new publisher user for the session
+	actionCreate = "create"
+	// actionEnter asks for token of the existing publisher user
+	actionEnter = "enter"
+)
+
+// startParams is the params of the start botcmd sent when user opened the
+// private chat link
+//
+// it's encoded as base64-url({action}:hex(userID):hex(chatID)), both ids are
+// the ones when the link was sent, to make sure the link is used by the same user
+type startParams struct {
+	action string
+	userID rt.UserID
+	chatID rt.ChatID
+}
+
+func (p *startParams) encode() string {
+	return base64.URLEncoding.EncodeToString(stringhelper.ToBytes[byte, byte](
+		p.action + ":" + encodeUint64Hex(p.userID) + ":" + encodeUint64Hex(p.chatID),
+	))
+}
+
+func decodeStartParams(s string) (ret startParams, err error) {
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return
+	}
+
+	parts := strings.SplitN(string(data), ":", 3)
+	if len(parts) != 3 {
+		err = fmt.Errorf("unexpected %d parts", len(parts))
+		return
+	}
+
+	ret.action = parts[0]
+
+	ret.userID, err = decodeUint64Hex[rt.UserID](parts[1])
+	if err != nil {
+		err = fmt.Errorf("bad user id: %w", err)
+		return
+	}
+
+	ret.chatID, err = decodeUint64Hex[rt.ChatID](parts[2])
+	if err != nil {
+		err = fmt.Errorf("bad chat id: %w", err)
+	}
+
+	return
+}
+
+func encodeUint64Hex[T rt.ChatID | rt.UserID](n T) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+	return hex.EncodeToString(buf[:])
+}
+
+func decodeUint64Hex[T rt.ChatID | rt.UserID](s string) (_ T, err error) {
+	var buf [8]byte
+	if hex.DecodedLen(len(s)) != len(buf) {
+		return 0, fmt.Errorf("invalid length %d", len(s))
+	}
+
+	_, err = hex.Decode(buf[:], stringhelper.ToBytes[byte, byte](s))
+	if err != nil {
+		return 0, err
+	}
+
+	return T(binary.BigEndian.Uint64(buf[:])), nil
+}
@@ -1,7 +1,212 @@
 package github
 
-// TODO
-
 import (
-	_ "github.com/google/go-github/v45/github"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"arhat.dev/pkg/log"
+	api "github.com/google/go-github/v45/github"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
 )
+
+// maxRequestBodySize limits the size of webhook payloads, github caps payloads
+// at 25MB
+const maxRequestBodySize = 25 << 20
+
+var _ bot.Interface = (*githubBot)(nil)
+
+type githubBot struct {
+	bot.BaseBot
+
+	client        *api.Client
+	webhookSecret []byte
+	webhookPath   string
+
+	// login of the bot account, resolved with the token
+	login string
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	// messages are handled one by one in the order received
+	msgCh chan *messageContext
+}
+
+// Configure checks the token and resolves login of the bot account
+func (c *githubBot) Configure() error {
+	user, _, err := c.client.Users.Get(c.Context(), "")
+	if err != nil {
+		return fmt.Errorf("check token: %w", err)
+	}
+
+	c.login = user.GetLogin()
+
+	c.Logger().D("logged in", log.String("login", c.login))
+	return nil
+}
+
+// Start registers the webhook handler to the mux
+func (c *githubBot) Start(baseURL string, mux rt.Mux) error {
+	mux.HandleFunc(c.webhookPath, c.handleWebhook)
+
+	c.Logger().D("serving github webhook", log.String("payload_url", baseURL+c.webhookPath))
+
+	go c.handleMessages()
+
+	return nil
+}
+
+func (c *githubBot) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = api.ValidateSignature(r.Header.Get(api.SHA256SignatureHeader), body, c.webhookSecret)
+	if err != nil {
+		c.Logger().I("invalid webhook signature", log.String("delivery", api.DeliveryID(r)), log.Error(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	payload := body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, err2 := url.ParseQuery(string(body))
+		if err2 != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		payload = []byte(form.Get("payload"))
+	}
+
+	evt, err := api.ParseWebHook(api.WebHookType(r), payload)
+	if err != nil {
+		// unsupported event types are not errors, they are not subscribed intentionally
+		c.Logger().V("ignored webhook", log.String("event", api.WebHookType(r)), log.Error(err))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// events are handled asynchronously, github expects response in 10s
+	w.WriteHeader(http.StatusAccepted)
+
+	switch e := evt.(type) {
+	case *api.IssueCommentEvent:
+		if e.GetAction() != "created" {
+			return
+		}
+
+		c.onComment(e.GetRepo(), e.GetIssue().GetNumber(), issueInfoOf(e.GetIssue()), commentOfIssueComment(e.GetComment()))
+	case *api.PullRequestReviewEvent:
+		if e.GetAction() != "submitted" || len(e.GetReview().GetBody()) == 0 {
+			return
+		}
+
+		pr := e.GetPullRequest()
+		c.onComment(e.GetRepo(), pr.GetNumber(), pullRequestInfoOf(pr), commentOfReview(e.GetReview()))
+	case *api.PullRequestReviewCommentEvent:
+		if e.GetAction() != "created" {
+			return
+		}
+
+		pr := e.GetPullRequest()
+		c.onComment(e.GetRepo(), pr.GetNumber(), pullRequestInfoOf(pr), commentOfReviewComment(e.GetComment()))
+	}
+}
+
+func (c *githubBot) onComment(repo *api.Repository, number int, issue issueInfo, cm comment) {
+	if cm.user.GetLogin() == c.login || cm.user.GetType() == "Bot" {
+		return
+	}
+
+	chat := chatIDWrapper{
+		owner:  repo.GetOwner().GetLogin(),
+		repo:   repo.GetName(),
+		number: number,
+	}
+
+	c.enqueue(c.newMessageContext(chat, issue, cm))
+}
+
+func (c *githubBot) newMessageContext(chat chatIDWrapper, issue issueInfo, cm comment) *messageContext {
+	return &messageContext{
+		con: conversationImpl{
+			bot:  c,
+			chat: chat,
+		},
+
+		chat:    chat,
+		issue:   issue,
+		comment: cm,
+
+		msgID: rt.MessageID(cm.id),
+
+		logger: c.Logger().WithFields(
+			rt.LogChatID(chat.ID()),
+			rt.LogSenderID(userIDOf(cm.user.GetLogin())),
+		),
+	}
+}
+
+func (c *githubBot) enqueue(mc *messageContext) {
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+}
+
+func (c *githubBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+		}
+	}
+}
+
+func (c *githubBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	// botcmd only takes the first line of the comment
+	if line, _, _ := strings.Cut(strings.TrimSpace(mc.body), "\n"); strings.HasPrefix(line, "/") {
+		cmd, params, _ := strings.Cut(strings.TrimSpace(line), " ")
+		handled, err := c.engine.HandleBotCmd(mc, cmd, strings.TrimSpace(params))
+		if handled {
+			return err
+		}
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+func (c *githubBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromComment(mc))
+
+	return nil
+}
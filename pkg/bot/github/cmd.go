@@ -0,0 +1,137 @@
+package github
+
+import (
+	"strconv"
+	"strings"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// handleBotCmd_Start replaces the default start botcmd, which is only meant
+// to be used in private chat
+func (c *githubBot) handleBotCmd_Start(mc *messageContext, wf *bot.Workflow, cmd, params string) error {
+	_, err := c.reply(mc,
+		plain("Welcome, need some help? comment "),
+		code(wf.BotCommands.TextOf(rt.BotCmd_Help)),
+		plain(" to show all commands."),
+	)
+	return err
+}
+
+// handleBotCmd_Unsupported handles botcmds asking for tokens in private chat
+func (c *githubBot) handleBotCmd_Unsupported(mc *messageContext, wf *bot.Workflow, cmd, params string) error {
+	_, err := c.reply(mc, code(cmd), plain(" is not supported on github, there is no private chat to send your token."))
+	return err
+}
+
+// handleBotCmd_Include includes the comment referenced by params, or the description
+// of the issue (pull request) when params is empty
+//
+// comments cannot be replied on github, so the comment is referenced by its url or id
+func (c *githubBot) handleBotCmd_Include(mc *messageContext, wf *bot.Workflow, cmd, params string) error {
+	_, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		c.reply(mc, plain("There is no active session, "), code(cmd), plain(" will do nothing in this case."))
+		return nil
+	}
+
+	var (
+		cm  comment
+		err error
+
+		ctx         = c.Context()
+		owner, repo = mc.chat.owner, mc.chat.repo
+	)
+
+	kind, id, ok := parseCommentRef(params)
+	switch {
+	case len(params) == 0:
+		issue, _, err2 := c.client.Issues.Get(ctx, owner, repo, mc.chat.number)
+		if err = err2; err == nil {
+			cm = commentOfIssue(issue)
+		}
+	case !ok:
+		c.reply(mc, plain("Invalid comment reference, please use the url or id of the comment."))
+		return nil
+	case kind == commentKindReview:
+		review, _, err2 := c.client.PullRequests.GetReview(ctx, owner, repo, mc.chat.number, id)
+		if err = err2; err == nil {
+			cm = commentOfReview(review)
+		}
+	case kind == commentKindReviewComment:
+		reviewComment, _, err2 := c.client.PullRequests.GetComment(ctx, owner, repo, id)
+		if err = err2; err == nil {
+			cm = commentOfReviewComment(reviewComment)
+		}
+	default:
+		issueComment, _, err2 := c.client.Issues.GetComment(ctx, owner, repo, id)
+		if err = err2; err == nil {
+			cm = commentOfIssueComment(issueComment)
+		}
+	}
+
+	if err != nil {
+		mc.logger.I("failed to get comment", log.String("ref", params), log.Error(err))
+		c.reply(mc, plain("That comment is not available."))
+		return nil
+	}
+
+	err = c.appendSessionMessage(c.newMessageContext(mc.chat, mc.issue, cm))
+	if err != nil {
+		c.reply(mc, plain("Failed to include that comment."))
+		return err
+	}
+
+	c.reply(mc, plain("Included."))
+	return nil
+}
+
+func (c *githubBot) handleBotCmd_Ignore(mc *messageContext, wf *bot.Workflow, cmd, params string) error {
+	currentSession, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		c.reply(mc, plain("There is no active session, "), code(cmd), plain(" will do nothing in this case."))
+		return nil
+	}
+
+	_, id, ok := parseCommentRef(params)
+	if !ok {
+		c.reply(mc, plain("Please specify the url or id of the comment, e.g. "), code(cmd+" 1234"))
+		return nil
+	}
+
+	_ = currentSession.DeleteMessage(rt.MessageID(id))
+
+	c.reply(mc, plain("Ignored."))
+	return nil
+}
+
+type commentKind uint8
+
+const (
+	commentKindIssueComment commentKind = iota
+	commentKindReview
+	commentKindReviewComment
+)
+
+// parseCommentRef parses comment url or id, the url is the one copied with
+// `Copy link` in the comment menu (e.g. https://github.com/o/r/pull/1#discussion_r1234)
+func parseCommentRef(ref string) (kind commentKind, id int64, ok bool) {
+	if _, anchor, found := strings.Cut(ref, "#"); found {
+		for prefix, k := range map[string]commentKind{
+			"issuecomment-":      commentKindIssueComment,
+			"pullrequestreview-": commentKindReview,
+			"discussion_r":       commentKindReviewComment,
+		} {
+			if strings.HasPrefix(anchor, prefix) {
+				kind, ref = k, strings.TrimPrefix(anchor, prefix)
+				break
+			}
+		}
+	}
+
+	id, err := strconv.ParseInt(ref, 10, 64)
+	return kind, id, err == nil && id > 0
+}
@@ -0,0 +1,110 @@
+package github
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"arhat.dev/rs"
+	api "github.com/google/go-github/v45/github"
+	"golang.org/x/oauth2"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "github"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// Config for github bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// Token is the access token of the github account used by the bot
+	Token string `yaml:"token"`
+
+	// WebhookSecret is the secret of the repository (or organization) webhook,
+	// used to verify X-Hub-Signature-256 of webhook requests
+	WebhookSecret string `yaml:"webhookSecret"`
+
+	// APIURL is the base url of github rest api
+	//
+	// defaults to https://api.github.com/, set it to https://github.example.com/api/v3/
+	// for github enterprise server
+	APIURL string `yaml:"apiURL"`
+
+	// WebhookPath is the http path of the webhook payload url
+	//
+	// defaults to /github/webhook
+	WebhookPath string `yaml:"webhookPath"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	if len(c.Token) == 0 {
+		return nil, fmt.Errorf("token is required")
+	}
+
+	if len(c.WebhookSecret) == 0 {
+		return nil, fmt.Errorf("webhookSecret is required")
+	}
+
+	client := api.NewClient(oauth2.NewClient(rtCtx.Context(), oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: c.Token},
+	)))
+
+	if len(c.APIURL) != 0 {
+		apiURL := c.APIURL
+		if !strings.HasSuffix(apiURL, "/") {
+			apiURL += "/"
+		}
+
+		baseURL, err := url.Parse(apiURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid apiURL: %w", err)
+		}
+
+		client.BaseURL = baseURL
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	webhookPath := c.WebhookPath
+	if len(webhookPath) == 0 {
+		webhookPath = "/github/webhook"
+	}
+
+	gb := &githubBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		client:        client,
+		webhookSecret: []byte(c.WebhookSecret),
+		webhookPath:   webhookPath,
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		msgCh: make(chan *messageContext, 64),
+	}
+
+	gb.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: gb}, gb.sessions, &gb.wfSet, engine.Options{
+		AdminOnly: "Only repository collaborators can use this bot.",
+	})
+	gb.engine.Handle(rt.BotCmd_Start, gb.handleBotCmd_Start)
+	gb.engine.Handle(rt.BotCmd_Include, gb.handleBotCmd_Include)
+	gb.engine.Handle(rt.BotCmd_Ignore, gb.handleBotCmd_Ignore)
+	for _, bc := range []rt.BotCmd{rt.BotCmd_Edit, rt.BotCmd_List, rt.BotCmd_Delete} {
+		gb.engine.Handle(bc, gb.handleBotCmd_Unsupported)
+	}
+
+	return gb, nil
+}
@@ -0,0 +1,67 @@
+package github
+
+import (
+	"context"
+	"strings"
+
+	api "github.com/google/go-github/v45/github"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// maxCommentLength is the max characters of comment body, github limits
+// it to 65536 characters
+const maxCommentLength = 65000
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *githubBot
+
+	chat chatIDWrapper
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// message body is sent as comments in markdown, url callbacks are appended
+// as links
+//
+// NOTE: comments have no reply or button, opts.ReplyTo and OnClick callbacks
+// are ignored
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) (_ []rt.MessageID, err error) {
+	text := markdown.Format(opts.Body)
+
+	var links []string
+	for _, row := range opts.Callbacks {
+		for _, cb := range row {
+			if !cb.URL.IsNil() {
+				links = append(links, "["+markdown.Escape(cb.Text)+"]("+cb.URL.Get()+")")
+			}
+		}
+	}
+
+	if len(links) != 0 {
+		text += "\n\n" + strings.Join(links, " | ")
+	}
+
+	var ret []rt.MessageID
+	for _, part := range bot.SplitText(text, maxCommentLength) {
+		cm, _, err := c.bot.client.Issues.CreateComment(ctx, c.chat.owner, c.chat.repo, c.chat.number, &api.IssueComment{
+			Body: api.String(part),
+		})
+		if err != nil {
+			return ret, err
+		}
+
+		ret = append(ret, rt.MessageID(cm.GetID()))
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,262 @@
+package github
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestParseCommentRef(t *testing.T) {
+	for _, test := range []struct {
+		ref  string
+		kind commentKind
+		id   int64
+		ok   bool
+	}{
+		{ref: "1234", kind: commentKindIssueComment, id: 1234, ok: true},
+		{ref: "https://github.com/o/r/issues/1#issuecomment-55", kind: commentKindIssueComment, id: 55, ok: true},
+		{ref: "https://github.com/o/r/pull/1#pullrequestreview-77", kind: commentKindReview, id: 77, ok: true},
+		{ref: "https://github.com/o/r/pull/1#discussion_r66", kind: commentKindReviewComment, id: 66, ok: true},
+		{ref: "https://github.com/o/r/pull/1#unknown-1"},
+		{ref: "foo"},
+		{ref: ""},
+	} {
+		t.Run(test.ref, func(t *testing.T) {
+			kind, id, ok := parseCommentRef(test.ref)
+			assert.Equal(t, test.ok, ok)
+			if ok {
+				assert.Equal(t, test.kind, kind)
+				assert.Equal(t, test.id, id)
+			}
+		})
+	}
+}
+
+const (
+	testToken  = "gh-token"
+	testSecret = "secret"
+)
+
+// fakeAPI is a github rest api stand-in
+type fakeAPI struct {
+	*httptest.Server
+
+	seq int64
+
+	// bodies of comments created by the bot
+	posted chan string
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	s := &fakeAPI{
+		posted: make(chan string, 16),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *fakeAPI) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	alice := map[string]any{"login": "alice", "html_url": "https://github.com/alice"}
+
+	switch r.Method + " " + r.URL.Path {
+	case "GET /user":
+		s.reply(w, map[string]any{"login": "mbot"})
+	case "POST /repos/o/r/issues/1/comments":
+		var cm struct {
+			Body string `json:"body"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&cm)
+		s.posted <- cm.Body
+
+		s.reply(w, map[string]any{"id": 1000 + atomic.AddInt64(&s.seq, 1), "body": cm.Body})
+	case "GET /repos/o/r/issues/1":
+		s.reply(w, map[string]any{"id": 1, "number": 1, "title": "Design", "body": "the proposal", "user": alice})
+	case "GET /repos/o/r/issues/comments/55":
+		s.reply(w, map[string]any{"id": 55, "body": "early comment", "user": alice})
+	case "GET /repos/o/r/pulls/comments/66":
+		s.reply(w, map[string]any{"id": 66, "body": "nit", "path": "main.go", "user": alice})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeAPI) reply(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (s *fakeAPI) expectPosted(t *testing.T, expected string) {
+	select {
+	case body := <-s.posted:
+		assert.Equal(t, expected, body)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timeout waiting for comment", expected)
+	}
+}
+
+func webhookRequest(event string, payload any, secret string) *http.Request {
+	body, _ := json.Marshal(payload)
+
+	h := hmac.New(sha256.New, []byte(secret))
+	_, _ = h.Write(body)
+
+	req := httptest.NewRequest(http.MethodPost, "/github/webhook", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(h.Sum(nil)))
+
+	return req
+}
+
+var testRepo = map[string]any{"name": "r", "owner": map[string]any{"login": "o"}}
+
+func issueComment(id int64, user, association, body string) map[string]any {
+	return map[string]any{
+		"action": "created",
+		"issue": map[string]any{
+			"number":   1,
+			"title":    "Design",
+			"html_url": "https://github.com/o/r/pull/1",
+		},
+		"comment": map[string]any{
+			"id":                 id,
+			"body":               body,
+			"user":               map[string]any{"login": user, "type": "User"},
+			"author_association": association,
+			"created_at":         time.Now().UTC().Format(time.RFC3339),
+		},
+		"repository": testRepo,
+	}
+}
+
+func TestBot(t *testing.T) {
+	srv := newFakeAPI(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, false),
+
+		Token:         testToken,
+		WebhookSecret: testSecret,
+		APIURL:        srv.URL,
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	require.NoError(t, b.Configure())
+	require.NoError(t, b.Start("", mux))
+
+	send := func(t *testing.T, event string, payload any) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, webhookRequest(event, payload, testSecret))
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+	}
+
+	t.Run("Signature", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, webhookRequest("ping", map[string]any{"zen": "hi"}, "invalid"))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		send(t, "ping", map[string]any{"zen": "hi"})
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		send(t, "issue_comment", issueComment(1, "bob", "CONTRIBUTOR", "/new topic"))
+		srv.expectPosted(t, "Only repository collaborators can use this bot.")
+
+		send(t, "issue_comment", issueComment(2, "alice", "OWNER", "/new topic\n\nlet's start"))
+		srv.expectPosted(t, "created topic")
+
+		send(t, "issue_comment", issueComment(3, "bob", "CONTRIBUTOR", "**LGTM** @alice"))
+
+		edited := issueComment(3, "bob", "CONTRIBUTOR", "edited")
+		edited["action"] = "edited"
+		send(t, "issue_comment", edited)
+
+		botComment := issueComment(4, "ci-bot", "NONE", "build passed")
+		botComment["comment"].(map[string]any)["user"] = map[string]any{"login": "ci-bot", "type": "Bot"}
+		send(t, "issue_comment", botComment)
+
+		send(t, "pull_request_review", map[string]any{
+			"action":       "submitted",
+			"pull_request": map[string]any{"number": 1, "title": "Design"},
+			"review": map[string]any{
+				"id":                 77,
+				"body":               "approved",
+				"user":               map[string]any{"login": "carol"},
+				"author_association": "MEMBER",
+			},
+			"repository": testRepo,
+		})
+
+		send(t, "pull_request_review_comment", map[string]any{
+			"action":       "created",
+			"pull_request": map[string]any{"number": 1, "title": "Design"},
+			"comment": map[string]any{
+				"id":   88,
+				"body": "typo",
+				"path": "README.md",
+				"user": map[string]any{"login": "carol"},
+			},
+			"repository": testRepo,
+		})
+
+		send(t, "issue_comment", issueComment(5, "alice", "OWNER", "/include"))
+		srv.expectPosted(t, "Included.")
+
+		send(t, "issue_comment", issueComment(6, "alice", "OWNER", "/include https://github.com/o/r/issues/1#issuecomment-55"))
+		srv.expectPosted(t, "Included.")
+
+		send(t, "issue_comment", issueComment(7, "alice", "OWNER", "/include https://github.com/o/r/pull/1#discussion_r66"))
+		srv.expectPosted(t, "Included.")
+
+		send(t, "issue_comment", issueComment(8, "alice", "OWNER", "/include 99"))
+		srv.expectPosted(t, "That comment is not available.")
+
+		send(t, "issue_comment", issueComment(9, "alice", "OWNER", "/ignore https://github.com/o/r/issues/1#issuecomment-55"))
+		srv.expectPosted(t, "Ignored.")
+
+		send(t, "issue_comment", issueComment(10, "alice", "OWNER", "/end"))
+		srv.expectPosted(t, "published")
+
+		assert.EqualValues(t, []string{
+			"topic" +
+				"bob: LGTM @alice\n" +
+				"carol: approved\n" +
+				"carol: README.md: typo\n" +
+				"alice: the proposal\n" +
+				"alice: main.go: nit\n",
+		}, pub.Posts())
+	})
+}
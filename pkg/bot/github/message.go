@@ -0,0 +1,42 @@
+package github
+
+import (
+	"strings"
+
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func (c *githubBot) newMessageFromComment(mc *messageContext) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.createdAt.UTC()
+	ret.Spans = markdown.Parse(mc.body, markdown.Options{Mentions: true})
+
+	if len(mc.path) != 0 {
+		// review comment on a file
+		ret.Spans = append([]rt.Span{
+			{Flags: rt.SpanFlag_Code, Text: mc.path},
+			{Text: ": "},
+		}, ret.Spans...)
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	ret.MessageLink = mc.htmlURL
+	ret.ChatName = mc.chat.String()
+	if len(mc.issue.title) != 0 {
+		ret.ChatName += " " + mc.issue.title
+	}
+	ret.ChatLink = mc.issue.htmlURL
+
+	ret.Author = mc.user.GetLogin()
+	ret.AuthorLink = mc.user.GetHTMLURL()
+
+	return
+}
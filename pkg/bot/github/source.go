@@ -0,0 +1,137 @@
+package github
+
+import (
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+	api "github.com/google/go-github/v45/github"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashString generates a stable uint64 id for github logins and issue paths
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](s))
+	return h.Sum64()
+}
+
+func userIDOf(login string) rt.UserID { return rt.UserID(hashString(login)) }
+
+// chatIDWrapper is the chat data stored in session requests, every issue or
+// pull request is a chat
+type chatIDWrapper struct {
+	owner  string
+	repo   string
+	number int
+}
+
+func (c chatIDWrapper) ID() rt.ChatID { return rt.ChatID(hashString(c.String())) }
+
+// String returns the issue reference (e.g. arhat-dev/mbot#1)
+func (c chatIDWrapper) String() string {
+	return c.owner + "/" + c.repo + "#" + strconv.Itoa(c.number)
+}
+
+// issueInfo is the issue or pull request a comment belongs to
+type issueInfo struct {
+	title   string
+	htmlURL string
+}
+
+func issueInfoOf(issue *api.Issue) issueInfo {
+	return issueInfo{title: issue.GetTitle(), htmlURL: issue.GetHTMLURL()}
+}
+
+func pullRequestInfoOf(pr *api.PullRequest) issueInfo {
+	return issueInfo{title: pr.GetTitle(), htmlURL: pr.GetHTMLURL()}
+}
+
+// comment is the common part of issue comments, pull request reviews and
+// review comments
+type comment struct {
+	id   int64
+	user *api.User
+
+	// body in github flavored markdown
+	body string
+	// path is the file commented, only set for review comments
+	path string
+
+	htmlURL     string
+	association string
+	createdAt   time.Time
+}
+
+func commentOfIssueComment(cm *api.IssueComment) comment {
+	return comment{
+		id:          cm.GetID(),
+		user:        cm.GetUser(),
+		body:        cm.GetBody(),
+		htmlURL:     cm.GetHTMLURL(),
+		association: cm.GetAuthorAssociation(),
+		createdAt:   cm.GetCreatedAt(),
+	}
+}
+
+func commentOfReviewComment(cm *api.PullRequestComment) comment {
+	return comment{
+		id:          cm.GetID(),
+		user:        cm.GetUser(),
+		body:        cm.GetBody(),
+		path:        cm.GetPath(),
+		htmlURL:     cm.GetHTMLURL(),
+		association: cm.GetAuthorAssociation(),
+		createdAt:   cm.GetCreatedAt(),
+	}
+}
+
+func commentOfReview(review *api.PullRequestReview) comment {
+	return comment{
+		id:          review.GetID(),
+		user:        review.GetUser(),
+		body:        review.GetBody(),
+		htmlURL:     review.GetHTMLURL(),
+		association: review.GetAuthorAssociation(),
+		createdAt:   review.GetSubmittedAt(),
+	}
+}
+
+// commentOfIssue converts description of the issue (or pull request) to comment
+func commentOfIssue(issue *api.Issue) comment {
+	return comment{
+		id:          issue.GetID(),
+		user:        issue.GetUser(),
+		body:        issue.GetBody(),
+		htmlURL:     issue.GetHTMLURL(),
+		association: issue.GetAuthorAssociation(),
+		createdAt:   issue.GetCreatedAt(),
+	}
+}
+
+type messageContext struct {
+	con conversationImpl
+
+	chat  chatIDWrapper
+	issue issueInfo
+
+	comment
+
+	msgID rt.MessageID
+
+	logger log.Interface
+}
+
+// isCollaborator checks whether the author of the comment has write access
+// to the repository
+func (mc *messageContext) isCollaborator() bool {
+	switch mc.association {
+	case "OWNER", "MEMBER", "COLLABORATOR":
+		return true
+	default:
+		return false
+	}
+}
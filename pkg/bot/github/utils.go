@@ -0,0 +1,25 @@
+package github
+
+import (
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func plain(text string) rt.Span { return rt.Span{Flags: rt.SpanFlag_PlainText, Text: text} }
+func code(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Code, Text: text} }
+
+// reply comments on the issue (pull request) where mc comes from
+func (c *githubBot) reply(mc *messageContext, body ...rt.Span) (msgID rt.MessageID, err error) {
+	msgIDs, err := mc.con.SendMessage(c.Context(), rt.SendMessageOptions{Body: body})
+	if err != nil {
+		mc.logger.E("failed to send comment", log.Error(err))
+		return
+	}
+
+	if len(msgIDs) != 0 {
+		msgID = msgIDs[0]
+	}
+
+	return
+}
@@ -1,7 +1,279 @@
 package gitlab
 
-// TODO
-
 import (
-	_ "github.com/xanzy/go-gitlab"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"arhat.dev/pkg/log"
+	api "github.com/xanzy/go-gitlab"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
 )
+
+const (
+	// maxRequestBodySize limits the size of webhook payloads
+	maxRequestBodySize = 25 << 20
+
+	// webhookTokenHeader is the header carrying secret token of the webhook
+	webhookTokenHeader = "X-Gitlab-Token"
+)
+
+var _ bot.Interface = (*gitlabBot)(nil)
+
+type gitlabBot struct {
+	bot.BaseBot
+
+	client       *api.Client
+	webhookToken []byte
+	webhookPath  string
+
+	// id of the bot account, resolved with the token
+	userID int
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	// messages are handled one by one in the order received
+	msgCh chan *messageContext
+}
+
+// Configure checks the token and resolves the bot account
+func (c *gitlabBot) Configure() error {
+	u, _, err := c.client.Users.CurrentUser(api.WithContext(c.Context()))
+	if err != nil {
+		return fmt.Errorf("check token: %w", err)
+	}
+
+	c.userID = u.ID
+
+	c.Logger().D("logged in", log.String("username", u.Username))
+	return nil
+}
+
+// Start registers the webhook handler to the mux
+func (c *gitlabBot) Start(baseURL string, mux rt.Mux) error {
+	mux.HandleFunc(c.webhookPath, c.handleWebhook)
+
+	c.Logger().D("serving gitlab webhook", log.String("url", baseURL+c.webhookPath))
+
+	go c.handleMessages()
+
+	return nil
+}
+
+func (c *gitlabBot) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookTokenHeader)), c.webhookToken) != 1 {
+		c.Logger().I("invalid webhook token", log.String("event", string(api.HookEventType(r))))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	evt, err := api.ParseWebhook(api.HookEventType(r), body)
+	if err != nil {
+		// unsupported event types and notes on commits or snippets
+		c.Logger().V("ignored webhook", log.String("event", string(api.HookEventType(r))), log.Error(err))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// events are handled asynchronously, gitlab expects response in 10s
+	w.WriteHeader(http.StatusAccepted)
+
+	switch e := evt.(type) {
+	case *api.IssueCommentEvent:
+		attrs := &e.ObjectAttributes
+		if attrs.System || attrs.UpdatedAt != attrs.CreatedAt {
+			// note hooks are also triggered on edit
+			return
+		}
+
+		chat := chatIDWrapper{
+			projectID: e.ProjectID,
+			project:   e.Project.PathWithNamespace,
+			kind:      noteableIssue,
+			iid:       e.Issue.IID,
+		}
+
+		author := user{}
+		if e.User != nil {
+			author = user{id: e.User.ID, username: e.User.Username, name: e.User.Name, webURL: e.User.WebURL}
+		}
+
+		c.onNote(chat, issueInfoOf(chat, e.Issue.Title, e.Project.WebURL), note{
+			id:        attrs.ID,
+			author:    author,
+			body:      attrs.Note,
+			webURL:    attrs.URL,
+			createdAt: parseWebhookTime(attrs.CreatedAt),
+		})
+	case *api.MergeCommentEvent:
+		attrs := &e.ObjectAttributes
+		if attrs.System || attrs.UpdatedAt != attrs.CreatedAt {
+			return
+		}
+
+		chat := chatIDWrapper{
+			projectID: e.ProjectID,
+			project:   e.Project.PathWithNamespace,
+			kind:      noteableMergeRequest,
+			iid:       e.MergeRequest.IID,
+		}
+
+		c.onNote(chat, issueInfoOf(chat, e.MergeRequest.Title, e.Project.WebURL), note{
+			id:        attrs.ID,
+			author:    userOfEventUser(e.User, e.Project.WebURL, e.Project.PathWithNamespace),
+			body:      attrs.Note,
+			webURL:    attrs.URL,
+			createdAt: parseWebhookTime(attrs.CreatedAt),
+		})
+	case *api.IssueEvent:
+		// description of newly opened issue is handled as the first note
+		attrs := &e.ObjectAttributes
+		if attrs.Action != "open" || len(attrs.Description) == 0 {
+			return
+		}
+
+		chat := chatIDWrapper{
+			projectID: e.Project.ID,
+			project:   e.Project.PathWithNamespace,
+			kind:      noteableIssue,
+			iid:       attrs.IID,
+		}
+
+		c.onNote(chat, issueInfoOf(chat, attrs.Title, e.Project.WebURL), note{
+			id:        attrs.ID,
+			author:    userOfEventUser(e.User, e.Project.WebURL, e.Project.PathWithNamespace),
+			body:      attrs.Description,
+			webURL:    attrs.URL,
+			createdAt: parseWebhookTime(attrs.CreatedAt),
+		})
+	case *api.MergeEvent:
+		attrs := &e.ObjectAttributes
+		if attrs.Action != "open" || len(attrs.Description) == 0 {
+			return
+		}
+
+		chat := chatIDWrapper{
+			projectID: e.Project.ID,
+			project:   e.Project.PathWithNamespace,
+			kind:      noteableMergeRequest,
+			iid:       attrs.IID,
+		}
+
+		c.onNote(chat, issueInfoOf(chat, attrs.Title, e.Project.WebURL), note{
+			id:        attrs.ID,
+			author:    userOfEventUser(e.User, e.Project.WebURL, e.Project.PathWithNamespace),
+			body:      attrs.Description,
+			webURL:    attrs.URL,
+			createdAt: parseWebhookTime(attrs.CreatedAt),
+		})
+	}
+}
+
+func (c *gitlabBot) onNote(chat chatIDWrapper, issue issueInfo, n note) {
+	if n.author.id == c.userID {
+		return
+	}
+
+	c.enqueue(c.newMessageContext(chat, issue, n))
+}
+
+func (c *gitlabBot) newMessageContext(chat chatIDWrapper, issue issueInfo, n note) *messageContext {
+	return &messageContext{
+		con: conversationImpl{
+			bot:  c,
+			chat: chat,
+		},
+
+		chat:  chat,
+		issue: issue,
+		note:  n,
+
+		msgID: rt.MessageID(n.id),
+
+		logger: c.Logger().WithFields(
+			rt.LogChatID(chat.ID()),
+			rt.LogSenderID(rt.UserID(n.author.id)),
+		),
+	}
+}
+
+// isDeveloper checks whether the author of the note has at least developer
+// access to the project
+func (c *gitlabBot) isDeveloper(mc *messageContext) bool {
+	member, _, err := c.client.ProjectMembers.GetInheritedProjectMember(
+		mc.chat.projectID, mc.author.id, api.WithContext(c.Context()),
+	)
+	if err != nil {
+		mc.logger.I("failed to get project member", log.Error(err))
+		return false
+	}
+
+	return member.AccessLevel >= api.DeveloperPermissions
+}
+
+func (c *gitlabBot) enqueue(mc *messageContext) {
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+}
+
+func (c *gitlabBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+		}
+	}
+}
+
+func (c *gitlabBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	// botcmd only takes the first line of the note
+	if line, _, _ := strings.Cut(strings.TrimSpace(mc.body), "\n"); strings.HasPrefix(line, "/") {
+		cmd, params, _ := strings.Cut(strings.TrimSpace(line), " ")
+		handled, err := c.engine.HandleBotCmd(mc, cmd, strings.TrimSpace(params))
+		if handled {
+			return err
+		}
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+func (c *gitlabBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromNote(mc, s.Workflow()))
+
+	return nil
+}
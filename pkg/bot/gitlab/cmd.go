@@ -0,0 +1,127 @@
+package gitlab
+
+import (
+	"strconv"
+	"strings"
+
+	"arhat.dev/pkg/log"
+	api "github.com/xanzy/go-gitlab"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// handleBotCmd_Start replaces the default start botcmd, which is only meant
+// to be used in private chat
+func (c *gitlabBot) handleBotCmd_Start(mc *messageContext, wf *bot.Workflow, cmd, params string) error {
+	_, err := c.reply(mc,
+		plain("Welcome, need some help? comment "),
+		code(wf.BotCommands.TextOf(rt.BotCmd_Help)),
+		plain(" to show all commands."),
+	)
+	return err
+}
+
+// handleBotCmd_Unsupported handles botcmds asking for tokens in private chat
+func (c *gitlabBot) handleBotCmd_Unsupported(mc *messageContext, wf *bot.Workflow, cmd, params string) error {
+	_, err := c.reply(mc, code(cmd), plain(" is not supported on gitlab, there is no private chat to send your token."))
+	return err
+}
+
+// handleBotCmd_Include includes the note referenced by params, or the description
+// of the issue (merge request) when params is empty
+//
+// notes cannot be replied on gitlab, so the note is referenced by its url or id
+func (c *gitlabBot) handleBotCmd_Include(mc *messageContext, wf *bot.Workflow, cmd, params string) error {
+	_, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		c.reply(mc, plain("There is no active session, "), code(cmd), plain(" will do nothing in this case."))
+		return nil
+	}
+
+	var (
+		n   note
+		err error
+
+		opts = api.WithContext(c.Context())
+		pid  = mc.chat.projectID
+		iid  = mc.chat.iid
+		isMR = mc.chat.kind == noteableMergeRequest
+	)
+
+	id, ok := parseNoteRef(params)
+	switch {
+	case len(params) == 0 && isMR:
+		mr, _, err2 := c.client.MergeRequests.GetMergeRequest(pid, iid, nil, opts)
+		if err = err2; err == nil {
+			n = noteOfMergeRequest(mr)
+		}
+	case len(params) == 0:
+		issue, _, err2 := c.client.Issues.GetIssue(pid, iid, opts)
+		if err = err2; err == nil {
+			n = noteOfIssue(issue)
+		}
+	case !ok:
+		c.reply(mc, plain("Invalid note reference, please use the url or id of the comment."))
+		return nil
+	case isMR:
+		apiNote, _, err2 := c.client.Notes.GetMergeRequestNote(pid, iid, id, opts)
+		if err = err2; err == nil {
+			n = noteOfAPINote(apiNote, mc.issue)
+		}
+	default:
+		apiNote, _, err2 := c.client.Notes.GetIssueNote(pid, iid, id, opts)
+		if err = err2; err == nil {
+			n = noteOfAPINote(apiNote, mc.issue)
+		}
+	}
+
+	if err != nil {
+		mc.logger.I("failed to get note", log.String("ref", params), log.Error(err))
+		c.reply(mc, plain("That comment is not available."))
+		return nil
+	}
+
+	err = c.appendSessionMessage(c.newMessageContext(mc.chat, mc.issue, n))
+	if err != nil {
+		c.reply(mc, plain("Failed to include that comment."))
+		return err
+	}
+
+	c.reply(mc, plain("Included."))
+	return nil
+}
+
+func (c *gitlabBot) handleBotCmd_Ignore(mc *messageContext, wf *bot.Workflow, cmd, params string) error {
+	currentSession, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		c.reply(mc, plain("There is no active session, "), code(cmd), plain(" will do nothing in this case."))
+		return nil
+	}
+
+	id, ok := parseNoteRef(params)
+	if !ok {
+		c.reply(mc, plain("Please specify the url or id of the comment, e.g. "), code(cmd+" 1234"))
+		return nil
+	}
+
+	_ = currentSession.DeleteMessage(rt.MessageID(id))
+
+	c.reply(mc, plain("Ignored."))
+	return nil
+}
+
+// parseNoteRef parses note url or id, the url is the one copied with
+// `Copy link` in the comment menu (e.g. https://gitlab.com/g/p/-/issues/1#note_1234)
+func parseNoteRef(ref string) (id int, ok bool) {
+	if _, anchor, found := strings.Cut(ref, "#"); found {
+		if !strings.HasPrefix(anchor, "note_") {
+			return 0, false
+		}
+
+		ref = strings.TrimPrefix(anchor, "note_")
+	}
+
+	id, err := strconv.Atoi(ref)
+	return id, err == nil && id > 0
+}
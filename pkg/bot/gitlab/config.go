@@ -0,0 +1,99 @@
+package gitlab
+
+import (
+	"fmt"
+
+	"arhat.dev/rs"
+	api "github.com/xanzy/go-gitlab"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "gitlab"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// Config for gitlab bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// Token is the personal (or project) access token used by the bot
+	Token string `yaml:"token"`
+
+	// WebhookToken is the secret token of the webhook, compared with
+	// X-Gitlab-Token of webhook requests
+	WebhookToken string `yaml:"webhookToken"`
+
+	// APIURL is the base url of gitlab rest api
+	//
+	// defaults to https://gitlab.com/api/v4/, set it to https://gitlab.example.com/api/v4/
+	// for self-hosted gitlab
+	APIURL string `yaml:"apiURL"`
+
+	// WebhookPath is the http path of the webhook url
+	//
+	// defaults to /gitlab/webhook
+	WebhookPath string `yaml:"webhookPath"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	if len(c.Token) == 0 {
+		return nil, fmt.Errorf("token is required")
+	}
+
+	if len(c.WebhookToken) == 0 {
+		return nil, fmt.Errorf("webhookToken is required")
+	}
+
+	var opts []api.ClientOptionFunc
+	if len(c.APIURL) != 0 {
+		opts = append(opts, api.WithBaseURL(c.APIURL))
+	}
+
+	client, err := api.NewClient(c.Token, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apiURL: %w", err)
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	webhookPath := c.WebhookPath
+	if len(webhookPath) == 0 {
+		webhookPath = "/gitlab/webhook"
+	}
+
+	gb := &gitlabBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		client:       client,
+		webhookToken: []byte(c.WebhookToken),
+		webhookPath:  webhookPath,
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		msgCh: make(chan *messageContext, 64),
+	}
+
+	gb.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: gb}, gb.sessions, &gb.wfSet, engine.Options{
+		AdminOnly: "Only project members with developer access can use this bot.",
+	})
+	gb.engine.Handle(rt.BotCmd_Start, gb.handleBotCmd_Start)
+	gb.engine.Handle(rt.BotCmd_Include, gb.handleBotCmd_Include)
+	gb.engine.Handle(rt.BotCmd_Ignore, gb.handleBotCmd_Ignore)
+	for _, bc := range []rt.BotCmd{rt.BotCmd_Edit, rt.BotCmd_List, rt.BotCmd_Delete} {
+		gb.engine.Handle(bc, gb.handleBotCmd_Unsupported)
+	}
+
+	return gb, nil
+}
@@ -0,0 +1,78 @@
+package gitlab
+
+import (
+	"context"
+	"strings"
+
+	api "github.com/xanzy/go-gitlab"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// maxNoteLength is the max characters of note body, gitlab limits it to
+// 1000000 characters
+const maxNoteLength = 1000000
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *gitlabBot
+
+	chat chatIDWrapper
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// message body is sent as notes in markdown, url callbacks are appended
+// as links
+//
+// NOTE: notes have no reply or button, opts.ReplyTo and OnClick callbacks
+// are ignored
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) (_ []rt.MessageID, err error) {
+	text := markdown.Format(opts.Body)
+
+	var links []string
+	for _, row := range opts.Callbacks {
+		for _, cb := range row {
+			if !cb.URL.IsNil() {
+				links = append(links, "["+markdown.Escape(cb.Text)+"]("+cb.URL.Get()+")")
+			}
+		}
+	}
+
+	if len(links) != 0 {
+		text += "\n\n" + strings.Join(links, " | ")
+	}
+
+	var ret []rt.MessageID
+	for _, part := range bot.SplitText(text, maxNoteLength) {
+		var (
+			n    *api.Note
+			opts = api.WithContext(ctx)
+		)
+
+		if c.chat.kind == noteableMergeRequest {
+			n, _, err = c.bot.client.Notes.CreateMergeRequestNote(c.chat.projectID, c.chat.iid, &api.CreateMergeRequestNoteOptions{
+				Body: api.String(part),
+			}, opts)
+		} else {
+			n, _, err = c.bot.client.Notes.CreateIssueNote(c.chat.projectID, c.chat.iid, &api.CreateIssueNoteOptions{
+				Body: api.String(part),
+			}, opts)
+		}
+		if err != nil {
+			return ret, err
+		}
+
+		ret = append(ret, rt.MessageID(n.ID))
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,59 @@
+package gitlab
+
+import (
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+var (
+	_ engine.Message[chatIDWrapper]                  = (*messageContext)(nil)
+	_ engine.Adapter[chatIDWrapper, *messageContext] = (*adapter)(nil)
+)
+
+func (mc *messageContext) Chat() chatIDWrapper           { return mc.chat }
+func (mc *messageContext) ChatName() string              { return mc.chat.String() }
+func (mc *messageContext) IsPrivate() bool               { return false }
+func (mc *messageContext) SenderID() rt.UserID           { return rt.UserID(mc.author.id) }
+func (mc *messageContext) MessageID() rt.MessageID       { return mc.msgID }
+func (mc *messageContext) ReplyTo() rt.MessageID         { return 0 }
+func (mc *messageContext) InputText() string             { return mc.body }
+func (mc *messageContext) Conversation() rt.Conversation { return &mc.con }
+func (mc *messageContext) Logger() log.Interface         { return mc.logger }
+
+// adapter implements engine.Adapter for gitlab, there is no private chat on
+// gitlab, so publishers requiring login and botcmds asking for tokens are not
+// supported
+type adapter struct {
+	c *gitlabBot
+}
+
+func (a adapter) Reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	return a.c.reply(mc, body...)
+}
+
+func (a adapter) Conversation(chat chatIDWrapper) rt.Conversation {
+	return &conversationImpl{bot: a.c, chat: chat}
+}
+
+// DeleteAfter does nothing, notices are kept as normal notes
+func (a adapter) DeleteAfter(chat chatIDWrapper, delay time.Duration, msgIDs ...rt.MessageID) {}
+
+func (a adapter) PrivateChatOf(mc *messageContext) (chatIDWrapper, bool, error) {
+	return chatIDWrapper{}, false, nil
+}
+
+func (a adapter) PrivateChatLink(startParams string) (string, bool) { return "", false }
+
+func (a adapter) IsAdmin(mc *messageContext) (bool, error) { return a.c.isDeveloper(mc), nil }
+
+// RepliedMessage always returns false, notes cannot be replied on gitlab,
+// see handleBotCmd_Include
+func (a adapter) RepliedMessage(mc *messageContext) (*messageContext, bool) { return nil, false }
+
+func (a adapter) AppendSessionMessage(mc *messageContext) error {
+	return a.c.appendSessionMessage(mc)
+}
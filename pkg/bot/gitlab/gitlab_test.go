@@ -0,0 +1,279 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestParseNoteRef(t *testing.T) {
+	for _, test := range []struct {
+		ref string
+		id  int
+		ok  bool
+	}{
+		{ref: "1234", id: 1234, ok: true},
+		{ref: "https://gitlab.com/g/p/-/issues/1#note_55", id: 55, ok: true},
+		{ref: "https://gitlab.com/g/p/-/merge_requests/1#note_66", id: 66, ok: true},
+		{ref: "https://gitlab.com/g/p/-/issues/1#unknown_1"},
+		{ref: "foo"},
+		{ref: ""},
+	} {
+		t.Run(test.ref, func(t *testing.T) {
+			id, ok := parseNoteRef(test.ref)
+			assert.Equal(t, test.ok, ok)
+			if ok {
+				assert.Equal(t, test.id, id)
+			}
+		})
+	}
+}
+
+func TestParseWebhookTime(t *testing.T) {
+	expected := time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, s := range []string{
+		"2022-08-01T10:00:00Z",
+		"2022-08-01 10:00:00 UTC",
+		"2022-08-01 12:00:00 +0200",
+	} {
+		assert.True(t, expected.Equal(parseWebhookTime(s)), s)
+	}
+}
+
+const (
+	testToken        = "gl-token"
+	testWebhookToken = "secret"
+
+	testProjectID = 42
+	testBotID     = 100
+)
+
+// fakeAPI is a gitlab rest api stand-in, project 42 (g/p) is served at /g/p
+type fakeAPI struct {
+	*httptest.Server
+
+	seq int64
+
+	downloads int32
+
+	// bodies of notes created by the bot
+	posted chan string
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	s := &fakeAPI{
+		posted: make(chan string, 16),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *fakeAPI) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("PRIVATE-TOKEN") != testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	alice := map[string]any{"id": 1, "username": "alice", "web_url": s.URL + "/alice"}
+
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/v4/user":
+		s.reply(w, map[string]any{"id": testBotID, "username": "mbot"})
+	case "GET /api/v4/projects/42/members/all/1":
+		s.reply(w, map[string]any{"id": 1, "username": "alice", "access_level": 40})
+	case "GET /api/v4/projects/42/members/all/2":
+		s.reply(w, map[string]any{"id": 2, "username": "bob", "access_level": 20})
+	case "POST /api/v4/projects/42/issues/1/notes", "POST /api/v4/projects/42/merge_requests/2/notes":
+		var n struct {
+			Body string `json:"body"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&n)
+		s.posted <- n.Body
+
+		s.reply(w, map[string]any{"id": 1000 + atomic.AddInt64(&s.seq, 1), "body": n.Body})
+	case "GET /api/v4/projects/42/issues/1":
+		s.reply(w, map[string]any{"id": 1, "iid": 1, "title": "Design", "description": "the proposal", "author": alice})
+	case "GET /api/v4/projects/42/issues/1/notes/55":
+		s.reply(w, map[string]any{"id": 55, "body": "early note", "author": alice})
+	case "GET /g/p/uploads/abcd/shot.png":
+		atomic.AddInt32(&s.downloads, 1)
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeAPI) reply(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (s *fakeAPI) expectPosted(t *testing.T, expected string) {
+	select {
+	case body := <-s.posted:
+		assert.Equal(t, expected, body)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timeout waiting for note", expected)
+	}
+}
+
+func webhookRequest(event string, payload any, token string) *http.Request {
+	body, _ := json.Marshal(payload)
+
+	req := httptest.NewRequest(http.MethodPost, "/gitlab/webhook", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitlab-Event", event)
+	req.Header.Set("X-Gitlab-Token", token)
+
+	return req
+}
+
+func TestBot(t *testing.T) {
+	srv := newFakeAPI(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, true),
+
+		Token:        testToken,
+		WebhookToken: testWebhookToken,
+		APIURL:       srv.URL + "/api/v4/",
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	require.NoError(t, b.Configure())
+	require.NoError(t, b.Start("", mux))
+
+	send := func(t *testing.T, event string, payload any) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, webhookRequest(event, payload, testWebhookToken))
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+	}
+
+	project := map[string]any{
+		"id":                  testProjectID,
+		"path_with_namespace": "g/p",
+		"web_url":             srv.URL + "/g/p",
+	}
+
+	issueNote := func(id, userID int, username, body string) map[string]any {
+		now := time.Now().UTC().Format(time.RFC3339)
+		return map[string]any{
+			"object_kind": "note",
+			"project_id":  testProjectID,
+			"project":     project,
+			"user":        map[string]any{"id": userID, "username": username},
+			"object_attributes": map[string]any{
+				"id":            id,
+				"note":          body,
+				"noteable_type": "Issue",
+				"created_at":    now,
+				"updated_at":    now,
+				"url":           srv.URL + "/g/p/-/issues/1#note_" + strconv.Itoa(id),
+			},
+			"issue": map[string]any{"iid": 1, "title": "Design"},
+		}
+	}
+
+	t.Run("Token", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, webhookRequest("Note Hook", issueNote(1, 1, "alice", "/new x"), "invalid"))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, webhookRequest("Push Hook", map[string]any{"object_kind": "push"}, testWebhookToken))
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		send(t, "Note Hook", issueNote(1, 2, "bob", "/new topic"))
+		srv.expectPosted(t, "Only project members with developer access can use this bot.")
+
+		send(t, "Note Hook", issueNote(2, 1, "alice", "/new topic\n\nlet's start"))
+		srv.expectPosted(t, "created topic")
+
+		send(t, "Note Hook", issueNote(3, 2, "bob", "**LGTM** @alice ![screenshot](/uploads/abcd/shot.png)"))
+
+		edited := issueNote(3, 2, "bob", "edited")
+		edited["object_attributes"].(map[string]any)["updated_at"] = time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+		send(t, "Note Hook", edited)
+
+		system := issueNote(4, 2, "bob", "changed the description")
+		system["object_attributes"].(map[string]any)["system"] = true
+		send(t, "Note Hook", system)
+
+		send(t, "Note Hook", issueNote(5, testBotID, "mbot", "created topic"))
+
+		send(t, "Note Hook", issueNote(6, 1, "alice", "/include"))
+		srv.expectPosted(t, "Included.")
+
+		send(t, "Note Hook", issueNote(7, 1, "alice", "/include "+srv.URL+"/g/p/-/issues/1#note_55"))
+		srv.expectPosted(t, "Included.")
+
+		send(t, "Note Hook", issueNote(8, 1, "alice", "/include 99"))
+		srv.expectPosted(t, "That comment is not available.")
+
+		send(t, "Note Hook", issueNote(9, 1, "alice", "/ignore "+srv.URL+"/g/p/-/issues/1#note_55"))
+		srv.expectPosted(t, "Ignored.")
+
+		send(t, "Note Hook", issueNote(10, 1, "alice", "/end"))
+		srv.expectPosted(t, "published")
+
+		assert.EqualValues(t, []string{
+			"topic" +
+				"bob: LGTM @alice \n" +
+				"alice: the proposal\n",
+		}, pub.Posts())
+		assert.EqualValues(t, 1, atomic.LoadInt32(&srv.downloads))
+	})
+
+	t.Run("MergeRequest", func(t *testing.T) {
+		send(t, "Merge Request Hook", map[string]any{
+			"object_kind": "merge_request",
+			"user":        map[string]any{"id": 1, "username": "alice"},
+			"project":     project,
+			"object_attributes": map[string]any{
+				"id":          200,
+				"iid":         2,
+				"title":       "Fix",
+				"description": "/help",
+				"action":      "open",
+				"url":         srv.URL + "/g/p/-/merge_requests/2",
+			},
+		})
+
+		select {
+		case body := <-srv.posted:
+			assert.True(t, strings.HasPrefix(body, "Usage:"), body)
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "timeout waiting for help")
+		}
+	})
+}
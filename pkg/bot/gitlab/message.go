@@ -0,0 +1,130 @@
+package gitlab
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"arhat.dev/pkg/log"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// uploadsPrefix is the prefix of links to files uploaded to notes, they are
+// relative to the project url
+const uploadsPrefix = "/uploads/"
+
+func (c *gitlabBot) newMessageFromNote(mc *messageContext, wf *bot.Workflow) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.createdAt.UTC()
+	ret.Spans = markdown.Parse(mc.body, markdown.Options{Mentions: true})
+
+	for i := range ret.Spans {
+		sp := &ret.Spans[i]
+		if !sp.IsURL() || !strings.HasPrefix(sp.URL, uploadsPrefix) {
+			continue
+		}
+
+		c.convertUploadSpan(mc, ret, i, wf)
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	ret.MessageLink = mc.webURL
+	ret.ChatName = mc.chat.String()
+	if len(mc.issue.title) != 0 {
+		ret.ChatName += " " + mc.issue.title
+	}
+	ret.ChatLink = mc.issue.webURL
+
+	ret.Author = mc.author.username
+	ret.AuthorLink = mc.author.webURL
+
+	return
+}
+
+// convertUploadSpan converts the link to uploaded file to media span, and downloads
+// the file in background when the workflow requires
+func (c *gitlabBot) convertUploadSpan(mc *messageContext, m *rt.Message, i int, wf *bot.Workflow) {
+	mediaSpan := &m.Spans[i]
+
+	fileURL := mc.issue.projectURL + mediaSpan.URL
+	filename := path.Base(mediaSpan.URL)
+	contentType := mime.TypeByExtension(path.Ext(filename))
+
+	mediaSpan.Text = ""
+	mediaSpan.URL = fileURL
+	mediaSpan.Filename = filename
+
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		mediaSpan.Flags = rt.SpanFlag_Image
+	case strings.HasPrefix(contentType, "video/"):
+		mediaSpan.Flags = rt.SpanFlag_Video
+	case strings.HasPrefix(contentType, "audio/"):
+		mediaSpan.Flags = rt.SpanFlag_Audio
+	default:
+		mediaSpan.Flags = rt.SpanFlag_File
+	}
+
+	if len(contentType) != 0 {
+		mediaSpan.ContentType = contentType
+	} else {
+		// provide default mime type for storage driver
+		mediaSpan.ContentType = "application/octet-stream"
+	}
+
+	if !wf.DownloadMedia() {
+		return
+	}
+
+	con := mc.con
+
+	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
+		mc.logger.D("download file", log.String("url", fileURL))
+
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			req, err2 := retryablehttp.NewRequestWithContext(c.Context(), http.MethodGet, fileURL, nil)
+			if err2 != nil {
+				return err2
+			}
+
+			// client sets the token and copies response body to the writer
+			_, err2 = c.client.Do(req, io.Writer(cacheWR))
+			return err2
+		})
+		if err != nil {
+			mc.logger.I("failed to download file", log.Error(err))
+			c.sendErrorf(mc, "unable to download: %v", err)
+			return
+		}
+
+		mc.logger.D("upload file",
+			log.String("filename", filename),
+			rt.LogCacheID(cacheRD.ID()),
+			log.Int64("size", sz),
+		)
+
+		sout, err := bot.Upload(&con, wf.Storage, filename, sz, cacheRD, mediaSpan.ContentType)
+		if err != nil {
+			mc.logger.I("failed to upload file", log.Error(err))
+			c.sendErrorf(mc, "unable to upload file: %v", err)
+			return
+		}
+
+		mediaSpan.Size = sz
+		mediaSpan.URL = sout.URL
+		mediaSpan.Data = cacheRD
+	})
+}
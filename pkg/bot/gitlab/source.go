@@ -0,0 +1,211 @@
+package gitlab
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+	api "github.com/xanzy/go-gitlab"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashString generates a stable uint64 id for chat references
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](s))
+	return h.Sum64()
+}
+
+type noteableKind uint8
+
+const (
+	noteableIssue noteableKind = iota
+	noteableMergeRequest
+)
+
+// chatIDWrapper is the chat data stored in session requests, every issue or
+// merge request is a chat
+type chatIDWrapper struct {
+	projectID int
+	// project is the full path of the project (e.g. arhat-dev/mbot)
+	project string
+
+	kind noteableKind
+	iid  int
+}
+
+// ID is derived from project id, which stays the same when the project is
+// renamed or transferred
+func (c chatIDWrapper) ID() rt.ChatID {
+	return rt.ChatID(hashString(strconv.Itoa(c.projectID) + c.refPrefix() + strconv.Itoa(c.iid)))
+}
+
+// String returns the gitlab reference (e.g. arhat-dev/mbot#1, arhat-dev/mbot!1)
+func (c chatIDWrapper) String() string {
+	return c.project + c.refPrefix() + strconv.Itoa(c.iid)
+}
+
+func (c chatIDWrapper) refPrefix() string {
+	if c.kind == noteableMergeRequest {
+		return "!"
+	}
+
+	return "#"
+}
+
+// issueInfo is the issue or merge request a note belongs to
+type issueInfo struct {
+	title  string
+	webURL string
+
+	// projectURL is the web url of the project, uploads are relative to it
+	projectURL string
+}
+
+// issueInfoOf builds issueInfo from fields in webhook payloads, the web url of
+// issue or merge request is not always included, so it's derived from projectURL
+func issueInfoOf(chat chatIDWrapper, title, projectURL string) issueInfo {
+	kind := "issues"
+	if chat.kind == noteableMergeRequest {
+		kind = "merge_requests"
+	}
+
+	return issueInfo{
+		title:      title,
+		webURL:     projectURL + "/-/" + kind + "/" + strconv.Itoa(chat.iid),
+		projectURL: projectURL,
+	}
+}
+
+// user is the author of a note
+type user struct {
+	id       int
+	username string
+	name     string
+	webURL   string
+}
+
+// note is the common part of notes, issue and merge request descriptions
+type note struct {
+	id     int
+	author user
+
+	// body in gitlab flavored markdown
+	body   string
+	webURL string
+
+	createdAt time.Time
+}
+
+// webhookTimeLayouts are time formats used in webhook payloads, older gitlab
+// versions do not use RFC3339
+var webhookTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05 -0700",
+}
+
+func parseWebhookTime(s string) time.Time {
+	for _, layout := range webhookTimeLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+
+	return time.Now()
+}
+
+func noteOfAPINote(n *api.Note, issue issueInfo) note {
+	ret := note{
+		id: n.ID,
+		author: user{
+			id:       n.Author.ID,
+			username: n.Author.Username,
+			name:     n.Author.Name,
+			webURL:   n.Author.WebURL,
+		},
+		body:   n.Body,
+		webURL: issue.webURL + "#note_" + strconv.Itoa(n.ID),
+	}
+
+	if n.CreatedAt != nil {
+		ret.createdAt = *n.CreatedAt
+	} else {
+		ret.createdAt = time.Now()
+	}
+
+	return ret
+}
+
+// noteOfIssue converts description of the issue to note
+func noteOfIssue(issue *api.Issue) note {
+	ret := note{
+		id:        issue.ID,
+		body:      issue.Description,
+		webURL:    issue.WebURL,
+		createdAt: time.Now(),
+	}
+
+	if a := issue.Author; a != nil {
+		ret.author = user{id: a.ID, username: a.Username, name: a.Name, webURL: a.WebURL}
+	}
+
+	if issue.CreatedAt != nil {
+		ret.createdAt = *issue.CreatedAt
+	}
+
+	return ret
+}
+
+// noteOfMergeRequest converts description of the merge request to note
+func noteOfMergeRequest(mr *api.MergeRequest) note {
+	ret := note{
+		id:        mr.ID,
+		body:      mr.Description,
+		webURL:    mr.WebURL,
+		createdAt: time.Now(),
+	}
+
+	if a := mr.Author; a != nil {
+		ret.author = user{id: a.ID, username: a.Username, name: a.Name, webURL: a.WebURL}
+	}
+
+	if mr.CreatedAt != nil {
+		ret.createdAt = *mr.CreatedAt
+	}
+
+	return ret
+}
+
+// userOfEventUser converts the user in webhook payloads, whose web url is not
+// included, so it's derived from the project url
+func userOfEventUser(u *api.EventUser, projectURL, project string) user {
+	if u == nil {
+		return user{}
+	}
+
+	return user{
+		id:       u.ID,
+		username: u.Username,
+		name:     u.Name,
+		webURL:   strings.TrimSuffix(projectURL, "/"+project) + "/" + u.Username,
+	}
+}
+
+type messageContext struct {
+	con conversationImpl
+
+	chat  chatIDWrapper
+	issue issueInfo
+
+	note
+
+	msgID rt.MessageID
+
+	logger log.Interface
+}
@@ -0,0 +1,32 @@
+package gitlab
+
+import (
+	"fmt"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func plain(text string) rt.Span { return rt.Span{Flags: rt.SpanFlag_PlainText, Text: text} }
+func bold(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Bold, Text: text} }
+func code(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Code, Text: text} }
+
+// reply creates a note on the issue (merge request) where mc comes from
+func (c *gitlabBot) reply(mc *messageContext, body ...rt.Span) (msgID rt.MessageID, err error) {
+	msgIDs, err := mc.con.SendMessage(c.Context(), rt.SendMessageOptions{Body: body})
+	if err != nil {
+		mc.logger.E("failed to create note", log.Error(err))
+		return
+	}
+
+	if len(msgIDs) != 0 {
+		msgID = msgIDs[0]
+	}
+
+	return
+}
+
+func (c *gitlabBot) sendErrorf(mc *messageContext, format string, args ...any) {
+	c.reply(mc, plain("Internal bot error: "), bold(fmt.Sprintf(format, args...)))
+}
@@ -1,10 +1,15 @@
 package bot
 
 import (
+	"fmt"
+	"io"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"arhat.dev/mbot/pkg/generator"
 	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/storage"
 )
 
 func Download(cache rt.Cache, doDownload func(rt.CacheWriter) error) (cacheRD rt.CacheReader, sz int64, err error) {
@@ -32,6 +37,56 @@ func Download(cache rt.Cache, doDownload func(rt.CacheWriter) error) (cacheRD rt
 	return
 }
 
+// Upload uploads the cached data to the storage, then seeks to start of the cache
+// reader to reuse this cache file
+//
+// NOTE: the cache reader is not closed to keep it available (avoid unexpected file deletion)
+func Upload(
+	con rt.Conversation,
+	store storage.Interface,
+	filename string,
+	size int64,
+	cacheRD rt.CacheReader,
+	contentType string,
+) (out rt.StorageOutput, err error) {
+	input := rt.NewStorageInput(filename, size, cacheRD, contentType)
+	out, err = store.Upload(con, &input)
+	if err != nil {
+		return
+	}
+
+	_, err = cacheRD.Seek(0, io.SeekStart)
+	if err != nil {
+		err = fmt.Errorf("reuse cached data: %w", err)
+	}
+
+	return
+}
+
+// SplitText splits text into parts no longer than max characters, at newlines if possible
+func SplitText(text string, max int) (ret []string) {
+	for utf8.RuneCountInString(text) > max {
+		n := 0
+		for i := 0; i < max; i++ {
+			_, sz := utf8.DecodeRuneInString(text[n:])
+			n += sz
+		}
+
+		if i := strings.LastIndexByte(text[:n], '\n'); i > 0 {
+			n = i
+		}
+
+		ret = append(ret, text[:n])
+		text = strings.TrimPrefix(text[n:], "\n")
+	}
+
+	if len(text) != 0 {
+		ret = append(ret, text)
+	}
+
+	return
+}
+
 func GenerateContent(
 	gen generator.Interface,
 	con rt.Conversation,
@@ -0,0 +1,53 @@
+package bot
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestSplitText(t *testing.T) {
+	assert.EqualValues(t, []string{"ab", "cd", "ef"}, SplitText("ab\ncdef", 2))
+	assert.EqualValues(t, []string{"a", "b\nc"}, SplitText("a\nb\nc", 3))
+	assert.EqualValues(t, []string{"你好", "世界"}, SplitText("你好世界", 2))
+	assert.EqualValues(t, []string{"abc"}, SplitText("abc", 3))
+	assert.Nil(t, SplitText("", 2))
+}
+
+// readAllStorage reads all data uploaded
+type readAllStorage struct {
+	data []byte
+}
+
+func (s *readAllStorage) Upload(con rt.Conversation, in *rt.StorageInput) (out rt.StorageOutput, err error) {
+	s.data, err = io.ReadAll(in.Reader())
+	out.URL = "fake://" + in.Filename()
+	return
+}
+
+func TestUpload(t *testing.T) {
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	cacheRD, sz, err := Download(cache, func(w rt.CacheWriter) error {
+		_, err2 := w.Write([]byte("hello"))
+		return err2
+	})
+	require.NoError(t, err)
+	defer func() { _ = cacheRD.Close() }()
+
+	store := &readAllStorage{}
+	out, err := Upload(nil, store, "a.txt", sz, cacheRD, "text/plain")
+	require.NoError(t, err)
+	assert.Equal(t, "fake://a.txt", out.URL)
+	assert.Equal(t, "hello", string(store.data))
+
+	// the cache reader is reusable after upload
+	data, err := io.ReadAll(cacheRD)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
@@ -0,0 +1,70 @@
+package bot
+
+import (
+	"sync"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// DefaultHistorySize is the default max count of messages kept in every chat
+const DefaultHistorySize = 128
+
+// HistoryMessage is the message kept in MessageHistory
+type HistoryMessage[C interface{ ID() rt.ChatID }] interface {
+	// Chat returns the chat where the message was sent
+	Chat() C
+
+	// MessageID returns the id of this message
+	MessageID() rt.MessageID
+}
+
+// MessageHistory keeps recent messages in every chat, so that messages sent before
+// the session was activated can be included by reply
+type MessageHistory[C interface{ ID() rt.ChatID }, M HistoryMessage[C]] struct {
+	mu    sync.Mutex
+	size  int
+	chats map[rt.ChatID][]M
+}
+
+// NewMessageHistory creates a MessageHistory keeping at most size messages in
+// every chat, size defaults to DefaultHistorySize when not positive
+func NewMessageHistory[C interface{ ID() rt.ChatID }, M HistoryMessage[C]](size int) *MessageHistory[C, M] {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+
+	return &MessageHistory[C, M]{
+		size:  size,
+		chats: make(map[rt.ChatID][]M),
+	}
+}
+
+// Add adds m to the history of its chat, the oldest message is dropped when the
+// history is full
+func (h *MessageHistory[C, M]) Add(m M) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	chatID := m.Chat().ID()
+	msgs := append(h.chats[chatID], m)
+	if len(msgs) > h.size {
+		msgs = msgs[len(msgs)-h.size:]
+	}
+
+	h.chats[chatID] = msgs
+}
+
+// Find returns the latest message with msgID in the chat
+func (h *MessageHistory[C, M]) Find(chatID rt.ChatID, msgID rt.MessageID) (ret M, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	msgs := h.chats[chatID]
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].MessageID() == msgID {
+			return msgs[i], true
+		}
+	}
+
+	return
+}
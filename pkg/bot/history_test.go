@@ -0,0 +1,52 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+type testChat rt.ChatID
+
+func (c testChat) ID() rt.ChatID { return rt.ChatID(c) }
+
+type testMessage struct {
+	chat testChat
+	id   rt.MessageID
+	text string
+}
+
+func (m *testMessage) Chat() testChat          { return m.chat }
+func (m *testMessage) MessageID() rt.MessageID { return m.id }
+
+func TestMessageHistory(t *testing.T) {
+	h := NewMessageHistory[testChat, *testMessage](2)
+
+	h.Add(&testMessage{chat: 1, id: 1, text: "a"})
+	h.Add(&testMessage{chat: 2, id: 1, text: "b"})
+	h.Add(&testMessage{chat: 1, id: 2, text: "c"})
+
+	m, ok := h.Find(1, 1)
+	assert.True(t, ok)
+	assert.Equal(t, "a", m.text)
+
+	m, ok = h.Find(2, 1)
+	assert.True(t, ok)
+	assert.Equal(t, "b", m.text)
+
+	_, ok = h.Find(3, 1)
+	assert.False(t, ok)
+
+	// oldest message is dropped when full
+	h.Add(&testMessage{chat: 1, id: 3, text: "d"})
+	_, ok = h.Find(1, 1)
+	assert.False(t, ok)
+
+	// latest message is returned for duplicate ids
+	h.Add(&testMessage{chat: 1, id: 3, text: "e"})
+	m, ok = h.Find(1, 3)
+	assert.True(t, ok)
+	assert.Equal(t, "e", m.text)
+}
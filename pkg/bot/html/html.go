@@ -0,0 +1,304 @@
+// Package html converts html formatted text in chat messages to spans and vice versa
+//
+// it's shared by platforms formatting messages in html
+package html
+
+import (
+	"html"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// Options for Parse
+type Options struct {
+	// Mention returns the mentioned user as Hint when href of the link is a mention
+	Mention func(href string) (hint string, ok bool)
+
+	// Ignore returns true when the element and its children should be skipped
+	Ignore func(n *nethtml.Node) bool
+}
+
+// Parse converts html to spans, only inline styles, links and basic blocks are
+// converted, other elements are treated as plain text containers
+func Parse(formatted string, opts Options) []rt.Span {
+	nodes, err := nethtml.ParseFragment(strings.NewReader(formatted), &nethtml.Node{
+		Type:     nethtml.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return []rt.Span{{Flags: rt.SpanFlag_PlainText, Text: formatted}}
+	}
+
+	p := &parser{opts: opts}
+	for _, n := range nodes {
+		p.walk(n, rt.Span{})
+	}
+
+	// remove trailing newline added by block elements
+	for len(p.spans) != 0 {
+		last := &p.spans[len(p.spans)-1]
+		last.Text = strings.TrimRight(last.Text, "\n")
+		if len(last.Text) != 0 {
+			break
+		}
+
+		p.spans = p.spans[:len(p.spans)-1]
+	}
+
+	return p.spans
+}
+
+type parser struct {
+	opts Options
+
+	spans []rt.Span
+}
+
+// nolint:gocyclo
+func (p *parser) walk(n *nethtml.Node, style rt.Span) {
+	switch n.Type {
+	case nethtml.TextNode:
+		text := n.Data
+		if !style.IsPre() && !style.IsCode() && len(strings.TrimSpace(text)) == 0 && strings.Contains(text, "\n") {
+			// formatting newlines between block elements
+			return
+		}
+
+		p.appendText(style, text)
+		return
+	case nethtml.ElementNode:
+	default:
+		return
+	}
+
+	if p.opts.Ignore != nil && p.opts.Ignore(n) {
+		return
+	}
+
+	block := false
+	switch n.DataAtom {
+	case atom.Head, atom.Title, atom.Style, atom.Script:
+		return
+	case atom.B, atom.Strong:
+		style.Flags |= rt.SpanFlag_Bold
+	case atom.I, atom.Em:
+		style.Flags |= rt.SpanFlag_Italic
+	case atom.U:
+		style.Flags |= rt.SpanFlag_Underline
+	case atom.Del, atom.S, atom.Strike:
+		style.Flags |= rt.SpanFlag_Strikethrough
+	case atom.Code:
+		if style.IsPre() {
+			style.Hint = strings.TrimPrefix(attrOf(n, "class"), "language-")
+		} else {
+			style.Flags |= rt.SpanFlag_Code
+		}
+	case atom.Pre:
+		style.Flags |= rt.SpanFlag_Pre
+		block = true
+	case atom.Blockquote:
+		style.Flags |= rt.SpanFlag_Blockquote
+		block = true
+	case atom.A:
+		href := attrOf(n, "href")
+		if len(href) == 0 {
+			break
+		}
+
+		style.URL = href
+		if p.opts.Mention != nil {
+			if hint, ok := p.opts.Mention(href); ok {
+				style.Flags |= rt.SpanFlag_Mention
+				style.Hint = hint
+				break
+			}
+		}
+
+		if strings.HasPrefix(href, "mailto:") {
+			style.Flags |= rt.SpanFlag_Email
+		} else {
+			style.Flags |= rt.SpanFlag_URL
+		}
+	case atom.Br:
+		p.appendText(rt.Span{}, "\n")
+		return
+	case atom.Img:
+		p.appendText(style, attrOf(n, "alt"))
+		return
+	case atom.P, atom.Div, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Ul, atom.Ol, atom.Table, atom.Tr:
+		block = true
+	case atom.Li:
+		p.newline()
+		p.appendText(rt.Span{}, "- ")
+	}
+
+	if block {
+		p.newline()
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		p.walk(child, style)
+	}
+
+	if block || n.DataAtom == atom.Li {
+		p.newline()
+	}
+}
+
+// newline ends current line if not ended
+func (p *parser) newline() {
+	if len(p.spans) == 0 || strings.HasSuffix(p.spans[len(p.spans)-1].Text, "\n") {
+		return
+	}
+
+	p.appendText(rt.Span{}, "\n")
+}
+
+func (p *parser) appendText(style rt.Span, text string) {
+	if len(text) == 0 {
+		return
+	}
+
+	if len(p.spans) != 0 {
+		last := &p.spans[len(p.spans)-1]
+		if last.Flags == style.Flags && last.URL == style.URL && last.Hint == style.Hint {
+			last.Text += text
+			return
+		}
+	}
+
+	style.Text = text
+	p.spans = append(p.spans, style)
+}
+
+func attrOf(n *nethtml.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+
+	return ""
+}
+
+// Format converts spans to plain text and html
+func Format(spans []rt.Span) (plain, formatted string) {
+	var pb, buf strings.Builder
+
+	for i := range spans {
+		formatSpan(&pb, &buf, &spans[i])
+	}
+
+	return pb.String(), buf.String()
+}
+
+// nolint:gocyclo
+func formatSpan(plain, buf *strings.Builder, sp *rt.Span) {
+	if sp.IsMedia() {
+		name := sp.Filename
+		if len(name) == 0 {
+			name = sp.URL
+		}
+
+		switch {
+		case len(sp.URL) != 0:
+			if len(sp.Filename) != 0 {
+				plain.WriteString(sp.Filename)
+				plain.WriteString(": ")
+			}
+			plain.WriteString(sp.URL)
+
+			buf.WriteString(`<a href="`)
+			buf.WriteString(html.EscapeString(sp.URL))
+			buf.WriteString(`">`)
+			buf.WriteString(escapeText(name))
+			buf.WriteString("</a>")
+		case len(sp.Filename) != 0:
+			plain.WriteString("[" + sp.Filename + "]")
+			buf.WriteString(escapeText("[" + sp.Filename + "]"))
+		}
+
+		if len(sp.Caption) != 0 {
+			body, formatted := Format(sp.Caption)
+			plain.WriteString(" " + body)
+			buf.WriteString(" " + formatted)
+		}
+
+		return
+	}
+
+	plain.WriteString(sp.Text)
+	if sp.IsURL() && len(sp.URL) != 0 && sp.URL != sp.Text {
+		plain.WriteString(" (")
+		plain.WriteString(sp.URL)
+		plain.WriteString(")")
+	}
+
+	var closing []string
+	open := func(tag, attrs string) {
+		buf.WriteString("<" + tag + attrs + ">")
+		closing = append(closing, "</"+tag+">")
+	}
+
+	if sp.IsBlockquote() {
+		open("blockquote", "")
+	}
+
+	if sp.IsPre() {
+		open("pre", "")
+		if len(sp.Hint) != 0 {
+			open("code", ` class="language-`+html.EscapeString(sp.Hint)+`"`)
+		} else {
+			open("code", "")
+		}
+	} else if sp.IsCode() {
+		open("code", "")
+	}
+
+	if sp.IsLink() && len(sp.URL) != 0 {
+		href := sp.URL
+		if sp.IsEmail() && !strings.HasPrefix(href, "mailto:") {
+			href = "mailto:" + href
+		}
+
+		open("a", ` href="`+html.EscapeString(href)+`"`)
+	}
+
+	if sp.IsBold() {
+		open("strong", "")
+	}
+
+	if sp.IsItalic() {
+		open("em", "")
+	}
+
+	if sp.IsUnderline() {
+		open("u", "")
+	}
+
+	if sp.IsStrikethrough() {
+		open("del", "")
+	}
+
+	if sp.IsPre() {
+		// newlines are kept in pre
+		buf.WriteString(html.EscapeString(sp.Text))
+	} else {
+		buf.WriteString(escapeText(sp.Text))
+	}
+
+	for i := len(closing) - 1; i >= 0; i-- {
+		buf.WriteString(closing[i])
+	}
+}
+
+// escapeText escapes text for html, newlines are converted to `<br>`
+func escapeText(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+}
@@ -0,0 +1,53 @@
+package html
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestParse(t *testing.T) {
+	assert.EqualValues(t, []rt.Span{
+		{Text: "hi "},
+		{Flags: rt.SpanFlag_Email, Text: "alice", URL: "mailto:alice@example.com"},
+		{Text: "\n"},
+		{Flags: rt.SpanFlag_Blockquote, Text: "quoted"},
+	}, Parse(
+		"<html><head><style>p { color: red; }</style></head><body>"+
+			`<p>hi <a href="mailto:alice@example.com">alice</a></p>`+
+			"<blockquote>quoted</blockquote></body></html>",
+		Options{},
+	))
+}
+
+func TestFormat(t *testing.T) {
+	plain, formatted := Format([]rt.Span{
+		{Text: "a<"},
+		{Flags: rt.SpanFlag_Bold | rt.SpanFlag_Italic, Text: "b"},
+		{Text: "\n"},
+		{Flags: rt.SpanFlag_URL, Text: "link", URL: "https://example.com/?a=1&b=2"},
+		{Text: " "},
+		{Flags: rt.SpanFlag_Pre, Text: "x\ny", Hint: "go"},
+		{
+			Flags: rt.SpanFlag_Image,
+			URL:   "https://example.com/p.png",
+			SpanMediaOptions: rt.SpanMediaOptions{
+				Filename: "photo.png",
+			},
+		},
+	})
+
+	assert.Equal(t,
+		"a<b\nlink (https://example.com/?a=1&b=2) x\nyphoto.png: https://example.com/p.png",
+		plain,
+	)
+	assert.Equal(t,
+		"a&lt;<strong><em>b</em></strong><br>"+
+			`<a href="https://example.com/?a=1&amp;b=2">link</a> `+
+			`<pre><code class="language-go">x`+"\n"+`y</code></pre>`+
+			`<a href="https://example.com/p.png">photo.png</a>`,
+		formatted,
+	)
+}
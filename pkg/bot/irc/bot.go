@@ -1,7 +1,260 @@
 package irc
 
-// TODO
-
 import (
-	_ "github.com/lrstanley/girc"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/lrstanley/girc"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
 )
+
+var _ bot.Interface = (*ircBot)(nil)
+
+type ircBot struct {
+	bot.BaseBot
+
+	client *girc.Client
+
+	channels      []ChannelConfig
+	cmdPrefix     string
+	maxLineLength int
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	history   *bot.MessageHistory[chatIDWrapper, *messageContext]
+	callbacks *bot.CallbackRegistry
+	msgSeq    uint64
+
+	// messages are handled one by one in the order received
+	msgCh chan *messageContext
+
+	connected     chan struct{}
+	connectedOnce sync.Once
+}
+
+// Configure connects to the irc server, it returns after the client is registered
+// to the server
+func (c *ircBot) Configure() error {
+	go c.handleMessages()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		for {
+			err := c.client.Connect()
+			select {
+			case errCh <- err:
+			default:
+			}
+
+			select {
+			case <-c.Context().Done():
+				return
+			default:
+			}
+
+			c.Logger().I("disconnected, reconnect later", log.Error(err))
+
+			select {
+			case <-c.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+
+	select {
+	case <-c.connected:
+	case err := <-errCh:
+		c.client.Close()
+		return fmt.Errorf("connect: %w", err)
+	case <-c.Context().Done():
+		c.client.Close()
+		return c.Context().Err()
+	}
+
+	c.Logger().D("connected", log.String("server", c.client.Server()), log.String("nick", c.client.GetNick()))
+	return nil
+}
+
+func (c *ircBot) Start(baseURL string, mux rt.Mux) error {
+	go func() {
+		<-c.Context().Done()
+		c.client.Close()
+	}()
+
+	return nil
+}
+
+func (c *ircBot) nextMsgID() rt.MessageID {
+	return rt.MessageID(atomic.AddUint64(&c.msgSeq, 1))
+}
+
+func (c *ircBot) onConnected(client *girc.Client, e girc.Event) {
+	for _, ch := range c.channels {
+		if len(ch.Key) != 0 {
+			client.Cmd.JoinKey(ch.Name, ch.Key)
+		} else {
+			client.Cmd.Join(ch.Name)
+		}
+	}
+
+	c.connectedOnce.Do(func() { close(c.connected) })
+}
+
+func (c *ircBot) onMessage(client *girc.Client, e girc.Event) {
+	if e.Source == nil || len(e.Params) < 2 {
+		return
+	}
+
+	if ok, ctcp := e.IsCTCP(); ok && ctcp.Command != girc.CTCP_ACTION {
+		// CTCP requests are handled by the client
+		return
+	}
+
+	mc := &messageContext{
+		nick:      e.Source.Name,
+		isNotice:  e.Command == girc.NOTICE,
+		isPrivate: !girc.IsValidChannel(e.Params[0]),
+		timestamp: e.Timestamp.UTC(),
+	}
+
+	if mc.isPrivate {
+		mc.chat.target = e.Source.Name
+	} else {
+		mc.chat.target = e.Params[0]
+	}
+
+	if e.IsAction() {
+		mc.isAction = true
+		mc.text = e.StripAction()
+	} else {
+		mc.text = e.Last()
+	}
+
+	if msgid, ok := e.Tags.Get("msgid"); ok && len(msgid) != 0 {
+		mc.msgID = hashMsgID(msgid)
+	} else {
+		mc.msgID = c.nextMsgID()
+	}
+
+	for _, tag := range [...]string{"+draft/reply", "+reply"} {
+		if replyTo, ok := e.Tags.Get(tag); ok && len(replyTo) != 0 {
+			mc.replyTo = hashMsgID(replyTo)
+			break
+		}
+	}
+
+	mc.con = conversationImpl{
+		bot:    c,
+		target: mc.chat.target,
+	}
+
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.chat.ID()),
+		rt.LogSenderID(userIDOf(mc.nick)),
+	)
+
+	c.history.Add(mc)
+
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+}
+
+func (c *ircBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+		}
+	}
+}
+
+func (c *ircBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	// bots should never respond to NOTICE automatically, see RFC 1459 section 4.4.2
+	if !mc.isNotice && !mc.isAction && strings.HasPrefix(mc.text, c.cmdPrefix) {
+		cmd, params, _ := strings.Cut(strings.TrimPrefix(mc.text, c.cmdPrefix), " ")
+		if cmd == clickCmd {
+			return c.handleClick(mc, strings.TrimSpace(params))
+		}
+
+		if len(cmd) != 0 {
+			handled, err := c.engine.HandleBotCmd(mc, "/"+cmd, strings.TrimSpace(params))
+			if handled {
+				return err
+			}
+		}
+	}
+
+	// filter private message for input to this bot
+	if !mc.isNotice {
+		handled, err := c.engine.HandleInput(mc)
+		if handled {
+			return err
+		}
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+// handleClick calls the OnClick callback of the button with the id, failures are
+// replied to the sender
+func (c *ircBot) handleClick(mc *messageContext, id string) error {
+	onClick, ok := c.callbacks.Find(id)
+	if !ok {
+		_, err := c.reply(mc, plain("The button has expired."))
+		return err
+	}
+
+	go func() {
+		err := onClick()
+		if err != nil {
+			mc.logger.I("failed to handle button click", log.Error(err))
+			_, _ = c.reply(mc, plain("Failed: "+err.Error()))
+		}
+	}()
+
+	return nil
+}
+
+func (c *ircBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(newMessageFromIRCMessage(mc, c.client.Config.Server))
+
+	return nil
+}
+
+// isChannelAdmin checks whether the user is an operator (or above) of the channel
+func (c *ircBot) isChannelAdmin(channel, nick string) bool {
+	user := c.client.LookupUser(nick)
+	if user == nil {
+		return false
+	}
+
+	perms, ok := user.Perms.Lookup(channel)
+	return ok && perms.IsAdmin()
+}
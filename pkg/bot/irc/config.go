@@ -0,0 +1,195 @@
+package irc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/tlshelper"
+	"arhat.dev/rs"
+	"github.com/lrstanley/girc"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "irc"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// SASLConfig for sasl authentication
+type SASLConfig struct {
+	rs.BaseField
+
+	// Mechanism of sasl authentication, one of [plain, external]
+	//
+	// defaults to plain when username is set
+	Mechanism string `yaml:"mechanism"`
+
+	// Username and Password for PLAIN mechanism
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ChannelConfig is the channel to join after connected
+type ChannelConfig struct {
+	rs.BaseField
+
+	// Name of the channel (e.g. #foo)
+	Name string `yaml:"name"`
+
+	// Key to join the channel, if any
+	Key string `yaml:"key"`
+}
+
+// Config for irc bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// Server address with port (e.g. irc.libera.chat:6697)
+	Server string              `yaml:"server"`
+	TLS    tlshelper.TLSConfig `yaml:"tls"`
+
+	// ServerPassword is the PASS sent to the server, if any
+	ServerPassword string `yaml:"serverPassword"`
+
+	Nick     string `yaml:"nick"`
+	User     string `yaml:"user"`
+	RealName string `yaml:"realName"`
+
+	SASL SASLConfig `yaml:"sasl"`
+
+	// Channels to join
+	Channels []ChannelConfig `yaml:"channels"`
+
+	// CommandPrefix is the prefix of bot commands in irc messages
+	//
+	// most irc clients intercept messages starting with `/`, so the
+	// workflow command `/new` is triggered by `!new` by default
+	//
+	// defaults to `!`
+	CommandPrefix string `yaml:"commandPrefix"`
+
+	// MaxLineLength is the max bytes of message text in a single line sent
+	// to the server, longer lines are splitted
+	//
+	// defaults to 400
+	MaxLineLength int `yaml:"maxLineLength"`
+
+	// CallbackTTL is how long buttons with callbacks are clickable
+	//
+	// defaults to 24h
+	CallbackTTL time.Duration `yaml:"callbackTTL"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	host, portStr, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %q: %w", c.Server, err)
+	}
+
+	port, err := strconv.ParseInt(portStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server port %q: %w", portStr, err)
+	}
+
+	nick := strings.TrimSpace(c.Nick)
+	if len(nick) == 0 {
+		return nil, fmt.Errorf("nick is required")
+	}
+
+	tlsConfig, err := c.TLS.GetTLSConfig(false)
+	if err != nil {
+		return nil, fmt.Errorf("create tls config: %w", err)
+	}
+
+	if tlsConfig != nil && len(tlsConfig.ServerName) == 0 {
+		tlsConfig.ServerName = host
+	}
+
+	var sasl girc.SASLMech
+	switch mech := strings.ToLower(c.SASL.Mechanism); {
+	case mech == "external":
+		sasl = &girc.SASLExternal{Identity: c.SASL.Username}
+	case mech == "plain", len(mech) == 0 && len(c.SASL.Username) != 0:
+		sasl = &girc.SASLPlain{User: c.SASL.Username, Pass: c.SASL.Password}
+	case len(mech) == 0:
+	default:
+		return nil, fmt.Errorf("unsupported sasl mechanism %q", c.SASL.Mechanism)
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	cmdPrefix := c.CommandPrefix
+	if len(cmdPrefix) == 0 {
+		cmdPrefix = "!"
+	}
+
+	maxLineLength := c.MaxLineLength
+	if maxLineLength <= 0 {
+		maxLineLength = defaultMaxLineLength
+	}
+
+	user, realName := c.User, c.RealName
+	if len(user) == 0 {
+		user = nick
+	}
+
+	if len(realName) == 0 {
+		realName = nick
+	}
+
+	ib := &ircBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		channels:      c.Channels,
+		cmdPrefix:     cmdPrefix,
+		maxLineLength: maxLineLength,
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		callbacks: bot.NewCallbackRegistry(rtCtx.Context(), c.CallbackTTL, callbackIDSize),
+
+		msgCh:     make(chan *messageContext, 64),
+		connected: make(chan struct{}),
+	}
+
+	ib.history = bot.NewMessageHistory[chatIDWrapper, *messageContext](0)
+	ib.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: ib}, ib.sessions, &ib.wfSet, engine.Options{
+		CmdPrefix:     cmdPrefix,
+		HelpInPrivate: true,
+		AdminOnly:     "Only channel operators can use this bot in channel.",
+		GroupChat:     "channel",
+	})
+
+	ib.client = girc.New(girc.Config{
+		Server:     host,
+		Port:       int(port),
+		ServerPass: c.ServerPassword,
+		Nick:       nick,
+		User:       user,
+		Name:       realName,
+		SASL:       sasl,
+		SSL:        tlsConfig != nil,
+		TLSConfig:  tlsConfig,
+		PingDelay:  time.Minute,
+	})
+
+	ib.client.Handlers.AddBg(girc.CONNECTED, ib.onConnected)
+	ib.client.Handlers.Add(girc.PRIVMSG, ib.onMessage)
+	ib.client.Handlers.Add(girc.NOTICE, ib.onMessage)
+
+	return ib, nil
+}
@@ -0,0 +1,84 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const defaultMaxLineLength = 400
+
+const (
+	// clickCmd is the command clicking the OnClick button with the id in params
+	clickCmd = "click"
+
+	// callbackIDSize is the number of random bytes in ids of OnClick buttons, ids
+	// are typed by users, so they are kept short
+	callbackIDSize = 4
+)
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *ircBot
+
+	// target channel or nick
+	target string
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// irc has no rich message, spans are rendered with formatting codes, media
+// spans are rendered as their urls, and callbacks are appended as extra lines,
+// OnClick callbacks are clicked by sending `!click <id>`
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) (msgIDs []rt.MessageID, err error) {
+	if !c.bot.client.IsConnected() {
+		return nil, fmt.Errorf("not connected")
+	}
+
+	var buf strings.Builder
+	buf.WriteString(formatSpans(opts.Body))
+
+	for _, row := range opts.Callbacks {
+		for _, cb := range row {
+			switch {
+			case !cb.URL.IsNil():
+				buf.WriteString("\n")
+				buf.WriteString(cb.Text)
+				buf.WriteString(": ")
+				buf.WriteString(cb.URL.Get())
+			case !cb.OnClick.IsNil():
+				var id string
+				id, err = c.bot.callbacks.Add(cb.OnClick.Get())
+				if err != nil {
+					return nil, fmt.Errorf("add button callback: %w", err)
+				}
+
+				buf.WriteString("\n")
+				buf.WriteString(cb.Text)
+				buf.WriteString(": send ")
+				buf.WriteString(c.bot.cmdPrefix + clickCmd + " " + id)
+			}
+		}
+	}
+
+	for _, line := range splitLines(buf.String(), c.bot.maxLineLength) {
+		select {
+		case <-ctx.Done():
+			return msgIDs, ctx.Err()
+		default:
+		}
+
+		c.bot.client.Cmd.Message(c.target, line)
+		msgIDs = append(msgIDs, c.bot.nextMsgID())
+	}
+
+	return
+}
@@ -0,0 +1,59 @@
+package irc
+
+import (
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+var (
+	_ engine.Message[chatIDWrapper]                  = (*messageContext)(nil)
+	_ engine.Adapter[chatIDWrapper, *messageContext] = (*adapter)(nil)
+)
+
+func (mc *messageContext) Chat() chatIDWrapper           { return mc.chat }
+func (mc *messageContext) ChatName() string              { return mc.chat.target }
+func (mc *messageContext) IsPrivate() bool               { return mc.isPrivate }
+func (mc *messageContext) SenderID() rt.UserID           { return userIDOf(mc.nick) }
+func (mc *messageContext) MessageID() rt.MessageID       { return mc.msgID }
+func (mc *messageContext) ReplyTo() rt.MessageID         { return mc.replyTo }
+func (mc *messageContext) InputText() string             { return mc.text }
+func (mc *messageContext) Conversation() rt.Conversation { return &mc.con }
+func (mc *messageContext) Logger() log.Interface         { return mc.logger }
+
+// adapter implements engine.Adapter for irc
+type adapter struct {
+	c *ircBot
+}
+
+func (a adapter) Reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	return a.c.reply(mc, body...)
+}
+
+func (a adapter) Conversation(chat chatIDWrapper) rt.Conversation {
+	return &conversationImpl{bot: a.c, target: chat.target}
+}
+
+// DeleteAfter does nothing, messages cannot be deleted in irc
+func (a adapter) DeleteAfter(chat chatIDWrapper, delay time.Duration, msgIDs ...rt.MessageID) {}
+
+func (a adapter) PrivateChatOf(mc *messageContext) (chatIDWrapper, bool, error) {
+	return chatIDWrapper{target: mc.nick}, true, nil
+}
+
+func (a adapter) PrivateChatLink(startParams string) (string, bool) { return "", false }
+
+func (a adapter) IsAdmin(mc *messageContext) (bool, error) {
+	return a.c.isChannelAdmin(mc.chat.target, mc.nick), nil
+}
+
+func (a adapter) RepliedMessage(mc *messageContext) (*messageContext, bool) {
+	return a.c.history.Find(mc.chat.ID(), mc.replyTo)
+}
+
+func (a adapter) AppendSessionMessage(mc *messageContext) error {
+	return a.c.appendSessionMessage(mc)
+}
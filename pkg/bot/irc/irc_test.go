@@ -0,0 +1,362 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/lrstanley/girc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestParseFormattedText(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		text     string
+		expected []rt.Span
+	}{
+		{
+			name:     "Plain",
+			text:     "hello",
+			expected: []rt.Span{{Text: "hello"}},
+		},
+		{
+			name: "Styles",
+			text: "a \x02bold\x02 \x1ditalic\x0f \x11code\x11",
+			expected: []rt.Span{
+				{Text: "a "},
+				{Flags: rt.SpanFlag_Bold, Text: "bold"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Italic, Text: "italic"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Code, Text: "code"},
+			},
+		},
+		{
+			name: "Nested",
+			text: "\x02\x1fboth\x02 underline",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Bold | rt.SpanFlag_Underline, Text: "both"},
+				{Flags: rt.SpanFlag_Underline, Text: " underline"},
+			},
+		},
+		{
+			name:     "Colors",
+			text:     "\x0304,12red\x03 \x04ff00ffpink\x04 \x031,2",
+			expected: []rt.Span{{Text: "red pink "}},
+		},
+		{
+			name: "URL",
+			text: "see https://example.com/a?b=c, ok",
+			expected: []rt.Span{
+				{Text: "see "},
+				{Flags: rt.SpanFlag_URL, Text: "https://example.com/a?b=c", URL: "https://example.com/a?b=c"},
+				{Text: ", ok"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.EqualValues(t, test.expected, parseFormattedText(test.text))
+		})
+	}
+}
+
+func TestFormatSpans(t *testing.T) {
+	assert.Equal(t,
+		"a \x02b\x0f \x11c\x0f link (https://example.com) photo.png: https://example.com/p.png",
+		formatSpans([]rt.Span{
+			{Text: "a "},
+			{Flags: rt.SpanFlag_Bold, Text: "b"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Code, Text: "c"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_URL, Text: "link", URL: "https://example.com"},
+			{Text: " "},
+			{
+				Flags: rt.SpanFlag_Image,
+				URL:   "https://example.com/p.png",
+				SpanMediaOptions: rt.SpanMediaOptions{
+					Filename: "photo.png",
+				},
+			},
+		}),
+	)
+}
+
+func TestSplitLines(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		text     string
+		max      int
+		expected []string
+	}{
+		{
+			name:     "Lines",
+			text:     "a\r\nb\n\nc",
+			max:      10,
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			name:     "Space",
+			text:     "hello world foo",
+			max:      12,
+			expected: []string{"hello world ", "foo"},
+		},
+		{
+			name:     "UTF-8",
+			text:     "你好世界",
+			max:      7,
+			expected: []string{"你好", "世界"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.EqualValues(t, test.expected, splitLines(test.text, test.max))
+		})
+	}
+}
+
+// fakeServer is a minimal irc server stand-in serving single client
+type fakeServer struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+
+	// sasl credentials received
+	sasl chan string
+	// channels joined
+	joined chan string
+	// PRIVMSG sent by the client, in form of `target :text`
+	privmsg chan string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &fakeServer{
+		t:  t,
+		ln: ln,
+
+		sasl:    make(chan string, 1),
+		joined:  make(chan string, 8),
+		privmsg: make(chan string, 32),
+	}
+
+	go s.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+
+	return s
+}
+
+func (s *fakeServer) send(lines ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, line := range lines {
+		_, _ = s.w.WriteString(line + "\r\n")
+	}
+
+	_ = s.w.Flush()
+}
+
+func (s *fakeServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.conn = conn
+	s.w = bufio.NewWriter(conn)
+	s.mu.Unlock()
+
+	defer func() { _ = conn.Close() }()
+
+	var nick string
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		e := girc.ParseEvent(line)
+		if e == nil {
+			continue
+		}
+
+		switch e.Command {
+		case girc.CAP:
+			switch {
+			case len(e.Params) > 0 && e.Params[0] == girc.CAP_LS:
+				s.send(":fake CAP * LS :sasl message-tags")
+			case len(e.Params) > 0 && e.Params[0] == girc.CAP_REQ:
+				s.send(":fake CAP * ACK :" + e.Last())
+			}
+		case girc.AUTHENTICATE:
+			if e.Last() == "PLAIN" {
+				s.send("AUTHENTICATE +")
+				continue
+			}
+
+			s.sasl <- e.Last()
+			s.send(":fake 903 * :SASL authentication successful")
+		case girc.NICK:
+			nick = e.Last()
+		case girc.USER:
+			s.send(":fake 001 " + nick + " :Welcome")
+		case girc.PING:
+			s.send(":fake PONG fake :" + e.Last())
+		case girc.JOIN:
+			s.send(
+				":"+nick+"!"+nick+"@localhost JOIN "+e.Params[0],
+				":fake 353 "+nick+" = "+e.Params[0]+" :"+nick+" @alice bob",
+				":fake 366 "+nick+" "+e.Params[0]+" :End of /NAMES list.",
+			)
+			s.joined <- e.Params[0]
+		case girc.PRIVMSG:
+			s.privmsg <- e.Params[0] + " :" + e.Last()
+		}
+	}
+}
+
+func (s *fakeServer) expectPrivmsg(t *testing.T, expected string) {
+	select {
+	case msg := <-s.privmsg:
+		assert.Equal(t, expected, msg)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timeout waiting for message", expected)
+	}
+}
+
+func TestBot(t *testing.T) {
+	srv := newFakeServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, false),
+
+		Server: srv.ln.Addr().String(),
+		Nick:   "mbot",
+		SASL: SASLConfig{
+			Username: "foo",
+			Password: "bar",
+		},
+		Channels: []ChannelConfig{{Name: "#test"}},
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	require.NoError(t, b.Configure())
+	require.NoError(t, b.Start("", nil))
+
+	select {
+	case cred := <-srv.sasl:
+		data, err2 := base64.StdEncoding.DecodeString(cred)
+		assert.NoError(t, err2)
+		assert.Equal(t, "foo\x00foo\x00bar", string(data))
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "sasl authentication not performed")
+	}
+
+	select {
+	case ch := <-srv.joined:
+		assert.Equal(t, "#test", ch)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "channel not joined")
+	}
+
+	// wait for NAMES handled
+	assert.Eventually(t, func() bool {
+		return b.(*ircBot).isChannelAdmin("#test", "alice")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	srv.send(":bob!bob@localhost PRIVMSG #test :!new topic")
+	srv.expectPrivmsg(t, "#test :bob: Only channel operators can use this bot in channel.")
+
+	srv.send(":alice!alice@localhost PRIVMSG #test :!new topic")
+	srv.expectPrivmsg(t, "#test :created topic")
+
+	srv.send(
+		"@msgid=m1 :alice!alice@localhost PRIVMSG #test :\x02hello\x02 https://example.com",
+		":bob!bob@localhost PRIVMSG #test :\x01ACTION waves\x01",
+		":bob!bob@localhost NOTICE #test :!end",
+		":alice!alice@localhost PRIVMSG #test :!end",
+	)
+	srv.expectPrivmsg(t, "#test :published")
+
+	assert.EqualValues(t, []string{
+		"topic" +
+			"alice: hello https://example.com\n" +
+			"bob: * bob waves\n" +
+			"bob: !end\n",
+	}, pub.Posts())
+
+	con := &conversationImpl{bot: b.(*ircBot), target: "#test"}
+	msgIDs, err := con.SendMessage(ctx, rt.SendMessageOptions{
+		Body: []rt.Span{{Text: strings.Repeat("a", 500)}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, msgIDs, 2)
+	srv.expectPrivmsg(t, "#test :"+strings.Repeat("a", 400))
+	srv.expectPrivmsg(t, "#test :"+strings.Repeat("a", 100))
+
+	t.Run("Click", func(t *testing.T) {
+		clicked := make(chan struct{}, 1)
+		_, err := con.SendMessage(ctx, rt.SendMessageOptions{
+			Body: []rt.Span{{Text: "choose"}},
+			Callbacks: [][]rt.MessageCallbackSpec{{
+				{Text: "docs", URL: rt.NewOptionalValue("https://example.com")},
+				{Text: "ok", OnClick: rt.NewOptionalValue(func() error {
+					clicked <- struct{}{}
+					return nil
+				})},
+			}},
+		})
+		require.NoError(t, err)
+
+		srv.expectPrivmsg(t, "#test :choose")
+		srv.expectPrivmsg(t, "#test :docs: https://example.com")
+
+		var line string
+		select {
+		case line = <-srv.privmsg:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "button not sent")
+		}
+
+		require.True(t, strings.HasPrefix(line, "#test :ok: send "), line)
+		clickCmd := strings.TrimPrefix(line, "#test :ok: send ")
+		assert.Len(t, strings.TrimPrefix(clickCmd, "!click "), 2*callbackIDSize)
+
+		srv.send(":bob!bob@localhost PRIVMSG #test :" + clickCmd)
+		select {
+		case <-clicked:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "callback not called")
+		}
+
+		srv.send(":bob!bob@localhost PRIVMSG #test :!click 00000000")
+		srv.expectPrivmsg(t, "#test :bob: The button has expired.")
+	})
+}
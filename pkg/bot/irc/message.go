@@ -0,0 +1,292 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// irc formatting control codes
+//
+// ref: https://modern.ircdocs.horse/formatting.html
+const (
+	fmtBold          = '\x02'
+	fmtItalic        = '\x1d'
+	fmtUnderline     = '\x1f'
+	fmtStrikethrough = '\x1e'
+	fmtMonospace     = '\x11'
+	fmtColor         = '\x03'
+	fmtHexColor      = '\x04'
+	fmtReverse       = '\x16'
+	fmtReset         = '\x0f'
+)
+
+func newMessageFromIRCMessage(mc *messageContext, serverName string) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.timestamp
+	ret.Spans = parseFormattedText(mc.text)
+
+	if mc.isAction {
+		// `/me waves` is rendered as `* nick waves`
+		ret.Spans = append([]rt.Span{
+			{Flags: rt.SpanFlag_Italic, Text: "* " + mc.nick + " "},
+		}, ret.Spans...)
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	if mc.isPrivate {
+		ret.Flags |= rt.MessageFlag_Private
+	}
+
+	if mc.replyTo != 0 {
+		ret.Flags |= rt.MessageFlag_Reply
+		ret.ReplyTo = mc.replyTo
+	}
+
+	ret.ChatName = mc.chat.target
+	if !mc.isPrivate && len(serverName) != 0 {
+		ret.ChatLink = "irc://" + serverName + "/" + strings.TrimPrefix(mc.chat.target, "#")
+	}
+
+	ret.Author = mc.nick
+
+	return
+}
+
+// parseFormattedText converts irc formatted text to spans
+// nolint:gocyclo
+func parseFormattedText(text string) (ret []rt.Span) {
+	var (
+		buf   strings.Builder
+		flags rt.SpanFlag
+	)
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+
+		if flags == rt.SpanFlag_PlainText {
+			ret = append(ret, detectURLs(buf.String())...)
+		} else {
+			ret = append(ret, rt.Span{Flags: flags, Text: buf.String()})
+		}
+
+		buf.Reset()
+	}
+
+	toggle := func(f rt.SpanFlag) {
+		flush()
+		flags ^= f
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case fmtBold:
+			toggle(rt.SpanFlag_Bold)
+		case fmtItalic:
+			toggle(rt.SpanFlag_Italic)
+		case fmtUnderline:
+			toggle(rt.SpanFlag_Underline)
+		case fmtStrikethrough:
+			toggle(rt.SpanFlag_Strikethrough)
+		case fmtMonospace:
+			toggle(rt.SpanFlag_Code)
+		case fmtReset:
+			flush()
+			flags = rt.SpanFlag_PlainText
+		case fmtReverse:
+			// no equivalent
+		case fmtColor:
+			// \x03[fg[,bg]], both fg and bg are 1 or 2 digits
+			i += skipColor(text[i+1:], isDigit, 2)
+		case fmtHexColor:
+			// \x04[RRGGBB[,RRGGBB]]
+			i += skipColor(text[i+1:], isHexDigit, 6)
+		default:
+			buf.WriteByte(text[i])
+		}
+	}
+
+	flush()
+	return
+}
+
+// skipColor returns count of bytes used as color spec at the start of s
+func skipColor(s string, valid func(c byte) bool, maxDigits int) (n int) {
+	n = countPrefix(s, valid, maxDigits)
+	if n == 0 {
+		return
+	}
+
+	if n < len(s) && s[n] == ',' {
+		bg := countPrefix(s[n+1:], valid, maxDigits)
+		if bg != 0 {
+			n += 1 + bg
+		}
+	}
+
+	return
+}
+
+func countPrefix(s string, valid func(c byte) bool, max int) (n int) {
+	for n < len(s) && n < max && valid(s[n]) {
+		n++
+	}
+
+	return
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// detectURLs splits plain text into text and url spans
+func detectURLs(text string) (ret []rt.Span) {
+	start := 0
+	for i := 0; i < len(text); {
+		if i != 0 && !isSpace(text[i-1]) {
+			i++
+			continue
+		}
+
+		if !strings.HasPrefix(text[i:], "http://") && !strings.HasPrefix(text[i:], "https://") {
+			i++
+			continue
+		}
+
+		end := i
+		for end < len(text) && !isSpace(text[end]) {
+			end++
+		}
+
+		url := strings.TrimRight(text[i:end], ".,;:!?)'\"")
+		if start != i {
+			ret = append(ret, rt.Span{Flags: rt.SpanFlag_PlainText, Text: text[start:i]})
+		}
+
+		ret = append(ret, rt.Span{Flags: rt.SpanFlag_URL, Text: url, URL: url})
+		i += len(url)
+		start = i
+	}
+
+	if start < len(text) {
+		ret = append(ret, rt.Span{Flags: rt.SpanFlag_PlainText, Text: text[start:]})
+	}
+
+	return
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' }
+
+// formatSpans converts spans to irc formatted text
+func formatSpans(spans []rt.Span) string {
+	var buf strings.Builder
+
+	for i := range spans {
+		formatSpan(&buf, &spans[i])
+	}
+
+	return buf.String()
+}
+
+func formatSpan(buf *strings.Builder, sp *rt.Span) {
+	var codes []byte
+
+	if sp.IsMedia() {
+		switch {
+		case len(sp.URL) != 0:
+			if len(sp.Filename) != 0 {
+				buf.WriteString(sp.Filename)
+				buf.WriteString(": ")
+			}
+			buf.WriteString(sp.URL)
+		case len(sp.Filename) != 0:
+			buf.WriteString("[")
+			buf.WriteString(sp.Filename)
+			buf.WriteString("]")
+		}
+
+		if len(sp.Caption) != 0 {
+			buf.WriteString(" ")
+			buf.WriteString(formatSpans(sp.Caption))
+		}
+
+		return
+	}
+
+	if sp.IsBold() {
+		codes = append(codes, fmtBold)
+	}
+
+	if sp.IsItalic() {
+		codes = append(codes, fmtItalic)
+	}
+
+	if sp.IsUnderline() {
+		codes = append(codes, fmtUnderline)
+	}
+
+	if sp.IsStrikethrough() {
+		codes = append(codes, fmtStrikethrough)
+	}
+
+	if sp.IsCode() || sp.IsPre() {
+		codes = append(codes, fmtMonospace)
+	}
+
+	buf.Write(codes)
+	buf.WriteString(sp.Text)
+	if sp.IsURL() && len(sp.URL) != 0 && sp.URL != sp.Text {
+		buf.WriteString(" (")
+		buf.WriteString(sp.URL)
+		buf.WriteString(")")
+	}
+
+	if len(codes) != 0 {
+		buf.WriteByte(fmtReset)
+	}
+}
+
+// splitLines splits text into lines no longer than max bytes, formatting codes
+// are not carried over to the next line
+func splitLines(text string, max int) (ret []string) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		for len(line) > max {
+			n := max
+			// prefer splitting at space
+			if idx := strings.LastIndexByte(line[:n], ' '); idx > max/2 {
+				n = idx + 1
+			} else {
+				for n > 0 && !utf8.RuneStart(line[n]) {
+					n--
+				}
+
+				if n == 0 {
+					n = max
+				}
+			}
+
+			ret = append(ret, line[:n])
+			line = line[n:]
+		}
+
+		if len(line) != 0 {
+			ret = append(ret, line)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,60 @@
+package irc
+
+import (
+	"hash/fnv"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+	"github.com/lrstanley/girc"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashName generates a stable uint64 id for irc names (nick, channel)
+//
+// irc names are case insensitive, so names are normalized before hashing
+func hashName(name string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](girc.ToRFC1459(name)))
+	return h.Sum64()
+}
+
+// hashMsgID generates a message id from value of the `msgid` message tag
+func hashMsgID(msgid string) rt.MessageID {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](msgid))
+	return rt.MessageID(h.Sum64())
+}
+
+func userIDOf(nick string) rt.UserID { return rt.UserID(hashName(nick)) }
+
+// chatIDWrapper is the chat data stored in session requests
+type chatIDWrapper struct {
+	// target is the name of the channel or the nick of the user in
+	// private chat
+	target string
+}
+
+func (c chatIDWrapper) ID() rt.ChatID { return rt.ChatID(hashName(c.target)) }
+
+type messageContext struct {
+	con conversationImpl
+
+	chat chatIDWrapper
+	nick string
+
+	msgID   rt.MessageID
+	replyTo rt.MessageID
+
+	// text with irc formatting codes
+	text string
+
+	isPrivate bool
+	isAction  bool
+	isNotice  bool
+
+	timestamp time.Time
+
+	logger log.Interface
+}
@@ -0,0 +1,34 @@
+package irc
+
+import (
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func plain(text string) rt.Span { return rt.Span{Flags: rt.SpanFlag_PlainText, Text: text} }
+
+// sendText sends spans as a single message, returns id of the first line sent
+func (c *ircBot) sendText(con *conversationImpl, body ...rt.Span) (msgID rt.MessageID, err error) {
+	msgIDs, err := con.SendMessage(c.Context(), rt.SendMessageOptions{Body: body})
+	if err != nil {
+		c.Logger().E("failed to send message", log.Error(err))
+		return
+	}
+
+	if len(msgIDs) != 0 {
+		msgID = msgIDs[0]
+	}
+
+	return
+}
+
+// reply sends message to the chat where mc comes from, messages in channel are
+// prefixed with the nick of the sender
+func (c *ircBot) reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	if !mc.isPrivate {
+		body = append([]rt.Span{plain(mc.nick + ": ")}, body...)
+	}
+
+	return c.sendText(&mc.con, body...)
+}
@@ -0,0 +1,341 @@
+// Package markdown converts markdown text in chat messages to spans and vice versa
+//
+// it's shared by platforms formatting messages in (github flavored) markdown
+package markdown
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// Options for Parse
+type Options struct {
+	// Mentions converts `@name` in text to mention spans with name as Hint
+	Mentions bool
+
+	// HashTags converts `#tag` in text to hashtag spans
+	HashTags bool
+}
+
+var md = goldmark.New(goldmark.WithExtensions(
+	extension.Strikethrough,
+	extension.Linkify,
+))
+
+// Parse converts markdown text to spans
+func Parse(markdown string, opts Options) []rt.Span {
+	src := []byte(markdown)
+	p := &parser{
+		src:  src,
+		opts: opts,
+	}
+
+	p.blocks(md.Parser().Parse(text.NewReader(src)), 0, "\n\n")
+
+	return p.spans
+}
+
+type parser struct {
+	src  []byte
+	opts Options
+
+	spans []rt.Span
+}
+
+// blocks converts children of the block node, sep is appended between child blocks
+//
+// nolint:gocyclo
+func (p *parser) blocks(n ast.Node, flags rt.SpanFlag, sep string) {
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		if child != n.FirstChild() {
+			p.appendText(flags, sep, "", "")
+		}
+
+		switch b := child.(type) {
+		case *ast.Paragraph, *ast.TextBlock:
+			p.inlines(b, flags)
+		case *ast.Heading:
+			p.inlines(b, flags|rt.SpanFlag_Bold)
+		case *ast.ThematicBreak:
+			p.appendText(flags, "---", "", "")
+		case *ast.FencedCodeBlock:
+			p.appendText(flags|rt.SpanFlag_Pre, p.lines(b), "", string(b.Language(p.src)))
+		case *ast.CodeBlock:
+			p.appendText(flags|rt.SpanFlag_Pre, p.lines(b), "", "")
+		case *ast.HTMLBlock:
+			p.appendText(flags, p.lines(b), "", "")
+		case *ast.Blockquote:
+			p.blocks(b, flags|rt.SpanFlag_Blockquote, "\n")
+		case *ast.List:
+			i := b.Start
+			for item := b.FirstChild(); item != nil; item = item.NextSibling() {
+				if item != b.FirstChild() {
+					p.appendText(flags, "\n", "", "")
+				}
+
+				if b.IsOrdered() {
+					p.appendText(flags, strconv.Itoa(i)+". ", "", "")
+					i++
+				} else {
+					p.appendText(flags, "- ", "", "")
+				}
+
+				p.blocks(item, flags, "\n")
+			}
+		default:
+			p.blocks(b, flags, "\n")
+		}
+	}
+}
+
+// lines returns content of the block without the trailing newline
+func (p *parser) lines(n ast.Node) string {
+	var buf strings.Builder
+
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		buf.Write(seg.Value(p.src))
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// nolint:gocyclo
+func (p *parser) inlines(n ast.Node, flags rt.SpanFlag) {
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		switch v := child.(type) {
+		case *ast.Text:
+			value := v.Segment.Value(p.src)
+			if !v.IsRaw() {
+				value = util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(value)))
+			}
+
+			p.appendPlainText(flags, string(value))
+			if v.SoftLineBreak() || v.HardLineBreak() {
+				p.appendText(flags, "\n", "", "")
+			}
+		case *ast.String:
+			p.appendPlainText(flags, string(v.Value))
+		case *ast.CodeSpan:
+			p.appendText(flags|rt.SpanFlag_Code, string(v.Text(p.src)), "", "")
+		case *ast.Emphasis:
+			if v.Level >= 2 {
+				p.inlines(v, flags|rt.SpanFlag_Bold)
+			} else {
+				p.inlines(v, flags|rt.SpanFlag_Italic)
+			}
+		case *east.Strikethrough:
+			p.inlines(v, flags|rt.SpanFlag_Strikethrough)
+		case *ast.Link:
+			p.appendLink(flags, string(v.Text(p.src)), string(v.Destination))
+		case *ast.Image:
+			p.appendLink(flags, string(v.Text(p.src)), string(v.Destination))
+		case *ast.AutoLink:
+			url, label := string(v.URL(p.src)), string(v.Label(p.src))
+			if v.AutoLinkType == ast.AutoLinkEmail {
+				p.appendText(flags|rt.SpanFlag_Email, label, "mailto:"+label, "")
+			} else {
+				p.appendText(flags|rt.SpanFlag_URL, label, url, "")
+			}
+		case *ast.RawHTML:
+			for i := 0; i < v.Segments.Len(); i++ {
+				seg := v.Segments.At(i)
+				p.appendText(flags, string(seg.Value(p.src)), "", "")
+			}
+		default:
+			p.inlines(v, flags)
+		}
+	}
+}
+
+func (p *parser) appendLink(flags rt.SpanFlag, label, url string) {
+	if len(label) == 0 {
+		label = url
+	}
+
+	if strings.HasPrefix(url, "mailto:") {
+		p.appendText(flags|rt.SpanFlag_Email, label, url, "")
+	} else {
+		p.appendText(flags|rt.SpanFlag_URL, label, url, "")
+	}
+}
+
+// appendPlainText appends text with mentions and hashtags recognized as required
+func (p *parser) appendPlainText(flags rt.SpanFlag, s string) {
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '@' && p.opts.Mentions, c == '#' && p.opts.HashTags:
+		default:
+			continue
+		}
+
+		if i != 0 {
+			prev, _ := utf8.DecodeLastRuneInString(s[:i])
+			if isNameRune(prev) {
+				continue
+			}
+		}
+
+		name := s[i+1:]
+		if end := strings.IndexFunc(name, func(r rune) bool { return !isNameRune(r) }); end >= 0 {
+			name = name[:end]
+		}
+
+		// names never end with dots, e.g. `@foo.` at the end of sentence
+		name = strings.TrimRight(name, ".")
+		if len(name) == 0 {
+			continue
+		}
+
+		p.appendText(flags, s[start:i], "", "")
+		if c == '@' {
+			p.appendText(flags|rt.SpanFlag_Mention, s[i:i+1+len(name)], "", name)
+		} else {
+			p.appendText(flags|rt.SpanFlag_HashTag, s[i:i+1+len(name)], "", "")
+		}
+
+		i += len(name)
+		start = i + 1
+	}
+
+	p.appendText(flags, s[start:], "", "")
+}
+
+func isNameRune(r rune) bool {
+	return r == '_' || r == '-' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (p *parser) appendText(flags rt.SpanFlag, text, url, hint string) {
+	if len(text) == 0 {
+		return
+	}
+
+	if len(p.spans) != 0 {
+		last := &p.spans[len(p.spans)-1]
+		if last.Flags == flags && last.URL == url && last.Hint == hint &&
+			!flags.IsLink() && !flags.IsPre() {
+			last.Text += text
+			return
+		}
+	}
+
+	p.spans = append(p.spans, rt.Span{Flags: flags, Text: text, URL: url, Hint: hint})
+}
+
+var escaper = strings.NewReplacer(
+	`\`, `\\`, `*`, `\*`, `_`, `\_`, `~`, `\~`, "`", "\\`",
+	`[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`, `#`, `\#`,
+)
+
+// Escape escapes markdown special characters in text
+func Escape(text string) string {
+	return escaper.Replace(text)
+}
+
+// Format converts spans to markdown text
+func Format(spans []rt.Span) string {
+	var buf strings.Builder
+
+	for i := range spans {
+		formatSpan(&buf, &spans[i])
+	}
+
+	return buf.String()
+}
+
+// nolint:gocyclo
+func formatSpan(buf *strings.Builder, sp *rt.Span) {
+	if sp.IsMedia() {
+		switch {
+		case len(sp.URL) != 0:
+			name := sp.Filename
+			if len(name) == 0 {
+				name = sp.URL
+			}
+
+			buf.WriteString(link(name, sp.URL))
+		case len(sp.Filename) != 0:
+			buf.WriteString(Escape("[" + sp.Filename + "]"))
+		}
+
+		if len(sp.Caption) != 0 {
+			buf.WriteString(" ")
+			buf.WriteString(Format(sp.Caption))
+		}
+
+		return
+	}
+
+	var text string
+	switch {
+	case sp.IsMention() && len(sp.Hint) != 0:
+		text = "@" + sp.Hint
+	case sp.Flags.IsHashTag():
+		text = sp.Text
+	case sp.IsURL() && len(sp.URL) != 0:
+		text = link(sp.Text, sp.URL)
+	case sp.IsEmail():
+		text = sp.Text
+	case sp.IsPre():
+		text = "```" + sp.Hint + "\n" + sp.Text + "\n```"
+	case sp.IsCode():
+		if strings.Contains(sp.Text, "`") {
+			text = "`` " + sp.Text + " ``"
+		} else {
+			text = "`" + sp.Text + "`"
+		}
+	default:
+		text = Escape(sp.Text)
+	}
+
+	if !sp.IsPre() && !sp.IsCode() {
+		if sp.IsStrikethrough() {
+			text = wrapMarker(text, "~~")
+		}
+
+		if sp.IsItalic() {
+			text = wrapMarker(text, "*")
+		}
+
+		if sp.IsBold() {
+			text = wrapMarker(text, "**")
+		}
+	}
+
+	if sp.IsBlockquote() {
+		text = "> " + strings.ReplaceAll(text, "\n", "\n> ")
+	}
+
+	buf.WriteString(text)
+}
+
+// link formats `[text](url)`
+func link(text, url string) string {
+	return "[" + Escape(text) + "](" + strings.NewReplacer(" ", "%20", ")", "%29").Replace(url) + ")"
+}
+
+// wrapMarker wraps text with style marker, leading and trailing spaces are kept
+// outside of the markers
+func wrapMarker(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if len(trimmed) == 0 {
+		return text
+	}
+
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
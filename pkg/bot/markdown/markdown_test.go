@@ -0,0 +1,106 @@
+package markdown
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		text     string
+		opts     Options
+		expected []rt.Span
+	}{
+		{
+			name:     "Plain",
+			text:     "a \\*b\\* &amp; snake_case_name\nnext",
+			expected: []rt.Span{{Text: "a *b* & snake_case_name\nnext"}},
+		},
+		{
+			name: "Styles",
+			text: "**bold** _it_ ~~gone~~ `a*b`",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Bold, Text: "bold"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Italic, Text: "it"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Strikethrough, Text: "gone"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Code, Text: "a*b"},
+			},
+		},
+		{
+			name: "Links",
+			text: "[site](https://example.com) https://a.example/b <foo@example.com>",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_URL, Text: "site", URL: "https://example.com"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_URL, Text: "https://a.example/b", URL: "https://a.example/b"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Email, Text: "foo@example.com", URL: "mailto:foo@example.com"},
+			},
+		},
+		{
+			name: "MentionsAndHashTags",
+			text: "hi @alice.b, see #topic-1 and a@b `@code`",
+			opts: Options{Mentions: true, HashTags: true},
+			expected: []rt.Span{
+				{Text: "hi "},
+				{Flags: rt.SpanFlag_Mention, Text: "@alice.b", Hint: "alice.b"},
+				{Text: ", see "},
+				{Flags: rt.SpanFlag_HashTag, Text: "#topic-1"},
+				{Text: " and a@b "},
+				{Flags: rt.SpanFlag_Code, Text: "@code"},
+			},
+		},
+		{
+			name: "Blocks",
+			text: "# Title\n\n> quoted\n> more\n\n- a\n- b\n\n```go\nx := 1\n```",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Bold, Text: "Title"},
+				{Text: "\n\n"},
+				{Flags: rt.SpanFlag_Blockquote, Text: "quoted\nmore"},
+				{Text: "\n\n- a\n- b\n\n"},
+				{Flags: rt.SpanFlag_Pre, Text: "x := 1", Hint: "go"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.EqualValues(t, test.expected, Parse(test.text, test.opts))
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t,
+		"a\\*b **bold** *it* `x` [link](https://example.com/a%20b) @alice #tag > q\n> r"+
+			"```go\nx := 1\n```[photo.png](fake://p.png)",
+		Format([]rt.Span{
+			{Text: "a*b "},
+			{Flags: rt.SpanFlag_Bold, Text: "bold "},
+			{Flags: rt.SpanFlag_Italic, Text: "it"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Code, Text: "x"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_URL, Text: "link", URL: "https://example.com/a b"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Mention, Text: "@Alice", Hint: "alice"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_HashTag, Text: "#tag"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Blockquote, Text: "q\nr"},
+			{Flags: rt.SpanFlag_Pre, Text: "x := 1", Hint: "go"},
+			{
+				Flags: rt.SpanFlag_Image,
+				URL:   "fake://p.png",
+				SpanMediaOptions: rt.SpanMediaOptions{
+					Filename: "photo.png",
+				},
+			},
+		}),
+	)
+}
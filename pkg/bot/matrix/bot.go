@@ -1,7 +1,336 @@
 package matrix
 
-// TODO
-
 import (
-	_ "maunium.net/go/mautrix"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
 )
+
+// adminPowerLevel is the minimum power level of room moderators
+const adminPowerLevel = 50
+
+var _ bot.Interface = (*matrixBot)(nil)
+
+type matrixBot struct {
+	bot.BaseBot
+
+	client *mautrix.Client
+
+	autoJoin  bool
+	cmdPrefix string
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	history   *bot.MessageHistory[chatIDWrapper, *messageContext]
+	callbacks *bot.CallbackRegistry
+
+	roomsMu *sync.Mutex
+	rooms   map[id.RoomID]*roomInfo
+	// dmRooms are direct chat rooms of users, used to ask for tokens
+	dmRooms map[id.UserID]id.RoomID
+}
+
+// Configure checks the access token and resolves user id of the bot
+func (c *matrixBot) Configure() error {
+	resp, err := c.client.Whoami()
+	if err != nil {
+		return fmt.Errorf("check access token: %w", err)
+	}
+
+	if len(c.client.UserID) != 0 && c.client.UserID != resp.UserID {
+		return fmt.Errorf("access token belongs to %q, not %q", resp.UserID, c.client.UserID)
+	}
+
+	c.client.UserID = resp.UserID
+
+	c.Logger().D("logged in", log.String("user_id", string(resp.UserID)))
+	return nil
+}
+
+// Start long-polls /sync until the bot context is canceled
+func (c *matrixBot) Start(baseURL string, mux rt.Mux) error {
+	go func() {
+		for {
+			err := c.client.SyncWithContext(c.Context())
+
+			select {
+			case <-c.Context().Done():
+				return
+			default:
+			}
+
+			c.Logger().I("sync stopped, retry later", log.Error(err))
+
+			select {
+			case <-c.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// onSync drops timeline events in the initial sync, they were sent before
+// the bot started
+func (c *matrixBot) onSync(resp *mautrix.RespSync, since string) bool {
+	if len(since) != 0 {
+		return true
+	}
+
+	for roomID, room := range resp.Rooms.Join {
+		room.Timeline.Events = nil
+		resp.Rooms.Join[roomID] = room
+	}
+
+	return true
+}
+
+func (c *matrixBot) onStateChanged(source mautrix.EventSource, evt *event.Event) {
+	if source&mautrix.EventSourceInvite != 0 {
+		member := evt.Content.AsMember()
+		if !c.autoJoin ||
+			member.Membership != event.MembershipInvite ||
+			evt.GetStateKey() != string(c.client.UserID) {
+			return
+		}
+
+		c.Logger().D("join room on invitation",
+			log.String("room_id", string(evt.RoomID)),
+			log.String("inviter", string(evt.Sender)),
+		)
+
+		_, err := c.client.JoinRoomByID(evt.RoomID)
+		if err != nil {
+			c.Logger().I("failed to join room", log.String("room_id", string(evt.RoomID)), log.Error(err))
+		}
+
+		return
+	}
+
+	c.roomsMu.Lock()
+	delete(c.rooms, evt.RoomID)
+	c.roomsMu.Unlock()
+}
+
+func (c *matrixBot) onMessage(source mautrix.EventSource, evt *event.Event) {
+	if source&mautrix.EventSourceTimeline == 0 || source&mautrix.EventSourceJoin == 0 {
+		return
+	}
+
+	content := evt.Content.AsMessage()
+	if content.RelatesTo != nil && content.RelatesTo.Type == event.RelReplace {
+		// TODO: handle message edits
+		return
+	}
+
+	if content.File != nil {
+		// TODO: support end-to-end encrypted attachments
+		content.URL = ""
+	}
+
+	content.RemoveReplyFallback()
+
+	room, err := c.roomInfo(evt.RoomID)
+	if err != nil {
+		c.Logger().I("failed to get room info", log.String("room_id", string(evt.RoomID)), log.Error(err))
+		return
+	}
+
+	mc := &messageContext{
+		chat:   chatIDWrapper{room: evt.RoomID},
+		sender: evt.Sender,
+
+		eventID: evt.ID,
+		msgID:   messageIDOf(evt.ID),
+
+		content: content,
+
+		author:    room.displayName(evt.Sender),
+		chatName:  room.name,
+		isPrivate: room.isDirect(),
+		timestamp: time.UnixMilli(evt.Timestamp).UTC(),
+	}
+
+	if replyTo := content.GetReplyTo(); len(replyTo) != 0 {
+		mc.replyTo = messageIDOf(replyTo)
+	}
+
+	mc.con = conversationImpl{
+		bot:  c,
+		room: evt.RoomID,
+	}
+
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.chat.ID()),
+		rt.LogSenderID(userIDOf(mc.sender)),
+	)
+
+	c.history.Add(mc)
+
+	if evt.Sender == c.client.UserID {
+		return
+	}
+
+	if mc.isPrivate {
+		c.roomsMu.Lock()
+		c.dmRooms[evt.Sender] = evt.RoomID
+		c.roomsMu.Unlock()
+	}
+
+	err = c.dispatchNewMessage(mc)
+	if err != nil {
+		mc.logger.I("bad message", log.Error(err))
+	}
+}
+
+func (c *matrixBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	// bots should never respond to m.notice, it's usually sent by other bots
+	text := mc.text()
+	if mc.content.MsgType == event.MsgText && strings.HasPrefix(text, c.cmdPrefix) {
+		cmd, params, _ := strings.Cut(strings.TrimPrefix(text, c.cmdPrefix), " ")
+		if cmd == clickCmd {
+			return c.handleClick(mc, strings.TrimSpace(params))
+		}
+
+		if len(cmd) != 0 {
+			handled, err := c.engine.HandleBotCmd(mc, "/"+cmd, strings.TrimSpace(params))
+			if handled {
+				return err
+			}
+		}
+	}
+
+	// filter private message for input to this bot
+	if mc.content.MsgType == event.MsgText {
+		handled, err := c.engine.HandleInput(mc)
+		if handled {
+			return err
+		}
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+// handleClick calls the OnClick callback of the button with the id, failures are
+// replied to the sender
+func (c *matrixBot) handleClick(mc *messageContext, id string) error {
+	onClick, ok := c.callbacks.Find(id)
+	if !ok {
+		c.reply(mc, plain("The button has expired."))
+		return nil
+	}
+
+	go func() {
+		err := onClick()
+		if err != nil {
+			mc.logger.I("failed to handle button click", log.Error(err))
+			c.reply(mc, plain("Failed: "+err.Error()))
+		}
+	}()
+
+	return nil
+}
+
+func (c *matrixBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromEvent(mc, s.Workflow()))
+
+	return nil
+}
+
+// roomInfo returns cached room state, it fetches the state from the
+// homeserver when not cached
+func (c *matrixBot) roomInfo(roomID id.RoomID) (*roomInfo, error) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+
+	if info, ok := c.rooms[roomID]; ok {
+		return info, nil
+	}
+
+	resp, err := c.client.JoinedMembers(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("get joined members: %w", err)
+	}
+
+	info := &roomInfo{
+		members: make(map[id.UserID]string, len(resp.Joined)),
+	}
+
+	for userID, m := range resp.Joined {
+		if m.DisplayName != nil {
+			info.members[userID] = *m.DisplayName
+		} else {
+			info.members[userID] = ""
+		}
+	}
+
+	var name event.RoomNameEventContent
+	if err = c.client.StateEvent(roomID, event.StateRoomName, "", &name); err == nil {
+		info.name = name.Name
+	}
+
+	if len(info.name) == 0 {
+		info.name = string(roomID)
+	}
+
+	c.rooms[roomID] = info
+	return info, nil
+}
+
+// privateRoomOf returns the direct chat room with the user, it creates one
+// when there is no such room
+func (c *matrixBot) privateRoomOf(userID id.UserID) (id.RoomID, error) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+
+	if roomID, ok := c.dmRooms[userID]; ok {
+		return roomID, nil
+	}
+
+	resp, err := c.client.CreateRoom(&mautrix.ReqCreateRoom{
+		Invite:   []id.UserID{userID},
+		IsDirect: true,
+		Preset:   "trusted_private_chat",
+	})
+	if err != nil {
+		return "", fmt.Errorf("create direct chat: %w", err)
+	}
+
+	c.dmRooms[userID] = resp.RoomID
+	return resp.RoomID, nil
+}
+
+// isRoomAdmin checks whether the user is a moderator (or above) of the room
+func (c *matrixBot) isRoomAdmin(roomID id.RoomID, userID id.UserID) bool {
+	var pl event.PowerLevelsEventContent
+	err := c.client.StateEvent(roomID, event.StatePowerLevels, "", &pl)
+	if err != nil {
+		c.Logger().I("failed to get power levels", log.String("room_id", string(roomID)), log.Error(err))
+		return false
+	}
+
+	return pl.GetUserLevel(userID) >= adminPowerLevel
+}
@@ -0,0 +1,136 @@
+package matrix
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/tlshelper"
+	"arhat.dev/rs"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "matrix"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// Config for matrix bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// HomeserverURL is the base url of the client-server api (e.g. https://matrix-client.matrix.org)
+	HomeserverURL string              `yaml:"homeserverURL"`
+	TLS           tlshelper.TLSConfig `yaml:"tls"`
+
+	// UserID of the bot account (e.g. @mbot:matrix.org)
+	//
+	// resolved with the access token when not set
+	UserID string `yaml:"userID"`
+
+	// AccessToken of the bot account
+	AccessToken string `yaml:"accessToken"`
+
+	// AutoJoin accepts room invitations automatically
+	AutoJoin bool `yaml:"autoJoin"`
+
+	// CommandPrefix is the prefix of bot commands in matrix messages
+	//
+	// most matrix clients intercept messages starting with `/`, so the
+	// workflow command `/new` is triggered by `!new` by default
+	//
+	// defaults to `!`
+	CommandPrefix string `yaml:"commandPrefix"`
+
+	// CallbackTTL is how long buttons with callbacks are clickable
+	//
+	// defaults to 24h
+	CallbackTTL time.Duration `yaml:"callbackTTL"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	if len(c.HomeserverURL) == 0 {
+		return nil, fmt.Errorf("homeserverURL is required")
+	}
+
+	if len(c.AccessToken) == 0 {
+		return nil, fmt.Errorf("accessToken is required")
+	}
+
+	client, err := mautrix.NewClient(c.HomeserverURL, id.UserID(c.UserID), c.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("create matrix client: %w", err)
+	}
+
+	tlsConfig, err := c.TLS.GetTLSConfig(false)
+	if err != nil {
+		return nil, fmt.Errorf("create tls config: %w", err)
+	}
+
+	if tlsConfig != nil {
+		client.Client = &http.Client{
+			// long enough for the 30s long-polling sync request
+			Timeout: 3 * time.Minute,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	cmdPrefix := c.CommandPrefix
+	if len(cmdPrefix) == 0 {
+		cmdPrefix = "!"
+	}
+
+	mb := &matrixBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		client: client,
+
+		autoJoin:  c.AutoJoin,
+		cmdPrefix: strings.TrimSpace(cmdPrefix),
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		callbacks: bot.NewCallbackRegistry(rtCtx.Context(), c.CallbackTTL, callbackIDSize),
+
+		roomsMu: &sync.Mutex{},
+		rooms:   make(map[id.RoomID]*roomInfo),
+		dmRooms: make(map[id.UserID]id.RoomID),
+	}
+
+	mb.history = bot.NewMessageHistory[chatIDWrapper, *messageContext](0)
+	mb.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: mb}, mb.sessions, &mb.wfSet, engine.Options{
+		CmdPrefix:        mb.cmdPrefix,
+		AdminOnly:        "Only room moderators can use this bot in group rooms.",
+		GroupChat:        "group rooms",
+		CheckPrivateChat: "Please check direct messages from me.",
+	})
+
+	syncer := client.Syncer.(*mautrix.DefaultSyncer)
+	syncer.OnSync(mb.onSync)
+	syncer.OnEventType(event.EventMessage, mb.onMessage)
+	syncer.OnEventType(event.StateMember, mb.onStateChanged)
+	syncer.OnEventType(event.StateRoomName, mb.onStateChanged)
+
+	return mb, nil
+}
@@ -0,0 +1,108 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"arhat.dev/mbot/pkg/bot/html"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const (
+	// clickCmd is the command clicking the OnClick button with the id in params
+	clickCmd = "click"
+
+	// callbackIDSize is the number of random bytes in ids of OnClick buttons, ids
+	// are typed by users, so they are kept short
+	callbackIDSize = 4
+)
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *matrixBot
+
+	room id.RoomID
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// messages are sent as m.notice with html formatted body, callbacks with url
+// are appended as links, and OnClick callbacks are appended as `!click <id>`
+// commands to send
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) (_ []rt.MessageID, err error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	body, formatted := html.Format(opts.Body)
+
+	var (
+		plainBuf = strings.Builder{}
+		htmlBuf  = strings.Builder{}
+	)
+
+	plainBuf.WriteString(body)
+	htmlBuf.WriteString(formatted)
+
+	for _, row := range opts.Callbacks {
+		for _, cb := range row {
+			var spans []rt.Span
+			switch {
+			case !cb.URL.IsNil():
+				spans = []rt.Span{{Flags: rt.SpanFlag_URL, Text: cb.Text, URL: cb.URL.Get()}}
+			case !cb.OnClick.IsNil():
+				var id string
+				id, err = c.bot.callbacks.Add(cb.OnClick.Get())
+				if err != nil {
+					return nil, fmt.Errorf("add button callback: %w", err)
+				}
+
+				spans = []rt.Span{
+					{Text: cb.Text + ": send "},
+					{Flags: rt.SpanFlag_Code, Text: c.bot.cmdPrefix + clickCmd + " " + id},
+				}
+			default:
+				continue
+			}
+
+			b, f := html.Format(spans)
+			plainBuf.WriteString("\n" + b)
+			htmlBuf.WriteString("<br>" + f)
+		}
+	}
+
+	content := &event.MessageEventContent{
+		MsgType:       event.MsgNotice,
+		Body:          plainBuf.String(),
+		Format:        event.FormatHTML,
+		FormattedBody: htmlBuf.String(),
+	}
+
+	if opts.ReplyTo != 0 {
+		if mc, ok := c.bot.history.Find(chatIDWrapper{room: c.room}.ID(), opts.ReplyTo); ok {
+			content.RelatesTo = &event.RelatesTo{
+				Type:    event.RelReply,
+				EventID: mc.eventID,
+			}
+		}
+	}
+
+	resp, err := c.bot.client.SendMessageEvent(c.room, event.EventMessage, content)
+	if err != nil {
+		return nil, err
+	}
+
+	return []rt.MessageID{messageIDOf(resp.EventID)}, nil
+}
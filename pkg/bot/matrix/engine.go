@@ -0,0 +1,64 @@
+package matrix
+
+import (
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+var (
+	_ engine.Message[chatIDWrapper]                  = (*messageContext)(nil)
+	_ engine.Adapter[chatIDWrapper, *messageContext] = (*adapter)(nil)
+)
+
+func (mc *messageContext) Chat() chatIDWrapper           { return mc.chat }
+func (mc *messageContext) ChatName() string              { return mc.chatName }
+func (mc *messageContext) IsPrivate() bool               { return mc.isPrivate }
+func (mc *messageContext) SenderID() rt.UserID           { return userIDOf(mc.sender) }
+func (mc *messageContext) MessageID() rt.MessageID       { return mc.msgID }
+func (mc *messageContext) ReplyTo() rt.MessageID         { return mc.replyTo }
+func (mc *messageContext) InputText() string             { return mc.text() }
+func (mc *messageContext) Conversation() rt.Conversation { return &mc.con }
+func (mc *messageContext) Logger() log.Interface         { return mc.logger }
+
+// adapter implements engine.Adapter for matrix
+type adapter struct {
+	c *matrixBot
+}
+
+func (a adapter) Reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	return a.c.sendText(&mc.con, mc.msgID, body...)
+}
+
+func (a adapter) Conversation(chat chatIDWrapper) rt.Conversation {
+	return &conversationImpl{bot: a.c, room: chat.room}
+}
+
+// DeleteAfter does nothing, notices are kept in the room history
+func (a adapter) DeleteAfter(chat chatIDWrapper, delay time.Duration, msgIDs ...rt.MessageID) {}
+
+func (a adapter) PrivateChatOf(mc *messageContext) (chatIDWrapper, bool, error) {
+	roomID, err := a.c.privateRoomOf(mc.sender)
+	if err != nil {
+		return chatIDWrapper{}, false, err
+	}
+
+	return chatIDWrapper{room: roomID}, true, nil
+}
+
+func (a adapter) PrivateChatLink(startParams string) (string, bool) { return "", false }
+
+func (a adapter) IsAdmin(mc *messageContext) (bool, error) {
+	return a.c.isRoomAdmin(mc.chat.room, mc.sender), nil
+}
+
+func (a adapter) RepliedMessage(mc *messageContext) (*messageContext, bool) {
+	return a.c.history.Find(mc.chat.ID(), mc.replyTo)
+}
+
+func (a adapter) AppendSessionMessage(mc *messageContext) error {
+	return a.c.appendSessionMessage(mc)
+}
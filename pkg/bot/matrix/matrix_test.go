@@ -0,0 +1,312 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestParseHTML(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		html     string
+		expected []rt.Span
+	}{
+		{
+			name:     "Plain",
+			html:     "hello &amp; bye",
+			expected: []rt.Span{{Text: "hello & bye"}},
+		},
+		{
+			name: "Styles",
+			html: "a <strong>bold</strong> <em><del>both</del></em> <code>code</code>",
+			expected: []rt.Span{
+				{Text: "a "},
+				{Flags: rt.SpanFlag_Bold, Text: "bold"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Italic | rt.SpanFlag_Strikethrough, Text: "both"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Code, Text: "code"},
+			},
+		},
+		{
+			name: "Links",
+			html: `<a href="https://matrix.to/#/@alice:example.com">Alice</a>: see <a href="https://example.com">this</a>`,
+			expected: []rt.Span{
+				{
+					Flags: rt.SpanFlag_Mention,
+					Text:  "Alice",
+					Hint:  "@alice:example.com",
+					URL:   "https://matrix.to/#/@alice:example.com",
+				},
+				{Text: ": see "},
+				{Flags: rt.SpanFlag_URL, Text: "this", URL: "https://example.com"},
+			},
+		},
+		{
+			name: "Blocks",
+			html: "<mx-reply><blockquote>quoted</blockquote></mx-reply><p>line<br>break</p>\n" +
+				"<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n" +
+				`<pre><code class="language-go">x := 1` + "\n</code></pre>",
+			expected: []rt.Span{
+				{Text: "line\nbreak\n- a\n- b\n"},
+				{Flags: rt.SpanFlag_Pre, Text: "x := 1", Hint: "go"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.EqualValues(t, test.expected, parseHTML(test.html))
+		})
+	}
+}
+
+const (
+	testUserID = "@mbot:example.com"
+	testRoomID = "!room:example.com"
+)
+
+// fakeHomeserver is a minimal matrix homeserver stand-in serving the
+// client-server api used by the bot
+type fakeHomeserver struct {
+	*httptest.Server
+
+	batch int64
+
+	// events to be sent in next sync response
+	events chan map[string]any
+	// messages sent by the bot, in form of body text
+	sent chan string
+
+	mu         sync.Mutex
+	downloaded int
+}
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	s := &fakeHomeserver{
+		events: make(chan map[string]any, 16),
+		sent:   make(chan string, 16),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *fakeHomeserver) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN"}`))
+		return
+	}
+
+	p := r.URL.Path
+	switch {
+	case strings.HasSuffix(p, "/account/whoami"):
+		s.reply(w, map[string]any{"user_id": testUserID})
+	case strings.HasSuffix(p, "/filter"):
+		s.reply(w, map[string]any{"filter_id": "1"})
+	case strings.HasSuffix(p, "/sync"):
+		s.handleSync(w, r)
+	case strings.HasSuffix(p, "/joined_members"):
+		s.reply(w, map[string]any{
+			"joined": map[string]any{
+				testUserID:           map[string]any{"display_name": "mbot"},
+				"@alice:example.com": map[string]any{"display_name": "Alice"},
+				"@bob:example.com":   map[string]any{"display_name": "Bob"},
+			},
+		})
+	case strings.Contains(p, "/state/m.room.name"):
+		s.reply(w, map[string]any{"name": "Test Room"})
+	case strings.Contains(p, "/state/m.room.power_levels"):
+		s.reply(w, map[string]any{"users": map[string]any{"@alice:example.com": 100}})
+	case strings.Contains(p, "/send/m.room.message/"):
+		var content struct {
+			Body string `json:"body"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&content)
+		s.sent <- content.Body
+
+		s.reply(w, map[string]any{"event_id": fmt.Sprintf("$sent%d", atomic.AddInt64(&s.batch, 1))})
+	case strings.HasSuffix(p, "/download/example.com/photo"):
+		s.mu.Lock()
+		s.downloaded++
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+	}
+}
+
+func (s *fakeHomeserver) reply(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (s *fakeHomeserver) handleSync(w http.ResponseWriter, r *http.Request) {
+	var events []map[string]any
+	if len(r.URL.Query().Get("since")) == 0 {
+		// initial sync contains old message, which should be ignored
+		events = append(events, textEvent("$old", "@alice:example.com", "!new old"))
+	} else {
+		select {
+		case evt := <-s.events:
+			events = append(events, evt)
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.reply(w, map[string]any{
+		"next_batch": fmt.Sprint(atomic.AddInt64(&s.batch, 1)),
+		"rooms": map[string]any{
+			"join": map[string]any{
+				testRoomID: map[string]any{
+					"timeline": map[string]any{"events": events},
+				},
+			},
+		},
+	})
+}
+
+func (s *fakeHomeserver) expectSent(t *testing.T, expected string) {
+	select {
+	case msg := <-s.sent:
+		assert.Equal(t, expected, msg)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timeout waiting for message", expected)
+	}
+}
+
+func messageEvent(eventID, sender string, content map[string]any) map[string]any {
+	return map[string]any{
+		"type":             "m.room.message",
+		"event_id":         eventID,
+		"sender":           sender,
+		"origin_server_ts": time.Now().UnixMilli(),
+		"content":          content,
+	}
+}
+
+func textEvent(eventID, sender, text string) map[string]any {
+	return messageEvent(eventID, sender, map[string]any{"msgtype": "m.text", "body": text})
+}
+
+func TestBot(t *testing.T) {
+	srv := newFakeHomeserver(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, true),
+
+		HomeserverURL: srv.URL,
+		AccessToken:   "token",
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	require.NoError(t, b.Configure())
+	assert.EqualValues(t, testUserID, b.(*matrixBot).client.UserID)
+	require.NoError(t, b.Start("", nil))
+
+	srv.events <- textEvent("$1", "@bob:example.com", "!new topic")
+	srv.expectSent(t, "Only room moderators can use this bot in group rooms.")
+
+	srv.events <- textEvent("$2", "@alice:example.com", "!new topic")
+	srv.expectSent(t, "created topic")
+
+	srv.events <- messageEvent("$3", "@alice:example.com", map[string]any{
+		"msgtype":        "m.text",
+		"body":           "**hello** link",
+		"format":         "org.matrix.custom.html",
+		"formatted_body": `<strong>hello</strong> <a href="https://example.com">link</a>`,
+	})
+	srv.events <- messageEvent("$4", "@bob:example.com", map[string]any{
+		"msgtype": "m.emote",
+		"body":    "waves",
+	})
+	srv.events <- messageEvent("$5", "@bob:example.com", map[string]any{
+		"msgtype": "m.image",
+		"body":    "photo",
+		"url":     "mxc://example.com/photo",
+	})
+	srv.events <- messageEvent("$6", "@bob:example.com", map[string]any{
+		"msgtype": "m.notice",
+		"body":    "!end",
+	})
+	srv.events <- textEvent("$7", "@alice:example.com", "!end")
+	srv.expectSent(t, "published")
+
+	assert.EqualValues(t, []string{
+		"topic" +
+			"Alice: hello link\n" +
+			"Bob: * Bob waves\n" +
+			"Bob: \n" +
+			"Bob: !end\n",
+	}, pub.Posts())
+
+	srv.mu.Lock()
+	assert.Equal(t, 1, srv.downloaded)
+	srv.mu.Unlock()
+
+	t.Run("Click", func(t *testing.T) {
+		clicked := make(chan struct{}, 1)
+		con := &conversationImpl{bot: b.(*matrixBot), room: testRoomID}
+		_, err := con.SendMessage(ctx, rt.SendMessageOptions{
+			Body: []rt.Span{{Text: "choose"}},
+			Callbacks: [][]rt.MessageCallbackSpec{{
+				{Text: "ok", OnClick: rt.NewOptionalValue(func() error {
+					clicked <- struct{}{}
+					return nil
+				})},
+			}},
+		})
+		require.NoError(t, err)
+
+		var body string
+		select {
+		case body = <-srv.sent:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "button not sent")
+		}
+
+		require.True(t, strings.HasPrefix(body, "choose\nok: send !click "), body)
+		id := strings.TrimPrefix(body, "choose\nok: send !click ")
+		assert.Len(t, id, 2*callbackIDSize)
+
+		srv.events <- textEvent("$8", "@bob:example.com", "!click "+id)
+		select {
+		case <-clicked:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "callback not called")
+		}
+
+		srv.events <- textEvent("$9", "@bob:example.com", "!click 00000000")
+		srv.expectSent(t, "The button has expired.")
+	})
+}
@@ -0,0 +1,232 @@
+package matrix
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/types"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	nethtml "golang.org/x/net/html"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/html"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const matrixToPrefix = "https://matrix.to/#/"
+
+func (c *matrixBot) newMessageFromEvent(mc *messageContext, wf *bot.Workflow) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.timestamp
+
+	content := mc.content
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		c.appendMediaSpan(mc, ret, wf)
+	default:
+		if content.Format == event.FormatHTML && len(content.FormattedBody) != 0 {
+			ret.Spans = parseHTML(content.FormattedBody)
+		} else if len(content.Body) != 0 {
+			ret.Spans = []rt.Span{{Flags: rt.SpanFlag_PlainText, Text: content.Body}}
+		}
+
+		if content.MsgType == event.MsgEmote {
+			// `/me waves` is rendered as `* name waves`
+			ret.Spans = append([]rt.Span{
+				{Flags: rt.SpanFlag_Italic, Text: "* " + mc.author + " "},
+			}, ret.Spans...)
+		}
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	if mc.isPrivate {
+		ret.Flags |= rt.MessageFlag_Private
+	}
+
+	if mc.replyTo != 0 {
+		ret.Flags |= rt.MessageFlag_Reply
+		ret.ReplyTo = mc.replyTo
+	}
+
+	ret.ChatName = mc.chatName
+	ret.ChatLink = matrixToPrefix + string(mc.chat.room)
+	ret.Author = mc.author
+	ret.AuthorLink = matrixToPrefix + string(mc.sender)
+
+	return
+}
+
+// appendMediaSpan adds the media span to the message, and downloads the media in background
+// when the workflow requires
+func (c *matrixBot) appendMediaSpan(mc *messageContext, m *rt.Message, wf *bot.Workflow) {
+	content := mc.content
+
+	var span rt.Span
+	switch content.MsgType {
+	case event.MsgImage:
+		span.Flags = rt.SpanFlag_Image
+	case event.MsgVideo:
+		span.Flags = rt.SpanFlag_Video
+	case event.MsgAudio:
+		span.Flags = rt.SpanFlag_Audio
+	default:
+		span.Flags = rt.SpanFlag_File
+	}
+
+	// body of media message is the filename
+	span.Filename = content.Body
+	if info := content.Info; info != nil {
+		span.ContentType = info.MimeType
+		span.Size = int64(info.Size)
+		span.Duration = time.Duration(info.Duration) * time.Millisecond
+	}
+
+	mxc, err := content.URL.Parse()
+	if err == nil {
+		span.URL = c.client.GetDownloadURL(mxc)
+	}
+
+	m.Spans = append(m.Spans, span)
+
+	if err != nil || !wf.DownloadMedia() {
+		return
+	}
+
+	mediaSpan := &m.Spans[len(m.Spans)-1]
+	con := mc.con
+
+	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
+		mc.logger.D("download file", log.Int64("size", mediaSpan.Size), log.String("content_type", mediaSpan.ContentType))
+
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			return c.download(mxc, cacheWR)
+		})
+		if err != nil {
+			mc.logger.I("failed to download file", log.Error(err))
+			c.sendErrorf(mc, "unable to download: %v", err)
+			return
+		}
+
+		contentType, ext := mediaSpan.ContentType, strings.TrimPrefix(path.Ext(mediaSpan.Filename), ".")
+		if len(contentType) == 0 || len(ext) == 0 {
+			var (
+				buf [32]byte
+				ft  types.Type
+			)
+
+			n, _ := cacheRD.Read(buf[:])
+			_, err = cacheRD.Seek(0, io.SeekStart)
+			if err != nil {
+				mc.logger.E("failed to seek to start", log.Error(err))
+				c.sendErrorf(mc, "bad cache reuse")
+				return
+			}
+
+			ft, err = filetype.Match(buf[:n])
+			if err == nil {
+				if len(contentType) == 0 {
+					contentType = ft.MIME.Value
+				}
+
+				if len(ext) == 0 {
+					ext = ft.Extension
+				}
+			}
+		}
+
+		if len(contentType) != 0 {
+			mediaSpan.ContentType = contentType
+		} else {
+			// provide default mime type for storage driver
+			mediaSpan.ContentType = "application/octet-stream"
+		}
+
+		var filename string
+		if len(mediaSpan.Filename) == 0 { // no filename set
+			filename = cacheRD.ID().String() + "." + ext
+		} else {
+			filename = mediaSpan.Filename
+			if len(path.Ext(filename)) == 0 {
+				filename += "." + ext
+			}
+		}
+
+		mc.logger.D("upload file",
+			log.String("filename", filename),
+			rt.LogCacheID(cacheRD.ID()),
+			log.Int64("size", sz),
+		)
+
+		sout, err := bot.Upload(&con, wf.Storage, filename, sz, cacheRD, mediaSpan.ContentType)
+		if err != nil {
+			mc.logger.I("failed to upload file", log.Error(err))
+			c.sendErrorf(mc, "unable to upload file: %v", err)
+			return
+		}
+
+		mediaSpan.Size = sz
+		mediaSpan.URL = sout.URL
+		mediaSpan.Data = cacheRD
+	})
+}
+
+// download writes content of the mxc uri to w
+func (c *matrixBot) download(mxc id.ContentURI, w io.Writer) error {
+	req, err := http.NewRequestWithContext(c.Context(), http.MethodGet, c.client.GetDownloadURL(mxc), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.client.AccessToken)
+	resp, err := c.client.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %q", resp.Status)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// htmlOptions handles matrix specific elements
+var htmlOptions = html.Options{
+	Mention: func(href string) (string, bool) {
+		if !strings.HasPrefix(href, matrixToPrefix+"@") {
+			return "", false
+		}
+
+		hint, _ := url.PathUnescape(strings.TrimPrefix(href, matrixToPrefix))
+		return hint, true
+	},
+	Ignore: func(n *nethtml.Node) bool {
+		// reply fallback
+		return n.Data == "mx-reply"
+	},
+}
+
+// parseHTML converts formatted_body of the message to spans
+//
+// ref: https://spec.matrix.org/v1.2/client-server-api/#mroommessage-msgtypes
+func parseHTML(formatted string) []rt.Span {
+	return html.Parse(formatted, htmlOptions)
+}
@@ -0,0 +1,77 @@
+package matrix
+
+import (
+	"hash/fnv"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashString generates a stable uint64 id for matrix identifiers (room id, user id
+// and event id), they are all opaque strings
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](s))
+	return h.Sum64()
+}
+
+func userIDOf(userID id.UserID) rt.UserID         { return rt.UserID(hashString(string(userID))) }
+func messageIDOf(eventID id.EventID) rt.MessageID { return rt.MessageID(hashString(string(eventID))) }
+
+// chatIDWrapper is the chat data stored in session requests
+type chatIDWrapper struct {
+	room id.RoomID
+}
+
+func (c chatIDWrapper) ID() rt.ChatID { return rt.ChatID(hashString(string(c.room))) }
+
+type messageContext struct {
+	con conversationImpl
+
+	chat   chatIDWrapper
+	sender id.UserID
+
+	eventID id.EventID
+	msgID   rt.MessageID
+	replyTo rt.MessageID
+
+	// content with reply fallback removed
+	content *event.MessageEventContent
+
+	// author is the display name of the sender
+	author   string
+	chatName string
+
+	isPrivate bool
+
+	timestamp time.Time
+
+	logger log.Interface
+}
+
+// text returns the plain text body of the message
+func (mc *messageContext) text() string { return mc.content.Body }
+
+// roomInfo is the cached room state, invalidated on state changes
+type roomInfo struct {
+	name string
+
+	// members is the display name of joined members
+	members map[id.UserID]string
+}
+
+// isDirect is true when there are only two members in the room (bot and the user)
+func (r *roomInfo) isDirect() bool { return len(r.members) == 2 }
+
+func (r *roomInfo) displayName(userID id.UserID) string {
+	if name := r.members[userID]; len(name) != 0 {
+		return name
+	}
+
+	return string(userID)
+}
@@ -0,0 +1,39 @@
+package matrix
+
+import (
+	"fmt"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func plain(text string) rt.Span { return rt.Span{Flags: rt.SpanFlag_PlainText, Text: text} }
+func bold(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Bold, Text: text} }
+
+// sendText sends spans as a single message
+func (c *matrixBot) sendText(con *conversationImpl, replyTo rt.MessageID, body ...rt.Span) (msgID rt.MessageID, err error) {
+	msgIDs, err := con.SendMessage(c.Context(), rt.SendMessageOptions{
+		ReplyTo: replyTo,
+		Body:    body,
+	})
+	if err != nil {
+		c.Logger().E("failed to send message", log.Error(err))
+		return
+	}
+
+	if len(msgIDs) != 0 {
+		msgID = msgIDs[0]
+	}
+
+	return
+}
+
+// reply sends message to the room where mc comes from as a reply to mc
+func (c *matrixBot) reply(mc *messageContext, body ...rt.Span) {
+	_, _ = c.sendText(&mc.con, mc.msgID, body...)
+}
+
+func (c *matrixBot) sendErrorf(mc *messageContext, format string, args ...any) {
+	c.reply(mc, plain("Internal bot error: "), bold(fmt.Sprintf(format, args...)))
+}
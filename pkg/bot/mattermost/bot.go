@@ -1,10 +1,418 @@
 package mattermost
 
-// TODO
-
 import (
-	_ "github.com/mattermost/mattermost-plugin-api"
-	_ "github.com/mattermost/mattermost-plugin-apps/apps"
-	_ "github.com/mattermost/mattermost-plugin-apps/apps/appclient"
-	_ "github.com/mattermost/mattermost-plugin-apps/utils/httputils"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gorilla/websocket"
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
 )
+
+// maxRequestBodySize limits the size of action requests from mattermost
+const maxRequestBodySize = 1 << 20
+
+var _ bot.Interface = (*mattermostBot)(nil)
+
+type mattermostBot struct {
+	bot.BaseBot
+
+	client    *model.Client4
+	dialer    *websocket.Dialer
+	serverURL string
+	wsURL     string
+	token     string
+
+	actionsPath string
+	// actionsURL is the url of actionsPath, resolved when started
+	actionsURL   string
+	actionSecret string
+	cmdPrefix    string
+
+	// resolved with the token
+	botUserID string
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	history   *bot.MessageHistory[chatIDWrapper, *messageContext]
+	callbacks *bot.CallbackRegistry
+
+	// messages are handled one by one in the order received
+	msgCh chan *messageContext
+
+	cacheMu  *sync.Mutex
+	users    map[string]*userInfo
+	channels map[string]*channelInfo
+	// dmChats are direct message channels of users, used to ask for tokens
+	dmChats map[string]string
+}
+
+// Configure checks the bot token and resolves identity of the bot
+func (c *mattermostBot) Configure() error {
+	me, _, err := c.client.GetMe("")
+	if err != nil {
+		return fmt.Errorf("check bot token: %w", err)
+	}
+
+	c.botUserID = me.Id
+
+	c.Logger().D("logged in", log.String("user_id", me.Id), log.String("username", me.Username))
+	return nil
+}
+
+// Start registers the actions path to the mux and listens to websocket events
+// in background
+func (c *mattermostBot) Start(baseURL string, mux rt.Mux) error {
+	mux.HandleFunc(c.actionsPath, c.handleActions)
+	if len(baseURL) != 0 {
+		c.actionsURL = strings.TrimRight(baseURL, "/") + c.actionsPath
+	}
+
+	c.Logger().D("serving mattermost actions", log.String("actions_url", c.actionsURL))
+
+	go c.handleMessages()
+
+	go func() {
+		for {
+			err := c.listen()
+
+			select {
+			case <-c.Context().Done():
+				return
+			default:
+			}
+
+			c.Logger().I("websocket disconnected, retry later", log.Error(err))
+
+			select {
+			case <-c.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// listen connects to the websocket api and handles events until disconnected
+func (c *mattermostBot) listen() error {
+	ws, err := model.NewWebSocketClient4WithDialer(c.dialer, c.wsURL, c.token)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	ws.Listen()
+
+	c.Logger().V("websocket connected")
+
+	for {
+		select {
+		case <-c.Context().Done():
+			return nil
+		case <-ws.PingTimeoutChannel:
+			return fmt.Errorf("ping timeout")
+		case resp, ok := <-ws.ResponseChannel:
+			if !ok {
+				continue
+			}
+
+			if resp.Error != nil {
+				c.Logger().I("websocket request failed", log.String("status", resp.Status), log.Error(resp.Error))
+			}
+		case evt, ok := <-ws.EventChannel:
+			if !ok {
+				if ws.ListenError != nil {
+					return ws.ListenError
+				}
+
+				return fmt.Errorf("connection closed")
+			}
+
+			if evt.EventType() == model.WebsocketEventPosted {
+				c.onPosted(evt)
+			}
+		}
+	}
+}
+
+// onPosted handles `posted` event, the post is a json string in event data
+func (c *mattermostBot) onPosted(evt *model.WebSocketEvent) {
+	data := evt.GetData()
+	postJSON, _ := data["post"].(string)
+
+	post := &model.Post{}
+	err := json.Unmarshal([]byte(postJSON), post)
+	if err != nil {
+		c.Logger().I("bad post event", log.Error(err))
+		return
+	}
+
+	switch post.Type {
+	case model.PostTypeDefault, model.PostTypeMe:
+	default:
+		// system messages
+		return
+	}
+
+	if post.UserId == c.botUserID || len(post.UserId) == 0 {
+		return
+	}
+
+	channelType, _ := data["channel_type"].(string)
+	c.enqueue(c.newMessageContext(post, channelType == string(model.ChannelTypeDirect)))
+}
+
+func (c *mattermostBot) newMessageContext(post *model.Post, isPrivate bool) *messageContext {
+	mc := &messageContext{
+		con: conversationImpl{
+			bot:     c,
+			channel: post.ChannelId,
+		},
+
+		chat: chatIDWrapper{channel: post.ChannelId},
+		user: post.UserId,
+
+		postID: post.Id,
+		rootID: post.RootId,
+		msgID:  messageIDOf(post.Id),
+
+		text:    post.Message,
+		fileIDs: post.FileIds,
+
+		isPrivate: isPrivate,
+		isMe:      post.Type == model.PostTypeMe,
+		timestamp: time.UnixMilli(post.CreateAt).UTC(),
+	}
+
+	if post.Metadata != nil {
+		mc.files = post.Metadata.Files
+	}
+
+	if len(post.RootId) != 0 {
+		mc.replyTo = messageIDOf(post.RootId)
+	}
+
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.chat.ID()),
+		rt.LogSenderID(userIDOf(mc.user)),
+	)
+
+	return mc
+}
+
+// handleActions handles button clicks of interactive messages
+func (c *mattermostBot) handleActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.PostActionIntegrationRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodySize)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	secret, _ := req.Context[actionContextSecret].(string)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(c.actionSecret)) != 1 {
+		c.Logger().I("invalid action request", log.String("post_id", req.PostId))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// empty response, the post is not updated
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte("{}"))
+
+	actionID, _ := req.Context[actionContextID].(string)
+	if !strings.HasPrefix(actionID, callbackActionIDPrefix) {
+		return
+	}
+
+	onClick, ok := c.callbacks.Find(strings.TrimPrefix(actionID, callbackActionIDPrefix))
+	if !ok {
+		c.Logger().V("callback not found", log.String("action_id", actionID))
+		return
+	}
+
+	go func() {
+		err2 := onClick()
+		if err2 != nil {
+			c.Logger().I("failed to handle button click", log.String("action_id", actionID), log.Error(err2))
+		}
+	}()
+}
+
+func (c *mattermostBot) enqueue(mc *messageContext) {
+	c.history.Add(mc)
+
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+}
+
+func (c *mattermostBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+		}
+	}
+}
+
+func (c *mattermostBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	if !mc.isMe && strings.HasPrefix(mc.text, c.cmdPrefix) {
+		cmd, params, _ := strings.Cut(strings.TrimPrefix(mc.text, c.cmdPrefix), " ")
+		if len(cmd) != 0 {
+			handled, err := c.engine.HandleBotCmd(mc, "/"+cmd, strings.TrimSpace(params))
+			if handled {
+				return err
+			}
+		}
+	}
+
+	// filter private message for input to this bot
+	handled, err := c.engine.HandleInput(mc)
+	if handled {
+		return err
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+func (c *mattermostBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromPost(mc, s.Workflow()))
+
+	return nil
+}
+
+// userInfo returns cached user profile, it fetches the profile when not cached
+func (c *mattermostBot) userInfo(user string) *userInfo {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if info, ok := c.users[user]; ok {
+		return info
+	}
+
+	resp, _, err := c.client.GetUser(user, "")
+	if err != nil {
+		c.Logger().I("failed to get user info", log.String("user", user), log.Error(err))
+
+		// do not cache on error
+		return &userInfo{username: user, name: user}
+	}
+
+	info := &userInfo{
+		username: resp.Username,
+		name:     resp.GetDisplayName(model.ShowNicknameFullName),
+		isAdmin:  resp.IsSystemAdmin(),
+	}
+
+	c.users[user] = info
+	return info
+}
+
+// isAdmin checks whether the sender of mc is a system admin or an admin of
+// the channel
+func (c *mattermostBot) isAdmin(mc *messageContext) bool {
+	if c.userInfo(mc.user).isAdmin {
+		return true
+	}
+
+	member, _, err := c.client.GetChannelMember(mc.chat.channel, mc.user, "")
+	if err != nil {
+		mc.logger.I("failed to get channel member", log.Error(err))
+		return false
+	}
+
+	return member.SchemeAdmin
+}
+
+// channelInfo returns cached channel info, it fetches the channel and its team
+// when not cached
+func (c *mattermostBot) channelInfo(channel string) *channelInfo {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if info, ok := c.channels[channel]; ok {
+		return info
+	}
+
+	ch, _, err := c.client.GetChannel(channel, "")
+	if err != nil {
+		c.Logger().I("failed to get channel info", log.String("channel", channel), log.Error(err))
+
+		// do not cache on error
+		return &channelInfo{name: channel, displayName: channel}
+	}
+
+	info := &channelInfo{
+		name:        ch.Name,
+		displayName: ch.DisplayName,
+	}
+
+	if len(info.displayName) == 0 {
+		info.displayName = ch.Name
+	}
+
+	if len(ch.TeamId) != 0 {
+		team, _, err := c.client.GetTeam(ch.TeamId, "")
+		if err != nil {
+			c.Logger().I("failed to get team info", log.String("team", ch.TeamId), log.Error(err))
+		} else {
+			info.teamName = team.Name
+		}
+	}
+
+	c.channels[channel] = info
+	return info
+}
+
+// privateChannelOf returns the direct message channel with the user
+func (c *mattermostBot) privateChannelOf(user string) (string, error) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if channel, ok := c.dmChats[user]; ok {
+		return channel, nil
+	}
+
+	ch, _, err := c.client.CreateDirectChannel(c.botUserID, user)
+	if err != nil {
+		return "", fmt.Errorf("create direct channel: %w", err)
+	}
+
+	c.dmChats[user] = ch.Id
+	return ch.Id, nil
+}
@@ -0,0 +1,161 @@
+package mattermost
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/tlshelper"
+	"arhat.dev/rs"
+	"github.com/gorilla/websocket"
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "mattermost"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// Config for mattermost bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// ServerURL is the url of the mattermost server (e.g. https://mattermost.example.com)
+	ServerURL string `yaml:"serverURL"`
+
+	// BotToken is the access token of the bot account
+	BotToken string `yaml:"botToken"`
+
+	TLS tlshelper.TLSConfig `yaml:"tls"`
+
+	// ActionsPath is the http path receiving button clicks of interactive messages,
+	// it MUST be reachable from the mattermost server
+	//
+	// defaults to /mattermost/actions
+	ActionsPath string `yaml:"actionsPath"`
+
+	// CommandPrefix is the prefix of bot commands in mattermost messages
+	//
+	// mattermost clients intercept messages starting with `/` as slash commands,
+	// so the workflow command `/new` is triggered by `!new` in messages
+	//
+	// defaults to `!`
+	CommandPrefix string `yaml:"commandPrefix"`
+
+	// CallbackTTL is how long buttons with callbacks are clickable
+	//
+	// defaults to 24h
+	CallbackTTL time.Duration `yaml:"callbackTTL"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	if len(c.ServerURL) == 0 {
+		return nil, fmt.Errorf("serverURL is required")
+	}
+
+	if len(c.BotToken) == 0 {
+		return nil, fmt.Errorf("botToken is required")
+	}
+
+	serverURL := strings.TrimRight(c.ServerURL, "/")
+
+	var wsURL string
+	switch {
+	case strings.HasPrefix(serverURL, "https://"):
+		wsURL = "wss://" + strings.TrimPrefix(serverURL, "https://")
+	case strings.HasPrefix(serverURL, "http://"):
+		wsURL = "ws://" + strings.TrimPrefix(serverURL, "http://")
+	default:
+		return nil, fmt.Errorf("invalid serverURL %q: unsupported scheme", c.ServerURL)
+	}
+
+	tlsConfig, err := c.TLS.GetTLSConfig(false)
+	if err != nil {
+		return nil, fmt.Errorf("create tls config: %w", err)
+	}
+
+	client := model.NewAPIv4Client(serverURL)
+	client.SetToken(c.BotToken)
+	if tlsConfig != nil {
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	// secret in the context of interactive buttons to verify action requests
+	var secret [16]byte
+	_, err = rand.Read(secret[:])
+	if err != nil {
+		return nil, fmt.Errorf("generate action secret: %w", err)
+	}
+
+	actionsPath := c.ActionsPath
+	if len(actionsPath) == 0 {
+		actionsPath = "/mattermost/actions"
+	}
+
+	cmdPrefix := c.CommandPrefix
+	if len(cmdPrefix) == 0 {
+		cmdPrefix = "!"
+	}
+
+	mb := &mattermostBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		client: client,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 30 * time.Second,
+			TLSClientConfig:  tlsConfig,
+		},
+		serverURL: serverURL,
+		wsURL:     wsURL,
+		token:     c.BotToken,
+
+		actionsPath:  actionsPath,
+		actionSecret: hex.EncodeToString(secret[:]),
+		cmdPrefix:    cmdPrefix,
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		callbacks: bot.NewCallbackRegistry(rtCtx.Context(), c.CallbackTTL, 0),
+
+		msgCh: make(chan *messageContext, 64),
+
+		cacheMu:  &sync.Mutex{},
+		users:    make(map[string]*userInfo),
+		channels: make(map[string]*channelInfo),
+		dmChats:  make(map[string]string),
+	}
+
+	mb.history = bot.NewMessageHistory[chatIDWrapper, *messageContext](0)
+	mb.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: mb}, mb.sessions, &mb.wfSet, engine.Options{
+		CmdPrefix:        cmdPrefix,
+		AdminOnly:        "Only system or channel admins can use this bot in channel.",
+		GroupChat:        "channel",
+		CheckPrivateChat: "Please check direct messages from me.",
+	})
+
+	return mb, nil
+}
@@ -0,0 +1,131 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const (
+	// maxMessageLength is the max characters of post message, mattermost
+	// limits it to 16383 characters by default
+	maxMessageLength = 16000
+
+	// maxActionNameLength is the max characters of text in a button
+	maxActionNameLength = 80
+
+	// callbackActionIDPrefix is the prefix of ids of OnClick actions, mattermost
+	// only accepts alphanumeric action ids
+	callbackActionIDPrefix = "mbot"
+)
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *mattermostBot
+
+	channel string
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// message body is sent in markdown, long text is split into multiple posts,
+// url callbacks are appended as links and OnClick callbacks are sent as
+// interactive buttons in the last post
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) (_ []rt.MessageID, err error) {
+	text := markdown.Format(opts.Body)
+
+	var (
+		links   []string
+		actions []*model.PostAction
+	)
+
+	for _, row := range opts.Callbacks {
+		for _, cb := range row {
+			label := cb.Text
+			if r := []rune(label); len(r) > maxActionNameLength {
+				label = string(r[:maxActionNameLength])
+			}
+
+			switch {
+			case !cb.URL.IsNil():
+				links = append(links, "["+markdown.Escape(label)+"]("+cb.URL.Get()+")")
+			case !cb.OnClick.IsNil() && len(c.bot.actionsURL) != 0:
+				var id string
+				id, err = c.bot.callbacks.Add(cb.OnClick.Get())
+				if err != nil {
+					return nil, fmt.Errorf("add button callback: %w", err)
+				}
+
+				actionID := callbackActionIDPrefix + id
+				actions = append(actions, &model.PostAction{
+					Id:   actionID,
+					Type: model.PostActionTypeButton,
+					Name: label,
+					Integration: &model.PostActionIntegration{
+						URL: c.bot.actionsURL,
+						Context: map[string]any{
+							actionContextID:     actionID,
+							actionContextSecret: c.bot.actionSecret,
+						},
+					},
+				})
+			}
+		}
+	}
+
+	if len(links) != 0 {
+		text += "\n\n" + strings.Join(links, " | ")
+	}
+
+	var rootID string
+	if opts.ReplyTo != 0 {
+		if mc, ok := c.bot.history.Find(chatIDWrapper{channel: c.channel}.ID(), opts.ReplyTo); ok {
+			rootID = mc.rootID
+			if len(rootID) == 0 {
+				rootID = mc.postID
+			}
+		}
+	}
+
+	parts := bot.SplitText(text, maxMessageLength)
+	if len(parts) == 0 {
+		parts = []string{""}
+	}
+
+	var ret []rt.MessageID
+	for i, part := range parts {
+		post := &model.Post{
+			ChannelId: c.channel,
+			RootId:    rootID,
+			Message:   part,
+		}
+
+		// NOTE: opts.NoWebPreview is ignored, link previews are controlled by
+		// server and user settings
+
+		if i == len(parts)-1 && len(actions) != 0 {
+			post.AddProp("attachments", []*model.SlackAttachment{{Actions: actions}})
+		}
+
+		post, _, err = c.bot.client.CreatePost(post)
+		if err != nil {
+			return ret, err
+		}
+
+		ret = append(ret, messageIDOf(post.Id))
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,350 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const testToken = "bot-token"
+
+type postedMessage struct {
+	ChannelID string `json:"channel_id"`
+	RootID    string `json:"root_id"`
+	Message   string `json:"message"`
+	Props     struct {
+		Attachments []struct {
+			Actions []struct {
+				ID          string `json:"id"`
+				Name        string `json:"name"`
+				Integration struct {
+					URL     string         `json:"url"`
+					Context map[string]any `json:"context"`
+				} `json:"integration"`
+			} `json:"actions"`
+		} `json:"attachments"`
+	} `json:"props"`
+}
+
+// fakeServer is a mattermost server stand-in serving the subset of rest and
+// websocket api used by the bot
+type fakeServer struct {
+	*httptest.Server
+
+	seq int64
+
+	// events to be sent through websocket
+	events chan map[string]any
+
+	// posts created by the bot
+	posted chan postedMessage
+
+	mu         sync.Mutex
+	downloaded int
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	s := &fakeServer{
+		events: make(chan map[string]any, 16),
+		posted: make(chan postedMessage, 16),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// nolint:gocyclo
+func (s *fakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v4")
+	if path == "/websocket" {
+		s.serveWebsocket(w, r)
+		return
+	}
+
+	if !strings.EqualFold(r.Header.Get("Authorization"), "Bearer "+testToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		s.reply(w, map[string]any{"id": "api.context.session_expired.app_error", "status_code": 401})
+		return
+	}
+
+	users := map[string]any{
+		"me":    map[string]any{"id": "bot", "username": "mbot"},
+		"alice": map[string]any{"id": "alice", "username": "alice", "nickname": "Alice", "roles": "system_user system_admin"},
+		"bob":   map[string]any{"id": "bob", "username": "bob", "first_name": "Bob", "roles": "system_user"},
+	}
+
+	switch {
+	case strings.HasPrefix(path, "/users/"):
+		user, ok := users[strings.TrimPrefix(path, "/users/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		s.reply(w, user)
+	case path == "/channels/town/members/bob":
+		s.reply(w, map[string]any{"channel_id": "town", "user_id": "bob", "scheme_admin": false})
+	case path == "/channels/town":
+		s.reply(w, map[string]any{"id": "town", "name": "town-square", "display_name": "Town Square", "team_id": "team1", "type": "O"})
+	case path == "/teams/team1":
+		s.reply(w, map[string]any{"id": "team1", "name": "test"})
+	case path == "/posts" && r.Method == http.MethodPost:
+		var post postedMessage
+		_ = json.NewDecoder(r.Body).Decode(&post)
+		s.posted <- post
+
+		s.reply(w, map[string]any{
+			"id":         fmt.Sprintf("botpost%d", atomic.AddInt64(&s.seq, 1)),
+			"channel_id": post.ChannelID,
+			"root_id":    post.RootID,
+			"message":    post.Message,
+		})
+	case path == "/posts/oldroot":
+		s.reply(w, map[string]any{"id": "oldroot", "channel_id": "town", "user_id": "alice", "message": "old root", "create_at": 1000})
+	case path == "/files/file2/info":
+		s.reply(w, map[string]any{"id": "file2", "name": "notes.txt", "mime_type": "text/plain", "size": 5})
+	case path == "/files/file1" || path == "/files/file2":
+		s.mu.Lock()
+		s.downloaded++
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeServer) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	var challenge struct {
+		Seq    int64 `json:"seq"`
+		Action string
+		Data   map[string]any
+	}
+	err = conn.ReadJSON(&challenge)
+	if err != nil || challenge.Action != "authentication_challenge" || challenge.Data["token"] != testToken {
+		return
+	}
+
+	err = conn.WriteJSON(map[string]any{"status": "OK", "seq_reply": challenge.Seq})
+	if err != nil {
+		return
+	}
+
+	// discard requests from the client
+	go func() {
+		for {
+			if _, _, err2 := conn.ReadMessage(); err2 != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt := <-s.events:
+			if conn.WriteJSON(evt) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *fakeServer) reply(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (s *fakeServer) expectPosted(t *testing.T, expected string) postedMessage {
+	select {
+	case msg := <-s.posted:
+		assert.Equal(t, expected, msg.Message)
+		return msg
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timeout waiting for post", expected)
+		return postedMessage{}
+	}
+}
+
+func (s *fakeServer) sendPost(t *testing.T, post map[string]any, channelType string) {
+	data, err := json.Marshal(post)
+	require.NoError(t, err)
+
+	s.events <- map[string]any{
+		"event": "posted",
+		"data": map[string]any{
+			"post":         string(data),
+			"channel_type": channelType,
+		},
+		"seq": atomic.AddInt64(&s.seq, 1),
+	}
+}
+
+func newPost(id, user, message string) map[string]any {
+	return map[string]any{
+		"id":         id,
+		"channel_id": "town",
+		"user_id":    user,
+		"message":    message,
+		"create_at":  time.Now().UnixMilli(),
+	}
+}
+
+func TestBot(t *testing.T) {
+	srv := newFakeServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, true),
+
+		ServerURL: srv.URL,
+		BotToken:  testToken,
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	require.NoError(t, b.Configure())
+	require.NoError(t, b.Start("http://mbot.example.com/", mux))
+
+	t.Run("Session", func(t *testing.T) {
+		srv.sendPost(t, newPost("p1", "bob", "!new topic"), "O")
+		srv.expectPosted(t, "Only system or channel admins can use this bot in channel.")
+
+		srv.sendPost(t, newPost("p2", "alice", "!new topic"), "O")
+		srv.expectPosted(t, "created topic")
+
+		srv.sendPost(t, newPost("p3", "alice", "**hello** [link](https://example.com) @bob"), "O")
+
+		filePost := newPost("p4", "bob", "")
+		filePost["file_ids"] = []string{"file1", "file2"}
+		filePost["metadata"] = map[string]any{
+			"files": []map[string]any{{"id": "file1", "name": "photo.png", "mime_type": "image/png", "size": 8}},
+		}
+		srv.sendPost(t, filePost, "O")
+
+		mePost := newPost("p5", "bob", "waves")
+		mePost["type"] = "me"
+		srv.sendPost(t, mePost, "O")
+
+		srv.sendPost(t, newPost("p6", "bot", "!end"), "O")
+
+		joinPost := newPost("p7", "bob", "bob joined the channel.")
+		joinPost["type"] = "system_join_channel"
+		srv.sendPost(t, joinPost, "O")
+
+		threadPost := newPost("p8", "bob", "in thread")
+		threadPost["root_id"] = "p3"
+		srv.sendPost(t, threadPost, "O")
+
+		includePost := newPost("p9", "alice", "!include")
+		includePost["root_id"] = "oldroot"
+		srv.sendPost(t, includePost, "O")
+		msg := srv.expectPosted(t, "Included.")
+		assert.Equal(t, "oldroot", msg.RootID)
+		assert.Equal(t, "town", msg.ChannelID)
+
+		srv.sendPost(t, newPost("p10", "alice", "!end"), "O")
+		srv.expectPosted(t, "published")
+
+		assert.EqualValues(t, []string{
+			"topic" +
+				"Alice: hello link @bob\n" +
+				"Bob: \n" +
+				"Bob: * Bob waves\n" +
+				"Bob: in thread\n" +
+				"Alice: old root\n",
+		}, pub.Posts())
+
+		srv.mu.Lock()
+		assert.Equal(t, 2, srv.downloaded)
+		srv.mu.Unlock()
+	})
+
+	t.Run("Callbacks", func(t *testing.T) {
+		clicked := make(chan struct{})
+		con := &conversationImpl{bot: b.(*mattermostBot), channel: "town"}
+		_, err := con.SendMessage(ctx, rt.SendMessageOptions{
+			Body: []rt.Span{{Text: "choose"}},
+			Callbacks: [][]rt.MessageCallbackSpec{{
+				{Text: "open", URL: rt.NewOptionalValue("https://example.com")},
+				{Text: "click", OnClick: rt.NewOptionalValue(func() error {
+					close(clicked)
+					return nil
+				})},
+			}},
+		})
+		require.NoError(t, err)
+
+		msg := srv.expectPosted(t, "choose\n\n[open](https://example.com)")
+		require.Len(t, msg.Props.Attachments, 1)
+		require.Len(t, msg.Props.Attachments[0].Actions, 1)
+
+		action := msg.Props.Attachments[0].Actions[0]
+		assert.Equal(t, "click", action.Name)
+		assert.Equal(t, "http://mbot.example.com/mattermost/actions", action.Integration.URL)
+
+		badCtx := map[string]any{}
+		for k, v := range action.Integration.Context {
+			badCtx[k] = v
+		}
+		badCtx[actionContextSecret] = "invalid"
+
+		for _, test := range []struct {
+			context  map[string]any
+			expected int
+		}{
+			{badCtx, http.StatusUnauthorized},
+			{action.Integration.Context, http.StatusOK},
+		} {
+			body, err := json.Marshal(map[string]any{
+				"user_id": "bob",
+				"post_id": "botpost",
+				"context": test.context,
+			})
+			require.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/mattermost/actions", strings.NewReader(string(body))))
+			assert.Equal(t, test.expected, rec.Code)
+		}
+
+		select {
+		case <-clicked:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "button callback not called")
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package mattermost
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"arhat.dev/pkg/log"
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/types"
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func (c *mattermostBot) newMessageFromPost(mc *messageContext, wf *bot.Workflow) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.timestamp
+	ret.Spans = markdown.Parse(mc.text, markdown.Options{Mentions: true, HashTags: true})
+
+	author := c.userInfo(mc.user).name
+	if mc.isMe {
+		// `/me waves` is rendered as `* name waves`
+		ret.Spans = append([]rt.Span{
+			{Flags: rt.SpanFlag_Italic, Text: "* " + author + " "},
+		}, ret.Spans...)
+	}
+
+	for _, f := range c.fileInfos(mc) {
+		c.appendFileSpan(mc, ret, f, wf)
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	if mc.isPrivate {
+		ret.Flags |= rt.MessageFlag_Private
+	}
+
+	if mc.replyTo != 0 {
+		ret.Flags |= rt.MessageFlag_Reply
+		ret.ReplyTo = mc.replyTo
+	}
+
+	ch := c.channelInfo(mc.chat.channel)
+	ret.ChatName = ch.displayName
+	if len(ch.teamName) != 0 {
+		ret.ChatLink = c.serverURL + "/" + ch.teamName + "/channels/" + ch.name
+		ret.MessageLink = c.serverURL + "/" + ch.teamName + "/pl/" + mc.postID
+	} else {
+		ret.MessageLink = c.serverURL + "/_redirect/pl/" + mc.postID
+	}
+
+	ret.Author = author
+
+	return
+}
+
+// fileInfos returns infos of files attached to the post, missing ones are fetched
+// from the server
+func (c *mattermostBot) fileInfos(mc *messageContext) (ret []*model.FileInfo) {
+	known := make(map[string]*model.FileInfo, len(mc.files))
+	for _, f := range mc.files {
+		known[f.Id] = f
+	}
+
+	for _, id := range mc.fileIDs {
+		if f, ok := known[id]; ok {
+			ret = append(ret, f)
+			continue
+		}
+
+		f, _, err := c.client.GetFileInfo(id)
+		if err != nil {
+			mc.logger.I("failed to get file info", log.String("file_id", id), log.Error(err))
+			f = &model.FileInfo{Id: id}
+		}
+
+		ret = append(ret, f)
+	}
+
+	return
+}
+
+// appendFileSpan adds the file span to the message, and downloads the file in background
+// when the workflow requires
+func (c *mattermostBot) appendFileSpan(mc *messageContext, m *rt.Message, f *model.FileInfo, wf *bot.Workflow) {
+	span := rt.Span{
+		URL: c.client.APIURL + "/files/" + f.Id,
+		SpanMediaOptions: rt.SpanMediaOptions{
+			Filename:    f.Name,
+			Size:        f.Size,
+			ContentType: f.MimeType,
+		},
+	}
+
+	switch mimeType := f.MimeType; {
+	case strings.HasPrefix(mimeType, "image/"):
+		span.Flags = rt.SpanFlag_Image
+	case strings.HasPrefix(mimeType, "video/"):
+		span.Flags = rt.SpanFlag_Video
+	case strings.HasPrefix(mimeType, "audio/"):
+		span.Flags = rt.SpanFlag_Audio
+	default:
+		span.Flags = rt.SpanFlag_File
+	}
+
+	m.Spans = append(m.Spans, span)
+
+	if !wf.DownloadMedia() {
+		return
+	}
+
+	mediaSpan := &m.Spans[len(m.Spans)-1]
+	con := mc.con
+	fileID := f.Id
+
+	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
+		mc.logger.D("download file", log.Int64("size", mediaSpan.Size), log.String("content_type", mediaSpan.ContentType))
+
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			resp, err2 := c.client.DoAPIGet("/files/"+fileID, "")
+			if err2 != nil {
+				return err2
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			_, err2 = io.Copy(cacheWR, resp.Body)
+			return err2
+		})
+		if err != nil {
+			mc.logger.I("failed to download file", log.Error(err))
+			c.sendErrorf(mc, "unable to download: %v", err)
+			return
+		}
+
+		contentType, ext := mediaSpan.ContentType, strings.TrimPrefix(path.Ext(mediaSpan.Filename), ".")
+		if len(contentType) == 0 || len(ext) == 0 {
+			var (
+				buf [32]byte
+				ft  types.Type
+			)
+
+			n, _ := cacheRD.Read(buf[:])
+			_, err = cacheRD.Seek(0, io.SeekStart)
+			if err != nil {
+				mc.logger.E("failed to seek to start", log.Error(err))
+				c.sendErrorf(mc, "bad cache reuse")
+				return
+			}
+
+			ft, err = filetype.Match(buf[:n])
+			if err == nil {
+				if len(contentType) == 0 {
+					contentType = ft.MIME.Value
+				}
+
+				if len(ext) == 0 {
+					ext = ft.Extension
+				}
+			}
+		}
+
+		if len(contentType) != 0 {
+			mediaSpan.ContentType = contentType
+		} else {
+			// provide default mime type for storage driver
+			mediaSpan.ContentType = "application/octet-stream"
+		}
+
+		var filename string
+		if len(mediaSpan.Filename) == 0 { // no filename set
+			filename = cacheRD.ID().String() + "." + ext
+		} else {
+			filename = mediaSpan.Filename
+			if len(path.Ext(filename)) == 0 {
+				filename += "." + ext
+			}
+		}
+
+		mc.logger.D("upload file",
+			log.String("filename", filename),
+			rt.LogCacheID(cacheRD.ID()),
+			log.Int64("size", sz),
+		)
+
+		sout, err := bot.Upload(&con, wf.Storage, filename, sz, cacheRD, mediaSpan.ContentType)
+		if err != nil {
+			mc.logger.I("failed to upload file", log.Error(err))
+			c.sendErrorf(mc, "unable to upload file: %v", err)
+			return
+		}
+
+		mediaSpan.Size = sz
+		mediaSpan.URL = sout.URL
+		mediaSpan.Data = cacheRD
+	})
+}
@@ -0,0 +1,78 @@
+package mattermost
+
+import (
+	"hash/fnv"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+	"github.com/mattermost/mattermost-server/v6/model"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashString generates a stable uint64 id for mattermost ids (26 chars base32)
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](s))
+	return h.Sum64()
+}
+
+func userIDOf(user string) rt.UserID         { return rt.UserID(hashString(user)) }
+func messageIDOf(postID string) rt.MessageID { return rt.MessageID(hashString(postID)) }
+
+// chatIDWrapper is the chat data stored in session requests
+type chatIDWrapper struct {
+	channel string
+}
+
+func (c chatIDWrapper) ID() rt.ChatID { return rt.ChatID(hashString(c.channel)) }
+
+type messageContext struct {
+	con conversationImpl
+
+	chat chatIDWrapper
+	user string
+
+	postID string
+	// rootID is the id of the thread root post, empty when not in a thread
+	rootID string
+
+	msgID   rt.MessageID
+	replyTo rt.MessageID
+
+	// text in markdown
+	text string
+
+	fileIDs []string
+	// files are file infos in post metadata, may be missing for some servers
+	files []*model.FileInfo
+
+	isPrivate bool
+	isMe      bool
+
+	timestamp time.Time
+
+	logger log.Interface
+}
+
+// userInfo is the cached user profile
+type userInfo struct {
+	username string
+	name     string
+	isAdmin  bool
+}
+
+// channelInfo is the cached channel info
+type channelInfo struct {
+	name        string
+	displayName string
+	// teamName is empty for direct and group channels
+	teamName string
+}
+
+// keys in the context of interactive button integrations
+const (
+	actionContextID     = "mbot_action"
+	actionContextSecret = "mbot_secret"
+)
@@ -1,9 +1,429 @@
 package slack
 
-// TODO
-
 import (
-	_ "github.com/slack-go/slack"
-	_ "github.com/slack-go/slack/slackevents"
-	_ "github.com/slack-go/slack/socketmode"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/log"
+	api "github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
 )
+
+// maxRequestBodySize limits the size of requests from slack
+const maxRequestBodySize = 1 << 20
+
+var _ bot.Interface = (*slackBot)(nil)
+
+type slackBot struct {
+	bot.BaseBot
+
+	client        *api.Client
+	signingSecret string
+
+	eventsPath       string
+	commandsPath     string
+	interactionsPath string
+	cmdPrefix        string
+
+	// resolved with auth.test
+	botUserID string
+	botID     string
+	teamURL   string
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	history   *bot.MessageHistory[chatIDWrapper, *messageContext]
+	callbacks *bot.CallbackRegistry
+
+	// messages are handled one by one in the order received
+	msgCh chan *messageContext
+
+	cacheMu  *sync.Mutex
+	users    map[string]*userInfo
+	channels map[string]string
+	// dmChats are direct message channels of users, used to ask for tokens
+	dmChats map[string]string
+}
+
+// Configure checks the bot token and resolves identity of the bot
+func (c *slackBot) Configure() error {
+	resp, err := c.client.AuthTestContext(c.Context())
+	if err != nil {
+		return fmt.Errorf("check bot token: %w", err)
+	}
+
+	c.botUserID = resp.UserID
+	c.botID = resp.BotID
+	c.teamURL = resp.URL
+
+	c.Logger().D("logged in", log.String("user_id", resp.UserID), log.String("team", resp.Team))
+	return nil
+}
+
+// Start registers request urls of the slack app to the mux
+func (c *slackBot) Start(baseURL string, mux rt.Mux) error {
+	mux.HandleFunc(c.eventsPath, c.handleEvents)
+	mux.HandleFunc(c.commandsPath, c.handleCommands)
+	mux.HandleFunc(c.interactionsPath, c.handleInteractions)
+
+	c.Logger().D("serving slack requests",
+		log.String("events_url", baseURL+c.eventsPath),
+		log.String("commands_url", baseURL+c.commandsPath),
+		log.String("interactions_url", baseURL+c.interactionsPath),
+	)
+
+	go c.handleMessages()
+
+	return nil
+}
+
+// readVerifiedBody reads request body and verifies the request signature
+func (c *slackBot) readVerifiedBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	sv, err := api.NewSecretsVerifier(r.Header, c.signingSecret)
+	if err == nil {
+		_, _ = sv.Write(body)
+		err = sv.Ensure()
+	}
+
+	if err != nil {
+		c.Logger().I("invalid request signature", log.String("path", r.URL.Path), log.Error(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return body, true
+}
+
+func (c *slackBot) handleEvents(w http.ResponseWriter, r *http.Request) {
+	body, ok := c.readVerifiedBody(w, r)
+	if !ok {
+		return
+	}
+
+	evt, err := slackevents.ParseEvent(json.RawMessage(body), slackevents.OptionNoVerifyToken())
+	if err != nil {
+		c.Logger().I("bad event", log.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch evt.Type {
+	case slackevents.URLVerification:
+		var challenge slackevents.ChallengeResponse
+		err = json.Unmarshal(body, &challenge)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(challenge.Challenge))
+		return
+	case slackevents.CallbackEvent:
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// always acknowledge in time, slack retries when there is no response in 3s
+	w.WriteHeader(http.StatusOK)
+
+	if len(r.Header.Get("X-Slack-Retry-Num")) != 0 {
+		// events are handled asynchronously, retried ones were already received
+		return
+	}
+
+	msg, ok := evt.InnerEvent.Data.(*slackevents.MessageEvent)
+	if !ok {
+		return
+	}
+
+	c.onMessage(msg)
+}
+
+func (c *slackBot) onMessage(msg *slackevents.MessageEvent) {
+	switch msg.SubType {
+	case "", "file_share", "thread_broadcast", "me_message":
+	default:
+		// edits, deletions and channel notifications
+		return
+	}
+
+	if msg.User == c.botUserID || (len(msg.BotID) != 0 && msg.BotID == c.botID) || len(msg.User) == 0 {
+		return
+	}
+
+	mc := &messageContext{
+		chat: chatIDWrapper{channel: msg.Channel},
+		user: msg.User,
+
+		ts:       msg.TimeStamp,
+		threadTS: msg.ThreadTimeStamp,
+		msgID:    messageIDOf(msg.TimeStamp),
+
+		text:  msg.Text,
+		files: msg.Files,
+
+		isPrivate: msg.ChannelType == "im",
+		isMe:      msg.SubType == "me_message",
+		timestamp: parseTimestamp(msg.TimeStamp),
+	}
+
+	if len(msg.ThreadTimeStamp) != 0 && msg.ThreadTimeStamp != msg.TimeStamp {
+		mc.replyTo = messageIDOf(msg.ThreadTimeStamp)
+	}
+
+	c.enqueue(mc)
+}
+
+func (c *slackBot) handleCommands(w http.ResponseWriter, r *http.Request) {
+	body, ok := c.readVerifiedBody(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	cmd, err := api.SlashCommandParse(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// empty response, replies are sent as normal messages
+	w.WriteHeader(http.StatusOK)
+
+	text := strings.TrimSpace(cmd.Command + " " + cmd.Text)
+	c.enqueue(&messageContext{
+		chat: chatIDWrapper{channel: cmd.ChannelID},
+		user: cmd.UserID,
+
+		// slash commands are not messages, commands text is prefixed so that
+		// it will be handled as botcmd
+		text: c.cmdPrefix + strings.TrimPrefix(text, "/"),
+
+		isPrivate: isDirectChannel(cmd.ChannelID),
+		timestamp: time.Now().UTC(),
+	})
+}
+
+func (c *slackBot) handleInteractions(w http.ResponseWriter, r *http.Request) {
+	body, ok := c.readVerifiedBody(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var ic api.InteractionCallback
+	err = json.Unmarshal([]byte(r.PostForm.Get("payload")), &ic)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if ic.Type != api.InteractionTypeBlockActions {
+		return
+	}
+
+	for _, action := range ic.ActionCallback.BlockActions {
+		if !strings.HasPrefix(action.ActionID, callbackActionIDPrefix) {
+			continue
+		}
+
+		onClick, ok := c.callbacks.Find(strings.TrimPrefix(action.ActionID, callbackActionIDPrefix))
+		if !ok {
+			c.Logger().V("callback not found", log.String("action_id", action.ActionID))
+			continue
+		}
+
+		go func(actionID string) {
+			err2 := onClick()
+			if err2 != nil {
+				c.Logger().I("failed to handle button click", log.String("action_id", actionID), log.Error(err2))
+			}
+		}(action.ActionID)
+	}
+}
+
+func (c *slackBot) enqueue(mc *messageContext) {
+	mc.con = conversationImpl{
+		bot:     c,
+		channel: mc.chat.channel,
+	}
+
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.chat.ID()),
+		rt.LogSenderID(userIDOf(mc.user)),
+	)
+
+	if len(mc.ts) != 0 {
+		c.history.Add(mc)
+	}
+
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+}
+
+func (c *slackBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+		}
+	}
+}
+
+func (c *slackBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	if !mc.isMe && strings.HasPrefix(mc.text, c.cmdPrefix) {
+		cmd, params, _ := strings.Cut(strings.TrimPrefix(mc.text, c.cmdPrefix), " ")
+		if len(cmd) != 0 {
+			handled, err := c.engine.HandleBotCmd(mc, "/"+cmd, strings.TrimSpace(params))
+			if handled || len(mc.ts) == 0 {
+				return err
+			}
+		}
+	}
+
+	if len(mc.ts) == 0 {
+		// unknown slash command
+		return nil
+	}
+
+	// filter private message for input to this bot
+	handled, err := c.engine.HandleInput(mc)
+	if handled {
+		return err
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+func (c *slackBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromSlackMessage(mc, s.Workflow()))
+
+	return nil
+}
+
+// userInfo returns cached user profile, it fetches the profile when not cached
+func (c *slackBot) userInfo(user string) *userInfo {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if info, ok := c.users[user]; ok {
+		return info
+	}
+
+	resp, err := c.client.GetUserInfoContext(c.Context(), user)
+	if err != nil {
+		c.Logger().I("failed to get user info", log.String("user", user), log.Error(err))
+
+		// do not cache on error
+		return &userInfo{name: user}
+	}
+
+	info := &userInfo{
+		name:    resp.Profile.DisplayName,
+		isAdmin: resp.IsAdmin || resp.IsOwner || resp.IsPrimaryOwner,
+	}
+
+	if len(info.name) == 0 {
+		info.name = resp.RealName
+	}
+
+	if len(info.name) == 0 {
+		info.name = resp.Name
+	}
+
+	c.users[user] = info
+	return info
+}
+
+// channelName returns cached name of the channel
+func (c *slackBot) channelName(channel string) string {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if name, ok := c.channels[channel]; ok {
+		return name
+	}
+
+	resp, err := c.client.GetConversationInfoContext(c.Context(), channel, false)
+	if err != nil {
+		c.Logger().I("failed to get channel info", log.String("channel", channel), log.Error(err))
+		return channel
+	}
+
+	name := resp.Name
+	if len(name) == 0 {
+		name = channel
+	}
+
+	c.channels[channel] = name
+	return name
+}
+
+// privateChannelOf returns the direct message channel with the user
+func (c *slackBot) privateChannelOf(user string) (string, error) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if channel, ok := c.dmChats[user]; ok {
+		return channel, nil
+	}
+
+	resp, _, _, err := c.client.OpenConversationContext(c.Context(), &api.OpenConversationParameters{
+		Users: []string{user},
+	})
+	if err != nil {
+		return "", fmt.Errorf("open direct message: %w", err)
+	}
+
+	c.dmChats[user] = resp.ID
+	return resp.ID, nil
+}
@@ -0,0 +1,138 @@
+package slack
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/rs"
+	api "github.com/slack-go/slack"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "slack"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// Config for slack bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// BotToken is the bot user oauth token (xoxb-...)
+	BotToken string `yaml:"botToken"`
+
+	// SigningSecret of the slack app, used to verify requests from slack
+	SigningSecret string `yaml:"signingSecret"`
+
+	// APIURL is the base url of slack web api
+	//
+	// defaults to https://slack.com/api/
+	APIURL string `yaml:"apiURL"`
+
+	// EventsPath is the http path of the Events API request url
+	//
+	// defaults to /slack/events
+	EventsPath string `yaml:"eventsPath"`
+
+	// CommandsPath is the http path of the slash commands request url
+	//
+	// defaults to /slack/commands
+	CommandsPath string `yaml:"commandsPath"`
+
+	// InteractionsPath is the http path of the interactivity request url
+	//
+	// defaults to /slack/interactions
+	InteractionsPath string `yaml:"interactionsPath"`
+
+	// CommandPrefix is the prefix of bot commands in slack messages
+	//
+	// slack clients intercept messages starting with `/` as slash commands,
+	// so the workflow command `/new` can be triggered by `!new` in messages,
+	// which is required for commands used in threads (e.g. `/include`)
+	//
+	// defaults to `!`
+	CommandPrefix string `yaml:"commandPrefix"`
+
+	// CallbackTTL is how long buttons with callbacks are clickable
+	//
+	// defaults to 24h
+	CallbackTTL time.Duration `yaml:"callbackTTL"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	if len(c.BotToken) == 0 {
+		return nil, fmt.Errorf("botToken is required")
+	}
+
+	if len(c.SigningSecret) == 0 {
+		return nil, fmt.Errorf("signingSecret is required")
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	apiURL := c.APIURL
+	if len(apiURL) == 0 {
+		apiURL = api.APIURL
+	} else if !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+
+	cmdPrefix := c.CommandPrefix
+	if len(cmdPrefix) == 0 {
+		cmdPrefix = "!"
+	}
+
+	sb := &slackBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		client:        api.New(c.BotToken, api.OptionAPIURL(apiURL)),
+		signingSecret: c.SigningSecret,
+
+		eventsPath:       defaultString(c.EventsPath, "/slack/events"),
+		commandsPath:     defaultString(c.CommandsPath, "/slack/commands"),
+		interactionsPath: defaultString(c.InteractionsPath, "/slack/interactions"),
+		cmdPrefix:        cmdPrefix,
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		callbacks: bot.NewCallbackRegistry(rtCtx.Context(), c.CallbackTTL, 0),
+
+		msgCh: make(chan *messageContext, 64),
+
+		cacheMu:  &sync.Mutex{},
+		users:    make(map[string]*userInfo),
+		channels: make(map[string]string),
+		dmChats:  make(map[string]string),
+	}
+
+	sb.history = bot.NewMessageHistory[chatIDWrapper, *messageContext](0)
+	sb.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: sb}, sb.sessions, &sb.wfSet, engine.Options{
+		CmdPrefix:        cmdPrefix,
+		AdminOnly:        "Only workspace admins can use this bot in channel.",
+		GroupChat:        "channel",
+		CheckPrivateChat: "Please check direct messages from me.",
+	})
+
+	return sb, nil
+}
+
+func defaultString(s, def string) string {
+	if len(s) == 0 {
+		return def
+	}
+
+	return s
+}
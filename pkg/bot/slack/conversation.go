@@ -0,0 +1,119 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	api "github.com/slack-go/slack"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const (
+	// maxSectionTextLength is the max length of text in a section block
+	maxSectionTextLength = 3000
+
+	// maxButtonTextLength is the max characters of text in a button
+	maxButtonTextLength = 75
+
+	// maxActionElements is the max count of elements in a actions block
+	maxActionElements = 25
+
+	// callbackActionIDPrefix is the prefix of action ids of OnClick buttons
+	callbackActionIDPrefix = "mbot-"
+)
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *slackBot
+
+	channel string
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// message body is sent as section blocks in mrkdwn, and each row of callbacks
+// is sent as an actions block of buttons
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) (_ []rt.MessageID, err error) {
+	text := formatSpans(opts.Body)
+
+	var blocks []api.Block
+	for _, section := range bot.SplitText(text, maxSectionTextLength) {
+		blocks = append(blocks, api.NewSectionBlock(
+			api.NewTextBlockObject(api.MarkdownType, section, false, false), nil, nil,
+		))
+	}
+
+	for i, row := range opts.Callbacks {
+		var elements []api.BlockElement
+		for _, cb := range row {
+			if len(elements) == maxActionElements {
+				break
+			}
+
+			label := cb.Text
+			if r := []rune(label); len(r) > maxButtonTextLength {
+				label = string(r[:maxButtonTextLength])
+			}
+
+			btn := api.NewButtonBlockElement("", "", api.NewTextBlockObject(api.PlainTextType, label, false, false))
+			switch {
+			case !cb.URL.IsNil():
+				btn.ActionID = "url-" + strconv.Itoa(i) + "-" + strconv.Itoa(len(elements))
+				btn.URL = cb.URL.Get()
+			case !cb.OnClick.IsNil():
+				var id string
+				id, err = c.bot.callbacks.Add(cb.OnClick.Get())
+				if err != nil {
+					return nil, fmt.Errorf("add button callback: %w", err)
+				}
+
+				btn.ActionID = callbackActionIDPrefix + id
+			default:
+				continue
+			}
+
+			elements = append(elements, btn)
+		}
+
+		if len(elements) != 0 {
+			blocks = append(blocks, api.NewActionBlock("", elements...))
+		}
+	}
+
+	msgOpts := []api.MsgOption{
+		// fallback text for notifications
+		api.MsgOptionText(text, false),
+		api.MsgOptionBlocks(blocks...),
+	}
+
+	if opts.NoWebPreview {
+		msgOpts = append(msgOpts, api.MsgOptionDisableLinkUnfurl(), api.MsgOptionDisableMediaUnfurl())
+	}
+
+	if opts.ReplyTo != 0 {
+		if mc, ok := c.bot.history.Find(chatIDWrapper{channel: c.channel}.ID(), opts.ReplyTo); ok {
+			threadTS := mc.threadTS
+			if len(threadTS) == 0 {
+				threadTS = mc.ts
+			}
+
+			msgOpts = append(msgOpts, api.MsgOptionTS(threadTS))
+		}
+	}
+
+	_, ts, err := c.bot.client.PostMessageContext(ctx, c.channel, msgOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return []rt.MessageID{messageIDOf(ts)}, nil
+}
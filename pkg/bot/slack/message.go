@@ -0,0 +1,480 @@
+package slack
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"arhat.dev/pkg/log"
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/types"
+	"github.com/slack-go/slack/slackevents"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func (c *slackBot) newMessageFromSlackMessage(mc *messageContext, wf *bot.Workflow) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.timestamp
+	ret.Spans = parseMrkdwn(mc.text)
+
+	author := c.userInfo(mc.user).name
+	if mc.isMe {
+		// `/me waves` is rendered as `* name waves`
+		ret.Spans = append([]rt.Span{
+			{Flags: rt.SpanFlag_Italic, Text: "* " + author + " "},
+		}, ret.Spans...)
+	}
+
+	for i := range mc.files {
+		c.appendFileSpan(mc, ret, &mc.files[i], wf)
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	if mc.isPrivate {
+		ret.Flags |= rt.MessageFlag_Private
+	}
+
+	if mc.replyTo != 0 {
+		ret.Flags |= rt.MessageFlag_Reply
+		ret.ReplyTo = mc.replyTo
+	}
+
+	ret.ChatName = c.channelName(mc.chat.channel)
+	if len(c.teamURL) != 0 {
+		ret.ChatLink = c.teamURL + "archives/" + mc.chat.channel
+		ret.AuthorLink = c.teamURL + "team/" + mc.user
+	}
+
+	ret.Author = author
+
+	return
+}
+
+// appendFileSpan adds the file span to the message, and downloads the file in background
+// when the workflow requires
+func (c *slackBot) appendFileSpan(mc *messageContext, m *rt.Message, f *slackevents.File, wf *bot.Workflow) {
+	span := rt.Span{
+		URL: f.URLPrivate,
+		SpanMediaOptions: rt.SpanMediaOptions{
+			Filename:    f.Name,
+			Size:        int64(f.Size),
+			ContentType: f.Mimetype,
+		},
+	}
+
+	switch mimeType := f.Mimetype; {
+	case strings.HasPrefix(mimeType, "image/"):
+		span.Flags = rt.SpanFlag_Image
+	case strings.HasPrefix(mimeType, "video/"):
+		span.Flags = rt.SpanFlag_Video
+	case strings.HasPrefix(mimeType, "audio/"):
+		span.Flags = rt.SpanFlag_Audio
+	default:
+		span.Flags = rt.SpanFlag_File
+	}
+
+	m.Spans = append(m.Spans, span)
+
+	downloadURL := f.URLPrivateDownload
+	if len(downloadURL) == 0 {
+		downloadURL = f.URLPrivate
+	}
+
+	if len(downloadURL) == 0 || !wf.DownloadMedia() {
+		return
+	}
+
+	mediaSpan := &m.Spans[len(m.Spans)-1]
+	con := mc.con
+
+	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
+		mc.logger.D("download file", log.Int64("size", mediaSpan.Size), log.String("content_type", mediaSpan.ContentType))
+
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			return c.client.GetFileContext(c.Context(), downloadURL, cacheWR)
+		})
+		if err != nil {
+			mc.logger.I("failed to download file", log.Error(err))
+			c.sendErrorf(mc, "unable to download: %v", err)
+			return
+		}
+
+		contentType, ext := mediaSpan.ContentType, strings.TrimPrefix(path.Ext(mediaSpan.Filename), ".")
+		if len(contentType) == 0 || len(ext) == 0 {
+			var (
+				buf [32]byte
+				ft  types.Type
+			)
+
+			n, _ := cacheRD.Read(buf[:])
+			_, err = cacheRD.Seek(0, io.SeekStart)
+			if err != nil {
+				mc.logger.E("failed to seek to start", log.Error(err))
+				c.sendErrorf(mc, "bad cache reuse")
+				return
+			}
+
+			ft, err = filetype.Match(buf[:n])
+			if err == nil {
+				if len(contentType) == 0 {
+					contentType = ft.MIME.Value
+				}
+
+				if len(ext) == 0 {
+					ext = ft.Extension
+				}
+			}
+		}
+
+		if len(contentType) != 0 {
+			mediaSpan.ContentType = contentType
+		} else {
+			// provide default mime type for storage driver
+			mediaSpan.ContentType = "application/octet-stream"
+		}
+
+		var filename string
+		if len(mediaSpan.Filename) == 0 { // no filename set
+			filename = cacheRD.ID().String() + "." + ext
+		} else {
+			filename = mediaSpan.Filename
+			if len(path.Ext(filename)) == 0 {
+				filename += "." + ext
+			}
+		}
+
+		mc.logger.D("upload file",
+			log.String("filename", filename),
+			rt.LogCacheID(cacheRD.ID()),
+			log.Int64("size", sz),
+		)
+
+		sout, err := bot.Upload(&con, wf.Storage, filename, sz, cacheRD, mediaSpan.ContentType)
+		if err != nil {
+			mc.logger.I("failed to upload file", log.Error(err))
+			c.sendErrorf(mc, "unable to upload file: %v", err)
+			return
+		}
+
+		mediaSpan.Size = sz
+		mediaSpan.URL = sout.URL
+		mediaSpan.Data = cacheRD
+	})
+}
+
+var mrkdwnUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+var mrkdwnEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// mrkdwnParser converts slack mrkdwn to spans
+//
+// ref: https://api.slack.com/reference/surfaces/formatting
+type mrkdwnParser struct {
+	spans []rt.Span
+}
+
+// parseMrkdwn converts text of slack message to spans
+func parseMrkdwn(text string) []rt.Span {
+	var p mrkdwnParser
+
+	// blockquote is line based
+	for len(text) != 0 {
+		var flags rt.SpanFlag
+		if strings.HasPrefix(text, "&gt;") {
+			flags = rt.SpanFlag_Blockquote
+			text = strings.TrimPrefix(strings.TrimPrefix(text, "&gt;"), " ")
+		}
+
+		line, rest, found := cutLine(text)
+		p.parseInline(line, flags)
+		if found {
+			p.appendText(flags, "\n", "", "")
+		}
+
+		text = rest
+	}
+
+	return p.spans
+}
+
+// cutLine cuts text at the first newline outside of pre-formatted text
+func cutLine(text string) (line, rest string, found bool) {
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\n':
+			return text[:i], text[i+1:], true
+		case strings.HasPrefix(text[i:], "```"):
+			end := strings.Index(text[i+3:], "```")
+			if end < 0 {
+				return text, "", false
+			}
+
+			i += 3 + end + 2
+		}
+	}
+
+	return text, "", false
+}
+
+// nolint:gocyclo
+func (p *mrkdwnParser) parseInline(text string, flags rt.SpanFlag) {
+	start := 0
+	flush := func(end int) {
+		if start < end {
+			p.appendText(flags, mrkdwnUnescaper.Replace(text[start:end]), "", "")
+		}
+	}
+
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case strings.HasPrefix(text[i:], "```"):
+			end := strings.Index(text[i+3:], "```")
+			if end < 0 {
+				i++
+				continue
+			}
+
+			flush(i)
+			pre := strings.TrimPrefix(text[i+3:i+3+end], "\n")
+			p.appendText(flags|rt.SpanFlag_Pre, mrkdwnUnescaper.Replace(pre), "", "")
+			i += 3 + end + 3
+			start = i
+		case c == '`':
+			end := strings.IndexByte(text[i+1:], '`')
+			if end <= 0 {
+				i++
+				continue
+			}
+
+			flush(i)
+			p.appendText(flags|rt.SpanFlag_Code, mrkdwnUnescaper.Replace(text[i+1:i+1+end]), "", "")
+			i += 1 + end + 1
+			start = i
+		case c == '<':
+			end := strings.IndexByte(text[i+1:], '>')
+			if end <= 0 {
+				i++
+				continue
+			}
+
+			flush(i)
+			p.appendEntity(flags, text[i+1:i+1+end])
+			i += 1 + end + 1
+			start = i
+		case c == '*' || c == '_' || c == '~':
+			end := findClosingMarker(text, i)
+			if end < 0 {
+				i++
+				continue
+			}
+
+			flush(i)
+
+			var f rt.SpanFlag
+			switch c {
+			case '*':
+				f = rt.SpanFlag_Bold
+			case '_':
+				f = rt.SpanFlag_Italic
+			default:
+				f = rt.SpanFlag_Strikethrough
+			}
+
+			p.parseInline(text[i+1:end], flags|f)
+			i = end + 1
+			start = i
+		default:
+			i++
+		}
+	}
+
+	flush(len(text))
+}
+
+// findClosingMarker finds the closing style marker of the one at text[i], returns
+// -1 when not found
+//
+// style markers only take effect at word boundaries
+func findClosingMarker(text string, i int) int {
+	marker := text[i]
+	if i != 0 && isWordChar(text[i-1]) {
+		return -1
+	}
+
+	if i+1 >= len(text) || text[i+1] == ' ' || text[i+1] == marker {
+		return -1
+	}
+
+	for j := i + 2; j < len(text); j++ {
+		if text[j] != marker || text[j-1] == ' ' {
+			continue
+		}
+
+		if j+1 < len(text) && isWordChar(text[j+1]) {
+			continue
+		}
+
+		return j
+	}
+
+	return -1
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// appendEntity handles `<...>` in mrkdwn, which can be user mention, channel link,
+// special mention or url
+func (p *mrkdwnParser) appendEntity(flags rt.SpanFlag, entity string) {
+	target, label, hasLabel := strings.Cut(entity, "|")
+	label = mrkdwnUnescaper.Replace(label)
+
+	switch {
+	case strings.HasPrefix(target, "@"):
+		if !hasLabel {
+			label = target
+		} else if !strings.HasPrefix(label, "@") {
+			label = "@" + label
+		}
+
+		p.appendText(flags|rt.SpanFlag_Mention, label, "", target[1:])
+	case strings.HasPrefix(target, "#"):
+		if !hasLabel {
+			label = target
+		} else {
+			label = "#" + label
+		}
+
+		p.appendText(flags, label, "", "")
+	case strings.HasPrefix(target, "!"):
+		// special mentions, e.g. <!here>, <!subteam^ID|@team>
+		if !hasLabel {
+			label = "@" + strings.TrimPrefix(target, "!")
+		}
+
+		p.appendText(flags, label, "", "")
+	default:
+		url := mrkdwnUnescaper.Replace(target)
+		if !hasLabel {
+			label = strings.TrimPrefix(url, "mailto:")
+		}
+
+		if strings.HasPrefix(url, "mailto:") {
+			p.appendText(flags|rt.SpanFlag_Email, label, url, "")
+		} else {
+			p.appendText(flags|rt.SpanFlag_URL, label, url, "")
+		}
+	}
+}
+
+func (p *mrkdwnParser) appendText(flags rt.SpanFlag, text, url, hint string) {
+	if len(text) == 0 {
+		return
+	}
+
+	if len(p.spans) != 0 {
+		last := &p.spans[len(p.spans)-1]
+		if last.Flags == flags && last.URL == url && last.Hint == hint && !flags.IsLink() {
+			last.Text += text
+			return
+		}
+	}
+
+	p.spans = append(p.spans, rt.Span{Flags: flags, Text: text, URL: url, Hint: hint})
+}
+
+// formatSpans converts spans to slack mrkdwn
+func formatSpans(spans []rt.Span) string {
+	var buf strings.Builder
+
+	for i := range spans {
+		formatSpan(&buf, &spans[i])
+	}
+
+	return buf.String()
+}
+
+// nolint:gocyclo
+func formatSpan(buf *strings.Builder, sp *rt.Span) {
+	if sp.IsMedia() {
+		switch {
+		case len(sp.URL) != 0:
+			name := sp.Filename
+			if len(name) == 0 {
+				name = sp.URL
+			}
+
+			buf.WriteString("<" + sp.URL + "|" + mrkdwnEscaper.Replace(name) + ">")
+		case len(sp.Filename) != 0:
+			buf.WriteString(mrkdwnEscaper.Replace("[" + sp.Filename + "]"))
+		}
+
+		if len(sp.Caption) != 0 {
+			buf.WriteString(" ")
+			buf.WriteString(formatSpans(sp.Caption))
+		}
+
+		return
+	}
+
+	var text string
+	switch {
+	case sp.IsMention() && strings.HasPrefix(sp.Hint, "U"):
+		text = "<@" + sp.Hint + ">"
+	case sp.IsLink() && len(sp.URL) != 0:
+		url := sp.URL
+		if sp.IsEmail() && !strings.HasPrefix(url, "mailto:") {
+			url = "mailto:" + url
+		}
+
+		text = "<" + url + "|" + mrkdwnEscaper.Replace(sp.Text) + ">"
+	case sp.IsPre():
+		text = "```" + mrkdwnEscaper.Replace(sp.Text) + "```"
+	case sp.IsCode():
+		text = "`" + mrkdwnEscaper.Replace(sp.Text) + "`"
+	default:
+		text = mrkdwnEscaper.Replace(sp.Text)
+	}
+
+	if !sp.IsPre() && !sp.IsCode() {
+		if sp.IsStrikethrough() {
+			text = wrapMarker(text, "~")
+		}
+
+		if sp.IsItalic() {
+			text = wrapMarker(text, "_")
+		}
+
+		if sp.IsBold() {
+			text = wrapMarker(text, "*")
+		}
+	}
+
+	if sp.IsBlockquote() {
+		text = "> " + strings.ReplaceAll(text, "\n", "\n> ")
+	}
+
+	buf.WriteString(text)
+}
+
+// wrapMarker wraps text with style marker, leading and trailing spaces are kept
+// outside of the markers as required by mrkdwn
+func wrapMarker(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if len(trimmed) == 0 {
+		return text
+	}
+
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
@@ -0,0 +1,385 @@
+package slack
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestParseMrkdwn(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		text     string
+		expected []rt.Span
+	}{
+		{
+			name:     "Plain",
+			text:     "a &amp; b_c 2*3*4",
+			expected: []rt.Span{{Text: "a & b_c 2*3*4"}},
+		},
+		{
+			name: "Styles",
+			text: "*bold* _it ~both~_ `a*b*`",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Bold, Text: "bold"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Italic, Text: "it "},
+				{Flags: rt.SpanFlag_Italic | rt.SpanFlag_Strikethrough, Text: "both"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Code, Text: "a*b*"},
+			},
+		},
+		{
+			name: "Entities",
+			text: "<@U123> <@U456|bob> see <https://example.com?a=1&amp;b=2|this> <mailto:a@example.com> <!here>",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Mention, Text: "@U123", Hint: "U123"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Mention, Text: "@bob", Hint: "U456"},
+				{Text: " see "},
+				{Flags: rt.SpanFlag_URL, Text: "this", URL: "https://example.com?a=1&b=2"},
+				{Text: " "},
+				{Flags: rt.SpanFlag_Email, Text: "a@example.com", URL: "mailto:a@example.com"},
+				{Text: " @here"},
+			},
+		},
+		{
+			name: "Blocks",
+			text: "&gt; quoted\nnormal\n```x := 1\n\ny```",
+			expected: []rt.Span{
+				{Flags: rt.SpanFlag_Blockquote, Text: "quoted\n"},
+				{Text: "normal\n"},
+				{Flags: rt.SpanFlag_Pre, Text: "x := 1\n\ny"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.EqualValues(t, test.expected, parseMrkdwn(test.text))
+		})
+	}
+}
+
+func TestFormatSpans(t *testing.T) {
+	assert.Equal(t,
+		"a&lt;b *bold* _it_ `x` <https://example.com|link> <@U123> > q\n> r"+
+			"<fake://p.png|photo.png>",
+		formatSpans([]rt.Span{
+			{Text: "a<b "},
+			{Flags: rt.SpanFlag_Bold, Text: "bold "},
+			{Flags: rt.SpanFlag_Italic, Text: "it"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Code, Text: "x"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_URL, Text: "link", URL: "https://example.com"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Mention, Text: "@alice", Hint: "U123"},
+			{Text: " "},
+			{Flags: rt.SpanFlag_Blockquote, Text: "q\nr"},
+			{
+				Flags: rt.SpanFlag_Image,
+				URL:   "fake://p.png",
+				SpanMediaOptions: rt.SpanMediaOptions{
+					Filename: "photo.png",
+				},
+			},
+		}),
+	)
+}
+
+const testSigningSecret = "secret"
+
+type postedMessage struct {
+	channel  string
+	text     string
+	blocks   string
+	threadTS string
+}
+
+// fakeWebAPI is a slack web api stand-in
+type fakeWebAPI struct {
+	*httptest.Server
+
+	seq int64
+
+	// messages sent by chat.postMessage
+	posted chan postedMessage
+
+	mu         sync.Mutex
+	downloaded int
+}
+
+func newFakeWebAPI(t *testing.T) *fakeWebAPI {
+	s := &fakeWebAPI{
+		posted: make(chan postedMessage, 16),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *fakeWebAPI) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer xoxb-token" && r.FormValue("token") != "xoxb-token" {
+		s.reply(w, map[string]any{"ok": false, "error": "invalid_auth"})
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/api/") {
+	case "auth.test":
+		s.reply(w, map[string]any{
+			"ok":      true,
+			"url":     "https://test.slack.com/",
+			"team":    "test",
+			"user":    "mbot",
+			"user_id": "UBOT",
+			"bot_id":  "BBOT",
+		})
+	case "users.info":
+		users := map[string]any{
+			"UALICE": map[string]any{"id": "UALICE", "name": "alice", "is_admin": true, "profile": map[string]any{"display_name": "Alice"}},
+			"UBOB":   map[string]any{"id": "UBOB", "name": "bob", "profile": map[string]any{"real_name": "Bob"}, "real_name": "Bob"},
+		}
+		s.reply(w, map[string]any{"ok": true, "user": users[r.FormValue("user")]})
+	case "conversations.info":
+		s.reply(w, map[string]any{"ok": true, "channel": map[string]any{"id": r.FormValue("channel"), "name": "general"}})
+	case "chat.postMessage":
+		s.posted <- postedMessage{
+			channel:  r.FormValue("channel"),
+			text:     r.FormValue("text"),
+			blocks:   r.FormValue("blocks"),
+			threadTS: r.FormValue("thread_ts"),
+		}
+
+		s.reply(w, map[string]any{
+			"ok":      true,
+			"channel": r.FormValue("channel"),
+			"ts":      fmt.Sprintf("2000000000.%06d", atomic.AddInt64(&s.seq, 1)),
+		})
+	case "files/photo.png":
+		s.mu.Lock()
+		s.downloaded++
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeWebAPI) reply(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (s *fakeWebAPI) expectPosted(t *testing.T, expected string) postedMessage {
+	select {
+	case msg := <-s.posted:
+		assert.Equal(t, expected, msg.text)
+		return msg
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timeout waiting for message", expected)
+		return postedMessage{}
+	}
+}
+
+// signedRequest creates a request signed with testSigningSecret
+func signedRequest(path, contentType, body string) *http.Request {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	h := hmac.New(sha256.New, []byte(testSigningSecret))
+	_, _ = h.Write([]byte("v0:" + ts + ":" + body))
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(h.Sum(nil)))
+
+	return req
+}
+
+func serve(mux *http.ServeMux, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func sendEvent(t *testing.T, mux *http.ServeMux, event map[string]any) {
+	data, err := json.Marshal(map[string]any{
+		"type":     "event_callback",
+		"event_id": fmt.Sprint(event["ts"]),
+		"event":    event,
+	})
+	require.NoError(t, err)
+
+	rec := serve(mux, signedRequest("/slack/events", "application/json", string(data)))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func messageEvent(user, ts, text string) map[string]any {
+	return map[string]any{
+		"type":         "message",
+		"channel":      "CGENERAL",
+		"channel_type": "channel",
+		"user":         user,
+		"text":         text,
+		"ts":           ts,
+	}
+}
+
+func TestBot(t *testing.T) {
+	srv := newFakeWebAPI(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	pub := &bottest.Publisher{}
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, true),
+
+		BotToken:      "xoxb-token",
+		SigningSecret: testSigningSecret,
+		APIURL:        srv.URL + "/api",
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	require.NoError(t, b.Configure())
+	require.NoError(t, b.Start("", mux))
+
+	t.Run("Verification", func(t *testing.T) {
+		body := `{"type":"url_verification","challenge":"foo"}`
+		rec := serve(mux, signedRequest("/slack/events", "application/json", body))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "foo", rec.Body.String())
+
+		req := signedRequest("/slack/events", "application/json", body)
+		req.Header.Set("X-Slack-Signature", "v0=00")
+		assert.Equal(t, http.StatusUnauthorized, serve(mux, req).Code)
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		form := url.Values{
+			"command":    {"/new"},
+			"text":       {"topic"},
+			"channel_id": {"CGENERAL"},
+			"user_id":    {"UBOB"},
+		}
+		rec := serve(mux, signedRequest("/slack/commands", "application/x-www-form-urlencoded", form.Encode()))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		srv.expectPosted(t, "Only workspace admins can use this bot in channel.")
+
+		sendEvent(t, mux, messageEvent("UALICE", "1000000000.000001", "!new topic"))
+		srv.expectPosted(t, "created topic")
+
+		sendEvent(t, mux, messageEvent("UALICE", "1000000000.000002", "*hello* <https://example.com|link>"))
+
+		fileMsg := messageEvent("UBOB", "1000000000.000003", "")
+		fileMsg["subtype"] = "file_share"
+		fileMsg["files"] = []map[string]any{{
+			"id":                   "F1",
+			"name":                 "photo.png",
+			"mimetype":             "image/png",
+			"url_private":          srv.URL + "/api/files/photo.png",
+			"url_private_download": srv.URL + "/api/files/photo.png",
+		}}
+		sendEvent(t, mux, fileMsg)
+
+		meMsg := messageEvent("UBOB", "1000000000.000004", "waves")
+		meMsg["subtype"] = "me_message"
+		sendEvent(t, mux, meMsg)
+
+		botMsg := messageEvent("UBOT", "1000000000.000005", "!end")
+		sendEvent(t, mux, botMsg)
+
+		sendEvent(t, mux, messageEvent("UALICE", "1000000000.000006", "!end"))
+		srv.expectPosted(t, "published")
+
+		assert.EqualValues(t, []string{
+			"topic" +
+				"Alice: hello link\n" +
+				"Bob: \n" +
+				"Bob: * Bob waves\n",
+		}, pub.Posts())
+
+		srv.mu.Lock()
+		assert.Equal(t, 1, srv.downloaded)
+		srv.mu.Unlock()
+	})
+
+	t.Run("Callbacks", func(t *testing.T) {
+		clicked := make(chan struct{})
+		con := &conversationImpl{bot: b.(*slackBot), channel: "CGENERAL"}
+		_, err := con.SendMessage(ctx, rt.SendMessageOptions{
+			Body: []rt.Span{{Text: "choose"}},
+			Callbacks: [][]rt.MessageCallbackSpec{{
+				{Text: "open", URL: rt.NewOptionalValue("https://example.com")},
+				{Text: "click", OnClick: rt.NewOptionalValue(func() error {
+					close(clicked)
+					return nil
+				})},
+			}},
+		})
+		require.NoError(t, err)
+
+		msg := srv.expectPosted(t, "choose")
+
+		var blocks []struct {
+			Type     string `json:"type"`
+			Elements []struct {
+				ActionID string `json:"action_id"`
+				URL      string `json:"url"`
+			} `json:"elements"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(msg.blocks), &blocks))
+		require.Len(t, blocks, 2)
+		assert.Equal(t, "section", blocks[0].Type)
+		assert.Equal(t, "actions", blocks[1].Type)
+		require.Len(t, blocks[1].Elements, 2)
+		assert.Equal(t, "https://example.com", blocks[1].Elements[0].URL)
+
+		payload, err := json.Marshal(map[string]any{
+			"type":    "block_actions",
+			"actions": []map[string]any{{"block_id": "b", "action_id": blocks[1].Elements[1].ActionID, "type": "button"}},
+		})
+		require.NoError(t, err)
+
+		rec := serve(mux, signedRequest(
+			"/slack/interactions",
+			"application/x-www-form-urlencoded",
+			url.Values{"payload": {string(payload)}}.Encode(),
+		))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		select {
+		case <-clicked:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "button callback not called")
+		}
+	})
+}
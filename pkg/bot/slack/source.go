@@ -0,0 +1,78 @@
+package slack
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+	"github.com/slack-go/slack/slackevents"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashString generates a stable uint64 id for slack ids (user, channel) and
+// message timestamps
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](s))
+	return h.Sum64()
+}
+
+func userIDOf(user string) rt.UserID     { return rt.UserID(hashString(user)) }
+func messageIDOf(ts string) rt.MessageID { return rt.MessageID(hashString(ts)) }
+
+// parseTimestamp converts slack message ts (e.g. 1355517523.000005) to time
+func parseTimestamp(ts string) time.Time {
+	sec, nsec, _ := strings.Cut(ts, ".")
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Now().UTC()
+	}
+
+	us, _ := strconv.ParseInt(nsec, 10, 64)
+	return time.Unix(s, us*int64(time.Microsecond)).UTC()
+}
+
+// isDirectChannel checks whether the channel id is a direct message channel
+func isDirectChannel(channel string) bool { return strings.HasPrefix(channel, "D") }
+
+// chatIDWrapper is the chat data stored in session requests
+type chatIDWrapper struct {
+	channel string
+}
+
+func (c chatIDWrapper) ID() rt.ChatID { return rt.ChatID(hashString(c.channel)) }
+
+type messageContext struct {
+	con conversationImpl
+
+	chat chatIDWrapper
+	user string
+
+	// ts is the timestamp of the message, empty for slash commands
+	ts       string
+	threadTS string
+
+	msgID   rt.MessageID
+	replyTo rt.MessageID
+
+	// text in mrkdwn
+	text  string
+	files []slackevents.File
+
+	isPrivate bool
+	isMe      bool
+
+	timestamp time.Time
+
+	logger log.Interface
+}
+
+// userInfo is the cached user profile
+type userInfo struct {
+	name    string
+	isAdmin bool
+}
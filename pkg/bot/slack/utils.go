@@ -0,0 +1,45 @@
+package slack
+
+import (
+	"fmt"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func plain(text string) rt.Span { return rt.Span{Flags: rt.SpanFlag_PlainText, Text: text} }
+func bold(text string) rt.Span  { return rt.Span{Flags: rt.SpanFlag_Bold, Text: text} }
+
+// sendText sends spans as a single message
+func (c *slackBot) sendText(con *conversationImpl, replyTo rt.MessageID, body ...rt.Span) (msgID rt.MessageID, err error) {
+	msgIDs, err := con.SendMessage(c.Context(), rt.SendMessageOptions{
+		ReplyTo: replyTo,
+		Body:    body,
+	})
+	if err != nil {
+		c.Logger().E("failed to send message", log.Error(err))
+		return
+	}
+
+	if len(msgIDs) != 0 {
+		msgID = msgIDs[0]
+	}
+
+	return
+}
+
+// reply sends message to the channel where mc comes from, it's sent to the thread
+// when mc is in a thread
+func (c *slackBot) reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	var replyTo rt.MessageID
+	if len(mc.threadTS) != 0 {
+		replyTo = mc.msgID
+	}
+
+	return c.sendText(&mc.con, replyTo, body...)
+}
+
+func (c *slackBot) sendErrorf(mc *messageContext, format string, args ...any) {
+	c.reply(mc, plain("Internal bot error: "), bold(fmt.Sprintf(format, args...)))
+}
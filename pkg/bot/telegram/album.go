@@ -0,0 +1,127 @@
+package telegram
+
+import (
+	"sort"
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+// albumWindow is how long messages of the same album are collected since the
+// last one received
+const albumWindow = time.Second
+
+type albumKey struct {
+	chatID    rt.ChatID
+	groupedID int64
+}
+
+// album is a media group, messages of an album share the same grouped_id
+type album struct {
+	// msg is the merged session message
+	msg   *rt.Message
+	parts []*messageContext
+
+	// timer completes the album, reset when a part received
+	timer *time.Timer
+}
+
+// appendAlbumMessage merges the message into the album it belongs to, the
+// album is completed and appended to the session when no more message
+// received within albumWindow
+func (c *tgBot) appendAlbumMessage(mc *messageContext, s *session.Session, groupedID int64) {
+	key := albumKey{chatID: mc.src.Chat.ID(), groupedID: groupedID}
+
+	c.albumsMu.Lock()
+	defer c.albumsMu.Unlock()
+
+	a, ok := c.albums[key]
+	if ok {
+		mc.logger.V("collect album message", log.Int64("grouped_id", groupedID))
+		a.parts = append(a.parts, mc)
+		a.timer.Reset(albumWindow)
+		return
+	}
+
+	mc.logger.V("new album", log.Int64("grouped_id", groupedID))
+	a = &album{
+		msg:   newMessageFromTelegramMessage(mc),
+		parts: []*messageContext{mc},
+	}
+	a.msg.Flags |= rt.MessageFlag_Album
+
+	if c.albums == nil {
+		c.albums = make(map[albumKey]*album)
+	}
+	c.albums[key] = a
+
+	a.timer = time.AfterFunc(albumWindow, func() {
+		c.albumsMu.Lock()
+		// the timer can be reset after fired
+		if c.albums[key] != a {
+			c.albumsMu.Unlock()
+			return
+		}
+
+		delete(c.albums, key)
+		c.albumsMu.Unlock()
+
+		if c.Context().Err() != nil {
+			return
+		}
+
+		// the album is only visible in the session when complete, media can
+		// still be downloading
+		c.fillAlbumSpans(a.parts, s.Workflow(), a.msg)
+		s.AppendMessage(a.msg)
+	})
+}
+
+// fillAlbumSpans sets the shared caption and media spans of all parts to m
+func (c *tgBot) fillAlbumSpans(parts []*messageContext, wf *bot.Workflow, m *rt.Message) {
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].msg.GetID() < parts[j].msg.GetID()
+	})
+
+	// the album is identified by its first part
+	m.ID = rt.MessageID(parts[0].msg.GetID())
+
+	m.Text, m.Spans = "", nil
+	for _, p := range parts {
+		if text := p.msg.GetMessage(); len(text) != 0 {
+			m.Text = text
+			m.Spans = parseTextEntities(text, p.msg.Entities)
+			break
+		}
+	}
+
+	type mediaDownload struct {
+		mc         *messageContext
+		idx        int
+		doDownload donwlodFunc
+	}
+
+	var downloads []mediaDownload
+	for _, p := range parts {
+		nonText, doDownload, ok := c.parseMediaSpan(p)
+		if !ok {
+			continue
+		}
+
+		m.Spans = append(m.Spans, nonText)
+		downloads = append(downloads, mediaDownload{mc: p, idx: len(m.Spans) - 1, doDownload: doDownload})
+	}
+
+	if !wf.DownloadMedia() {
+		return
+	}
+
+	// start downloading after all spans appended
+	for _, d := range downloads {
+		c.downloadMediaSpan(d.mc, wf, m, d.idx, d.doDownload)
+	}
+}
@@ -0,0 +1,82 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+func TestAppendAlbumMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	wf := &bot.Workflow{}
+	alice := &tg.User{ID: 1, FirstName: "alice"}
+
+	c := &tgBot{sessions: session.NewManager[chatIDWrapper](ctx)}
+	c.BaseBot = bot.NewBotBase(rt.NewContext(ctx, log.NoOpLogger, nil))
+
+	chat := chatIDWrapper{chat: alice.AsInputPeer()}
+	assert.True(t, c.sessions.MarkSessionStandby(wf, 1, chat, "", false, time.Minute))
+	s, err := c.sessions.ActivateSession(wf, 1, chat.ID(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	newPart := func(id int, caption string) *messageContext {
+		msg := &tg.Message{
+			ID:      id,
+			PeerID:  &tg.PeerUser{UserID: alice.ID},
+			Message: caption,
+		}
+		msg.SetGroupedID(100)
+
+		media := &tg.MessageMediaPhoto{}
+		media.SetPhoto(&tg.Photo{ID: int64(id)})
+		msg.SetMedia(media)
+
+		mc := &messageContext{msg: msg, logger: log.NoOpLogger}
+		mc.src.Chat = resolveChatSpec(alice)
+		return mc
+	}
+
+	// parts may arrive out of order, and the window is extended by each part
+	assert.NoError(t, c.appendSessionMessage(newPart(11, "")))
+	time.Sleep(albumWindow * 3 / 5)
+	assert.NoError(t, c.appendSessionMessage(newPart(10, "caption")))
+	time.Sleep(albumWindow * 3 / 5)
+	assert.NoError(t, c.appendSessionMessage(newPart(12, "")))
+
+	// not visible until complete
+	assert.Empty(t, s.GetMessages())
+
+	assert.Eventually(t, func() bool {
+		return len(s.GetMessages()) == 1
+	}, 5*albumWindow, 10*time.Millisecond)
+
+	m := s.GetMessages()[0]
+	assert.True(t, m.IsAlbum())
+	assert.True(t, m.Ready())
+	assert.Equal(t, rt.MessageID(10), m.ID)
+	assert.Equal(t, "caption", m.Text)
+	if assert.Len(t, m.Spans, 4) {
+		assert.Equal(t, "caption", m.Spans[0].Text)
+		for _, span := range m.Spans[1:] {
+			assert.True(t, span.IsImage())
+		}
+	}
+
+	// a new album after the window
+	assert.NoError(t, c.appendSessionMessage(newPart(13, "")))
+	assert.Eventually(t, func() bool {
+		return len(s.GetMessages()) == 2
+	}, 5*albumWindow, 10*time.Millisecond)
+}
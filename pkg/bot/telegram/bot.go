@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"arhat.dev/pkg/log"
 	"arhat.dev/pkg/queue"
 	"github.com/gotd/contrib/bg"
+	tds "github.com/gotd/td/session"
 	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/telegram/downloader"
 	"github.com/gotd/td/telegram/message"
@@ -17,6 +20,7 @@ import (
 	"github.com/gotd/td/tg"
 
 	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
 	"arhat.dev/mbot/pkg/rt"
 	"arhat.dev/mbot/pkg/session"
 )
@@ -28,18 +32,46 @@ type tgBot struct {
 
 	isBot    bool
 	botToken string
+	user     UserConfig
+	selfID   int64  // set when Configure() called
 	username string // set when Configure() called
 
 	client     *telegram.Client
 	sender     *message.Sender
 	uploader   *uploader.Uploader
 	dispatcher tg.UpdateDispatcher
+	updates    *updatesTracker
 	downloader downloader.Downloader
 
 	sessions session.Manager[chatIDWrapper]
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	// storage of active sessions, nil when they are not persisted
+	sessionsStorage tds.Storage
+	// storedSessions is the data last stored
+	storedSessions []byte
+
+	// key: topicKey
+	// value: bool, whether the message is a topic
+	topics sync.Map
+
+	// key: rt.ChatID of private chats and legacy groups where botcmds or session
+	// messages were sent
+	//
+	// they share the message id sequence of the account
+	legacyChats sync.Map
+
+	albumsMu sync.Mutex
+	albums   map[albumKey]*album
+
+	secrets *secretChats
 
 	wfSet   bot.WorkflowSet
+	scopes  map[*bot.Workflow]*commandScope // set when Configure() called
 	msgDelQ *queue.TimeoutQueue[msgDeleteKey, tg.InputPeerClass]
+
+	// key: callback data
+	callbacks *bot.CallbackRegistry
 }
 
 func (c *tgBot) Configure() (err error) {
@@ -53,26 +85,13 @@ func (c *tgBot) Configure() (err error) {
 		}
 	}()
 
-	// TODO: support user account
-	auth, err := c.client.Auth().Bot(c.Context(), c.botToken)
+	self, err := c.login()
 	if err != nil {
 		return fmt.Errorf("auth: %w", err)
 	}
-	_ = auth
-
-	var self *tg.User
-	switch t := auth.GetUser().(type) {
-	case *tg.UserEmpty:
-	case *tg.User:
-		self = t
-	default:
-		self, err = c.client.Self(c.Context())
-		if err != nil {
-			return fmt.Errorf("recognize self: %w", err)
-		}
-	}
 
 	c.isBot = self.GetBot()
+	c.selfID = self.GetID()
 	c.username, _ = self.GetUsername()
 
 	c.Logger().D("recognized self",
@@ -81,65 +100,34 @@ func (c *tgBot) Configure() (err error) {
 		log.Bool("is_bot", c.isBot),
 	)
 
-	if self.Bot {
-		const (
-			reqDefault = iota
-			reqUsers
-			reqChats
-			reqChatAdmins
-
-			REQ_COUNT
-		)
-
-		var (
-			requests [REQ_COUNT]tg.BotsSetBotCommandsRequest
-
-			defaultScope    tg.BotCommandScopeDefault
-			usersScope      tg.BotCommandScopeUsers
-			chatsScope      tg.BotCommandScopeChats
-			chatAdminsScope tg.BotCommandScopeChatAdmins
-
-			// TODO: support peer scopes?
-			// peerScope       tg.BotCommandScopePeer
-			// peerAdminsScope tg.BotCommandScopePeerAdmins
-			// peerUserScope   tg.BotCommandScopePeerUser
-		)
-
-		requests[reqDefault].Scope = &defaultScope
-		requests[reqUsers].Scope = &usersScope
-		requests[reqChats].Scope = &chatsScope
-		requests[reqChatAdmins].Scope = &chatAdminsScope
-
-		for _, wf := range c.wfSet.Workflows {
-			for i, cmd := range wf.BotCommands.Commands {
-				if len(cmd) == 0 || len(wf.BotCommands.Descriptions[i]) == 0 {
-					continue
-				}
-
-				cmdSpec := tg.BotCommand{
-					Command:     strings.TrimPrefix(cmd, "/"),
-					Description: wf.BotCommands.Descriptions[i],
-				}
+	err = c.resolveScopes()
+	if err != nil {
+		return fmt.Errorf("resolve workflow scopes: %w", err)
+	}
 
-				for j := 0; j < REQ_COUNT; j++ {
-					switch {
-					case j == reqChats && wf.RequireAdmin():
-						// skip
-					default:
-						requests[j].Commands = append(requests[j].Commands, cmdSpec)
-					}
-				}
-			}
+	if c.isBot {
+		err = c.setBotCommands()
+		if err != nil {
+			return err
 		}
+	}
 
-		for i := 0; i < REQ_COUNT; i++ {
-			_, err = c.client.API().BotsSetBotCommands(c.Context(), &requests[i])
-			if err != nil {
-				return fmt.Errorf("set bot commands: %w", err)
-			}
+	if !c.isBot {
+		err = c.secrets.Load(c.Context())
+		if err != nil {
+			return fmt.Errorf("load secret chats: %w", err)
 		}
+	}
 
-		c.Logger().D("bot commands updated", log.Any("commands", requests[reqDefault].Commands))
+	// restore sessions before recovering messages missed for them
+	err = c.restoreSessions(c.Context())
+	if err != nil {
+		c.Logger().I("failed to restore sessions", log.Error(err))
+	}
+
+	err = c.initUpdates()
+	if err != nil {
+		return fmt.Errorf("init updates state: %w", err)
 	}
 
 	return nil
@@ -148,6 +136,7 @@ func (c *tgBot) Configure() (err error) {
 // nolint:gocyclo
 func (c *tgBot) Start(baseURL string, mux rt.Mux) error {
 	c.msgDelQ.Start(c.Context().Done())
+
 	go func() {
 		msgDelCh := c.msgDelQ.TakeCh()
 
@@ -173,28 +162,61 @@ func (c *tgBot) Start(baseURL string, mux rt.Mux) error {
 		}
 	}()
 
+	go c.syncUpdatesState()
+
 	return nil
 }
 
-func (c *tgBot) onNewTelegramEncryptedMessage(ctx context.Context, e tg.Entities, update *tg.UpdateNewEncryptedMessage) error {
-	switch m := update.GetMessage().(type) {
-	case *tg.EncryptedMessage:
-		c.Logger().V("new encrypted message", log.Uint32("type_id", m.TypeID()))
-	case *tg.EncryptedMessageService:
-		c.Logger().V("new encrypted service message", log.Uint32("type_id", m.TypeID()))
-	default:
-		c.Logger().I("unknown encrypted message type", log.Uint32("type_id", m.TypeID()))
+// syncUpdatesState persists updates state, secret chats and active sessions
+// periodically, and recovers missed updates when signaled
+func (c *tgBot) syncUpdatesState() {
+	const interval = 5 * time.Second
+
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-c.Context().Done():
+			// context is canceled, use a new one for the final flush
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			c.flushStates(ctx)
+			cancel()
+
+			return
+		case <-c.updates.gapCh:
+			c.Logger().V("recover missed updates")
+			c.recoverUpdates()
+		case <-tk.C:
+			c.flushStates(c.Context())
+		}
 	}
+}
 
-	return nil
+// flushStates stores updates state, secret chats and active sessions
+func (c *tgBot) flushStates(ctx context.Context) {
+	err := c.updates.Flush(ctx)
+	if err != nil {
+		c.Logger().I("failed to store updates state", log.Error(err))
+	}
+
+	err = c.secrets.Flush(ctx)
+	if err != nil {
+		c.Logger().I("failed to store secret chats", log.Error(err))
+	}
+
+	err = c.storeSessions(ctx)
+	if err != nil {
+		c.Logger().I("failed to store sessions", log.Error(err))
+	}
 }
 
 func (c *tgBot) onNewTelegramChannelMessage(ctx context.Context, e tg.Entities, update *tg.UpdateNewChannelMessage) error {
-	return c.handleTelegramMessage(e, update.GetMessage())
+	return c.handleTelegramMessage(e, update.GetMessage(), false)
 }
 
 func (c *tgBot) onNewTelegramLegacyMessage(ctx context.Context, e tg.Entities, update *tg.UpdateNewMessage) error {
-	return c.handleTelegramMessage(e, update.GetMessage())
+	return c.handleTelegramMessage(e, update.GetMessage(), false)
 }
 
 type messageContext struct {
@@ -202,9 +224,22 @@ type messageContext struct {
 	src    source
 	msg    *tg.Message
 	logger log.Interface
+
+	// topicID is the id of the forum topic where the message was sent
+	topicID int
+
+	// secret is set when the message was sent in a secret chat
+	secret *secretMessage
 }
 
-func (c *tgBot) handleTelegramMessage(e tg.Entities, msg tg.MessageClass) error {
+// isChannelPost checks whether the message is a post in broadcast channel
+func (mc *messageContext) isChannelPost() bool {
+	return mc.src.Chat.IsChannelChat() && mc.msg.GetPost()
+}
+
+// handleTelegramMessage handles new messages, recovered messages are missed ones
+// and only appended to active sessions
+func (c *tgBot) handleTelegramMessage(e tg.Entities, msg tg.MessageClass, recovered bool) error {
 	switch m := msg.(type) {
 	case *tg.MessageEmpty:
 		c.Logger().V("new empty message", log.Uint32("type_id", m.TypeID()))
@@ -213,107 +248,130 @@ func (c *tgBot) handleTelegramMessage(e tg.Entities, msg tg.MessageClass) error
 		c.Logger().V("new service message", log.Uint32("type_id", m.TypeID()))
 		return nil
 	case *tg.Message:
-		var (
-			mc messageContext
-		)
+		mc, ok, err := c.resolveMessageContext(e, m)
+		if !ok {
+			return err
+		}
+
+		c.Logger().V("new message", log.Uint32("type_id", m.TypeID()), log.Bool("pm", mc.src.Chat.IsPrivateChat()))
+
+		if recovered {
+			err = c.appendSessionMessage(mc)
+		} else {
+			err = c.dispatchNewMessage(mc)
+		}
 
-		// resolve chat
-		chat, err := extractPeer(e, m.GetPeerID())
 		if err != nil {
-			c.Logger().E("bad chat of new message", log.Error(err))
-			return err
+			c.Logger().I("bad message", log.Error(err))
 		}
-		mc.src.Chat = resolveChatSpec(chat)
 
-		mc.con = conversationImpl{
-			bot:  c,
-			peer: mc.src.Chat.InputPeer(),
+		return err
+	default:
+		c.Logger().E("unknown new message", log.Uint32("type_id", msg.TypeID()))
+		return nil
+	}
+}
+
+// resolveMessageContext resolves chat and sender of the message, ok is false
+// when the message should be ignored
+func (c *tgBot) resolveMessageContext(e tg.Entities, m *tg.Message) (_ *messageContext, ok bool, err error) {
+	var (
+		mc messageContext
+	)
+
+	// resolve chat
+	chat, err := extractPeer(e, m.GetPeerID())
+	if err != nil {
+		c.Logger().E("bad chat of message", log.Error(err))
+		return nil, false, err
+	}
+	mc.src.Chat = resolveChatSpec(chat)
+	mc.topicID = c.topicOf(&mc.src.Chat, m)
+
+	mc.con = conversationImpl{
+		bot:   c,
+		peer:  mc.src.Chat.InputPeer(),
+		topic: mc.topicID,
+	}
+
+	// resolve sender
+	fromID, ok := m.GetFromID()
+	if ok {
+		var from any
+		from, err = extractPeer(e, fromID)
+		if err != nil {
+			c.Logger().E("bad sender of message", log.Error(err))
+			return nil, false, err
 		}
 
-		c.Logger().V("new message", log.Uint32("type_id", m.TypeID()), log.Bool("pm", mc.src.Chat.IsPrivateChat()))
+		mc.src.From, err = resolveAuthorSpec(from)
+		if err != nil {
+			c.Logger().E("unresolable sender", log.Error(err))
+			return nil, false, err
+		}
+	} else if mc.src.Chat.IsPrivateChat() || mc.src.Chat.IsChannelChat() {
+		// channel posts are sent on behalf of the channel
+		mc.src.From, err = resolveAuthorSpec(chat)
+		if err != nil {
+			c.Logger().E("unresolable sender", log.Error(err))
+			return nil, false, err
+		}
 
-		// resolve sender
-		fromID, ok := m.GetFromID()
-		if ok {
-			var from any
-			from, err = extractPeer(e, fromID)
-			if err != nil {
-				c.Logger().E("bad sender of new message", log.Error(err))
-				return err
-			}
+		if signature, ok := m.GetPostAuthor(); ok {
+			mc.src.From.titile = signature
+		}
+	} else {
+		c.Logger().E("unexpected message sent from anonymous user", rt.LogChatID(mc.src.Chat.ID()))
+		return nil, false, nil
+	}
 
-			mc.src.From, err = resolveAuthorSpec(from)
-			if err != nil {
-				c.Logger().E("unresolable sender", log.Error(err))
-				return err
-			}
-		} else if mc.src.Chat.IsPrivateChat() {
-			mc.src.From, err = resolveAuthorSpec(chat)
+	// resolve orignial chat and sender
+	fwd, ok := m.GetFwdFrom()
+	if ok {
+		var fwdFrom authorInfo
+		if fwdChatID, ok := fwd.GetFromID(); ok {
+			var peer any
+			peer, err = extractPeer(e, fwdChatID)
 			if err != nil {
-				c.Logger().E("unresolable sender", log.Error(err))
-				return err
+				c.Logger().E("bad fwd chat", log.Error(err))
+				return nil, false, err
 			}
-		} else {
-			c.Logger().E("unexpected message sent from anonymous user", rt.LogChatID(mc.src.Chat.ID()))
-			return nil
-		}
 
-		// resolve orignial chat and sender
-		fwd, ok := m.GetFwdFrom()
-		if ok {
-			var fwdFrom authorInfo
-			if fwdChatID, ok := fwd.GetFromID(); ok {
-				var peer any
-				peer, err = extractPeer(e, fwdChatID)
-				if err != nil {
-					c.Logger().E("bad fwd chat", log.Error(err))
-					return err
+			fwdChat := resolveChatSpec(peer)
+			switch {
+			case fwdChat.IsChannelChat(), fwdChat.IsGroupChat():
+				fwdFrom.username, ok = fwd.GetPostAuthor()
+				if ok {
+					fwdFrom.authorFlag |= authorFlag_User
+				} else if fwdChat.IsChannelChat() {
+					fwdFrom.authorFlag |= authorFlag_Channel
+				} else {
+					fwdFrom.authorFlag |= authorFlag_Group
 				}
 
-				fwdChat := resolveChatSpec(peer)
-				switch {
-				case fwdChat.IsChannelChat(), fwdChat.IsGroupChat():
-					fwdFrom.username, ok = fwd.GetPostAuthor()
-					if ok {
-						fwdFrom.authorFlag |= authorFlag_User
-					} else if fwdChat.IsChannelChat() {
-						fwdFrom.authorFlag |= authorFlag_Channel
-					} else {
-						fwdFrom.authorFlag |= authorFlag_Group
-					}
-
-					mc.src.FwdFrom.Set(fwdFrom)
-				case fwdChat.IsLegacyGroupChat():
-					// TODO
-				case fwdChat.IsPrivateChat():
-					fwdFrom, err = resolveAuthorSpec(peer)
-					if err != nil {
-						c.Logger().E("bad fwd user", log.Error(err))
-						return err
-					}
-					mc.src.FwdFrom.Set(fwdFrom)
+				mc.src.FwdFrom.Set(fwdFrom)
+			case fwdChat.IsLegacyGroupChat():
+				// TODO
+			case fwdChat.IsPrivateChat():
+				fwdFrom, err = resolveAuthorSpec(peer)
+				if err != nil {
+					c.Logger().E("bad fwd user", log.Error(err))
+					return nil, false, err
 				}
-
-				mc.src.FwdChat.Set(fwdChat)
+				mc.src.FwdFrom.Set(fwdFrom)
 			}
-		}
-
-		mc.msg = m
-		mc.logger = c.Logger().WithFields(
-			rt.LogChatID(mc.src.Chat.ID()),
-			rt.LogSenderID(mc.src.From.ID()),
-		)
 
-		err = c.dispatchNewMessage(&mc)
-		if err != nil {
-			c.Logger().I("bad message", log.Error(err))
+			mc.src.FwdChat.Set(fwdChat)
 		}
-
-		return err
-	default:
-		c.Logger().E("unknown new message", log.Uint32("type_id", msg.TypeID()))
-		return nil
 	}
+
+	mc.msg = m
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.src.Chat.ID()),
+		rt.LogSenderID(mc.src.From.ID()),
+	)
+
+	return &mc, true, nil
 }
 
 // nolint:gocyclo
@@ -330,8 +388,20 @@ func (c *tgBot) dispatchNewMessage(mc *messageContext) error {
 		mention string
 	)
 
+	if !c.isBot {
+		// running as user account, commands are plain text and only accepted
+		// from the account owner
+		if c.isOwner(mc) {
+			cmd, params, isCmd = parsePlainTextCommand(mc.msg.GetMessage(), c.username)
+		}
+	}
+
 	entities, _ := mc.msg.GetEntities()
 	for _, v := range entities {
+		if !c.isBot {
+			break
+		}
+
 		e, ok := v.(*tg.MessageEntityBotCommand)
 		if !ok {
 			continue
@@ -354,46 +424,68 @@ func (c *tgBot) dispatchNewMessage(mc *messageContext) error {
 
 	// not containing bot command
 	// filter private message for special replies to this bot
-	if mc.src.Chat.IsPrivateChat() {
-		replyToHdr, ok := mc.msg.GetReplyTo()
-		mc.logger.V("check potential input", log.Bool("do_check", ok))
-		if ok {
-			replyTo := rt.MessageID(replyToHdr.ReplyToMsgID)
-			for _, handle := range [...]inputHandleFunc{
-				c.tryToHandleInputForDiscussOrContinue,
-				c.tryToHandleInputForEditing,
-				c.tryToHandleInputForListing,
-				c.tryToHandleInputForDeleting,
-			} {
-				done, err := handle(mc, replyTo)
-				if done {
-					return err
-				}
-			}
-		}
+	handled, err := c.engine.HandleInput(mc)
+	if handled {
+		return err
 	}
 
 	return c.appendSessionMessage(mc)
 }
 
+// isOwner checks whether the message is sent by the logged in user account
+//
+// the account owner cannot send messages to secret chats from other devices,
+// so the other user of a secret chat accepted by the account is trusted, see
+// isSecretChatOwner
+func (c *tgBot) isOwner(mc *messageContext) bool {
+	if mc.src.Chat.IsSecretChat() {
+		return c.isSecretChatOwner(mc)
+	}
+
+	return mc.msg.GetOut() || mc.src.From.ID() == rt.UserID(c.selfID)
+}
+
+// parsePlainTextCommand parses text in the form of `/cmd[@username] [params]`,
+// command mentioning others is not a command for us
+func parsePlainTextCommand(text, username string) (cmd, params string, ok bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return
+	}
+
+	cmd = text
+	if i := strings.IndexFunc(text, unicode.IsSpace); i > 0 {
+		cmd, params = text[:i], text[i:]
+	}
+
+	cmd, mention, found := strings.Cut(cmd, "@")
+	if len(cmd) == 1 || (found && mention != username) {
+		return "", "", false
+	}
+
+	return cmd, strings.TrimSpace(params), true
+}
+
 func (c *tgBot) appendSessionMessage(mc *messageContext) (err error) {
 	mc.logger.V("check active session")
-	s, ok := c.sessions.GetActiveSession(mc.src.Chat.ID())
+	s, ok := c.sessions.ActiveSessionOf(mc.Chat())
 	if !ok {
 		return nil
 	}
 
+	c.trackLegacyChat(mc)
+
+	if groupedID, ok := mc.msg.GetGroupedID(); ok {
+		c.appendAlbumMessage(mc, s, groupedID)
+		return nil
+	}
+
 	mc.logger.V("append session message")
 	m := newMessageFromTelegramMessage(mc)
 
 	err = c.fillMessageSpans(mc, s.Workflow(), m)
 	if err != nil {
-		_, _ = c.sendTextMessage(
-			c.sender.To(mc.src.Chat.InputPeer()).NoWebpage().Silent().Reply(mc.msg.GetID()),
-			styling.Plain("Internal bot error: "),
-			styling.Bold(err.Error()),
-		)
-
+		c.sendErrorf(mc, "%v", err)
 		return
 	}
 
@@ -402,13 +494,22 @@ func (c *tgBot) appendSessionMessage(mc *messageContext) (err error) {
 	return nil
 }
 
+// trackLegacyChat records the chat of mc if it's a private chat or legacy group,
+// secret chats are not tracked
+func (c *tgBot) trackLegacyChat(mc *messageContext) {
+	chat := &mc.src.Chat
+	if !chat.IsSecretChat() && (chat.IsPrivateChat() || chat.IsLegacyGroupChat()) {
+		c.legacyChats.Store(chat.ID(), struct{}{})
+	}
+}
+
 // handleBotCmd handles single command with all params as a single string
-// nolint:gocyclo
 func (c *tgBot) handleBotCmd(
 	mc *messageContext, cmd, params string,
 ) error {
 	mc.logger.V("handle bot command", log.String("cmd", cmd))
-	if !mc.src.From.IsUser() {
+	c.trackLegacyChat(mc)
+	if !mc.src.From.IsUser() && !mc.isChannelPost() {
 		_, _ = c.sendTextMessage(
 			c.sender.To(mc.src.Chat.InputPeer()).NoWebpage().Silent().Reply(mc.msg.GetID()),
 			styling.Plain("Anonymous user not allowed"),
@@ -417,98 +518,23 @@ func (c *tgBot) handleBotCmd(
 		return nil
 	}
 
-	wf, ok := c.wfSet.WorkflowFor(cmd)
-	if !ok {
-		msgID, _ := c.sendTextMessage(
-			c.sender.To(mc.src.Chat.InputPeer()).NoWebpage().Silent().Reply(mc.msg.GetID()),
-			styling.Plain("Unknown command: "),
-			styling.Code(cmd),
-		)
-
-		c.scheduleMessageDelete(&mc.src.Chat, 5*time.Second, msgID, rt.MessageID(mc.msg.GetID()))
-		return nil
-	}
-
-	if wf.RequireAdmin() && !mc.src.Chat.IsPrivateChat() {
-		// ensure only admin can use this bot in group
-
-		if mc.src.Chat.IsLegacyGroupChat() {
-			_, _ = c.sendTextMessage(
-				c.sender.To(mc.src.Chat.InputPeer()).NoWebpage().Silent().Reply(mc.msg.GetID()),
-				styling.Plain("Unsupported chat type: please consider upgrading this chat to supergroup."),
-			)
-
-			return nil
-		}
-
-		pt, err := c.client.API().ChannelsGetParticipant(c.Context(), &tg.ChannelsGetParticipantRequest{
-			Channel: &tg.InputChannel{
-				ChannelID:  mc.src.Chat.InputPeer().(*tg.InputPeerChannel).GetChannelID(),
-				AccessHash: mc.src.Chat.InputPeer().(*tg.InputPeerChannel).GetAccessHash(),
-			},
-			Participant: &tg.InputPeerUser{
-				UserID:     mc.src.From.InputUser().GetUserID(),
-				AccessHash: mc.src.From.InputUser().GetAccessHash(),
-			},
-		})
-		if err != nil || len(pt.Users) != 1 {
-			_, _ = c.sendTextMessage(
-				c.sender.To(mc.src.Chat.InputPeer()).NoWebpage().Silent().Reply(mc.msg.GetID()),
-				styling.Plain("Internal bot error: "),
-				styling.Code("unable to verify the initiator."),
-			)
-			return err
-		}
-
-		switch pt.GetParticipant().(type) {
-		case *tg.ChannelParticipantCreator:
-		case *tg.ChannelParticipantAdmin:
-		default:
-			msgID, _ := c.sendTextMessage(
-				c.sender.To(mc.src.Chat.InputPeer()).NoWebpage().Silent().Reply(mc.msg.GetID()),
-				styling.Plain("Only administrators can use this bot in group chat"),
-			)
-
-			c.scheduleMessageDelete(&mc.src.Chat, 5*time.Second, msgID, rt.MessageID(mc.msg.GetID()))
-			return nil
-		}
-	}
-
-	switch bc := wf.BotCommands.Parse(cmd); bc {
-	case rt.BotCmd_New:
-		return c.handleBotCmd_Discuss(mc, wf, cmd, params)
-	case rt.BotCmd_Resume:
-		return c.handleBotCmd_Continue(mc, wf, cmd, params)
-	case rt.BotCmd_Start:
-		return c.handleBotCmd_Start(mc, wf, params)
-	case rt.BotCmd_Cancel:
-		return c.handleBotCmd_Cancel(mc, wf, cmd, params)
-	case rt.BotCmd_End:
-		return c.handleBotCmd_End(mc, wf, cmd, params)
-	case rt.BotCmd_Include:
-		return c.handleBotCmd_Include(mc, wf, cmd, params)
-	case rt.BotCmd_Ignore:
-		return c.handleBotCmd_Ignore(mc, wf, cmd, params)
-	case rt.BotCmd_Edit:
-		return c.handleBotCmd_Edit(mc, wf, cmd, params)
-	case rt.BotCmd_Delete:
-		return c.handleBotCmd_Delete(mc, wf, cmd, params)
-	case rt.BotCmd_List:
-		return c.handleBotCmd_List(mc, wf, cmd, params)
-	case rt.BotCmd_Help:
-		return c.handleBotCmd_Help(mc)
-	default:
-		mc.logger.E("unhandled cmd", log.String("cmd", cmd))
-
-		_, err := c.sendTextMessage(
-			c.sender.To(mc.src.Chat.InputPeer()).NoWebpage().Silent().Reply(mc.msg.GetID()),
-			styling.Plain("Internal bot error: "),
-			styling.Bold(cmd),
-			styling.Bold(" not handled."),
-		)
-
+	handled, err := c.engine.HandleBotCmd(mc, cmd, params)
+	if handled {
 		return err
 	}
+
+	msgIDs, _ := mc.con.SendMessage(c.Context(), rt.SendMessageOptions{
+		ReplyTo:        mc.MessageID(),
+		NoNotification: true,
+		NoWebPreview:   true,
+		Body: []rt.Span{
+			{Text: "Unknown command: "},
+			{Flags: rt.SpanFlag_Code, Text: cmd},
+		},
+	})
+
+	c.scheduleMessageDelete(&mc.src.Chat, 5*time.Second, append(msgIDs, mc.MessageID())...)
+	return nil
 }
 
 func expectExactOneMessage(msgs []tg.MessageClass) (*tg.Message, error) {
@@ -0,0 +1,58 @@
+package telegram
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+)
+
+// maxCallbackAnswerLength is the max length of the answer text
+const maxCallbackAnswerLength = 200
+
+// onBotCallbackQuery calls the OnClick callback of the clicked button, and
+// answers the query with the result
+func (c *tgBot) onBotCallbackQuery(ctx context.Context, e tg.Entities, update *tg.UpdateBotCallbackQuery) error {
+	logger := c.Logger().WithFields(
+		log.Int64("user_id", update.GetUserID()),
+		log.Int("msg_id", update.GetMsgID()),
+	)
+
+	data, _ := update.GetData()
+	onClick, ok := c.callbacks.Find(string(data))
+	if !ok {
+		logger.V("callback not found")
+		c.answerCallbackQuery(logger, update.GetQueryID(), "This button has expired.", true)
+		return nil
+	}
+
+	go func() {
+		err := onClick()
+		if err != nil {
+			logger.I("failed to handle button click", log.Error(err))
+			c.answerCallbackQuery(logger, update.GetQueryID(), "Failed: "+err.Error(), true)
+			return
+		}
+
+		c.answerCallbackQuery(logger, update.GetQueryID(), "Done.", false)
+	}()
+
+	return nil
+}
+
+// answerCallbackQuery shows text as notification (toast) or alert to the user
+func (c *tgBot) answerCallbackQuery(logger log.Interface, queryID int64, text string, alert bool) {
+	if utf8.RuneCountInString(text) > maxCallbackAnswerLength {
+		text = string([]rune(text)[:maxCallbackAnswerLength-1]) + "…"
+	}
+
+	_, err := c.client.API().MessagesSetBotCallbackAnswer(c.Context(), &tg.MessagesSetBotCallbackAnswerRequest{
+		Alert:   alert,
+		QueryID: queryID,
+		Message: text,
+	})
+	if err != nil {
+		logger.I("failed to answer callback query", log.Error(err))
+	}
+}
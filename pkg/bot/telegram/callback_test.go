@@ -0,0 +1,86 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// fakeCallbackAnswerInvoker sends answers of callback queries to the channel
+type fakeCallbackAnswerInvoker chan *tg.MessagesSetBotCallbackAnswerRequest
+
+func (f fakeCallbackAnswerInvoker) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	req, ok := input.(*tg.MessagesSetBotCallbackAnswerRequest)
+	if !ok {
+		return fmt.Errorf("unexpected request %T", input)
+	}
+
+	f <- req
+	output.(*tg.BoolBox).Bool = &tg.BoolTrue{}
+	return nil
+}
+
+func TestOnBotCallbackQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	answers := make(fakeCallbackAnswerInvoker, 1)
+	c := &tgBot{
+		BaseBot:   bot.NewBotBase(rt.NewContext(ctx, log.NoOpLogger, nil)),
+		callbacks: bot.NewCallbackRegistry(ctx, 0, 0),
+		client: telegram.NewClient(1, "test", telegram.Options{
+			Middlewares: []telegram.Middleware{
+				telegram.MiddlewareFunc(func(tg.Invoker) telegram.InvokeFunc { return answers.Invoke }),
+			},
+		}),
+	}
+
+	clicked := 0
+	id, err := c.callbacks.Add(func() error { clicked++; return nil })
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	failed, err := c.callbacks.Add(func() error { return errors.New("oops") })
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	query := func(data string) *tg.MessagesSetBotCallbackAnswerRequest {
+		update := &tg.UpdateBotCallbackQuery{QueryID: 1, UserID: 1, MsgID: 1}
+		update.SetData([]byte(data))
+		assert.NoError(t, c.onBotCallbackQuery(ctx, tg.Entities{}, update))
+
+		select {
+		case req := <-answers:
+			return req
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "callback query not answered")
+			return nil
+		}
+	}
+
+	req := query(id)
+	assert.Equal(t, "Done.", req.Message)
+	assert.False(t, req.Alert)
+	assert.Equal(t, 1, clicked)
+
+	req = query(failed)
+	assert.Equal(t, "Failed: oops", req.Message)
+	assert.True(t, req.Alert)
+
+	req = query("unknown")
+	assert.Equal(t, "This button has expired.", req.Message)
+	assert.True(t, req.Alert)
+}
@@ -0,0 +1,91 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestResolveChannelPost(t *testing.T) {
+	c := &tgBot{}
+	c.BaseBot = bot.NewBotBase(rt.NewContext(context.TODO(), log.NoOpLogger, nil))
+
+	channel := &tg.Channel{ID: 1, Title: "news"}
+	channel.SetBroadcast(true)
+	e := tg.Entities{Channels: map[int64]*tg.Channel{channel.ID: channel}}
+
+	post := &tg.Message{ID: 10, PeerID: &tg.PeerChannel{ChannelID: channel.ID}, Message: "/start"}
+	post.SetPost(true)
+
+	mc, ok, err := c.resolveMessageContext(e, post)
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.True(t, mc.isChannelPost())
+		assert.True(t, mc.src.Chat.IsChannelChat())
+		assert.Equal(t, "news", mc.src.From.Title())
+
+		isAdmin, err := adapter{c: c}.IsAdmin(mc)
+		assert.NoError(t, err)
+		assert.True(t, isAdmin)
+	}
+
+	post.SetPostAuthor("alice")
+	mc, ok, err = c.resolveMessageContext(e, post)
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "alice", mc.src.From.Title())
+	}
+
+	// messages in discussion groups are not channel posts
+	group := &tg.Channel{ID: 2, Title: "chat", Megagroup: true}
+	e.Channels[group.ID] = group
+
+	msg := &tg.Message{ID: 11, PeerID: &tg.PeerChannel{ChannelID: group.ID}}
+	msg.SetFromID(&tg.PeerChannel{ChannelID: channel.ID})
+
+	mc, ok, err = c.resolveMessageContext(e, msg)
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.False(t, mc.isChannelPost())
+		assert.Equal(t, "news", mc.src.From.Title())
+	}
+}
+
+func TestExtractPeer(t *testing.T) {
+	var (
+		alice   = &tg.User{ID: 1, FirstName: "alice"}
+		channel = &tg.Channel{ID: 2, Title: "news"}
+		group   = &tg.Chat{ID: 3, Title: "group"}
+	)
+
+	e := tg.Entities{
+		Users:    map[int64]*tg.User{alice.ID: alice},
+		Channels: map[int64]*tg.Channel{channel.ID: channel},
+		Chats:    map[int64]*tg.Chat{group.ID: group},
+	}
+
+	for _, test := range []struct {
+		peer     tg.PeerClass
+		expected any
+	}{
+		{peer: &tg.PeerUser{UserID: alice.ID}, expected: alice},
+		{peer: &tg.PeerChannel{ChannelID: channel.ID}, expected: channel},
+		{peer: &tg.PeerChat{ChatID: group.ID}, expected: group},
+	} {
+		peer, err := extractPeer(e, test.peer)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, peer)
+	}
+
+	for _, p := range []tg.PeerClass{
+		&tg.PeerUser{UserID: 10},
+		&tg.PeerChannel{ChannelID: 10},
+		&tg.PeerChat{ChatID: 10},
+	} {
+		_, err := extractPeer(e, p)
+		assert.Error(t, err)
+	}
+}
@@ -21,6 +21,13 @@ type conversationImpl struct {
 	bot *tgBot
 
 	peer tg.InputPeerClass
+
+	// topic is the id of the forum topic, messages not replying to others are
+	// sent as replies to it
+	topic int
+
+	// secret is the id of the secret chat, messages are sent encrypted when set
+	secret int
 }
 
 type uploadResult struct {
@@ -35,6 +42,10 @@ func (c *conversationImpl) Context() context.Context {
 
 // SendMessage implements rt.Conversation
 func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) (msgIDs []rt.MessageID, err error) {
+	if c.secret != 0 {
+		return c.bot.sendSecretMessage(ctx, c.secret, opts)
+	}
+
 	var (
 		text  []styling.StyledTextOption
 		media []message.MultiMediaOption
@@ -47,9 +58,15 @@ func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageO
 	)
 
 	sz := len(opts.Body)
-	builder := c.bot.sender.To(c.peer).Reply(int(opts.ReplyTo))
+	replyTo := int(opts.ReplyTo)
+	if replyTo == 0 {
+		replyTo = c.topic
+	}
+
+	builder := c.bot.sender.To(c.peer).Reply(replyTo)
 
-	if len(opts.Callbacks) != 0 {
+	// reply markup is only available to bots
+	if len(opts.Callbacks) != 0 && c.bot.isBot {
 		var markup tg.ReplyInlineMarkup
 
 		markup.Rows = make([]tg.KeyboardButtonRow, len(opts.Callbacks))
@@ -58,10 +75,15 @@ func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageO
 			for j, cb := range cbs {
 				switch {
 				case !cb.OnClick.IsNil():
-					// TODO: support callback
+					var id string
+					id, err = c.bot.callbacks.Add(cb.OnClick.Get())
+					if err != nil {
+						return nil, fmt.Errorf("add callback: %w", err)
+					}
+
 					markup.Rows[i].Buttons[j] = &tg.KeyboardButtonCallback{
 						Text: cb.Text,
-						Data: []byte{},
+						Data: []byte(id),
 					}
 				case !cb.URL.IsNil():
 					markup.Rows[i].Buttons[j] = &tg.KeyboardButtonURL{
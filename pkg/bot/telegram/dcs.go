@@ -0,0 +1,96 @@
+package telegram
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/gotd/td/telegram/dcs"
+	"github.com/gotd/td/tg"
+	"golang.org/x/net/proxy"
+)
+
+// dcList converts configured servers to dcs.List, zero value is returned when
+// there is no server configured, which means built-in production DCs
+func (c *Config) dcList() (dcs.List, error) {
+	var ret dcs.List
+	for i, s := range c.Servers {
+		host, portStr, err := net.SplitHostPort(s.Address)
+		if err != nil {
+			return ret, fmt.Errorf("servers[%d]: %w", i, err)
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return ret, fmt.Errorf("servers[%d]: invalid port %q", i, portStr)
+		}
+
+		if i != 0 && s.Test != ret.Test {
+			return ret, fmt.Errorf("servers[%d]: servers in test and production DCs are mixed", i)
+		}
+		ret.Test = s.Test
+
+		dc := s.DC
+		if dc == 0 {
+			dc = c.DC
+		}
+
+		if dc == 0 {
+			return ret, fmt.Errorf("servers[%d]: dc id is required", i)
+		}
+
+		ip := net.ParseIP(host)
+		ret.Options = append(ret.Options, tg.DCOption{
+			Ipv6:      ip != nil && ip.To4() == nil,
+			ID:        dc,
+			IPAddress: host,
+			Port:      int(port),
+		})
+	}
+
+	return ret, nil
+}
+
+// resolver creates dcs.Resolver with proxy settings
+func (c *Config) resolver() (dcs.Resolver, error) {
+	var dial dcs.DialFunc
+
+	if len(c.Proxy.SOCKS5) != 0 {
+		u, err := url.Parse(c.Proxy.SOCKS5)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5 proxy url: %w", err)
+		}
+
+		if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+
+		d, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("create socks5 dialer: %w", err)
+		}
+
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("unexpected non context dialer %T", d)
+		}
+
+		dial = cd.DialContext
+	}
+
+	if mtp := &c.Proxy.MTProxy; len(mtp.Address) != 0 {
+		secret, err := hex.DecodeString(mtp.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mtproxy secret: %w", err)
+		}
+
+		return dcs.MTProxy(mtp.Address, secret, dcs.MTProxyOptions{Dial: dial})
+	}
+
+	return dcs.Plain(dcs.PlainOptions{
+		Dial:       dial,
+		PreferIPv6: c.PreferIPv6,
+	}), nil
+}
@@ -0,0 +1,207 @@
+package telegram
+
+import (
+	"context"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+func (c *tgBot) onEditTelegramLegacyMessage(ctx context.Context, e tg.Entities, update *tg.UpdateEditMessage) error {
+	return c.handleTelegramMessageEdit(e, update.GetMessage())
+}
+
+func (c *tgBot) onEditTelegramChannelMessage(ctx context.Context, e tg.Entities, update *tg.UpdateEditChannelMessage) error {
+	return c.handleTelegramMessageEdit(e, update.GetMessage())
+}
+
+func (c *tgBot) onDeleteTelegramLegacyMessages(ctx context.Context, e tg.Entities, update *tg.UpdateDeleteMessages) error {
+	c.Logger().V("messages deleted", log.Ints("msg_ids", update.GetMessages()))
+
+	// private chats and legacy groups share the same message id sequence, while
+	// channels and secret chats have their own
+	c.sessions.RangeActiveSessions(func(chatID rt.ChatID, s *session.Session) bool {
+		if _, isLegacy := c.legacyChats.Load(chatID); isLegacy {
+			c.deleteSessionMessages(s, update.GetMessages())
+		}
+
+		return true
+	})
+
+	return nil
+}
+
+func (c *tgBot) onDeleteTelegramChannelMessages(ctx context.Context, e tg.Entities, update *tg.UpdateDeleteChannelMessages) error {
+	chatID := rt.ChatID(update.GetChannelID())
+	c.Logger().V("channel messages deleted", rt.LogChatID(chatID), log.Ints("msg_ids", update.GetMessages()))
+
+	// sessions of all topics in the channel
+	c.sessions.RangeActiveSessions(func(id rt.ChatID, s *session.Session) bool {
+		if id == chatID {
+			c.deleteSessionMessages(s, update.GetMessages())
+		}
+
+		return true
+	})
+
+	return nil
+}
+
+func (c *tgBot) deleteSessionMessages(s *session.Session, msgIDs []int) {
+	for _, id := range msgIDs {
+		c.deleteSessionMessage(s, rt.MessageID(id))
+	}
+}
+
+// deleteSessionMessage removes the message from the session and disposes it
+func (c *tgBot) deleteSessionMessage(s *session.Session, msgID rt.MessageID) {
+	m, ok := s.GetMessage(msgID)
+	if !ok || !s.DeleteMessage(msgID) {
+		return
+	}
+
+	c.disposeWhenReady(m)
+}
+
+// handleTelegramMessageEdit replaces the edited message in the active session
+func (c *tgBot) handleTelegramMessageEdit(e tg.Entities, msg tg.MessageClass) error {
+	m, ok := msg.(*tg.Message)
+	if !ok {
+		c.Logger().V("ignored message edit", log.Uint32("type_id", msg.TypeID()))
+		return nil
+	}
+
+	mc, ok, err := c.resolveMessageContext(e, m)
+	if !ok {
+		return err
+	}
+
+	s, ok := c.sessions.ActiveSessionOf(mc.Chat())
+	if !ok {
+		return nil
+	}
+
+	current, ok := s.GetMessage(rt.MessageID(m.GetID()))
+	if !ok {
+		// not a session message
+		return nil
+	}
+
+	mc.logger.V("edit session message", log.Int("msg_id", m.GetID()))
+	edited := newMessageFromTelegramMessage(mc)
+	if editDate, ok := m.GetEditDate(); ok {
+		edited.EditTimestamp = time.Unix(int64(editDate), 0).UTC()
+	}
+
+	isAlbum := current.IsAlbum()
+	if isAlbum {
+		if !current.Ready() {
+			mc.logger.D("ignored edit of incomplete album")
+			return nil
+		}
+
+		// only caption of the album can be edited, keep media of all parts
+		edited.Flags |= rt.MessageFlag_Album
+		if len(edited.Text) != 0 {
+			edited.Spans = parseTextEntities(edited.Text, m.Entities)
+		}
+
+		for _, span := range current.Spans {
+			if span.IsMedia() {
+				edited.Spans = append(edited.Spans, span)
+			}
+		}
+	} else {
+		err = c.fillMessageSpans(mc, s.Workflow(), edited)
+		if err != nil {
+			mc.logger.I("failed to fill edited message", log.Error(err))
+			return err
+		}
+	}
+
+	prev, ok := s.ReplaceMessage(edited)
+	if !ok {
+		// deleted meanwhile
+		if !isAlbum {
+			c.disposeWhenReady(edited)
+		}
+
+		return nil
+	}
+
+	switch {
+	case s.Workflow().KeepEditHistory():
+		version := prev.Version()
+		if isAlbum {
+			// media is shared with the edited one, the version has its own
+			// readers to be disposed separately
+			version.Spans = c.copyMediaSpans(version.Spans)
+		}
+
+		edited.Edits = append(prev.Edits, version)
+	case isAlbum:
+		// media is shared with the edited one
+	default:
+		c.disposeWhenReady(prev)
+	}
+
+	return nil
+}
+
+// copyMediaSpans copies spans with media data opened again from the cache,
+// media data is dropped when not available in the cache
+func (c *tgBot) copyMediaSpans(spans []rt.Span) []rt.Span {
+	ret := make([]rt.Span, len(spans))
+	copy(ret, spans)
+
+	for i := range ret {
+		data := ret[i].Data
+		if data == nil {
+			continue
+		}
+
+		ret[i].Data = nil
+
+		cache := c.Cache()
+		if cache == nil {
+			continue
+		}
+
+		rd, err := cache.Open(data.ID())
+		if err != nil {
+			c.Logger().I("failed to open cached media", log.Error(err))
+			continue
+		}
+
+		ret[i].Data = rd
+	}
+
+	return ret
+}
+
+// disposeWhenReady disposes m after its workers (e.g. media downloads) finished
+func (c *tgBot) disposeWhenReady(m *rt.Message) {
+	if m.Ready() {
+		m.Dispose()
+		return
+	}
+
+	go func() {
+		tk := time.NewTicker(time.Second)
+		defer tk.Stop()
+
+		for !m.Ready() {
+			select {
+			case <-c.Context().Done():
+				return
+			case <-tk.C:
+			}
+		}
+
+		m.Dispose()
+	}()
+}
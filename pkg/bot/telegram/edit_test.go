@@ -0,0 +1,201 @@
+package telegram
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+func TestMessageEditAndDelete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var (
+		alice = &tg.User{ID: 1, FirstName: "alice"}
+		group = &tg.Channel{ID: 2, Title: "group", Megagroup: true}
+
+		wf = &bot.Workflow{}
+	)
+
+	c := &tgBot{sessions: session.NewManager[chatIDWrapper](ctx)}
+	c.BaseBot = bot.NewBotBase(rt.NewContext(ctx, log.NoOpLogger, nil))
+
+	activate := func(chat tg.InputPeerClass) *session.Session {
+		chatID := chatIDWrapper{chat: chat}.ID()
+		assert.True(t, c.sessions.MarkSessionStandby(wf, 1, chatIDWrapper{chat: chat}, "", false, time.Minute))
+		s, err := c.sessions.ActivateSession(wf, 1, chatID, nil)
+		assert.NoError(t, err)
+		return s
+	}
+
+	pm := activate(alice.AsInputPeer())
+	gs := activate(group.AsInputPeer())
+	c.legacyChats.Store(rt.ChatID(alice.ID), struct{}{})
+
+	secret := chatIDWrapper{chat: alice.AsInputPeer(), secret: 5}
+	assert.True(t, c.sessions.MarkSessionStandby(wf, 2, secret, "", false, time.Minute))
+	ss, err := c.sessions.ActivateSession(wf, 2, secret.ID(), nil)
+	assert.NoError(t, err)
+
+	for _, s := range []*session.Session{pm, gs, ss} {
+		for i := 1; i <= 3; i++ {
+			s.AppendMessage(&rt.Message{ID: rt.MessageID(i), Text: "foo"})
+		}
+	}
+
+	e := tg.Entities{
+		Users:    map[int64]*tg.User{alice.ID: alice},
+		Channels: map[int64]*tg.Channel{group.ID: group},
+	}
+
+	edited := &tg.Message{
+		ID:      2,
+		PeerID:  &tg.PeerChannel{ChannelID: group.ID},
+		Date:    100,
+		Message: "bar",
+	}
+	edited.SetFromID(&tg.PeerUser{UserID: alice.ID})
+	edited.SetEditDate(200)
+
+	assert.NoError(t, c.onEditTelegramChannelMessage(ctx, e, &tg.UpdateEditChannelMessage{Message: edited}))
+
+	m, ok := gs.GetMessage(2)
+	if assert.True(t, ok) {
+		assert.Equal(t, "bar", m.Text)
+		assert.True(t, m.IsEdited())
+		assert.Equal(t, time.Unix(200, 0).UTC(), m.EditTimestamp)
+		assert.Empty(t, m.Edits)
+	}
+
+	// not a session message
+	edited.ID = 4
+	assert.NoError(t, c.onEditTelegramChannelMessage(ctx, e, &tg.UpdateEditChannelMessage{Message: edited}))
+	assert.Len(t, gs.GetMessages(), 3)
+
+	// channels and secret chats are not affected
+	assert.NoError(t, c.onDeleteTelegramLegacyMessages(ctx, e, &tg.UpdateDeleteMessages{Messages: []int{1, 3}}))
+	assert.Len(t, pm.GetMessages(), 1)
+	assert.Len(t, gs.GetMessages(), 3)
+	assert.Len(t, ss.GetMessages(), 3)
+
+	assert.NoError(t, c.onDeleteTelegramChannelMessages(ctx, e, &tg.UpdateDeleteChannelMessages{
+		ChannelID: group.ID,
+		Messages:  []int{2},
+	}))
+	assert.Len(t, pm.GetMessages(), 1)
+	assert.Len(t, gs.GetMessages(), 2)
+
+	// media of deleted messages is disposed
+	data := &testCacheReader{closed: make(chan struct{})}
+	m = rt.NewMessage()
+	m.ID = 5
+	m.Spans = []rt.Span{{Flags: rt.SpanFlag_Image}}
+	m.Spans[0].Data = data
+	gs.AppendMessage(m)
+
+	assert.NoError(t, c.onDeleteTelegramChannelMessages(ctx, e, &tg.UpdateDeleteChannelMessages{
+		ChannelID: group.ID,
+		Messages:  []int{5},
+	}))
+	assert.Len(t, gs.GetMessages(), 2)
+	select {
+	case <-data.closed:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "deleted message not disposed")
+	}
+}
+
+func TestCopyMediaSpans(t *testing.T) {
+	cache, err := rt.NewCache(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	wr, err := cache.NewWriter()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = wr.Write([]byte("foo"))
+	assert.NoError(t, err)
+	assert.NoError(t, wr.Close())
+
+	data, err := cache.Open(wr.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	c := &tgBot{}
+	c.BaseBot = bot.NewBotBase(rt.NewContext(context.TODO(), log.NoOpLogger, cache))
+
+	spans := []rt.Span{{Text: "foo"}, {Flags: rt.SpanFlag_Image}}
+	spans[1].Data = data
+
+	copied := c.copyMediaSpans(spans)
+	if !assert.Len(t, copied, 2) || !assert.NotNil(t, copied[1].Data) {
+		return
+	}
+	assert.Equal(t, "foo", copied[0].Text)
+	assert.Equal(t, data.ID(), copied[1].Data.ID())
+	assert.True(t, copied[1].Data != data)
+
+	// copies are closed separately
+	assert.NoError(t, data.Close())
+	content, err := io.ReadAll(copied[1].Data)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(content))
+	assert.NoError(t, copied[1].Data.Close())
+
+	// media data is dropped without cache
+	c.BaseBot = bot.NewBotBase(rt.NewContext(context.TODO(), log.NoOpLogger, nil))
+	copied = c.copyMediaSpans(spans)
+	assert.Nil(t, copied[1].Data)
+	assert.Equal(t, data, spans[1].Data)
+}
+
+type testCacheReader struct {
+	rt.CacheReader
+
+	closed chan struct{}
+}
+
+func (r *testCacheReader) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func TestDisposeWhenReady(t *testing.T) {
+	c := &tgBot{}
+	c.BaseBot = bot.NewBotBase(rt.NewContext(context.TODO(), log.NoOpLogger, nil))
+
+	data := &testCacheReader{closed: make(chan struct{})}
+	m := rt.NewMessage()
+	m.Spans = []rt.Span{{Flags: rt.SpanFlag_Image}}
+	m.Spans[0].Data = data
+
+	// media still downloading
+	downloaded := make(chan struct{})
+	m.AddWorker(func(_ rt.Signal, m *rt.Message) { <-downloaded })
+
+	c.disposeWhenReady(m)
+	select {
+	case <-data.closed:
+		assert.Fail(t, "disposed before ready")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(downloaded)
+	select {
+	case <-data.closed:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "not disposed after ready")
+	}
+}
@@ -0,0 +1,247 @@
+package telegram
+
+import (
+	"fmt"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+var (
+	_ engine.Message[chatIDWrapper]                  = (*messageContext)(nil)
+	_ engine.Adapter[chatIDWrapper, *messageContext] = (*adapter)(nil)
+	_ engine.Prompter[chatIDWrapper]                 = (*adapter)(nil)
+)
+
+func (mc *messageContext) IsPrivate() bool               { return mc.src.Chat.IsPrivateChat() }
+func (mc *messageContext) SenderID() rt.UserID           { return mc.src.From.ID() }
+func (mc *messageContext) MessageID() rt.MessageID       { return rt.MessageID(mc.msg.GetID()) }
+func (mc *messageContext) InputText() string             { return mc.msg.GetMessage() }
+func (mc *messageContext) Conversation() rt.Conversation { return &mc.con }
+func (mc *messageContext) Logger() log.Interface         { return mc.logger }
+
+func (mc *messageContext) Chat() chatIDWrapper {
+	return chatIDWrapper{chat: mc.src.Chat.InputPeer(), topic: mc.topicID, secret: mc.src.Chat.secret}
+}
+
+func (mc *messageContext) ChatName() string {
+	if title := mc.src.Chat.Title(); len(title) != 0 {
+		return title
+	}
+
+	return mc.src.Chat.Username()
+}
+
+func (mc *messageContext) ReplyTo() rt.MessageID {
+	replyTo, ok := mc.msg.GetReplyTo()
+	if !ok {
+		return 0
+	}
+
+	msgID := replyTo.GetReplyToMsgID()
+	if _, hasTop := replyTo.GetReplyToTopID(); !hasTop && msgID == mc.topicID {
+		// not a reply, but a message in the topic
+		return 0
+	}
+
+	return rt.MessageID(msgID)
+}
+
+// adapter implements engine.Adapter for telegram
+type adapter struct {
+	c *tgBot
+}
+
+func (a adapter) Reply(mc *messageContext, body ...rt.Span) (rt.MessageID, error) {
+	msgIDs, err := mc.con.SendMessage(a.c.Context(), rt.SendMessageOptions{
+		ReplyTo:        mc.MessageID(),
+		NoNotification: true,
+		NoWebPreview:   true,
+		Body:           body,
+	})
+	if len(msgIDs) == 0 {
+		return 0, err
+	}
+
+	return msgIDs[0], err
+}
+
+func (a adapter) Conversation(chat chatIDWrapper) rt.Conversation {
+	return &conversationImpl{bot: a.c, peer: chat.chat, topic: chat.topic, secret: chat.secret}
+}
+
+func (a adapter) DeleteAfter(chat chatIDWrapper, delay time.Duration, msgIDs ...rt.MessageID) {
+	if chat.secret != 0 {
+		// messages in secret chats are not deleted by the server
+		return
+	}
+
+	a.c.scheduleMessageDelete(&chatInfo{peer: chat.chat, commonInfo: commonInfo[rt.ChatID]{id: chat.ID()}}, delay, msgIDs...)
+}
+
+// Prompt sends message with force reply markup, so users can reply with token directly
+func (a adapter) Prompt(chat chatIDWrapper, placeholder string, body ...rt.Span) (rt.MessageID, error) {
+	if chat.secret != 0 {
+		// no reply markup in secret chats
+		msgIDs, err := a.c.sendSecretMessage(a.c.Context(), chat.secret, rt.SendMessageOptions{
+			NoWebPreview: true,
+			Body:         body,
+		})
+		if len(msgIDs) == 0 {
+			return 0, err
+		}
+
+		return msgIDs[0], err
+	}
+
+	builder := a.c.sender.To(chat.chat).NoWebpage()
+	if chat.topic != 0 {
+		builder = builder.Reply(chat.topic)
+	}
+
+	if a.c.isBot {
+		builder = builder.Markup(&tg.ReplyKeyboardForceReply{
+			SingleUse:   true,
+			Selective:   true,
+			Placeholder: placeholder,
+		})
+	}
+
+	return a.c.sendTextMessage(builder, translateTextSpans(body)...)
+}
+
+// PrivateChatOf returns the private chat with the sender, the bot can only send
+// messages to users started it before
+func (a adapter) PrivateChatOf(mc *messageContext) (chatIDWrapper, bool, error) {
+	user := mc.src.From.InputUser()
+	if user == nil {
+		return chatIDWrapper{}, false, nil
+	}
+
+	return chatIDWrapper{chat: &tg.InputPeerUser{
+		UserID:     user.GetUserID(),
+		AccessHash: user.GetAccessHash(),
+	}}, true, nil
+}
+
+// PrivateChatLink returns the deep link starting the bot, start params are not
+// available to user accounts
+func (a adapter) PrivateChatLink(startParams string) (string, bool) {
+	if !a.c.isBot || len(a.c.username) == 0 {
+		return "", false
+	}
+
+	return fmt.Sprintf("https://t.me/%s?start=%s", a.c.username, startParams), true
+}
+
+func (a adapter) IsAdmin(mc *messageContext) (bool, error) {
+	if mc.isChannelPost() {
+		// only admins can post in broadcast channels
+		return true, nil
+	}
+
+	if mc.src.Chat.IsLegacyGroupChat() {
+		return false, fmt.Errorf("unsupported chat type: please consider upgrading this chat to supergroup")
+	}
+
+	peer, ok := mc.src.Chat.InputPeer().(*tg.InputPeerChannel)
+	if !ok {
+		return false, fmt.Errorf("unexpected chat type %T", mc.src.Chat.InputPeer())
+	}
+
+	pt, err := a.c.client.API().ChannelsGetParticipant(a.c.Context(), &tg.ChannelsGetParticipantRequest{
+		Channel: &tg.InputChannel{
+			ChannelID:  peer.GetChannelID(),
+			AccessHash: peer.GetAccessHash(),
+		},
+		Participant: &tg.InputPeerUser{
+			UserID:     mc.src.From.InputUser().GetUserID(),
+			AccessHash: mc.src.From.InputUser().GetAccessHash(),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if len(pt.Users) != 1 {
+		return false, fmt.Errorf("unexpected %d users", len(pt.Users))
+	}
+
+	switch pt.GetParticipant().(type) {
+	case *tg.ChannelParticipantCreator, *tg.ChannelParticipantAdmin:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (a adapter) RepliedMessage(mc *messageContext) (*messageContext, bool) {
+	msg, err := a.c.getMessage(&mc.src.Chat, int(mc.ReplyTo()))
+	if err != nil {
+		mc.logger.I("failed to get replied message", log.Error(err))
+		return nil, false
+	}
+
+	nMC := *mc
+	nMC.msg = msg
+	return &nMC, true
+}
+
+func (a adapter) AppendSessionMessage(mc *messageContext) error {
+	return a.c.appendSessionMessage(mc)
+}
+
+// getMessage fetches single message in the chat
+func (c *tgBot) getMessage(chat *chatInfo, msgID int) (*tg.Message, error) {
+	var (
+		history tg.MessagesMessagesClass
+		err     error
+	)
+
+	if c.isBot {
+		if chat.IsPrivateChat() || chat.IsLegacyGroupChat() {
+			history, err = c.client.API().MessagesGetMessages(c.Context(), []tg.InputMessageClass{
+				&tg.InputMessageID{ID: msgID},
+			})
+		} else {
+			peer := chat.InputPeer().(*tg.InputPeerChannel)
+			history, err = c.client.API().ChannelsGetMessages(c.Context(), &tg.ChannelsGetMessagesRequest{
+				Channel: &tg.InputChannel{
+					ChannelID:  peer.ChannelID,
+					AccessHash: peer.AccessHash,
+				},
+				ID: []tg.InputMessageClass{
+					&tg.InputMessageID{ID: msgID},
+				},
+			})
+		}
+	} else {
+		// message.getHistory is not allowed for bot user
+		history, err = c.client.API().MessagesGetHistory(c.Context(), &tg.MessagesGetHistoryRequest{
+			Peer:     chat.InputPeer(),
+			OffsetID: msgID,
+			Limit:    1,
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var hmsgs []tg.MessageClass
+	switch h := history.(type) {
+	case *tg.MessagesMessages:
+		hmsgs = h.GetMessages()
+	case *tg.MessagesMessagesSlice:
+		hmsgs = h.GetMessages()
+	case *tg.MessagesChannelMessages:
+		hmsgs = h.GetMessages()
+	case *tg.MessagesMessagesNotModified:
+	}
+
+	return expectExactOneMessage(hmsgs)
+}
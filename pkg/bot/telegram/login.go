@@ -0,0 +1,228 @@
+package telegram
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/telegram/auth"
+	"github.com/gotd/td/tg"
+)
+
+// sources of the login code
+const (
+	loginCodeFromStdin = "stdin"
+	loginCodeFromFile  = "file"
+	loginCodeFromHTTP  = "http"
+)
+
+const (
+	defaultLoginCodeTimeout = 5 * time.Minute
+	defaultLoginCodePath    = "/telegram/login-code"
+)
+
+// login authorizes the client as a bot when bot token is set, otherwise as the
+// configured user account
+//
+// no login is performed when the stored session is still authorized
+func (c *tgBot) login() (*tg.User, error) {
+	status, err := c.client.Auth().Status(c.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	if status.Authorized {
+		return status.User, nil
+	}
+
+	if len(c.botToken) != 0 {
+		authz, err := c.client.Auth().Bot(c.Context(), c.botToken)
+		if err != nil {
+			return nil, err
+		}
+
+		if self, ok := authz.GetUser().(*tg.User); ok {
+			return self, nil
+		}
+
+		return c.client.Self(c.Context())
+	}
+
+	flow := auth.NewFlow(
+		auth.Constant(
+			strings.TrimSpace(c.user.Phone),
+			c.user.Password,
+			auth.CodeAuthenticatorFunc(c.readLoginCode),
+		),
+		auth.SendCodeOptions{},
+	)
+
+	err = flow.Run(c.Context(), c.client.Auth())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.client.Self(c.Context())
+}
+
+// readLoginCode waits for the login code from the configured source
+func (c *tgBot) readLoginCode(ctx context.Context, sentCode *tg.AuthSentCode) (string, error) {
+	cfg := &c.user.LoginCode
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultLoginCodeTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	from := cfg.From
+	if len(from) == 0 {
+		from = loginCodeFromStdin
+	}
+
+	c.Logger().I("waiting for login code",
+		log.String("from", from),
+		log.String("code_type", fmt.Sprintf("%T", sentCode.GetType())),
+		log.Duration("timeout", timeout),
+	)
+
+	switch from {
+	case loginCodeFromFile:
+		return readLoginCodeFromFile(ctx, cfg.File, time.Now(), time.Second)
+	case loginCodeFromHTTP:
+		ln, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			return "", fmt.Errorf("listen for login code: %w", err)
+		}
+
+		path := cfg.Path
+		if len(path) == 0 {
+			path = defaultLoginCodePath
+		}
+
+		return serveLoginCode(ctx, ln, path, cfg.Token)
+	default:
+		return readLoginCodeFromReader(ctx, os.Stdin)
+	}
+}
+
+// readLoginCodeFromReader reads the first non-empty line in r
+func readLoginCodeFromReader(ctx context.Context, r io.Reader) (string, error) {
+	type result struct {
+		code string
+		err  error
+	}
+
+	resultCh := make(chan result, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			code := strings.TrimSpace(scanner.Text())
+			if len(code) != 0 {
+				resultCh <- result{code: code}
+				return
+			}
+		}
+
+		err := scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+
+		resultCh <- result{err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case ret := <-resultCh:
+		return ret.code, ret.err
+	}
+}
+
+// readLoginCodeFromFile polls file until it's modified after since with non-empty content
+func readLoginCodeFromFile(ctx context.Context, file string, since time.Time, interval time.Duration) (string, error) {
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+
+	for {
+		info, err := os.Stat(file)
+		if err == nil && info.ModTime().After(since) {
+			var data []byte
+			data, err = os.ReadFile(file)
+			if code := strings.TrimSpace(string(data)); err == nil && len(code) != 0 {
+				return code, nil
+			}
+		}
+
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-tk.C:
+		}
+	}
+}
+
+// serveLoginCode serves http on ln until the login code is posted to path
+func serveLoginCode(ctx context.Context, ln net.Listener, path, token string) (string, error) {
+	codeCh := make(chan string, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if len(token) != 0 {
+			bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		data, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		code := strings.TrimSpace(string(data))
+		if err != nil || len(code) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case codeCh <- code:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusConflict)
+		}
+	})
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	defer func() { _ = srv.Close() }()
+
+	go func() { _ = srv.Serve(ln) }()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case code := <-codeCh:
+		return code, nil
+	}
+}
@@ -0,0 +1,117 @@
+package telegram
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlainTextCommand(t *testing.T) {
+	for _, test := range []struct {
+		text string
+
+		cmd    string
+		params string
+		ok     bool
+	}{
+		{text: "/new", cmd: "/new", ok: true},
+		{text: " /new weekly sync ", cmd: "/new", params: "weekly sync", ok: true},
+		{text: "/new\nweekly", cmd: "/new", params: "weekly", ok: true},
+		{text: "/new@me foo", cmd: "/new", params: "foo", ok: true},
+		{text: "/new@others foo"},
+		{text: "/"},
+		{text: "new"},
+		{text: "hello /new"},
+	} {
+		t.Run(test.text, func(t *testing.T) {
+			cmd, params, ok := parsePlainTextCommand(test.text, "me")
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.cmd, cmd)
+			assert.Equal(t, test.params, params)
+		})
+	}
+}
+
+func TestReadLoginCode(t *testing.T) {
+	t.Run("Reader", func(t *testing.T) {
+		code, err := readLoginCodeFromReader(context.TODO(), strings.NewReader("\n  12345 \n"))
+		assert.NoError(t, err)
+		assert.Equal(t, "12345", code)
+
+		_, err = readLoginCodeFromReader(context.TODO(), strings.NewReader("\n"))
+		assert.Error(t, err)
+	})
+
+	t.Run("File", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "code")
+		since := time.Now()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_ = os.WriteFile(file, []byte("54321\n"), 0600)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+		defer cancel()
+
+		code, err := readLoginCodeFromFile(ctx, file, since.Add(-time.Second), 10*time.Millisecond)
+		assert.NoError(t, err)
+		assert.Equal(t, "54321", code)
+
+		// stale code written before the code was sent
+		ctx, cancel = context.WithTimeout(context.TODO(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err = readLoginCodeFromFile(ctx, file, time.Now().Add(time.Hour), 10*time.Millisecond)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		url := "http://" + ln.Addr().String() + "/code"
+		post := func(token, body string) int {
+			req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+			if !assert.NoError(t, err) {
+				return 0
+			}
+
+			if len(token) != 0 {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if !assert.NoError(t, err) {
+				return 0
+			}
+			_ = resp.Body.Close()
+
+			return resp.StatusCode
+		}
+
+		ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+		defer cancel()
+
+		resultCh := make(chan string, 1)
+		go func() {
+			code, _ := serveLoginCode(ctx, ln, "/code", "secret")
+			resultCh <- code
+		}()
+
+		assert.Equal(t, http.StatusUnauthorized, post("", "11111"))
+		assert.Equal(t, http.StatusUnauthorized, post("invalid", "11111"))
+		assert.Equal(t, http.StatusBadRequest, post("secret", " "))
+		assert.Equal(t, http.StatusNoContent, post("secret", "22222"))
+		assert.Equal(t, "22222", <-resultCh)
+	})
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"arhat.dev/pkg/log"
-	"github.com/gotd/td/telegram/message/styling"
 	"github.com/gotd/td/tg"
 	"github.com/h2non/filetype"
 	"github.com/h2non/filetype/types"
@@ -18,17 +17,40 @@ import (
 
 type donwlodFunc = func() (_ rt.CacheReader, contentType, ext string, sz int64, err error)
 
-// nolint:gocyclo
 func (c *tgBot) fillMessageSpans(mc *messageContext, wf *bot.Workflow, m *rt.Message) (err error) {
 	if len(m.Text) != 0 {
 		m.Spans = parseTextEntities(m.Text, mc.msg.Entities)
 	}
 
-	media, ok := mc.msg.GetMedia()
+	nonText, doDownload, ok := c.parseMediaSpan(mc)
 	if !ok {
 		return
 	}
 
+	m.Spans = append(m.Spans, nonText)
+
+	if !wf.DownloadMedia() {
+		return nil
+	}
+
+	c.downloadMediaSpan(mc, wf, m, len(m.Spans)-1, doDownload)
+	return nil
+}
+
+// parseMediaSpan creates the media span of the message, ok is false when
+// there is no supported media
+//
+// nolint:gocyclo
+func (c *tgBot) parseMediaSpan(mc *messageContext) (rt.Span, donwlodFunc, bool) {
+	if mc.secret != nil {
+		return c.parseSecretMediaSpan(mc)
+	}
+
+	media, ok := mc.msg.GetMedia()
+	if !ok {
+		return rt.Span{}, nil, false
+	}
+
 	var (
 		nonText    rt.Span
 		doDownload donwlodFunc
@@ -38,7 +60,7 @@ func (c *tgBot) fillMessageSpans(mc *messageContext, wf *bot.Workflow, m *rt.Mes
 	case *tg.MessageMediaPhoto:
 		photo, ok := t.GetPhoto()
 		if !ok {
-			return nil
+			return nonText, nil, false
 		}
 
 		switch p := photo.(type) {
@@ -100,12 +122,12 @@ func (c *tgBot) fillMessageSpans(mc *messageContext, wf *bot.Workflow, m *rt.Mes
 				return c.download(fileLoc, int64(maxSize), "")
 			}
 		default:
-			return
+			return nonText, nil, false
 		}
 	case *tg.MessageMediaDocument:
 		doc, ok := t.GetDocument()
 		if !ok {
-			return
+			return nonText, nil, false
 		}
 
 		switch d := doc.(type) {
@@ -151,7 +173,7 @@ func (c *tgBot) fillMessageSpans(mc *messageContext, wf *bot.Workflow, m *rt.Mes
 				return c.download(fileLoc, sz, ct)
 			}
 		default:
-			return
+			return nonText, nil, false
 		}
 
 	// case *tg.MessageMediaGeo:
@@ -165,24 +187,24 @@ func (c *tgBot) fillMessageSpans(mc *messageContext, wf *bot.Workflow, m *rt.Mes
 	// case *tg.MessageMediaPoll:
 	// case *tg.MessageMediaDice:
 	default:
-		return nil
+		return nonText, nil, false
 	}
 
-	m.Spans = append(m.Spans, nonText)
-
-	if !wf.DownloadMedia() {
-		return nil
-	}
+	return nonText, doDownload, true
+}
 
-	mediaSpan := &m.Spans[len(m.Spans)-1]
-	peer := mc.src.Chat.InputPeer()
-	msgID := mc.msg.GetID()
+// downloadMediaSpan downloads media of m.Spans[idx] in background and uploads
+// it to the storage of the workflow
+//
+// NOTE: spans of m MUST NOT be appended after calling this function
+func (c *tgBot) downloadMediaSpan(mc *messageContext, wf *bot.Workflow, m *rt.Message, idx int, doDownload donwlodFunc) {
+	m.AddWorker(func(cancel rt.Signal, m *rt.Message) {
+		mediaSpan := &m.Spans[idx]
 
-	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
 		cacheRD, contentType, ext, sz, err := doDownload()
 		if err != nil {
 			mc.logger.I("failed to download file", log.Error(err))
-			c.sendErrorf(peer, msgID, "unable to download: %v", err)
+			c.sendErrorf(mc, "unable to download: %v", err)
 			return
 		}
 
@@ -196,7 +218,7 @@ func (c *tgBot) fillMessageSpans(mc *messageContext, wf *bot.Workflow, m *rt.Mes
 			_, err = cacheRD.Seek(0, io.SeekStart)
 			if err != nil {
 				mc.logger.E("failed to seek to start", log.Error(err))
-				c.sendErrorf(peer, msgID, "bad cache reuse")
+				c.sendErrorf(mc, "bad cache reuse")
 				return
 			}
 
@@ -235,37 +257,29 @@ func (c *tgBot) fillMessageSpans(mc *messageContext, wf *bot.Workflow, m *rt.Mes
 			log.Int64("size", sz),
 		)
 
-		input := rt.NewStorageInput(filename, sz, cacheRD, contentType)
-		sout, err := wf.Storage.Upload(&mc.con, &input)
+		sout, err := bot.Upload(&mc.con, wf.Storage, filename, sz, cacheRD, contentType)
 		if err != nil {
 			mc.logger.I("failed to upload file", log.Error(err))
-			c.sendErrorf(peer, msgID, "unable to upload file: %v", err)
-			return
-		}
-
-		// seek to start to reuse this cache file
-		//
-		// NOTE: here we do not close the cache reader to keep it available (avoid unexpected file deletion)
-		_, err = cacheRD.Seek(0, io.SeekStart)
-		if err != nil {
-			mc.logger.E("failed to reuse cached data", log.Error(err))
-			c.sendErrorf(peer, msgID, "bad cache reuse")
+			c.sendErrorf(mc, "unable to upload file: %v", err)
 			return
 		}
 
 		mediaSpan.URL = sout.URL
 		mediaSpan.Data = cacheRD
 	})
-
-	return nil
 }
 
-func (c *tgBot) sendErrorf(peer tg.InputPeerClass, msgID int, format string, args ...any) {
-	_, _ = c.sendTextMessage(
-		c.sender.To(peer).NoWebpage().Silent().Reply(int(msgID)),
-		styling.Plain("Internal bot error: "),
-		styling.Bold(fmt.Sprintf(format, args...)),
-	)
+// sendErrorf replies mc with the error message
+func (c *tgBot) sendErrorf(mc *messageContext, format string, args ...any) {
+	_, _ = mc.con.SendMessage(c.Context(), rt.SendMessageOptions{
+		ReplyTo:        mc.MessageID(),
+		NoNotification: true,
+		NoWebPreview:   true,
+		Body: []rt.Span{
+			{Text: "Internal bot error: "},
+			{Flags: rt.SpanFlag_Bold, Text: fmt.Sprintf(format, args...)},
+		},
+	})
 }
 
 func (c *tgBot) download(
@@ -0,0 +1,413 @@
+package telegram
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+
+	"arhat.dev/mbot/pkg/bot"
+)
+
+// peerRef is a resolved chat or user reference
+type peerRef struct {
+	// id is the same as the one in chatInfo and authorInfo
+	id   int64
+	peer tg.InputPeerClass
+
+	// unresolved is true when the access hash of peer is not available, commands
+	// are not registered for it
+	unresolved bool
+}
+
+func (p peerRef) isUser() bool {
+	_, ok := p.peer.(*tg.InputPeerUser)
+	return ok
+}
+
+func (p peerRef) inputUser() tg.InputUserClass {
+	u, ok := p.peer.(*tg.InputPeerUser)
+	if !ok {
+		return &tg.InputUserEmpty{}
+	}
+
+	return &tg.InputUser{UserID: u.UserID, AccessHash: u.AccessHash}
+}
+
+// commandScope is the resolved bot.WorkflowScope
+type commandScope struct {
+	chats      []peerRef
+	chatAdmins []peerRef
+	users      []scopedUser
+}
+
+type scopedUser struct {
+	// chat is the same as user for private chat
+	chat peerRef
+	user peerRef
+}
+
+func hasPeer(refs []peerRef, id int64) bool {
+	for _, r := range refs {
+		if r.id == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveScopes resolves scopes of all workflows
+func (c *tgBot) resolveScopes() error {
+	resolved := make(map[string]peerRef)
+	resolve := func(ref string) (peerRef, error) {
+		ret, ok := resolved[ref]
+		if ok {
+			return ret, nil
+		}
+
+		ret, err := c.resolvePeer(ref)
+		if err != nil {
+			return ret, fmt.Errorf("resolve %q: %w", ref, err)
+		}
+
+		resolved[ref] = ret
+		return ret, nil
+	}
+
+	c.scopes = make(map[*bot.Workflow]*commandScope)
+	for i := range c.wfSet.Workflows {
+		wf := &c.wfSet.Workflows[i]
+		scope := wf.Scope()
+		if scope == nil {
+			continue
+		}
+
+		cs := &commandScope{}
+		for _, ref := range scope.Chats {
+			chat, err := resolve(ref)
+			if err != nil {
+				return err
+			}
+
+			cs.chats = append(cs.chats, chat)
+		}
+
+		for _, ref := range scope.ChatAdmins {
+			chat, err := resolve(ref)
+			if err != nil {
+				return err
+			}
+
+			if chat.isUser() {
+				return fmt.Errorf("unexpected user %q as chat with admins", ref)
+			}
+
+			cs.chatAdmins = append(cs.chatAdmins, chat)
+		}
+
+		for _, su := range scope.Users {
+			user, err := resolve(su.User)
+			if err != nil {
+				return err
+			}
+
+			if !user.isUser() {
+				return fmt.Errorf("unexpected chat %q as user", su.User)
+			}
+
+			chat := user
+			if len(su.Chat) != 0 {
+				chat, err = resolve(su.Chat)
+				if err != nil {
+					return err
+				}
+			}
+
+			cs.users = append(cs.users, scopedUser{chat: chat, user: user})
+		}
+
+		c.scopes[wf] = cs
+	}
+
+	return nil
+}
+
+// resolvePeer resolves chat or user reference, which is either `@username` or
+// bot api style id (e.g. 1234 for user, -1234 for legacy group, -1001234 for
+// supergroup and channel)
+func (c *tgBot) resolvePeer(ref string) (peerRef, error) {
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		return c.resolvePeerID(ref, id)
+	}
+
+	resolved, err := c.client.API().ContactsResolveUsername(c.Context(), strings.TrimPrefix(ref, "@"))
+	if err != nil {
+		return peerRef{}, err
+	}
+
+	switch p := resolved.GetPeer().(type) {
+	case *tg.PeerUser:
+		for _, u := range resolved.GetUsers() {
+			if user, ok := u.(*tg.User); ok && user.GetID() == p.GetUserID() {
+				return peerRef{id: user.GetID(), peer: user.AsInputPeer()}, nil
+			}
+		}
+	case *tg.PeerChannel:
+		for _, ch := range resolved.GetChats() {
+			if channel, ok := ch.(*tg.Channel); ok && channel.GetID() == p.GetChannelID() {
+				return peerRef{id: channel.GetID(), peer: channel.AsInputPeer()}, nil
+			}
+		}
+	}
+
+	return peerRef{}, fmt.Errorf("peer not found")
+}
+
+// resolvePeerID resolves access hash of the peer referenced by bot api style id,
+// the peer is kept unresolved with a warning when it's not available (e.g. user
+// never seen by the bot), as it's still usable for checking scopes
+func (c *tgBot) resolvePeerID(ref string, id int64) (peerRef, error) {
+	var (
+		ret = peerRef{id: id}
+		err error
+	)
+
+	switch {
+	case id > 0:
+		ret.peer = &tg.InputPeerUser{UserID: id}
+
+		var users []tg.UserClass
+		users, err = c.client.API().UsersGetUsers(c.Context(), []tg.InputUserClass{&tg.InputUser{UserID: id}})
+		for _, u := range users {
+			if user, ok := u.(*tg.User); ok && user.GetID() == id {
+				ret.peer = user.AsInputPeer()
+				return ret, nil
+			}
+		}
+	case strings.HasPrefix(ref, "-100"):
+		ret.id, _ = strconv.ParseInt(strings.TrimPrefix(ref, "-100"), 10, 64)
+		ret.peer = &tg.InputPeerChannel{ChannelID: ret.id}
+
+		var chats tg.MessagesChatsClass
+		chats, err = c.client.API().ChannelsGetChannels(c.Context(), []tg.InputChannelClass{&tg.InputChannel{ChannelID: ret.id}})
+		if err == nil {
+			for _, ch := range chats.GetChats() {
+				if channel, ok := ch.(*tg.Channel); ok && channel.GetID() == ret.id {
+					ret.peer = channel.AsInputPeer()
+					return ret, nil
+				}
+			}
+		}
+	case id < 0:
+		// legacy groups have no access hash
+		return peerRef{id: -id, peer: &tg.InputPeerChat{ChatID: -id}}, nil
+	default:
+		return peerRef{}, fmt.Errorf("invalid id")
+	}
+
+	if err == nil {
+		err = fmt.Errorf("peer not found")
+	}
+
+	c.Logger().I("access hash of peer not available, commands are not registered for it",
+		log.String("ref", ref), log.Error(err))
+
+	ret.unresolved = true
+	return ret, nil
+}
+
+// InScope implements engine.ScopeChecker
+func (a adapter) InScope(mc *messageContext, wf *bot.Workflow, _ *bot.WorkflowScope) (bool, error) {
+	cs, ok := a.c.scopes[wf]
+	if !ok {
+		return false, nil
+	}
+
+	chatID, userID := int64(mc.src.Chat.ID()), int64(mc.src.From.ID())
+	if hasPeer(cs.chats, chatID) {
+		return true, nil
+	}
+
+	for _, su := range cs.users {
+		if su.chat.id == chatID && su.user.id == userID {
+			return true, nil
+		}
+	}
+
+	if !mc.IsPrivate() && hasPeer(cs.chatAdmins, chatID) {
+		return a.IsAdmin(mc)
+	}
+
+	return false, nil
+}
+
+// peerCommands are commands of a single peer scope
+type peerCommands struct {
+	scope tg.BotCommandScopeClass
+
+	// base is the key of peerCommands included in this scope, as peer scopes
+	// override commands of the chat
+	base string
+
+	private bool
+	admins  bool
+
+	commands []tg.BotCommand
+}
+
+// setBotCommands registers commands of workflows
+func (c *tgBot) setBotCommands() error {
+	requests := botCommandsRequests(c.wfSet.Workflows, c.scopes)
+	for i := range requests {
+		_, err := c.client.API().BotsSetBotCommands(c.Context(), &requests[i])
+		if err != nil {
+			return fmt.Errorf("set bot commands for %s: %w", requests[i].Scope.TypeName(), err)
+		}
+	}
+
+	c.Logger().D("bot commands updated",
+		log.Any("commands", requests[0].Commands),
+		log.Int("scopes", len(requests)),
+	)
+
+	return nil
+}
+
+// botCommandsRequests creates requests setting commands of workflows, commands of
+// scoped workflows are only set in peer scopes
+func botCommandsRequests(workflows []bot.Workflow, scopes map[*bot.Workflow]*commandScope) []tg.BotsSetBotCommandsRequest {
+	var (
+		allCmds   []tg.BotCommand
+		chatsCmds []tg.BotCommand
+
+		peerKeys []string
+		peers    = make(map[string]*peerCommands)
+	)
+
+	addPeerCommands := func(key string, pc peerCommands, cmds []tg.BotCommand) {
+		p, ok := peers[key]
+		if !ok {
+			p = &pc
+			peers[key] = p
+			peerKeys = append(peerKeys, key)
+		}
+
+		p.commands = append(p.commands, cmds...)
+	}
+
+	for i := range workflows {
+		wf := &workflows[i]
+		cmds := botCommandsOf(wf)
+
+		cs, scoped := scopes[wf]
+		if !scoped {
+			allCmds = append(allCmds, cmds...)
+			if !wf.RequireAdmin() {
+				chatsCmds = append(chatsCmds, cmds...)
+			}
+
+			continue
+		}
+
+		for _, chat := range cs.chats {
+			if chat.unresolved {
+				continue
+			}
+
+			if chat.isUser() {
+				addPeerCommands(peerKey(chat), peerCommands{
+					scope: &tg.BotCommandScopePeer{Peer: chat.peer}, private: true,
+				}, cmds)
+				continue
+			}
+
+			if !wf.RequireAdmin() {
+				addPeerCommands(peerKey(chat), peerCommands{
+					scope: &tg.BotCommandScopePeer{Peer: chat.peer},
+				}, cmds)
+			}
+
+			addPeerCommands(peerAdminsKey(chat), peerCommands{
+				scope: &tg.BotCommandScopePeerAdmins{Peer: chat.peer}, admins: true,
+			}, cmds)
+		}
+
+		for _, chat := range cs.chatAdmins {
+			if chat.unresolved {
+				continue
+			}
+
+			addPeerCommands(peerAdminsKey(chat), peerCommands{
+				scope: &tg.BotCommandScopePeerAdmins{Peer: chat.peer}, admins: true,
+			}, cmds)
+		}
+
+		for _, su := range cs.users {
+			if su.chat.unresolved || su.user.unresolved {
+				continue
+			}
+
+			if su.chat.id == su.user.id {
+				addPeerCommands(peerKey(su.chat), peerCommands{
+					scope: &tg.BotCommandScopePeer{Peer: su.chat.peer}, private: true,
+				}, cmds)
+				continue
+			}
+
+			addPeerCommands(peerKey(su.chat)+":"+strconv.FormatInt(su.user.id, 10), peerCommands{
+				scope: &tg.BotCommandScopePeerUser{Peer: su.chat.peer, UserID: su.user.inputUser()},
+				base:  peerKey(su.chat),
+			}, cmds)
+		}
+	}
+
+	requests := []tg.BotsSetBotCommandsRequest{
+		{Scope: &tg.BotCommandScopeDefault{}, Commands: allCmds},
+		{Scope: &tg.BotCommandScopeUsers{}, Commands: allCmds},
+		{Scope: &tg.BotCommandScopeChats{}, Commands: chatsCmds},
+		{Scope: &tg.BotCommandScopeChatAdmins{}, Commands: allCmds},
+	}
+
+	for _, key := range peerKeys {
+		p := peers[key]
+
+		var cmds []tg.BotCommand
+		if p.private || p.admins {
+			cmds = append(cmds, allCmds...)
+		} else {
+			cmds = append(cmds, chatsCmds...)
+		}
+
+		if base, ok := peers[p.base]; ok {
+			cmds = append(cmds, base.commands...)
+		}
+
+		requests = append(requests, tg.BotsSetBotCommandsRequest{
+			Scope:    p.scope,
+			Commands: append(cmds, p.commands...),
+		})
+	}
+
+	return requests
+}
+
+func peerKey(p peerRef) string       { return p.peer.TypeName() + ":" + strconv.FormatInt(p.id, 10) }
+func peerAdminsKey(p peerRef) string { return "admins:" + peerKey(p) }
+
+func botCommandsOf(wf *bot.Workflow) (ret []tg.BotCommand) {
+	for i, cmd := range wf.BotCommands.Commands {
+		if len(cmd) == 0 || len(wf.BotCommands.Descriptions[i]) == 0 {
+			continue
+		}
+
+		ret = append(ret, tg.BotCommand{
+			Command:     strings.TrimPrefix(cmd, "/"),
+			Description: wf.BotCommands.Descriptions[i],
+		})
+	}
+
+	return
+}
@@ -0,0 +1,103 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestBotCommandsRequests(t *testing.T) {
+	workflows := []bot.Workflow{{}, {}}
+	workflows[0].BotCommands.Commands[0], workflows[0].BotCommands.Descriptions[0] = "/foo", "foo"
+	workflows[1].BotCommands.Commands[0], workflows[1].BotCommands.Descriptions[0] = "/bar", "bar"
+
+	var (
+		group = peerRef{id: 1, peer: &tg.InputPeerChannel{ChannelID: 1}}
+		alice = peerRef{id: 2, peer: &tg.InputPeerUser{UserID: 2}}
+
+		foo = tg.BotCommand{Command: "foo", Description: "foo"}
+		bar = tg.BotCommand{Command: "bar", Description: "bar"}
+	)
+
+	requests := botCommandsRequests(workflows, map[*bot.Workflow]*commandScope{
+		&workflows[1]: {
+			chats: []peerRef{group},
+			users: []scopedUser{{chat: alice, user: alice}},
+		},
+	})
+
+	assert.Equal(t, []tg.BotsSetBotCommandsRequest{
+		{Scope: &tg.BotCommandScopeDefault{}, Commands: []tg.BotCommand{foo}},
+		{Scope: &tg.BotCommandScopeUsers{}, Commands: []tg.BotCommand{foo}},
+		{Scope: &tg.BotCommandScopeChats{}, Commands: []tg.BotCommand{foo}},
+		{Scope: &tg.BotCommandScopeChatAdmins{}, Commands: []tg.BotCommand{foo}},
+		{Scope: &tg.BotCommandScopePeer{Peer: group.peer}, Commands: []tg.BotCommand{foo, bar}},
+		{Scope: &tg.BotCommandScopePeerAdmins{Peer: group.peer}, Commands: []tg.BotCommand{foo, bar}},
+		{Scope: &tg.BotCommandScopePeer{Peer: alice.peer}, Commands: []tg.BotCommand{foo, bar}},
+	}, requests)
+
+	requests = botCommandsRequests(workflows, map[*bot.Workflow]*commandScope{
+		&workflows[1]: {
+			users: []scopedUser{{chat: group, user: alice}},
+		},
+	})
+
+	assert.Equal(t, tg.BotsSetBotCommandsRequest{
+		Scope: &tg.BotCommandScopePeerUser{
+			Peer:   group.peer,
+			UserID: &tg.InputUser{UserID: 2},
+		},
+		Commands: []tg.BotCommand{foo, bar},
+	}, requests[len(requests)-1])
+
+	// no commands registered for peers without access hash
+	requests = botCommandsRequests(workflows, map[*bot.Workflow]*commandScope{
+		&workflows[1]: {
+			chats:      []peerRef{{id: 3, peer: &tg.InputPeerChannel{ChannelID: 3}, unresolved: true}},
+			chatAdmins: []peerRef{{id: 3, peer: &tg.InputPeerChannel{ChannelID: 3}, unresolved: true}},
+			users:      []scopedUser{{chat: group, user: peerRef{id: 4, peer: &tg.InputPeerUser{UserID: 4}, unresolved: true}}},
+		},
+	})
+	assert.Len(t, requests, 4)
+}
+
+func TestAdapterInScope(t *testing.T) {
+	wf := &bot.Workflow{}
+	c := &tgBot{scopes: map[*bot.Workflow]*commandScope{
+		wf: {
+			chats: []peerRef{{id: 1}},
+			users: []scopedUser{{chat: peerRef{id: 3}, user: peerRef{id: 2}}},
+		},
+	}}
+
+	newMessage := func(chatID rt.ChatID, userID rt.UserID) *messageContext {
+		mc := &messageContext{}
+		mc.src.Chat.id = chatID
+		mc.src.From.id = userID
+		return mc
+	}
+
+	for _, test := range []struct {
+		chat rt.ChatID
+		user rt.UserID
+
+		expected bool
+	}{
+		{chat: 1, user: 10, expected: true},
+		{chat: 3, user: 2, expected: true},
+		{chat: 3, user: 10},
+		{chat: 4, user: 2},
+	} {
+		ok, err := adapter{c: c}.InScope(newMessage(test.chat, test.user), wf, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, ok, test)
+	}
+
+	ok, err := adapter{c: c}.InScope(newMessage(1, 10), &bot.Workflow{}, nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,612 @@
+package telegram
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"arhat.dev/pkg/log"
+	tds "github.com/gotd/td/session"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tg/e2e"
+	"go.uber.org/multierr"
+
+	"arhat.dev/mbot/pkg/bot/telegram/secret"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// secretChat is an accepted secret chat with the user requested it
+type secretChat struct {
+	secret.Chat
+
+	// the user requested the secret chat (the admin)
+	UserAccessHash int64  `json:"userAccessHash"`
+	Username       string `json:"username,omitempty"`
+	FirstName      string `json:"firstName,omitempty"`
+	LastName       string `json:"lastName,omitempty"`
+}
+
+func (sc *secretChat) user() *tg.User {
+	u := &tg.User{ID: sc.AdminID}
+	u.SetAccessHash(sc.UserAccessHash)
+	if len(sc.Username) != 0 {
+		u.SetUsername(sc.Username)
+	}
+
+	if len(sc.FirstName) != 0 {
+		u.SetFirstName(sc.FirstName)
+	}
+
+	if len(sc.LastName) != 0 {
+		u.SetLastName(sc.LastName)
+	}
+
+	return u
+}
+
+// secretChats are secret chats accepted, they are persisted to decrypt
+// messages after restart
+type secretChats struct {
+	// storage of secret chats, nil when they are not persisted
+	storage tds.Storage
+
+	// sendMu serializes sending to keep seq numbers in order
+	sendMu sync.Mutex
+
+	mu    sync.Mutex
+	chats map[int]*secretChat
+	dirty bool
+}
+
+func newSecretChats(storage tds.Storage) *secretChats {
+	return &secretChats{
+		storage: storage,
+		chats:   make(map[int]*secretChat),
+	}
+}
+
+// Get returns a shallow copy of the secret chat, maps and slices in it are
+// shared, access them in Update
+func (s *secretChats) Get(id int) (secretChat, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.chats[id]
+	if !ok {
+		return secretChat{}, false
+	}
+
+	return *sc, true
+}
+
+func (s *secretChats) Set(sc secretChat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chats[sc.ID] = &sc
+	s.dirty = true
+}
+
+func (s *secretChats) Delete(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chats, id)
+	s.dirty = true
+}
+
+// Update calls fn with the secret chat, ok is false when there is no such chat
+func (s *secretChats) Update(id int, fn func(sc *secretChat)) (ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.chats[id]
+	if ok {
+		fn(sc)
+		s.dirty = true
+	}
+
+	return
+}
+
+// Load loads secret chats from the storage
+func (s *secretChats) Load(ctx context.Context) error {
+	if s.storage == nil {
+		return nil
+	}
+
+	data, err := s.storage.LoadSession(ctx)
+	if err != nil {
+		if errors.Is(err, tds.ErrNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	var chats []*secretChat
+	err = json.Unmarshal(data, &chats)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sc := range chats {
+		s.chats[sc.ID] = sc
+	}
+
+	return nil
+}
+
+// Flush stores secret chats if changed
+func (s *secretChats) Flush(ctx context.Context) error {
+	if s.storage == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+
+	chats := make([]*secretChat, 0, len(s.chats))
+	for _, sc := range s.chats {
+		chats = append(chats, sc)
+	}
+
+	data, err := json.Marshal(chats)
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return s.storage.StoreSession(ctx, data)
+}
+
+// acceptsSecretChatFrom checks whether the user is configured to start secret
+// chats with the account
+func (c *tgBot) acceptsSecretChatFrom(u *tg.User) bool {
+	username, _ := u.GetUsername()
+
+	for _, ref := range c.user.SecretChats {
+		ref = strings.TrimSpace(ref)
+		if strings.HasPrefix(ref, "@") {
+			if len(username) != 0 && strings.EqualFold(ref[1:], username) {
+				return true
+			}
+
+			continue
+		}
+
+		id, err := strconv.ParseInt(ref, 10, 64)
+		if err == nil && id == u.GetID() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSecretChatOwner checks whether the message in secret chat is sent by the
+// user trusted as the account owner, which is the admin of the secret chat
+// accepted by the logged in account, and still configured in secretChats
+func (c *tgBot) isSecretChatOwner(mc *messageContext) bool {
+	sc, ok := c.secrets.Get(mc.src.Chat.secret)
+	if !ok || sc.ParticipantID != c.selfID || mc.src.From.ID() != rt.UserID(sc.AdminID) {
+		return false
+	}
+
+	return c.acceptsSecretChatFrom(sc.user())
+}
+
+func (c *tgBot) onTelegramEncryption(ctx context.Context, e tg.Entities, update *tg.UpdateEncryption) error {
+	switch chat := update.GetChat().(type) {
+	case *tg.EncryptedChatRequested:
+		return c.acceptSecretChat(e, chat)
+	case *tg.EncryptedChatDiscarded:
+		c.Logger().D("secret chat discarded", log.Int("secret_chat_id", chat.GetID()))
+		c.secrets.Delete(chat.GetID())
+	default:
+		c.Logger().V("secret chat updated", log.Uint32("type_id", chat.TypeID()))
+	}
+
+	return nil
+}
+
+// acceptSecretChat accepts the secret chat request from configured users, and
+// notifies the peer supported layer
+func (c *tgBot) acceptSecretChat(e tg.Entities, req *tg.EncryptedChatRequested) error {
+	logger := c.Logger().WithFields(
+		log.Int("secret_chat_id", req.GetID()),
+		rt.LogSenderID(rt.UserID(req.GetAdminID())),
+	)
+
+	u, ok := e.Users[req.GetAdminID()]
+	if c.isBot || !ok || !c.acceptsSecretChatFrom(u) {
+		logger.D("ignored secret chat request")
+		return nil
+	}
+
+	logger.V("accept secret chat")
+	resp, err := c.client.API().MessagesGetDhConfig(c.Context(), &tg.MessagesGetDhConfigRequest{
+		RandomLength: secret.KeySize,
+	})
+	if err != nil {
+		return fmt.Errorf("get dh config: %w", err)
+	}
+
+	cfg, ok := resp.(*tg.MessagesDhConfig)
+	if !ok {
+		return fmt.Errorf("unexpected dh config %T", resp)
+	}
+
+	key, gb, err := secret.ComputeKey(cfg, req.GetGA())
+	if err != nil {
+		logger.I("invalid dh parameters", log.Error(err))
+		return err
+	}
+
+	fingerprint := secret.KeyFingerprint(key)
+	chat, err := c.client.API().MessagesAcceptEncryption(c.Context(), &tg.MessagesAcceptEncryptionRequest{
+		Peer:           tg.InputEncryptedChat{ChatID: req.GetID(), AccessHash: req.GetAccessHash()},
+		GB:             gb,
+		KeyFingerprint: fingerprint,
+	})
+	if err != nil {
+		return fmt.Errorf("accept secret chat: %w", err)
+	}
+
+	accepted, ok := chat.(*tg.EncryptedChat)
+	if !ok || accepted.GetKeyFingerprint() != fingerprint {
+		return fmt.Errorf("secret chat not accepted")
+	}
+
+	sc := secretChat{
+		Chat: secret.Chat{
+			ID:            req.GetID(),
+			AccessHash:    req.GetAccessHash(),
+			Key:           key,
+			AdminID:       accepted.GetAdminID(),
+			ParticipantID: accepted.GetParticipantID(),
+		},
+		UserAccessHash: u.AccessHash,
+	}
+	sc.Username, _ = u.GetUsername()
+	sc.FirstName, _ = u.GetFirstName()
+	sc.LastName, _ = u.GetLastName()
+
+	c.secrets.Set(sc)
+	err = c.secrets.Flush(c.Context())
+	if err != nil {
+		logger.I("failed to store secret chats", log.Error(err))
+	}
+
+	return c.sendSecret(c.Context(), sc.ID, &e2e.DecryptedMessageService{
+		RandomID: randomInt64(),
+		Action:   &e2e.DecryptedMessageActionNotifyLayer{Layer: secret.Layer},
+	}, true, nil)
+}
+
+func randomInt64() int64 {
+	var buf [8]byte
+	_, _ = io.ReadFull(rand.Reader, buf[:])
+	return int64(binary.LittleEndian.Uint64(buf[:]))
+}
+
+// sendSecret sends m as the next message of the secret chat, file is the
+// encrypted file of its media
+func (c *tgBot) sendSecret(
+	ctx context.Context,
+	chatID int,
+	m e2e.DecryptedMessageClass,
+	silent bool,
+	file tg.InputEncryptedFileClass,
+) error {
+	c.secrets.sendMu.Lock()
+	defer c.secrets.sendMu.Unlock()
+
+	sc, ok := c.secrets.Get(chatID)
+	if !ok {
+		return fmt.Errorf("unknown secret chat %d", chatID)
+	}
+
+	sentFile, err := c.sendSecretAt(ctx, &sc, sc.OutSeq, m, silent, file)
+	if err != nil {
+		return err
+	}
+
+	c.secrets.Update(chatID, func(sc *secretChat) {
+		err = sc.MarkSent(m, sentFile)
+	})
+
+	return err
+}
+
+// sendSecretAt sends m as the n-th message of the secret chat, it returns the
+// encrypted file sent
+func (c *tgBot) sendSecretAt(
+	ctx context.Context,
+	sc *secretChat,
+	n int,
+	m e2e.DecryptedMessageClass,
+	silent bool,
+	file tg.InputEncryptedFileClass,
+) (*tg.EncryptedFile, error) {
+	data, err := sc.Encrypt(n, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := secret.Action(m); ok {
+		_, err = c.client.API().MessagesSendEncryptedService(ctx, &tg.MessagesSendEncryptedServiceRequest{
+			Peer:     sc.InputPeer(),
+			RandomID: m.GetRandomID(),
+			Data:     data,
+		})
+
+		return nil, err
+	}
+
+	if file == nil {
+		_, err = c.client.API().MessagesSendEncrypted(ctx, &tg.MessagesSendEncryptedRequest{
+			Silent:   silent,
+			Peer:     sc.InputPeer(),
+			RandomID: m.GetRandomID(),
+			Data:     data,
+		})
+
+		return nil, err
+	}
+
+	resp, err := c.client.API().MessagesSendEncryptedFile(ctx, &tg.MessagesSendEncryptedFileRequest{
+		Silent:   silent,
+		Peer:     sc.InputPeer(),
+		RandomID: m.GetRandomID(),
+		Data:     data,
+		File:     file,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if sent, ok := resp.(*tg.MessagesSentEncryptedFile); ok {
+		f, _ := sent.GetFile().(*tg.EncryptedFile)
+		return f, nil
+	}
+
+	return nil, nil
+}
+
+// resendSecretMessages sends messages requested by the peer again with their
+// seq numbers, messages not kept are sent as noop
+func (c *tgBot) resendSecretMessages(chatID, start, end int) {
+	logger := c.Logger().WithFields(log.Int("secret_chat_id", chatID))
+
+	c.secrets.sendMu.Lock()
+	defer c.secrets.sendMu.Unlock()
+
+	var (
+		sc   secretChat
+		sent []secret.SentMessage
+	)
+
+	c.secrets.Update(chatID, func(s *secretChat) {
+		sc = *s
+
+		from, to := s.ResendRange(start, end)
+		for n := from; n <= to; n++ {
+			m, ok := s.SentMessage(n)
+			if !ok {
+				m = secret.SentMessage{Seq: n}
+			}
+
+			sent = append(sent, m)
+		}
+	})
+
+	logger.D("resend secret messages", log.Int("start", start), log.Int("end", end), log.Int("count", len(sent)))
+	for i := range sent {
+		var (
+			m   e2e.DecryptedMessageClass
+			err error
+		)
+
+		if len(sent[i].Message) != 0 {
+			m, err = sent[i].Decode()
+		}
+
+		if m == nil || err != nil {
+			m = &e2e.DecryptedMessageService{
+				RandomID: randomInt64(),
+				Action:   &e2e.DecryptedMessageActionNoop{},
+			}
+		}
+
+		_, err = c.sendSecretAt(c.Context(), &sc, sent[i].Seq, m, true, sent[i].InputFile())
+		if err != nil {
+			logger.I("failed to resend secret message", log.Int("seq", sent[i].Seq), log.Error(err))
+			return
+		}
+	}
+}
+
+func (c *tgBot) onNewTelegramEncryptedMessage(ctx context.Context, e tg.Entities, update *tg.UpdateNewEncryptedMessage) error {
+	err := c.handleEncryptedMessage(update.GetMessage(), false)
+	c.ackSecretMessages(update.GetQts())
+	return err
+}
+
+// handleRecoveredSecretMessages appends missed messages in secret chats to
+// active sessions
+func (c *tgBot) handleRecoveredSecretMessages(msgs []tg.EncryptedMessageClass, qts int) {
+	for _, m := range msgs {
+		_ = c.handleEncryptedMessage(m, true)
+	}
+
+	if len(msgs) != 0 {
+		c.ackSecretMessages(qts)
+	}
+}
+
+// ackSecretMessages confirms messages in secret chats up to qts are received,
+// otherwise they are pushed again
+func (c *tgBot) ackSecretMessages(qts int) {
+	_, err := c.client.API().MessagesReceivedQueue(c.Context(), qts)
+	if err != nil {
+		c.Logger().I("failed to confirm secret messages", log.Int("qts", qts), log.Error(err))
+	}
+}
+
+func (c *tgBot) handleEncryptedMessage(msg tg.EncryptedMessageClass, recovered bool) error {
+	switch m := msg.(type) {
+	case *tg.EncryptedMessage:
+		file, _ := m.GetFile().(*tg.EncryptedFile)
+		return c.handleSecretMessage(m.GetChatID(), m.GetDate(), m.GetBytes(), file, recovered)
+	case *tg.EncryptedMessageService:
+		return c.handleSecretMessage(m.GetChatID(), m.GetDate(), m.GetBytes(), nil, recovered)
+	default:
+		c.Logger().I("unknown encrypted message type", log.Uint32("type_id", msg.TypeID()))
+		return nil
+	}
+}
+
+// handleSecretMessage decrypts the message in secret chat, and handles it with
+// messages held for it in order
+//
+// messages after a gap of seq numbers are held, and the peer is requested to
+// resend messages in the gap
+func (c *tgBot) handleSecretMessage(chatID, date int, data []byte, file *tg.EncryptedFile, recovered bool) error {
+	logger := c.Logger().WithFields(log.Int("secret_chat_id", chatID))
+
+	sc, ok := c.secrets.Get(chatID)
+	if !ok {
+		logger.D("message from unknown secret chat")
+		return nil
+	}
+
+	r, err := sc.Decrypt(date, data, file)
+	if err != nil {
+		logger.I("failed to decrypt secret message", log.Error(err))
+		return err
+	}
+
+	var (
+		ready  []*secret.Received
+		resend *e2e.DecryptedMessageActionResend
+	)
+
+	c.secrets.Update(chatID, func(sc *secretChat) {
+		ready, resend, err = sc.Receive(r)
+	})
+	if err != nil {
+		logger.I("bad secret message", log.Error(err))
+		return err
+	}
+
+	if resend != nil {
+		logger.D("request resending secret messages",
+			log.Int("start", resend.StartSeqNo), log.Int("end", resend.EndSeqNo))
+
+		err = c.sendSecret(c.Context(), chatID, &e2e.DecryptedMessageService{
+			RandomID: randomInt64(),
+			Action:   resend,
+		}, true, nil)
+		if err != nil {
+			logger.I("failed to request resending", log.Error(err))
+			err = nil
+		}
+	}
+
+	if len(ready) == 0 {
+		logger.V("secret message not handled yet", log.Int("seq_no", r.Layer.OutSeqNo))
+		return nil
+	}
+
+	for _, r := range ready {
+		err = multierr.Append(err, c.handleSecretLayer(chatID, r, recovered))
+	}
+
+	return err
+}
+
+// handleSecretLayer handles the message received in order as other messages
+func (c *tgBot) handleSecretLayer(chatID int, r *secret.Received, recovered bool) error {
+	if action, ok := secret.Action(r.Layer.Message); ok {
+		c.handleSecretService(chatID, action)
+		return nil
+	}
+
+	dm, ok := secret.Message(r.Layer.Message)
+	if !ok {
+		return nil
+	}
+
+	var (
+		sc      secretChat
+		msgID   int
+		replyTo int
+	)
+
+	c.secrets.Update(chatID, func(s *secretChat) {
+		sc = *s
+		msgID = s.AssignID(dm.RandomID)
+		if dm.ReplyToRandomID != 0 {
+			replyTo, _ = s.LookupID(dm.ReplyToRandomID)
+		}
+	})
+
+	mc := c.newSecretMessageContext(&sc, r, dm, msgID, replyTo)
+	mc.logger.V("new secret message", log.Int("layer", r.Layer.Layer))
+
+	var err error
+	if recovered {
+		err = c.appendSessionMessage(mc)
+	} else {
+		err = c.dispatchNewMessage(mc)
+	}
+
+	if err != nil {
+		mc.logger.I("bad message", log.Error(err))
+	}
+
+	return err
+}
+
+func (c *tgBot) handleSecretService(chatID int, action e2e.DecryptedMessageActionClass) {
+	switch a := action.(type) {
+	case *e2e.DecryptedMessageActionDeleteMessages:
+		var msgIDs []rt.MessageID
+		c.secrets.Update(chatID, func(sc *secretChat) {
+			for _, randomID := range a.RandomIDs {
+				if id, ok := sc.LookupID(randomID); ok {
+					msgIDs = append(msgIDs, rt.MessageID(id))
+				}
+			}
+		})
+
+		s, ok := c.sessions.ActiveSessionOf(chatIDWrapper{secret: chatID})
+		if !ok {
+			return
+		}
+
+		for _, id := range msgIDs {
+			c.deleteSessionMessage(s, id)
+		}
+	case *e2e.DecryptedMessageActionResend:
+		c.resendSecretMessages(chatID, a.StartSeqNo, a.EndSeqNo)
+	default:
+		// layer is updated when received, other actions are ignored
+	}
+}
@@ -0,0 +1,372 @@
+package secret
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tg/e2e"
+)
+
+const (
+	// maxPending is the max number of messages held for a gap of seq numbers,
+	// messages in the gap are skipped when exceeded
+	maxPending = 100
+
+	// maxSent is the number of recent messages kept for resending
+	maxSent = 100
+
+	// maxIDs is the number of recent message ids kept for random id mapping
+	maxIDs = 1000
+)
+
+// Chat is the state of an accepted secret chat
+type Chat struct {
+	ID         int    `json:"id"`
+	AccessHash int64  `json:"accessHash"`
+	Key        []byte `json:"key"`
+
+	// AdminID is the user requested the secret chat, ParticipantID is the user
+	// accepted it
+	AdminID       int64 `json:"adminID"`
+	ParticipantID int64 `json:"participantID"`
+
+	// Creator is true when the secret chat was requested by the client
+	Creator bool `json:"creator,omitempty"`
+
+	// Layer used in the secret chat, 0 when the peer hasn't notified its layer
+	Layer int `json:"layer"`
+
+	// InSeq and OutSeq are counts of messages received and sent
+	InSeq  int `json:"inSeq"`
+	OutSeq int `json:"outSeq"`
+
+	// Pending are messages received after a gap of seq numbers, by their
+	// out_seq_no, they are handled when the gap is filled
+	Pending map[int]*Received `json:"pending,omitempty"`
+
+	// Requested is the out_seq_no of the peer, messages before it were
+	// requested to resend
+	Requested int `json:"requested"`
+
+	// Sent are recent messages sent, kept for resending
+	Sent []SentMessage `json:"sent,omitempty"`
+
+	// LastID is the last local message id assigned, IDs maps random ids of
+	// recent messages to local ids
+	LastID int           `json:"lastID"`
+	IDs    map[int64]int `json:"ids,omitempty"`
+}
+
+// Received is a message received in the secret chat
+type Received struct {
+	Date int `json:"date"`
+
+	// File attached to the message, nil when there is no file
+	File *tg.EncryptedFile `json:"file,omitempty"`
+
+	// Payload is the decrypted DecryptedMessageLayer
+	Payload []byte `json:"payload"`
+
+	// Layer is decoded from Payload
+	Layer *e2e.DecryptedMessageLayer `json:"-"`
+}
+
+// SentMessage is a message sent in the secret chat
+type SentMessage struct {
+	// Seq is the count of messages sent before it
+	Seq int `json:"seq"`
+
+	// Message is the encoded DecryptedMessage or DecryptedMessageService
+	Message []byte `json:"message"`
+
+	// the encrypted file sent with the message
+	FileID         int64 `json:"fileID,omitempty"`
+	FileAccessHash int64 `json:"fileAccessHash,omitempty"`
+}
+
+// Decode decodes the message sent
+func (m *SentMessage) Decode() (e2e.DecryptedMessageClass, error) {
+	return e2e.DecodeDecryptedMessage(&bin.Buffer{Buf: m.Message})
+}
+
+// InputFile returns the encrypted file sent with the message, nil when there is
+// no file
+func (m *SentMessage) InputFile() tg.InputEncryptedFileClass {
+	if m.FileID == 0 {
+		return nil
+	}
+
+	return &tg.InputEncryptedFile{ID: m.FileID, AccessHash: m.FileAccessHash}
+}
+
+// InputPeer returns the peer to send messages
+func (c *Chat) InputPeer() tg.InputEncryptedChat {
+	return tg.InputEncryptedChat{ChatID: c.ID, AccessHash: c.AccessHash}
+}
+
+// layer returns the layer of messages sent to the peer
+func (c *Chat) layer() int {
+	if c.Layer == 0 {
+		return Layer
+	}
+
+	return c.Layer
+}
+
+func (c *Chat) updateLayer(layer int) {
+	if layer > Layer {
+		layer = Layer
+	}
+
+	if layer > c.Layer {
+		c.Layer = layer
+	}
+}
+
+// seq numbers of messages from the creator are odd, and even from the other
+// user, in_seq_no is the out_seq_no of next message expected from the peer
+//
+// ref: https://core.telegram.org/api/end-to-end/seq_no
+
+// x returns x used in key derivation of messages sent and received
+func (c *Chat) x() (out, in int) {
+	if c.Creator {
+		return xCreator, xParticipant
+	}
+
+	return xParticipant, xCreator
+}
+
+func (c *Chat) inSeqNo() int {
+	if c.Creator {
+		return 2 * c.InSeq
+	}
+
+	return 2*c.InSeq + 1
+}
+
+func (c *Chat) outSeqNo(n int) int {
+	if c.Creator {
+		return 2*n + 1
+	}
+
+	return 2 * n
+}
+
+// Encrypt encrypts m as the n-th message sent, in the layer of the peer
+func (c *Chat) Encrypt(n int, m e2e.DecryptedMessageClass) ([]byte, error) {
+	layer := c.layer()
+	payload, err := encodeLayer(layer, c.inSeqNo(), c.outSeqNo(n), downgrade(layer, m))
+	if err != nil {
+		return nil, err
+	}
+
+	x, _ := c.x()
+	return encryptMessage(c.Key, x, payload)
+}
+
+// Decrypt decrypts the message sent by the peer
+func (c *Chat) Decrypt(date int, data []byte, file *tg.EncryptedFile) (*Received, error) {
+	_, x := c.x()
+	payload, err := decryptMessage(c.Key, x, data)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := DecodeLayer(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Received{Date: date, File: file, Payload: payload, Layer: l}, nil
+}
+
+// Receive records the message received, and returns messages ready to handle
+// in order, duplicate messages are dropped
+//
+// when there is a gap of seq numbers before the message, it's held until the
+// gap is filled, and resend is the action to request messages in the gap, nil
+// when they were requested before
+func (c *Chat) Receive(r *Received) (ready []*Received, resend *e2e.DecryptedMessageActionResend, err error) {
+	seqNo := r.Layer.OutSeqNo
+	if seqNo < 0 || seqNo%2 != c.inSeqNo()%2 {
+		return nil, nil, fmt.Errorf("unexpected out_seq_no %d", seqNo)
+	}
+
+	expected := c.inSeqNo()
+	switch {
+	case seqNo < expected:
+		return nil, nil, nil
+	case seqNo == expected:
+		c.InSeq++
+		return c.drain(append(ready, r)), nil, nil
+	}
+
+	if c.Pending == nil {
+		c.Pending = make(map[int]*Received)
+	}
+	c.Pending[seqNo] = r
+
+	if len(c.Pending) > maxPending {
+		// the gap is not filled after resending, skip it
+		seqNos := make([]int, 0, len(c.Pending))
+		for k := range c.Pending {
+			seqNos = append(seqNos, k)
+		}
+		sort.Ints(seqNos)
+
+		c.InSeq = seqNos[0] / 2
+		return c.drain(nil), nil, nil
+	}
+
+	start := expected
+	if c.Requested > start {
+		start = c.Requested
+	}
+
+	end := seqNo - 2
+	if start > end {
+		return nil, nil, nil
+	}
+
+	c.Requested = seqNo
+	return nil, &e2e.DecryptedMessageActionResend{StartSeqNo: start, EndSeqNo: end}, nil
+}
+
+// drain appends pending messages following the received ones to ready, and
+// updates the layer of the peer
+func (c *Chat) drain(ready []*Received) []*Received {
+	for {
+		r, ok := c.Pending[c.inSeqNo()]
+		if !ok {
+			break
+		}
+
+		delete(c.Pending, c.inSeqNo())
+		c.InSeq++
+
+		if r.Layer == nil {
+			// loaded from storage
+			l, err := DecodeLayer(r.Payload)
+			if err != nil {
+				continue
+			}
+
+			r.Layer = l
+		}
+
+		ready = append(ready, r)
+	}
+
+	for _, r := range ready {
+		c.updateLayer(r.Layer.Layer)
+
+		action, _ := Action(r.Layer.Message)
+		if a, ok := action.(*e2e.DecryptedMessageActionNotifyLayer); ok {
+			c.updateLayer(a.Layer)
+		}
+	}
+
+	return ready
+}
+
+// MarkSent records m sent as the next message, file is the encrypted file sent
+// with it
+func (c *Chat) MarkSent(m e2e.DecryptedMessageClass, file *tg.EncryptedFile) error {
+	b := &bin.Buffer{}
+	err := m.Encode(b)
+	if err != nil {
+		return err
+	}
+
+	sent := SentMessage{Seq: c.OutSeq, Message: b.Buf}
+	if file != nil {
+		sent.FileID, sent.FileAccessHash = file.GetID(), file.GetAccessHash()
+	}
+
+	c.Sent = append(c.Sent, sent)
+	if len(c.Sent) > maxSent {
+		c.Sent = append(c.Sent[:0], c.Sent[len(c.Sent)-maxSent:]...)
+	}
+
+	c.OutSeq++
+	return nil
+}
+
+// ResendRange returns counts of messages sent requested by the peer to resend
+// with seq numbers in [start, end], from > to when there is none
+func (c *Chat) ResendRange(start, end int) (from, to int) {
+	p := c.outSeqNo(0)
+	if start < p {
+		start = p
+	}
+
+	if end < p {
+		return 0, -1
+	}
+
+	from, to = (start-p+1)/2, (end-p)/2
+
+	if to >= c.OutSeq {
+		to = c.OutSeq - 1
+	}
+
+	return
+}
+
+// SentMessage returns the n-th message sent, ok is false when it's not kept
+func (c *Chat) SentMessage(n int) (_ SentMessage, ok bool) {
+	for _, m := range c.Sent {
+		if m.Seq == n {
+			return m, true
+		}
+	}
+
+	return
+}
+
+// AssignID returns the local message id of the message with randomID, ids are
+// assigned in order, as random ids are 64-bit and message ids are not
+func (c *Chat) AssignID(randomID int64) int {
+	if id, ok := c.IDs[randomID]; ok {
+		return id
+	}
+
+	if c.IDs == nil {
+		c.IDs = make(map[int64]int)
+	}
+
+	c.LastID++
+	c.IDs[randomID] = c.LastID
+
+	if len(c.IDs) > maxIDs+maxIDs/10 {
+		for k, id := range c.IDs {
+			if id <= c.LastID-maxIDs {
+				delete(c.IDs, k)
+			}
+		}
+	}
+
+	return c.LastID
+}
+
+// LookupID returns the local message id of the message with randomID, ok is
+// false when it's unknown
+func (c *Chat) LookupID(randomID int64) (id int, ok bool) {
+	id, ok = c.IDs[randomID]
+	return
+}
+
+// RandomID returns the random id of the message with local id, ok is false when
+// it's unknown
+func (c *Chat) RandomID(id int) (int64, bool) {
+	for k, v := range c.IDs {
+		if v == id {
+			return k, true
+		}
+	}
+
+	return 0, false
+}
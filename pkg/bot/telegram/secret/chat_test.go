@@ -0,0 +1,245 @@
+package secret
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tg/e2e"
+	"github.com/stretchr/testify/assert"
+)
+
+// received creates the message sent by the creator with out_seq_no
+func received(t *testing.T, c *Chat, seqNo int, m e2e.DecryptedMessageClass) *Received {
+	payload, err := encodeLayer(Layer, 0, seqNo, m)
+	assert.NoError(t, err)
+
+	data, err := encryptMessage(c.Key, xCreator, payload)
+	assert.NoError(t, err)
+
+	r, err := c.Decrypt(seqNo, data, nil)
+	assert.NoError(t, err)
+	return r
+}
+
+func textMessage(randomID int64) *e2e.DecryptedMessage {
+	return &e2e.DecryptedMessage{RandomID: randomID, Message: "hello"}
+}
+
+func seqNosOf(ready []*Received) (ret []int) {
+	for _, r := range ready {
+		ret = append(ret, r.Layer.OutSeqNo)
+	}
+
+	return
+}
+
+func TestChatReceive(t *testing.T) {
+	c := &Chat{Key: randomBytes(t, KeySize)}
+
+	ready, resend, err := c.Receive(received(t, c, 1, &e2e.DecryptedMessageService{
+		RandomID: 1,
+		Action:   &e2e.DecryptedMessageActionNotifyLayer{Layer: 46},
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, resend)
+	assert.Equal(t, []int{1}, seqNosOf(ready))
+	assert.Equal(t, 1, c.InSeq)
+	assert.Equal(t, Layer, c.Layer)
+
+	// duplicate
+	ready, resend, err = c.Receive(received(t, c, 1, textMessage(1)))
+	assert.NoError(t, err)
+	assert.Nil(t, resend)
+	assert.Empty(t, ready)
+
+	// not sent by the creator
+	_, _, err = c.Receive(received(t, c, 2, textMessage(2)))
+	assert.Error(t, err)
+
+	t.Run("Gap", func(t *testing.T) {
+		// 3 and 5 are missing
+		ready, resend, err := c.Receive(received(t, c, 7, textMessage(7)))
+		assert.NoError(t, err)
+		assert.Empty(t, ready)
+		assert.Equal(t, &e2e.DecryptedMessageActionResend{StartSeqNo: 3, EndSeqNo: 5}, resend)
+
+		// requested before
+		ready, resend, err = c.Receive(received(t, c, 7, textMessage(7)))
+		assert.NoError(t, err)
+		assert.Empty(t, ready)
+		assert.Nil(t, resend)
+
+		// only the new gap is requested
+		ready, resend, err = c.Receive(received(t, c, 11, textMessage(11)))
+		assert.NoError(t, err)
+		assert.Empty(t, ready)
+		assert.Equal(t, &e2e.DecryptedMessageActionResend{StartSeqNo: 7, EndSeqNo: 9}, resend)
+
+		ready, _, err = c.Receive(received(t, c, 5, textMessage(5)))
+		assert.NoError(t, err)
+		assert.Empty(t, ready)
+
+		// pending messages survive restart
+		data, err := json.Marshal(c)
+		assert.NoError(t, err)
+		c2 := &Chat{}
+		assert.NoError(t, json.Unmarshal(data, c2))
+
+		for _, c := range []*Chat{c, c2} {
+			ready, resend, err = c.Receive(received(t, c, 3, textMessage(3)))
+			assert.NoError(t, err)
+			assert.Nil(t, resend)
+			assert.Equal(t, []int{3, 5, 7}, seqNosOf(ready))
+			assert.Equal(t, 4, c.InSeq)
+
+			ready, _, err = c.Receive(received(t, c, 9, textMessage(9)))
+			assert.NoError(t, err)
+			assert.Equal(t, []int{9, 11}, seqNosOf(ready))
+			assert.Equal(t, 6, c.InSeq)
+			assert.Empty(t, c.Pending)
+		}
+	})
+
+	t.Run("Skip Gap", func(t *testing.T) {
+		c := &Chat{Key: randomBytes(t, KeySize)}
+
+		seqNo := 3
+		for i := 0; i < maxPending; i++ {
+			ready, _, err := c.Receive(received(t, c, seqNo, textMessage(int64(seqNo))))
+			assert.NoError(t, err)
+			assert.Empty(t, ready)
+			seqNo += 2
+		}
+
+		ready, _, err := c.Receive(received(t, c, seqNo, textMessage(int64(seqNo))))
+		assert.NoError(t, err)
+		assert.Len(t, ready, maxPending+1)
+		assert.Equal(t, 3, ready[0].Layer.OutSeqNo)
+		assert.Equal(t, maxPending+2, c.InSeq)
+		assert.Empty(t, c.Pending)
+	})
+}
+
+func TestChatSent(t *testing.T) {
+	c := &Chat{Key: randomBytes(t, KeySize)}
+
+	from, to := c.ResendRange(0, 10)
+	assert.Greater(t, from, to)
+
+	for i := 0; i < maxSent+10; i++ {
+		var file *tg.EncryptedFile
+		if i == maxSent+9 {
+			file = &tg.EncryptedFile{ID: 1, AccessHash: 2}
+		}
+
+		assert.NoError(t, c.MarkSent(textMessage(int64(i)), file))
+	}
+	assert.Equal(t, maxSent+10, c.OutSeq)
+	assert.Len(t, c.Sent, maxSent)
+
+	_, ok := c.SentMessage(9)
+	assert.False(t, ok)
+
+	m, ok := c.SentMessage(maxSent + 9)
+	if assert.True(t, ok) {
+		assert.Equal(t, &tg.InputEncryptedFile{ID: 1, AccessHash: 2}, m.InputFile())
+
+		dm, err := m.Decode()
+		assert.NoError(t, err)
+		assert.EqualValues(t, maxSent+9, dm.GetRandomID())
+	}
+
+	// our seq numbers are even
+	from, to = c.ResendRange(3, 8)
+	assert.Equal(t, 2, from)
+	assert.Equal(t, 4, to)
+
+	from, to = c.ResendRange(2*maxSent, 4*maxSent)
+	assert.Equal(t, maxSent, from)
+	assert.Equal(t, maxSent+9, to)
+
+	// in_seq_no is the next out_seq_no expected from the creator
+	c.InSeq = 2
+	data, err := c.Encrypt(3, textMessage(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	payload, err := decryptMessage(c.Key, xParticipant, data)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	l, err := DecodeLayer(payload)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 5, l.InSeqNo)
+		assert.Equal(t, 6, l.OutSeqNo)
+	}
+}
+
+func TestChatIDs(t *testing.T) {
+	c := &Chat{}
+
+	// random ids colliding when truncated to 32-bit
+	assert.Equal(t, 1, c.AssignID(1))
+	assert.Equal(t, 2, c.AssignID(1<<32+1))
+	assert.Equal(t, 1, c.AssignID(1))
+
+	id, ok := c.LookupID(1<<32 + 1)
+	assert.True(t, ok)
+	assert.Equal(t, 2, id)
+
+	_, ok = c.LookupID(2)
+	assert.False(t, ok)
+
+	randomID, ok := c.RandomID(2)
+	assert.True(t, ok)
+	assert.EqualValues(t, 1<<32+1, randomID)
+
+	_, ok = c.RandomID(3)
+	assert.False(t, ok)
+
+	for i := 0; i < 2*maxIDs; i++ {
+		c.AssignID(int64(100 + i))
+	}
+
+	assert.LessOrEqual(t, len(c.IDs), maxIDs+maxIDs/10)
+	_, ok = c.LookupID(1)
+	assert.False(t, ok)
+
+	id, ok = c.LookupID(int64(100 + 2*maxIDs - 1))
+	assert.True(t, ok)
+	assert.Equal(t, 2*maxIDs+2, id)
+}
+
+func TestChatPeers(t *testing.T) {
+	key := randomBytes(t, KeySize)
+	creator, participant := &Chat{Key: key, Creator: true}, &Chat{Key: key}
+
+	for i, pair := range [][2]*Chat{{creator, participant}, {participant, creator}} {
+		from, to := pair[0], pair[1]
+
+		for n := 0; n < 2; n++ {
+			data, err := from.Encrypt(n, textMessage(int64(n)))
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NoError(t, from.MarkSent(textMessage(int64(n)), nil))
+
+			r, err := to.Decrypt(0, data, nil)
+			if !assert.NoError(t, err, i) {
+				return
+			}
+
+			ready, resend, err := to.Receive(r)
+			assert.NoError(t, err)
+			assert.Nil(t, resend)
+			assert.Len(t, ready, 1)
+		}
+	}
+
+	from, to := creator.ResendRange(0, 2)
+	assert.Equal(t, 0, from)
+	assert.Equal(t, 0, to)
+}
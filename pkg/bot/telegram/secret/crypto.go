@@ -0,0 +1,244 @@
+// Package secret implements end-to-end encryption and message sequencing of
+// telegram secret chats on top of the TL types in package e2e
+//
+// the client only accepts secret chats, so it's always the participant, the
+// peer is the creator (admin) of the secret chat
+//
+// ref: https://core.telegram.org/api/end-to-end
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/gotd/ige"
+	"github.com/gotd/td/tg"
+)
+
+const (
+	// KeySize is the size of the shared key in bytes
+	KeySize = 256
+
+	// x used in key derivation, it's 0 for messages sent by the creator of the
+	// secret chat, and 8 for messages sent by the other user
+	xCreator     = 0
+	xParticipant = 8
+)
+
+// ComputeKey generates b for the secret chat requested with g_a, and returns the
+// shared key and g_b
+func ComputeKey(cfg *tg.MessagesDhConfig, ga []byte) (key, gb []byte, err error) {
+	p := new(big.Int).SetBytes(cfg.GetP())
+	err = checkDHConfig(cfg.GetG(), p)
+	if err != nil {
+		return
+	}
+
+	gaInt := new(big.Int).SetBytes(ga)
+	err = checkDHValue(gaInt, p)
+	if err != nil {
+		return
+	}
+
+	// mix random bytes from the server
+	b := make([]byte, KeySize)
+	_, err = io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return
+	}
+
+	for i, v := range cfg.GetRandom() {
+		if i < len(b) {
+			b[i] ^= v
+		}
+	}
+
+	bInt := new(big.Int).SetBytes(b)
+	gbInt := new(big.Int).Exp(big.NewInt(int64(cfg.GetG())), bInt, p)
+	err = checkDHValue(gbInt, p)
+	if err != nil {
+		return
+	}
+
+	key = new(big.Int).Exp(gaInt, bInt, p).FillBytes(make([]byte, KeySize))
+	gb = gbInt.FillBytes(make([]byte, KeySize))
+	return
+}
+
+// checkDHConfig checks the prime and generator returned by messages.getDhConfig
+func checkDHConfig(g int, p *big.Int) error {
+	if p.BitLen() != KeySize*8 {
+		return fmt.Errorf("unexpected %d-bit prime", p.BitLen())
+	}
+
+	if !p.ProbablyPrime(20) {
+		return fmt.Errorf("p is not a prime")
+	}
+
+	// p is odd, (p-1)/2 is p>>1
+	if !new(big.Int).Rsh(p, 1).ProbablyPrime(20) {
+		return fmt.Errorf("p is not a safe prime")
+	}
+
+	mod := func(m int64) int64 {
+		return new(big.Int).Mod(p, big.NewInt(m)).Int64()
+	}
+
+	// g generates a cyclic subgroup of prime order (p-1)/2
+	var ok bool
+	switch g {
+	case 2:
+		ok = mod(8) == 7
+	case 3:
+		ok = mod(3) == 2
+	case 4:
+		ok = true
+	case 5:
+		r := mod(5)
+		ok = r == 1 || r == 4
+	case 6:
+		r := mod(24)
+		ok = r == 19 || r == 23
+	case 7:
+		r := mod(7)
+		ok = r == 3 || r == 5 || r == 6
+	}
+
+	if !ok {
+		return fmt.Errorf("bad generator %d", g)
+	}
+
+	return nil
+}
+
+// checkDHValue checks g_a or g_b is in range (2^{2048-64}, p-2^{2048-64})
+func checkDHValue(v, p *big.Int) error {
+	low := new(big.Int).Lsh(big.NewInt(1), KeySize*8-64)
+	high := new(big.Int).Sub(p, low)
+
+	if v.Cmp(low) <= 0 || v.Cmp(high) >= 0 {
+		return fmt.Errorf("dh value out of range")
+	}
+
+	return nil
+}
+
+// KeyFingerprint returns the fingerprint of the shared key, which is the last
+// 64 bits of its sha1 hash
+func KeyFingerprint(key []byte) int64 {
+	sum := sha1.Sum(key)
+	return int64(binary.LittleEndian.Uint64(sum[12:]))
+}
+
+// messageKey returns msg_key of the padded plaintext
+func messageKey(key []byte, x int, plaintext []byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write(key[88+x : 88+x+32])
+	_, _ = h.Write(plaintext)
+	return h.Sum(nil)[8:24]
+}
+
+// aesKeyIV derives aes key and iv from the shared key and msg_key
+func aesKeyIV(key, msgKey []byte, x int) (aesKey, iv []byte) {
+	h := sha256.New()
+	_, _ = h.Write(msgKey)
+	_, _ = h.Write(key[x : x+36])
+	a := h.Sum(nil)
+
+	h.Reset()
+	_, _ = h.Write(key[40+x : 40+x+36])
+	_, _ = h.Write(msgKey)
+	b := h.Sum(nil)
+
+	aesKey = make([]byte, 0, 32)
+	aesKey = append(aesKey, a[:8]...)
+	aesKey = append(aesKey, b[8:24]...)
+	aesKey = append(aesKey, a[24:32]...)
+
+	iv = make([]byte, 0, 32)
+	iv = append(iv, b[:8]...)
+	iv = append(iv, a[8:24]...)
+	iv = append(iv, b[24:32]...)
+
+	return
+}
+
+// encryptMessage encrypts the serialized DecryptedMessageLayer
+func encryptMessage(key []byte, x int, payload []byte) ([]byte, error) {
+	sz := 4 + len(payload)
+	padding := 12 + (aes.BlockSize-(sz+12)%aes.BlockSize)%aes.BlockSize
+
+	plaintext := make([]byte, sz+padding)
+	binary.LittleEndian.PutUint32(plaintext, uint32(len(payload)))
+	copy(plaintext[4:], payload)
+	_, err := io.ReadFull(rand.Reader, plaintext[sz:])
+	if err != nil {
+		return nil, err
+	}
+
+	msgKey := messageKey(key, x, plaintext)
+	aesKey, iv := aesKeyIV(key, msgKey, x)
+	blk, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, 24+len(plaintext))
+	binary.LittleEndian.PutUint64(ret, uint64(KeyFingerprint(key)))
+	copy(ret[8:24], msgKey)
+	ige.EncryptBlocks(blk, iv, ret[24:], plaintext)
+
+	return ret, nil
+}
+
+// decryptMessage decrypts the data of encrypted message to serialized
+// DecryptedMessageLayer, x is the one used by the sender
+func decryptMessage(key []byte, x int, data []byte) ([]byte, error) {
+	if len(data) < 24+aes.BlockSize || (len(data)-24)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted data size %d", len(data))
+	}
+
+	if int64(binary.LittleEndian.Uint64(data)) != KeyFingerprint(key) {
+		return nil, fmt.Errorf("key fingerprint mismatch")
+	}
+
+	msgKey := data[8:24]
+	aesKey, iv := aesKeyIV(key, msgKey, x)
+	blk, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(data)-24)
+	ige.DecryptBlocks(blk, iv, plaintext, data[24:])
+
+	if subtle.ConstantTimeCompare(msgKey, messageKey(key, x, plaintext)) != 1 {
+		return nil, fmt.Errorf("msg_key mismatch")
+	}
+
+	sz := int64(binary.LittleEndian.Uint32(plaintext))
+	padding := int64(len(plaintext)) - 4 - sz
+	if padding < 12 || padding > 1024 {
+		return nil, fmt.Errorf("invalid padding size %d", padding)
+	}
+
+	return plaintext[4 : 4+sz], nil
+}
+
+// FileFingerprint returns the key fingerprint of encrypted file
+func FileFingerprint(key, iv []byte) int32 {
+	h := md5.New()
+	_, _ = h.Write(key)
+	_, _ = h.Write(iv)
+	sum := h.Sum(nil)
+
+	return int32(binary.LittleEndian.Uint32(sum[0:4]) ^ binary.LittleEndian.Uint32(sum[4:8]))
+}
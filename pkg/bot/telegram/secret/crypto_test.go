@@ -0,0 +1,80 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	ret := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, ret)
+	assert.NoError(t, err)
+	return ret
+}
+
+func TestComputeKey(t *testing.T) {
+	// prime used by telegram servers
+	p, _ := hex.DecodeString("" +
+		"c71caeb9c6b1c9048e6c522f70f13f73980d40238e3e21c14934d037563d930f" +
+		"48198a0aa7c14058229493d22530f4dbfa336f6e0ac925139543aed44cce7c37" +
+		"20fd51f69458705ac68cd4fe6b6b13abdc9746512969328454f18faf8c595f64" +
+		"2477fe96bb2a941d5bcd1d4ac8cc49880708fa9b378e3c4f3a9060bee67cf9a4" +
+		"a4a695811051907e162753b56b0f6b410dba74d8a84b2a14b3144e0ef1284754" +
+		"fd17ed950d5965b4b9dd46582db1178d169c6bc465b0d6ff9ca3928fef5b9ae4" +
+		"e418fc15e83ebea0f87fa9ff5eed70050ded2849f47bf959d956850ce929851f" +
+		"0d8115f635b105ee2e4e15d04b2454bf6f4fadf034b10403119cd8e3b92fcc5b",
+	)
+	cfg := &tg.MessagesDhConfig{G: 3, P: p, Random: randomBytes(t, KeySize)}
+	pInt := new(big.Int).SetBytes(p)
+
+	// the creator
+	a := new(big.Int).SetBytes(randomBytes(t, KeySize))
+	ga := new(big.Int).Exp(big.NewInt(3), a, pInt)
+
+	key, gb, err := ComputeKey(cfg, ga.Bytes())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	expected := new(big.Int).Exp(new(big.Int).SetBytes(gb), a, pInt).FillBytes(make([]byte, KeySize))
+	assert.Equal(t, expected, key)
+
+	_, _, err = ComputeKey(cfg, []byte{1})
+	assert.Error(t, err)
+
+	cfg.G = 2
+	_, _, err = ComputeKey(cfg, ga.Bytes())
+	assert.Error(t, err)
+}
+
+func TestMessageCrypto(t *testing.T) {
+	key := randomBytes(t, KeySize)
+	payload := []byte("hello secret chat")
+
+	data, err := encryptMessage(key, xParticipant, payload)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Zero(t, (len(data)-24)%aes.BlockSize)
+
+	plaintext, err := decryptMessage(key, xParticipant, data)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, plaintext)
+
+	_, err = decryptMessage(key, xCreator, data)
+	assert.Error(t, err)
+
+	_, err = decryptMessage(randomBytes(t, KeySize), xParticipant, data)
+	assert.Error(t, err)
+
+	data[len(data)-1] ^= 1
+	_, err = decryptMessage(key, xParticipant, data)
+	assert.Error(t, err)
+}
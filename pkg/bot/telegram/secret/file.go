@@ -0,0 +1,199 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/gotd/ige"
+)
+
+var _ io.Writer = (*FileWriter)(nil)
+
+// FileWriter decrypts the encrypted file written to it with aes-256-ige, and
+// writes at most size bytes of the plaintext to w
+type FileWriter struct {
+	w     io.Writer
+	block cipher.Block
+
+	// iv of next block, the last cipher text and plain text block
+	iv []byte
+
+	// buf holds cipher text not forming a full block
+	buf       []byte
+	plaintext []byte
+
+	left int64
+}
+
+// NewFileWriter creates FileWriter decrypting the file with key and iv from the
+// media of the message
+func NewFileWriter(w io.Writer, key, iv []byte, size int64) (*FileWriter, error) {
+	if len(key) != 32 || len(iv) != 32 {
+		return nil, fmt.Errorf("invalid key or iv size")
+	}
+
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileWriter{
+		w:     w,
+		block: blk,
+		iv:    append([]byte(nil), iv...),
+		left:  size,
+	}, nil
+}
+
+// Write implements io.Writer
+func (d *FileWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	n := len(d.buf) &^ (aes.BlockSize - 1)
+	if n == 0 {
+		return len(p), nil
+	}
+
+	if cap(d.plaintext) < n {
+		d.plaintext = make([]byte, n)
+	}
+
+	plaintext := d.plaintext[:n]
+	ige.DecryptBlocks(d.block, d.iv, plaintext, d.buf[:n])
+
+	copy(d.iv[:aes.BlockSize], d.buf[n-aes.BlockSize:n])
+	copy(d.iv[aes.BlockSize:], plaintext[n-aes.BlockSize:])
+	d.buf = append(d.buf[:0], d.buf[n:]...)
+
+	// drop padding
+	if int64(len(plaintext)) > d.left {
+		plaintext = plaintext[:d.left]
+	}
+	d.left -= int64(len(plaintext))
+
+	if len(plaintext) != 0 {
+		_, err := d.w.Write(plaintext)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+var _ io.Reader = (*FileReader)(nil)
+
+// FileReader encrypts the file read from r with a random key and iv, the last
+// block is padded with random bytes
+type FileReader struct {
+	// Key and IV to decrypt the file, sent in the media of the message
+	Key []byte
+	IV  []byte
+
+	r     io.Reader
+	block cipher.Block
+	iv    []byte
+
+	// size of the file left to read
+	left int64
+
+	// buf holds encrypted blocks not read yet
+	buf       []byte
+	off       int
+	plaintext []byte
+}
+
+// NewFileReader creates FileReader encrypting size bytes from r
+func NewFileReader(r io.Reader, size int64) (*FileReader, error) {
+	key := make([]byte, 64)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileReader{
+		Key: key[:32],
+		IV:  append([]byte(nil), key[32:]...),
+
+		r:     r,
+		block: blk,
+		iv:    key[32:],
+		left:  size,
+	}, nil
+}
+
+// Size returns size of the encrypted file
+func (e *FileReader) Size() int64 {
+	return EncryptedFileSize(e.left + int64(len(e.buf)-e.off))
+}
+
+// EncryptedFileSize returns size of the file after encryption
+func EncryptedFileSize(size int64) int64 {
+	return (size + aes.BlockSize - 1) &^ (aes.BlockSize - 1)
+}
+
+// Read implements io.Reader
+func (e *FileReader) Read(p []byte) (int, error) {
+	if e.off == len(e.buf) {
+		err := e.fill(len(p))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.buf[e.off:])
+	e.off += n
+	return n, nil
+}
+
+// fill encrypts next blocks of about n bytes
+func (e *FileReader) fill(n int) error {
+	if e.left <= 0 {
+		return io.EOF
+	}
+
+	n = (n + aes.BlockSize - 1) &^ (aes.BlockSize - 1)
+	if int64(n) > EncryptedFileSize(e.left) {
+		n = int(EncryptedFileSize(e.left))
+	}
+
+	if cap(e.buf) < n {
+		e.buf = make([]byte, n)
+		e.plaintext = make([]byte, n)
+	}
+	e.buf, e.off = e.buf[:n], 0
+	plaintext := e.plaintext[:n]
+
+	sz := n
+	if int64(sz) > e.left {
+		sz = int(e.left)
+	}
+
+	_, err := io.ReadFull(e.r, plaintext[:sz])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return err
+	}
+
+	_, err = io.ReadFull(rand.Reader, plaintext[sz:])
+	if err != nil {
+		return err
+	}
+	e.left -= int64(sz)
+
+	ige.EncryptBlocks(e.block, e.iv, e.buf, plaintext)
+	copy(e.iv[:aes.BlockSize], e.buf[n-aes.BlockSize:])
+	copy(e.iv[aes.BlockSize:], plaintext[n-aes.BlockSize:])
+
+	return nil
+}
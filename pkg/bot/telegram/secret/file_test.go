@@ -0,0 +1,88 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io"
+	"testing"
+
+	"github.com/gotd/ige"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileWriter(t *testing.T) {
+	key, iv := randomBytes(t, 32), randomBytes(t, 32)
+	plaintext := randomBytes(t, 1000)
+
+	padded := make([]byte, 1008)
+	copy(padded, plaintext)
+
+	blk, err := aes.NewCipher(key)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	encrypted := make([]byte, len(padded))
+	ige.EncryptBlocks(blk, iv, encrypted, padded)
+
+	var out bytes.Buffer
+	w, err := NewFileWriter(&out, key, iv, int64(len(plaintext)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, sz := range []int{1, 15, 16, 100, 300} {
+		n, err := w.Write(encrypted[:sz])
+		assert.NoError(t, err)
+		assert.Equal(t, sz, n)
+		encrypted = encrypted[sz:]
+	}
+
+	_, err = w.Write(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, out.Bytes())
+}
+
+func TestFileReader(t *testing.T) {
+	for _, sz := range []int{0, 1, 16, 1000, 40000} {
+		plaintext := randomBytes(t, sz)
+
+		r, err := NewFileReader(bytes.NewReader(plaintext), int64(sz))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.EqualValues(t, EncryptedFileSize(int64(sz)), r.Size())
+
+		// read in chunks not aligned to blocks
+		var encrypted []byte
+		buf := make([]byte, 1000)
+		for {
+			n, err := r.Read(buf)
+			encrypted = append(encrypted, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+
+			if !assert.NoError(t, err) {
+				return
+			}
+		}
+		assert.Len(t, encrypted, int(EncryptedFileSize(int64(sz))))
+
+		var out bytes.Buffer
+		w, err := NewFileWriter(&out, r.Key, r.IV, int64(sz))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		_, err = w.Write(encrypted)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plaintext, out.Bytes()))
+	}
+
+	r, err := NewFileReader(bytes.NewReader([]byte("short")), 10)
+	if assert.NoError(t, err) {
+		_, err = io.ReadAll(r)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	}
+}
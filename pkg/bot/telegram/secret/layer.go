@@ -0,0 +1,184 @@
+package secret
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg/e2e"
+)
+
+// Layer is the highest layer of secret chats supported, peers send messages in
+// the lower one of their layer and this
+const Layer = 73
+
+// DecodeLayer decodes the decrypted DecryptedMessageLayer
+func DecodeLayer(payload []byte) (*e2e.DecryptedMessageLayer, error) {
+	var l e2e.DecryptedMessageLayer
+
+	b := &bin.Buffer{Buf: payload}
+	id, err := b.PeekID()
+	if err == nil && id != e2e.DecryptedMessageLayerTypeID {
+		// messages of layer 8 are not wrapped
+		return nil, fmt.Errorf("unsupported message type %#x", id)
+	}
+
+	err = l.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+// encodeLayer wraps m with DecryptedMessageLayer
+func encodeLayer(layer, inSeqNo, outSeqNo int, m e2e.DecryptedMessageClass) ([]byte, error) {
+	randomBytes := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bin.Buffer{}
+	err = (&e2e.DecryptedMessageLayer{
+		RandomBytes: randomBytes,
+		Layer:       layer,
+		InSeqNo:     inSeqNo,
+		OutSeqNo:    outSeqNo,
+		Message:     m,
+	}).Encode(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Buf, nil
+}
+
+// Message converts messages of all layers to DecryptedMessage, ok is false
+// when m is a service message
+func Message(m e2e.DecryptedMessageClass) (ret *e2e.DecryptedMessage, ok bool) {
+	switch m := m.(type) {
+	case *e2e.DecryptedMessage:
+		return m, true
+	case *e2e.DecryptedMessage46:
+		ret = &e2e.DecryptedMessage{
+			RandomID:        m.RandomID,
+			TTL:             m.TTL,
+			Message:         m.Message,
+			Media:           m.Media,
+			Entities:        m.Entities,
+			ViaBotName:      m.ViaBotName,
+			ReplyToRandomID: m.ReplyToRandomID,
+		}
+	case *e2e.DecryptedMessage23:
+		ret = &e2e.DecryptedMessage{
+			RandomID: m.RandomID,
+			TTL:      m.TTL,
+			Message:  m.Message,
+			Media:    m.Media,
+		}
+	case *e2e.DecryptedMessage8:
+		ret = &e2e.DecryptedMessage{
+			RandomID: m.RandomID,
+			Message:  m.Message,
+			Media:    m.Media,
+		}
+	default:
+		return nil, false
+	}
+
+	return ret, true
+}
+
+// Action returns the action of the service message, ok is false when m is not
+// a service message
+func Action(m e2e.DecryptedMessageClass) (_ e2e.DecryptedMessageActionClass, ok bool) {
+	switch m := m.(type) {
+	case *e2e.DecryptedMessageService:
+		return m.Action, true
+	case *e2e.DecryptedMessageService8:
+		return m.Action, true
+	default:
+		return nil, false
+	}
+}
+
+// downgrade converts DecryptedMessage to the constructor available in the
+// layer, fields not available are dropped
+func downgrade(layer int, m e2e.DecryptedMessageClass) e2e.DecryptedMessageClass {
+	dm, ok := m.(*e2e.DecryptedMessage)
+	if !ok {
+		return m
+	}
+
+	// entities added after layer 45 are not supported yet
+	var entities []e2e.MessageEntityClass
+	for _, ent := range dm.Entities {
+		if isLayer45Entity(ent) {
+			entities = append(entities, ent)
+		}
+	}
+
+	if layer >= 73 {
+		ret := *dm
+		ret.Entities = entities
+		return &ret
+	}
+
+	media := dm.Media
+	if media == nil {
+		media = &e2e.DecryptedMessageMediaEmpty{}
+	}
+
+	if layer >= 45 {
+		return &e2e.DecryptedMessage46{
+			RandomID:        dm.RandomID,
+			TTL:             dm.TTL,
+			Message:         dm.Message,
+			Media:           dm.Media,
+			Entities:        entities,
+			ViaBotName:      dm.ViaBotName,
+			ReplyToRandomID: dm.ReplyToRandomID,
+		}
+	}
+
+	// no captions and document attributes before layer 45
+	if doc, ok := media.(*e2e.DecryptedMessageMediaDocument46); ok {
+		d23 := &e2e.DecryptedMessageMediaDocument23{
+			Thumb:    doc.Thumb,
+			MimeType: doc.MimeType,
+			Size:     doc.Size,
+			Key:      doc.Key,
+			Iv:       doc.Iv,
+		}
+
+		for _, attr := range doc.Attributes {
+			if a, ok := attr.(*e2e.DocumentAttributeFilename); ok {
+				d23.FileName = a.FileName
+			}
+		}
+
+		media = d23
+	}
+
+	return &e2e.DecryptedMessage23{
+		RandomID: dm.RandomID,
+		TTL:      dm.TTL,
+		Message:  dm.Message,
+		Media:    media,
+	}
+}
+
+// isLayer45Entity checks whether the entity is available in layer 45
+func isLayer45Entity(ent e2e.MessageEntityClass) bool {
+	switch ent.(type) {
+	case *e2e.MessageEntityMention, *e2e.MessageEntityHashtag, *e2e.MessageEntityBotCommand,
+		*e2e.MessageEntityURL, *e2e.MessageEntityEmail, *e2e.MessageEntityBold,
+		*e2e.MessageEntityItalic, *e2e.MessageEntityCode, *e2e.MessageEntityPre,
+		*e2e.MessageEntityTextURL:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,119 @@
+package secret
+
+import (
+	"testing"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg/e2e"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeLayer(t *testing.T) {
+	payload, err := encodeLayer(Layer, 4, 6, &e2e.DecryptedMessageService{
+		RandomID: 1,
+		Action:   &e2e.DecryptedMessageActionNotifyLayer{Layer: Layer},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	l, err := DecodeLayer(payload)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, Layer, l.Layer)
+	assert.Equal(t, 4, l.InSeqNo)
+	assert.Equal(t, 6, l.OutSeqNo)
+
+	action, ok := Action(l.Message)
+	assert.True(t, ok)
+	assert.Equal(t, &e2e.DecryptedMessageActionNotifyLayer{Layer: Layer}, action)
+
+	_, ok = Message(l.Message)
+	assert.False(t, ok)
+
+	// messages of layer 8 are not wrapped
+	b := &bin.Buffer{}
+	assert.NoError(t, (&e2e.DecryptedMessage8{RandomID: 1, Media: &e2e.DecryptedMessageMediaEmpty{}}).Encode(b))
+	_, err = DecodeLayer(b.Buf)
+	assert.Error(t, err)
+}
+
+func TestDowngrade(t *testing.T) {
+	sent := &e2e.DecryptedMessage{
+		Silent:   true,
+		RandomID: 1,
+		Message:  "hello",
+		Media: &e2e.DecryptedMessageMediaDocument46{
+			MimeType:   "text/plain",
+			Size:       10,
+			Key:        []byte("key"),
+			Iv:         []byte("iv"),
+			Attributes: []e2e.DocumentAttributeClass{&e2e.DocumentAttributeFilename{FileName: "a.txt"}},
+			Caption:    "caption",
+		},
+		Entities: []e2e.MessageEntityClass{
+			&e2e.MessageEntityCode{Offset: 0, Length: 5},
+			&e2e.MessageEntityUnderline{Offset: 0, Length: 5},
+		},
+		ReplyToRandomID: 2,
+	}
+
+	for _, test := range []struct {
+		layer    int
+		expected *e2e.DecryptedMessage
+	}{
+		{
+			layer: 17,
+			expected: &e2e.DecryptedMessage{
+				RandomID: 1,
+				Message:  "hello",
+				Media: &e2e.DecryptedMessageMediaDocument23{
+					FileName: "a.txt",
+					MimeType: "text/plain",
+					Size:     10,
+					Key:      []byte("key"),
+					Iv:       []byte("iv"),
+				},
+			},
+		},
+		{
+			layer: 45,
+			expected: &e2e.DecryptedMessage{
+				RandomID:        1,
+				Message:         "hello",
+				Media:           sent.Media,
+				Entities:        sent.Entities[:1],
+				ReplyToRandomID: 2,
+			},
+		},
+		{
+			layer: Layer,
+			expected: &e2e.DecryptedMessage{
+				Silent:          true,
+				RandomID:        1,
+				Message:         "hello",
+				Media:           sent.Media,
+				Entities:        sent.Entities[:1],
+				ReplyToRandomID: 2,
+			},
+		},
+	} {
+		payload, err := encodeLayer(test.layer, 1, 0, downgrade(test.layer, sent))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		l, err := DecodeLayer(payload)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		m, ok := Message(l.Message)
+		if assert.True(t, ok, test.layer) {
+			m.Flags = 0
+			assert.Equal(t, test.expected, m, test.layer)
+		}
+	}
+}
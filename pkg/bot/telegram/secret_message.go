@@ -0,0 +1,463 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/telegram/message/entity"
+	"github.com/gotd/td/telegram/message/styling"
+	"github.com/gotd/td/telegram/uploader"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tg/e2e"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/telegram/secret"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// secretMessage is the decrypted media of message in secret chat
+type secretMessage struct {
+	// media is nil when there is no media
+	media e2e.DecryptedMessageMediaClass
+	file  *tg.EncryptedFile
+}
+
+// sendSecretMessage sends spans to the secret chat, each media span is sent as
+// a document with its caption before the text
+func (c *tgBot) sendSecretMessage(ctx context.Context, chatID int, opts rt.SendMessageOptions) ([]rt.MessageID, error) {
+	var replyTo int64
+	if opts.ReplyTo != 0 {
+		c.secrets.Update(chatID, func(sc *secretChat) {
+			replyTo, _ = sc.RandomID(int(opts.ReplyTo))
+		})
+	}
+
+	type secretMedia struct {
+		media *e2e.DecryptedMessageMediaDocument46
+		file  tg.InputEncryptedFileClass
+	}
+
+	var media []secretMedia
+	for i := range opts.Body {
+		sp := &opts.Body[i]
+		if !sp.IsMedia() || sp.Size == 0 {
+			continue
+		}
+
+		m, file, err := c.uploadSecretFile(ctx, sp)
+		if err != nil {
+			return nil, fmt.Errorf("upload secret file: %w", err)
+		}
+
+		media = append(media, secretMedia{media: m, file: file})
+	}
+
+	var eb entity.Builder
+	err := styling.Perform(&eb, translateTextSpans(opts.Body)...)
+	if err != nil {
+		return nil, err
+	}
+
+	text, entities := eb.Complete()
+
+	var msgIDs []rt.MessageID
+	send := func(m *e2e.DecryptedMessage, file tg.InputEncryptedFileClass) error {
+		m.RandomID = randomInt64()
+		m.Silent = opts.NoNotification
+		m.ReplyToRandomID = replyTo
+
+		err := c.sendSecret(ctx, chatID, m, m.Silent, file)
+		if err != nil {
+			return err
+		}
+
+		c.secrets.Update(chatID, func(sc *secretChat) {
+			msgIDs = append(msgIDs, rt.MessageID(sc.AssignID(m.RandomID)))
+		})
+
+		return nil
+	}
+
+	for _, m := range media {
+		err = send(&e2e.DecryptedMessage{Media: m.media}, m.file)
+		if err != nil {
+			return msgIDs, err
+		}
+	}
+
+	if len(text) == 0 {
+		return msgIDs, nil
+	}
+
+	err = send(&e2e.DecryptedMessage{
+		Message:  text,
+		Entities: toSecretEntities(entities),
+	}, nil)
+
+	return msgIDs, err
+}
+
+// uploadSecretFile encrypts and uploads data of the media span
+func (c *tgBot) uploadSecretFile(
+	ctx context.Context, sp *rt.Span,
+) (*e2e.DecryptedMessageMediaDocument46, tg.InputEncryptedFileClass, error) {
+	r, err := secret.NewFileReader(sp.Data, sp.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uploaded, err := c.uploader.Upload(ctx, uploader.NewUpload(sp.Filename, r, r.Size()))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fingerprint := int(secret.FileFingerprint(r.Key, r.IV))
+
+	var file tg.InputEncryptedFileClass
+	switch f := uploaded.(type) {
+	case *tg.InputFile:
+		file = &tg.InputEncryptedFileUploaded{
+			ID:             f.GetID(),
+			Parts:          f.GetParts(),
+			MD5Checksum:    f.GetMD5Checksum(),
+			KeyFingerprint: fingerprint,
+		}
+	case *tg.InputFileBig:
+		file = &tg.InputEncryptedFileBigUploaded{
+			ID:             f.GetID(),
+			Parts:          f.GetParts(),
+			KeyFingerprint: fingerprint,
+		}
+	default:
+		return nil, nil, fmt.Errorf("unexpected uploaded file %T", uploaded)
+	}
+
+	var eb entity.Builder
+	err = styling.Perform(&eb, translateTextSpans(sp.Caption)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	caption, _ := eb.Complete()
+
+	media := &e2e.DecryptedMessageMediaDocument46{
+		MimeType: sp.ContentType,
+		Size:     int(sp.Size),
+		Key:      r.Key,
+		Iv:       r.IV,
+		Caption:  caption,
+	}
+
+	if len(media.MimeType) == 0 {
+		media.MimeType = "application/octet-stream"
+	}
+
+	duration := int(sp.Duration / time.Second)
+	switch {
+	case sp.IsVoice():
+		media.Attributes = append(media.Attributes, &e2e.DocumentAttributeAudio{Voice: true, Duration: duration})
+	case sp.IsAudio():
+		media.Attributes = append(media.Attributes, &e2e.DocumentAttributeAudio{Duration: duration})
+	case sp.IsVideo():
+		media.Attributes = append(media.Attributes, &e2e.DocumentAttributeVideo66{Duration: duration})
+	}
+
+	if len(sp.Filename) != 0 {
+		media.Attributes = append(media.Attributes, &e2e.DocumentAttributeFilename{FileName: sp.Filename})
+	}
+
+	return media, file, nil
+}
+
+// newSecretMessageContext creates messageContext of the decrypted message with
+// local message ids
+func (c *tgBot) newSecretMessageContext(
+	sc *secretChat, r *secret.Received, dm *e2e.DecryptedMessage, msgID, replyTo int,
+) *messageContext {
+	var mc messageContext
+
+	u := sc.user()
+	mc.src.Chat = resolveChatSpec(u)
+	mc.src.Chat.chatFlag |= chatFlag_Secret
+	mc.src.Chat.id = secretChatID(sc.ID)
+	mc.src.Chat.secret = sc.ID
+	mc.src.From, _ = resolveAuthorSpec(u)
+
+	mc.con = conversationImpl{
+		bot:    c,
+		peer:   mc.src.Chat.InputPeer(),
+		secret: sc.ID,
+	}
+
+	text := dm.Message
+	if len(text) == 0 && dm.Media != nil {
+		text = secretMediaOf(dm.Media).caption
+	}
+
+	msg := &tg.Message{
+		ID:      msgID,
+		PeerID:  &tg.PeerUser{UserID: sc.AdminID},
+		Date:    r.Date,
+		Message: text,
+		Silent:  dm.Silent,
+	}
+	msg.SetFromID(&tg.PeerUser{UserID: sc.AdminID})
+
+	if len(dm.Entities) != 0 && len(dm.Message) != 0 {
+		msg.SetEntities(fromSecretEntities(dm.Entities))
+	}
+
+	if replyTo != 0 {
+		msg.SetReplyTo(tg.MessageReplyHeader{ReplyToMsgID: replyTo})
+	}
+
+	if dm.GroupedID != 0 {
+		msg.SetGroupedID(dm.GroupedID)
+	}
+
+	mc.msg = msg
+	mc.secret = &secretMessage{media: dm.Media, file: r.File}
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.src.Chat.ID()),
+		rt.LogSenderID(mc.src.From.ID()),
+	)
+
+	return &mc
+}
+
+// secretMedia is the downloadable media of message in secret chat
+type secretMedia struct {
+	flags    rt.SpanFlag
+	mimeType string
+	filename string
+	duration int
+
+	// size of the decrypted file
+	size int64
+
+	// key and iv to decrypt the file, nil when there is no file
+	key []byte
+	iv  []byte
+
+	caption string
+}
+
+// secretMediaOf converts media of all layers to secretMedia
+//
+// nolint:gocyclo
+func secretMediaOf(media e2e.DecryptedMessageMediaClass) (ret secretMedia) {
+	switch m := media.(type) {
+	case *e2e.DecryptedMessageMediaPhoto23:
+		ret = secretMedia{flags: rt.SpanFlag_Image, mimeType: "image/jpeg", size: int64(m.Size), key: m.Key, iv: m.Iv}
+	case *e2e.DecryptedMessageMediaPhoto:
+		ret = secretMedia{flags: rt.SpanFlag_Image, mimeType: "image/jpeg", size: int64(m.Size), key: m.Key, iv: m.Iv}
+		ret.caption = m.Caption
+	case *e2e.DecryptedMessageMediaVideo8:
+		ret = secretMedia{flags: rt.SpanFlag_Video, mimeType: "video/mp4", size: int64(m.Size), key: m.Key, iv: m.Iv}
+		ret.duration = m.Duration
+	case *e2e.DecryptedMessageMediaVideo23:
+		ret = secretMedia{flags: rt.SpanFlag_Video, mimeType: m.MimeType, size: int64(m.Size), key: m.Key, iv: m.Iv}
+		ret.duration = m.Duration
+	case *e2e.DecryptedMessageMediaVideo:
+		ret = secretMedia{flags: rt.SpanFlag_Video, mimeType: m.MimeType, size: int64(m.Size), key: m.Key, iv: m.Iv}
+		ret.duration, ret.caption = m.Duration, m.Caption
+	case *e2e.DecryptedMessageMediaAudio8:
+		ret = secretMedia{flags: rt.SpanFlag_Audio, mimeType: "audio/ogg", size: int64(m.Size), key: m.Key, iv: m.Iv}
+		ret.duration = m.Duration
+	case *e2e.DecryptedMessageMediaAudio:
+		ret = secretMedia{flags: rt.SpanFlag_Audio, mimeType: m.MimeType, size: int64(m.Size), key: m.Key, iv: m.Iv}
+		ret.duration = m.Duration
+	case *e2e.DecryptedMessageMediaDocument23:
+		ret = secretMedia{flags: rt.SpanFlag_File, mimeType: m.MimeType, size: int64(m.Size), key: m.Key, iv: m.Iv}
+		ret.filename = m.FileName
+	case *e2e.DecryptedMessageMediaDocument46:
+		ret = secretMedia{mimeType: m.MimeType, size: int64(m.Size), key: m.Key, iv: m.Iv, caption: m.Caption}
+		ret.applyAttributes(m.Attributes)
+	case *e2e.DecryptedMessageMediaDocument:
+		ret = secretMedia{mimeType: m.MimeType, size: m.Size, key: m.Key, iv: m.Iv, caption: m.Caption}
+		ret.applyAttributes(m.Attributes)
+	default:
+		// no file in geo point, contact, venue, web page and external
+		// document
+	}
+
+	return
+}
+
+func (m *secretMedia) applyAttributes(attrs []e2e.DocumentAttributeClass) {
+	for _, attr := range attrs {
+		switch a := attr.(type) {
+		case *e2e.DocumentAttributeImageSize:
+			m.flags |= rt.SpanFlag_Image
+		case *e2e.DocumentAttributeAnimated, *e2e.DocumentAttributeSticker, *e2e.DocumentAttributeSticker23:
+			m.flags |= rt.SpanFlag_Video
+		case *e2e.DocumentAttributeVideo:
+			m.flags |= rt.SpanFlag_Video
+			m.duration = a.Duration
+		case *e2e.DocumentAttributeVideo66:
+			m.flags |= rt.SpanFlag_Video
+			m.duration = a.Duration
+		case *e2e.DocumentAttributeAudio23:
+			m.flags |= rt.SpanFlag_Audio
+			m.duration = a.Duration
+		case *e2e.DocumentAttributeAudio45:
+			m.flags |= rt.SpanFlag_Audio
+			m.duration = a.Duration
+		case *e2e.DocumentAttributeAudio:
+			if a.Voice {
+				m.flags |= rt.SpanFlag_Voice
+			} else {
+				m.flags |= rt.SpanFlag_Audio
+			}
+
+			m.duration = a.Duration
+		case *e2e.DocumentAttributeFilename:
+			m.filename = a.FileName
+		}
+	}
+
+	if !m.flags.IsMedia() {
+		m.flags |= rt.SpanFlag_File
+	}
+}
+
+// parseSecretMediaSpan creates the media span of message in secret chat, the
+// file is decrypted when downloading
+func (c *tgBot) parseSecretMediaSpan(mc *messageContext) (rt.Span, donwlodFunc, bool) {
+	file := mc.secret.file
+	if mc.secret.media == nil || file == nil {
+		return rt.Span{}, nil, false
+	}
+
+	media := secretMediaOf(mc.secret.media)
+	if media.key == nil {
+		return rt.Span{}, nil, false
+	}
+
+	if int32(file.GetKeyFingerprint()) != secret.FileFingerprint(media.key, media.iv) {
+		mc.logger.I("key fingerprint mismatch of secret file")
+		return rt.Span{}, nil, false
+	}
+
+	nonText := rt.Span{Flags: media.flags}
+	nonText.Filename = media.filename
+	nonText.Duration = time.Duration(media.duration) * time.Second
+
+	loc := &tg.InputEncryptedFileLocation{
+		ID:         file.GetID(),
+		AccessHash: file.GetAccessHash(),
+	}
+
+	return nonText, func() (rt.CacheReader, string, string, int64, error) {
+		mc.logger.D("download secret file", log.Int64("size", media.size), log.String("content_type", media.mimeType))
+
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			w, err := secret.NewFileWriter(cacheWR, media.key, media.iv, media.size)
+			if err != nil {
+				return err
+			}
+
+			_, err = c.downloader.Download(c.client.API(), loc).Stream(c.Context(), w)
+			return err
+		})
+
+		return cacheRD, media.mimeType, "", sz, err
+	}, true
+}
+
+// fromSecretEntities converts entities in secret chats to the ones in api
+// schema
+func fromSecretEntities(entities []e2e.MessageEntityClass) (ret []tg.MessageEntityClass) {
+	for _, ent := range entities {
+		var v tg.MessageEntityClass
+
+		switch e := ent.(type) {
+		case *e2e.MessageEntityMention:
+			v = &tg.MessageEntityMention{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityHashtag:
+			v = &tg.MessageEntityHashtag{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityBotCommand:
+			v = &tg.MessageEntityBotCommand{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityURL:
+			v = &tg.MessageEntityURL{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityEmail:
+			v = &tg.MessageEntityEmail{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityBold:
+			v = &tg.MessageEntityBold{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityItalic:
+			v = &tg.MessageEntityItalic{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityCode:
+			v = &tg.MessageEntityCode{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityPre:
+			v = &tg.MessageEntityPre{Offset: e.Offset, Length: e.Length, Language: e.Language}
+		case *e2e.MessageEntityTextURL:
+			v = &tg.MessageEntityTextURL{Offset: e.Offset, Length: e.Length, URL: e.URL}
+		case *e2e.MessageEntityMentionName:
+			v = &tg.MessageEntityMentionName{Offset: e.Offset, Length: e.Length, UserID: int64(e.UserID)}
+		case *e2e.MessageEntityPhone:
+			v = &tg.MessageEntityPhone{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityCashtag:
+			v = &tg.MessageEntityCashtag{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityBankCard:
+			v = &tg.MessageEntityBankCard{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityUnderline:
+			v = &tg.MessageEntityUnderline{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityStrike:
+			v = &tg.MessageEntityStrike{Offset: e.Offset, Length: e.Length}
+		case *e2e.MessageEntityBlockquote:
+			v = &tg.MessageEntityBlockquote{Offset: e.Offset, Length: e.Length}
+		default:
+			continue
+		}
+
+		ret = append(ret, v)
+	}
+
+	return
+}
+
+// toSecretEntities converts entities to the ones in secret chats, entities not
+// available in secret chats are dropped
+func toSecretEntities(entities []tg.MessageEntityClass) (ret []e2e.MessageEntityClass) {
+	for _, ent := range entities {
+		var v e2e.MessageEntityClass
+
+		switch e := ent.(type) {
+		case *tg.MessageEntityMention:
+			v = &e2e.MessageEntityMention{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityHashtag:
+			v = &e2e.MessageEntityHashtag{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityBotCommand:
+			v = &e2e.MessageEntityBotCommand{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityURL:
+			v = &e2e.MessageEntityURL{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityEmail:
+			v = &e2e.MessageEntityEmail{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityBold:
+			v = &e2e.MessageEntityBold{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityItalic:
+			v = &e2e.MessageEntityItalic{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityCode:
+			v = &e2e.MessageEntityCode{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityPre:
+			v = &e2e.MessageEntityPre{Offset: e.Offset, Length: e.Length, Language: e.Language}
+		case *tg.MessageEntityTextURL:
+			v = &e2e.MessageEntityTextURL{Offset: e.Offset, Length: e.Length, URL: e.URL}
+		case *tg.MessageEntityPhone:
+			v = &e2e.MessageEntityPhone{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityUnderline:
+			v = &e2e.MessageEntityUnderline{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityStrike:
+			v = &e2e.MessageEntityStrike{Offset: e.Offset, Length: e.Length}
+		case *tg.MessageEntityBlockquote:
+			v = &e2e.MessageEntityBlockquote{Offset: e.Offset, Length: e.Length}
+		default:
+			continue
+		}
+
+		ret = append(ret, v)
+	}
+
+	return
+}
@@ -0,0 +1,288 @@
+package telegram
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tg/e2e"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/telegram/secret"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	ret := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, ret)
+	assert.NoError(t, err)
+	return ret
+}
+
+// fakeSecretInvoker records encrypted messages sent
+type fakeSecretInvoker struct {
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (f *fakeSecretInvoker) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	var data []byte
+	switch req := input.(type) {
+	case *tg.MessagesSendEncryptedRequest:
+		data = req.Data
+	case *tg.MessagesSendEncryptedServiceRequest:
+		data = req.Data
+	default:
+		return fmt.Errorf("unexpected request %T", input)
+	}
+
+	f.mu.Lock()
+	f.sent = append(f.sent, data)
+	f.mu.Unlock()
+
+	output.(*tg.MessagesSentEncryptedMessageBox).SentEncryptedMessage = &tg.MessagesSentEncryptedMessage{Date: 1}
+	return nil
+}
+
+// take returns messages sent since last call
+func (f *fakeSecretInvoker) take() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ret := f.sent
+	f.sent = nil
+	return ret
+}
+
+func newTestSecretBot(ctx context.Context, invoker tg.Invoker) *tgBot {
+	c := &tgBot{
+		selfID:   2,
+		sessions: session.NewManager[chatIDWrapper](ctx),
+		secrets:  newSecretChats(nil),
+		client: telegram.NewClient(1, "test", telegram.Options{
+			Middlewares: []telegram.Middleware{
+				telegram.MiddlewareFunc(func(tg.Invoker) telegram.InvokeFunc { return invoker.Invoke }),
+			},
+		}),
+	}
+	c.BaseBot = bot.NewBotBase(rt.NewContext(ctx, log.NoOpLogger, nil))
+	c.user.SecretChats = []string{"@alice"}
+
+	return c
+}
+
+func TestHandleSecretMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	invoker := &fakeSecretInvoker{}
+	c := newTestSecretBot(ctx, invoker)
+
+	sc := secretChat{
+		Chat: secret.Chat{
+			ID:            7,
+			Key:           randomBytes(t, secret.KeySize),
+			AdminID:       1,
+			ParticipantID: c.selfID,
+		},
+		Username:  "alice",
+		FirstName: "alice",
+		LastName:  "liddell",
+	}
+	c.secrets.Set(sc)
+
+	// the peer created the secret chat
+	peer := &secret.Chat{Key: sc.Key, Creator: true}
+	encrypt := func(n int, m e2e.DecryptedMessageClass) []byte {
+		data, err := peer.Encrypt(n, m)
+		assert.NoError(t, err)
+		return data
+	}
+
+	// decryptSent decrypts messages sent by the bot
+	decryptSent := func() (ret []*e2e.DecryptedMessageLayer) {
+		for _, data := range invoker.take() {
+			r, err := peer.Decrypt(0, data, nil)
+			if assert.NoError(t, err) {
+				ret = append(ret, r.Layer)
+			}
+		}
+
+		return
+	}
+
+	wf := &bot.Workflow{}
+	chat := chatIDWrapper{secret: sc.ID}
+	assert.True(t, c.sessions.MarkSessionStandby(wf, 1, chat, "", false, time.Minute))
+	s, err := c.sessions.ActivateSession(wf, 1, chat.ID(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fileKey, fileIV := randomBytes(t, 32), randomBytes(t, 32)
+	msg := encrypt(0, &e2e.DecryptedMessage{
+		// same as the random id of "second" when truncated to 32-bit
+		RandomID: 1<<32 + 100,
+		Media: &e2e.DecryptedMessageMediaPhoto{
+			W: 10, H: 10, Size: 1024, Key: fileKey, Iv: fileIV, Caption: "photo",
+		},
+	})
+	file := &tg.EncryptedFile{ID: 1, KeyFingerprint: int(secret.FileFingerprint(fileKey, fileIV))}
+
+	assert.NoError(t, c.handleSecretMessage(sc.ID, 10, msg, file, true))
+	// duplicate
+	assert.NoError(t, c.handleSecretMessage(sc.ID, 10, msg, file, true))
+
+	msgs := s.GetMessages()
+	if assert.Len(t, msgs, 1) {
+		m := msgs[0]
+		assert.Equal(t, rt.MessageID(1), m.ID)
+		assert.Equal(t, "photo", m.Text)
+		assert.Equal(t, "alice liddell", m.Author)
+		assert.True(t, m.IsPrivate())
+		if assert.Len(t, m.Spans, 2) {
+			assert.True(t, m.Spans[1].IsImage())
+		}
+	}
+
+	updated, _ := c.secrets.Get(sc.ID)
+	assert.Equal(t, 1, updated.InSeq)
+	assert.Equal(t, secret.Layer, updated.Layer)
+
+	// unknown secret chat
+	assert.NoError(t, c.handleSecretMessage(8, 10, msg, nil, true))
+
+	t.Run("Gap", func(t *testing.T) {
+		// message 1 is missing
+		assert.NoError(t, c.handleSecretMessage(sc.ID, 12, encrypt(2, &e2e.DecryptedMessage{
+			RandomID:        102,
+			Message:         "third",
+			ReplyToRandomID: 1<<32 + 100,
+		}), nil, true))
+		assert.Len(t, s.GetMessages(), 1)
+
+		sent := decryptSent()
+		if assert.Len(t, sent, 1) {
+			// out_seq_no of messages from the creator are odd
+			assert.Equal(t, &e2e.DecryptedMessageService{
+				RandomID: sent[0].Message.GetRandomID(),
+				Action:   &e2e.DecryptedMessageActionResend{StartSeqNo: 3, EndSeqNo: 3},
+			}, sent[0].Message)
+		}
+
+		assert.NoError(t, c.handleSecretMessage(sc.ID, 11, encrypt(1, &e2e.DecryptedMessage{
+			RandomID: 100,
+			Message:  "second",
+		}), nil, true))
+
+		msgs := s.GetMessages()
+		if assert.Len(t, msgs, 3) {
+			assert.Equal(t, rt.MessageID(2), msgs[1].ID)
+			assert.Equal(t, "second", msgs[1].Text)
+
+			assert.Equal(t, rt.MessageID(3), msgs[2].ID)
+			assert.Equal(t, "third", msgs[2].Text)
+			assert.Equal(t, rt.MessageID(1), msgs[2].ReplyTo)
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		msgIDs, err := c.sendSecretMessage(ctx, sc.ID, rt.SendMessageOptions{
+			ReplyTo: 2,
+			Body:    []rt.Span{{Flags: rt.SpanFlag_Bold, Text: "reply"}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []rt.MessageID{4}, msgIDs)
+
+		sent := decryptSent()
+		if assert.Len(t, sent, 1) {
+			// sent after the resend request
+			assert.Equal(t, 2, sent[0].OutSeqNo)
+
+			m, ok := secret.Message(sent[0].Message)
+			if assert.True(t, ok) {
+				assert.Equal(t, "reply", m.Message)
+				assert.EqualValues(t, 100, m.ReplyToRandomID)
+				assert.Equal(t, []e2e.MessageEntityClass{&e2e.MessageEntityBold{Offset: 0, Length: 5}}, m.Entities)
+			}
+		}
+
+		// the peer missed the reply
+		assert.NoError(t, c.handleSecretMessage(sc.ID, 13, encrypt(3, &e2e.DecryptedMessageService{
+			RandomID: 103,
+			Action:   &e2e.DecryptedMessageActionResend{StartSeqNo: 2, EndSeqNo: 2},
+		}), nil, true))
+
+		resent := decryptSent()
+		if assert.Len(t, resent, 1) && assert.Len(t, sent, 1) {
+			assert.Equal(t, sent[0].OutSeqNo, resent[0].OutSeqNo)
+			assert.Equal(t, sent[0].Message, resent[0].Message)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.NoError(t, c.handleSecretMessage(sc.ID, 14, encrypt(4, &e2e.DecryptedMessageService{
+			RandomID: 104,
+			Action:   &e2e.DecryptedMessageActionDeleteMessages{RandomIDs: []int64{1<<32 + 100, 100}},
+		}), nil, true))
+
+		msgs := s.GetMessages()
+		if assert.Len(t, msgs, 1) {
+			assert.Equal(t, "third", msgs[0].Text)
+		}
+	})
+
+	// bad key
+	c.secrets.Update(sc.ID, func(sc *secretChat) { sc.Key = randomBytes(t, secret.KeySize) })
+	assert.Error(t, c.handleSecretMessage(sc.ID, 15, encrypt(5, &e2e.DecryptedMessageService{
+		RandomID: 105,
+		Action:   &e2e.DecryptedMessageActionNoop{},
+	}), nil, true))
+}
+
+func TestIsSecretChatOwner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	c := newTestSecretBot(ctx, &fakeSecretInvoker{})
+
+	sc := secretChat{
+		Chat: secret.Chat{
+			ID:            7,
+			AdminID:       1,
+			ParticipantID: c.selfID,
+		},
+		Username: "alice",
+	}
+	c.secrets.Set(sc)
+
+	newMessage := func(chatID int) *messageContext {
+		sc := sc
+		sc.ID = chatID
+		return c.newSecretMessageContext(&sc, &secret.Received{}, &e2e.DecryptedMessage{Message: "/end"}, 1, 0)
+	}
+
+	assert.True(t, c.isOwner(newMessage(sc.ID)))
+
+	// unknown secret chat
+	assert.False(t, c.isOwner(newMessage(8)))
+
+	// not accepted by the logged in account
+	c.secrets.Update(sc.ID, func(sc *secretChat) { sc.ParticipantID = 3 })
+	assert.False(t, c.isOwner(newMessage(sc.ID)))
+	c.secrets.Set(sc)
+
+	// no longer configured
+	c.user.SecretChats = []string{"@bob"}
+	assert.False(t, c.isOwner(newMessage(sc.ID)))
+}
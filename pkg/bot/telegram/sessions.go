@@ -0,0 +1,252 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"arhat.dev/pkg/log"
+	tds "github.com/gotd/td/session"
+
+	"arhat.dev/mbot/pkg/publisher"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+// storedSession is an active session persisted to be restored after restart
+type storedSession struct {
+	ChatID  rt.ChatID    `json:"chatID"`
+	TopicID rt.MessageID `json:"topicID,omitempty"`
+
+	// Legacy is true for private chats and legacy groups
+	Legacy bool `json:"legacy,omitempty"`
+
+	// Workflow is the botcmd creating sessions of the workflow
+	Workflow string `json:"workflow"`
+
+	// Publisher is the state of the publisher when it's publisher.Stateful
+	Publisher []byte `json:"publisher,omitempty"`
+
+	Messages []storedMessage `json:"messages,omitempty"`
+}
+
+// storedMessage is a session message with media data stored as cache ids
+type storedMessage struct {
+	rt.Message
+
+	Spans []storedSpan `json:"Spans"`
+	Edits []storedEdit `json:"Edits,omitempty"`
+}
+
+type storedEdit struct {
+	rt.MessageEdit
+
+	Spans []storedSpan `json:"Spans"`
+}
+
+type storedSpan struct {
+	rt.Span
+
+	// Cache is the cache id of media data, 0 when there is no data
+	Cache rt.CacheID `json:"cache,omitempty"`
+}
+
+func newStoredSpans(spans []rt.Span) []storedSpan {
+	ret := make([]storedSpan, len(spans))
+	for i, span := range spans {
+		if span.Data != nil {
+			ret[i].Cache = span.Data.ID()
+			span.Data = nil
+		}
+
+		ret[i].Span = span
+	}
+
+	return ret
+}
+
+// storeSessions stores active sessions if changed, messages not ready (e.g.
+// downloading media) are not stored
+func (c *tgBot) storeSessions(ctx context.Context) error {
+	if c.sessionsStorage == nil {
+		return nil
+	}
+
+	stored := []storedSession{}
+	c.sessions.RangeActiveTopicSessions(func(chatID rt.ChatID, topicID rt.MessageID, s *session.Session) bool {
+		ss, err := c.newStoredSession(chatID, topicID, s)
+		if err != nil {
+			c.Logger().I("failed to save session", rt.LogChatID(chatID), log.Error(err))
+			return true
+		}
+
+		stored = append(stored, ss)
+		return true
+	})
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(data, c.storedSessions) {
+		return nil
+	}
+
+	err = c.sessionsStorage.StoreSession(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	c.storedSessions = data
+	return nil
+}
+
+func (c *tgBot) newStoredSession(chatID rt.ChatID, topicID rt.MessageID, s *session.Session) (ret storedSession, err error) {
+	_, isLegacy := c.legacyChats.Load(chatID)
+	ret = storedSession{
+		ChatID:   chatID,
+		TopicID:  topicID,
+		Legacy:   isLegacy,
+		Workflow: s.Workflow().BotCommands.TextOf(rt.BotCmd_New),
+	}
+
+	if sp, ok := s.GetPublisher().(publisher.Stateful); ok {
+		ret.Publisher, err = sp.SaveState()
+		if err != nil {
+			return ret, fmt.Errorf("save publisher state: %w", err)
+		}
+	}
+
+	for _, m := range s.GetMessages() {
+		if !m.Ready() {
+			continue
+		}
+
+		sm := storedMessage{Message: *m, Spans: newStoredSpans(m.Spans)}
+		sm.Message.Spans, sm.Message.Edits = nil, nil
+		for _, v := range m.Edits {
+			sm.Edits = append(sm.Edits, storedEdit{MessageEdit: v, Spans: newStoredSpans(v.Spans)})
+		}
+
+		ret.Messages = append(ret.Messages, sm)
+	}
+
+	return
+}
+
+// restoreSessions restores active sessions stored before restart, it MUST be
+// called before recovering missed updates
+func (c *tgBot) restoreSessions(ctx context.Context) error {
+	if c.sessionsStorage == nil {
+		return nil
+	}
+
+	data, err := c.sessionsStorage.LoadSession(ctx)
+	if err != nil {
+		if errors.Is(err, tds.ErrNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	var stored []storedSession
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return err
+	}
+
+	for i := range stored {
+		err = c.restoreSession(&stored[i])
+		if err != nil {
+			c.Logger().I("failed to restore session", rt.LogChatID(stored[i].ChatID), log.Error(err))
+		}
+	}
+
+	c.storedSessions = data
+	return nil
+}
+
+func (c *tgBot) restoreSession(ss *storedSession) error {
+	wf, ok := c.wfSet.WorkflowFor(ss.Workflow)
+	if !ok {
+		return fmt.Errorf("workflow %q not found", ss.Workflow)
+	}
+
+	pub, user, err := wf.CreatePublisher()
+	if err != nil {
+		return fmt.Errorf("create publisher: %w", err)
+	}
+
+	if sp, ok := pub.(publisher.Stateful); ok {
+		if len(ss.Publisher) != 0 {
+			err = sp.RestoreState(ss.Publisher)
+			if err != nil {
+				return fmt.Errorf("restore publisher state: %w", err)
+			}
+		}
+	} else if user.NextCredential() != rt.LoginFlow_None {
+		return fmt.Errorf("login of publisher %q can not be restored", wf.PublisherName())
+	}
+
+	s, ok := c.sessions.RestoreSession(ss.ChatID, ss.TopicID, wf, pub)
+	if !ok {
+		return fmt.Errorf("session exists")
+	}
+
+	if ss.Legacy {
+		c.legacyChats.Store(ss.ChatID, struct{}{})
+	}
+
+	for i := range ss.Messages {
+		sm := &ss.Messages[i]
+
+		m := rt.NewMessage()
+		*m = sm.Message
+		m.Spans = c.restoreSpans(sm.Spans)
+		for _, v := range sm.Edits {
+			v.MessageEdit.Spans = c.restoreSpans(v.Spans)
+			m.Edits = append(m.Edits, v.MessageEdit)
+		}
+
+		s.AppendMessage(m)
+	}
+
+	c.Logger().V("restored session",
+		rt.LogChatID(ss.ChatID),
+		log.String("workflow", ss.Workflow),
+		log.Int("messages", len(ss.Messages)),
+	)
+
+	return nil
+}
+
+// restoreSpans opens media data from the cache, media spans are dropped when
+// their data is not available
+func (c *tgBot) restoreSpans(stored []storedSpan) []rt.Span {
+	ret := make([]rt.Span, 0, len(stored))
+	for _, ss := range stored {
+		span := ss.Span
+		if ss.Cache != 0 {
+			cache := c.Cache()
+			if cache == nil {
+				continue
+			}
+
+			data, err := cache.Open(ss.Cache)
+			if err != nil {
+				c.Logger().I("failed to open cached media", rt.LogCacheID(ss.Cache), log.Error(err))
+				continue
+			}
+
+			span.Data = data
+		}
+
+		ret = append(ret, span)
+	}
+
+	return ret
+}
@@ -0,0 +1,150 @@
+package telegram
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+func TestStoreAndRestoreSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	cache, err := rt.NewCache(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cc := bottest.CommonConfig(false, false)
+	wfSet, err := cc.Resolve(bottest.NewCreationContext(&bottest.Publisher{}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	storage, err := newFileStorage(filepath.Join(t.TempDir(), "test.session.sessions"), "key")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	newBot := func() *tgBot {
+		c := &tgBot{
+			sessions:        session.NewManager[chatIDWrapper](ctx),
+			sessionsStorage: storage,
+			wfSet:           wfSet,
+		}
+		c.BaseBot = bot.NewBotBase(rt.NewContext(ctx, log.NoOpLogger, cache))
+		return c
+	}
+
+	alice := &tg.User{ID: 1, FirstName: "alice"}
+	chat := chatIDWrapper{chat: alice.AsInputPeer()}
+	wf := &wfSet.Workflows[0]
+
+	c := newBot()
+	assert.True(t, c.sessions.MarkSessionStandby(wf, 1, chat, "", false, time.Minute))
+	s, err := c.sessions.ActivateSession(wf, 1, chat.ID(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	c.legacyChats.Store(chat.ID(), struct{}{})
+
+	wr, err := cache.NewWriter()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = wr.Write([]byte("foo"))
+	assert.NoError(t, err)
+	assert.NoError(t, wr.Close())
+
+	data, err := cache.Open(wr.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = data.Close() }()
+
+	m := rt.NewMessage()
+	m.ID, m.Text = 1, "foo"
+	m.Spans = []rt.Span{{Text: "foo"}, {Flags: rt.SpanFlag_Image}}
+	m.Spans[1].Data = data
+	m.Edits = []rt.MessageEdit{{Text: "bar", Spans: []rt.Span{{Text: "bar"}}}}
+	s.AppendMessage(m)
+
+	// not ready messages are not stored
+	downloading := rt.NewMessage()
+	downloading.ID = 2
+	done := make(chan struct{})
+	defer close(done)
+	downloading.AddWorker(func(_ rt.Signal, _ *rt.Message) { <-done })
+	s.AppendMessage(downloading)
+
+	if !assert.NoError(t, c.storeSessions(ctx)) {
+		return
+	}
+
+	c = newBot()
+	if !assert.NoError(t, c.restoreSessions(ctx)) {
+		return
+	}
+
+	_, isLegacy := c.legacyChats.Load(chat.ID())
+	assert.True(t, isLegacy)
+
+	s, ok := c.sessions.ActiveSessionOf(chat)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, wf, s.Workflow())
+
+	msgs := s.GetMessages()
+	if !assert.Len(t, msgs, 1) {
+		return
+	}
+
+	restored := msgs[0]
+	assert.Equal(t, rt.MessageID(1), restored.ID)
+	assert.Equal(t, "foo", restored.Text)
+	assert.True(t, restored.Ready())
+	if assert.Len(t, restored.Edits, 1) {
+		assert.Equal(t, "bar", restored.Edits[0].Text)
+		assert.Equal(t, []rt.Span{{Text: "bar"}}, restored.Edits[0].Spans)
+	}
+
+	if assert.Len(t, restored.Spans, 2) && assert.NotNil(t, restored.Spans[1].Data) {
+		assert.True(t, restored.Spans[1].IsImage())
+
+		content, err := io.ReadAll(restored.Spans[1].Data)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", string(content))
+	}
+	defer restored.Dispose()
+
+	// missed messages are appended to the restored session
+	missed := &tg.Message{ID: 3, PeerID: &tg.PeerUser{UserID: alice.ID}, Message: "missed"}
+	missed.SetFromID(&tg.PeerUser{UserID: alice.ID})
+	c.handleRecoveredUpdates([]tg.MessageClass{missed}, nil, []tg.UserClass{alice}, nil)
+
+	msgs = s.GetMessages()
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, "missed", msgs[1].Text)
+	}
+
+	// only changed sessions are stored
+	stored := c.storedSessions
+	assert.NoError(t, c.storeSessions(ctx))
+	assert.NotEqual(t, stored, c.storedSessions)
+
+	stored = c.storedSessions
+	assert.NoError(t, c.storeSessions(ctx))
+	assert.Equal(t, stored, c.storedSessions)
+}
@@ -0,0 +1,63 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+)
+
+var _ telegram.UpdateHandler = (*shortUpdatesHandler)(nil)
+
+// shortUpdatesHandler expands short message updates to UpdateNewMessage before
+// handing them to next, as tg.UpdateDispatcher ignores short updates
+//
+// short updates carry no users and chats, the message is fetched with them
+type shortUpdatesHandler struct {
+	next telegram.UpdateHandler
+
+	// api to fetch messages, set after the client created
+	api *tg.Client
+}
+
+// Handle implements telegram.UpdateHandler
+func (h *shortUpdatesHandler) Handle(ctx context.Context, u tg.UpdatesClass) error {
+	var (
+		msgID, pts, ptsCount, date int
+	)
+
+	switch u := u.(type) {
+	case *tg.UpdateShortMessage:
+		msgID, pts, ptsCount, date = u.ID, u.Pts, u.PtsCount, u.Date
+	case *tg.UpdateShortChatMessage:
+		msgID, pts, ptsCount, date = u.ID, u.Pts, u.PtsCount, u.Date
+	default:
+		return h.next.Handle(ctx, u)
+	}
+
+	resp, err := h.api.MessagesGetMessages(ctx, []tg.InputMessageClass{&tg.InputMessageID{ID: msgID}})
+	if err != nil {
+		return fmt.Errorf("fetch short message %d: %w", msgID, err)
+	}
+
+	msgs, ok := resp.AsModified()
+	if !ok {
+		return fmt.Errorf("unexpected response of short message %d: %T", msgID, resp)
+	}
+
+	for _, m := range msgs.GetMessages() {
+		if m.GetID() != msgID {
+			continue
+		}
+
+		return h.next.Handle(ctx, &tg.Updates{
+			Updates: []tg.UpdateClass{&tg.UpdateNewMessage{Message: m, Pts: pts, PtsCount: ptsCount}},
+			Users:   msgs.GetUsers(),
+			Chats:   msgs.GetChats(),
+			Date:    date,
+		})
+	}
+
+	return fmt.Errorf("short message %d not found", msgID)
+}
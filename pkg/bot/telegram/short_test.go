@@ -0,0 +1,104 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+// fakeMessagesInvoker serves messages.getMessages with msgs
+type fakeMessagesInvoker struct {
+	msgs *tg.MessagesMessages
+}
+
+func (f fakeMessagesInvoker) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	req, ok := input.(*tg.MessagesGetMessagesRequest)
+	if !ok {
+		return fmt.Errorf("unexpected request %T", input)
+	}
+
+	resp := &tg.MessagesMessages{Users: f.msgs.Users, Chats: f.msgs.Chats}
+	for _, id := range req.ID {
+		for _, m := range f.msgs.Messages {
+			if m.GetID() == id.(*tg.InputMessageID).ID {
+				resp.Messages = append(resp.Messages, m)
+			}
+		}
+	}
+
+	output.(*tg.MessagesMessagesBox).Messages = resp
+	return nil
+}
+
+func TestShortUpdatesHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var (
+		self  = &tg.User{ID: 1, FirstName: "self", Self: true}
+		alice = &tg.User{ID: 2, FirstName: "alice"}
+		group = &tg.Chat{ID: 3, Title: "group"}
+
+		wf = &bot.Workflow{}
+	)
+
+	pm := &tg.Message{ID: 10, PeerID: &tg.PeerUser{UserID: alice.ID}, Message: "hello"}
+	pm.SetFromID(&tg.PeerUser{UserID: alice.ID})
+	gm := &tg.Message{ID: 11, PeerID: &tg.PeerChat{ChatID: group.ID}, Message: "hi"}
+	gm.SetFromID(&tg.PeerUser{UserID: alice.ID})
+
+	c := &tgBot{
+		selfID:     self.ID,
+		dispatcher: tg.NewUpdateDispatcher(),
+		sessions:   session.NewManager[chatIDWrapper](ctx),
+	}
+	c.BaseBot = bot.NewBotBase(rt.NewContext(ctx, log.NoOpLogger, nil))
+	c.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: c}, c.sessions, &c.wfSet, engine.Options{})
+	c.dispatcher.OnNewMessage(c.onNewTelegramLegacyMessage)
+
+	h := &shortUpdatesHandler{
+		next: c.dispatcher,
+		api: tg.NewClient(fakeMessagesInvoker{msgs: &tg.MessagesMessages{
+			Messages: []tg.MessageClass{pm, gm},
+			Users:    []tg.UserClass{self, alice},
+			Chats:    []tg.ChatClass{group},
+		}}),
+	}
+
+	activate := func(chat tg.InputPeerClass) *session.Session {
+		chatID := chatIDWrapper{chat: chat}.ID()
+		assert.True(t, c.sessions.MarkSessionStandby(wf, 1, chatIDWrapper{chat: chat}, "", false, time.Minute))
+		s, err := c.sessions.ActivateSession(wf, 1, chatID, nil)
+		assert.NoError(t, err)
+		return s
+	}
+
+	ps := activate(alice.AsInputPeer())
+	gs := activate(group.AsInputPeer())
+
+	assert.NoError(t, h.Handle(ctx, &tg.UpdateShortMessage{ID: pm.ID, UserID: alice.ID, Message: pm.Message, Pts: 1, PtsCount: 1}))
+	assert.NoError(t, h.Handle(ctx, &tg.UpdateShortChatMessage{ID: gm.ID, FromID: alice.ID, ChatID: group.ID, Message: gm.Message, Pts: 2, PtsCount: 1}))
+
+	if msgs := ps.GetMessages(); assert.Len(t, msgs, 1) {
+		assert.Equal(t, rt.MessageID(pm.ID), msgs[0].ID)
+		assert.Equal(t, "hello", msgs[0].Text)
+	}
+
+	if msgs := gs.GetMessages(); assert.Len(t, msgs, 1) {
+		assert.Equal(t, rt.MessageID(gm.ID), msgs[0].ID)
+		assert.Equal(t, "hi", msgs[0].Text)
+	}
+
+	assert.Error(t, h.Handle(ctx, &tg.UpdateShortMessage{ID: 100, UserID: alice.ID}))
+}
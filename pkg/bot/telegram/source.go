@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
 	"github.com/gotd/td/tg"
 )
 
@@ -28,12 +29,24 @@ const (
 	chatFlag_Channel
 
 	chatFlag_LegacyGroup
+
+	// supergroup with topics
+	chatFlag_Forum
+
+	// end-to-end encrypted private chat, only available to user accounts
+	chatFlag_Secret
 )
 
+// channelFlagForum is the bit of forum flag in channel flags, which is not
+// defined in the api layer in use
+const channelFlagForum = 30
+
 func (f chatFlag) IsPrivateChat() bool     { return f&chatFlag_PM != 0 }
 func (f chatFlag) IsChannelChat() bool     { return f&chatFlag_Channel != 0 }
 func (f chatFlag) IsGroupChat() bool       { return f&chatFlag_Group != 0 }
 func (f chatFlag) IsLegacyGroupChat() bool { return f&chatFlag_LegacyGroup != 0 }
+func (f chatFlag) IsForum() bool           { return f&chatFlag_Forum != 0 }
+func (f chatFlag) IsSecretChat() bool      { return f&chatFlag_Secret != 0 }
 
 type commonInfo[ID rt.UserID | rt.ChatID] struct {
 	id ID
@@ -58,10 +71,20 @@ type chatInfo struct {
 	commonInfo[rt.ChatID]
 
 	peer tg.InputPeerClass
+
+	// secret is the id of the secret chat, peer is the user in the secret chat
+	// when set
+	secret int
 }
 
 func (cs *chatInfo) InputPeer() tg.InputPeerClass { return cs.peer }
 
+// secretChatID returns the chat id of the secret chat, which is distinct from
+// ids of all other chats
+func secretChatID(id int) rt.ChatID {
+	return rt.ChatID(1<<63 | uint64(uint32(id)))
+}
+
 func resolveChatSpec(chatPeer any) (ret chatInfo) {
 	switch c := chatPeer.(type) {
 	case *tg.User:
@@ -83,6 +106,10 @@ func resolveChatSpec(chatPeer any) (ret chatInfo) {
 			ret.chatFlag |= chatFlag_Group
 		}
 
+		if c.Flags.Has(channelFlagForum) {
+			ret.chatFlag |= chatFlag_Forum
+		}
+
 		ret.titile = c.GetTitle()
 		ret.username, _ = c.GetUsername()
 
@@ -198,7 +225,7 @@ func extractPeer(e tg.Entities, p tg.PeerClass) (any, error) {
 
 		if len(e.Chats) != 0 {
 			u, ok := e.Chats[id]
-			if !ok {
+			if ok {
 				return u, nil
 			}
 		}
@@ -209,11 +236,25 @@ func extractPeer(e tg.Entities, p tg.PeerClass) (any, error) {
 	}
 }
 
+var _ session.TopicChat = chatIDWrapper{}
+
 type chatIDWrapper struct {
 	chat tg.InputPeerClass
+
+	// topic is the id of the forum topic, 0 for the chat itself
+	topic int
+
+	// secret is the id of the secret chat with the user in chat
+	secret int
 }
 
+func (c chatIDWrapper) TopicID() rt.MessageID { return rt.MessageID(c.topic) }
+
 func (c chatIDWrapper) ID() rt.ChatID {
+	if c.secret != 0 {
+		return secretChatID(c.secret)
+	}
+
 	switch this := c.chat.(type) {
 	case *tg.InputPeerChat:
 		return rt.ChatID(this.GetChatID())
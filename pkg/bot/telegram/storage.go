@@ -0,0 +1,117 @@
+package telegram
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	tds "github.com/gotd/td/session"
+)
+
+var _ tds.Storage = (*fileStorage)(nil)
+
+// fileStorage stores data in a single file, the file is encrypted with
+// aes-256-gcm when there is an encryption key
+type fileStorage struct {
+	path string
+	aead cipher.AEAD
+
+	mu sync.Mutex
+}
+
+func newFileStorage(path, key string) (*fileStorage, error) {
+	ret := &fileStorage{path: path}
+	if len(key) == 0 {
+		return ret, nil
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	blk, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	ret.aead, err = cipher.NewGCM(blk)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// LoadSession implements tds.Storage, tds.ErrNotFound is returned when the
+// file doesn't exist
+func (s *fileStorage) LoadSession(_ context.Context) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, tds.ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	if s.aead == nil {
+		return data, nil
+	}
+
+	sz := s.aead.NonceSize()
+	if len(data) < sz {
+		return nil, fmt.Errorf("invalid encrypted data in %q", s.path)
+	}
+
+	data, err = s.aead.Open(nil, data[:sz], data[sz:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %q: %w", s.path, err)
+	}
+
+	return data, nil
+}
+
+// StoreSession implements tds.Storage, data is written to a temporary file
+// and then renamed to the target file
+func (s *fileStorage) StoreSession(_ context.Context, data []byte) error {
+	if s.aead != nil {
+		nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(data)+s.aead.Overhead())
+		_, err := io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return err
+		}
+
+		data = s.aead.Seal(nonce, nonce, data, nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
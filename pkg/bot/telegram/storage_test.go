@@ -0,0 +1,47 @@
+package telegram
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tds "github.com/gotd/td/session"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorage(t *testing.T) {
+	for _, key := range []string{"", "secret"} {
+		t.Run("key="+key, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session")
+			s, err := newFileStorage(path, key)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			_, err = s.LoadSession(context.TODO())
+			assert.ErrorIs(t, err, tds.ErrNotFound)
+
+			assert.NoError(t, s.StoreSession(context.TODO(), []byte("foo")))
+			assert.NoError(t, s.StoreSession(context.TODO(), []byte("bar")))
+
+			data, err := s.LoadSession(context.TODO())
+			assert.NoError(t, err)
+			assert.Equal(t, "bar", string(data))
+
+			raw, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			if len(key) == 0 {
+				assert.Equal(t, "bar", string(raw))
+				return
+			}
+
+			assert.NotContains(t, string(raw), "bar")
+
+			other, err := newFileStorage(path, "invalid")
+			assert.NoError(t, err)
+			_, err = other.LoadSession(context.TODO())
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package telegram
+
+import (
+	"fmt"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+type topicKey struct {
+	chatID rt.ChatID
+	msgID  int
+}
+
+// topicOf returns id of the forum topic where the message was sent, 0 for the
+// general topic and chats without topics
+//
+// messages in a topic are replies to the service message created the topic,
+// and replies in the topic have reply_to_top_id set to it
+func (c *tgBot) topicOf(chat *chatInfo, m *tg.Message) int {
+	if !chat.IsForum() {
+		return 0
+	}
+
+	replyTo, ok := m.GetReplyTo()
+	if !ok {
+		return 0
+	}
+
+	if topID, ok := replyTo.GetReplyToTopID(); ok {
+		return topID
+	}
+
+	// either a message in the topic or a reply in the general topic
+	msgID := replyTo.GetReplyToMsgID()
+	if c.isTopic(chat, msgID) {
+		return msgID
+	}
+
+	return 0
+}
+
+// isTopic checks whether the message created a topic in the forum
+func (c *tgBot) isTopic(chat *chatInfo, msgID int) bool {
+	key := topicKey{chatID: chat.ID(), msgID: msgID}
+	if v, ok := c.topics.Load(key); ok {
+		return v.(bool)
+	}
+
+	msg, err := c.getChannelMessage(chat, msgID)
+	if err != nil {
+		c.Logger().I("failed to check forum topic", rt.LogChatID(chat.ID()), log.Int("msg_id", msgID), log.Error(err))
+		return false
+	}
+
+	_, isTopic := msg.(*tg.MessageService)
+	c.topics.Store(key, isTopic)
+	return isTopic
+}
+
+func (c *tgBot) getChannelMessage(chat *chatInfo, msgID int) (tg.MessageClass, error) {
+	peer, ok := chat.InputPeer().(*tg.InputPeerChannel)
+	if !ok {
+		return nil, fmt.Errorf("unexpected chat type %T", chat.InputPeer())
+	}
+
+	resp, err := c.client.API().ChannelsGetMessages(c.Context(), &tg.ChannelsGetMessagesRequest{
+		Channel: &tg.InputChannel{
+			ChannelID:  peer.GetChannelID(),
+			AccessHash: peer.GetAccessHash(),
+		},
+		ID: []tg.InputMessageClass{
+			&tg.InputMessageID{ID: msgID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, ok := resp.(*tg.MessagesChannelMessages)
+	if !ok || len(msgs.GetMessages()) != 1 {
+		return nil, fmt.Errorf("unexpected response %T", resp)
+	}
+
+	return msgs.GetMessages()[0], nil
+}
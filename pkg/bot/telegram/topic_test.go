@@ -0,0 +1,61 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func TestTopicOf(t *testing.T) {
+	forum := &tg.Channel{ID: 1, Megagroup: true}
+	forum.Flags.Set(channelFlagForum)
+
+	chat := resolveChatSpec(forum)
+	assert.True(t, chat.IsForum())
+	assert.False(t, resolveChatSpec(&tg.Channel{ID: 2, Megagroup: true}).IsForum())
+
+	c := &tgBot{}
+	c.topics.Store(topicKey{chatID: 1, msgID: 5}, true)
+	c.topics.Store(topicKey{chatID: 1, msgID: 6}, false)
+
+	newMessage := func(replyTo, topID int) *tg.Message {
+		msg := &tg.Message{ID: 10, PeerID: &tg.PeerChannel{ChannelID: 1}}
+		if replyTo != 0 {
+			hdr := tg.MessageReplyHeader{ReplyToMsgID: replyTo}
+			if topID != 0 {
+				hdr.SetReplyToTopID(topID)
+			}
+
+			msg.SetReplyTo(hdr)
+		}
+
+		return msg
+	}
+
+	for _, test := range []struct {
+		name    string
+		msg     *tg.Message
+		topic   int
+		replyTo rt.MessageID
+	}{
+		{name: "General", msg: newMessage(0, 0)},
+		{name: "General Reply", msg: newMessage(6, 0), replyTo: 6},
+		{name: "Topic", msg: newMessage(5, 0), topic: 5},
+		{name: "Topic Reply", msg: newMessage(7, 5), topic: 5, replyTo: 7},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mc := &messageContext{msg: test.msg, topicID: c.topicOf(&chat, test.msg)}
+			mc.src.Chat = chat
+
+			assert.Equal(t, test.topic, mc.topicID)
+			assert.Equal(t, rt.MessageID(test.topic), mc.Chat().TopicID())
+			assert.Equal(t, test.replyTo, mc.ReplyTo())
+		})
+	}
+
+	group := resolveChatSpec(&tg.Channel{ID: 2, Megagroup: true})
+	assert.Equal(t, 0, c.topicOf(&group, newMessage(7, 5)))
+}
@@ -0,0 +1,447 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"arhat.dev/pkg/log"
+	tds "github.com/gotd/td/session"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+)
+
+// updatesState is the common and per channel state of updates, used to fetch
+// updates missed when the bot was disconnected
+//
+// ref: https://core.telegram.org/api/updates
+type updatesState struct {
+	Pts  int `json:"pts"`
+	Qts  int `json:"qts"`
+	Seq  int `json:"seq"`
+	Date int `json:"date"`
+
+	// key: channel id
+	Channels map[int64]channelState `json:"channels,omitempty"`
+}
+
+type channelState struct {
+	Pts        int   `json:"pts"`
+	AccessHash int64 `json:"accessHash"`
+}
+
+func (s *updatesState) setCommon(pts, qts, seq, date int) {
+	s.Pts = maxInt(s.Pts, pts)
+	s.Qts = maxInt(s.Qts, qts)
+	s.Seq = maxInt(s.Seq, seq)
+	s.Date = maxInt(s.Date, date)
+}
+
+func (s *updatesState) setChannelPts(channelID int64, pts int) {
+	if s.Channels == nil {
+		s.Channels = make(map[int64]channelState)
+	}
+
+	ch := s.Channels[channelID]
+	ch.Pts = maxInt(ch.Pts, pts)
+	s.Channels[channelID] = ch
+}
+
+var _ telegram.UpdateHandler = (*updatesTracker)(nil)
+
+// updatesTracker records updates state of updates handled by next
+type updatesTracker struct {
+	next telegram.UpdateHandler
+
+	// storage of the state, nil when the state is not persisted
+	storage tds.Storage
+
+	// gapCh is signaled when the server tells there are too many updates to push
+	gapCh chan struct{}
+
+	mu    sync.Mutex
+	state updatesState
+	dirty bool
+}
+
+func newUpdatesTracker(next telegram.UpdateHandler, storage tds.Storage) *updatesTracker {
+	return &updatesTracker{
+		next:    next,
+		storage: storage,
+		gapCh:   make(chan struct{}, 1),
+	}
+}
+
+// Handle implements telegram.UpdateHandler, the state is only recorded when
+// updates are handled successfully, so failed ones are fetched again on recovery
+func (t *updatesTracker) Handle(ctx context.Context, u tg.UpdatesClass) error {
+	err := t.next.Handle(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	t.record(u)
+	return nil
+}
+
+func (t *updatesTracker) record(u tg.UpdatesClass) {
+	var (
+		updates        []tg.UpdateClass
+		chats          []tg.ChatClass
+		pts, seq, date int
+	)
+
+	switch u := u.(type) {
+	case *tg.Updates:
+		updates, chats, seq, date = u.Updates, u.Chats, u.Seq, u.Date
+	case *tg.UpdatesCombined:
+		updates, chats, seq, date = u.Updates, u.Chats, u.Seq, u.Date
+	case *tg.UpdateShort:
+		updates, date = []tg.UpdateClass{u.Update}, u.Date
+	case *tg.UpdateShortMessage:
+		pts, date = u.Pts, u.Date
+	case *tg.UpdateShortChatMessage:
+		pts, date = u.Pts, u.Date
+	case *tg.UpdateShortSentMessage:
+		pts, date = u.Pts, u.Date
+	case *tg.UpdatesTooLong:
+		t.signalGap()
+		return
+	default:
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.state.setCommon(pts, 0, seq, date)
+	for _, upd := range updates {
+		if channelID, pts, ok := channelPtsOf(upd); ok {
+			if pts == 0 {
+				t.signalGap()
+			}
+
+			t.state.setChannelPts(channelID, pts)
+			continue
+		}
+
+		switch upd := upd.(type) {
+		case *tg.UpdateNewEncryptedMessage:
+			t.state.setCommon(0, upd.Qts, 0, 0)
+		case interface{ GetPts() int }:
+			t.state.setCommon(upd.GetPts(), 0, 0, 0)
+		}
+	}
+
+	t.setAccessHashes(chats)
+	t.dirty = true
+}
+
+// setAccessHashes updates access hashes of tracked channels
+func (t *updatesTracker) setAccessHashes(chats []tg.ChatClass) {
+	for _, c := range chats {
+		ch, ok := c.(*tg.Channel)
+		if !ok {
+			continue
+		}
+
+		cs, tracked := t.state.Channels[ch.GetID()]
+		if accessHash, ok := ch.GetAccessHash(); ok && tracked {
+			cs.AccessHash = accessHash
+			t.state.Channels[ch.GetID()] = cs
+		}
+	}
+}
+
+func (t *updatesTracker) signalGap() {
+	select {
+	case t.gapCh <- struct{}{}:
+	default:
+	}
+}
+
+// State returns a copy of current state
+func (t *updatesTracker) State() (ret updatesState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ret = t.state
+	ret.Channels = make(map[int64]channelState, len(t.state.Channels))
+	for k, v := range t.state.Channels {
+		ret.Channels[k] = v
+	}
+
+	return
+}
+
+// Update calls fn with current state
+func (t *updatesTracker) Update(fn func(s *updatesState)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fn(&t.state)
+	t.dirty = true
+}
+
+// Load loads state from the storage, ok is false when there is no state stored
+func (t *updatesTracker) Load(ctx context.Context) (ok bool, err error) {
+	if t.storage == nil {
+		return false, nil
+	}
+
+	data, err := t.storage.LoadSession(ctx)
+	if err != nil {
+		if errors.Is(err, tds.ErrNotFound) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err = json.Unmarshal(data, &t.state)
+	if err != nil {
+		return false, err
+	}
+
+	return t.state.Pts != 0, nil
+}
+
+// Flush stores the state if changed
+func (t *updatesTracker) Flush(ctx context.Context) error {
+	if t.storage == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(&t.state)
+	t.dirty = false
+	t.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return t.storage.StoreSession(ctx, data)
+}
+
+// channelPtsOf returns the channel id and pts of channel updates, pts is 0 when the
+// channel has too many updates to push
+func channelPtsOf(u tg.UpdateClass) (channelID int64, pts int, ok bool) {
+	switch u := u.(type) {
+	case *tg.UpdateNewChannelMessage:
+		channelID, ok = channelIDOf(u.Message)
+		return channelID, u.Pts, ok
+	case *tg.UpdateEditChannelMessage:
+		channelID, ok = channelIDOf(u.Message)
+		return channelID, u.Pts, ok
+	case *tg.UpdateDeleteChannelMessages:
+		return u.ChannelID, u.Pts, true
+	case *tg.UpdateChannelWebPage:
+		return u.ChannelID, u.Pts, true
+	case *tg.UpdatePinnedChannelMessages:
+		return u.ChannelID, u.Pts, true
+	case *tg.UpdateChannelTooLong:
+		return u.ChannelID, 0, true
+	default:
+		return 0, 0, false
+	}
+}
+
+func channelIDOf(msg tg.MessageClass) (int64, bool) {
+	var peer tg.PeerClass
+	switch m := msg.(type) {
+	case *tg.Message:
+		peer = m.GetPeerID()
+	case *tg.MessageService:
+		peer = m.GetPeerID()
+	}
+
+	ch, ok := peer.(*tg.PeerChannel)
+	if !ok {
+		return 0, false
+	}
+
+	return ch.GetChannelID(), true
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// initUpdates loads the stored updates state and fetches updates missed since
+// then, or initializes the state when there is no state stored
+func (c *tgBot) initUpdates() error {
+	ok, err := c.updates.Load(c.Context())
+	if err != nil {
+		c.Logger().I("failed to load updates state", log.Error(err))
+	}
+
+	if ok {
+		c.recoverUpdates()
+		return nil
+	}
+
+	state, err := c.client.API().UpdatesGetState(c.Context())
+	if err != nil {
+		return err
+	}
+
+	c.updates.Update(func(s *updatesState) {
+		s.setCommon(state.Pts, state.Qts, state.Seq, state.Date)
+	})
+
+	return nil
+}
+
+// recoverUpdates fetches updates missed since the recorded state
+//
+// missed messages are only appended to active sessions, botcmds in them are
+// not handled as they can be outdated
+//
+// sessions active before restart are restored before recovery when the session
+// file is set, so messages sent while the bot was down are appended to them
+func (c *tgBot) recoverUpdates() {
+	state := c.updates.State()
+
+	err := c.recoverCommonUpdates(state)
+	if err != nil {
+		c.Logger().I("failed to recover updates", log.Error(err))
+	}
+
+	for channelID, cs := range state.Channels {
+		err = c.recoverChannelUpdates(channelID, cs)
+		if err != nil {
+			c.Logger().I("failed to recover channel updates", log.Int64("channel_id", channelID), log.Error(err))
+		}
+	}
+}
+
+func (c *tgBot) recoverCommonUpdates(state updatesState) error {
+	for {
+		diff, err := c.client.API().UpdatesGetDifference(c.Context(), &tg.UpdatesGetDifferenceRequest{
+			Pts:  state.Pts,
+			Qts:  state.Qts,
+			Date: state.Date,
+		})
+		if err != nil {
+			return err
+		}
+
+		var next tg.UpdatesState
+		switch d := diff.(type) {
+		case *tg.UpdatesDifferenceEmpty:
+			c.updates.Update(func(s *updatesState) { s.setCommon(0, 0, d.Seq, d.Date) })
+			return nil
+		case *tg.UpdatesDifferenceTooLong:
+			c.Logger().I("too many updates missed", log.Int("pts", d.Pts))
+			c.updates.Update(func(s *updatesState) { s.setCommon(d.Pts, 0, 0, 0) })
+			return nil
+		case *tg.UpdatesDifference:
+			c.handleRecoveredUpdates(d.NewMessages, d.OtherUpdates, d.Users, d.Chats)
+			c.handleRecoveredSecretMessages(d.NewEncryptedMessages, d.State.Qts)
+			next = d.State
+		case *tg.UpdatesDifferenceSlice:
+			c.handleRecoveredUpdates(d.NewMessages, d.OtherUpdates, d.Users, d.Chats)
+			c.handleRecoveredSecretMessages(d.NewEncryptedMessages, d.IntermediateState.Qts)
+			next = d.IntermediateState
+		default:
+			return nil
+		}
+
+		c.updates.Update(func(s *updatesState) {
+			s.setCommon(next.Pts, next.Qts, next.Seq, next.Date)
+		})
+
+		if _, isSlice := diff.(*tg.UpdatesDifferenceSlice); !isSlice {
+			return nil
+		}
+
+		state.Pts, state.Qts, state.Date = next.Pts, next.Qts, next.Date
+	}
+}
+
+func (c *tgBot) recoverChannelUpdates(channelID int64, cs channelState) error {
+	const limit = 100
+
+	for pts := cs.Pts; pts != 0; {
+		diff, err := c.client.API().UpdatesGetChannelDifference(c.Context(), &tg.UpdatesGetChannelDifferenceRequest{
+			Channel: &tg.InputChannel{
+				ChannelID:  channelID,
+				AccessHash: cs.AccessHash,
+			},
+			Filter: &tg.ChannelMessagesFilterEmpty{},
+			Pts:    pts,
+			Limit:  limit,
+		})
+		if err != nil {
+			return err
+		}
+
+		final := true
+		switch d := diff.(type) {
+		case *tg.UpdatesChannelDifferenceEmpty:
+			pts = d.Pts
+		case *tg.UpdatesChannelDifferenceTooLong:
+			c.Logger().I("too many channel updates missed", log.Int64("channel_id", channelID))
+			if dialog, ok := d.Dialog.(*tg.Dialog); ok {
+				pts, _ = dialog.GetPts()
+			}
+		case *tg.UpdatesChannelDifference:
+			c.handleRecoveredUpdates(d.NewMessages, d.OtherUpdates, d.Users, d.Chats)
+			pts, final = d.Pts, d.Final
+		}
+
+		c.updates.Update(func(s *updatesState) { s.setChannelPts(channelID, pts) })
+
+		if final {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// handleRecoveredUpdates appends missed messages to active sessions, other updates
+// are handled as usual except new messages
+func (c *tgBot) handleRecoveredUpdates(msgs []tg.MessageClass, others []tg.UpdateClass, users []tg.UserClass, chats []tg.ChatClass) {
+	e := tg.Entities{
+		Users:    tg.UserClassArray(users).NotEmptyToMap(),
+		Chats:    tg.ChatClassArray(chats).ChatToMap(),
+		Channels: tg.ChatClassArray(chats).ChannelToMap(),
+	}
+
+	for _, m := range msgs {
+		_ = c.handleTelegramMessage(e, m, true)
+	}
+
+	var updates []tg.UpdateClass
+	for _, u := range others {
+		switch u.(type) {
+		case *tg.UpdateNewMessage, *tg.UpdateNewChannelMessage:
+		default:
+			updates = append(updates, u)
+		}
+	}
+
+	if len(updates) == 0 {
+		return
+	}
+
+	err := c.dispatcher.Handle(c.Context(), &tg.Updates{Updates: updates, Users: users, Chats: chats})
+	if err != nil {
+		c.Logger().I("failed to handle recovered updates", log.Error(err))
+	}
+}
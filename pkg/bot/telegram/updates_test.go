@@ -0,0 +1,155 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+func TestUpdatesTracker(t *testing.T) {
+	storage, err := newFileStorage(filepath.Join(t.TempDir(), "session.updates"), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	channel := &tg.Channel{ID: 2}
+	channel.SetAccessHash(22)
+
+	handled := 0
+	tracker := newUpdatesTracker(telegramUpdateHandlerFunc(func(ctx context.Context, u tg.UpdatesClass) error {
+		handled++
+		return nil
+	}), storage)
+
+	ok, err := tracker.Load(context.TODO())
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, tracker.Handle(context.TODO(), &tg.Updates{
+		Updates: []tg.UpdateClass{
+			&tg.UpdateNewMessage{Message: &tg.Message{PeerID: &tg.PeerUser{UserID: 1}}, Pts: 10, PtsCount: 1},
+			&tg.UpdateNewChannelMessage{Message: &tg.Message{PeerID: &tg.PeerChannel{ChannelID: 2}}, Pts: 20, PtsCount: 1},
+			&tg.UpdateNewEncryptedMessage{Qts: 3},
+		},
+		Chats: []tg.ChatClass{
+			channel,
+			// not tracked
+			&tg.Channel{ID: 4, AccessHash: 44},
+		},
+		Seq:  5,
+		Date: 100,
+	}))
+	assert.NoError(t, tracker.Handle(context.TODO(), &tg.UpdateShort{
+		Update: &tg.UpdateDeleteChannelMessages{ChannelID: 2, Pts: 21, PtsCount: 1},
+		Date:   101,
+	}))
+	assert.Equal(t, 2, handled)
+
+	expected := updatesState{
+		Pts: 10, Qts: 3, Seq: 5, Date: 101,
+		Channels: map[int64]channelState{2: {Pts: 21, AccessHash: 22}},
+	}
+	assert.Equal(t, expected, tracker.State())
+
+	select {
+	case <-tracker.gapCh:
+		assert.Fail(t, "unexpected gap")
+	default:
+	}
+
+	assert.NoError(t, tracker.Handle(context.TODO(), &tg.UpdatesTooLong{}))
+	select {
+	case <-tracker.gapCh:
+	default:
+		assert.Fail(t, "gap not signaled")
+	}
+
+	// short updates
+	assert.NoError(t, tracker.Handle(context.TODO(), &tg.UpdateShortMessage{Pts: 11, PtsCount: 1, Date: 102}))
+	assert.NoError(t, tracker.Handle(context.TODO(), &tg.UpdateShortChatMessage{Pts: 12, PtsCount: 1, Date: 103}))
+	assert.NoError(t, tracker.Handle(context.TODO(), &tg.UpdateShortSentMessage{Pts: 13, PtsCount: 1, Date: 104}))
+	expected.Pts, expected.Date = 13, 104
+	assert.Equal(t, expected, tracker.State())
+
+	assert.NoError(t, tracker.Flush(context.TODO()))
+
+	loaded := newUpdatesTracker(nil, storage)
+	ok, err = loaded.Load(context.TODO())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, expected, loaded.State())
+}
+
+func TestUpdatesTrackerHandleError(t *testing.T) {
+	tracker := newUpdatesTracker(telegramUpdateHandlerFunc(func(ctx context.Context, u tg.UpdatesClass) error {
+		return errors.New("failed")
+	}), nil)
+
+	assert.Error(t, tracker.Handle(context.TODO(), &tg.UpdateShortMessage{Pts: 10, PtsCount: 1, Date: 100}))
+	assert.Equal(t, updatesState{Channels: map[int64]channelState{}}, tracker.State())
+	assert.False(t, tracker.dirty)
+}
+
+func TestHandleRecoveredUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var (
+		alice = &tg.User{ID: 1, FirstName: "alice"}
+		bob   = &tg.User{ID: 2, FirstName: "bob"}
+
+		wf = &bot.Workflow{}
+	)
+
+	c := &tgBot{sessions: session.NewManager[chatIDWrapper](ctx)}
+	c.BaseBot = bot.NewBotBase(rt.NewContext(ctx, log.NoOpLogger, nil))
+
+	chat := chatIDWrapper{chat: alice.AsInputPeer()}
+	assert.True(t, c.sessions.MarkSessionStandby(wf, 1, chat, "", false, time.Minute))
+	s, err := c.sessions.ActivateSession(wf, 1, chat.ID(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	newMessage := func(id int, from *tg.User, text string) tg.MessageClass {
+		m := &tg.Message{ID: id, PeerID: &tg.PeerUser{UserID: from.ID}, Message: text}
+		m.SetFromID(&tg.PeerUser{UserID: from.ID})
+		return m
+	}
+
+	c.handleRecoveredUpdates([]tg.MessageClass{
+		newMessage(1, alice, "foo"),
+		// botcmds are appended as text
+		newMessage(2, alice, "/end"),
+		// no active session, e.g. after restart
+		newMessage(3, bob, "bar"),
+	}, nil, []tg.UserClass{alice, bob}, nil)
+
+	msgs := s.GetMessages()
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, "foo", msgs[0].Text)
+		assert.Equal(t, "/end", msgs[1].Text)
+	}
+
+	_, ok := c.sessions.ActiveSessionOf(chat)
+	assert.True(t, ok)
+
+	_, ok = c.sessions.ActiveSessionOf(chatIDWrapper{chat: bob.AsInputPeer()})
+	assert.False(t, ok)
+}
+
+type telegramUpdateHandlerFunc func(ctx context.Context, u tg.UpdatesClass) error
+
+func (f telegramUpdateHandlerFunc) Handle(ctx context.Context, u tg.UpdatesClass) error {
+	return f(ctx, u)
+}
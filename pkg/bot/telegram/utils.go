@@ -1,14 +1,11 @@
 package telegram
 
 import (
-	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"strconv"
 	"time"
 
 	"arhat.dev/pkg/log"
-	"arhat.dev/pkg/stringhelper"
 	tm "github.com/gotd/td/telegram/message"
 	"github.com/gotd/td/telegram/message/styling"
 	"github.com/gotd/td/tg"
@@ -16,22 +13,6 @@ import (
 	"arhat.dev/mbot/pkg/rt"
 )
 
-func encodeUint64Hex[T rt.ChatID | rt.UserID](n T) string {
-	var buf [8]byte
-	binary.BigEndian.PutUint64(buf[:], uint64(n))
-	return hex.EncodeToString(buf[:])
-}
-
-func decodeUint64Hex[T rt.ChatID | rt.UserID](s string) (_ T, err error) {
-	var buf [8]byte
-	_, err = hex.Decode(buf[:], stringhelper.ToBytes[byte, byte](s))
-	if err != nil {
-		return 0, err
-	}
-
-	return T(binary.BigEndian.Uint64(buf[:])), nil
-}
-
 func formatMessageID(msgID rt.MessageID) string {
 	return strconv.FormatUint(uint64(msgID), 10)
 }
@@ -42,6 +23,11 @@ type msgDeleteKey struct {
 }
 
 func (c *tgBot) scheduleMessageDelete(chat *chatInfo, after time.Duration, msgIDs ...rt.MessageID) {
+	if chat.IsSecretChat() {
+		// messages in secret chats are not deleted by the server
+		return
+	}
+
 	for _, msgID := range msgIDs {
 		if msgID == 0 {
 			// ignore invalid message id
@@ -0,0 +1,222 @@
+package bottest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/generator"
+	"arhat.dev/mbot/pkg/publisher"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/storage"
+)
+
+// Name of the generator, storage and publisher in the CreationContext
+const Name = "fake"
+
+// NewCreationContext creates a bot creation context with fake workflow components
+// named Name
+func NewCreationContext(pub *Publisher) *bot.CreationContext {
+	return &bot.CreationContext{
+		Storage: map[string]storage.Interface{
+			Name: &Storage{},
+		},
+		Generators: map[string]generator.Interface{
+			Name: &Generator{},
+		},
+		Publishers: map[string]publisher.Config{
+			Name: pub,
+		},
+	}
+}
+
+// CommonConfig returns an enabled bot config with single workflow using fake components
+func CommonConfig(adminOnly, downloadMedia bool) bot.CommonConfig {
+	return bot.CommonConfig{
+		Enabled: true,
+		Workflows: []bot.WorkflowConfig{
+			{
+				AdminOnly:     &adminOnly,
+				DownloadMedia: downloadMedia,
+				Storage:       Name,
+				Generator:     Name,
+				Publisher:     Name,
+			},
+		},
+	}
+}
+
+var _ storage.Interface = (*Storage)(nil)
+
+// Storage pretends to upload data, returns url with `fake://` scheme
+type Storage struct{}
+
+// Upload implements storage.Interface
+func (s *Storage) Upload(con rt.Conversation, in *rt.StorageInput) (out rt.StorageOutput, err error) {
+	out.URL = "fake://" + in.Filename()
+	return
+}
+
+var _ generator.Interface = (*Generator)(nil)
+
+// Generator generates plain text from params and message text
+type Generator struct{}
+
+// New implements generator.Interface
+func (g *Generator) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	out.Data.Set(in.Params)
+	return
+}
+
+// Continue implements generator.Interface
+func (g *Generator) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	out.Data.Set(in.Params)
+	return
+}
+
+// Peek implements generator.Interface
+func (g *Generator) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return
+}
+
+// Generate implements generator.Interface, each message is rendered as `author: text` in
+// a single line
+func (g *Generator) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	var buf strings.Builder
+	for _, m := range in.Messages {
+		buf.WriteString(m.Author)
+		buf.WriteString(": ")
+		buf.WriteString(m.Text)
+		buf.WriteString("\n")
+	}
+
+	out.Data.Set(buf.String())
+	return
+}
+
+var (
+	_ publisher.Config    = (*Publisher)(nil)
+	_ publisher.Interface = (*Publisher)(nil)
+)
+
+// Publisher records published content and replies the conversation with a short note
+//
+// it serves as both publisher config and publisher
+type Publisher struct {
+	// Token requires user login with it when set
+	Token string
+
+	mu sync.Mutex
+
+	posts []string
+}
+
+// Posts returns all published content, the last element is the current one
+func (p *Publisher) Posts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.posts...)
+}
+
+// Create implements publisher.Config
+func (p *Publisher) Create() (publisher.Interface, publisher.User, error) {
+	if len(p.Token) == 0 {
+		return p, publisher.NoUser{}, nil
+	}
+
+	return p, &User{}, nil
+}
+
+var _ publisher.User = (*User)(nil)
+
+// User of the Publisher requiring login
+type User struct {
+	publisher.NoUser
+
+	token string
+}
+
+// NextCredential implements publisher.User
+func (u *User) NextCredential() rt.LoginFlow { return rt.LoginFlow_Token }
+
+// SetToken implements publisher.User
+func (u *User) SetToken(token string) { u.token = token }
+
+func (p *Publisher) note(text string) (out rt.PublisherOutput) {
+	out.SendMessage.Set(rt.SendMessageOptions{
+		Body: []rt.Span{{Text: text}},
+	})
+
+	return
+}
+
+// CreateNew implements publisher.Interface
+func (p *Publisher) CreateNew(con rt.Conversation, cmd, params string, in *rt.GeneratorOutput) (rt.PublisherOutput, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.posts = append(p.posts, in.Data.Get())
+	return p.note("created " + params), nil
+}
+
+// Retrieve implements publisher.Interface
+func (p *Publisher) Retrieve(con rt.Conversation, cmd, params string) (rt.PublisherOutput, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.posts = append(p.posts, params)
+	return p.note("retrieved " + params), nil
+}
+
+// AppendToExisting implements publisher.Interface
+func (p *Publisher) AppendToExisting(con rt.Conversation, cmd, params string, in *rt.GeneratorOutput) (rt.PublisherOutput, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.posts) == 0 {
+		p.posts = append(p.posts, "")
+	}
+
+	p.posts[len(p.posts)-1] += in.Data.Get()
+	return p.note("published"), nil
+}
+
+// CheckLogin implements publisher.Interface
+func (p *Publisher) CheckLogin(con rt.Conversation, cmd, params string, user publisher.User) (out rt.PublisherOutput, err error) {
+	return
+}
+
+// Login implements publisher.Interface, user without token is treated as a new
+// one, and the Token is sent to the conversation
+func (p *Publisher) Login(con rt.Conversation, user publisher.User) (out rt.PublisherOutput, err error) {
+	u, ok := user.(*User)
+	switch {
+	case !ok:
+	case len(u.token) == 0:
+		out = p.note("token " + p.Token)
+	case u.token != p.Token:
+		err = fmt.Errorf("invalid token")
+	}
+
+	return
+}
+
+// RequestExternalAccess implements publisher.Interface
+func (p *Publisher) RequestExternalAccess(con rt.Conversation) (out rt.PublisherOutput, err error) {
+	return p.note("access"), nil
+}
+
+// List implements publisher.Interface
+func (p *Publisher) List(con rt.Conversation) (out rt.PublisherOutput, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.note(fmt.Sprintf("%d posts", len(p.posts))), nil
+}
+
+// Delete implements publisher.Interface
+func (p *Publisher) Delete(con rt.Conversation, cmd, params string) (out rt.PublisherOutput, err error) {
+	return p.note("deleted " + params), nil
+}
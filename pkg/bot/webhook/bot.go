@@ -0,0 +1,296 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const (
+	// maxRequestBodySize limits the size of webhook requests, attachments may
+	// be embedded as base64
+	maxRequestBodySize = 32 << 20
+
+	// SignatureHeader is the header of hmac-sha256 signature of request body, in
+	// format `sha256=<hex>`
+	SignatureHeader = "X-Mbot-Signature-256"
+)
+
+var _ bot.Interface = (*webhookBot)(nil)
+
+type webhookBot struct {
+	bot.BaseBot
+
+	path   string
+	secret []byte
+
+	// callbackURL is empty when replying synchronously
+	callbackURL string
+	client      *http.Client
+
+	sessions session.Manager[chatIDWrapper]
+	wfSet    bot.WorkflowSet
+	engine   *engine.Engine[chatIDWrapper, *messageContext]
+
+	history   *bot.MessageHistory[chatIDWrapper, *messageContext]
+	callbacks *bot.CallbackRegistry
+	ids       idRegistry
+	msgSeq    uint64
+
+	// current is the outbox of the message being handled
+	mu      sync.Mutex
+	current *outbox
+
+	// messages are handled one by one in the order received
+	msgCh chan *messageContext
+}
+
+// outbox collects messages sent during handling of a webhook request
+type outbox struct {
+	msgs []OutgoingMessage
+	done chan struct{}
+}
+
+func (c *webhookBot) Configure() error { return nil }
+
+// Start registers the webhook handler to the mux
+func (c *webhookBot) Start(baseURL string, mux rt.Mux) error {
+	mux.HandleFunc(c.path, c.handleWebhook)
+
+	c.Logger().D("serving webhook", log.String("url", baseURL+c.path))
+
+	go c.handleMessages()
+
+	return nil
+}
+
+func (c *webhookBot) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !c.verify(r, body) {
+		c.Logger().I("invalid webhook request signature")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	env := new(Envelope)
+	err = json.Unmarshal(body, env)
+	if err != nil || len(env.Chat.ID) == 0 || len(env.Author.ID) == 0 {
+		http.Error(w, "invalid envelope, chat.id and author.id are required", http.StatusBadRequest)
+		return
+	}
+
+	mc := c.newMessageContext(env)
+	if len(c.callbackURL) != 0 {
+		c.enqueue(mc)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	mc.out = &outbox{done: make(chan struct{})}
+	c.enqueue(mc)
+
+	select {
+	case <-mc.out.done:
+	case <-r.Context().Done():
+		return
+	case <-c.Context().Done():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := Response{Messages: mc.out.msgs}
+	if resp.Messages == nil {
+		resp.Messages = []OutgoingMessage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// verify checks the hmac signature or bearer token of the request
+func (c *webhookBot) verify(r *http.Request, body []byte) bool {
+	if sig := r.Header.Get(SignatureHeader); len(sig) != 0 {
+		expected, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+		if err != nil {
+			return false
+		}
+
+		return hmac.Equal(expected, c.sign(body))
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), c.secret) == 1
+}
+
+func (c *webhookBot) sign(body []byte) []byte {
+	h := hmac.New(sha256.New, c.secret)
+	_, _ = h.Write(body)
+	return h.Sum(nil)
+}
+
+func (c *webhookBot) newMessageContext(env *Envelope) *messageContext {
+	if len(env.ID) == 0 {
+		env.ID = "msg-" + strconv.FormatUint(atomic.AddUint64(&c.msgSeq, 1), 10)
+	}
+
+	mc := &messageContext{
+		chat: chatIDWrapper{
+			id:      env.Chat.ID,
+			private: env.Chat.Private,
+		},
+		info:   env.Chat,
+		author: env.Author,
+
+		msgID: messageIDOf(env.ID),
+		env:   env,
+
+		timestamp: time.Now().UTC(),
+	}
+
+	if len(env.ReplyTo) != 0 {
+		mc.replyTo = messageIDOf(env.ReplyTo)
+	}
+
+	if len(env.Timestamp) != 0 {
+		ts, err := time.Parse(time.RFC3339, env.Timestamp)
+		if err == nil {
+			mc.timestamp = ts.UTC()
+		}
+	}
+
+	if len(env.Spans) != 0 {
+		var buf strings.Builder
+		for _, sp := range env.Spans {
+			buf.WriteString(sp.Text)
+		}
+
+		mc.text = buf.String()
+	} else {
+		mc.text = env.Text
+	}
+
+	mc.con = conversationImpl{
+		bot:  c,
+		chat: mc.chat,
+	}
+
+	mc.logger = c.Logger().WithFields(
+		rt.LogChatID(mc.chat.ID()),
+		rt.LogSenderID(userIDOf(env.Author.ID)),
+	)
+
+	if len(env.Click) == 0 {
+		c.ids.add(mc.msgID, env.ID)
+		c.history.Add(mc)
+	}
+
+	return mc
+}
+
+func (c *webhookBot) enqueue(mc *messageContext) {
+	select {
+	case c.msgCh <- mc:
+	case <-c.Context().Done():
+	}
+}
+
+func (c *webhookBot) handleMessages() {
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case mc := <-c.msgCh:
+			c.setCurrentOutbox(mc.out)
+
+			err := c.dispatchNewMessage(mc)
+			if err != nil {
+				mc.logger.I("bad message", log.Error(err))
+			}
+
+			c.setCurrentOutbox(nil)
+			if mc.out != nil {
+				close(mc.out.done)
+			}
+		}
+	}
+}
+
+func (c *webhookBot) setCurrentOutbox(out *outbox) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current = out
+}
+
+func (c *webhookBot) dispatchNewMessage(mc *messageContext) error {
+	mc.logger.V("dispatch message")
+
+	if len(mc.env.Click) != 0 {
+		return c.handleClick(mc)
+	}
+
+	// botcmd only takes the first line of the message
+	if line, _, _ := strings.Cut(strings.TrimSpace(mc.text), "\n"); strings.HasPrefix(line, "/") {
+		cmd, params, _ := strings.Cut(line, " ")
+		handled, err := c.engine.HandleBotCmd(mc, cmd, strings.TrimSpace(params))
+		if handled {
+			return err
+		}
+	}
+
+	// filter private message for input to this bot
+	handled, err := c.engine.HandleInput(mc)
+	if handled {
+		return err
+	}
+
+	return c.appendSessionMessage(mc)
+}
+
+func (c *webhookBot) handleClick(mc *messageContext) error {
+	fn, ok := c.callbacks.Find(mc.env.Click)
+	if !ok {
+		c.reply(mc, plain("The button has expired."))
+		return nil
+	}
+
+	return fn()
+}
+
+func (c *webhookBot) appendSessionMessage(mc *messageContext) error {
+	s, ok := c.sessions.GetActiveSession(mc.chat.ID())
+	if !ok {
+		return nil
+	}
+
+	mc.logger.V("append session message")
+	s.AppendMessage(c.newMessageFromEnvelope(mc, s.Workflow()))
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"arhat.dev/pkg/tlshelper"
+	"arhat.dev/rs"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/bot/engine"
+	"arhat.dev/mbot/pkg/rt"
+	"arhat.dev/mbot/pkg/session"
+)
+
+const Platform = "webhook"
+
+func init() {
+	bot.Register(Platform, func() bot.Config { return &Config{} })
+}
+
+// CallbackConfig is the endpoint receiving messages sent by the bot
+type CallbackConfig struct {
+	rs.BaseField
+
+	// URL to POST OutgoingMessage, when not set, messages are sent as the
+	// synchronous http response of the webhook request
+	URL string `yaml:"url"`
+
+	TLS tlshelper.TLSConfig `yaml:"tls"`
+
+	// Timeout of a single callback request
+	//
+	// defaults to 30s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Config for webhook bot
+type Config struct {
+	rs.BaseField
+
+	bot.CommonConfig `yaml:",inline"`
+
+	// Path is the http path accepting webhook requests
+	//
+	// defaults to /webhook
+	Path string `yaml:"path"`
+
+	// Secret shared with the webhook sender, requests are accepted when either
+	// X-Mbot-Signature-256 is the valid hmac-sha256 signature of the body, or
+	// the Authorization header is `Bearer <secret>`
+	//
+	// callback requests are signed with the same secret
+	Secret string `yaml:"secret"`
+
+	// Callback to deliver messages sent by the bot
+	Callback CallbackConfig `yaml:"callback"`
+
+	// CallbackTTL is how long buttons with callbacks are clickable
+	//
+	// defaults to 24h
+	CallbackTTL time.Duration `yaml:"callbackTTL"`
+}
+
+func (c *Config) Create(rtCtx rt.RTContext, bctx *bot.CreationContext) (bot.Interface, error) {
+	if len(c.Secret) == 0 {
+		return nil, fmt.Errorf("secret is required")
+	}
+
+	var callbackURL string
+	if len(c.Callback.URL) != 0 {
+		u, err := url.Parse(c.Callback.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid callback url %q", c.Callback.URL)
+		}
+
+		callbackURL = u.String()
+	}
+
+	tlsConfig, err := c.Callback.TLS.GetTLSConfig(false)
+	if err != nil {
+		return nil, fmt.Errorf("create callback tls config: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	timeout := c.Callback.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	workflows, err := c.CommonConfig.Resolve(bctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve workflow contexts: %w", err)
+	}
+
+	path := c.Path
+	if len(path) == 0 {
+		path = "/webhook"
+	}
+
+	wb := &webhookBot{
+		BaseBot: bot.NewBotBase(rtCtx),
+
+		path:        path,
+		secret:      []byte(c.Secret),
+		callbackURL: callbackURL,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+
+		sessions: session.NewManager[chatIDWrapper](rtCtx.Context()),
+		wfSet:    workflows,
+
+		callbacks: bot.NewCallbackRegistry(rtCtx.Context(), c.CallbackTTL, 0),
+
+		msgCh: make(chan *messageContext, 64),
+	}
+
+	wb.history = bot.NewMessageHistory[chatIDWrapper, *messageContext](0)
+	wb.engine = engine.New[chatIDWrapper, *messageContext](adapter{c: wb}, wb.sessions, &wb.wfSet, engine.Options{
+		HelpInPrivate: true,
+	})
+
+	return wb, nil
+}
@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+var _ rt.Conversation = (*conversationImpl)(nil)
+
+type conversationImpl struct {
+	bot *webhookBot
+
+	chat chatIDWrapper
+}
+
+// Context implements rt.Conversation
+func (c *conversationImpl) Context() context.Context {
+	return c.bot.Context()
+}
+
+// SendMessage implements rt.Conversation
+//
+// the message is POSTed to the callback url, or added to the synchronous response
+// of the webhook request being handled
+func (c *conversationImpl) SendMessage(ctx context.Context, opts rt.SendMessageOptions) ([]rt.MessageID, error) {
+	var buf strings.Builder
+	for i := range opts.Body {
+		buf.WriteString(opts.Body[i].Text)
+	}
+
+	id := "mbot-" + strconv.FormatUint(atomic.AddUint64(&c.bot.msgSeq, 1), 10)
+	msg := OutgoingMessage{
+		ID:       id,
+		Chat:     c.chat.envelope(),
+		Text:     buf.String(),
+		Markdown: markdown.Format(opts.Body),
+		Spans:    spansToEnvelope(opts.Body),
+	}
+
+	if opts.ReplyTo != 0 {
+		msg.ReplyTo = c.bot.ids.get(opts.ReplyTo)
+	}
+
+	for _, row := range opts.Callbacks {
+		var buttons []Button
+		for _, cb := range row {
+			switch {
+			case !cb.OnClick.IsNil():
+				cbID, err := c.bot.callbacks.Add(cb.OnClick.Get())
+				if err != nil {
+					return nil, fmt.Errorf("add button callback: %w", err)
+				}
+
+				buttons = append(buttons, Button{Text: cb.Text, ID: cbID})
+			case !cb.URL.IsNil():
+				buttons = append(buttons, Button{Text: cb.Text, URL: cb.URL.Get()})
+			}
+		}
+
+		if len(buttons) != 0 {
+			msg.Buttons = append(msg.Buttons, buttons)
+		}
+	}
+
+	err := c.bot.deliver(ctx, &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	msgID := messageIDOf(id)
+	c.bot.ids.add(msgID, id)
+
+	return []rt.MessageID{msgID}, nil
+}
+
+// deliver sends the message to the callback url, or collects it to the outbox
+// of current webhook request
+func (c *webhookBot) deliver(ctx context.Context, msg *OutgoingMessage) error {
+	if len(c.callbackURL) == 0 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.current == nil {
+			// sent after the webhook request was responded (e.g. by background workers)
+			c.Logger().I("message dropped, no pending webhook request", log.String("chat", msg.Chat.ID))
+			return nil
+		}
+
+		c.current.msgs = append(c.current.msgs, *msg)
+		return nil
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(c.sign(body)))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post callback: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected callback response status %q", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"arhat.dev/mbot/pkg/bot/markdown"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// Envelope is the json body of webhook requests
+type Envelope struct {
+	// ID of the message, generated when not set
+	ID string `json:"id,omitempty"`
+
+	Chat   Chat   `json:"chat"`
+	Author Author `json:"author"`
+
+	// ReplyTo is the id of the message replied
+	ReplyTo string `json:"replyTo,omitempty"`
+
+	// Text in markdown, ignored when Spans is set
+	Text string `json:"text,omitempty"`
+
+	// Spans of rich text
+	Spans []Span `json:"spans,omitempty"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Timestamp in RFC3339 format, defaults to the time received
+	Timestamp string `json:"timestamp,omitempty"`
+
+	// Click is the id of the button clicked, other fields except Chat and Author
+	// are ignored when set
+	Click string `json:"click,omitempty"`
+}
+
+// Chat where the message is sent
+type Chat struct {
+	// ID of the chat, for private chats, it's the id of the user
+	ID string `json:"id"`
+
+	Name string `json:"name,omitempty"`
+	Link string `json:"link,omitempty"`
+
+	// Private is true when the chat is the private chat between the user and the bot
+	Private bool `json:"private,omitempty"`
+}
+
+// Author of the message
+type Author struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Link string `json:"link,omitempty"`
+
+	// Admin allows the user to use botcmds of adminOnly workflows in group chats
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Span is a segment of rich text
+type Span struct {
+	Text string `json:"text"`
+
+	// Styles of the span, one or more of [bold, italic, strikethrough, underline,
+	// pre, code, blockquote, email, phone, url, mention, hashtag]
+	Styles []string `json:"styles,omitempty"`
+
+	// URL of url (link) span
+	URL string `json:"url,omitempty"`
+
+	// Hint is the language of pre span, or the user mentioned
+	Hint string `json:"hint,omitempty"`
+}
+
+// Attachment is a media file of the message
+type Attachment struct {
+	// Type of the attachment, one of [image, video, audio, voice, file]
+	//
+	// defaults to file
+	Type string `json:"type,omitempty"`
+
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+
+	// URL to download the file, required when Data is not set
+	URL string `json:"url,omitempty"`
+
+	// Data is the base64 encoded file content
+	Data string `json:"data,omitempty"`
+
+	// Caption in markdown
+	Caption string `json:"caption,omitempty"`
+}
+
+// OutgoingMessage is the message sent by the bot
+type OutgoingMessage struct {
+	ID      string `json:"id"`
+	Chat    Chat   `json:"chat"`
+	ReplyTo string `json:"replyTo,omitempty"`
+
+	// Text is the plain text of spans
+	Text string `json:"text"`
+	// Markdown is the markdown rendered from spans
+	Markdown string `json:"markdown"`
+	Spans    []Span `json:"spans"`
+
+	// Buttons of the message, in rows
+	Buttons [][]Button `json:"buttons,omitempty"`
+}
+
+// Button attached to the outgoing message
+type Button struct {
+	Text string `json:"text"`
+
+	// URL to open, not set for buttons with callback
+	URL string `json:"url,omitempty"`
+
+	// ID is the value of `click` in the envelope to click this button
+	ID string `json:"id,omitempty"`
+}
+
+// Response is the body of synchronous http response
+type Response struct {
+	Messages []OutgoingMessage `json:"messages"`
+}
+
+var spanStyles = []struct {
+	name string
+	flag rt.SpanFlag
+}{
+	{"bold", rt.SpanFlag_Bold},
+	{"italic", rt.SpanFlag_Italic},
+	{"strikethrough", rt.SpanFlag_Strikethrough},
+	{"underline", rt.SpanFlag_Underline},
+	{"pre", rt.SpanFlag_Pre},
+	{"code", rt.SpanFlag_Code},
+	{"blockquote", rt.SpanFlag_Blockquote},
+	{"email", rt.SpanFlag_Email},
+	{"phone", rt.SpanFlag_PhoneNumber},
+	{"url", rt.SpanFlag_URL},
+	{"mention", rt.SpanFlag_Mention},
+	{"hashtag", rt.SpanFlag_HashTag},
+}
+
+// spansFromEnvelope converts text spans in envelope, unknown styles are ignored
+func spansFromEnvelope(spans []Span) []rt.Span {
+	ret := make([]rt.Span, 0, len(spans))
+	for _, sp := range spans {
+		var flags rt.SpanFlag
+		for _, style := range sp.Styles {
+			for _, s := range spanStyles {
+				if s.name == style {
+					flags |= s.flag
+					break
+				}
+			}
+		}
+
+		ret = append(ret, rt.Span{
+			Flags: flags,
+			Text:  sp.Text,
+			URL:   sp.URL,
+			Hint:  sp.Hint,
+		})
+	}
+
+	return ret
+}
+
+// spansToEnvelope converts spans sent by the bot, media spans are converted to
+// url spans with the filename as text
+func spansToEnvelope(spans []rt.Span) []Span {
+	ret := make([]Span, 0, len(spans))
+	for i := range spans {
+		sp := &spans[i]
+
+		if sp.IsMedia() {
+			text := sp.Filename
+			if len(text) == 0 {
+				text = sp.URL
+			}
+
+			ret = append(ret, Span{Text: text, URL: sp.URL, Styles: []string{"url"}})
+			continue
+		}
+
+		out := Span{Text: sp.Text, URL: sp.URL, Hint: sp.Hint}
+		for _, s := range spanStyles {
+			if sp.Flags&s.flag != 0 {
+				out.Styles = append(out.Styles, s.name)
+			}
+		}
+
+		ret = append(ret, out)
+	}
+
+	return ret
+}
+
+// parseText converts text in envelope to spans
+func parseText(text string) []rt.Span {
+	return markdown.Parse(text, markdown.Options{Mentions: true, HashTags: true})
+}
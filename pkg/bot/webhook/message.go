@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/mbot/pkg/bot"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+func (c *webhookBot) newMessageFromEnvelope(mc *messageContext, wf *bot.Workflow) (ret *rt.Message) {
+	ret = rt.NewMessage()
+
+	ret.ID = mc.msgID
+	ret.Timestamp = mc.timestamp
+
+	if len(mc.env.Spans) != 0 {
+		ret.Spans = spansFromEnvelope(mc.env.Spans)
+	} else {
+		ret.Spans = parseText(mc.env.Text)
+	}
+
+	for i := range mc.env.Attachments {
+		c.appendAttachmentSpan(mc, ret, &mc.env.Attachments[i], wf)
+	}
+
+	var buf strings.Builder
+	for i := range ret.Spans {
+		buf.WriteString(ret.Spans[i].Text)
+	}
+	ret.Text = buf.String()
+
+	if mc.chat.private {
+		ret.Flags |= rt.MessageFlag_Private
+	}
+
+	if mc.replyTo != 0 {
+		ret.Flags |= rt.MessageFlag_Reply
+		ret.ReplyTo = mc.replyTo
+	}
+
+	ret.ChatName = mc.ChatName()
+	ret.ChatLink = mc.info.Link
+
+	ret.Author = mc.author.Name
+	if len(ret.Author) == 0 {
+		ret.Author = mc.author.ID
+	}
+	ret.AuthorLink = mc.author.Link
+
+	return
+}
+
+// appendAttachmentSpan adds the attachment as media span, and downloads (or decodes)
+// the file in background when the workflow requires
+// nolint:gocyclo
+func (c *webhookBot) appendAttachmentSpan(mc *messageContext, m *rt.Message, a *Attachment, wf *bot.Workflow) {
+	span := rt.Span{
+		URL: a.URL,
+		SpanMediaOptions: rt.SpanMediaOptions{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+		},
+	}
+
+	if len(span.Filename) == 0 && len(a.URL) != 0 {
+		if u, err := url.Parse(a.URL); err == nil && len(path.Base(u.Path)) > 1 {
+			span.Filename = path.Base(u.Path)
+		}
+	}
+
+	if len(span.ContentType) == 0 && len(span.Filename) != 0 {
+		span.ContentType = mime.TypeByExtension(path.Ext(span.Filename))
+	}
+
+	if len(span.ContentType) == 0 {
+		// provide default mime type for storage driver
+		span.ContentType = "application/octet-stream"
+	}
+
+	switch a.Type {
+	case "image":
+		span.Flags = rt.SpanFlag_Image
+	case "video":
+		span.Flags = rt.SpanFlag_Video
+	case "audio":
+		span.Flags = rt.SpanFlag_Audio
+	case "voice":
+		span.Flags = rt.SpanFlag_Voice
+	default:
+		span.Flags = rt.SpanFlag_File
+	}
+
+	if len(a.Caption) != 0 {
+		span.Caption = parseText(a.Caption)
+	}
+
+	m.Spans = append(m.Spans, span)
+
+	if !wf.DownloadMedia() || (len(a.URL) == 0 && len(a.Data) == 0) {
+		return
+	}
+
+	mediaSpan := &m.Spans[len(m.Spans)-1]
+	con := mc.con
+	fileURL, data := a.URL, a.Data
+
+	m.AddWorker(func(cancel rt.Signal, _ *rt.Message) {
+		cacheRD, sz, err := bot.Download(c.Cache(), func(cacheWR rt.CacheWriter) error {
+			if len(data) != 0 {
+				_, err2 := io.Copy(cacheWR, base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+				return err2
+			}
+
+			mc.logger.D("download attachment", log.String("url", fileURL))
+
+			req, err2 := http.NewRequestWithContext(c.Context(), http.MethodGet, fileURL, nil)
+			if err2 != nil {
+				return err2
+			}
+
+			resp, err2 := c.client.Do(req)
+			if err2 != nil {
+				return err2
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected response status %q", resp.Status)
+			}
+
+			_, err2 = io.Copy(cacheWR, resp.Body)
+			return err2
+		})
+		if err != nil {
+			mc.logger.I("failed to get attachment", log.Error(err))
+			c.sendErrorf(mc, "unable to get attachment: %v", err)
+			return
+		}
+
+		filename := mediaSpan.Filename
+		if len(filename) == 0 {
+			filename = cacheRD.ID().String()
+		}
+
+		mc.logger.D("upload file",
+			log.String("filename", filename),
+			rt.LogCacheID(cacheRD.ID()),
+			log.Int64("size", sz),
+		)
+
+		sout, err := bot.Upload(&con, wf.Storage, filename, sz, cacheRD, mediaSpan.ContentType)
+		if err != nil {
+			mc.logger.I("failed to upload file", log.Error(err))
+			c.sendErrorf(mc, "unable to upload file: %v", err)
+			return
+		}
+
+		mediaSpan.Size = sz
+		mediaSpan.URL = sout.URL
+		mediaSpan.Data = cacheRD
+	})
+}
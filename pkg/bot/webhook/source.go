@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/stringhelper"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// hashID generates a stable uint64 id for ids in envelopes
+func hashID(id string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(stringhelper.ToBytes[byte, byte](id))
+	return h.Sum64()
+}
+
+func userIDOf(id string) rt.UserID       { return rt.UserID(hashID(id)) }
+func messageIDOf(id string) rt.MessageID { return rt.MessageID(hashID(id)) }
+
+// chatIDWrapper is the chat data stored in session requests
+type chatIDWrapper struct {
+	// id of the group chat, or id of the user for private chat
+	id string
+
+	private bool
+}
+
+func privateChatOf(userID string) chatIDWrapper { return chatIDWrapper{id: userID, private: true} }
+
+func (c chatIDWrapper) ID() rt.ChatID {
+	if c.private {
+		// avoid collision with group chats having the same id
+		return rt.ChatID(hashID("@" + c.id))
+	}
+
+	return rt.ChatID(hashID(c.id))
+}
+
+func (c chatIDWrapper) envelope() Chat { return Chat{ID: c.id, Private: c.private} }
+
+type messageContext struct {
+	con conversationImpl
+
+	chat   chatIDWrapper
+	info   Chat
+	author Author
+
+	msgID   rt.MessageID
+	replyTo rt.MessageID
+
+	// text is the plain text of the message
+	text string
+
+	env *Envelope
+
+	timestamp time.Time
+
+	// out collects messages sent during handling of this message when replying
+	// synchronously
+	out *outbox
+
+	logger log.Interface
+}
+
+// chatName returns the chat name for display
+func (mc *messageContext) ChatName() string {
+	if len(mc.info.Name) != 0 {
+		return mc.info.Name
+	}
+
+	return mc.chat.id
+}
+
+// maxIDs is the max number of message ids kept for reverse lookup
+const maxIDs = 1024
+
+// idRegistry maps hashed message ids back to ids in envelopes
+type idRegistry struct {
+	mu    sync.Mutex
+	order []rt.MessageID
+	ids   map[rt.MessageID]string
+}
+
+func (r *idRegistry) add(msgID rt.MessageID, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ids == nil {
+		r.ids = make(map[rt.MessageID]string)
+	}
+
+	r.ids[msgID] = id
+	r.order = append(r.order, msgID)
+	if len(r.order) > maxIDs {
+		delete(r.ids, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+func (r *idRegistry) get(msgID rt.MessageID) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ids[msgID]
+}
@@ -0,0 +1,251 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"arhat.dev/mbot/pkg/bot"
+	bottest "arhat.dev/mbot/pkg/bot/test"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+const testSecret = "secret"
+
+func TestSpans(t *testing.T) {
+	spans := spansFromEnvelope([]Span{
+		{Text: "a "},
+		{Text: "bold", Styles: []string{"bold", "unknown"}},
+		{Text: "link", Styles: []string{"url"}, URL: "https://example.com"},
+	})
+
+	assert.EqualValues(t, []rt.Span{
+		{Text: "a "},
+		{Flags: rt.SpanFlag_Bold, Text: "bold"},
+		{Flags: rt.SpanFlag_URL, Text: "link", URL: "https://example.com"},
+	}, spans)
+
+	spans = append(spans, rt.Span{
+		Flags:            rt.SpanFlag_Image,
+		URL:              "fake://a.png",
+		SpanMediaOptions: rt.SpanMediaOptions{Filename: "a.png"},
+	})
+
+	assert.EqualValues(t, []Span{
+		{Text: "a "},
+		{Text: "bold", Styles: []string{"bold"}},
+		{Text: "link", Styles: []string{"url"}, URL: "https://example.com"},
+		{Text: "a.png", Styles: []string{"url"}, URL: "fake://a.png"},
+	}, spansToEnvelope(spans))
+}
+
+func signature(body []byte) string {
+	h := hmac.New(sha256.New, []byte(testSecret))
+	_, _ = h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+func webhookRequest(t *testing.T, env *Envelope) *http.Request {
+	body, err := json.Marshal(env)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	req.Header.Set(SignatureHeader, signature(body))
+	return req
+}
+
+func newTestBot(t *testing.T, ctx context.Context, pub *bottest.Publisher, callback string) (*webhookBot, *http.ServeMux) {
+	cache, err := rt.NewCache(t.TempDir())
+	require.NoError(t, err)
+
+	config := &Config{
+		CommonConfig: bottest.CommonConfig(true, true),
+
+		Secret:   testSecret,
+		Callback: CallbackConfig{URL: callback},
+	}
+
+	b, err := config.Create(rt.NewContext(ctx, log.NoOpLogger, cache), bottest.NewCreationContext(pub))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	require.NoError(t, b.Configure())
+	require.NoError(t, b.Start("", mux))
+
+	return b.(*webhookBot), mux
+}
+
+func TestBot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pub := &bottest.Publisher{}
+	b, mux := newTestBot(t, ctx, pub, "")
+
+	alice := Author{ID: "alice", Admin: true}
+	bob := Author{ID: "bob"}
+	chat := Chat{ID: "dev", Name: "Dev"}
+
+	send := func(env *Envelope) []OutgoingMessage {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, webhookRequest(t, env))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.Messages
+	}
+
+	t.Run("Verify", func(t *testing.T) {
+		body := []byte(`{"chat":{"id":"dev"},"author":{"id":"alice"}}`)
+
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set(SignatureHeader, "sha256=00")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		req = httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testSecret)
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"messages":[]}`, rec.Body.String())
+
+		req = httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader([]byte(`{"chat":{"id":"dev"}}`)))
+		req.Header.Set("Authorization", "Bearer "+testSecret)
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		msgs := send(&Envelope{ID: "1", Chat: chat, Author: bob, Text: "/new topic"})
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "Only admins can use this bot in group chat.", msgs[0].Text)
+		assert.Equal(t, "1", msgs[0].ReplyTo)
+		assert.Equal(t, Chat{ID: "dev"}, msgs[0].Chat)
+
+		msgs = send(&Envelope{ID: "2", Chat: chat, Author: alice, Text: "/new topic"})
+		require.NotEmpty(t, msgs)
+		assert.Contains(t, msgs[len(msgs)-1].Text, "created topic")
+
+		send(&Envelope{ID: "3", Chat: chat, Author: alice, Text: "**hi** #tag"})
+		send(&Envelope{
+			ID: "4", Chat: chat, Author: alice, Text: "shot",
+			Attachments: []Attachment{{
+				Type:     "image",
+				Filename: "shot.png",
+				Data:     base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n")),
+			}},
+		})
+		send(&Envelope{ID: "5", Chat: chat, Author: bob, Text: "not relevant"})
+
+		msgs = send(&Envelope{ID: "6", Chat: chat, Author: alice, ReplyTo: "5", Text: "/ignore"})
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "Ignored.", msgs[0].Text)
+
+		msgs = send(&Envelope{ID: "7", Chat: chat, Author: alice, Text: "/end"})
+		require.NotEmpty(t, msgs)
+		assert.Contains(t, msgs[len(msgs)-1].Text, "published")
+
+		assert.EqualValues(t, []string{
+			"topic" +
+				"alice: hi #tag\n" +
+				"alice: shot\n",
+		}, pub.Posts())
+	})
+
+	t.Run("Click", func(t *testing.T) {
+		clicked := make(chan struct{}, 1)
+
+		con := &conversationImpl{bot: b, chat: chatIDWrapper{id: "dev"}}
+
+		// collect the message as if sent in a webhook request
+		out := &outbox{}
+		b.mu.Lock()
+		b.current = out
+		b.mu.Unlock()
+
+		_, err := con.SendMessage(ctx, rt.SendMessageOptions{
+			Body: []rt.Span{{Text: "choose"}},
+			Callbacks: [][]rt.MessageCallbackSpec{{
+				{Text: "ok", OnClick: rt.NewOptionalValue(func() error {
+					clicked <- struct{}{}
+					return nil
+				})},
+			}},
+		})
+		require.NoError(t, err)
+
+		b.mu.Lock()
+		b.current = nil
+		b.mu.Unlock()
+
+		require.Len(t, out.msgs, 1)
+		require.Len(t, out.msgs[0].Buttons, 1)
+		id := out.msgs[0].Buttons[0][0].ID
+		assert.Len(t, id, 2*bot.DefaultCallbackIDSize)
+
+		assert.Empty(t, send(&Envelope{Chat: chat, Author: bob, Click: id}))
+		select {
+		case <-clicked:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "callback not called")
+		}
+
+		msgs := send(&Envelope{Chat: chat, Author: bob, Click: "cb-0"})
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "The button has expired.", msgs[0].Text)
+	})
+}
+
+func TestBotCallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan OutgoingMessage, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if !assert.NoError(t, err) || !assert.Equal(t, signature(body), r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var msg OutgoingMessage
+		assert.NoError(t, json.Unmarshal(body, &msg))
+		received <- msg
+	}))
+	defer srv.Close()
+
+	_, mux := newTestBot(t, ctx, &bottest.Publisher{}, srv.URL)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, webhookRequest(t, &Envelope{
+		Chat:   Chat{ID: "alice", Private: true},
+		Author: Author{ID: "alice"},
+		Text:   "/help",
+	}))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, Chat{ID: "alice", Private: true}, msg.Chat)
+		assert.NotEmpty(t, msg.Markdown)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "callback not received")
+	}
+}
@@ -21,6 +21,9 @@ type WorkflowConfig struct {
 	AdminOnly     *bool `yaml:"adminOnly"`
 	DownloadMedia bool  `yaml:"downloadMedia"`
 
+	// KeepEditHistory keeps previous versions of edited messages
+	KeepEditHistory bool `yaml:"keepEditHistory"`
+
 	// Storage config name
 	Storage string `yaml:"storage"`
 
@@ -29,6 +32,39 @@ type WorkflowConfig struct {
 
 	// Publisher config name
 	Publisher string `yaml:"publisher"`
+
+	// Scope limits where the workflow is available, unlimited when empty
+	Scope WorkflowScope `yaml:"scope"`
+}
+
+// WorkflowScope of chats and users, chats and users are platform specific
+// references (e.g. id or username)
+//
+// workflow with scope is not available on platforms not supporting it
+type WorkflowScope struct {
+	rs.BaseField
+
+	// Chats where all members can use the workflow
+	Chats []string `yaml:"chats"`
+
+	// ChatAdmins are chats where only admins can use the workflow
+	ChatAdmins []string `yaml:"chatAdmins"`
+
+	// Users can use the workflow in the chat, or in private chat with the bot
+	// when the chat is not set
+	Users []ScopedUser `yaml:"users"`
+}
+
+type ScopedUser struct {
+	rs.BaseField
+
+	Chat string `yaml:"chat"`
+	User string `yaml:"user"`
+}
+
+// IsEmpty returns true when there is no limit
+func (s *WorkflowScope) IsEmpty() bool {
+	return len(s.Chats) == 0 && len(s.ChatAdmins) == 0 && len(s.Users) == 0
 }
 
 func (c *WorkflowConfig) Resolve(bctx *CreationContext) (ret Workflow, err error) {
@@ -68,6 +104,8 @@ func (c *WorkflowConfig) Resolve(bctx *CreationContext) (ret Workflow, err error
 
 		adminOnly:     true,
 		downloadMedia: c.DownloadMedia,
+		keepEdits:     c.KeepEditHistory,
+		scope:         c.Scope,
 		Storage:       st,
 		Generator:     gn,
 
@@ -105,14 +143,26 @@ type Workflow struct {
 	Generator generator.Interface
 
 	downloadMedia bool
+	keepEdits     bool
 	adminOnly     bool
+	scope         WorkflowScope
 	pbName        string
 	pbFactoryFunc PublisherFactoryFunc
 }
 
 func (c *Workflow) DownloadMedia() bool   { return c.downloadMedia }
+func (c *Workflow) KeepEditHistory() bool { return c.keepEdits }
 func (c *Workflow) RequireAdmin() bool    { return c.adminOnly }
 func (c *Workflow) PublisherName() string { return c.pbName }
+
+// Scope returns where the workflow is available, nil when unlimited
+func (c *Workflow) Scope() *WorkflowScope {
+	if c.scope.IsEmpty() {
+		return nil
+	}
+
+	return &c.scope
+}
 func (c *Workflow) CreatePublisher() (publisher.Interface, publisher.User, error) {
 	return c.pbFactoryFunc()
 }
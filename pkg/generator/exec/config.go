@@ -1,8 +1,15 @@
 package exec
 
 import (
-	"arhat.dev/mbot/pkg/generator"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"arhat.dev/pkg/log"
 	"arhat.dev/rs"
+
+	"arhat.dev/mbot/pkg/generator"
 )
 
 const (
@@ -24,9 +31,59 @@ type Config struct {
 
 	// Args
 	Args []string `yaml:"args"`
+
+	// Env is set in addition to the environment of the bot
+	Env map[string]string `yaml:"env"`
+
+	// Timeout of each call to the executable, defaults to 5m
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Calls handled by the executable, one of [new, continue, peek, generate]
+	//
+	// defaults to all calls, the executable is not run for other calls
+	Calls []string `yaml:"calls"`
 }
 
 // Create implements generator.Config
-func (*Config) Create() (generator.Interface, error) {
-	return &Driver{}, nil
+func (c *Config) Create() (generator.Interface, error) {
+	if len(c.Executable) == 0 {
+		return nil, fmt.Errorf("no executable specified")
+	}
+
+	d := &Driver{
+		workdir:    c.WorkDir,
+		executable: c.Executable,
+		args:       c.Args,
+		env:        os.Environ(),
+		timeout:    c.Timeout,
+		logger:     log.Log.WithName(Name),
+	}
+
+	if d.timeout == 0 {
+		d.timeout = 5 * time.Minute
+	}
+
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		d.env = append(d.env, k+"="+c.Env[k])
+	}
+
+	if len(c.Calls) != 0 {
+		d.calls = make(map[Call]struct{}, len(c.Calls))
+		for _, call := range c.Calls {
+			switch v := Call(call); v {
+			case Call_New, Call_Continue, Call_Peek, Call_Generate:
+				d.calls[v] = struct{}{}
+			default:
+				return nil, fmt.Errorf("unknown call %q", call)
+			}
+		}
+	}
+
+	return d, nil
 }
@@ -1,31 +1,177 @@
 // Package exec implements a generator generating content by running local executable
+//
+// the executable is run for each call to the generator, with Request written
+// to its stdin, and Response read from its stdout, both encoded as json
 package exec
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"arhat.dev/pkg/log"
+
 	"arhat.dev/mbot/pkg/generator"
 	"arhat.dev/mbot/pkg/rt"
 )
 
 var _ generator.Interface = (*Driver)(nil)
 
-type Driver struct{}
+type Driver struct {
+	workdir    string
+	executable string
+	args       []string
+	env        []string
+	timeout    time.Duration
+
+	// calls handled by the executable, nil for all calls
+	calls map[Call]struct{}
+
+	logger log.Interface
+}
 
 // New implements generator.Interface
-func (*Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, Call_New, in)
 }
 
 // Continue implements generator.Interface
-func (*Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, Call_Continue, in)
 }
 
 // Generate implements generator.Interface
-func (*Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, Call_Generate, in)
 }
 
 // Peek implements generator.Interface
-func (*Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+func (d *Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, Call_Peek, in)
+}
+
+func (d *Driver) call(con rt.Conversation, call Call, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	if d.calls != nil {
+		if _, ok := d.calls[call]; !ok {
+			return
+		}
+	}
+
+	req := Request{
+		Version:  ProtocolVersion,
+		Call:     call,
+		Cmd:      in.Cmd,
+		Params:   in.Params,
+		Messages: make([]Message, len(in.Messages)),
+	}
+
+	for i, m := range in.Messages {
+		req.Messages[i] = NewMessage(m)
+	}
+
+	input, err := json.Marshal(&req)
+	if err != nil {
+		err = fmt.Errorf("encode request: %w", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(con.Context(), d.timeout)
+	defer cancel()
+
+	var (
+		stdout bytes.Buffer
+		stderr = NewLineWriter(func(line string) {
+			d.logger.I("executable stderr", log.String("call", string(call)), log.String("line", line))
+		})
+	)
+
+	cmd := exec.CommandContext(ctx, d.executable, d.args...)
+	cmd.Dir = d.workdir
+	cmd.Env = d.env
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	stderr.Flush()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%s: timed out after %v", call, d.timeout)
+		} else {
+			err = fmt.Errorf("%s: %w", call, err)
+		}
+
+		return
+	}
+
+	out, err = DecodeResponse(stdout.Bytes(), d.workdir)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+	}
+
 	return
 }
+
+// NewLineWriter creates a LineWriter calling do with each line
+func NewLineWriter(do func(line string)) *LineWriter {
+	return &LineWriter{do: do}
+}
+
+// LineWriter calls do with each line written to it
+type LineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+
+	do func(line string)
+}
+
+// maxLineSize is the max size of a line before it's passed to do
+const maxLineSize = 4096
+
+// Write implements io.Writer
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			if len(w.buf) < maxLineSize {
+				break
+			}
+
+			i = maxLineSize
+		}
+
+		w.emit(w.buf[:i])
+		if i < len(w.buf) && w.buf[i] == '\n' {
+			i++
+		}
+
+		w.buf = w.buf[:copy(w.buf, w.buf[i:])]
+	}
+
+	return len(p), nil
+}
+
+// Flush passes the last line without newline to do
+func (w *LineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.emit(w.buf)
+	w.buf = w.buf[:0]
+}
+
+func (w *LineWriter) emit(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) != 0 {
+		w.do(string(line))
+	}
+}
@@ -0,0 +1,291 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/rt"
+	rttest "arhat.dev/mbot/pkg/rt/test"
+)
+
+// TestHelperProcess is the executable run by tests
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("MBOT_EXEC_TEST_HELPER") != "1" {
+		return
+	}
+
+	var req Request
+	err := json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fmt.Fprintf(os.Stderr, "called %s\nno newline", req.Call)
+
+	switch req.Params {
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "fail":
+		os.Exit(1)
+	case "bad version":
+		fmt.Print(`{"version": 2}`)
+		os.Exit(0)
+	case "empty":
+		os.Exit(0)
+	}
+
+	data := fmt.Sprintf("%d %s %s %s %s", req.Version, req.Call, req.Cmd, req.Params, os.Getenv("FOO"))
+	_ = json.NewEncoder(os.Stdout).Encode(&Response{
+		Version:  ProtocolVersion,
+		Data:     &data,
+		Messages: req.Messages,
+		Other: []Response{{
+			Messages: []Message{{
+				ID:    1,
+				Spans: []Span{{Flags: []string{"file"}, File: "out.txt"}},
+			}},
+		}},
+	})
+
+	os.Exit(0)
+}
+
+func TestDriver(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "out.txt"), []byte("hello"), 0600))
+
+	f, err := os.Open(filepath.Join(dir, "out.txt"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ts := time.Unix(100, 0).UTC()
+	in := &rt.GeneratorInput{
+		Cmd:    "/new",
+		Params: "foo",
+		Messages: []*rt.Message{{
+			ID:        10,
+			Flags:     rt.MessageFlag_Private | rt.MessageFlag_Album,
+			Author:    "alice",
+			Timestamp: ts,
+			Text:      "hi",
+			Spans: []rt.Span{
+				{Flags: rt.SpanFlag_Bold | rt.SpanFlag_URL, Text: "hi", URL: "https://example.com"},
+				{Flags: rt.SpanFlag_Image},
+			},
+		}},
+	}
+	in.Messages[0].Spans[1].Data = mediaFile{File: f}
+	in.Messages[0].Spans[1].Size = 5
+	in.Messages[0].Spans[1].ContentType = "image/png"
+	in.Messages[0].Spans[1].Duration = 1500 * time.Millisecond
+	defer in.Messages[0].Dispose()
+
+	newDriver := func(calls ...string) *Driver {
+		cfg := &Config{
+			WorkDir:    dir,
+			Executable: os.Args[0],
+			Args:       []string{"-test.run=TestHelperProcess", "--"},
+			Env:        map[string]string{"MBOT_EXEC_TEST_HELPER": "1", "FOO": "bar"},
+			Timeout:    time.Minute,
+			Calls:      calls,
+		}
+
+		impl, err := cfg.Create()
+		assert.NoError(t, err)
+		return impl.(*Driver)
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+
+	d := newDriver()
+	out, err := d.New(con, in)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "1 new /new foo bar", out.Data.Get())
+	if assert.Len(t, out.Messages, 1) {
+		m := out.Messages[0]
+		defer m.Dispose()
+
+		assert.Equal(t, rt.MessageID(10), m.ID)
+		assert.True(t, m.IsPrivate())
+		assert.True(t, m.IsAlbum())
+		assert.False(t, m.IsForwarded())
+		assert.Equal(t, "alice", m.Author)
+		assert.Equal(t, ts, m.Timestamp)
+		assert.False(t, m.IsEdited())
+
+		if assert.Len(t, m.Spans, 2) {
+			assert.Equal(t, in.Messages[0].Spans[0], m.Spans[0])
+
+			media := m.Spans[1]
+			assert.True(t, media.IsImage())
+			assert.Equal(t, "image/png", media.ContentType)
+			assert.Equal(t, "out.txt", media.Filename)
+			assert.EqualValues(t, 5, media.Size)
+			assert.Equal(t, 1500*time.Millisecond, media.Duration)
+
+			data, err := io.ReadAll(media.Data)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(data))
+		}
+	}
+
+	if assert.Len(t, out.Other, 1) && assert.Len(t, out.Other[0].Messages, 1) {
+		m := out.Other[0].Messages[0]
+		defer m.Dispose()
+
+		if assert.Len(t, m.Spans, 1) {
+			assert.True(t, m.Spans[0].IsFile())
+			assert.EqualValues(t, 5, m.Spans[0].Size)
+			assert.Equal(t, "application/octet-stream", m.Spans[0].ContentType)
+		}
+	}
+
+	in.Params = "empty"
+	out, err = d.Generate(con, in)
+	assert.NoError(t, err)
+	assert.True(t, out.Data.IsNil())
+	assert.Empty(t, out.Messages)
+
+	for _, params := range []string{"fail", "bad version"} {
+		in.Params = params
+		_, err = d.Peek(con, in)
+		assert.Error(t, err, params)
+	}
+
+	// the helper process sleeps longer than the timeout
+	in.Params = "sleep"
+	d.timeout = time.Second
+	_, err = d.Peek(con, in)
+	assert.ErrorContains(t, err, "timed out")
+
+	// not handled by the executable
+	in.Params = "fail"
+	out, err = newDriver("new").Continue(con, in)
+	assert.NoError(t, err)
+	assert.True(t, out.Data.IsNil())
+
+	_, err = (&Config{Executable: "foo", Calls: []string{"bar"}}).Create()
+	assert.Error(t, err)
+}
+
+func TestDecodeResponse(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data string
+		err  bool
+	}{
+		{name: "Empty", data: " \n"},
+		{name: "Invalid", data: "foo", err: true},
+		{name: "Unknown Message Flag", data: `{"messages": [{"flags": ["foo"]}]}`, err: true},
+		{name: "Unknown Span Flag", data: `{"messages": [{"spans": [{"flags": ["foo"]}]}]}`, err: true},
+		{name: "Missing File", data: `{"messages": [{"spans": [{"file": "not-exists"}]}]}`, err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeResponse([]byte(test.data), t.TempDir())
+			if test.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	out, err := DecodeResponse([]byte(`{"messages": [{"spans": [{"text": "a"}, {"flags": ["code"], "text": "b"}]}]}`), "")
+	if assert.NoError(t, err) && assert.Len(t, out.Messages, 1) {
+		assert.Equal(t, "ab", out.Messages[0].Text)
+	}
+}
+
+func TestResponseConfineFiles(t *testing.T) {
+	for _, test := range []struct {
+		file     string
+		expected string
+		err      bool
+	}{
+		{file: "out.txt", expected: filepath.Join("dir", "out.txt")},
+		{file: "foo/../out.txt", expected: filepath.Join("dir", "out.txt")},
+		{file: "/etc/hostname", err: true},
+		{file: "..", err: true},
+		{file: "../out.txt", err: true},
+		{file: "foo/../../out.txt", err: true},
+		{file: "/cache/1", expected: "/cache/1"},
+	} {
+		t.Run(test.file, func(t *testing.T) {
+			resp := Response{Other: []Response{{
+				Messages: []Message{{Spans: []Span{{Caption: []Span{{File: test.file}}}}}},
+			}}}
+
+			err := resp.ConfineFiles("dir", &Request{
+				Messages: []Message{{Spans: []Span{{Caption: []Span{{File: "/cache/1"}}}}}},
+			})
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, resp.Other[0].Messages[0].Spans[0].Caption[0].File)
+		})
+	}
+
+	resp := Response{Messages: []Message{{Spans: []Span{{File: "out.txt"}}}}}
+	assert.ErrorContains(t, resp.ConfineFiles("", nil), "no workdir")
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := NewLineWriter(func(line string) { lines = append(lines, line) })
+
+	_, _ = w.Write([]byte("foo\nba"))
+	_, _ = w.Write([]byte("r\r\n\n"))
+	_, _ = w.Write(make([]byte, maxLineSize+1))
+	_, _ = w.Write([]byte("baz"))
+	w.Flush()
+
+	assert.Equal(t, []string{"foo", "bar", string(make([]byte, maxLineSize)), "\x00baz"}, lines)
+}
+
+func TestScriptMessageIDs(t *testing.T) {
+	data, err := EncodeScriptRequest(&Request{
+		Messages: []Message{{ID: math.MaxUint64, ReplyTo: 1<<53 + 1}, {ID: 1}},
+	})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(data), `"id":"18446744073709551615","replyTo":"9007199254740993"`)
+		assert.Contains(t, string(data), `"id":"1"`)
+		assert.NotContains(t, string(data), `"replyTo":"0"`)
+	}
+
+	resp, err := DecodeScriptResponse([]byte(`{"messages": [{"id": "18446744073709551615", "replyTo": 2}], "other": [{"messages": [{"id": "9007199254740993"}]}]}`))
+	if assert.NoError(t, err) && assert.Len(t, resp.Messages, 1) && assert.Len(t, resp.Other, 1) {
+		assert.EqualValues(t, uint64(math.MaxUint64), resp.Messages[0].ID)
+		assert.EqualValues(t, 2, resp.Messages[0].ReplyTo)
+		assert.EqualValues(t, 1<<53+1, resp.Other[0].Messages[0].ID)
+	}
+
+	for _, data := range []string{
+		`{"messages": [{"id": 18446744073709552000}]}`,
+		`{"messages": [{"id": "-1"}]}`,
+		`{"messages": [{"id": 1.5}]}`,
+	} {
+		_, err = DecodeScriptResponse([]byte(data))
+		assert.Error(t, err, data)
+	}
+
+	resp, err = DecodeScriptResponse([]byte(" \n"))
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Messages)
+}
@@ -0,0 +1,575 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/h2non/filetype"
+
+	"arhat.dev/mbot/pkg/rt"
+)
+
+// ProtocolVersion is the version of Request and Response
+const ProtocolVersion = 1
+
+// Call is the method of the generator called
+type Call string
+
+// nolint:revive
+const (
+	Call_New      Call = "new"
+	Call_Continue Call = "continue"
+	Call_Peek     Call = "peek"
+	Call_Generate Call = "generate"
+)
+
+// Request is written to the stdin of the executable as json
+type Request struct {
+	Version int    `json:"version"`
+	Call    Call   `json:"call"`
+	Cmd     string `json:"cmd"`
+	Params  string `json:"params"`
+
+	Messages []Message `json:"messages"`
+}
+
+// Response is read from the stdout of the executable as json
+//
+// empty stdout is the same as an empty response
+type Response struct {
+	// Version of the protocol, the current version is assumed when not set
+	Version int `json:"version,omitempty"`
+
+	Data     *string    `json:"data,omitempty"`
+	Messages []Message  `json:"messages,omitempty"`
+	Other    []Response `json:"other,omitempty"`
+}
+
+// Message is the json form of rt.Message
+type Message struct {
+	ID      uint64 `json:"id"`
+	ReplyTo uint64 `json:"replyTo,omitempty"`
+
+	// Flags of the message, any of [private, forwarded, reply, album]
+	Flags []string `json:"flags,omitempty"`
+
+	MessageLink string `json:"messageLink,omitempty"`
+	ChatName    string `json:"chatName,omitempty"`
+	ChatLink    string `json:"chatLink,omitempty"`
+	Author      string `json:"author,omitempty"`
+	AuthorLink  string `json:"authorLink,omitempty"`
+
+	OriginalChatName    string `json:"originalChatName,omitempty"`
+	OriginalChatLink    string `json:"originalChatLink,omitempty"`
+	OriginalAuthor      string `json:"originalAuthor,omitempty"`
+	OriginalAuthorLink  string `json:"originalAuthorLink,omitempty"`
+	OriginalMessageLink string `json:"originalMessageLink,omitempty"`
+
+	Timestamp     *time.Time `json:"timestamp,omitempty"`
+	EditTimestamp *time.Time `json:"editTimestamp,omitempty"`
+
+	Text  string `json:"text,omitempty"`
+	Spans []Span `json:"spans,omitempty"`
+}
+
+// Span is the json form of rt.Span
+type Span struct {
+	// Flags of the span, any of [bold, italic, strikethrough, underline, pre,
+	// code, blockquote, email, phoneNumber, url, mention, hashtag, image,
+	// video, audio, voice, file], plain text when empty
+	Flags []string `json:"flags,omitempty"`
+
+	Text                    string `json:"text,omitempty"`
+	Hint                    string `json:"hint,omitempty"`
+	URL                     string `json:"url,omitempty"`
+	WebArchiveURL           string `json:"webArchiveURL,omitempty"`
+	WebArchiveScreenshotURL string `json:"webArchiveScreenshotURL,omitempty"`
+
+	Caption  []Span `json:"caption,omitempty"`
+	Filename string `json:"filename,omitempty"`
+
+	// File is the path to the media data
+	//
+	// in requests, it's the absolute path to the cache file, in responses,
+	// relative paths are resolved against the workdir
+	File string `json:"file,omitempty"`
+
+	// Size of the media data, size of File is used when not set in responses
+	Size int64 `json:"size,omitempty"`
+
+	// ContentType of the media data, detected from File when not set in
+	// responses
+	ContentType string `json:"contentType,omitempty"`
+
+	// Duration of video/audio/voice in seconds
+	Duration float64 `json:"duration,omitempty"`
+}
+
+var messageFlags = []struct {
+	name string
+	flag rt.MessageFlag
+}{
+	{"private", rt.MessageFlag_Private},
+	{"forwarded", rt.MessageFlag_Forwarded},
+	{"reply", rt.MessageFlag_Reply},
+	{"album", rt.MessageFlag_Album},
+}
+
+var spanFlags = []struct {
+	name string
+	flag rt.SpanFlag
+}{
+	{"bold", rt.SpanFlag_Bold},
+	{"italic", rt.SpanFlag_Italic},
+	{"strikethrough", rt.SpanFlag_Strikethrough},
+	{"underline", rt.SpanFlag_Underline},
+	{"pre", rt.SpanFlag_Pre},
+	{"code", rt.SpanFlag_Code},
+	{"blockquote", rt.SpanFlag_Blockquote},
+	{"email", rt.SpanFlag_Email},
+	{"phoneNumber", rt.SpanFlag_PhoneNumber},
+	{"url", rt.SpanFlag_URL},
+	{"mention", rt.SpanFlag_Mention},
+	{"hashtag", rt.SpanFlag_HashTag},
+	{"image", rt.SpanFlag_Image},
+	{"video", rt.SpanFlag_Video},
+	{"audio", rt.SpanFlag_Audio},
+	{"voice", rt.SpanFlag_Voice},
+	{"file", rt.SpanFlag_File},
+}
+
+// NewMessage converts rt.Message to Message
+func NewMessage(m *rt.Message) (ret Message) {
+	ret = Message{
+		ID:      uint64(m.ID),
+		ReplyTo: uint64(m.ReplyTo),
+
+		MessageLink: m.MessageLink,
+		ChatName:    m.ChatName,
+		ChatLink:    m.ChatLink,
+		Author:      m.Author,
+		AuthorLink:  m.AuthorLink,
+
+		OriginalChatName:    m.OriginalChatName,
+		OriginalChatLink:    m.OriginalChatLink,
+		OriginalAuthor:      m.OriginalAuthor,
+		OriginalAuthorLink:  m.OriginalAuthorLink,
+		OriginalMessageLink: m.OriginalMessageLink,
+
+		Text:  m.Text,
+		Spans: newSpans(m.Spans),
+	}
+
+	for _, f := range messageFlags {
+		if m.Flags&f.flag != 0 {
+			ret.Flags = append(ret.Flags, f.name)
+		}
+	}
+
+	if !m.Timestamp.IsZero() {
+		ts := m.Timestamp
+		ret.Timestamp = &ts
+	}
+
+	if m.IsEdited() {
+		ts := m.EditTimestamp
+		ret.EditTimestamp = &ts
+	}
+
+	return
+}
+
+func newSpans(spans []rt.Span) []Span {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	ret := make([]Span, len(spans))
+	for i := range spans {
+		s := &spans[i]
+
+		ret[i] = Span{
+			Text:                    s.Text,
+			Hint:                    s.Hint,
+			URL:                     s.URL,
+			WebArchiveURL:           s.WebArchiveURL,
+			WebArchiveScreenshotURL: s.WebArchiveScreenshotURL,
+
+			Caption:     newSpans(s.Caption),
+			Filename:    s.Filename,
+			Size:        s.Size,
+			ContentType: s.ContentType,
+			Duration:    s.Duration.Seconds(),
+		}
+
+		for _, f := range spanFlags {
+			if s.Flags&f.flag != 0 {
+				ret[i].Flags = append(ret[i].Flags, f.name)
+			}
+		}
+
+		if s.Data != nil {
+			ret[i].File = cacheFilePath(s.Data)
+		}
+	}
+
+	return ret
+}
+
+// cacheFilePath returns the absolute path to the cache file, empty if the
+// cache is not a local file
+func cacheFilePath(r rt.CacheReader) string {
+	f, ok := r.(interface{ Name() string })
+	if !ok {
+		return ""
+	}
+
+	path, err := filepath.Abs(f.Name())
+	if err != nil {
+		return ""
+	}
+
+	return path
+}
+
+// DecodeResponse decodes the response in stdout of the executable
+//
+// media files referenced in the response are opened, relative paths are
+// resolved against dir
+func DecodeResponse(data []byte, dir string) (out rt.GeneratorOutput, err error) {
+	var resp Response
+	data = bytes.TrimSpace(data)
+	if len(data) != 0 {
+		err = json.Unmarshal(data, &resp)
+		if err != nil {
+			return out, fmt.Errorf("invalid response: %w", err)
+		}
+	}
+
+	return resp.Output(dir)
+}
+
+// Output converts the response to generator output
+//
+// media files referenced in the response are opened, relative paths are
+// resolved against dir
+func (r *Response) Output(dir string) (out rt.GeneratorOutput, err error) {
+	if r.Version != 0 && r.Version != ProtocolVersion {
+		return out, fmt.Errorf("unsupported protocol version %d", r.Version)
+	}
+
+	err = r.convert(&out, dir)
+	if err != nil {
+		disposeOutput(&out)
+		return rt.GeneratorOutput{}, err
+	}
+
+	return
+}
+
+// ConfineFiles resolves paths of media files in the response against dir,
+// for scripts not allowed to read arbitrary files, absolute paths and paths
+// outside dir are rejected unless they are files of input messages in req
+func (r *Response) ConfineFiles(dir string, req *Request) error {
+	inputs := make(map[string]struct{})
+	if req != nil {
+		for i := range req.Messages {
+			collectFiles(req.Messages[i].Spans, inputs)
+		}
+	}
+
+	return r.confineFiles(dir, inputs)
+}
+
+func collectFiles(spans []Span, files map[string]struct{}) {
+	for i := range spans {
+		if len(spans[i].File) != 0 {
+			files[spans[i].File] = struct{}{}
+		}
+
+		collectFiles(spans[i].Caption, files)
+	}
+}
+
+func (r *Response) confineFiles(dir string, inputs map[string]struct{}) error {
+	for i := range r.Messages {
+		err := confineFiles(r.Messages[i].Spans, dir, inputs)
+		if err != nil {
+			return fmt.Errorf("message #%d: %w", i, err)
+		}
+	}
+
+	for i := range r.Other {
+		err := r.Other[i].confineFiles(dir, inputs)
+		if err != nil {
+			return fmt.Errorf("other #%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func confineFiles(spans []Span, dir string, inputs map[string]struct{}) error {
+	for i := range spans {
+		s := &spans[i]
+
+		err := confineFiles(s.Caption, dir, inputs)
+		if err != nil {
+			return err
+		}
+
+		if len(s.File) == 0 {
+			continue
+		}
+
+		if _, ok := inputs[s.File]; ok {
+			continue
+		}
+
+		if len(dir) == 0 {
+			return fmt.Errorf("media file %q: no workdir", s.File)
+		}
+
+		path := filepath.Clean(filepath.FromSlash(s.File))
+		if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("media file %q: not in workdir", s.File)
+		}
+
+		s.File = filepath.Join(dir, path)
+	}
+
+	return nil
+}
+
+func (r *Response) convert(out *rt.GeneratorOutput, dir string) error {
+	if r.Data != nil {
+		out.Data.Set(*r.Data)
+	}
+
+	for i := range r.Messages {
+		m, err := r.Messages[i].convert(dir)
+		if m != nil {
+			out.Messages = append(out.Messages, m)
+		}
+
+		if err != nil {
+			return fmt.Errorf("message #%d: %w", i, err)
+		}
+	}
+
+	for i := range r.Other {
+		out.Other = append(out.Other, rt.GeneratorOutput{})
+		err := r.Other[i].convert(&out.Other[i], dir)
+		if err != nil {
+			return fmt.Errorf("other #%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Message) convert(dir string) (*rt.Message, error) {
+	ret := &rt.Message{
+		ID:      rt.MessageID(m.ID),
+		ReplyTo: rt.MessageID(m.ReplyTo),
+
+		MessageLink: m.MessageLink,
+		ChatName:    m.ChatName,
+		ChatLink:    m.ChatLink,
+		Author:      m.Author,
+		AuthorLink:  m.AuthorLink,
+
+		OriginalChatName:    m.OriginalChatName,
+		OriginalChatLink:    m.OriginalChatLink,
+		OriginalAuthor:      m.OriginalAuthor,
+		OriginalAuthorLink:  m.OriginalAuthorLink,
+		OriginalMessageLink: m.OriginalMessageLink,
+
+		Text: m.Text,
+	}
+
+	for _, name := range m.Flags {
+		found := false
+		for _, f := range messageFlags {
+			if f.name == name {
+				ret.Flags |= f.flag
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unknown message flag %q", name)
+		}
+	}
+
+	if m.Timestamp != nil {
+		ret.Timestamp = *m.Timestamp
+	}
+
+	if m.EditTimestamp != nil {
+		ret.EditTimestamp = *m.EditTimestamp
+	}
+
+	var err error
+	ret.Spans, err = convertSpans(m.Spans, dir)
+	if err != nil {
+		// return opened files for disposal
+		return ret, err
+	}
+
+	if len(ret.Text) == 0 {
+		for i := range ret.Spans {
+			if !ret.Spans[i].IsMedia() {
+				ret.Text += ret.Spans[i].Text
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func convertSpans(spans []Span, dir string) (ret []rt.Span, err error) {
+	if len(spans) == 0 {
+		return nil, nil
+	}
+
+	ret = make([]rt.Span, 0, len(spans))
+	for i := range spans {
+		s := &spans[i]
+
+		span := rt.Span{
+			Text:                    s.Text,
+			Hint:                    s.Hint,
+			URL:                     s.URL,
+			WebArchiveURL:           s.WebArchiveURL,
+			WebArchiveScreenshotURL: s.WebArchiveScreenshotURL,
+		}
+
+		for _, name := range s.Flags {
+			found := false
+			for _, f := range spanFlags {
+				if f.name == name {
+					span.Flags |= f.flag
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return ret, fmt.Errorf("unknown span flag %q", name)
+			}
+		}
+
+		span.Filename = s.Filename
+		span.Size = s.Size
+		span.ContentType = s.ContentType
+		span.Duration = time.Duration(s.Duration * float64(time.Second))
+
+		span.Caption, err = convertSpans(s.Caption, dir)
+		if err != nil {
+			disposeSpans(span.Caption)
+			return ret, err
+		}
+
+		if len(s.File) != 0 {
+			err = openMediaFile(&span, s.File, dir)
+			if err != nil {
+				disposeSpans(span.Caption)
+				return ret, err
+			}
+		}
+
+		ret = append(ret, span)
+	}
+
+	return
+}
+
+func disposeSpans(spans []rt.Span) {
+	m := rt.Message{Spans: spans}
+	m.Dispose()
+}
+
+func disposeOutput(out *rt.GeneratorOutput) {
+	for _, m := range out.Messages {
+		m.Dispose()
+	}
+
+	for i := range out.Other {
+		disposeOutput(&out.Other[i])
+	}
+}
+
+var _ rt.CacheReader = (*mediaFile)(nil)
+
+// mediaFile is a media file generated by the executable
+type mediaFile struct {
+	*os.File
+}
+
+// ID implements rt.CacheReader
+func (f mediaFile) ID() rt.CacheID { return 0 }
+
+// Size implements rt.CacheReader
+func (f mediaFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// openMediaFile opens the file at path as data of the span
+func openMediaFile(span *rt.Span, path, dir string) error {
+	if !filepath.IsAbs(path) && len(dir) != 0 {
+		path = filepath.Join(dir, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open media file: %w", err)
+	}
+
+	data := mediaFile{File: f}
+	if span.Size == 0 {
+		span.Size, err = data.Size()
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("check media file size: %w", err)
+		}
+	}
+
+	if len(span.ContentType) == 0 {
+		var buf [262]byte
+
+		n, _ := f.Read(buf[:])
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("seek media file: %w", err)
+		}
+
+		ft, err := filetype.Match(buf[:n])
+		if err == nil && ft != filetype.Unknown {
+			span.ContentType = ft.MIME.Value
+		} else {
+			// provide default mime type for storage driver
+			span.ContentType = "application/octet-stream"
+		}
+	}
+
+	if len(span.Filename) == 0 {
+		span.Filename = filepath.Base(path)
+	}
+
+	span.Data = data
+	return nil
+}
@@ -0,0 +1,123 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// scripts see message ids as strings, numbers in script languages are float64
+// and can't hold all uint64 ids (e.g. hashed ids)
+
+// EncodeScriptRequest encodes req as json for scripts, message ids are strings
+func EncodeScriptRequest(req *Request) ([]byte, error) {
+	r := scriptRequest{
+		Request:  *req,
+		Messages: newScriptMessages(req.Messages),
+	}
+
+	return json.Marshal(&r)
+}
+
+// DecodeScriptResponse decodes the json response of scripts, message ids can
+// be strings or integers
+//
+// empty data is the same as an empty response
+func DecodeScriptResponse(data []byte) (resp Response, err error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return
+	}
+
+	var r scriptResponse
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return resp, fmt.Errorf("invalid response: %w", err)
+	}
+
+	return r.response(), nil
+}
+
+// scriptID is the message id in string form
+type scriptID uint64
+
+// MarshalJSON implements json.Marshaler
+func (id scriptID) MarshalJSON() ([]byte, error) {
+	return strconv.AppendQuote(nil, strconv.FormatUint(uint64(id), 10)), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (id *scriptID) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+
+	if len(s) != 0 && s[0] == '"' {
+		var err error
+		s, err = strconv.Unquote(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid message id %s", data)
+	}
+
+	*id = scriptID(v)
+	return nil
+}
+
+// scriptMessage overrides ids of Message
+type scriptMessage struct {
+	Message
+
+	ID      scriptID `json:"id"`
+	ReplyTo scriptID `json:"replyTo,omitempty"`
+}
+
+func newScriptMessages(msgs []Message) []scriptMessage {
+	ret := make([]scriptMessage, len(msgs))
+	for i := range msgs {
+		ret[i] = scriptMessage{
+			Message: msgs[i],
+			ID:      scriptID(msgs[i].ID),
+			ReplyTo: scriptID(msgs[i].ReplyTo),
+		}
+	}
+
+	return ret
+}
+
+type scriptRequest struct {
+	Request
+
+	Messages []scriptMessage `json:"messages"`
+}
+
+type scriptResponse struct {
+	Response
+
+	Messages []scriptMessage  `json:"messages,omitempty"`
+	Other    []scriptResponse `json:"other,omitempty"`
+}
+
+func (r *scriptResponse) response() Response {
+	ret := r.Response
+	ret.Messages, ret.Other = nil, nil
+
+	for _, m := range r.Messages {
+		msg := m.Message
+		msg.ID, msg.ReplyTo = uint64(m.ID), uint64(m.ReplyTo)
+		ret.Messages = append(ret.Messages, msg)
+	}
+
+	for i := range r.Other {
+		ret.Other = append(ret.Other, r.Other[i].response())
+	}
+
+	return ret
+}
@@ -34,6 +34,26 @@ func testMessages() []*rt.Message {
 			},
 			ReplyTo: 1,
 		},
+		{ /* album */
+			ID:       3,
+			Flags:    rt.MessageFlag_Album,
+			ChatName: "basic-chat-name",
+			Author:   "basic-author-1",
+			Spans: []rt.Span{
+				{
+					Flags: rt.SpanFlag_PlainText,
+					Text:  "album-caption",
+				},
+				{
+					Flags: rt.SpanFlag_Image,
+					URL:   "https://example.com/1.jpg",
+				},
+				{
+					Flags: rt.SpanFlag_Image,
+					URL:   "https://example.com/2.jpg",
+				},
+			},
+		},
 	}
 }
 
@@ -1,8 +1,14 @@
 package js
 
 import (
-	"arhat.dev/mbot/pkg/generator"
+	"fmt"
+	"os"
+	"time"
+
 	"arhat.dev/rs"
+	"github.com/dop251/goja"
+
+	"arhat.dev/mbot/pkg/generator"
 )
 
 const (
@@ -15,9 +21,55 @@ func init() {
 
 type Config struct {
 	rs.BaseField
+
+	// Script is the inline script
+	Script string `yaml:"script"`
+
+	// ScriptFile is the path to the script file, used when Script is empty
+	ScriptFile string `yaml:"scriptFile"`
+
+	// WorkDir to resolve relative media paths in script output
+	WorkDir string `yaml:"workdir"`
+
+	// Timeout of each call to the script, defaults to 10s
+	Timeout time.Duration `yaml:"timeout"`
 }
 
 // Create implements generator.Config
-func (*Config) Create() (generator.Interface, error) {
-	return &Driver{}, nil
+func (c *Config) Create() (generator.Interface, error) {
+	var (
+		name   = "script.js"
+		script = c.Script
+	)
+
+	if len(script) == 0 {
+		if len(c.ScriptFile) == 0 {
+			return nil, fmt.Errorf("no script specified")
+		}
+
+		data, err := os.ReadFile(c.ScriptFile)
+		if err != nil {
+			return nil, fmt.Errorf("read script file: %w", err)
+		}
+
+		name, script = c.ScriptFile, string(data)
+	}
+
+	prog, err := goja.Compile(name, script, false)
+	if err != nil {
+		return nil, fmt.Errorf("compile script: %w", err)
+	}
+
+	d := &Driver{
+		prog:    prog,
+		workdir: c.WorkDir,
+		timeout: c.Timeout,
+		funcs:   newFuncMap(),
+	}
+
+	if d.timeout == 0 {
+		d.timeout = 10 * time.Second
+	}
+
+	return d, nil
 }
@@ -1,34 +1,184 @@
 // Package js implements a generator for javascript scripting
+//
+// the script exports functions named after generator calls (e.g.
+// `exports.generate = function (input) {...}`), each call runs the script in
+// a new runtime with the compiled program
 package js
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dop251/goja"
+
 	"arhat.dev/mbot/pkg/generator"
+	"arhat.dev/mbot/pkg/generator/exec"
 	"arhat.dev/mbot/pkg/rt"
-	"github.com/dop251/goja"
 )
 
 var _ generator.Interface = (*Driver)(nil)
 
 type Driver struct {
-	goja.Program
+	prog    *goja.Program
+	workdir string
+	timeout time.Duration
+
+	funcs map[string]any
 }
 
 // New implements generator.Interface
-func (*Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_New, in)
 }
 
 // Continue implements generator.Interface
-func (*Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Continue, in)
 }
 
 // Peek implements generator.Interface
-func (*Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Peek, in)
 }
 
 // Generate implements generator.Interface
-func (*Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+func (d *Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Generate, in)
+}
+
+// errTimeout is the value to interrupt the runtime when timed out
+var errTimeout = errors.New("execution timeout")
+
+func (d *Driver) call(con rt.Conversation, call exec.Call, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	// scripts see inputs in the same form as exec generators
+	req := exec.Request{
+		Version:  exec.ProtocolVersion,
+		Call:     call,
+		Cmd:      in.Cmd,
+		Params:   in.Params,
+		Messages: make([]exec.Message, len(in.Messages)),
+	}
+
+	for i, m := range in.Messages {
+		req.Messages[i] = exec.NewMessage(m)
+	}
+
+	data, err := exec.EncodeScriptRequest(&req)
+	if err != nil {
+		err = fmt.Errorf("encode input: %w", err)
+		return
+	}
+
+	vm := goja.New()
+
+	ctx, cancel := context.WithTimeout(con.Context(), d.timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				vm.Interrupt(errTimeout)
+			} else {
+				vm.Interrupt(ctx.Err())
+			}
+		case <-done:
+		}
+	}()
+
+	result, err := d.run(vm, call, string(data))
+	if err != nil {
+		var ierr *goja.InterruptedError
+		if errors.As(err, &ierr) && ierr.Value() == errTimeout {
+			err = fmt.Errorf("%s: timed out after %v", call, d.timeout)
+		} else {
+			err = fmt.Errorf("%s: %w", call, err)
+		}
+
+		return
+	}
+
+	resp, err := exec.DecodeScriptResponse(result)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+		return
+	}
+
+	// scripts can only output files in the workdir, or files of inputs
+	err = resp.ConfineFiles(d.workdir, &req)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+		return
+	}
+
+	out, err = resp.Output("")
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+	}
+
 	return
 }
+
+// run runs the script and calls the exported function, the result is
+// converted to json form of exec.Response
+func (d *Driver) run(vm *goja.Runtime, call exec.Call, input string) (_ []byte, err error) {
+	jsonObj := vm.Get("JSON").ToObject(vm)
+	parse, _ := goja.AssertFunction(jsonObj.Get("parse"))
+	stringify, _ := goja.AssertFunction(jsonObj.Get("stringify"))
+
+	arg, err := parse(jsonObj, vm.ToValue(input))
+	if err != nil {
+		return nil, fmt.Errorf("parse input: %w", err)
+	}
+
+	err = d.setupRuntime(vm, arg.ToObject(vm))
+	if err != nil {
+		return nil, fmt.Errorf("setup runtime: %w", err)
+	}
+
+	_, err = vm.RunProgram(d.prog)
+	if err != nil {
+		return nil, err
+	}
+
+	exports := vm.Get("module").ToObject(vm).Get("exports")
+	if exports == nil || goja.IsUndefined(exports) || goja.IsNull(exports) {
+		return nil, nil
+	}
+
+	fn, ok := goja.AssertFunction(exports.ToObject(vm).Get(string(call)))
+	if !ok {
+		// not handled by the script
+		return nil, nil
+	}
+
+	ret, err := fn(exports, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ret == nil, goja.IsUndefined(ret), goja.IsNull(ret):
+		return nil, nil
+	case isString(ret):
+		// returned data only
+		ret = vm.ToValue(map[string]any{"data": ret.String()})
+	}
+
+	text, err := stringify(jsonObj, ret)
+	if err != nil {
+		return nil, fmt.Errorf("stringify result: %w", err)
+	}
+
+	return []byte(text.String()), nil
+}
+
+func isString(v goja.Value) bool {
+	_, ok := v.Export().(string)
+	return ok
+}
@@ -0,0 +1,166 @@
+package js
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/rt"
+	rttest "arhat.dev/mbot/pkg/rt/test"
+)
+
+const testScript = `
+exports.new = function (input) {
+  return sprig.upper(input.cmd) + " " + input.params;
+};
+
+exports.generate = function (input) {
+  const m = findMessage(2);
+  return {
+    data: input.messages.map((m) => m.author + ": " + m.text).join("\n"),
+    messages: [{
+      id: m.id,
+      spans: m.spans.filter((s) => (s.flags || []).includes("bold")),
+    }],
+  };
+};
+
+exports.peek = function (input) {
+  return jq(".[0].text", input.messages);
+};
+
+exports.continue = function (input) {
+  if (input.params === "loop") {
+    for (;;) {}
+  }
+
+  throw new Error("bad params");
+};
+`
+
+func TestDriver(t *testing.T) {
+	impl, err := (&Config{Script: testScript, Timeout: time.Second}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+	in := &rt.GeneratorInput{
+		Cmd:    "/new",
+		Params: "foo",
+		Messages: []*rt.Message{
+			{ID: 1, Author: "alice", Text: "hi", Spans: []rt.Span{{Text: "hi"}}},
+			{ID: 2, Author: "bob", Text: "hello world", Spans: []rt.Span{
+				{Flags: rt.SpanFlag_Bold, Text: "hello"},
+				{Text: " world"},
+			}},
+		},
+	}
+
+	out, err := impl.New(con, in)
+	assert.NoError(t, err)
+	assert.Equal(t, "/NEW foo", out.Data.Get())
+
+	out, err = impl.Generate(con, in)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice: hi\nbob: hello world", out.Data.Get())
+		if assert.Len(t, out.Messages, 1) {
+			assert.Equal(t, rt.MessageID(2), out.Messages[0].ID)
+			assert.Equal(t, "hello", out.Messages[0].Text)
+			assert.Equal(t, []rt.Span{{Flags: rt.SpanFlag_Bold, Text: "hello"}}, out.Messages[0].Spans)
+		}
+	}
+
+	out, err = impl.Peek(con, in)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", out.Data.Get())
+
+	_, err = impl.Continue(con, in)
+	assert.ErrorContains(t, err, "bad params")
+
+	in.Params = "loop"
+	_, err = impl.Continue(con, in)
+	assert.ErrorContains(t, err, "timed out")
+
+	// no exported function
+	impl, err = (&Config{Script: `var x = 1;`}).Create()
+	if assert.NoError(t, err) {
+		out, err = impl.Generate(con, in)
+		assert.NoError(t, err)
+		assert.True(t, out.Data.IsNil())
+	}
+
+	_, err = (&Config{Script: `exports.new = function (`}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{}).Create()
+	assert.Error(t, err)
+}
+
+func TestDriverMediaFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "out.txt"), []byte("hello"), 0600))
+
+	impl, err := (&Config{
+		Script: `exports.generate = function (input) {
+  return { messages: [{ id: 1, spans: [{ flags: ["file"], file: input.params }] }] };
+};`,
+		WorkDir: dir,
+	}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+
+	out, err := impl.Generate(con, &rt.GeneratorInput{Params: "out.txt"})
+	if assert.NoError(t, err) && assert.Len(t, out.Messages, 1) {
+		defer out.Messages[0].Dispose()
+
+		if assert.Len(t, out.Messages[0].Spans, 1) {
+			data, err := io.ReadAll(out.Messages[0].Spans[0].Data)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(data))
+		}
+	}
+
+	for _, file := range []string{"/etc/hostname", "../out.txt", "foo/../../out.txt"} {
+		_, err = impl.Generate(con, &rt.GeneratorInput{Params: file})
+		assert.ErrorContains(t, err, "not in workdir", file)
+	}
+}
+
+func TestDriverMessageIDs(t *testing.T) {
+	impl, err := (&Config{Script: `exports.generate = function (input) {
+  return {
+    messages: input.messages.map((m) => {
+      const found = findMessage(m.id);
+      return { id: found.id, replyTo: found.id, text: typeof found.id };
+    }),
+  };
+};`}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ids := []rt.MessageID{1<<53 + 1, 0x9e3779b97f4a7c15, math.MaxUint64}
+	in := &rt.GeneratorInput{}
+	for _, id := range ids {
+		in.Messages = append(in.Messages, &rt.Message{ID: id})
+	}
+
+	out, err := impl.Generate(rttest.FakeConversation(context.TODO()), in)
+	if assert.NoError(t, err) && assert.Len(t, out.Messages, len(ids)) {
+		for i, m := range out.Messages {
+			assert.Equal(t, ids[i], m.ID)
+			assert.Equal(t, ids[i], m.ReplyTo)
+			assert.Equal(t, "string", m.Text)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package js
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"arhat.dev/pkg/textquery"
+	"github.com/Masterminds/sprig/v3"
+	"github.com/dop251/goja"
+)
+
+// newFuncMap creates sprig funcs available as `sprig.<name>` in scripts
+//
+// funcs reading environment variables are not available
+func newFuncMap() map[string]any {
+	ret := map[string]any(sprig.TxtFuncMap())
+	delete(ret, "env")
+	delete(ret, "expandenv")
+
+	return ret
+}
+
+// setupRuntime sets globals available to scripts
+func (d *Driver) setupRuntime(vm *goja.Runtime, input *goja.Object) error {
+	module := vm.NewObject()
+	exports := vm.NewObject()
+	err := module.Set("exports", exports)
+	if err != nil {
+		return err
+	}
+
+	sprigObj := vm.NewObject()
+	for k, f := range d.funcs {
+		err = sprigObj.Set(k, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, v := range map[string]any{
+		"module":  module,
+		"exports": exports,
+		"sprig":   sprigObj,
+
+		"jq": func(query string, data goja.Value) (string, error) {
+			switch t := data.Export().(type) {
+			case string:
+				return textquery.JQ[byte](query, t)
+			case []byte:
+				return textquery.JQ[byte](query, t)
+			default:
+				text, err := json.Marshal(t)
+				if err != nil {
+					return "", fmt.Errorf("unexpected data %T: %w", t, err)
+				}
+
+				return textquery.JQ[byte](query, text)
+			}
+		},
+
+		// ids are strings, numbers are only accepted for small ids
+		"findMessage": func(id goja.Value) goja.Value {
+			msgs := input.Get("messages").ToObject(vm)
+			n := msgs.Get("length").ToInteger()
+			for i := int64(0); i < n; i++ {
+				m := msgs.Get(fmt.Sprint(i)).ToObject(vm)
+				if m.Get("id").String() == id.String() {
+					return m
+				}
+			}
+
+			return goja.Null()
+		},
+	} {
+		err = vm.Set(k, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
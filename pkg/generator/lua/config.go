@@ -1,8 +1,16 @@
 package lua
 
 import (
-	"arhat.dev/mbot/pkg/generator"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	"arhat.dev/rs"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"arhat.dev/mbot/pkg/generator"
 )
 
 const (
@@ -15,9 +23,116 @@ func init() {
 
 type Config struct {
 	rs.BaseField
+
+	// Script is the inline script
+	Script string `yaml:"script"`
+
+	// ScriptFile is the path to the script file, used when Script is empty
+	ScriptFile string `yaml:"scriptFile"`
+
+	// WorkDir to resolve relative media paths in script output
+	WorkDir string `yaml:"workdir"`
+
+	// Timeout of each call to the script, defaults to 10s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// CallStackSize is the max depth of lua function calls, defaults to 256
+	CallStackSize int `yaml:"callStackSize"`
+
+	// RegistryMaxSize is the max size of the data stack, defaults to 64K
+	RegistryMaxSize int `yaml:"registryMaxSize"`
+
+	// Libs are extra libraries available to the script, any of [package, io, os]
+	//
+	// base, table, string, math and coroutine libraries are always available,
+	// base functions loading files (dofile, loadfile) are removed unless io
+	// library is enabled, and loading modules (require, module) unless package
+	// library is enabled
+	Libs []string `yaml:"libs"`
 }
 
 // Create implements generator.Config
-func (*Config) Create() (generator.Interface, error) {
-	return &Driver{}, nil
+func (c *Config) Create() (generator.Interface, error) {
+	var (
+		name   = "script.lua"
+		script = c.Script
+	)
+
+	if len(script) == 0 {
+		if len(c.ScriptFile) == 0 {
+			return nil, fmt.Errorf("no script specified")
+		}
+
+		data, err := os.ReadFile(c.ScriptFile)
+		if err != nil {
+			return nil, fmt.Errorf("read script file: %w", err)
+		}
+
+		name, script = c.ScriptFile, string(data)
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(script), name)
+	if err != nil {
+		return nil, fmt.Errorf("parse script: %w", err)
+	}
+
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("compile script: %w", err)
+	}
+
+	d := &Driver{
+		proto:   proto,
+		workdir: c.WorkDir,
+		timeout: c.Timeout,
+		opts: lua.Options{
+			CallStackSize:       c.CallStackSize,
+			RegistryMaxSize:     c.RegistryMaxSize,
+			SkipOpenLibs:        true,
+			MinimizeStackMemory: true,
+		},
+		libs: []string{
+			lua.BaseLibName,
+			lua.TabLibName,
+			lua.StringLibName,
+			lua.MathLibName,
+			lua.CoroutineLibName,
+		},
+	}
+
+	if d.timeout == 0 {
+		d.timeout = 10 * time.Second
+	}
+
+	if d.opts.CallStackSize == 0 {
+		d.opts.CallStackSize = 256
+	}
+
+	if d.opts.RegistryMaxSize == 0 {
+		d.opts.RegistryMaxSize = 64 * 1024
+	}
+
+	// grow on demand
+	d.opts.RegistrySize = 1024
+	if d.opts.RegistrySize > d.opts.RegistryMaxSize {
+		d.opts.RegistrySize = d.opts.RegistryMaxSize
+	}
+
+	for _, lib := range c.Libs {
+		switch lib {
+		case lua.LoadLibName, lua.IoLibName, lua.OsLibName:
+			d.libs = append(d.libs, lib)
+		default:
+			return nil, fmt.Errorf("unsupported lib %q", lib)
+		}
+
+		switch lib {
+		case lua.IoLibName:
+			d.allowFiles = true
+		case lua.LoadLibName:
+			d.allowPackage = true
+		}
+	}
+
+	return d, nil
 }
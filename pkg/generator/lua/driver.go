@@ -1,34 +1,296 @@
 // Package lua implements a generator for lua scripting
+//
+// the script defines global functions named after generator calls (e.g.
+// `function generate(input) ... end`), lua states with the script loaded are
+// pooled per driver, and globals are reset after each call
 package lua
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
 	"arhat.dev/mbot/pkg/generator"
+	"arhat.dev/mbot/pkg/generator/exec"
 	"arhat.dev/mbot/pkg/rt"
-	lua "github.com/yuin/gopher-lua"
 )
 
 var _ generator.Interface = (*Driver)(nil)
 
 type Driver struct {
-	lua.Global
+	proto   *lua.FunctionProto
+	workdir string
+	timeout time.Duration
+
+	opts lua.Options
+	libs []string
+
+	// allowFiles keeps base functions loading files
+	allowFiles bool
+
+	// allowPackage keeps base functions loading modules
+	allowPackage bool
+
+	mu    sync.Mutex
+	saved []*state
 }
 
 // New implements generator.Interface
-func (*Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_New, in)
 }
 
 // Continue implements generator.Interface
-func (*Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Continue, in)
 }
 
 // Peek implements generator.Interface
-func (*Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Peek, in)
 }
 
 // Generate implements generator.Interface
-func (*Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+func (d *Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Generate, in)
+}
+
+var libs = map[string]lua.LGFunction{
+	lua.BaseLibName:      lua.OpenBase,
+	lua.LoadLibName:      lua.OpenPackage,
+	lua.TabLibName:       lua.OpenTable,
+	lua.IoLibName:        lua.OpenIo,
+	lua.OsLibName:        lua.OpenOs,
+	lua.StringLibName:    lua.OpenString,
+	lua.MathLibName:      lua.OpenMath,
+	lua.CoroutineLibName: lua.OpenCoroutine,
+}
+
+// state is a pooled lua state
+type state struct {
+	*lua.LState
+
+	// input of current call
+	input lua.LValue
+
+	// globals are entries of the global table and tables in it after the
+	// script loaded, restored after each call
+	globals map[*lua.LTable][]tableEntry
+}
+
+type tableEntry struct {
+	key, value lua.LValue
+}
+
+// save records entries of globals
+func (s *state) save() {
+	s.globals = make(map[*lua.LTable][]tableEntry)
+
+	g := s.G.Global
+	s.saveTable(g)
+	g.ForEach(func(_, v lua.LValue) {
+		if t, ok := v.(*lua.LTable); ok {
+			s.saveTable(t)
+		}
+	})
+}
+
+func (s *state) saveTable(t *lua.LTable) {
+	if _, ok := s.globals[t]; ok {
+		return
+	}
+
+	var entries []tableEntry
+	t.ForEach(func(k, v lua.LValue) {
+		entries = append(entries, tableEntry{key: k, value: v})
+	})
+
+	s.globals[t] = entries
+}
+
+// reset restores globals saved, including the mbot table and libraries, so
+// values set in a call are not seen by calls from other conversations
+//
+// tables nested deeper and upvalues of functions are not restored
+func (s *state) reset() {
+	for t, entries := range s.globals {
+		var keys []lua.LValue
+		t.ForEach(func(k, _ lua.LValue) { keys = append(keys, k) })
+
+		for _, k := range keys {
+			t.RawSet(k, lua.LNil)
+		}
+
+		for _, e := range entries {
+			t.RawSet(e.key, e.value)
+		}
+	}
+
+	s.input = lua.LNil
+	s.SetTop(0)
+}
+
+// newState creates a lua state with the script loaded
+func (d *Driver) newState() (*state, error) {
+	s := &state{LState: lua.NewState(d.opts), input: lua.LNil}
+
+	for _, name := range d.libs {
+		err := s.CallByParam(lua.P{
+			Fn:      s.NewFunction(libs[name]),
+			NRet:    0,
+			Protect: true,
+		}, lua.LString(name))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("open lib %q: %w", name, err)
+		}
+	}
+
+	if !d.allowFiles {
+		s.SetGlobal("dofile", lua.LNil)
+		s.SetGlobal("loadfile", lua.LNil)
+	}
+
+	if !d.allowPackage {
+		s.SetGlobal("require", lua.LNil)
+		s.SetGlobal("module", lua.LNil)
+	}
+
+	s.SetGlobal("mbot", s.newMbotTable())
+
+	s.Push(s.NewFunctionFromProto(d.proto))
+	err := s.PCall(0, lua.MultRet, nil)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("load script: %w", err)
+	}
+
+	s.save()
+	return s, nil
+}
+
+func (d *Driver) get() (*state, error) {
+	d.mu.Lock()
+	if n := len(d.saved); n != 0 {
+		s := d.saved[n-1]
+		d.saved = d.saved[:n-1]
+		d.mu.Unlock()
+		return s, nil
+	}
+	d.mu.Unlock()
+
+	return d.newState()
+}
+
+func (d *Driver) put(s *state) {
+	s.reset()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.saved = append(d.saved, s)
+}
+
+func (d *Driver) call(con rt.Conversation, call exec.Call, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	s, err := d.get()
+	if err != nil {
+		return
+	}
+
+	fn, ok := s.GetGlobal(string(call)).(*lua.LFunction)
+	if !ok {
+		// not handled by the script
+		d.put(s)
+		return
+	}
+
+	// scripts see inputs in the same form as exec generators
+	req := exec.Request{
+		Version:  exec.ProtocolVersion,
+		Call:     call,
+		Cmd:      in.Cmd,
+		Params:   in.Params,
+		Messages: make([]exec.Message, len(in.Messages)),
+	}
+
+	for i, m := range in.Messages {
+		req.Messages[i] = exec.NewMessage(m)
+	}
+
+	// message ids are strings, lua numbers can't hold all of them
+	input, err := exec.EncodeScriptRequest(&req)
+	if err == nil {
+		s.input, err = toLValue(s.LState, input)
+	}
+
+	if err != nil {
+		d.put(s)
+		err = fmt.Errorf("%s: convert input: %w", call, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(con.Context(), d.timeout)
+	defer cancel()
+
+	s.SetContext(ctx)
+	err = s.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}, s.input)
+	s.RemoveContext()
+
+	if err != nil {
+		// the state can be left in the middle of the call
+		s.Close()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%s: timed out after %v", call, d.timeout)
+		} else {
+			err = fmt.Errorf("%s: %w", call, err)
+		}
+
+		return
+	}
+
+	var data []byte
+	switch ret := s.Get(-1); ret.Type() {
+	case lua.LTNil:
+	case lua.LTString:
+		// returned data only
+		data, err = json.Marshal(map[string]string{"data": ret.String()})
+	default:
+		data, err = json.Marshal(fromLValue(ret))
+	}
+	d.put(s)
+
+	if err != nil {
+		err = fmt.Errorf("%s: encode result: %w", call, err)
+		return
+	}
+
+	resp, err := exec.DecodeScriptResponse(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+		return
+	}
+
+	// scripts can only output files in the workdir, or files of inputs
+	err = resp.ConfineFiles(d.workdir, &req)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+		return
+	}
+
+	out, err = resp.Output("")
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+	}
+
 	return
 }
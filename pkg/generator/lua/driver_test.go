@@ -0,0 +1,228 @@
+package lua
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+
+	"arhat.dev/mbot/pkg/rt"
+	rttest "arhat.dev/mbot/pkg/rt/test"
+)
+
+const testScript = `
+calls = 0
+
+function new(input)
+  calls = calls + 1
+  return string.upper(input.cmd) .. " " .. input.params .. " " .. calls
+end
+
+function generate(input)
+  local lines = {}
+  for _, m in ipairs(input.messages) do
+    table.insert(lines, m.author .. ": " .. m.text)
+  end
+
+  local m = mbot.findMessage(2)
+  return {
+    data = table.concat(lines, "\n"),
+    messages = {
+      { id = m.id, spans = { mbot.span("hello", "bold"), mbot.span(" world") } },
+    },
+  }
+end
+
+function peek(input)
+  return mbot.jq(".[0].text", input.messages)
+end
+
+function continue(input)
+  if input.params == "loop" then
+    while true do end
+  end
+
+  if input.params == "io" then
+    return tostring(io == nil and dofile == nil and require == nil and package == nil)
+  end
+
+  error("bad params")
+end
+`
+
+func TestDriver(t *testing.T) {
+	impl, err := (&Config{Script: testScript, Timeout: time.Second}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+	in := &rt.GeneratorInput{
+		Cmd:    "/new",
+		Params: "foo",
+		Messages: []*rt.Message{
+			{ID: 1, Author: "alice", Text: "hi"},
+			{ID: 2, Author: "bob", Text: "hello world"},
+		},
+	}
+
+	for i := 1; i <= 2; i++ {
+		out, err := impl.New(con, in)
+		assert.NoError(t, err)
+		// globals are not kept between calls
+		assert.Equal(t, "/NEW foo 1", out.Data.Get())
+	}
+
+	out, err := impl.Generate(con, in)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice: hi\nbob: hello world", out.Data.Get())
+		if assert.Len(t, out.Messages, 1) {
+			assert.Equal(t, rt.MessageID(2), out.Messages[0].ID)
+			assert.Equal(t, "hello world", out.Messages[0].Text)
+			assert.Equal(t, []rt.Span{
+				{Flags: rt.SpanFlag_Bold, Text: "hello"},
+				{Text: " world"},
+			}, out.Messages[0].Spans)
+		}
+	}
+
+	out, err = impl.Peek(con, in)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", out.Data.Get())
+
+	in.Params = "io"
+	out, err = impl.Continue(con, in)
+	assert.NoError(t, err)
+	assert.Equal(t, "true", out.Data.Get())
+
+	in.Params = "bad"
+	_, err = impl.Continue(con, in)
+	assert.ErrorContains(t, err, "bad params")
+
+	in.Params = "loop"
+	_, err = impl.Continue(con, in)
+	assert.ErrorContains(t, err, "timed out")
+
+	impl, err = (&Config{
+		Script: `function generate() return tostring(io ~= nil and os ~= nil and require ~= nil) end`,
+		Libs:   []string{"io", "os", "package"},
+	}).Create()
+	if assert.NoError(t, err) {
+		out, err = impl.Generate(con, in)
+		assert.NoError(t, err)
+		assert.Equal(t, "true", out.Data.Get())
+
+		// not defined by the script
+		out, err = impl.Peek(con, in)
+		assert.NoError(t, err)
+		assert.True(t, out.Data.IsNil())
+	}
+
+	_, err = (&Config{Script: `function generate(`}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{Script: `x = 1`, Libs: []string{"debug"}}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{}).Create()
+	assert.Error(t, err)
+}
+
+func TestDriverMediaFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "out.txt"), []byte("hello"), 0600))
+
+	impl, err := (&Config{
+		Script: `function generate(input)
+  return { messages = {{ id = 1, spans = {{ flags = { "file" }, file = input.params }} }} }
+end`,
+		WorkDir: dir,
+	}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+
+	out, err := impl.Generate(con, &rt.GeneratorInput{Params: "out.txt"})
+	if assert.NoError(t, err) && assert.Len(t, out.Messages, 1) {
+		defer out.Messages[0].Dispose()
+
+		if assert.Len(t, out.Messages[0].Spans, 1) {
+			data, err := io.ReadAll(out.Messages[0].Spans[0].Data)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(data))
+		}
+	}
+
+	for _, file := range []string{"/etc/hostname", "../out.txt", "foo/../../out.txt"} {
+		_, err = impl.Generate(con, &rt.GeneratorInput{Params: file})
+		assert.ErrorContains(t, err, "not in workdir", file)
+	}
+}
+
+func TestDriverStateReset(t *testing.T) {
+	impl, err := (&Config{Script: `
+local loads = 0
+loads = loads + 1
+
+function generate(input)
+  local leaked = tostring(foo) .. " " .. tostring(string.foo) .. " " .. tostring(mbot.foo)
+  foo, string.foo, mbot.foo = 1, 1, 1
+  mbot.span = nil
+  return leaked .. " " .. loads
+end
+`}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+	for i := 0; i < 2; i++ {
+		out, err := impl.Generate(con, &rt.GeneratorInput{})
+		assert.NoError(t, err)
+		// the script is loaded once in the pooled state
+		assert.Equal(t, "nil nil nil 1", out.Data.Get())
+	}
+
+	d := impl.(*Driver)
+	if assert.Len(t, d.saved, 1) {
+		assert.NotEqual(t, lua.LNil, d.saved[0].GetField(d.saved[0].GetGlobal("mbot"), "span"))
+	}
+}
+
+func TestDriverMessageIDs(t *testing.T) {
+	impl, err := (&Config{Script: `function generate(input)
+  local msgs = {}
+  for _, m in ipairs(input.messages) do
+    local found = mbot.findMessage(m.id)
+    table.insert(msgs, { id = found.id, replyTo = found.id, text = type(found.id) })
+  end
+
+  return { messages = msgs }
+end`}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ids := []rt.MessageID{1<<53 + 1, 0x9e3779b97f4a7c15, math.MaxUint64}
+	in := &rt.GeneratorInput{}
+	for _, id := range ids {
+		in.Messages = append(in.Messages, &rt.Message{ID: id})
+	}
+
+	out, err := impl.Generate(rttest.FakeConversation(context.TODO()), in)
+	if assert.NoError(t, err) && assert.Len(t, out.Messages, len(ids)) {
+		for i, m := range out.Messages {
+			assert.Equal(t, ids[i], m.ID)
+			assert.Equal(t, ids[i], m.ReplyTo)
+			assert.Equal(t, "string", m.Text)
+		}
+	}
+}
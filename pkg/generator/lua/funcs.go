@@ -0,0 +1,81 @@
+package lua
+
+import (
+	"encoding/json"
+
+	"arhat.dev/pkg/textquery"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// newMbotTable creates the `mbot` table with helper functions
+func (s *state) newMbotTable() *lua.LTable {
+	return s.SetFuncs(s.NewTable(), map[string]lua.LGFunction{
+		// span(text, flags...) creates a span
+		"span": func(L *lua.LState) int {
+			span := L.NewTable()
+			span.RawSetString("text", lua.LString(L.CheckString(1)))
+
+			if top := L.GetTop(); top > 1 {
+				flags := L.CreateTable(top-1, 0)
+				for i := 2; i <= top; i++ {
+					flags.Append(lua.LString(L.CheckString(i)))
+				}
+
+				span.RawSetString("flags", flags)
+			}
+
+			L.Push(span)
+			return 1
+		},
+
+		// jq(query, data) runs jq query on json string or table
+		"jq": func(L *lua.LState) int {
+			var (
+				query = L.CheckString(1)
+				data  string
+			)
+
+			switch v := L.CheckAny(2); v.Type() {
+			case lua.LTString:
+				data = v.String()
+			default:
+				text, err := json.Marshal(fromLValue(v))
+				if err != nil {
+					L.RaiseError("encode data: %v", err)
+					return 0
+				}
+
+				data = string(text)
+			}
+
+			ret, err := textquery.JQ[byte](query, data)
+			if err != nil {
+				L.RaiseError("jq: %v", err)
+				return 0
+			}
+
+			L.Push(lua.LString(ret))
+			return 1
+		},
+
+		// findMessage(id) finds message in input messages by id, ids are
+		// strings, numbers are only accepted for small ids
+		"findMessage": func(L *lua.LState) int {
+			id := L.CheckAny(1).String()
+
+			msgs, ok := L.GetField(s.input, "messages").(*lua.LTable)
+			if ok {
+				for i := 1; i <= msgs.Len(); i++ {
+					m := msgs.RawGetInt(i)
+					if L.GetField(m, "id").String() == id {
+						L.Push(m)
+						return 1
+					}
+				}
+			}
+
+			L.Push(lua.LNil)
+			return 1
+		},
+	})
+}
@@ -0,0 +1,99 @@
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxTableDepth limits depth of nested tables converted by fromLValue
+const maxTableDepth = 64
+
+// toLValue converts json data to lua value
+func toLValue(L *lua.LState, data []byte) (lua.LValue, error) {
+	var obj any
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return lua.LNil, err
+	}
+
+	return jsonToLValue(L, obj), nil
+}
+
+func jsonToLValue(L *lua.LState, v any) lua.LValue {
+	switch t := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(t)
+	case float64:
+		return lua.LNumber(t)
+	case string:
+		return lua.LString(t)
+	case []any:
+		tbl := L.CreateTable(len(t), 0)
+		for _, elem := range t {
+			tbl.Append(jsonToLValue(L, elem))
+		}
+
+		return tbl
+	case map[string]any:
+		tbl := L.CreateTable(0, len(t))
+		for k, elem := range t {
+			tbl.RawSetString(k, jsonToLValue(L, elem))
+		}
+
+		return tbl
+	default:
+		return lua.LNil
+	}
+}
+
+// fromLValue converts lua value to the value can be encoded as json
+//
+// tables with only sequential keys from 1 are converted to arrays, empty
+// tables are converted to nil
+func fromLValue(v lua.LValue) any {
+	return fromLValueDepth(v, 0)
+}
+
+func fromLValueDepth(v lua.LValue, depth int) any {
+	switch t := v.(type) {
+	case lua.LBool:
+		return bool(t)
+	case lua.LNumber:
+		return float64(t)
+	case lua.LString:
+		return string(t)
+	case *lua.LTable:
+		if depth >= maxTableDepth {
+			return nil
+		}
+
+		n, count := t.MaxN(), 0
+		t.ForEach(func(lua.LValue, lua.LValue) { count++ })
+
+		switch {
+		case count == 0:
+			return nil
+		case n == count:
+			ret := make([]any, n)
+			for i := range ret {
+				ret[i] = fromLValueDepth(t.RawGetInt(i+1), depth+1)
+			}
+
+			return ret
+		default:
+			ret := make(map[string]any, count)
+			t.ForEach(func(k, elem lua.LValue) {
+				ret[fmt.Sprint(k)] = fromLValueDepth(elem, depth+1)
+			})
+
+			return ret
+		}
+	default:
+		// nil, functions, userdata, etc.
+		return nil
+	}
+}
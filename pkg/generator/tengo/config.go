@@ -1,8 +1,16 @@
 package tengo
 
 import (
-	"arhat.dev/mbot/pkg/generator"
+	"fmt"
+	"os"
+	"time"
+
 	"arhat.dev/rs"
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+
+	"arhat.dev/mbot/pkg/generator"
+	"arhat.dev/mbot/pkg/generator/exec"
 )
 
 const (
@@ -15,9 +23,105 @@ func init() {
 
 type Config struct {
 	rs.BaseField
+
+	// Script is the inline script
+	Script string `yaml:"script"`
+
+	// ScriptFile is the path to the script file, used when Script is empty
+	ScriptFile string `yaml:"scriptFile"`
+
+	// WorkDir to resolve relative media paths in script output
+	WorkDir string `yaml:"workdir"`
+
+	// Modules the script can import, any of [mbot, json] and tengo stdlib
+	// modules except os
+	Modules []string `yaml:"modules"`
+
+	// Timeout of each run, defaults to 10s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxAllocs is the max number of objects allocated in each run, defaults
+	// to unlimited
+	MaxAllocs int64 `yaml:"maxAllocs"`
+
+	// Calls the script runs for, one of [new, continue, peek, generate]
+	//
+	// defaults to all calls
+	Calls []string `yaml:"calls"`
 }
 
 // Create implements generator.Config
-func (*Config) Create() (generator.Interface, error) {
-	return &Driver{}, nil
+func (c *Config) Create() (generator.Interface, error) {
+	script := []byte(c.Script)
+	if len(script) == 0 {
+		if len(c.ScriptFile) == 0 {
+			return nil, fmt.Errorf("no script specified")
+		}
+
+		var err error
+		script, err = os.ReadFile(c.ScriptFile)
+		if err != nil {
+			return nil, fmt.Errorf("read script file: %w", err)
+		}
+	}
+
+	s := tengo.NewScript(script)
+
+	modules := tengo.NewModuleMap()
+	for _, name := range c.Modules {
+		if attrs, ok := builtinModules[name]; ok {
+			modules.AddBuiltinModule(name, attrs)
+			continue
+		}
+
+		if !isStdlibModule(name) {
+			return nil, fmt.Errorf("unknown module %q", name)
+		}
+
+		modules.AddMap(stdlib.GetModuleMap(name))
+	}
+	s.SetImports(modules)
+
+	if c.MaxAllocs > 0 {
+		s.SetMaxAllocs(c.MaxAllocs)
+	}
+
+	for _, name := range []string{
+		varCall, varCmd, varParams, varMessages, varData,
+	} {
+		// values are set for each run
+		err := s.Add(name, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	compiled, err := s.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("compile script: %w", err)
+	}
+
+	d := &Driver{
+		compiled: compiled,
+		workdir:  c.WorkDir,
+		timeout:  c.Timeout,
+	}
+
+	if d.timeout == 0 {
+		d.timeout = 10 * time.Second
+	}
+
+	if len(c.Calls) != 0 {
+		d.calls = make(map[exec.Call]struct{}, len(c.Calls))
+		for _, call := range c.Calls {
+			switch v := exec.Call(call); v {
+			case exec.Call_New, exec.Call_Continue, exec.Call_Peek, exec.Call_Generate:
+				d.calls[v] = struct{}{}
+			default:
+				return nil, fmt.Errorf("unknown call %q", call)
+			}
+		}
+	}
+
+	return d, nil
 }
@@ -1,34 +1,211 @@
 // Package tengo implements a generator for tengo scripting
+//
+// the script is compiled once, and run with a clone of the compiled script
+// for each call, inputs are set as global variables, and outputs are read
+// from global variables after the run
 package tengo
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/d5/tengo/v2"
+
 	"arhat.dev/mbot/pkg/generator"
+	"arhat.dev/mbot/pkg/generator/exec"
 	"arhat.dev/mbot/pkg/rt"
-	"github.com/d5/tengo/v2"
+)
+
+// global variables of the script
+const (
+	// inputs
+	varCall   = "call"
+	varCmd    = "cmd"
+	varParams = "params"
+
+	// input and output
+	varMessages = "messages"
+
+	// output
+	varData = "data"
 )
 
 var _ generator.Interface = (*Driver)(nil)
 
 type Driver struct {
-	tengo.VM
+	compiled *tengo.Compiled
+	workdir  string
+	timeout  time.Duration
+
+	// calls the script runs for, nil for all calls
+	calls map[exec.Call]struct{}
 }
 
 // New implements generator.Interface
-func (*Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.run(con, exec.Call_New, in)
 }
 
 // Continue implements generator.Interface
-func (*Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.run(con, exec.Call_Continue, in)
 }
 
 // Peek implements generator.Interface
-func (*Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
-	return
+func (d *Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.run(con, exec.Call_Peek, in)
 }
 
 // Generate implements generator.Interface
-func (*Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+func (d *Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.run(con, exec.Call_Generate, in)
+}
+
+func (d *Driver) run(con rt.Conversation, call exec.Call, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	if d.calls != nil {
+		if _, ok := d.calls[call]; !ok {
+			return
+		}
+	}
+
+	// scripts see messages in the same form as exec generators
+	msgs := make([]exec.Message, len(in.Messages))
+	for i, m := range in.Messages {
+		msgs[i] = exec.NewMessage(m)
+	}
+
+	// message ids are strings, tengo ints can't hold all of them
+	msgsObj, err := toMessagesObject(msgs)
+	if err != nil {
+		err = fmt.Errorf("%s: convert messages: %w", call, err)
+		return
+	}
+
+	c := d.compiled.Clone()
+	for k, v := range map[string]any{
+		varCall:     string(call),
+		varCmd:      in.Cmd,
+		varParams:   in.Params,
+		varMessages: msgsObj,
+		varData:     nil,
+	} {
+		err = c.Set(k, v)
+		if err != nil {
+			err = fmt.Errorf("%s: set %q: %w", call, k, err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(con.Context(), d.timeout)
+	defer cancel()
+
+	err = c.RunContext(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%s: timed out after %v", call, d.timeout)
+		} else {
+			err = fmt.Errorf("%s: %w", call, err)
+		}
+
+		return
+	}
+
+	var result struct {
+		Data     *string `json:"data,omitempty"`
+		Messages any     `json:"messages,omitempty"`
+	}
+
+	switch v := c.Get(varData).Object().(type) {
+	case *tengo.Undefined:
+	case *tengo.String:
+		result.Data = &v.Value
+	default:
+		err = fmt.Errorf("%s: unexpected non string data %s", call, v.TypeName())
+		return
+	}
+
+	// messages are only output when reassigned
+	if v := c.Get(varMessages).Object(); v != msgsObj {
+		result.Messages = tengo.ToInterface(v)
+	}
+
+	data, err := json.Marshal(&result)
+	if err != nil {
+		err = fmt.Errorf("%s: encode output: %w", call, err)
+		return
+	}
+
+	resp, err := exec.DecodeScriptResponse(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+		return
+	}
+
+	// scripts can only output files in the workdir, or files of inputs
+	err = resp.ConfineFiles(d.workdir, &exec.Request{Messages: msgs})
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+		return
+	}
+
+	out, err = resp.Output("")
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+	}
+
 	return
 }
+
+// toMessagesObject converts messages to tengo object in the form for scripts
+func toMessagesObject(msgs []exec.Message) (tengo.Object, error) {
+	data, err := exec.EncodeScriptRequest(&exec.Request{Messages: msgs})
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := toObjectFromJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.(*tengo.Map).Value[varMessages], nil
+}
+
+func toObjectFromJSON(data []byte) (tengo.Object, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var obj any
+	err := dec.Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return tengo.FromInterface(convertNumbers(obj))
+}
+
+func convertNumbers(v any) any {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+
+		f, _ := t.Float64()
+		return f
+	case []any:
+		for i := range t {
+			t[i] = convertNumbers(t[i])
+		}
+	case map[string]any:
+		for k := range t {
+			t[k] = convertNumbers(t[k])
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,200 @@
+package tengo
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/rt"
+	rttest "arhat.dev/mbot/pkg/rt/test"
+)
+
+const testScript = `
+mbot := import("mbot")
+json := import("json")
+text := import("text")
+
+if call == "new" {
+	data = text.to_upper(cmd) + " " + params
+	messages[0].text = "modified in place"
+} else if call == "generate" {
+	lines := []
+	for m in messages {
+		lines = append(lines, m.author + ": " + m.text)
+	}
+
+	data = json.encode(lines)
+	messages = [{
+		id: messages[1].id,
+		spans: [mbot.span("hello", "bold"), mbot.span(" world")]
+	}]
+} else if call == "peek" {
+	data = mbot.jq(".[0].text", messages)
+} else if params == "loop" {
+	for {}
+} else if params == "number" {
+	data = json.decode("{\"a\": 1}").a
+}
+`
+
+func TestDriver(t *testing.T) {
+	impl, err := (&Config{
+		Script:  testScript,
+		Modules: []string{"mbot", "json", "text"},
+		Timeout: time.Second,
+	}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+	in := &rt.GeneratorInput{
+		Cmd:    "/new",
+		Params: "foo",
+		Messages: []*rt.Message{
+			{ID: 1, Author: "alice", Text: "hi"},
+			{ID: 2, Author: "bob", Text: "hello world"},
+		},
+	}
+
+	out, err := impl.New(con, in)
+	assert.NoError(t, err)
+	assert.Equal(t, "/NEW foo", out.Data.Get())
+	// messages not reassigned
+	assert.Len(t, out.Messages, 0)
+
+	out, err = impl.Generate(con, in)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `["alice: hi","bob: hello world"]`, out.Data.Get())
+		if assert.Len(t, out.Messages, 1) {
+			assert.Equal(t, rt.MessageID(2), out.Messages[0].ID)
+			assert.Equal(t, "hello world", out.Messages[0].Text)
+			assert.Equal(t, []rt.Span{
+				{Flags: rt.SpanFlag_Bold, Text: "hello"},
+				{Text: " world"},
+			}, out.Messages[0].Spans)
+		}
+	}
+
+	out, err = impl.Peek(con, in)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", out.Data.Get())
+
+	in.Params = "number"
+	_, err = impl.Continue(con, in)
+	assert.ErrorContains(t, err, "non string data int")
+
+	in.Params = "loop"
+	_, err = impl.Continue(con, in)
+	assert.ErrorContains(t, err, "timed out")
+
+	// nothing generated
+	in.Params = ""
+	out, err = impl.Continue(con, in)
+	assert.NoError(t, err)
+	assert.True(t, out.Data.IsNil())
+	assert.Len(t, out.Messages, 0)
+
+	impl, err = (&Config{Script: `data = call`, Calls: []string{"peek"}}).Create()
+	if assert.NoError(t, err) {
+		out, err = impl.Peek(con, in)
+		assert.NoError(t, err)
+		assert.Equal(t, "peek", out.Data.Get())
+
+		out, err = impl.Generate(con, in)
+		assert.NoError(t, err)
+		assert.True(t, out.Data.IsNil())
+	}
+
+	// stdlib modules
+	impl, err = (&Config{
+		Script:  `fmt := import("fmt"); times := import("times"); data = fmt.sprintf("%d", times.second)`,
+		Modules: []string{"fmt", "times"},
+	}).Create()
+	if assert.NoError(t, err) {
+		out, err = impl.Generate(con, in)
+		assert.NoError(t, err)
+		assert.Equal(t, "1000000000", out.Data.Get())
+	}
+
+	// modules not allowed
+	_, err = (&Config{Script: `json := import("json")`}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{Script: `os := import("os")`, Modules: []string{"os"}}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{Script: `data = 1`, Calls: []string{"foo"}}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{Script: `data = (`}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{}).Create()
+	assert.Error(t, err)
+}
+
+func TestDriverMediaFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "out.txt"), []byte("hello"), 0600))
+
+	impl, err := (&Config{
+		Script:  `messages = [{id: 1, spans: [{flags: ["file"], file: params}]}]`,
+		WorkDir: dir,
+	}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+
+	out, err := impl.Generate(con, &rt.GeneratorInput{Params: "out.txt"})
+	if assert.NoError(t, err) && assert.Len(t, out.Messages, 1) {
+		defer out.Messages[0].Dispose()
+
+		if assert.Len(t, out.Messages[0].Spans, 1) {
+			data, err := io.ReadAll(out.Messages[0].Spans[0].Data)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(data))
+		}
+	}
+
+	for _, file := range []string{"/etc/hostname", "../out.txt", "foo/../../out.txt"} {
+		_, err = impl.Generate(con, &rt.GeneratorInput{Params: file})
+		assert.ErrorContains(t, err, "not in workdir", file)
+	}
+}
+
+func TestDriverMessageIDs(t *testing.T) {
+	impl, err := (&Config{Script: `
+msgs := []
+for m in messages {
+	msgs = append(msgs, {id: m.id, replyTo: m.id, text: type_name(m.id)})
+}
+messages = msgs
+`}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ids := []rt.MessageID{1<<53 + 1, 0x9e3779b97f4a7c15, math.MaxUint64}
+	in := &rt.GeneratorInput{}
+	for _, id := range ids {
+		in.Messages = append(in.Messages, &rt.Message{ID: id})
+	}
+
+	out, err := impl.Generate(rttest.FakeConversation(context.TODO()), in)
+	if assert.NoError(t, err) && assert.Len(t, out.Messages, len(ids)) {
+		for i, m := range out.Messages {
+			assert.Equal(t, ids[i], m.ID)
+			assert.Equal(t, ids[i], m.ReplyTo)
+			assert.Equal(t, "string", m.Text)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package tengo
+
+import (
+	"encoding/json"
+
+	"arhat.dev/pkg/textquery"
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+)
+
+// builtinModules are modules can be allowed in config
+var builtinModules = map[string]map[string]tengo.Object{
+	"mbot": {
+		// span(text, flags...) creates a span
+		"span": &tengo.UserFunction{
+			Name: "span",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				if len(args) == 0 {
+					return nil, tengo.ErrWrongNumArguments
+				}
+
+				span := map[string]tengo.Object{}
+				for i, arg := range args {
+					s, ok := tengo.ToString(arg)
+					if !ok {
+						return nil, tengo.ErrInvalidArgumentType{
+							Name:     argName(i),
+							Expected: "string",
+							Found:    arg.TypeName(),
+						}
+					}
+
+					if i == 0 {
+						span["text"] = &tengo.String{Value: s}
+						continue
+					}
+
+					flags, _ := span["flags"].(*tengo.Array)
+					if flags == nil {
+						flags = &tengo.Array{}
+						span["flags"] = flags
+					}
+
+					flags.Value = append(flags.Value, &tengo.String{Value: s})
+				}
+
+				return &tengo.Map{Value: span}, nil
+			},
+		},
+
+		// jq(query, data) runs jq query on json string or object
+		"jq": &tengo.UserFunction{
+			Name: "jq",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				if len(args) != 2 {
+					return nil, tengo.ErrWrongNumArguments
+				}
+
+				query, ok := tengo.ToString(args[0])
+				if !ok {
+					return nil, tengo.ErrInvalidArgumentType{
+						Name:     "first",
+						Expected: "string",
+						Found:    args[0].TypeName(),
+					}
+				}
+
+				var data string
+				switch v := args[1].(type) {
+				case *tengo.String:
+					data = v.Value
+				default:
+					text, err := json.Marshal(tengo.ToInterface(v))
+					if err != nil {
+						return nil, err
+					}
+
+					data = string(text)
+				}
+
+				ret, err := textquery.JQ[byte](query, data)
+				if err != nil {
+					return &tengo.Error{Value: &tengo.String{Value: err.Error()}}, nil
+				}
+
+				return &tengo.String{Value: ret}, nil
+			},
+		},
+	},
+
+	"json": {
+		// encode(v) encodes v as json string
+		"encode": &tengo.UserFunction{
+			Name: "encode",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				if len(args) != 1 {
+					return nil, tengo.ErrWrongNumArguments
+				}
+
+				data, err := json.Marshal(tengo.ToInterface(args[0]))
+				if err != nil {
+					return &tengo.Error{Value: &tengo.String{Value: err.Error()}}, nil
+				}
+
+				return &tengo.String{Value: string(data)}, nil
+			},
+		},
+
+		// decode(s) decodes json string
+		"decode": &tengo.UserFunction{
+			Name: "decode",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				if len(args) != 1 {
+					return nil, tengo.ErrWrongNumArguments
+				}
+
+				s, ok := tengo.ToString(args[0])
+				if !ok {
+					return nil, tengo.ErrInvalidArgumentType{
+						Name:     "first",
+						Expected: "string",
+						Found:    args[0].TypeName(),
+					}
+				}
+
+				ret, err := toObjectFromJSON([]byte(s))
+				if err != nil {
+					return &tengo.Error{Value: &tengo.String{Value: err.Error()}}, nil
+				}
+
+				return ret, nil
+			},
+		},
+	},
+}
+
+// isStdlibModule checks whether the tengo stdlib module can be allowed in
+// config, os module is excluded as it can access files and processes
+func isStdlibModule(name string) bool {
+	if name == "os" {
+		return false
+	}
+
+	for _, n := range stdlib.AllModuleNames() {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func argName(i int) string {
+	switch i {
+	case 0:
+		return "first"
+	case 1:
+		return "second"
+	case 2:
+		return "third"
+	default:
+		return "variadic"
+	}
+}
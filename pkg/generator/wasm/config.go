@@ -0,0 +1,164 @@
+package wasm
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"arhat.dev/rs"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"arhat.dev/mbot/pkg/generator"
+	"arhat.dev/mbot/pkg/generator/exec"
+)
+
+const (
+	Name = "wasm"
+)
+
+// maxMemoryLimitPages is the max number of memory pages of a wasm module
+const maxMemoryLimitPages = 65536
+
+func init() {
+	generator.Register(Name, func() generator.Config { return &Config{} })
+}
+
+type Config struct {
+	rs.BaseField
+
+	// Module is the path to the wasm module file
+	Module string `yaml:"module"`
+
+	// Dir is mounted read-only as the root dir of the module, media files in
+	// module output are resolved in this dir
+	//
+	// input media files are mounted at /.media in the module, the module has
+	// no other filesystem access when not set
+	Dir string `yaml:"dir"`
+
+	// Env of the module
+	Env map[string]string `yaml:"env"`
+
+	// Timeout of each call, defaults to 10s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MemoryLimitPages is the max number of 64KiB memory pages of the module,
+	// defaults to 256 (16MiB)
+	MemoryLimitPages uint32 `yaml:"memoryLimitPages"`
+
+	// Calls handled by the module, one of [new, continue, peek, generate]
+	//
+	// defaults to all calls exported by the module
+	Calls []string `yaml:"calls"`
+}
+
+// Create implements generator.Config
+func (c *Config) Create() (_ generator.Interface, err error) {
+	if len(c.Module) == 0 {
+		return nil, fmt.Errorf("no module specified")
+	}
+
+	bin, err := os.ReadFile(c.Module)
+	if err != nil {
+		return nil, fmt.Errorf("read module file: %w", err)
+	}
+
+	pages := c.MemoryLimitPages
+	if pages == 0 {
+		pages = 256
+	}
+
+	if pages > maxMemoryLimitPages {
+		return nil, fmt.Errorf("memory limit pages %d exceeds %d", pages, maxMemoryLimitPages)
+	}
+
+	modCfg := wazero.NewModuleConfig().
+		// anonymous module can be instantiated for each call
+		WithName("").
+		// wasi reactors are initialized by `_initialize`, `_start` of wasi
+		// commands exits the module after main
+		WithStartFunctions("_initialize").
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader)
+
+	fsCfg := wazero.NewFSConfig()
+	if len(c.Dir) != 0 {
+		info, err := os.Stat(c.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("check dir: %w", err)
+		}
+
+		if !info.IsDir() {
+			return nil, fmt.Errorf("dir %q is not a directory", c.Dir)
+		}
+
+		// os.DirFS rejects paths escaping the dir, dir mounts of wazero don't
+		fsCfg = fsCfg.WithFSMount(os.DirFS(c.Dir), "/")
+		modCfg = modCfg.WithFSConfig(fsCfg)
+	}
+
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		modCfg = modCfg.WithEnv(k, c.Env[k])
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pages).
+		WithCloseOnContextDone(true),
+	)
+	defer func() {
+		if err != nil {
+			_ = runtime.Close(ctx)
+		}
+	}()
+
+	_, err = wasi_snapshot_preview1.Instantiate(ctx, runtime)
+	if err != nil {
+		return nil, fmt.Errorf("instantiate wasi: %w", err)
+	}
+
+	compiled, err := runtime.CompileModule(ctx, bin)
+	if err != nil {
+		return nil, fmt.Errorf("compile module: %w", err)
+	}
+
+	d := &Driver{
+		runtime:  runtime,
+		compiled: compiled,
+		config:   modCfg,
+		fsConfig: fsCfg,
+		dir:      c.Dir,
+		timeout:  c.Timeout,
+		logger:   log.Log.WithName(Name),
+	}
+
+	if d.timeout == 0 {
+		d.timeout = 10 * time.Second
+	}
+
+	if len(c.Calls) != 0 {
+		d.calls = make(map[exec.Call]struct{}, len(c.Calls))
+		for _, call := range c.Calls {
+			switch v := exec.Call(call); v {
+			case exec.Call_New, exec.Call_Continue, exec.Call_Peek, exec.Call_Generate:
+				d.calls[v] = struct{}{}
+			default:
+				return nil, fmt.Errorf("unknown call %q", call)
+			}
+		}
+	}
+
+	return d, nil
+}
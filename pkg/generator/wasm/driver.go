@@ -0,0 +1,242 @@
+// Package wasm implements a generator running WebAssembly modules
+//
+// the module is instantiated in a sandbox for each call, with exec.Request
+// written to its stdin as json, then the function exported with the name of
+// the call is called, and exec.Response is read from its stdout
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"arhat.dev/pkg/log"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+
+	"arhat.dev/mbot/pkg/generator"
+	"arhat.dev/mbot/pkg/generator/exec"
+	"arhat.dev/mbot/pkg/rt"
+)
+
+var _ generator.Interface = (*Driver)(nil)
+
+type Driver struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	config   wazero.ModuleConfig
+	fsConfig wazero.FSConfig
+
+	dir     string
+	timeout time.Duration
+
+	// calls handled by the module, nil for all calls
+	calls map[exec.Call]struct{}
+
+	logger log.Interface
+}
+
+// New implements generator.Interface
+func (d *Driver) New(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_New, in)
+}
+
+// Continue implements generator.Interface
+func (d *Driver) Continue(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Continue, in)
+}
+
+// Peek implements generator.Interface
+func (d *Driver) Peek(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Peek, in)
+}
+
+// Generate implements generator.Interface
+func (d *Driver) Generate(con rt.Conversation, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	return d.call(con, exec.Call_Generate, in)
+}
+
+func (d *Driver) call(con rt.Conversation, call exec.Call, in *rt.GeneratorInput) (out rt.GeneratorOutput, err error) {
+	if d.calls != nil {
+		if _, ok := d.calls[call]; !ok {
+			return
+		}
+	}
+
+	if _, ok := d.compiled.ExportedFunctions()[string(call)]; !ok {
+		return
+	}
+
+	req := exec.Request{
+		Version:  exec.ProtocolVersion,
+		Call:     call,
+		Cmd:      in.Cmd,
+		Params:   in.Params,
+		Messages: make([]exec.Message, len(in.Messages)),
+	}
+
+	// cache files are mounted by their index in the request
+	media := make(mediaFS)
+	for i, m := range in.Messages {
+		req.Messages[i] = exec.NewMessage(m)
+
+		_ = walkSpans(req.Messages[i].Spans, func(s *exec.Span) error {
+			if len(s.File) == 0 {
+				return nil
+			}
+
+			name := strconv.Itoa(len(media))
+			media[name] = s.File
+			s.File = path.Join(mediaDir, name)
+			return nil
+		})
+	}
+
+	config := d.config
+	if len(media) != 0 {
+		config = config.WithFSConfig(d.fsConfig.WithFSMount(media, mediaDir))
+	}
+
+	input, err := json.Marshal(&req)
+	if err != nil {
+		err = fmt.Errorf("encode request: %w", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(con.Context(), d.timeout)
+	defer cancel()
+
+	var (
+		stdout bytes.Buffer
+		stderr = exec.NewLineWriter(func(line string) {
+			d.logger.I("module stderr", log.String("call", string(call)), log.String("line", line))
+		})
+	)
+
+	err = d.run(ctx, call, config.
+		WithStdin(bytes.NewReader(input)).
+		WithStdout(&stdout).
+		WithStderr(stderr),
+	)
+	stderr.Flush()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%s: timed out after %v", call, d.timeout)
+		} else {
+			err = fmt.Errorf("%s: %w", call, err)
+		}
+
+		return
+	}
+
+	var resp exec.Response
+	data := bytes.TrimSpace(stdout.Bytes())
+	if len(data) != 0 {
+		err = json.Unmarshal(data, &resp)
+		if err != nil {
+			err = fmt.Errorf("%s: invalid response: %w", call, err)
+			return
+		}
+	}
+
+	err = d.resolveMediaFiles(&resp, media)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+		return
+	}
+
+	out, err = resp.Output(d.dir)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", call, err)
+	}
+
+	return
+}
+
+// run instantiates the module and calls the function exported for the call
+func (d *Driver) run(ctx context.Context, call exec.Call, config wazero.ModuleConfig) error {
+	mod, err := d.runtime.InstantiateModule(ctx, d.compiled, config)
+	if err != nil {
+		return fmt.Errorf("instantiate module: %w", err)
+	}
+	defer func() { _ = mod.Close(context.Background()) }()
+
+	_, err = mod.ExportedFunction(string(call)).Call(ctx)
+	if err != nil {
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// resolveMediaFiles converts paths of media files in the module to paths
+// in the mounted dir, or cache files of input media
+func (d *Driver) resolveMediaFiles(resp *exec.Response, media mediaFS) error {
+	for i := range resp.Messages {
+		err := walkSpans(resp.Messages[i].Spans, func(s *exec.Span) error {
+			if len(s.File) == 0 {
+				return nil
+			}
+
+			// paths are always in the mounted dirs
+			file := path.Clean("/" + s.File)
+			if strings.HasPrefix(file, mediaDir+"/") {
+				cacheFile, ok := media[file[len(mediaDir)+1:]]
+				if !ok {
+					return fmt.Errorf("media file %q: not found", s.File)
+				}
+
+				s.File = cacheFile
+				return nil
+			}
+
+			if len(d.dir) == 0 {
+				return fmt.Errorf("media file %q: no dir mounted", s.File)
+			}
+
+			s.File = filepath.Join(d.dir, filepath.FromSlash(file))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range resp.Other {
+		err := d.resolveMediaFiles(&resp.Other[i], media)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkSpans calls do with spans and their captions
+func walkSpans(spans []exec.Span, do func(s *exec.Span) error) error {
+	for i := range spans {
+		err := do(&spans[i])
+		if err != nil {
+			return err
+		}
+
+		err = walkSpans(spans[i].Caption, do)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package wasm
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"arhat.dev/mbot/pkg/generator/exec"
+	"arhat.dev/mbot/pkg/rt"
+	rttest "arhat.dev/mbot/pkg/rt/test"
+)
+
+// testModule is built from testdata/plugin.wat
+const testModule = "testdata/plugin.wasm"
+
+// cacheFile is an input media file
+type cacheFile struct {
+	*os.File
+}
+
+func (f cacheFile) ID() rt.CacheID { return 0 }
+
+func (f cacheFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func TestDriver(t *testing.T) {
+	dir := t.TempDir()
+	if !assert.NoError(t, os.WriteFile(filepath.Join(dir, "media.txt"), []byte("foo"), 0644)) {
+		return
+	}
+
+	impl, err := (&Config{Module: testModule, Dir: dir, Timeout: time.Second}).Create()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(dir, "media.txt"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	con := rttest.FakeConversation(context.TODO())
+	in := &rt.GeneratorInput{
+		Cmd:    "/new",
+		Params: "foo",
+		Messages: []*rt.Message{
+			{ID: 1, Author: "alice", Text: "hi", Spans: []rt.Span{{Text: "hi"}, {Flags: rt.SpanFlag_File}}},
+			{ID: 2, Author: "bob", Text: "hello world"},
+		},
+	}
+	in.Messages[0].Spans[1].Data = cacheFile{File: f}
+	defer in.Messages[0].Dispose()
+
+	// request echoed as response
+	out, err := impl.New(con, in)
+	if assert.NoError(t, err) && assert.Len(t, out.Messages, 2) {
+		defer out.Messages[0].Dispose()
+
+		assert.True(t, out.Data.IsNil())
+		assert.Equal(t, rt.MessageID(1), out.Messages[0].ID)
+		assert.Equal(t, "alice", out.Messages[0].Author)
+		assert.Equal(t, "hello world", out.Messages[1].Text)
+
+		if assert.Len(t, out.Messages[0].Spans, 2) {
+			assert.Equal(t, rt.Span{Text: "hi"}, out.Messages[0].Spans[0])
+
+			// input media mounted in the module
+			data, err := io.ReadAll(out.Messages[0].Spans[1].Data)
+			assert.NoError(t, err)
+			assert.Equal(t, "foo", string(data))
+		}
+	}
+
+	out, err = impl.Generate(con, in)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello", out.Data.Get())
+		if assert.Len(t, out.Messages, 1) && assert.Len(t, out.Messages[0].Spans, 1) {
+			span := out.Messages[0].Spans[0]
+			assert.Equal(t, rt.SpanFlag_File, span.Flags)
+			assert.Equal(t, "media.txt", span.Filename)
+			assert.EqualValues(t, 3, span.Size)
+			out.Messages[0].Dispose()
+		}
+	}
+
+	_, err = impl.Peek(con, in)
+	assert.ErrorContains(t, err, "timed out")
+
+	// memory limit exceeded
+	_, err = impl.Continue(con, in)
+	assert.ErrorContains(t, err, "unreachable")
+
+	impl, err = (&Config{Module: testModule, MemoryLimitPages: 2048, Calls: []string{"continue", "generate"}}).Create()
+	if assert.NoError(t, err) {
+		out, err = impl.Continue(con, in)
+		assert.NoError(t, err)
+		assert.True(t, out.Data.IsNil())
+
+		// no dir for media files
+		_, err = impl.Generate(con, in)
+		assert.ErrorContains(t, err, "no dir mounted")
+
+		out, err = impl.Peek(con, in)
+		assert.NoError(t, err)
+		assert.True(t, out.Data.IsNil())
+	}
+
+	_, err = (&Config{Module: testModule, Calls: []string{"foo"}}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{Module: testModule, Dir: filepath.Join(dir, "media.txt")}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{Module: "testdata/plugin.wat"}).Create()
+	assert.Error(t, err)
+
+	_, err = (&Config{}).Create()
+	assert.Error(t, err)
+}
+
+func TestResolveMediaFiles(t *testing.T) {
+	d := &Driver{dir: "/data"}
+	media := mediaFS{"0": "/cache/1"}
+	resp := &exec.Response{
+		Messages: []exec.Message{{Spans: []exec.Span{
+			{File: "../../etc/passwd"},
+			{Caption: []exec.Span{{File: "a/b.png"}}},
+			{File: "/.media/../.media/0"},
+		}}},
+		Other: []exec.Response{{Messages: []exec.Message{{Spans: []exec.Span{{File: "/c.png"}}}}}},
+	}
+
+	assert.NoError(t, d.resolveMediaFiles(resp, media))
+	assert.Equal(t, "/data/etc/passwd", resp.Messages[0].Spans[0].File)
+	assert.Equal(t, "", resp.Messages[0].Spans[1].File)
+	assert.Equal(t, "/data/a/b.png", resp.Messages[0].Spans[1].Caption[0].File)
+	assert.Equal(t, "/cache/1", resp.Messages[0].Spans[2].File)
+	assert.Equal(t, "/data/c.png", resp.Other[0].Messages[0].Spans[0].File)
+
+	resp = &exec.Response{Messages: []exec.Message{{Spans: []exec.Span{{File: "/.media/1"}}}}}
+	assert.ErrorContains(t, d.resolveMediaFiles(resp, media), "not found")
+}
+
+func TestMediaFS(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+
+	media := mediaFS{"0": filepath.Join(dir, "a"), "1": filepath.Join(dir, "b")}
+	assert.NoError(t, fstest.TestFS(media, "0", "1"))
+
+	for _, name := range []string{"2", "../a", "/a"} {
+		_, err := media.Open(name)
+		assert.Error(t, err, name)
+	}
+}
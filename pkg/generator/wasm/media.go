@@ -0,0 +1,135 @@
+package wasm
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+// mediaDir is where input media files are mounted in the module
+const mediaDir = "/.media"
+
+var _ fs.FS = (mediaFS)(nil)
+
+// mediaFS is a flat read-only dir of input media files, by names in the
+// module to paths of cache files
+type mediaFS map[string]string
+
+// Open implements fs.FS
+func (m mediaFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return &mediaDirFile{fs: m}, nil
+	}
+
+	file, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return mediaFile{File: f, name: name}, nil
+}
+
+// mediaFile is the cache file with the name in the module
+type mediaFile struct {
+	*os.File
+
+	name string
+}
+
+// Stat implements fs.File
+func (f mediaFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return mediaFileInfo{FileInfo: info, name: f.name}, nil
+}
+
+var _ fs.ReadDirFile = (*mediaDirFile)(nil)
+
+// mediaDirFile is the root dir of mediaFS
+type mediaDirFile struct {
+	fs mediaFS
+
+	// entries not read, nil before the first read
+	entries []fs.DirEntry
+}
+
+// Stat implements fs.File
+func (f *mediaDirFile) Stat() (fs.FileInfo, error) { return mediaDirInfo{}, nil }
+
+// Read implements fs.File
+func (f *mediaDirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+
+// Close implements fs.File
+func (f *mediaDirFile) Close() error { return nil }
+
+// ReadDir implements fs.ReadDirFile
+func (f *mediaDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.entries == nil {
+		names := make([]string, 0, len(f.fs))
+		for name := range f.fs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		f.entries = make([]fs.DirEntry, 0, len(names))
+		for _, name := range names {
+			info, err := os.Stat(f.fs[name])
+			if err != nil {
+				return nil, err
+			}
+
+			f.entries = append(f.entries, fs.FileInfoToDirEntry(mediaFileInfo{FileInfo: info, name: name}))
+		}
+	}
+
+	if n <= 0 || n >= len(f.entries) {
+		ret := f.entries
+		f.entries = f.entries[len(f.entries):]
+
+		if n > 0 && len(ret) == 0 {
+			return nil, io.EOF
+		}
+
+		return ret, nil
+	}
+
+	ret := f.entries[:n]
+	f.entries = f.entries[n:]
+	return ret, nil
+}
+
+// mediaFileInfo is the info of the cache file with the name in the module
+type mediaFileInfo struct {
+	fs.FileInfo
+
+	name string
+}
+
+func (i mediaFileInfo) Name() string { return i.name }
+
+// mediaDirInfo is the info of the root dir of mediaFS
+type mediaDirInfo struct{}
+
+func (mediaDirInfo) Name() string       { return "." }
+func (mediaDirInfo) Size() int64        { return 0 }
+func (mediaDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (mediaDirInfo) ModTime() time.Time { return time.Time{} }
+func (mediaDirInfo) IsDir() bool        { return true }
+func (mediaDirInfo) Sys() any           { return nil }
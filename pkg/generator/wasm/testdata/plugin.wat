@@ -0,0 +1,39 @@
+;; source of plugin.wasm
+(module
+  (import "wasi_snapshot_preview1" "fd_read"
+    (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write"
+    (func $fd_write (param i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  ;; iovec at 0, size read/written at 8, buffer at 1024
+  (data (i32.const 512) "{\"data\":\"hello\",\"messages\":[{\"spans\":[{\"flags\":[\"file\"],\"file\":\"/media.txt\"}]}]}")
+
+  ;; echo the request as response
+  (func (export "new")
+    (local $n i32)
+    (loop $copy
+      (i32.store (i32.const 0) (i32.const 1024))
+      (i32.store (i32.const 4) (i32.const 60000))
+      (drop (call $fd_read (i32.const 0) (i32.const 0) (i32.const 1) (i32.const 8)))
+      (br_if 1 (i32.eqz (local.tee $n (i32.load (i32.const 8)))))
+      (i32.store (i32.const 4) (local.get $n))
+      (drop (call $fd_write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))
+      (br $copy)))
+
+  ;; write the response in data segment
+  (func (export "generate")
+    (i32.store (i32.const 0) (i32.const 512))
+    (i32.store (i32.const 4) (i32.const 80))
+    (drop (call $fd_write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8))))
+
+  ;; never returns
+  (func (export "peek")
+    (loop $forever (br $forever)))
+
+  ;; allocates 64MiB
+  (func (export "continue")
+    (if (i32.eq (memory.grow (i32.const 1024)) (i32.const -1))
+      (then unreachable)))
+)
@@ -6,7 +6,10 @@ import (
 	"arhat.dev/mbot/pkg/rt"
 )
 
-var _ publisher.Interface = (*Driver)(nil)
+var (
+	_ publisher.Interface = (*Driver)(nil)
+	_ publisher.Stateful  = (*Driver)(nil)
+)
 
 type Driver struct {
 	publisher.Interface
@@ -17,3 +20,22 @@ func (*Driver) RequireLogin(con rt.Conversation, cmd, params string, user publis
 	// nop
 	return
 }
+
+// SaveState implements publisher.Stateful, state of the actual publisher is
+// saved if any
+func (d *Driver) SaveState() ([]byte, error) {
+	if sp, ok := d.Interface.(publisher.Stateful); ok {
+		return sp.SaveState()
+	}
+
+	return nil, nil
+}
+
+// RestoreState implements publisher.Stateful
+func (d *Driver) RestoreState(data []byte) error {
+	if sp, ok := d.Interface.(publisher.Stateful); ok {
+		return sp.RestoreState(data)
+	}
+
+	return nil
+}
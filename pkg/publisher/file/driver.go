@@ -13,7 +13,10 @@ import (
 	"arhat.dev/mbot/pkg/rt"
 )
 
-var _ publisher.Interface = (*Driver)(nil)
+var (
+	_ publisher.Interface = (*Driver)(nil)
+	_ publisher.Stateful  = (*Driver)(nil)
+)
 
 type Driver struct {
 	dir string
@@ -148,3 +151,15 @@ func (d *Driver) Delete(con rt.Conversation, cmd, params string) (out rt.Publish
 func normalizeFilename(title string) string {
 	return title
 }
+
+// SaveState implements publisher.Stateful, the state is the current filename
+func (d *Driver) SaveState() ([]byte, error) {
+	filename, _ := d.currentFilename.Load().(string)
+	return []byte(filename), nil
+}
+
+// RestoreState implements publisher.Stateful
+func (d *Driver) RestoreState(data []byte) error {
+	d.currentFilename.Store(string(data))
+	return nil
+}
@@ -3,12 +3,18 @@
 package multipub
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"arhat.dev/mbot/pkg/publisher"
 	"arhat.dev/mbot/pkg/rt"
 	"go.uber.org/multierr"
 )
 
-var _ publisher.Interface = (*Driver)(nil)
+var (
+	_ publisher.Interface = (*Driver)(nil)
+	_ publisher.Stateful  = (*Driver)(nil)
+)
 
 type Driver struct {
 	underlay []pair
@@ -90,3 +96,51 @@ func (d *Driver) Retrieve(con rt.Conversation, cmd, params string) (out rt.Publi
 		return p.impl.Retrieve(con, cmd, params)
 	})
 }
+
+// SaveState implements publisher.Stateful, states of underlay publishers are
+// saved in order, null for stateless ones
+func (d *Driver) SaveState() ([]byte, error) {
+	states := make([][]byte, len(d.underlay))
+	for i := range d.underlay {
+		sp, ok := d.underlay[i].impl.(publisher.Stateful)
+		if !ok {
+			continue
+		}
+
+		state, err := sp.SaveState()
+		if err != nil {
+			return nil, err
+		}
+
+		states[i] = state
+	}
+
+	return json.Marshal(states)
+}
+
+// RestoreState implements publisher.Stateful
+func (d *Driver) RestoreState(data []byte) error {
+	var states [][]byte
+	err := json.Unmarshal(data, &states)
+	if err != nil {
+		return err
+	}
+
+	if len(states) != len(d.underlay) {
+		return fmt.Errorf("unexpected number of states %d, want %d", len(states), len(d.underlay))
+	}
+
+	for i := range d.underlay {
+		sp, ok := d.underlay[i].impl.(publisher.Stateful)
+		if !ok || states[i] == nil {
+			continue
+		}
+
+		err = sp.RestoreState(states[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package telegraph
 
 import (
+	"encoding/json"
 	"fmt"
 	urlpkg "net/url"
 	"strings"
@@ -15,7 +16,10 @@ const (
 	Name = "telegraph"
 )
 
-var _ publisher.Interface = (*Driver)(nil)
+var (
+	_ publisher.Interface = (*Driver)(nil)
+	_ publisher.Stateful  = (*Driver)(nil)
+)
 
 type Driver struct {
 	client client
@@ -435,3 +439,32 @@ func (d *Driver) Delete(con rt.Conversation, cmd, params string) (out rt.Publish
 
 	return
 }
+
+// driverState is the saved state of Driver
+type driverState struct {
+	Account telegraphAccount `json:"account"`
+	Page    telegraphPage    `json:"page"`
+}
+
+// SaveState implements publisher.Stateful
+func (d *Driver) SaveState() ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return json.Marshal(&driverState{Account: d.account, Page: d.page})
+}
+
+// RestoreState implements publisher.Stateful
+func (d *Driver) RestoreState(data []byte) error {
+	var state driverState
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.account, d.page = state.Account, state.Page
+	return nil
+}
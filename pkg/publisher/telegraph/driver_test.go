@@ -0,0 +1,37 @@
+package telegraph
+
+import (
+	"testing"
+
+	"arhat.dev/mbot/pkg/rt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDriverState(t *testing.T) {
+	d := &Driver{
+		account: telegraphAccount{ShortName: "foo", AccessToken: "token"},
+		page: telegraphPage{
+			Path:    "foo-01-01",
+			Title:   "foo",
+			Content: []telegraphNode{{Text: "bar"}},
+		},
+	}
+	d.page.Content = append(d.page.Content, telegraphNode{
+		Elm: rt.NewOptionalValue(telegraphNodeElement{
+			Tag:      "p",
+			Children: []telegraphNode{{Text: "baz"}},
+		}),
+	})
+
+	data, err := d.SaveState()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	restored := &Driver{}
+	assert.NoError(t, restored.RestoreState(data))
+	assert.Equal(t, d.account, restored.account)
+	assert.EqualValues(t, d.page, restored.page)
+
+	assert.Error(t, restored.RestoreState([]byte("invalid")))
+}
@@ -65,6 +65,17 @@ type Interface interface {
 	Delete(con rt.Conversation, cmd, params string) (out rt.PublisherOutput, err error)
 }
 
+// Stateful is implemented by publishers keeping state of the session (e.g. the
+// logged in account and the post), the state is saved to restore the session
+// after restart
+type Stateful interface {
+	// SaveState returns current state of the publisher
+	SaveState() ([]byte, error)
+
+	// RestoreState restores the state returned by SaveState
+	RestoreState(data []byte) error
+}
+
 type User interface {
 	// NextCredential returns next expected user credential
 	NextCredential() rt.LoginFlow
@@ -15,11 +15,13 @@ const (
 	MessageFlag_Private MessageFlag = 1 << iota
 	MessageFlag_Forwarded
 	MessageFlag_Reply
+	MessageFlag_Album
 )
 
 func (f MessageFlag) IsPrivate() bool   { return f&MessageFlag_Private != 0 }
 func (f MessageFlag) IsForwarded() bool { return f&MessageFlag_Forwarded != 0 }
 func (f MessageFlag) IsReply() bool     { return f&MessageFlag_Reply != 0 }
+func (f MessageFlag) IsAlbum() bool     { return f&MessageFlag_Album != 0 }
 
 // Message defines a message
 type Message struct {
@@ -60,6 +62,14 @@ type Message struct {
 	// Text of all text spans
 	Text string
 
+	// EditTimestamp when the message was last edited, zero if never edited
+	EditTimestamp time.Time
+
+	// Edits are previous versions of the message, oldest first
+	//
+	// only kept when the workflow keeps edit history
+	Edits []MessageEdit
+
 	workers int32
 
 	wait <-chan struct{}
@@ -68,6 +78,33 @@ type Message struct {
 func (m *Message) IsForwarded() bool { return m.Flags.IsForwarded() }
 func (m *Message) IsPrivate() bool   { return m.Flags.IsPrivate() }
 func (m *Message) IsReply() bool     { return m.Flags.IsReply() }
+func (m *Message) IsAlbum() bool     { return m.Flags.IsAlbum() }
+func (m *Message) IsEdited() bool    { return !m.EditTimestamp.IsZero() }
+
+// MessageEdit is a previous version of an edited message
+type MessageEdit struct {
+	// Timestamp when this version was sent or edited
+	Timestamp time.Time
+
+	Spans []Span
+
+	// Text of all text spans
+	Text string
+}
+
+// Version returns current version of the message as MessageEdit
+func (m *Message) Version() MessageEdit {
+	ts := m.EditTimestamp
+	if ts.IsZero() {
+		ts = m.Timestamp
+	}
+
+	return MessageEdit{
+		Timestamp: ts,
+		Spans:     m.Spans,
+		Text:      m.Text,
+	}
+}
 
 // Ready returns true if the message is ready for content generation
 func (m *Message) Ready() bool {
@@ -91,11 +128,18 @@ func (m *Message) Wait(until <-chan struct{}, cancelBgJobAfterUntil bool) (jobFi
 
 // Dispose this message
 //
-// - close cache file (if any)
+// - close cache file (if any), including ones of previous versions
 func (m *Message) Dispose() {
-	for i := range m.Spans {
-		if m.Spans[i].Data != nil {
-			_ = m.Spans[i].Data.Close()
+	disposeSpans(m.Spans)
+	for i := range m.Edits {
+		disposeSpans(m.Edits[i].Spans)
+	}
+}
+
+func disposeSpans(spans []Span) {
+	for i := range spans {
+		if spans[i].Data != nil {
+			_ = spans[i].Data.Close()
 		}
 	}
 }
@@ -39,12 +39,36 @@ type Chat interface {
 	ID() rt.ChatID
 }
 
+// TopicChat is implemented by chats with topics (e.g. telegram forum), sessions
+// in different topics of the same chat are independent
+type TopicChat interface {
+	Chat
+
+	// TopicID returns id of the topic, 0 for the chat itself
+	TopicID() rt.MessageID
+}
+
+// sessionKey is the key of active sessions
+type sessionKey struct {
+	chatID  rt.ChatID
+	topicID rt.MessageID
+}
+
+func keyOf[C Chat](chat C) sessionKey {
+	key := sessionKey{chatID: chat.ID()}
+	if tc, ok := any(chat).(TopicChat); ok {
+		key.topicID = tc.TopicID()
+	}
+
+	return key
+}
+
 type Manager[C Chat] struct {
 	// key: user_id
 	// value: request
 	pendingRequests *sync.Map
 
-	// key: chat_id
+	// key: sessionKey
 	// value: Session
 	activeSessions *sync.Map
 
@@ -157,8 +181,8 @@ func (c *Manager[C]) MarkSessionStandby(
 
 			Data: data,
 
-			Params:    params,
-			IsNew: isDiscuss,
+			Params: params,
+			IsNew:  isDiscuss,
 		},
 	)
 	if !loaded {
@@ -192,8 +216,20 @@ func (c *Manager[C]) MarkRequestExpectingInput(
 	return reqVal.(Request).SetMessageIDShouldReplyTo(shouldReplyToMsgID)
 }
 
+// GetActiveSession returns the active session of the chat, excluding ones in
+// topics of the chat
 func (c *Manager[C]) GetActiveSession(chatID rt.ChatID) (ret *Session, ok bool) {
-	sVal, ok := c.activeSessions.Load(chatID)
+	return c.getActiveSession(sessionKey{chatID: chatID})
+}
+
+// ActiveSessionOf returns the active session of the chat, or the topic when the
+// chat is a TopicChat
+func (c *Manager[C]) ActiveSessionOf(chat C) (ret *Session, ok bool) {
+	return c.getActiveSession(keyOf(chat))
+}
+
+func (c *Manager[C]) getActiveSession(key sessionKey) (ret *Session, ok bool) {
+	sVal, ok := c.activeSessions.Load(key)
 	if !ok {
 		return
 	}
@@ -202,6 +238,41 @@ func (c *Manager[C]) GetActiveSession(chatID rt.ChatID) (ret *Session, ok bool)
 	return
 }
 
+// RangeActiveSessions calls fn for each active session until fn returns false,
+// sessions in topics of the same chat share the same chatID
+func (c *Manager[C]) RangeActiveSessions(fn func(chatID rt.ChatID, s *Session) bool) {
+	c.activeSessions.Range(func(key, value any) bool {
+		return fn(key.(sessionKey).chatID, value.(*Session))
+	})
+}
+
+// RangeActiveTopicSessions is like RangeActiveSessions, with topic ids of
+// sessions, the topic id is 0 for sessions not in topics
+func (c *Manager[C]) RangeActiveTopicSessions(fn func(chatID rt.ChatID, topicID rt.MessageID, s *Session) bool) {
+	c.activeSessions.Range(func(key, value any) bool {
+		k := key.(sessionKey)
+		return fn(k.chatID, k.topicID, value.(*Session))
+	})
+}
+
+// RestoreSession activates a session in the chat (or the topic) without
+// request, it's used to restore sessions persisted before restart
+//
+// ok is false when there is an active session already
+func (c *Manager[C]) RestoreSession(
+	chatID rt.ChatID, topicID rt.MessageID, wf *bot.Workflow, p publisher.Interface,
+) (_ *Session, ok bool) {
+	newS := newSession(wf, p)
+	_, loaded := c.activeSessions.LoadOrStore(sessionKey{chatID: chatID, topicID: topicID}, newS)
+	if loaded {
+		return nil, false
+	}
+
+	return newS, true
+}
+
+// ActivateSession activates the standby session of the user in the chat (or
+// the topic) where it was requested
 func (c *Manager[C]) ActivateSession(
 	wf *bot.Workflow, userID rt.UserID, chatID rt.ChatID, p publisher.Interface,
 ) (_ *Session, err error) {
@@ -223,7 +294,7 @@ func (c *Manager[C]) ActivateSession(
 	}
 
 	newS := newSession(wf, p)
-	sVal, loaded := c.activeSessions.LoadOrStore(chatID, newS)
+	sVal, loaded := c.activeSessions.LoadOrStore(keyOf(sr.Data), newS)
 	if loaded {
 		return sVal.(*Session), fmt.Errorf("already exists")
 	}
@@ -231,8 +302,20 @@ func (c *Manager[C]) ActivateSession(
 	return newS, nil
 }
 
+// DeactivateSession ends the active session of the chat, excluding ones in
+// topics of the chat
 func (c *Manager[C]) DeactivateSession(chatID rt.ChatID) (_ *Session, ok bool) {
-	sVal, loaded := c.activeSessions.LoadAndDelete(chatID)
+	return c.deactivateSession(sessionKey{chatID: chatID})
+}
+
+// DeactivateSessionOf ends the active session of the chat, or the topic when
+// the chat is a TopicChat
+func (c *Manager[C]) DeactivateSessionOf(chat C) (_ *Session, ok bool) {
+	return c.deactivateSession(keyOf(chat))
+}
+
+func (c *Manager[C]) deactivateSession(key sessionKey) (_ *Session, ok bool) {
+	sVal, loaded := c.activeSessions.LoadAndDelete(key)
 	if loaded {
 		return sVal.(*Session), true
 	}
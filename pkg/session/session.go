@@ -1,6 +1,8 @@
 package session
 
 import (
+	"sync"
+
 	"arhat.dev/mbot/pkg/bot"
 	"arhat.dev/mbot/pkg/publisher"
 	"arhat.dev/mbot/pkg/rt"
@@ -20,18 +22,25 @@ type Session struct {
 	wf        *bot.Workflow
 	publisher publisher.Interface
 
+	// mu guards msgs, messages can be added by background jobs (e.g. albums)
+	mu   sync.Mutex
 	msgs []*rt.Message
 }
 
 func (s *Session) Workflow() *bot.Workflow           { return s.wf }
 func (s *Session) GetPublisher() publisher.Interface { return s.publisher }
-func (s *Session) RefMessages() *[]*rt.Message       { return &s.msgs }
 
 func (s *Session) AppendMessage(msg *rt.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.msgs = append(s.msgs, msg)
 }
 
 func (s *Session) DeleteMessage(msgID rt.MessageID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	// there won't be many messages
 	for i := range s.msgs {
 		if s.msgs[i].ID == msgID {
@@ -43,7 +52,38 @@ func (s *Session) DeleteMessage(msgID rt.MessageID) bool {
 	return false
 }
 
+func (s *Session) GetMessage(msgID rt.MessageID) (*rt.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.msgs {
+		if m.ID == msgID {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
+
+// ReplaceMessage replaces the message with the same id, returns the replaced one
+func (s *Session) ReplaceMessage(msg *rt.Message) (prev *rt.Message, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.msgs {
+		if s.msgs[i].ID == msg.ID {
+			prev, s.msgs[i] = s.msgs[i], msg
+			return prev, true
+		}
+	}
+
+	return nil, false
+}
+
 func (s *Session) TruncMessages(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if sz := len(s.msgs); n < sz {
 		copy(s.msgs, s.msgs[n:])
 		s.msgs = s.msgs[:sz-n]
@@ -52,4 +92,12 @@ func (s *Session) TruncMessages(n int) {
 	}
 }
 
-func (s *Session) GetMessages() []*rt.Message { return s.msgs }
+// GetMessages returns a copy of current session messages
+func (s *Session) GetMessages() []*rt.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]*rt.Message, len(s.msgs))
+	copy(ret, s.msgs)
+	return ret
+}